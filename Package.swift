@@ -6,12 +6,15 @@ let package = Package(
     platforms: [.macOS(.v13)],
     products: [
         .library(name: "IMsgCore", targets: ["IMsgCore"]),
+        .library(name: "IMsgTesting", targets: ["IMsgTesting"]),
         .executable(name: "imsg", targets: ["imsg"]),
+        .executable(name: "imsg-send-helper", targets: ["imsg-send-helper"]),
     ],
     dependencies: [
         .package(path: "../Commander-local"),
         .package(url: "https://github.com/stephencelis/SQLite.swift.git", from: "0.15.4"),
         .package(url: "https://github.com/marmelroy/PhoneNumberKit.git", from: "4.2.2"),
+        .package(url: "https://github.com/jpsim/Yams.git", from: "5.1.0"),
     ],
     targets: [
         .target(
@@ -24,16 +27,26 @@ let package = Package(
                 .linkedFramework("ScriptingBridge"),
             ]
         ),
+        .target(
+            name: "IMsgTesting",
+            dependencies: [
+                "IMsgCore",
+                .product(name: "SQLite", package: "SQLite.swift"),
+            ]
+        ),
     .executableTarget(
         name: "imsg",
         dependencies: [
             "IMsgCore",
             .product(name: "Commander", package: "Commander-local"),
+            .product(name: "SQLite", package: "SQLite.swift"),
+            .product(name: "Yams", package: "Yams"),
         ],
         exclude: [
             "Resources/Info.plist",
         ],
         linkerSettings: [
+            .linkedFramework("Contacts"),
             .unsafeFlags([
                 "-Xlinker", "-sectcreate",
                 "-Xlinker", "__TEXT",
@@ -42,10 +55,17 @@ let package = Package(
             ])
         ]
     ),
+        .executableTarget(
+            name: "imsg-send-helper",
+            linkerSettings: [
+                .linkedFramework("ScriptingBridge"),
+            ]
+        ),
         .testTarget(
             name: "IMsgCoreTests",
             dependencies: [
                 "IMsgCore",
+                "IMsgTesting",
             ]
         ),
         .testTarget(
@@ -53,6 +73,7 @@ let package = Package(
             dependencies: [
                 "imsg",
                 "IMsgCore",
+                "IMsgTesting",
             ]
         ),
     ]
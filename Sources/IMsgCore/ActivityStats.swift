@@ -0,0 +1,76 @@
+import Foundation
+
+/// Message counts for one stats interval of a message stream.
+public struct ActivitySnapshot: Sendable, Equatable {
+  public struct ChatActivity: Sendable, Equatable {
+    public let chatID: Int64
+    public let messages: Int
+    /// Messages per minute over the whole interval, rounded to two decimals.
+    public let perMinute: Double
+  }
+
+  public struct SenderActivity: Sendable, Equatable {
+    /// Sender handle, or `me` for your own messages.
+    public let sender: String
+    public let messages: Int
+  }
+
+  public let start: Date
+  public let end: Date
+  public let messages: Int
+  /// Busiest chat first.
+  public let chats: [ChatActivity]
+  /// Busiest sender first.
+  public let topSenders: [SenderActivity]
+}
+
+/// Counts messages by chat and sender until the next snapshot. `record` and `snapshot` may be
+/// called from different tasks, e.g. the watch loop and a stats timer.
+public final class ActivityTracker: @unchecked Sendable {
+  public let topSenderLimit: Int
+  private let lock = NSLock()
+  private var start: Date
+  private var chatCounts: [Int64: Int] = [:]
+  private var senderCounts: [String: Int] = [:]
+
+  public init(start: Date = Date(), topSenderLimit: Int = 5) {
+    self.start = start
+    self.topSenderLimit = topSenderLimit
+  }
+
+  public func record(_ message: Message) {
+    let sender = message.isFromMe ? "me" : message.sender
+    lock.lock()
+    defer { lock.unlock() }
+    chatCounts[message.chatID, default: 0] += 1
+    if !sender.isEmpty {
+      senderCounts[sender, default: 0] += 1
+    }
+  }
+
+  /// Counts since the previous snapshot (or `init`), then starts a new interval at `end`.
+  public func snapshot(at end: Date = Date()) -> ActivitySnapshot {
+    lock.lock()
+    let start = self.start
+    let chatCounts = self.chatCounts
+    let senderCounts = self.senderCounts
+    self.start = end
+    self.chatCounts = [:]
+    self.senderCounts = [:]
+    lock.unlock()
+
+    let minutes = max(end.timeIntervalSince(start), 1) / 60
+    // Ties go to the lower chat id and the alphabetically first sender so output is stable.
+    let chats = chatCounts.sorted { ($1.value, $0.key) < ($0.value, $1.key) }.map {
+      ActivitySnapshot.ChatActivity(
+        chatID: $0.key, messages: $0.value,
+        perMinute: (Double($0.value) / minutes * 100).rounded() / 100)
+    }
+    let senders = senderCounts.sorted { ($1.value, $0.key) < ($0.value, $1.key) }
+      .prefix(topSenderLimit)
+      .map { ActivitySnapshot.SenderActivity(sender: $0.key, messages: $0.value) }
+    return ActivitySnapshot(
+      start: start, end: end, messages: chatCounts.values.reduce(0, +), chats: chats,
+      topSenders: Array(senders))
+  }
+}
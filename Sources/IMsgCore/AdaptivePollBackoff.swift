@@ -0,0 +1,23 @@
+import Foundation
+
+/// Delay before the next fallback poll of a watch: `min` right after a poll that found
+/// something, doubling with each quiet poll until it reaches `max`. Conversations get low
+/// latency and an idle watcher wakes up rarely.
+public struct AdaptivePollBackoff: Sendable, Equatable {
+  public let min: TimeInterval
+  public let max: TimeInterval
+  public private(set) var delay: TimeInterval
+
+  public init(min: TimeInterval, max: TimeInterval) {
+    self.min = Swift.max(0.01, min)
+    self.max = Swift.max(self.min, max)
+    self.delay = self.min
+  }
+
+  /// Records the outcome of a poll and returns the delay before the next one.
+  @discardableResult
+  public mutating func record(activity: Bool) -> TimeInterval {
+    delay = activity ? min : Swift.min(max, delay * 2)
+    return delay
+  }
+}
@@ -0,0 +1,128 @@
+import Foundation
+
+/// An iMessage app/extension message (`balloon_bundle_id` set): games, Apple Pay, stickers, etc.
+public struct AppMessageInfo: Sendable, Equatable {
+  public let bundleID: String
+  public let name: String
+  public let summary: String?
+
+  public init(bundleID: String, name: String, summary: String? = nil) {
+    self.bundleID = bundleID
+    self.name = name
+    self.summary = summary
+  }
+
+  /// Best-effort human label, e.g. "GamePigeon: 8-Ball" or "Apple Pay: $20 sent".
+  public var displayText: String {
+    guard let summary, !summary.isEmpty else { return name }
+    return "\(name): \(summary)"
+  }
+}
+
+enum AppMessage {
+  private static let knownApps: [(prefix: String, name: String)] = [
+    ("com.apple.PassbookUIService.PeerPaymentMessagesExtension", "Apple Pay"),
+    ("com.apple.DigitalTouchBalloonProvider", "Digital Touch"),
+    ("com.apple.Handwriting.HandwritingProvider", "Handwriting"),
+    ("com.apple.messages.URLBalloonProvider", "Link"),
+    ("com.apple.mobileslideshow.PhotosMessagesApp", "Photos"),
+    ("com.apple.findmy", "Find My"),
+    ("com.apple.SafetyMonitorApp", "Check In"),
+    ("com.apple.Stickers", "Sticker"),
+    ("com.apple.Animoji", "Memoji"),
+    ("com.gamerdelights.gamepigeon", "GamePigeon"),
+  ]
+
+  static func info(bundleID: String, payload: Data) -> AppMessageInfo {
+    let parsed = parsePayload(payload)
+    return AppMessageInfo(
+      bundleID: bundleID,
+      name: appName(bundleID: bundleID, payloadName: parsed.name),
+      summary: parsed.summary
+    )
+  }
+
+  /// Extension balloons look like `com.apple.messages.MSMessageExtensionBalloonPlugin:TEAM:bundle`.
+  static func appName(bundleID: String, payloadName: String? = nil) -> String {
+    let extensionID = bundleID.split(separator: ":").last.map(String.init) ?? bundleID
+    for app in knownApps
+    where bundleID.hasPrefix(app.prefix) || extensionID.hasPrefix(app.prefix) {
+      return app.name
+    }
+    if let payloadName, !payloadName.isEmpty { return payloadName }
+    let generic: Set<String> = ["ext", "extension", "messagesextension", "imessage", "messages"]
+    let parts = extensionID.split(separator: ".").map(String.init)
+    if let name = parts.reversed().first(where: { !generic.contains($0.lowercased()) }),
+      parts.count > 1
+    {
+      return name
+    }
+    return "App message"
+  }
+
+  /// Reads the app name (`an`) and caption text from the NSKeyedArchiver payload_data blob.
+  static func parsePayload(_ data: Data) -> (name: String?, summary: String?) {
+    guard !data.isEmpty,
+      let unarchiver = try? NSKeyedUnarchiver(forReadingFrom: data)
+    else { return (nil, nil) }
+    unarchiver.requiresSecureCoding = false
+    unarchiver.decodingFailurePolicy = .setErrorAndReturn
+    defer { unarchiver.finishDecoding() }
+    guard
+      let root = (try? unarchiver.decodeTopLevelObject(forKey: NSKeyedArchiveRootObjectKey))
+        as? [String: Any]
+    else { return (nil, nil) }
+
+    let name = root["an"] as? String
+    let userInfo = root["userInfo"] as? [String: Any] ?? [:]
+    let captions = ["caption", "subcaption", "secondary-subcaption"]
+      .compactMap { (userInfo[$0] as? String)?.trimmingCharacters(in: .whitespacesAndNewlines) }
+      .filter { !$0.isEmpty }
+    if !captions.isEmpty {
+      return (name, captions.joined(separator: " · "))
+    }
+    let layoutText = (root["ldtext"] as? String)?.trimmingCharacters(in: .whitespacesAndNewlines)
+    return (name, layoutText?.isEmpty == false ? layoutText : nil)
+  }
+}
+
+/// Messages that carry a drawing instead of text: Digital Touch sketches, taps and heartbeats,
+/// and handwritten notes.
+public enum DrawnMessageKind: String, Sendable, CaseIterable {
+  case digitalTouch = "digital_touch"
+  case handwriting
+
+  public var label: String {
+    switch self {
+    case .digitalTouch: return "Digital Touch"
+    case .handwriting: return "Handwriting"
+    }
+  }
+
+  /// Recognizes the balloon provider, or for older messages sent as plain attachments, the
+  /// attachment's type or name.
+  public static func detect(bundleID: String?, attachments: [AttachmentMeta] = [])
+    -> DrawnMessageKind?
+  {
+    if let bundleID {
+      if bundleID.hasPrefix("com.apple.DigitalTouchBalloonProvider") { return .digitalTouch }
+      if bundleID.hasPrefix("com.apple.Handwriting") { return .handwriting }
+    }
+    for meta in attachments {
+      let names = [meta.uti, meta.transferName, meta.filename].map { $0.lowercased() }
+      if names.contains(where: { $0.contains("digitaltouch") || $0.contains("digital-touch") }) {
+        return .digitalTouch
+      }
+      if names.contains(where: { $0.contains("handwriting") }) {
+        return .handwriting
+      }
+    }
+    return nil
+  }
+
+  /// The file holding the drawing, preferring one that is on disk. nil when Messages kept the
+  /// drawing only in the message's payload data.
+  public static func assetPath(in attachments: [AttachmentMeta]) -> String? {
+    (attachments.first { !$0.missing } ?? attachments.first).map(\.originalPath)
+  }
+}
@@ -0,0 +1,114 @@
+import Foundation
+
+/// Runs the AppleScript that drives Messages one script at a time, at least `minInterval`
+/// apart, and stops trying for `cooldown` after `failureThreshold` transient failures in a row
+/// (Messages not running, Apple event timeouts; see `SendRetryPolicy.isTransient`). Messages
+/// handles overlapping Apple events badly, so concurrent sends (RPC, bridge, autoreply) used to
+/// fail at random; and once it is wedged, more scripts only pile up. While the breaker is open,
+/// runs fail at once with `IMsgError.sendBackoff`. The first run after the cooldown is a probe:
+/// it closes the breaker on success and reopens it on failure. Permanent errors, such as an
+/// invalid recipient, mean Messages answered, so they don't count toward the breaker.
+///
+/// With a `lockURL`, runs hold an exclusive `flock` on that file and keep the spacing and
+/// breaker state in it, so separate imsg processes (a `watch` hook next to `rpc`) take turns too.
+public final class AppleScriptGate: @unchecked Sendable {
+  /// Shared by every script imsg runs against Messages, across processes.
+  public static let shared = AppleScriptGate(lockURL: StateDirectory.fileURL("applescript.lock"))
+
+  private struct State: Codable {
+    var lastFinished: Date?
+    var consecutiveFailures = 0
+    var openUntil: Date?
+  }
+
+  public let minInterval: TimeInterval
+  public let failureThreshold: Int
+  public let cooldown: TimeInterval
+  public let lockURL: URL?
+  private let now: () -> Date
+  private let sleep: (TimeInterval) -> Void
+  private let lock = NSLock()
+  private var state = State()
+
+  public init(
+    minInterval: TimeInterval = 0.25,
+    failureThreshold: Int = 5,
+    cooldown: TimeInterval = 30,
+    lockURL: URL? = nil,
+    now: @escaping () -> Date = Date.init,
+    sleep: @escaping (TimeInterval) -> Void = { Thread.sleep(forTimeInterval: $0) }
+  ) {
+    self.minInterval = max(0, minInterval)
+    self.failureThreshold = max(1, failureThreshold)
+    self.cooldown = max(0, cooldown)
+    self.lockURL = lockURL
+    self.now = now
+    self.sleep = sleep
+  }
+
+  /// Waits for the previous script to finish (and `minInterval` to pass), then runs `body`.
+  public func run<T>(_ body: () throws -> T) throws -> T {
+    lock.lock()
+    defer { lock.unlock() }
+    // Without the lock file (unwritable state directory) the gate still serializes this process.
+    let fd = openLockFile()
+    if fd >= 0 {
+      flock(fd, LOCK_EX)
+      if let shared = readState(fd) { state = shared }
+    }
+    defer {
+      if fd >= 0 {
+        writeState(fd)
+        flock(fd, LOCK_UN)
+        close(fd)
+      }
+    }
+    let start = now()
+    if let openUntil = state.openUntil, start < openUntil {
+      throw IMsgError.sendBackoff(
+        failures: state.consecutiveFailures, retryAfter: openUntil.timeIntervalSince(start))
+    }
+    if let lastFinished = state.lastFinished {
+      let wait = minInterval - start.timeIntervalSince(lastFinished)
+      if wait > 0 { sleep(wait) }
+    }
+    defer { state.lastFinished = now() }
+    do {
+      let result = try body()
+      state.consecutiveFailures = 0
+      state.openUntil = nil
+      return result
+    } catch {
+      if SendRetryPolicy.isTransient(error) {
+        state.consecutiveFailures += 1
+        if state.consecutiveFailures >= failureThreshold {
+          state.openUntil = now().addingTimeInterval(cooldown)
+        }
+      } else {
+        state.consecutiveFailures = 0
+        state.openUntil = nil
+      }
+      throw error
+    }
+  }
+
+  private func openLockFile() -> Int32 {
+    guard let lockURL else { return -1 }
+    try? FileManager.default.createDirectory(
+      at: lockURL.deletingLastPathComponent(), withIntermediateDirectories: true)
+    return open(lockURL.path, O_CREAT | O_RDWR, 0o644)
+  }
+
+  private func readState(_ fd: Int32) -> State? {
+    lseek(fd, 0, SEEK_SET)
+    let data = FileHandle(fileDescriptor: fd, closeOnDealloc: false).readDataToEndOfFile()
+    guard !data.isEmpty else { return nil }
+    return try? JSONDecoder().decode(State.self, from: data)
+  }
+
+  private func writeState(_ fd: Int32) {
+    guard let data = try? JSONEncoder().encode(state) else { return }
+    ftruncate(fd, 0)
+    _ = data.withUnsafeBytes { pwrite(fd, $0.baseAddress, data.count, 0) }
+  }
+}
@@ -0,0 +1,46 @@
+import Foundation
+
+/// Timestamps in chat.db count from 2001-01-01 UTC. Databases created before macOS 10.13 store
+/// seconds; newer ones store nanoseconds, and upgraded databases can hold both, so the unit is
+/// detected per value.
+public enum AppleTime {
+  public enum Unit: Sendable, Equatable {
+    case seconds
+    case nanoseconds
+  }
+
+  /// Seconds between the Unix epoch and 2001-01-01 UTC.
+  public static let epochOffset: TimeInterval = 978_307_200
+
+  /// Raw values at or above this magnitude are nanoseconds. As seconds it would be the year
+  /// 33,000; as nanoseconds it is 16 minutes into 2001, before any Messages database existed.
+  public static let nanosecondThreshold: Double = 1_000_000_000_000
+
+  public static func unit(of raw: Double) -> Unit {
+    abs(raw) >= nanosecondThreshold ? .nanoseconds : .seconds
+  }
+
+  public static func date(fromRaw raw: Int64) -> Date {
+    date(fromRaw: Double(raw))
+  }
+
+  public static func date(fromRaw raw: Double) -> Date {
+    let seconds = unit(of: raw) == .nanoseconds ? raw / 1_000_000_000 : raw
+    return Date(timeIntervalSince1970: seconds + epochOffset)
+  }
+
+  /// The raw value for `date` in `unit`, e.g. to bind against `message.date`. Dates past what
+  /// Int64 nanoseconds can hold (before 1709, after 2293), such as `Date.distantFuture` as an
+  /// open bound, clamp to the nearest end.
+  public static func raw(from date: Date, unit: Unit = .nanoseconds) -> Int64 {
+    let seconds = date.timeIntervalSince1970 - epochOffset
+    let value: Double
+    switch unit {
+    case .seconds: value = seconds.rounded(.down)
+    case .nanoseconds: value = seconds * 1_000_000_000
+    }
+    if value >= Double(Int64.max) { return .max }
+    if value <= Double(Int64.min) { return .min }
+    return Int64(value)
+  }
+}
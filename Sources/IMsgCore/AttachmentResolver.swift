@@ -1,12 +1,25 @@
 import Foundation
 
 enum AttachmentResolver {
-  static func resolve(_ path: String) -> (resolved: String, missing: Bool) {
+  /// chat.db records attachment paths under its owner's home (`~/Library/Messages/...`, or
+  /// `/Users/<name>/Library/Messages/...`). With `messagesDirectory`, the folder holding a
+  /// chat.db that isn't the current user's (another account, a mounted disk), the part after
+  /// `Library/Messages/` is looked up there first; the recorded path is the fallback.
+  static func resolve(_ path: String, messagesDirectory: String? = nil) -> (
+    resolved: String, missing: Bool
+  ) {
     guard !path.isEmpty else { return ("", true) }
-    let expanded = (path as NSString).expandingTildeInPath
-    var isDir: ObjCBool = false
-    let exists = FileManager.default.fileExists(atPath: expanded, isDirectory: &isDir)
-    return (expanded, !(exists && !isDir.boolValue))
+    let recorded = check((path as NSString).expandingTildeInPath)
+    guard let messagesDirectory, let relative = messagesRelativePath(path) else { return recorded }
+    let local = check((messagesDirectory as NSString).appendingPathComponent(relative))
+    return local.missing ? recorded : local
+  }
+
+  /// `Attachments/ab/12/...` for a path inside a Messages folder; nil otherwise.
+  static func messagesRelativePath(_ path: String) -> String? {
+    guard let range = path.range(of: "Library/Messages/") else { return nil }
+    let relative = path[range.upperBound...]
+    return relative.isEmpty ? nil : String(relative)
   }
 
   static func displayName(filename: String, transferName: String) -> String {
@@ -14,4 +27,10 @@ enum AttachmentResolver {
     if !filename.isEmpty { return filename }
     return "(unknown)"
   }
+
+  private static func check(_ expanded: String) -> (resolved: String, missing: Bool) {
+    var isDir: ObjCBool = false
+    let exists = FileManager.default.fileExists(atPath: expanded, isDirectory: &isDir)
+    return (expanded, !(exists && !isDir.boolValue))
+  }
 }
@@ -0,0 +1,129 @@
+import AVFoundation
+import Foundation
+import ImageIO
+import UniformTypeIdentifiers
+
+/// Shrinks images and videos that are over the send limit, so Messages doesn't drop them
+/// after the AppleScript call has already returned.
+public struct AttachmentTranscoder: Sendable {
+  public let maxBytes: Int64
+  /// JPEG quality from 0 to 1 for re-encoded images.
+  public let imageQuality: Double
+  let outputDirectory: URL
+
+  public init(
+    maxBytes: Int64 = SendAttachments.maxBytes,
+    imageQuality: Double = 0.8,
+    outputDirectory: URL = FileManager.default.temporaryDirectory
+      .appendingPathComponent("imsg-transcode", isDirectory: true)
+  ) {
+    self.maxBytes = maxBytes
+    self.imageQuality = imageQuality
+    self.outputDirectory = outputDirectory
+  }
+
+  /// Returns `attachment` unchanged when it fits, otherwise a smaller copy.
+  public func fit(_ attachment: SendAttachment) async throws -> SendAttachment {
+    guard attachment.bytes > maxBytes else { return attachment }
+    let directory = outputDirectory.appendingPathComponent(UUID().uuidString, isDirectory: true)
+    try FileManager.default.createDirectory(at: directory, withIntermediateDirectories: true)
+    let source = URL(fileURLWithPath: attachment.path)
+    let base = source.deletingPathExtension().lastPathComponent
+    let output: URL
+    switch attachment.kind {
+    case .image:
+      output = directory.appendingPathComponent(base + ".jpg")
+      try transcodeImage(source, to: output)
+    case .video:
+      output = directory.appendingPathComponent(base + ".mp4")
+      try await transcodeVideo(source, to: output)
+    default:
+      throw IMsgError.invalidAttachment(
+        "\(attachment.path) is \(SendAttachments.formatBytes(attachment.bytes)); the limit is "
+          + SendAttachments.formatBytes(maxBytes))
+    }
+    let attributes = try FileManager.default.attributesOfItem(atPath: output.path)
+    let bytes = (attributes[.size] as? NSNumber)?.int64Value ?? 0
+    return SendAttachment(
+      path: output.path, bytes: bytes, kind: attachment.kind, originalPath: attachment.path)
+  }
+
+  /// Deletes the copy `fit` made for `attachment`, with its folder; does nothing for an
+  /// attachment that wasn't transcoded.
+  public static func removeOutput(_ attachment: SendAttachment) {
+    guard attachment.originalPath != nil else { return }
+    let folder = URL(fileURLWithPath: attachment.path).deletingLastPathComponent()
+    try? FileManager.default.removeItem(at: folder)
+  }
+
+  /// Re-encodes as JPEG at `imageQuality`, scaling the longest side down by a quarter per try
+  /// until the result fits.
+  func transcodeImage(_ source: URL, to output: URL) throws {
+    guard let imageSource = CGImageSourceCreateWithURL(source as CFURL, nil),
+      let properties = CGImageSourceCopyPropertiesAtIndex(imageSource, 0, nil) as? [CFString: Any]
+    else {
+      throw IMsgError.invalidAttachment("\(source.path) is not a readable image")
+    }
+    let width = (properties[kCGImagePropertyPixelWidth] as? NSNumber)?.intValue ?? 4096
+    let height = (properties[kCGImagePropertyPixelHeight] as? NSNumber)?.intValue ?? 4096
+    var maxPixelSize = max(width, height)
+    while maxPixelSize >= 320 {
+      let options: [CFString: Any] = [
+        kCGImageSourceCreateThumbnailFromImageAlways: true,
+        kCGImageSourceCreateThumbnailWithTransform: true,
+        kCGImageSourceThumbnailMaxPixelSize: maxPixelSize,
+      ]
+      guard let image = CGImageSourceCreateThumbnailAtIndex(imageSource, 0, options as CFDictionary)
+      else {
+        break
+      }
+      let data = NSMutableData()
+      guard
+        let destination = CGImageDestinationCreateWithData(
+          data, UTType.jpeg.identifier as CFString, 1, nil)
+      else {
+        break
+      }
+      let quality: [CFString: Any] = [kCGImageDestinationLossyCompressionQuality: imageQuality]
+      CGImageDestinationAddImage(destination, image, quality as CFDictionary)
+      if CGImageDestinationFinalize(destination), Int64(data.length) <= maxBytes {
+        try (data as Data).write(to: output)
+        return
+      }
+      maxPixelSize = maxPixelSize * 3 / 4
+    }
+    throw IMsgError.invalidAttachment(
+      "\(source.path) can't be shrunk under \(SendAttachments.formatBytes(maxBytes))")
+  }
+
+  /// Exports with successively smaller presets until one fits.
+  func transcodeVideo(_ source: URL, to output: URL) async throws {
+    let asset = AVURLAsset(url: source)
+    let presets = [
+      AVAssetExportPreset1920x1080, AVAssetExportPreset1280x720, AVAssetExportPreset960x540,
+      AVAssetExportPreset640x480,
+    ]
+    for preset in presets {
+      guard let session = AVAssetExportSession(asset: asset, presetName: preset) else {
+        continue
+      }
+      try? FileManager.default.removeItem(at: output)
+      session.outputURL = output
+      session.outputFileType = .mp4
+      session.shouldOptimizeForNetworkUse = true
+      await withCheckedContinuation { continuation in
+        session.exportAsynchronously { continuation.resume() }
+      }
+      guard session.status == .completed else {
+        let reason = session.error?.localizedDescription ?? "export failed"
+        throw IMsgError.invalidAttachment("\(source.path) can't be transcoded: \(reason)")
+      }
+      let attributes = try FileManager.default.attributesOfItem(atPath: output.path)
+      if ((attributes[.size] as? NSNumber)?.int64Value ?? .max) <= maxBytes {
+        return
+      }
+    }
+    throw IMsgError.invalidAttachment(
+      "\(source.path) can't be shrunk under \(SendAttachments.formatBytes(maxBytes))")
+  }
+}
@@ -0,0 +1,49 @@
+import Foundation
+
+/// When `imsg autoreply` last answered each sender in each chat, so a restart doesn't answer
+/// everyone again before `--once-per` has passed.
+public final class AutoReplyLimiter {
+  private struct Snapshot: Codable {
+    var replies: [String: Date] = [:]
+  }
+
+  public let fileURL: URL
+  private var snapshot: Snapshot
+
+  public init(fileURL: URL = StateDirectory.fileURL("autoreply.json")) throws {
+    self.fileURL = fileURL
+    if FileManager.default.fileExists(atPath: fileURL.path) {
+      let decoder = JSONDecoder()
+      decoder.dateDecodingStrategy = .iso8601
+      self.snapshot = try decoder.decode(Snapshot.self, from: Data(contentsOf: fileURL))
+    } else {
+      self.snapshot = Snapshot()
+    }
+  }
+
+  /// `sender` should already be normalized so one person's formats share a slot.
+  public func allows(chatID: Int64, sender: String, interval: TimeInterval, now: Date) -> Bool {
+    guard let last = snapshot.replies[AutoReplyLimiter.key(chatID: chatID, sender: sender)]
+    else {
+      return true
+    }
+    return now.timeIntervalSince(last) >= interval
+  }
+
+  public func record(chatID: Int64, sender: String, at date: Date) {
+    snapshot.replies[AutoReplyLimiter.key(chatID: chatID, sender: sender)] = date
+  }
+
+  public func save() throws {
+    try FileManager.default.createDirectory(
+      at: fileURL.deletingLastPathComponent(), withIntermediateDirectories: true)
+    let encoder = JSONEncoder()
+    encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+    encoder.dateEncodingStrategy = .iso8601
+    try encoder.encode(snapshot).write(to: fileURL, options: .atomic)
+  }
+
+  private static func key(chatID: Int64, sender: String) -> String {
+    "\(chatID):\(sender)"
+  }
+}
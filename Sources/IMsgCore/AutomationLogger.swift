@@ -0,0 +1,129 @@
+import Foundation
+import SQLite
+
+public enum AutomationLogLevel: Int, Sendable, Comparable, CaseIterable {
+  case off = 0
+  case error
+  case info
+  case debug
+  case trace
+
+  public init?(name: String) {
+    switch name.lowercased() {
+    case "off", "none": self = .off
+    case "error", "warn", "warning": self = .error
+    case "info": self = .info
+    case "debug": self = .debug
+    case "trace": self = .trace
+    default: return nil
+    }
+  }
+
+  public var name: String {
+    switch self {
+    case .off: return "off"
+    case .error: return "error"
+    case .info: return "info"
+    case .debug: return "debug"
+    case .trace: return "trace"
+    }
+  }
+
+  public static func < (lhs: AutomationLogLevel, rhs: AutomationLogLevel) -> Bool {
+    lhs.rawValue < rhs.rawValue
+  }
+}
+
+/// Diagnostic log for imsg, written to stderr (or a `LogFile`) so stdout stays clean. `error`
+/// reports failed commands, `info` logs timings, `debug` adds redacted AppleScript arguments
+/// and script output, `trace` adds the full script source and the command line.
+public struct AutomationLogger: Sendable {
+  public enum Format: Sendable {
+    /// `[imsg debug] message key=value`
+    case text
+    /// One JSON object per line: `{"time":…,"level":"debug","msg":…,"key":"value"}`.
+    case json
+  }
+
+  public static let disabled = AutomationLogger(level: .off)
+
+  public let level: AutomationLogLevel
+  public let format: Format
+  private let sink: @Sendable (String) -> Void
+
+  public init(
+    level: AutomationLogLevel,
+    format: Format = .text,
+    sink: @escaping @Sendable (String) -> Void = { line in
+      FileHandle.standardError.write(Data((line + "\n").utf8))
+    }
+  ) {
+    self.level = level
+    self.format = format
+    self.sink = sink
+  }
+
+  public func isEnabled(_ level: AutomationLogLevel) -> Bool {
+    level != .off && level <= self.level
+  }
+
+  /// `fields` carry context such as the command or chat id; with `.text` they follow the
+  /// message as `key=value`.
+  public func log(
+    _ level: AutomationLogLevel, _ message: @autoclosure () -> String,
+    fields: [String: String] = [:]
+  ) {
+    guard isEnabled(level) else { return }
+    sink(line(level, message(), fields: fields, at: Date()))
+  }
+
+  /// Logs "`message`: `error`" at `.error`, adding what the error knows about its cause (see
+  /// `context(of:)`) to `fields`.
+  public func log(
+    _ error: Error, _ message: @autoclosure () -> String, fields: [String: String] = [:]
+  ) {
+    guard isEnabled(.error) else { return }
+    let context = fields.merging(AutomationLogger.context(of: error)) { current, _ in current }
+    sink(line(.error, "\(message()): \(error)", fields: context, at: Date()))
+  }
+
+  /// `sql` and `sqlite_code` for a failed SQLite statement, so a log line says which query
+  /// broke; empty for other errors.
+  public static func context(of error: Error) -> [String: String] {
+    guard case .error(_, let code, let statement)? = error as? SQLite.Result else { return [:] }
+    var fields = ["sqlite_code": String(code)]
+    if let statement {
+      fields["sql"] = statement.description
+    }
+    return fields
+  }
+
+  func line(
+    _ level: AutomationLogLevel, _ message: String, fields: [String: String], at date: Date
+  ) -> String {
+    switch format {
+    case .text:
+      let context = fields.sorted { $0.key < $1.key }.map { " \($0.key)=\($0.value)" }
+      return "[imsg \(level.name)] \(message)\(context.joined())"
+    case .json:
+      var object = fields
+      object["time"] = ISO8601Parser.format(date)
+      object["level"] = level.name
+      object["msg"] = message
+      let data = try? JSONSerialization.data(
+        withJSONObject: object, options: [.sortedKeys, .withoutEscapingSlashes])
+      return data.flatMap { String(data: $0, encoding: .utf8) } ?? message
+    }
+  }
+
+  /// Keeps the first and last two characters of a handle.
+  static func redactHandle(_ value: String) -> String {
+    guard value.count > 4 else { return String(repeating: "*", count: value.count) }
+    return "\(value.prefix(2))…\(value.suffix(2))"
+  }
+
+  /// Replaces a message body with its length.
+  static func redactText(_ value: String) -> String {
+    value.isEmpty ? "(empty)" : "<\(value.count) chars>"
+  }
+}
@@ -0,0 +1,87 @@
+import Foundation
+import SQLite
+
+/// Finds the Messages database inside an iOS (Finder/iTunes) backup or a Time Machine snapshot.
+public enum BackupLocator {
+  /// SHA-1 of `HomeDomain-Library/SMS/sms.db`, the stable name of sms.db in iOS backups.
+  public static let iOSMessagesFileID = "3d0d7e5fb2ce288813306e4d4636395e047a3d28"
+
+  public static func chatDatabasePath(
+    in backupPath: String,
+    userName: String = NSUserName()
+  ) throws -> String {
+    let root = NSString(string: backupPath).expandingTildeInPath
+    let fileManager = FileManager.default
+    var isDirectory: ObjCBool = false
+    guard fileManager.fileExists(atPath: root, isDirectory: &isDirectory) else {
+      throw IMsgError.invalidBackup("\(root) does not exist")
+    }
+    guard isDirectory.boolValue else { return root }
+
+    let manifest = (root as NSString).appendingPathComponent("Manifest.db")
+    if fileManager.fileExists(atPath: manifest) {
+      return try iOSDatabasePath(root: root, manifestPath: manifest)
+    }
+    if let path = timeMachineCandidates(root: root, userName: userName).first(where: {
+      fileManager.fileExists(atPath: $0)
+    }) {
+      return path
+    }
+    throw IMsgError.invalidBackup("no Messages database found under \(root)")
+  }
+
+  static func iOSDatabasePath(root: String, manifestPath: String) throws -> String {
+    if isEncrypted(root: root) {
+      throw IMsgError.invalidBackup("\(root) is an encrypted iOS backup; decrypt it first")
+    }
+    let fileID = (try? manifestFileID(manifestPath: manifestPath)) ?? iOSMessagesFileID
+    let candidates = [
+      (root as NSString).appendingPathComponent("\(fileID.prefix(2))/\(fileID)"),
+      (root as NSString).appendingPathComponent(fileID),
+    ]
+    guard let path = candidates.first(where: { FileManager.default.fileExists(atPath: $0) }) else {
+      throw IMsgError.invalidBackup("sms.db (\(fileID)) missing from \(root)")
+    }
+    return path
+  }
+
+  static func manifestFileID(manifestPath: String) throws -> String? {
+    let uri = URL(fileURLWithPath: manifestPath).absoluteString
+    let db = try Connection(.uri(uri, parameters: [.mode(.readOnly)]), readonly: true)
+    let sql = """
+      SELECT fileID FROM Files
+      WHERE domain = 'HomeDomain' AND relativePath = 'Library/SMS/sms.db'
+      LIMIT 1
+      """
+    for row in try db.prepare(sql) {
+      return row[0] as? String
+    }
+    return nil
+  }
+
+  static func isEncrypted(root: String) -> Bool {
+    let plistPath = (root as NSString).appendingPathComponent("Manifest.plist")
+    guard let data = FileManager.default.contents(atPath: plistPath),
+      let plist = try? PropertyListSerialization.propertyList(from: data, format: nil),
+      let dict = plist as? [String: Any]
+    else { return false }
+    return dict["IsEncrypted"] as? Bool ?? false
+  }
+
+  /// Accepts a home folder, a volume root, or a snapshot folder containing volumes
+  /// (e.g. `Backups.backupdb/<Mac>/<date>/` with `Macintosh HD - Data/` inside).
+  static func timeMachineCandidates(root: String, userName: String) -> [String] {
+    let relative = "Library/Messages/chat.db"
+    let userRelative = "Users/\(userName)/\(relative)"
+    var candidates = [
+      (root as NSString).appendingPathComponent(relative),
+      (root as NSString).appendingPathComponent(userRelative),
+    ]
+    let volumes = (try? FileManager.default.contentsOfDirectory(atPath: root)) ?? []
+    for volume in volumes.sorted() where !volume.hasPrefix(".") {
+      let volumePath = (root as NSString).appendingPathComponent(volume)
+      candidates.append((volumePath as NSString).appendingPathComponent(userRelative))
+    }
+    return candidates
+  }
+}
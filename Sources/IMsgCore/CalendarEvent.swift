@@ -0,0 +1,258 @@
+import Foundation
+
+/// A candidate calendar event found in a message: either an `.ics` attachment, or a date or
+/// time mentioned in the text ("dinner Friday at 7").
+public struct CalendarEvent: Sendable, Equatable {
+  public enum Source: String, Sendable {
+    case text
+    case attachment
+  }
+
+  public var uid: String
+  public var summary: String
+  public var start: Date
+  /// Exclusive: the next midnight for all-day events.
+  public var end: Date
+  public var allDay: Bool
+  public var location: String?
+  public var notes: String?
+  public var source: Source
+  public var messageRowID: Int64
+  public var messageGUID: String
+
+  public init(
+    uid: String,
+    summary: String,
+    start: Date,
+    end: Date,
+    allDay: Bool = false,
+    location: String? = nil,
+    notes: String? = nil,
+    source: Source = .text,
+    messageRowID: Int64 = 0,
+    messageGUID: String = ""
+  ) {
+    self.uid = uid
+    self.summary = summary
+    self.start = start
+    self.end = end
+    self.allDay = allDay
+    self.location = location
+    self.notes = notes
+    self.source = source
+    self.messageRowID = messageRowID
+    self.messageGUID = messageGUID
+  }
+}
+
+/// Finds candidate events in messages. Relative phrases are read against the day the
+/// message was sent, not today, so old messages resolve to the dates they meant.
+public enum CalendarEventExtractor {
+  /// Events from the message's `.ics` attachments, or else at most one from its text.
+  public static func events(
+    in message: Message, attachments: [AttachmentMeta], calendar: Calendar = .current
+  ) -> [CalendarEvent] {
+    let attached = attachments.filter(isCalendar).flatMap { meta -> [CalendarEvent] in
+      guard !meta.missing,
+        let contents = try? String(contentsOfFile: meta.originalPath, encoding: .utf8)
+      else {
+        return []
+      }
+      return ICalendar.events(in: contents, calendar: calendar).map { event in
+        var event = event
+        event.source = .attachment
+        event.messageRowID = message.rowID
+        event.messageGUID = message.guid
+        return event
+      }
+    }
+    if !attached.isEmpty { return attached }
+    guard var event = event(in: message.text, sentAt: message.date, calendar: calendar) else {
+      return []
+    }
+    event.uid = "\(message.guid.isEmpty ? String(message.rowID) : message.guid)@imsg"
+    event.messageRowID = message.rowID
+    event.messageGUID = message.guid
+    return [event]
+  }
+
+  public static func isCalendar(_ meta: AttachmentMeta) -> Bool {
+    let lowered = [meta.transferName, meta.filename].map { $0.lowercased() }
+    return lowered.contains { $0.hasSuffix(".ics") }
+      || meta.uti == "com.apple.ical.ics"
+      || meta.mimeType.lowercased() == "text/calendar"
+  }
+
+  /// A timed event (one hour) when the text names a time, an all-day one when it names a
+  /// date and reads like a plan. Bare hours ("at 7") are taken as afternoon or evening
+  /// unless the text says morning; "next Friday" is the first Friday after the send day.
+  static func event(in text: String, sentAt: Date, calendar: Calendar) -> CalendarEvent? {
+    let lowered = text.lowercased()
+    let day = self.day(in: lowered, sentAt: sentAt, calendar: calendar)
+    let time = self.time(in: lowered)
+    let summary = self.summary(text)
+    guard !summary.isEmpty else { return nil }
+
+    if let time {
+      var start = calendar.startOfDay(for: day?.date ?? sentAt)
+      start = calendar.date(
+        bySettingHour: time.hour, minute: time.minute, second: 0, of: start) ?? start
+      if day == nil && start < sentAt {
+        start = calendar.date(byAdding: .day, value: 1, to: start) ?? start
+      }
+      return CalendarEvent(
+        uid: "", summary: summary, start: start, end: start.addingTimeInterval(3600),
+        notes: text == summary ? nil : text)
+    }
+    guard let day, day.explicit || containsPlan(lowered) else { return nil }
+    let start = calendar.startOfDay(for: day.date)
+    let end = calendar.date(byAdding: .day, value: 1, to: start) ?? start.addingTimeInterval(86400)
+    return CalendarEvent(
+      uid: "", summary: summary, start: start, end: end, allDay: true,
+      notes: text == summary ? nil : text)
+  }
+
+  private static let weekdays = [
+    "sun": 1, "mon": 2, "tue": 3, "wed": 4, "thu": 5, "fri": 6, "sat": 7,
+  ]
+  private static let months = [
+    "jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9,
+    "oct": 10, "nov": 11, "dec": 12,
+  ]
+  private static let monthPattern =
+    "(jan(?:uary)?|feb(?:ruary)?|mar(?:ch)?|apr(?:il)?|may|june?|july?|aug(?:ust)?"
+    + "|sept?(?:ember)?|oct(?:ober)?|nov(?:ember)?|dec(?:ember)?)\\.?"
+  private static let planWords: Set<String> = [
+    "dinner", "lunch", "breakfast", "brunch", "coffee", "drinks", "party", "meeting", "meet",
+    "call", "appointment", "appt", "reservation", "flight", "concert", "game", "movie",
+    "birthday", "wedding", "trip", "class", "practice", "show", "interview", "pickup",
+  ]
+  private static let eveningWords: Set<String> = [
+    "dinner", "drinks", "tonight", "evening", "party", "movie", "concert", "show",
+  ]
+  private static let morningWords: Set<String> = ["morning", "breakfast", "coffee"]
+
+  /// The day the text names, and whether it was an explicit date rather than a weekday or
+  /// a word like "tomorrow". The earliest mention wins.
+  static func day(
+    in text: String, sentAt: Date, calendar: Calendar
+  ) -> (date: Date, explicit: Bool)? {
+    let today = calendar.startOfDay(for: sentAt)
+    var found: [(location: Int, date: Date, explicit: Bool)] = []
+    func add(_ location: Int, _ date: Date?, explicit: Bool) {
+      if let date { found.append((location, date, explicit)) }
+    }
+
+    for match in matches("\\b(today|tonight|tomorrow|tmrw)\\b", in: text) {
+      let days = match.groups[0] == "tomorrow" || match.groups[0] == "tmrw" ? 1 : 0
+      add(match.location, calendar.date(byAdding: .day, value: days, to: today), explicit: false)
+    }
+    let weekdayPattern =
+      "\\b(?:(next|this)\\s+)?(monday|mon|tuesday|tues|tue|wednesday|wed|thursday|thurs|thur"
+      + "|thu|friday|fri|saturday|sunday)\\b"
+    for match in matches(weekdayPattern, in: text) {
+      guard let name = match.groups[1], let target = weekdays[String(name.prefix(3))] else {
+        continue
+      }
+      var days = (target - calendar.component(.weekday, from: today) + 7) % 7
+      if match.groups[0] == "next" && days == 0 { days = 7 }
+      add(match.location, calendar.date(byAdding: .day, value: days, to: today), explicit: false)
+    }
+    let monthFirst = "\\b\(monthPattern)\\s+(\\d{1,2})(?:st|nd|rd|th)?\\b"
+    for match in matches(monthFirst, in: text) {
+      add(
+        match.location,
+        date(month: match.groups[0], day: match.groups[1], year: nil, after: today, calendar),
+        explicit: true)
+    }
+    let dayFirst = "\\b(\\d{1,2})(?:st|nd|rd|th)?\\s+(?:of\\s+)?\(monthPattern)\\b"
+    for match in matches(dayFirst, in: text) {
+      add(
+        match.location,
+        date(month: match.groups[1], day: match.groups[0], year: nil, after: today, calendar),
+        explicit: true)
+    }
+    for match in matches("\\b(\\d{1,2})/(\\d{1,2})(?:/(\\d{2}|\\d{4}))?\\b", in: text) {
+      add(
+        match.location,
+        date(month: match.groups[0], day: match.groups[1], year: match.groups[2], after: today,
+          calendar),
+        explicit: true)
+    }
+    return found.min { $0.location < $1.location }.map { ($0.date, $0.explicit) }
+  }
+
+  /// Hour and minute the text names: `7pm`, `7:30 p.m.`, `19:00`, `noon`, or `at 7`.
+  static func time(in text: String) -> (hour: Int, minute: Int)? {
+    if let match = matches("\\b(\\d{1,2})(?::([0-5]\\d))?\\s*([ap])\\.?m\\b\\.?", in: text).first,
+      let hour = match.groups[0].flatMap(Int.init), (1...12).contains(hour)
+    {
+      let minute = match.groups[1].flatMap(Int.init) ?? 0
+      return (hour % 12 + (match.groups[2] == "p" ? 12 : 0), minute)
+    }
+    if let match = matches("\\b(noon|midday|midnight)\\b", in: text).first {
+      return (match.groups[0] == "midnight" ? 0 : 12, 0)
+    }
+    let bare =
+      matches("\\b([01]?\\d|2[0-3]):([0-5]\\d)\\b", in: text).first
+      ?? matches("(?:\\bat|@)\\s*(\\d{1,2})\\b(?![:/.]?\\d)", in: text).first
+    guard let bare, let hour = bare.groups[0].flatMap(Int.init), hour <= 23 else { return nil }
+    let minute = bare.groups.count > 1 ? bare.groups[1].flatMap(Int.init) ?? 0 : 0
+    guard (1...11).contains(hour) else { return (hour, minute) }
+    let words = Set(text.split { !$0.isLetter }.map(String.init))
+    let evening =
+      hour <= 6 || (!words.isDisjoint(with: eveningWords) && words.isDisjoint(with: morningWords))
+    return (evening ? hour + 12 : hour, minute)
+  }
+
+  private static func containsPlan(_ text: String) -> Bool {
+    !Set(text.split { !$0.isLetter }.map(String.init)).isDisjoint(with: planWords)
+  }
+
+  /// The first line of the text, cut to 80 characters.
+  private static func summary(_ text: String) -> String {
+    let line =
+      text.split(whereSeparator: \.isNewline).first.map(String.init)?
+      .trimmingCharacters(in: .whitespaces) ?? ""
+    return line.count > 80 ? String(line.prefix(79)) + "…" : line
+  }
+
+  /// A valid date; without a year, the first one on or after `after`.
+  private static func date(
+    month: String?, day: String?, year: String?, after: Date, _ calendar: Calendar
+  ) -> Date? {
+    guard let month, let day = day.flatMap(Int.init) else { return nil }
+    guard let monthNumber = Int(month) ?? months[String(month.prefix(3))] else { return nil }
+    var components = DateComponents(month: monthNumber, day: day)
+    let sentYear = calendar.component(.year, from: after)
+    if let year = year.flatMap(Int.init) {
+      components.year = year < 100 ? 2000 + year : year
+    } else {
+      components.year = sentYear
+    }
+    guard var date = calendar.date(from: components),
+      calendar.component(.day, from: date) == day,
+      calendar.component(.month, from: date) == monthNumber
+    else {
+      return nil
+    }
+    if year == nil && date < after {
+      components.year = sentYear + 1
+      date = calendar.date(from: components) ?? date
+    }
+    return date
+  }
+
+  private static func matches(
+    _ pattern: String, in text: String
+  ) -> [(location: Int, groups: [String?])] {
+    guard let regex = try? NSRegularExpression(pattern: pattern) else { return [] }
+    let range = NSRange(text.startIndex..., in: text)
+    return regex.matches(in: text, range: range).map { result in
+      let groups = (1..<result.numberOfRanges).map { index -> String? in
+        Range(result.range(at: index), in: text).map { String(text[$0]) }
+      }
+      return (result.range.location, groups)
+    }
+  }
+}
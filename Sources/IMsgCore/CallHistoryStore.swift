@@ -0,0 +1,145 @@
+import Foundation
+import SQLite
+
+/// A phone or FaceTime call from the system call log.
+public struct CallRecord: Sendable, Equatable {
+  public enum Kind: String, Sendable {
+    case phone
+    case faceTimeVideo = "facetime_video"
+    case faceTimeAudio = "facetime_audio"
+    case other
+
+    /// `ZCALLTYPE`: 1 cellular/phone, 8 FaceTime video, 16 FaceTime audio.
+    init(callType: Int64, provider: String) {
+      switch callType {
+      case 1: self = .phone
+      case 8: self = .faceTimeVideo
+      case 16: self = .faceTimeAudio
+      default: self = provider.lowercased().contains("facetime") ? .faceTimeVideo : .other
+      }
+    }
+
+    public var label: String {
+      switch self {
+      case .phone: return "Phone"
+      case .faceTimeVideo: return "FaceTime video"
+      case .faceTimeAudio: return "FaceTime audio"
+      case .other: return "Call"
+      }
+    }
+  }
+
+  public let id: Int64
+  /// Phone number or email of the other party, as the call log recorded it.
+  public let handle: String
+  /// Contact name cached by the call log, if any.
+  public let name: String
+  public let kind: Kind
+  public let isOutgoing: Bool
+  public let answered: Bool
+  public let date: Date
+  public let duration: TimeInterval
+
+  public init(
+    id: Int64, handle: String, name: String, kind: Kind, isOutgoing: Bool, answered: Bool,
+    date: Date, duration: TimeInterval
+  ) {
+    self.id = id
+    self.handle = handle
+    self.name = name
+    self.kind = kind
+    self.isOutgoing = isOutgoing
+    self.answered = answered
+    self.date = date
+    self.duration = duration
+  }
+}
+
+/// Read-only access to `CallHistory.storedata`, the Core Data store behind the Phone and
+/// FaceTime recents list. It syncs across devices on the same Apple ID, so calls taken on the
+/// iPhone show up too. Needs Full Disk Access, like chat.db.
+public final class CallHistoryStore: @unchecked Sendable {
+  public static var defaultPath: String {
+    let home = FileManager.default.homeDirectoryForCurrentUser.path
+    return NSString(string: home).appendingPathComponent(
+      "Library/Application Support/CallHistoryDB/CallHistory.storedata")
+  }
+
+  public let path: String
+  private let connection: Connection
+
+  public init(path: String = CallHistoryStore.defaultPath) throws {
+    let normalized = NSString(string: path).expandingTildeInPath
+    self.path = normalized
+    do {
+      let uri = URL(fileURLWithPath: normalized).absoluteString
+      let location = Connection.Location.uri(uri, parameters: [.mode(.readOnly)])
+      self.connection = try Connection(location, readonly: true)
+      self.connection.busyTimeout = 5
+    } catch {
+      throw MessageStore.enhance(error: error, path: normalized)
+    }
+  }
+
+  init(connection: Connection, path: String) {
+    self.path = path
+    self.connection = connection
+  }
+
+  /// Newest calls first, optionally only those with `handle` (compared after phone
+  /// normalization with `region`).
+  public func calls(limit: Int, handle: String? = nil, region: String = "US") throws
+    -> [CallRecord]
+  {
+    var sql = """
+      SELECT Z_PK, IFNULL(ZADDRESS, ''), IFNULL(ZNAME, ''), IFNULL(ZCALLTYPE, 0),
+             IFNULL(ZSERVICE_PROVIDER, ''), IFNULL(ZORIGINATED, 0), IFNULL(ZANSWERED, 0),
+             IFNULL(ZDATE, 0), IFNULL(ZDURATION, 0)
+      FROM ZCALLRECORD
+      ORDER BY ZDATE DESC
+      """
+    var bindings: [Binding?] = []
+    // Handles are stored as typed, so filtering happens after normalization below.
+    if handle == nil {
+      sql += "\nLIMIT ?"
+      bindings.append(Int64(limit))
+    }
+    let wanted = handle.map { PhoneNumberNormalizer.shared.normalizeHandle($0, region: region) }
+    var records: [CallRecord] = []
+    for row in try connection.prepare(sql, bindings) {
+      let address = row[1] as? String ?? ""
+      if let wanted,
+        PhoneNumberNormalizer.shared.normalizeHandle(address, region: region) != wanted
+      {
+        continue
+      }
+      // Core Data stores seconds since 2001 as a double.
+      let seconds = CallHistoryStore.double(row[7]) + AppleTime.epochOffset
+      records.append(
+        CallRecord(
+          id: CallHistoryStore.int64(row[0]),
+          handle: address,
+          name: row[2] as? String ?? "",
+          kind: CallRecord.Kind(
+            callType: CallHistoryStore.int64(row[3]), provider: row[4] as? String ?? ""),
+          isOutgoing: CallHistoryStore.int64(row[5]) != 0,
+          answered: CallHistoryStore.int64(row[6]) != 0,
+          date: Date(timeIntervalSince1970: seconds),
+          duration: CallHistoryStore.double(row[8])))
+      if records.count >= limit { break }
+    }
+    return records
+  }
+
+  private static func int64(_ binding: Binding?) -> Int64 {
+    if let value = binding as? Int64 { return value }
+    if let value = binding as? Double { return Int64(value) }
+    return 0
+  }
+
+  private static func double(_ binding: Binding?) -> Double {
+    if let value = binding as? Double { return value }
+    if let value = binding as? Int64 { return Double(value) }
+    return 0
+  }
+}
@@ -0,0 +1,100 @@
+import Foundation
+
+/// Chats muted with `imsg mute`, kept in muted.json in the state directory. Chats are stored
+/// by guid, which is the same on every Mac and in backups; rowids are not. Listings hide
+/// muted chats and watch, autoreply, the bridge and RPC subscriptions skip their messages.
+public final class ChatMuteList {
+  public struct Entry: Codable, Sendable, Equatable {
+    public let guid: String
+    /// The chat's name when it was muted, for listing.
+    public let name: String
+    public let mutedAt: Date
+
+    enum CodingKeys: String, CodingKey {
+      case guid
+      case name
+      case mutedAt = "muted_at"
+    }
+  }
+
+  private struct Snapshot: Codable {
+    var chats: [Entry] = []
+  }
+
+  public let fileURL: URL
+  private var snapshot: Snapshot
+  private var modifiedAt: Date?
+
+  public init(fileURL: URL = StateDirectory.fileURL("muted.json")) throws {
+    self.fileURL = fileURL
+    self.snapshot = Snapshot()
+    try load()
+  }
+
+  /// Muted chats, oldest first.
+  public var entries: [Entry] {
+    snapshot.chats
+  }
+
+  public var isEmpty: Bool {
+    snapshot.chats.isEmpty
+  }
+
+  public func contains(guid: String) -> Bool {
+    !guid.isEmpty && snapshot.chats.contains { $0.guid == guid }
+  }
+
+  /// Whether `chatID` in `store` is muted. Chats missing from chat.db are not.
+  public func isMuted(chatID: Int64, in store: MessageStore) throws -> Bool {
+    guard !isEmpty, let chat = try store.chatInfo(chatID: chatID) else { return false }
+    return contains(guid: chat.guid)
+  }
+
+  /// Returns false when the chat was already muted.
+  @discardableResult
+  public func mute(_ chat: ChatInfo, at date: Date = Date()) -> Bool {
+    guard !chat.guid.isEmpty, !contains(guid: chat.guid) else { return false }
+    snapshot.chats.append(Entry(guid: chat.guid, name: chat.name, mutedAt: date))
+    return true
+  }
+
+  /// Returns false when the chat wasn't muted.
+  @discardableResult
+  public func unmute(guid: String) -> Bool {
+    let count = snapshot.chats.count
+    snapshot.chats.removeAll { $0.guid == guid }
+    return snapshot.chats.count != count
+  }
+
+  public func save() throws {
+    try FileManager.default.createDirectory(
+      at: fileURL.deletingLastPathComponent(), withIntermediateDirectories: true)
+    let encoder = JSONEncoder()
+    encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+    encoder.dateEncodingStrategy = .iso8601
+    try encoder.encode(snapshot).write(to: fileURL, options: .atomic)
+    modifiedAt = ChatMuteList.modificationDate(of: fileURL)
+  }
+
+  /// Re-reads muted.json when another imsg process changed it since it was loaded, so a
+  /// running watch picks up `imsg mute` without a restart.
+  public func reloadIfChanged() throws {
+    guard ChatMuteList.modificationDate(of: fileURL) != modifiedAt else { return }
+    try load()
+  }
+
+  private func load() throws {
+    modifiedAt = ChatMuteList.modificationDate(of: fileURL)
+    guard modifiedAt != nil else {
+      snapshot = Snapshot()
+      return
+    }
+    let decoder = JSONDecoder()
+    decoder.dateDecodingStrategy = .iso8601
+    snapshot = try decoder.decode(Snapshot.self, from: Data(contentsOf: fileURL))
+  }
+
+  private static func modificationDate(of url: URL) -> Date? {
+    (try? FileManager.default.attributesOfItem(atPath: url.path))?[.modificationDate] as? Date
+  }
+}
@@ -0,0 +1,92 @@
+import Foundation
+import SQLite
+
+/// Read-only connections to one chat.db, each with its own serial queue and prepared
+/// statements. A query takes an idle connection, opening another (up to `limit`) when all are
+/// busy, so concurrent readers — export's per-chat workers, an RPC watch next to history calls
+/// — don't queue behind each other. Calls made from inside a query stay on its connection.
+final class ConnectionPool: @unchecked Sendable {
+  final class Slot {
+    let connection: Connection
+    let queue: DispatchQueue
+    let index: Int
+    /// Prepared statements for hot queries, keyed by SQL; only touched on `queue`.
+    var statements: [String: Statement] = [:]
+
+    init(connection: Connection, index: Int) {
+      self.connection = connection
+      self.queue = DispatchQueue(label: "imsg.db.\(index)", qos: .userInitiated)
+      self.index = index
+    }
+  }
+
+  let limit: Int
+  private let open: (() throws -> Connection)?
+  private let key = DispatchSpecificKey<Int>()
+  private let lock = NSLock()
+  private let available: DispatchSemaphore
+  private var slots: [Slot] = []
+  private var idle: [Int] = []
+
+  /// `open` makes further connections; without it the pool is just `first`, e.g. for an
+  /// in-memory database that a second connection wouldn't see.
+  init(first: Connection, limit: Int = 4, open: (() throws -> Connection)? = nil) {
+    self.limit = open == nil ? 1 : max(limit, 1)
+    self.open = open
+    self.available = DispatchSemaphore(value: self.limit)
+    add(first)
+  }
+
+  /// Runs `block` on an idle connection's queue, or directly when already on one of this
+  /// pool's queues.
+  func withSlot<T>(_ block: (Slot) throws -> T) throws -> T {
+    if let index = DispatchQueue.getSpecific(key: key) {
+      return try block(slot(at: index))
+    }
+    available.wait()
+    let slot: Slot
+    do {
+      slot = try checkout()
+    } catch {
+      available.signal()
+      throw error
+    }
+    defer {
+      lock.lock()
+      idle.append(slot.index)
+      lock.unlock()
+      available.signal()
+    }
+    return try slot.queue.sync { try block(slot) }
+  }
+
+  private func slot(at index: Int) -> Slot {
+    lock.lock()
+    defer { lock.unlock() }
+    return slots[index]
+  }
+
+  private func checkout() throws -> Slot {
+    lock.lock()
+    defer { lock.unlock() }
+    if let index = idle.popLast() {
+      return slots[index]
+    }
+    // The semaphore only lets a caller through with no idle slot while fewer than `limit`
+    // connections are open.
+    guard let open else { preconditionFailure("connection pool has no way to grow") }
+    let slot = add(try open())
+    idle.removeLast()
+    return slot
+  }
+
+  @discardableResult
+  private func add(_ connection: Connection) -> Slot {
+    connection.busyTimeout = 5
+    let slot = Slot(connection: connection, index: slots.count)
+    slot.queue.setSpecific(key: key, value: slot.index)
+    slots.append(slot)
+    idle.append(slot.index)
+    return slot
+  }
+}
@@ -0,0 +1,127 @@
+import Foundation
+
+/// What `DatabaseWAL.inspect` found out about chat.db's write-ahead log.
+public struct WALStatus: Sendable, Equatable {
+  public enum Issue: Sendable, Equatable {
+    /// `chat.db-wal` exists but cannot be opened; the newest messages are invisible.
+    case walUnreadable
+    /// `chat.db-shm` exists but cannot be opened; SQLite refuses to read the WAL.
+    case shmUnreadable
+    /// There is a WAL but no `-shm`, and a read-only open cannot create one here.
+    case shmMissing
+    /// Messages has not checkpointed for a while; this many committed frames are only in the
+    /// WAL.
+    case checkpointLag(frames: Int64)
+  }
+
+  /// True when the database header says WAL mode; nil when the header can't be read.
+  public let isWAL: Bool?
+  public let walBytes: Int64
+  /// Frames the WAL file has room for. The file is reused after a checkpoint rather than
+  /// truncated, so this includes frames already copied into chat.db.
+  public let walFrames: Int64
+  /// Committed frames not yet checkpointed into chat.db, from the wal-index in `-shm`; nil
+  /// when that can't be read.
+  public let pendingFrames: Int64?
+  public let walModified: Date?
+  public let databaseModified: Date?
+  public let issues: [Issue]
+}
+
+public enum DatabaseWAL {
+  /// SQLite checkpoints every 1000 pages by default; Messages staying far past that means reads
+  /// that skip the WAL (copies of chat.db alone, `immutable=1`) are missing recent messages.
+  public static let lagFrameThreshold: Int64 = 10_000
+
+  public static func inspect(path: String, lagFrameThreshold: Int64 = lagFrameThreshold)
+    -> WALStatus
+  {
+    let fileManager = FileManager.default
+    let expanded = NSString(string: path).expandingTildeInPath
+    let walPath = expanded + "-wal"
+    let shmPath = expanded + "-shm"
+
+    // Bytes 18/19 of the database header are the file format versions; 2 means WAL.
+    let isWAL = readPrefix(of: expanded, count: 20).flatMap { header in
+      header.count == 20 ? header[18] == 2 : nil
+    }
+    let walBytes = fileSize(walPath, fileManager: fileManager)
+    var issues: [WALStatus.Issue] = []
+    var frames: Int64 = 0
+    var pending: Int64?
+    if fileManager.fileExists(atPath: walPath) {
+      if let header = readPrefix(of: walPath, count: 32) {
+        frames = frameCount(header: header, walBytes: walBytes)
+      } else {
+        issues.append(.walUnreadable)
+      }
+    }
+    if fileManager.fileExists(atPath: shmPath) {
+      if let index = readPrefix(of: shmPath, count: 136) {
+        pending = pendingFrames(walIndex: index)
+      } else {
+        issues.append(.shmUnreadable)
+      }
+    } else if walBytes > 0 {
+      let directory = (expanded as NSString).deletingLastPathComponent
+      if !fileManager.isWritableFile(atPath: directory) {
+        issues.append(.shmMissing)
+      }
+    }
+    if let pending, pending > lagFrameThreshold {
+      issues.append(.checkpointLag(frames: pending))
+    }
+    return WALStatus(
+      isWAL: isWAL,
+      walBytes: walBytes,
+      walFrames: frames,
+      pendingFrames: pending,
+      walModified: modificationDate(walPath, fileManager: fileManager),
+      databaseModified: modificationDate(expanded, fileManager: fileManager),
+      issues: issues
+    )
+  }
+
+  /// Frames in the log: a 32-byte header, then (24-byte frame header + page) per frame.
+  static func frameCount(header: Data, walBytes: Int64) -> Int64 {
+    guard header.count >= 12, walBytes > 32 else { return 0 }
+    let bytes = [UInt8](header)
+    let pageSize = bytes[8..<12].reduce(Int64(0)) { ($0 << 8) | Int64($1) }
+    // A stored page size of 1 means 65536.
+    let size = pageSize == 1 ? 65_536 : pageSize
+    guard size >= 512 else { return 0 }
+    return (walBytes - 32) / (size + 24)
+  }
+
+  /// `mxFrame - nBackfill` from the start of `-shm`: two copies of the 48-byte wal-index
+  /// header (mxFrame, the last committed frame, at offset 16) and then the checkpoint info
+  /// (nBackfill, the frames already copied into the database, at 96). Both are in native byte
+  /// order, little-endian on every Mac imsg runs on. Nil when the index isn't initialized or
+  /// its header copies disagree, as they do mid-write.
+  static func pendingFrames(walIndex: Data) -> Int64? {
+    guard walIndex.count >= 100 else { return nil }
+    let bytes = [UInt8](walIndex)
+    guard bytes[12] != 0, bytes[0..<48] == bytes[48..<96] else { return nil }
+    func uint32(at offset: Int) -> Int64 {
+      bytes[offset..<offset + 4].reversed().reduce(Int64(0)) { ($0 << 8) | Int64($1) }
+    }
+    let maxFrame = uint32(at: 16)
+    let backfilled = uint32(at: 96)
+    return max(maxFrame - backfilled, 0)
+  }
+
+  private static func readPrefix(of path: String, count: Int) -> Data? {
+    guard let handle = FileHandle(forReadingAtPath: path) else { return nil }
+    defer { try? handle.close() }
+    return handle.readData(ofLength: count)
+  }
+
+  private static func fileSize(_ path: String, fileManager: FileManager) -> Int64 {
+    let attributes = try? fileManager.attributesOfItem(atPath: path)
+    return (attributes?[.size] as? NSNumber)?.int64Value ?? 0
+  }
+
+  private static func modificationDate(_ path: String, fileManager: FileManager) -> Date? {
+    (try? fileManager.attributesOfItem(atPath: path))?[.modificationDate] as? Date
+  }
+}
@@ -5,7 +5,18 @@ public enum IMsgError: LocalizedError, Sendable {
   case invalidISODate(String)
   case invalidService(String)
   case invalidChatTarget(String)
+  case invalidHandle(String)
   case appleScriptFailure(String)
+  case invalidPattern(String)
+  case invalidBackup(String)
+  case messageNotFound(String)
+  case invalidAttachment(String)
+  case sendHelperFailure(String)
+  case invalidAccount(String)
+  case invalidNormalization(String)
+  case sendCancelled
+  /// Sent by `AppleScriptGate` while its circuit breaker is open.
+  case sendBackoff(failures: Int, retryAfter: TimeInterval)
 
   public var errorDescription: String? {
     switch self {
@@ -32,8 +43,30 @@ public enum IMsgError: LocalizedError, Sendable {
       return "Invalid service: \(value)"
     case .invalidChatTarget(let value):
       return "Invalid chat target: \(value)"
+    case .invalidHandle(let value):
+      return "Invalid phone number or email: \(value)"
     case .appleScriptFailure(let message):
       return "AppleScript failed: \(message)"
+    case .invalidPattern(let value):
+      return "Invalid regular expression: \(value)"
+    case .invalidBackup(let value):
+      return "Invalid backup: \(value)"
+    case .messageNotFound(let value):
+      return "Message not found: \(value)"
+    case .invalidAttachment(let value):
+      return "Invalid attachment: \(value)"
+    case .sendHelperFailure(let message):
+      return "Native send helper failed: \(message)"
+    case .invalidAccount(let value):
+      return "Invalid sending account: \(value)"
+    case .invalidNormalization(let value):
+      return "Invalid normalization: \(value) (expected fffc, zero-width, nfc or all)"
+    case .sendCancelled:
+      return "Send cancelled; nothing was sent"
+    case .sendBackoff(let failures, let retryAfter):
+      return
+        "E_SEND_BACKOFF: Messages failed \(failures) sends in a row; not trying again for "
+        + "\(Int(retryAfter.rounded(.up)))s"
     }
   }
 }
@@ -0,0 +1,57 @@
+import Foundation
+
+/// A group chat system message: someone was added or removed or left, or the chat was renamed
+/// or got a new photo. chat.db stores these as rows with a non-zero `item_type` and no text;
+/// the message's sender is the person who did it.
+public struct GroupEvent: Sendable, Equatable {
+  public enum Action: String, Sendable {
+    case added
+    case removed
+    case left
+    case renamed
+    case photoChanged = "photo_changed"
+    case photoRemoved = "photo_removed"
+  }
+
+  public let action: Action
+  /// The person added or removed; empty for other actions.
+  public let handle: String
+  /// The new chat name for `renamed`; empty when the name was cleared.
+  public let title: String
+
+  public init(action: Action, handle: String = "", title: String = "") {
+    self.action = action
+    self.handle = handle
+    self.title = title
+  }
+
+  /// Decodes `item_type` / `group_action_type`; nil for ordinary messages and for item types
+  /// that aren't group events (location sharing, kept audio, ...).
+  public init?(itemType: Int, groupActionType: Int, otherHandle: String, title: String) {
+    switch (itemType, groupActionType) {
+    case (1, 0): self.init(action: .added, handle: otherHandle)
+    case (1, 1): self.init(action: .removed, handle: otherHandle)
+    case (2, _): self.init(action: .renamed, title: title)
+    case (3, 0): self.init(action: .left)
+    case (3, 1): self.init(action: .photoChanged)
+    case (3, 2): self.init(action: .photoRemoved)
+    default: return nil
+    }
+  }
+
+  /// `Alice named the conversation "Trip"`; `actor` is who did it ("You" for your own).
+  public func summary(actor: String) -> String {
+    let actor = actor.isEmpty ? "Someone" : actor
+    let person = handle.isEmpty ? "someone" : handle
+    switch action {
+    case .added: return "\(actor) added \(person) to the conversation"
+    case .removed: return "\(actor) removed \(person) from the conversation"
+    case .left: return "\(actor) left the conversation"
+    case .renamed:
+      return title.isEmpty
+        ? "\(actor) removed the conversation name" : "\(actor) named the conversation \"\(title)\""
+    case .photoChanged: return "\(actor) changed the group photo"
+    case .photoRemoved: return "\(actor) removed the group photo"
+    }
+  }
+}
@@ -0,0 +1,169 @@
+import Foundation
+
+/// Just enough iCalendar (RFC 5545) to read the VEVENTs in an `.ics` attachment and to
+/// write candidate events back out for calendar tools.
+public enum ICalendar {
+  /// The VEVENTs in `text`. Times without `Z` or a known `TZID` are read in `calendar`'s
+  /// time zone; events without a usable DTSTART are skipped.
+  public static func events(in text: String, calendar: Calendar = .current) -> [CalendarEvent] {
+    var events: [CalendarEvent] = []
+    var properties: [(name: String, parameters: [String: String], value: String)]?
+    for line in unfold(text) {
+      let upper = line.uppercased()
+      if upper == "BEGIN:VEVENT" {
+        properties = []
+      } else if upper == "END:VEVENT" {
+        if let properties, let event = event(from: properties, calendar: calendar) {
+          events.append(event)
+        }
+        properties = nil
+      } else if properties != nil, let colon = line.firstIndex(of: ":") {
+        var parts = line[..<colon].split(separator: ";").map(String.init)
+        guard !parts.isEmpty else { continue }
+        let name = parts.removeFirst().uppercased()
+        var parameters: [String: String] = [:]
+        for part in parts {
+          let pair = part.split(separator: "=", maxSplits: 1).map(String.init)
+          if pair.count == 2 { parameters[pair[0].uppercased()] = pair[1] }
+        }
+        properties?.append((name, parameters, String(line[line.index(after: colon)...])))
+      }
+    }
+    return events
+  }
+
+  /// A VCALENDAR with one VEVENT per event. Timed events are written in UTC; all-day ones
+  /// as dates in `calendar`'s time zone.
+  public static func document(
+    for events: [CalendarEvent], stamp: Date = Date(), calendar: Calendar = .current
+  ) -> String {
+    var lines = ["BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:-//imsg//events//EN"]
+    for event in events {
+      lines += ["BEGIN:VEVENT", "UID:\(escape(event.uid))", "DTSTAMP:\(utc(stamp))"]
+      if event.allDay {
+        lines.append("DTSTART;VALUE=DATE:\(day(event.start, calendar))")
+        lines.append("DTEND;VALUE=DATE:\(day(event.end, calendar))")
+      } else {
+        lines.append("DTSTART:\(utc(event.start))")
+        lines.append("DTEND:\(utc(event.end))")
+      }
+      lines.append("SUMMARY:\(escape(event.summary))")
+      if let location = event.location { lines.append("LOCATION:\(escape(location))") }
+      if let notes = event.notes { lines.append("DESCRIPTION:\(escape(notes))") }
+      lines.append("END:VEVENT")
+    }
+    lines.append("END:VCALENDAR")
+    return lines.map(fold).joined(separator: "\r\n") + "\r\n"
+  }
+
+  private static func event(
+    from properties: [(name: String, parameters: [String: String], value: String)],
+    calendar: Calendar
+  ) -> CalendarEvent? {
+    func property(_ name: String) -> (parameters: [String: String], value: String)? {
+      properties.first { $0.name == name }.map { ($0.parameters, $0.value) }
+    }
+    guard let startProperty = property("DTSTART"),
+      let start = date(startProperty.value, parameters: startProperty.parameters, calendar)
+    else {
+      return nil
+    }
+    let allDay = start.allDay
+    let end =
+      property("DTEND").flatMap { date($0.value, parameters: $0.parameters, calendar)?.date }
+      ?? (allDay
+        ? calendar.date(byAdding: .day, value: 1, to: start.date)
+        : start.date.addingTimeInterval(3600))
+      ?? start.date
+    return CalendarEvent(
+      uid: property("UID").map { unescape($0.value) } ?? UUID().uuidString,
+      summary: property("SUMMARY").map { unescape($0.value) } ?? "",
+      start: start.date,
+      end: end,
+      allDay: allDay,
+      location: property("LOCATION").map { unescape($0.value) },
+      notes: property("DESCRIPTION").map { unescape($0.value) },
+      source: .attachment
+    )
+  }
+
+  /// `20261024`, `20261024T190000` (floating or `TZID=`), or `20261024T190000Z`.
+  private static func date(
+    _ value: String, parameters: [String: String], _ calendar: Calendar
+  ) -> (date: Date, allDay: Bool)? {
+    let digits = value.filter(\.isNumber)
+    guard digits.count == 8 || digits.count == 14 else { return nil }
+    var calendar = calendar
+    if value.hasSuffix("Z") {
+      calendar.timeZone = TimeZone(identifier: "UTC") ?? calendar.timeZone
+    } else if let tzid = parameters["TZID"], let zone = TimeZone(identifier: tzid) {
+      calendar.timeZone = zone
+    }
+    func number(_ offset: Int, _ length: Int) -> Int? {
+      let start = digits.index(digits.startIndex, offsetBy: offset)
+      return Int(digits[start..<digits.index(start, offsetBy: length)])
+    }
+    var components = DateComponents(year: number(0, 4), month: number(4, 2), day: number(6, 2))
+    let allDay = digits.count == 8
+    if !allDay {
+      components.hour = number(8, 2)
+      components.minute = number(10, 2)
+      components.second = number(12, 2)
+    }
+    return calendar.date(from: components).map { ($0, allDay) }
+  }
+
+  private static func unfold(_ text: String) -> [String] {
+    text.replacingOccurrences(of: "\r\n", with: "\n")
+      .replacingOccurrences(of: "\n ", with: "")
+      .replacingOccurrences(of: "\n\t", with: "")
+      .split(separator: "\n")
+      .map { $0.trimmingCharacters(in: .whitespaces) }
+  }
+
+  /// Lines longer than 75 octets continue on lines starting with a space.
+  private static func fold(_ line: String) -> String {
+    var folded = ""
+    var octets = 0
+    for character in line {
+      let size = String(character).utf8.count
+      if octets + size > 75 {
+        folded += "\r\n "
+        octets = 1
+      }
+      folded.append(character)
+      octets += size
+    }
+    return folded
+  }
+
+  private static func escape(_ value: String) -> String {
+    value.replacingOccurrences(of: "\\", with: "\\\\")
+      .replacingOccurrences(of: ";", with: "\\;")
+      .replacingOccurrences(of: ",", with: "\\,")
+      .replacingOccurrences(of: "\r\n", with: "\\n")
+      .replacingOccurrences(of: "\n", with: "\\n")
+  }
+
+  private static func unescape(_ value: String) -> String {
+    value.replacingOccurrences(of: "\\n", with: "\n")
+      .replacingOccurrences(of: "\\N", with: "\n")
+      .replacingOccurrences(of: "\\,", with: ",")
+      .replacingOccurrences(of: "\\;", with: ";")
+      .replacingOccurrences(of: "\\\\", with: "\\")
+  }
+
+  private static func utc(_ date: Date) -> String {
+    var calendar = Calendar(identifier: .gregorian)
+    calendar.timeZone = TimeZone(identifier: "UTC") ?? .current
+    let parts = calendar.dateComponents([.year, .month, .day, .hour, .minute, .second], from: date)
+    return String(
+      format: "%04d%02d%02dT%02d%02d%02dZ", parts.year ?? 0, parts.month ?? 0, parts.day ?? 0,
+      parts.hour ?? 0, parts.minute ?? 0, parts.second ?? 0)
+  }
+
+  private static func day(_ date: Date, _ calendar: Calendar) -> String {
+    let parts = calendar.dateComponents([.year, .month, .day], from: date)
+    return String(format: "%04d%02d%02d", parts.year ?? 0, parts.month ?? 0, parts.day ?? 0)
+  }
+}
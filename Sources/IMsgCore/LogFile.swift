@@ -0,0 +1,67 @@
+import Foundation
+
+/// An append-only log for long-running commands (`watch`, `rpc`, `bridge`, services). When a
+/// write would take the file past `maxBytes` it is renamed to `<path>.1`, older rotations move
+/// up to `<path>.<keep>`, and the oldest is dropped.
+public final class LogFile: @unchecked Sendable {
+  public static let defaultMaxBytes: Int64 = 10 * 1024 * 1024
+
+  public let url: URL
+  public let maxBytes: Int64
+  public let keep: Int
+  private let lock = NSLock()
+  private var handle: FileHandle?
+  private var size: Int64 = 0
+
+  public init(path: String, maxBytes: Int64 = LogFile.defaultMaxBytes, keep: Int = 3) {
+    self.url = URL(fileURLWithPath: NSString(string: path).expandingTildeInPath)
+    self.maxBytes = maxBytes
+    self.keep = max(keep, 1)
+  }
+
+  deinit {
+    try? handle?.close()
+  }
+
+  /// Appends `line` and a newline. Write errors are dropped: logging must never fail a command.
+  public func write(_ line: String) {
+    let data = Data((line + "\n").utf8)
+    lock.lock()
+    defer { lock.unlock() }
+    // Opened first so a file left by an earlier run counts toward the limit.
+    _ = openHandle()
+    if size > 0 && size + Int64(data.count) > maxBytes {
+      rotate()
+    }
+    guard let handle = openHandle() else { return }
+    handle.write(data)
+    size += Int64(data.count)
+  }
+
+  private func openHandle() -> FileHandle? {
+    if let handle { return handle }
+    let fileManager = FileManager.default
+    try? fileManager.createDirectory(
+      at: url.deletingLastPathComponent(), withIntermediateDirectories: true)
+    if !fileManager.fileExists(atPath: url.path) {
+      fileManager.createFile(atPath: url.path, contents: nil)
+    }
+    guard let opened = try? FileHandle(forWritingTo: url) else { return nil }
+    size = Int64((try? opened.seekToEnd()) ?? 0)
+    handle = opened
+    return opened
+  }
+
+  private func rotate() {
+    try? handle?.close()
+    handle = nil
+    size = 0
+    let fileManager = FileManager.default
+    func rotated(_ index: Int) -> String { "\(url.path).\(index)" }
+    try? fileManager.removeItem(atPath: rotated(keep))
+    for index in stride(from: keep - 1, through: 1, by: -1) {
+      try? fileManager.moveItem(atPath: rotated(index), toPath: rotated(index + 1))
+    }
+    try? fileManager.moveItem(atPath: url.path, toPath: rotated(1))
+  }
+}
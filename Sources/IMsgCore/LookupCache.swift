@@ -0,0 +1,48 @@
+import Foundation
+
+/// Chat info and participants resolved once per process instead of on every message: watch,
+/// history and templates otherwise join chat and handle for each row. Entries stay valid
+/// while the chat, handle and chat_handle_join tables gain no rows; that is checked at most
+/// once per `validationInterval`. Renames don't add rows, so the watcher calls
+/// `MessageStore.invalidateLookupCache()` when it sees a group event. Only touched holding
+/// the store's lookup lock.
+final class LookupCache {
+  /// Max rowids of chat, handle and chat_handle_join when the entries were loaded.
+  struct Stamp: Equatable {
+    let chat: Int64
+    let handle: Int64
+    let chatHandle: Int64
+  }
+
+  var validationInterval: TimeInterval = 1
+  var chats: [Int64: ChatInfo] = [:]
+  var participants: [Int64: [String]] = [:]
+  private var stamp: Stamp?
+  private var validatedAt: Date?
+
+  /// Drops every entry when `current()` differs from the stamp they were loaded under; returns
+  /// false when the stamp can't be read (e.g. a stripped-down test database), so the caller
+  /// skips caching.
+  func validate(now: Date = Date(), current: () throws -> Stamp) -> Bool {
+    if let validatedAt, stamp != nil, now.timeIntervalSince(validatedAt) < validationInterval {
+      return true
+    }
+    guard let latest = try? current() else {
+      removeAll()
+      return false
+    }
+    if latest != stamp {
+      removeAll()
+      stamp = latest
+    }
+    validatedAt = now
+    return true
+  }
+
+  func removeAll() {
+    chats.removeAll()
+    participants.removeAll()
+    stamp = nil
+    validatedAt = nil
+  }
+}
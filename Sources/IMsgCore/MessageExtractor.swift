@@ -0,0 +1,151 @@
+import Foundation
+
+/// Something worth acting on found in a message's text: a link, a one-time code, a street
+/// address, or a phone number.
+public struct ExtractedItem: Sendable, Equatable {
+  public enum Kind: String, CaseIterable, Sendable {
+    case url
+    case code
+    case address
+    case phone
+
+    /// `urls`, `codes`, `addresses` and `phones`, as `imsg extract --kind` takes them; the
+    /// singular names work too.
+    public init?(option: String) {
+      let name = option.trimmingCharacters(in: .whitespaces).lowercased()
+      switch name {
+      case "urls", "links", "link": self = .url
+      case "codes": self = .code
+      case "addresses": self = .address
+      case "phones": self = .phone
+      default: self.init(rawValue: name)
+      }
+    }
+  }
+
+  public let kind: Kind
+  /// Normalized: the absolute URL, the code without separators, the phone number or address
+  /// as written.
+  public let value: String
+  /// The text as it appears in the message.
+  public let match: String
+  public let messageRowID: Int64
+  public let messageGUID: String
+  public let chatID: Int64
+  public let sender: String
+  public let isFromMe: Bool
+  public let date: Date
+
+  public init(kind: Kind, value: String, match: String, message: Message) {
+    self.kind = kind
+    self.value = value
+    self.match = match
+    self.messageRowID = message.rowID
+    self.messageGUID = message.guid
+    self.chatID = message.chatID
+    self.sender = message.sender
+    self.isFromMe = message.isFromMe
+    self.date = message.date
+  }
+}
+
+/// Pulls URLs, addresses and phone numbers out of message text with the system data detectors,
+/// and one-time codes with patterns: a code is 4–8 digits (`123456`, `123-456`, `G-123456`) or
+/// an alphanumeric token right after "code"/"PIN", and only counts in messages that talk about
+/// a code, so order numbers and prices in ordinary chat are left alone.
+public enum MessageExtractor {
+  public static func items(
+    in message: Message, kinds: Set<ExtractedItem.Kind>
+  ) -> [ExtractedItem] {
+    let text = message.text
+    guard !text.isEmpty, !kinds.isEmpty else { return [] }
+    var found: [(range: NSRange, item: ExtractedItem)] = []
+    func add(_ kind: ExtractedItem.Kind, _ value: String, at range: NSRange) {
+      guard let swiftRange = Range(range, in: text) else { return }
+      let match = String(text[swiftRange])
+      found.append(
+        (range, ExtractedItem(kind: kind, value: value, match: match, message: message)))
+    }
+    var phoneRanges: [NSRange] = []
+    var types: NSTextCheckingResult.CheckingType = []
+    if kinds.contains(.url) { types.insert(.link) }
+    if kinds.contains(.address) { types.insert(.address) }
+    // Phone matches are also needed to keep phone numbers from passing as codes.
+    if kinds.contains(.phone) || kinds.contains(.code) { types.insert(.phoneNumber) }
+
+    let whole = NSRange(text.startIndex..<text.endIndex, in: text)
+    if !types.isEmpty, let detector = try? NSDataDetector(types: types.rawValue) {
+      for result in detector.matches(in: text, options: [], range: whole) {
+        guard let range = Range(result.range, in: text) else { continue }
+        switch result.resultType {
+        case .link where kinds.contains(.url):
+          guard let url = result.url, url.scheme?.lowercased() != "mailto" else { continue }
+          add(.url, url.absoluteString, at: result.range)
+        case .address where kinds.contains(.address):
+          add(.address, String(text[range]), at: result.range)
+        case .phoneNumber:
+          phoneRanges.append(result.range)
+          if kinds.contains(.phone) {
+            add(.phone, result.phoneNumber ?? String(text[range]), at: result.range)
+          }
+        default:
+          break
+        }
+      }
+    }
+
+    if kinds.contains(.code) {
+      // A code inside a longer phone number is part of the number; a code the detector
+      // mistook for a whole phone number is still a code.
+      for (range, code) in codes(in: text)
+      where !phoneRanges.contains(where: {
+        $0.length > range.length && NSIntersectionRange($0, range).length > 0
+      }) {
+        add(.code, code, at: range)
+      }
+    }
+    return found.sorted { $0.range.location < $1.range.location }.map(\.item)
+  }
+
+  /// The one-time code of a verification message: the first code in it, or nil when the
+  /// message doesn't look like one.
+  public static func oneTimeCode(in message: Message) -> ExtractedItem? {
+    items(in: message, kinds: [.code]).first
+  }
+
+  /// Words verification messages use, in the languages codes most often arrive in.
+  private static let codeContext = try! NSRegularExpression(
+    pattern: #"\b(codes?|passcode|pin|otp|verification|verify|one[- ]time|2fa|security|"#
+      + #"log ?in|sign[- ]in|código|codice|kode?|bestätigungscode|verifizierung)\b"#,
+    options: [.caseInsensitive])
+  /// Digits not part of a longer number, amount, time, date or path.
+  private static let numericCode = try! NSRegularExpression(
+    pattern: #"(?<![\w.,/:$€£-])(?:[A-Z]-)?(\d{3}[- ]\d{3}|\d{4,8})(?![\w/:]|[.,]\d)"#)
+  private static let labeledCode = try! NSRegularExpression(
+    pattern: #"\b(?:code|passcode|pin|código|codice)(?:\s+(?:is|es|è))?[:\s]\s*"#
+      + #"([A-Z0-9]{4,10})\b"#,
+    options: [.caseInsensitive])
+
+  /// Codes with the range of their match, in order of appearance.
+  static func codes(in text: String) -> [(NSRange, String)] {
+    let whole = NSRange(text.startIndex..<text.endIndex, in: text)
+    guard codeContext.firstMatch(in: text, options: [], range: whole) != nil else { return [] }
+    var codes: [(NSRange, String)] = []
+    func add(_ range: NSRange) {
+      guard let swiftRange = Range(range, in: text),
+        !codes.contains(where: { NSIntersectionRange($0.0, range).length > 0 })
+      else { return }
+      let value = text[swiftRange].filter { $0.isLetter || $0.isNumber }
+      // Labeled tokens need a digit, so "code is HERE" isn't a code.
+      guard value.contains(where: \.isNumber) else { return }
+      codes.append((range, String(value)))
+    }
+    for match in labeledCode.matches(in: text, options: [], range: whole) {
+      add(match.range(at: 1))
+    }
+    for match in numericCode.matches(in: text, options: [], range: whole) {
+      add(match.range(at: 1))
+    }
+    return codes.sorted { $0.0.location < $1.0.location }
+  }
+}
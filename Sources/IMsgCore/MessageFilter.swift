@@ -4,16 +4,41 @@ public struct MessageFilter: Sendable, Equatable {
   public let participants: [String]
   public let startDate: Date?
   public let endDate: Date?
+  public let textMatcher: MessageTextMatcher?
+  /// Lowercased language codes (`en`, `zh`, `und`) the text must be detected as; see
+  /// `MessageLanguage.matches`.
+  public let languages: Set<String>
+  /// Default region for participant phone numbers without a country code.
+  public let region: String
+  private let participantKeys: Set<String>
 
-  public init(participants: [String] = [], startDate: Date? = nil, endDate: Date? = nil) {
+  public init(
+    participants: [String] = [],
+    startDate: Date? = nil,
+    endDate: Date? = nil,
+    textMatcher: MessageTextMatcher? = nil,
+    languages: [String] = [],
+    region: String = "US"
+  ) {
     self.participants = participants
     self.startDate = startDate
     self.endDate = endDate
+    self.textMatcher = textMatcher
+    self.languages = Set(languages.map { $0.lowercased() })
+    self.region = region
+    self.participantKeys = Set(
+      participants.map { PhoneNumberNormalizer.shared.normalizeHandle($0, region: region) })
   }
 
-  public static func fromISO(participants: [String], startISO: String?, endISO: String?) throws
-    -> MessageFilter
-  {
+  public static func fromISO(
+    participants: [String],
+    startISO: String?,
+    endISO: String?,
+    textPattern: String? = nil,
+    caseInsensitive: Bool = false,
+    languages: [String] = [],
+    region: String = "US"
+  ) throws -> MessageFilter {
     let start = startISO.flatMap { ISO8601Parser.parse($0) }
     if let startISO, start == nil {
       throw IMsgError.invalidISODate(startISO)
@@ -22,22 +47,64 @@ public struct MessageFilter: Sendable, Equatable {
     if let endISO, end == nil {
       throw IMsgError.invalidISODate(endISO)
     }
-    return MessageFilter(participants: participants, startDate: start, endDate: end)
+    let matcher = try textPattern.map {
+      try MessageTextMatcher(pattern: $0, caseInsensitive: caseInsensitive)
+    }
+    return MessageFilter(
+      participants: participants,
+      startDate: start,
+      endDate: end,
+      textMatcher: matcher,
+      languages: languages,
+      region: region
+    )
+  }
+
+  /// `startDate..<endDate` for pushing the date bounds into SQL, open ends filled with the
+  /// distant past or future; nil without either bound. Empty when start is not before end.
+  public var dateRange: Range<Date>? {
+    guard startDate != nil || endDate != nil else { return nil }
+    let start = startDate ?? .distantPast
+    return start..<max(start, endDate ?? .distantFuture)
   }
 
   public func allows(_ message: Message) -> Bool {
+    allows(message, attachmentNames: [])
+  }
+
+  /// `allows(_:)` with the text pattern also tried against the message's attachment file
+  /// names, so `--match '\.pdf$'` finds a PDF sent without any text.
+  public func allows(_ message: Message, attachmentNames: [String]) -> Bool {
     if let startDate, message.date < startDate { return false }
     if let endDate, message.date >= endDate { return false }
-    if !participants.isEmpty {
-      var match = false
-      for participant in participants {
-        if participant.caseInsensitiveCompare(message.sender) == .orderedSame {
-          match = true
-          break
-        }
-      }
-      if !match { return false }
+    if !participantKeys.isEmpty {
+      let sender = PhoneNumberNormalizer.shared.normalizeHandle(message.sender, region: region)
+      if !participantKeys.contains(sender) { return false }
+    }
+    if let textMatcher, !textMatcher.matches(message.text),
+      !attachmentNames.contains(where: { textMatcher.matches($0) })
+    {
+      return false
+    }
+    if !languages.isEmpty,
+      !MessageLanguage.matches(MessageLanguage.detect(message.text), codes: languages)
+    {
+      return false
     }
     return true
   }
 }
+
+extension MessageStore {
+  /// Whether `filter` keeps `message`, looking up its attachment names only when a text
+  /// pattern is set and the text alone doesn't match.
+  public func allows(_ message: Message, by filter: MessageFilter) throws -> Bool {
+    guard let matcher = filter.textMatcher, message.attachmentsCount > 0,
+      !matcher.matches(message.text)
+    else { return filter.allows(message) }
+    let names = try attachments(for: message.rowID).map { meta in
+      meta.transferName.isEmpty ? (meta.filename as NSString).lastPathComponent : meta.transferName
+    }
+    return filter.allows(message, attachmentNames: names)
+  }
+}
@@ -0,0 +1,50 @@
+import Foundation
+import NaturalLanguage
+
+/// Guesses which language a message is written in with Apple's on-device language identifier,
+/// a character n-gram model in the spirit of lingua, so nothing leaves the Mac.
+public enum MessageLanguage {
+  /// Code for text whose language can't be told, as `--text-lang und` accepts it.
+  public static let undetermined = "und"
+
+  /// Guesses below this probability are dropped; short chat messages are often ambiguous.
+  static let minimumConfidence = 0.5
+
+  /// A BCP-47 code such as `en`, `de` or `zh-Hans`, or nil when the text is too short or too
+  /// mixed to tell. Links and @-mentions are left out first so they don't skew the guess.
+  public static func detect(_ text: String) -> String? {
+    let words = text.split(whereSeparator: \.isWhitespace).filter { word in
+      !word.contains("://") && !word.hasPrefix("www.") && !word.hasPrefix("@")
+    }
+    let cleaned = words.joined(separator: " ")
+    let letters = cleaned.unicodeScalars.filter { CharacterSet.letters.contains($0) }.count
+    guard letters >= 3 else { return nil }
+    let recognizer = NLLanguageRecognizer()
+    recognizer.processString(cleaned)
+    guard let (language, confidence) = recognizer.languageHypotheses(withMaximum: 1).first,
+      language != .undetermined, confidence >= minimumConfidence
+    else {
+      return nil
+    }
+    return language.rawValue
+  }
+
+  /// Whether `language` (from `detect`) is one of `codes`. A bare code covers its variants,
+  /// so `zh` matches `zh-Hans` and `zh-Hant`; `und` matches text with no detected language.
+  public static func matches(_ language: String?, codes: Set<String>) -> Bool {
+    guard let language = language?.lowercased() else {
+      return codes.contains(undetermined)
+    }
+    return codes.contains { language == $0 || language.hasPrefix($0 + "-") }
+  }
+
+  /// Lowercases a `--text-lang` code, or returns nil when it isn't shaped like one (`en`, `pt-BR`).
+  public static func normalizedCode(_ code: String) -> String? {
+    let trimmed = code.trimmingCharacters(in: .whitespaces).lowercased()
+    guard trimmed.range(of: "^[a-z]{2,3}(-[a-z0-9]+)*$", options: .regularExpression) != nil
+    else {
+      return nil
+    }
+    return trimmed
+  }
+}
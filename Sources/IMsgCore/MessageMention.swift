@@ -0,0 +1,100 @@
+import Foundation
+
+/// An @-mention in a group message: who was mentioned and where the mention sits in the text.
+public struct MessageMention: Sendable, Equatable {
+  /// Phone number or email of the mentioned person, as Messages recorded it.
+  public let handle: String
+  /// Start of the mention in the message text, in UTF-16 code units (NSRange semantics).
+  public let location: Int
+  /// Length in UTF-16 code units.
+  public let length: Int
+  /// The displayed text, usually the person's name.
+  public let text: String
+
+  public init(handle: String, location: Int, length: Int, text: String) {
+    self.handle = handle
+    self.location = location
+    self.length = length
+    self.text = text
+  }
+}
+
+public enum MentionParser {
+  /// Attribute Messages sets on the characters of a confirmed mention; the value is the handle.
+  static let attributeName = "__kIMMentionConfirmedMention"
+  private static let marker = Data(attributeName.utf8)
+
+  /// Mentions in an `attributedBody` blob, in text order. Empty when there are none or the
+  /// archive can't be read.
+  public static func mentions(in attributedBody: Data) -> [MessageMention] {
+    guard attributedBody.range(of: marker) != nil,
+      let root = try? TypedStreamReader(data: attributedBody).readRoot()
+    else {
+      return []
+    }
+    return mentions(in: root)
+  }
+
+  /// Walks the NSAttributedString layout: the string, then per run an attribute-dictionary
+  /// index and a length, with the dictionary itself following the first time an index is used.
+  static func mentions(in attributedString: TypedStreamReader.Object) -> [MessageMention] {
+    var values = attributedString.values[...]
+    guard let text = values.popFirst()?.stringObject else { return [] }
+    let utf16 = Array(text.utf16)
+    var dictionaries: [[String: TypedStreamReader.Value]] = []
+    var location = 0
+    var mentions: [MessageMention] = []
+    while let index = values.popFirst()?.integer, let length = values.popFirst()?.integer {
+      if index > dictionaries.count {
+        guard let dictionary = values.popFirst()?.object else { break }
+        dictionaries.append(attributes(of: dictionary))
+      }
+      guard index >= 1, index <= dictionaries.count, length >= 0 else { break }
+      let run = Int(length)
+      if let handle = dictionaries[Int(index) - 1][attributeName]?.stringObject,
+        !handle.isEmpty, location + run <= utf16.count
+      {
+        let display = String(utf16CodeUnits: Array(utf16[location..<location + run]), count: run)
+        mentions.append(
+          MessageMention(handle: handle, location: location, length: run, text: display))
+      }
+      location += run
+    }
+    return mentions
+  }
+
+  /// NSDictionary archives as a count followed by alternating keys and values.
+  private static func attributes(of dictionary: TypedStreamReader.Object)
+    -> [String: TypedStreamReader.Value]
+  {
+    var result: [String: TypedStreamReader.Value] = [:]
+    let pairs = dictionary.values.dropFirst()
+    var iterator = pairs.makeIterator()
+    while let key = iterator.next(), let value = iterator.next() {
+      if let name = key.stringObject {
+        result[name] = value
+      }
+    }
+    return result
+  }
+}
+
+/// Matches messages that mention one of your own handles.
+public struct MentionMatcher: Sendable {
+  public let handles: [String]
+  public let region: String
+  private let keys: Set<String>
+
+  public init(handles: [String], region: String = "US") {
+    self.handles = handles
+    self.region = region
+    self.keys = Set(
+      handles.map { PhoneNumberNormalizer.shared.normalizeHandle($0, region: region) })
+  }
+
+  public func matches(_ message: Message) -> Bool {
+    message.mentions.contains {
+      keys.contains(PhoneNumberNormalizer.shared.normalizeHandle($0.handle, region: region))
+    }
+  }
+}
@@ -0,0 +1,101 @@
+import Foundation
+
+/// Masks personal data in message text: phone numbers become `[phone]`, emails `[email]`, US
+/// social security numbers `[ssn]`, and matches of a custom regex `[redacted]`. Only the text
+/// is masked; senders, participants and attachment paths pass through unchanged, so redacted
+/// output still identifies who took part.
+public struct MessageRedactor: Sendable {
+  public static let builtInRules = ["phone", "email", "ssn"]
+
+  private let rules: [RedactionRule]
+
+  /// Each spec is `phone`, `email`, `ssn`, a comma-separated list of those, or a regex.
+  /// Built-in rules run first, email before phone so digits in addresses stay masked as email.
+  public init(specs: [String]) throws {
+    var names: Set<String> = []
+    var custom: [String] = []
+    for spec in specs {
+      let parts = spec.split(separator: ",").map {
+        $0.trimmingCharacters(in: .whitespaces).lowercased()
+      }
+      if !parts.isEmpty, parts.allSatisfy(MessageRedactor.builtInRules.contains) {
+        names.formUnion(parts)
+      } else {
+        custom.append(spec)
+      }
+    }
+    var rules: [RedactionRule] = []
+    for name in ["email", "ssn", "phone"] where names.contains(name) {
+      rules.append(
+        try RedactionRule(pattern: MessageRedactor.pattern(for: name), label: "[\(name)]"))
+    }
+    for pattern in custom {
+      rules.append(try RedactionRule(pattern: pattern, label: "[redacted]"))
+    }
+    self.rules = rules
+  }
+
+  public var isEmpty: Bool { rules.isEmpty }
+
+  public func redact(_ text: String) -> String {
+    var result = text
+    for rule in rules {
+      let range = NSRange(result.startIndex..<result.endIndex, in: result)
+      result = rule.regex.stringByReplacingMatches(
+        in: result, options: [], range: range,
+        withTemplate: NSRegularExpression.escapedTemplate(for: rule.label))
+    }
+    return result
+  }
+
+  /// A copy with redacted text. Mentions are dropped when the text changes: their offsets no
+  /// longer line up and their handles are the kind of data being masked.
+  public func redact(_ message: Message) -> Message {
+    let text = redact(message.text)
+    guard text != message.text else { return message }
+    return Message(
+      rowID: message.rowID,
+      chatID: message.chatID,
+      sender: message.sender,
+      text: text,
+      date: message.date,
+      isFromMe: message.isFromMe,
+      service: message.service,
+      handleID: message.handleID,
+      attachmentsCount: message.attachmentsCount,
+      guid: message.guid,
+      replyToGUID: message.replyToGUID,
+      app: message.app,
+      mentions: [],
+      account: message.account,
+      groupEvent: message.groupEvent
+    )
+  }
+
+  static func pattern(for rule: String) -> String {
+    switch rule {
+    case "email":
+      return #"[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}"#
+    case "ssn":
+      return #"(?<![\w-])\d{3}-\d{2}-\d{4}(?![\w-])"#
+    default:
+      // 7 to 15 digits, optionally with a leading + and single separators or parentheses, so
+      // "+1 (415) 555-1212" and "4155551212" match but 6-digit codes don't.
+      return #"(?<![\w+])\+?\(?\d(?:[\s().-]{0,2}\d){6,14}(?!\w)"#
+    }
+  }
+}
+
+private struct RedactionRule: @unchecked Sendable {
+  let regex: NSRegularExpression
+  let label: String
+
+  init(pattern: String, label: String) throws {
+    do {
+      self.regex = try NSRegularExpression(pattern: pattern)
+    } catch {
+      throw IMsgError.invalidPattern(pattern)
+    }
+    self.label = label
+  }
+}
@@ -10,28 +10,50 @@ public enum MessageService: String, Sendable, CaseIterable {
 public struct MessageSendOptions: Sendable {
   public var recipient: String
   public var text: String
-  public var attachmentPath: String
+  /// Files sent after the text, in order.
+  public var attachmentPaths: [String]
+  /// The single attachment, from before several files could be sent. Reads the first of
+  /// `attachmentPaths`; setting it replaces them all.
+  @available(*, deprecated, message: "use attachmentPaths")
+  public var attachmentPath: String {
+    get { attachmentPaths.first ?? "" }
+    set { attachmentPaths = newValue.isEmpty ? [] : [newValue] }
+  }
   public var service: MessageService
   public var region: String
   public var chatIdentifier: String
   public var chatGUID: String
+  /// Two or more handles to start a new group thread with (ignored when a chat target is set).
+  public var groupRecipients: [String]
+  /// Name for a newly created group thread (best effort; Messages may ignore it).
+  public var groupName: String
+  /// Id of the Messages account to send from (see `MessagesAccount`); empty uses the first
+  /// account for `service`. Ignored when a chat target is set, since a chat keeps its account.
+  public var accountID: String
 
   public init(
     recipient: String,
     text: String = "",
     attachmentPath: String = "",
+    attachmentPaths: [String] = [],
     service: MessageService = .auto,
     region: String = "US",
     chatIdentifier: String = "",
-    chatGUID: String = ""
+    chatGUID: String = "",
+    groupRecipients: [String] = [],
+    groupName: String = "",
+    accountID: String = ""
   ) {
     self.recipient = recipient
     self.text = text
-    self.attachmentPath = attachmentPath
+    self.attachmentPaths = (attachmentPath.isEmpty ? [] : [attachmentPath]) + attachmentPaths
     self.service = service
     self.region = region
     self.chatIdentifier = chatIdentifier
     self.chatGUID = chatGUID
+    self.groupRecipients = groupRecipients
+    self.groupName = groupName
+    self.accountID = accountID
   }
 }
 
@@ -39,17 +61,32 @@ public struct MessageSender {
   private let normalizer: PhoneNumberNormalizer
   private let runner: (String, [String]) throws -> Void
   private let attachmentsSubdirectoryProvider: () -> URL
+  private let logger: AutomationLogger
+  private var backend: SendBackend = .applescript
+  private var nativeHelper: NativeSendHelper?
 
-  public init() {
+  /// With `.native`, sends go through `nativeHelper`, or the helper `NativeSendHelper.locate()`
+  /// finds when it is nil.
+  public init(
+    logger: AutomationLogger = .disabled,
+    backend: SendBackend = .applescript,
+    nativeHelper: NativeSendHelper? = nil
+  ) {
     self.normalizer = PhoneNumberNormalizer()
-    self.runner = MessageSender.runAppleScript
+    self.runner = { source, arguments in
+      try MessageSender.runAppleScript(source: source, arguments: arguments, logger: logger)
+    }
     self.attachmentsSubdirectoryProvider = MessageSender.defaultAttachmentsSubdirectory
+    self.logger = logger
+    self.backend = backend
+    self.nativeHelper = nativeHelper
   }
 
-  init(runner: @escaping (String, [String]) throws -> Void) {
+  init(runner: @escaping (String, [String]) throws -> Void, logger: AutomationLogger = .disabled) {
     self.normalizer = PhoneNumberNormalizer()
     self.runner = runner
     self.attachmentsSubdirectoryProvider = MessageSender.defaultAttachmentsSubdirectory
+    self.logger = logger
   }
 
   init(
@@ -59,6 +96,7 @@ public struct MessageSender {
     self.normalizer = PhoneNumberNormalizer()
     self.runner = runner
     self.attachmentsSubdirectoryProvider = attachmentsSubdirectoryProvider
+    self.logger = .disabled
   }
 
   public func send(_ options: MessageSendOptions) throws {
@@ -67,24 +105,60 @@ public struct MessageSender {
     let useChat = !chatTarget.isEmpty
     if useChat == false {
       if resolved.region.isEmpty { resolved.region = "US" }
+      let handles =
+        resolved.groupRecipients.isEmpty ? [resolved.recipient] : resolved.groupRecipients
+      if let invalid = handles.first(where: {
+        !normalizer.isValidHandle($0, region: resolved.region)
+      }) {
+        throw IMsgError.invalidHandle(invalid)
+      }
       resolved.recipient = normalizer.normalize(resolved.recipient, region: resolved.region)
+      resolved.groupRecipients = normalizer.uniqueHandles(
+        resolved.groupRecipients, region: resolved.region)
       if resolved.service == .auto { resolved.service = .imessage }
     }
 
-    if resolved.attachmentPath.isEmpty == false {
-      resolved.attachmentPath = try stageAttachment(at: resolved.attachmentPath)
+    // Check every file before staging any, so a bad path doesn't leave partial copies behind.
+    for path in resolved.attachmentPaths {
+      let expandedPath = (path as NSString).expandingTildeInPath
+      guard FileManager.default.fileExists(atPath: expandedPath) else {
+        throw IMsgError.appleScriptFailure("Attachment not found at \(expandedPath)")
+      }
     }
+    resolved.attachmentPaths = try resolved.attachmentPaths.map { try stageAttachment(at: $0) }
 
-    try sendViaAppleScript(resolved, chatTarget: chatTarget, useChat: useChat)
+    switch backend {
+    case .applescript:
+      try sendViaAppleScript(resolved, chatTarget: chatTarget, useChat: useChat)
+    case .native:
+      try sendViaHelper(resolved, chatTarget: chatTarget)
+    }
+  }
+
+  private func sendViaHelper(_ resolved: MessageSendOptions, chatTarget: String) throws {
+    guard let helper = nativeHelper ?? NativeSendHelper.locate() else {
+      throw IMsgError.sendHelperFailure(
+        "\(NativeSendHelper.executableName) not found; install it next to imsg or set "
+          + "$\(NativeSendHelper.environmentKey)")
+    }
+    let request = NativeSendHelper.request(for: resolved, chatTarget: chatTarget)
+    let target =
+      request.chatGUID.map { "chat=\($0)" }
+      ?? request.groupRecipients.map {
+        "new-group=\($0.map(AutomationLogger.redactHandle).joined(separator: ","))"
+      }
+      ?? "buddy=\(AutomationLogger.redactHandle(resolved.recipient))"
+    logger.log(
+      .debug,
+      "send \(target) service=\(resolved.service.rawValue) "
+        + "text=\(AutomationLogger.redactText(resolved.text)) via \(helper.executableURL.path)")
+    try helper.send(request, logger: logger)
   }
 
   private func stageAttachment(at path: String) throws -> String {
     let expandedPath = (path as NSString).expandingTildeInPath
     let sourceURL = URL(fileURLWithPath: expandedPath)
     let fileManager = FileManager.default
-    guard fileManager.fileExists(atPath: sourceURL.path) else {
-      throw IMsgError.appleScriptFailure("Attachment not found at \(sourceURL.path)")
-    }
 
     let subdirectory = attachmentsSubdirectoryProvider()
     try fileManager.createDirectory(at: subdirectory, withIntermediateDirectories: true)
@@ -116,17 +190,84 @@ public struct MessageSender {
     chatTarget: String,
     useChat: Bool
   ) throws {
-    let script = appleScript()
-    let arguments = [
-      resolved.recipient,
-      resolved.text,
-      resolved.service.rawValue,
-      resolved.attachmentPath,
-      resolved.attachmentPath.isEmpty ? "0" : "1",
-      chatTarget,
-      useChat ? "1" : "0",
-    ]
-    try runner(script, arguments)
+    let useAttachment = resolved.attachmentPaths.isEmpty ? "0" : "1"
+    // Staged paths never contain newlines, so one argument carries them all.
+    let attachmentPaths = resolved.attachmentPaths.joined(separator: "\n")
+    let script: String
+    let arguments: [String]
+    let loggedArguments: [String]
+    let target: String
+    let attachmentNames = resolved.attachmentPaths.map {
+      URL(fileURLWithPath: $0).lastPathComponent
+    }
+    if !useChat && !resolved.groupRecipients.isEmpty {
+      script = newGroupAppleScript()
+      arguments =
+        [
+          resolved.text, resolved.service.rawValue, attachmentPaths, useAttachment,
+          resolved.groupName, resolved.accountID,
+        ] + resolved.groupRecipients
+      let handles = resolved.groupRecipients.map(AutomationLogger.redactHandle)
+      loggedArguments =
+        [
+          AutomationLogger.redactText(resolved.text), resolved.service.rawValue,
+          attachmentNames.joined(separator: ","), useAttachment,
+          AutomationLogger.redactText(resolved.groupName), resolved.accountID,
+        ] + handles
+      target = "new-group=\(handles.joined(separator: ","))"
+    } else {
+      script = appleScript()
+      arguments = [
+        resolved.recipient,
+        resolved.text,
+        resolved.service.rawValue,
+        attachmentPaths,
+        useAttachment,
+        chatTarget,
+        useChat ? "1" : "0",
+        resolved.accountID,
+      ]
+      loggedArguments = [
+        AutomationLogger.redactHandle(resolved.recipient),
+        AutomationLogger.redactText(resolved.text),
+        resolved.service.rawValue,
+        attachmentNames.joined(separator: ","),
+        useAttachment,
+        chatTarget,
+        useChat ? "1" : "0",
+        resolved.accountID,
+      ]
+      target =
+        useChat
+        ? "chat=\(chatTarget)" : "buddy=\(AutomationLogger.redactHandle(resolved.recipient))"
+    }
+    let attachmentName =
+      attachmentNames.isEmpty ? "none" : attachmentNames.joined(separator: ",")
+    let body = AutomationLogger.redactText(resolved.text)
+    let account = resolved.accountID.isEmpty || useChat ? "" : " account=\(resolved.accountID)"
+    logger.log(
+      .debug,
+      "send \(target) service=\(resolved.service.rawValue)\(account) text=\(body) "
+        + "attachment=\(attachmentName)"
+    )
+    // Redacted like the debug line: traces end up pasted into bug reports too.
+    logger.log(.trace, "applescript arguments: \(loggedArguments)")
+    logger.log(.trace, "applescript source:\n\(script)")
+    let started = Date()
+    do {
+      try runner(script, arguments)
+      logger.log(.info, "send finished in \(MessageSender.elapsedMilliseconds(since: started))ms")
+    } catch {
+      let elapsed = MessageSender.elapsedMilliseconds(since: started)
+      logger.log(
+        error, "send \(target) failed after \(elapsed)ms",
+        fields: ["service": resolved.service.rawValue, "attachment": attachmentName])
+      throw error
+    }
+  }
+
+  static func elapsedMilliseconds(since start: Date) -> Int {
+    Int(Date().timeIntervalSince(start) * 1000)
   }
 
   private func appleScript() -> String {
@@ -135,10 +276,11 @@ public struct MessageSender {
           set theRecipient to item 1 of argv
           set theMessage to item 2 of argv
           set theService to item 3 of argv
-          set theFilePath to item 4 of argv
+          set theFilePaths to item 4 of argv
           set useAttachment to item 5 of argv
           set chatId to item 6 of argv
           set useChat to item 7 of argv
+          set theAccount to item 8 of argv
 
           tell application "Messages"
               if useChat is "1" then
@@ -147,11 +289,15 @@ public struct MessageSender {
                       send theMessage to targetChat
                   end if
                   if useAttachment is "1" then
-                      set theFile to POSIX file theFilePath as alias
-                      send theFile to targetChat
+                      repeat with theFilePath in paragraphs of theFilePaths
+                          set theFile to POSIX file (theFilePath as text) as alias
+                          send theFile to targetChat
+                      end repeat
                   end if
               else
-                  if theService is "sms" then
+                  if theAccount is not "" then
+                      set targetService to service id theAccount
+                  else if theService is "sms" then
                       set targetService to first service whose service type is SMS
                   else
                       set targetService to first service whose service type is iMessage
@@ -162,8 +308,10 @@ public struct MessageSender {
                       send theMessage to targetBuddy
                   end if
                   if useAttachment is "1" then
-                      set theFile to POSIX file theFilePath as alias
-                      send theFile to targetBuddy
+                      repeat with theFilePath in paragraphs of theFilePaths
+                          set theFile to POSIX file (theFilePath as text) as alias
+                          send theFile to targetBuddy
+                      end repeat
                   end if
               end if
           end tell
@@ -171,6 +319,50 @@ public struct MessageSender {
       """
   }
 
+  private func newGroupAppleScript() -> String {
+    return """
+      on run argv
+          set theMessage to item 1 of argv
+          set theService to item 2 of argv
+          set theFilePaths to item 3 of argv
+          set useAttachment to item 4 of argv
+          set theGroupName to item 5 of argv
+          set theAccount to item 6 of argv
+          set theHandles to items 7 thru -1 of argv
+
+          tell application "Messages"
+              if theAccount is not "" then
+                  set targetService to service id theAccount
+              else if theService is "sms" then
+                  set targetService to first service whose service type is SMS
+              else
+                  set targetService to first service whose service type is iMessage
+              end if
+
+              set theBuddies to {}
+              repeat with theHandle in theHandles
+                  set end of theBuddies to buddy (theHandle as text) of targetService
+              end repeat
+              set targetChat to make new text chat with properties {participants:theBuddies}
+              if theGroupName is not "" then
+                  try
+                      set name of targetChat to theGroupName
+                  end try
+              end if
+              if theMessage is not "" then
+                  send theMessage to targetChat
+              end if
+              if useAttachment is "1" then
+                  repeat with theFilePath in paragraphs of theFilePaths
+                      set theFile to POSIX file (theFilePath as text) as alias
+                      send theFile to targetChat
+                  end repeat
+              end if
+          end tell
+      end run
+      """
+  }
+
   private func resolveChatTarget(_ options: inout MessageSendOptions) -> String {
     let guid = options.chatGUID.trimmingCharacters(in: .whitespacesAndNewlines)
     if !guid.isEmpty {
@@ -201,7 +393,22 @@ public struct MessageSender {
     return trimmed.rangeOfCharacter(from: allowed.inverted) == nil
   }
 
-  private static func runAppleScript(source: String, arguments: [String]) throws {
+  /// Runs through `AppleScriptGate.shared`, so scripts never overlap.
+  static func runAppleScript(
+    source: String,
+    arguments: [String],
+    logger: AutomationLogger
+  ) throws {
+    try AppleScriptGate.shared.run {
+      try runAppleScriptUngated(source: source, arguments: arguments, logger: logger)
+    }
+  }
+
+  private static func runAppleScriptUngated(
+    source: String,
+    arguments: [String],
+    logger: AutomationLogger
+  ) throws {
     guard let script = NSAppleScript(source: source) else {
       throw IMsgError.appleScriptFailure("Unable to compile AppleScript")
     }
@@ -220,16 +427,24 @@ public struct MessageSender {
       list.insert(NSAppleEventDescriptor(string: value), at: index + 1)
     }
     event.setParam(list, forKeyword: keyDirectObject)
-    script.executeAppleEvent(event, error: &errorInfo)
+    let started = Date()
+    let result = script.executeAppleEvent(event, error: &errorInfo)
+    logger.log(.info, "NSAppleScript finished in \(elapsedMilliseconds(since: started))ms")
     if let errorInfo {
+      logger.log(.debug, "NSAppleScript error: \(errorInfo)")
       if shouldFallbackToOsascript(errorInfo: errorInfo) {
-        try runOsascript(source: source, arguments: arguments)
+        logger.log(.info, "falling back to /usr/bin/osascript")
+        try runOsascript(source: source, arguments: arguments, logger: logger)
         return
       }
-      let message =
+      var message =
         (errorInfo[NSAppleScript.errorMessage] as? String) ?? "Unknown AppleScript error"
+      if let number = errorInfo[NSAppleScript.errorNumber] as? Int {
+        message += " (\(number))"
+      }
       throw IMsgError.appleScriptFailure(message)
     }
+    logger.log(.debug, "NSAppleScript result: \(result.stringValue ?? "(none)")")
   }
 
   private static func shouldFallbackToOsascript(errorInfo: NSDictionary) -> Bool {
@@ -246,23 +461,47 @@ public struct MessageSender {
     return false
   }
 
-  private static func runOsascript(source: String, arguments: [String]) throws {
+  private static func runOsascript(
+    source: String,
+    arguments: [String],
+    logger: AutomationLogger
+  ) throws {
+    // The script goes in a file rather than on stdin, so an osascript that exits early can't
+    // leave imsg writing into a closed pipe.
+    let scriptURL = FileManager.default.temporaryDirectory
+      .appendingPathComponent("imsg-\(UUID().uuidString).applescript")
+    try Data(source.utf8).write(to: scriptURL)
+    defer { try? FileManager.default.removeItem(at: scriptURL) }
     let process = Process()
     process.executableURL = URL(fileURLWithPath: "/usr/bin/osascript")
-    process.arguments = ["-l", "AppleScript", "-"] + arguments
-    let stdinPipe = Pipe()
+    process.arguments = ["-l", "AppleScript", scriptURL.path] + arguments
+    let stdoutPipe = Pipe()
     let stderrPipe = Pipe()
-    process.standardInput = stdinPipe
+    process.standardInput = FileHandle.nullDevice
+    process.standardOutput = stdoutPipe
     process.standardError = stderrPipe
+    let started = Date()
     try process.run()
-    if let data = source.data(using: .utf8) {
-      stdinPipe.fileHandleForWriting.write(data)
+    // Drain both pipes while osascript runs: one that fills up blocks it before it can exit.
+    var stdoutData = Data()
+    let stdoutRead = DispatchSemaphore(value: 0)
+    DispatchQueue.global().async {
+      stdoutData = stdoutPipe.fileHandleForReading.readDataToEndOfFile()
+      stdoutRead.signal()
     }
-    stdinPipe.fileHandleForWriting.closeFile()
+    let stderrData = stderrPipe.fileHandleForReading.readDataToEndOfFile()
+    stdoutRead.wait()
     process.waitUntilExit()
+    let stdout = String(data: stdoutData, encoding: .utf8) ?? ""
+    let stderr = String(data: stderrData, encoding: .utf8) ?? ""
+    logger.log(
+      .info,
+      "osascript exited \(process.terminationStatus) in \(elapsedMilliseconds(since: started))ms"
+    )
+    logger.log(.debug, "osascript stdout: \(stdout.trimmingCharacters(in: .newlines))")
+    logger.log(.debug, "osascript stderr: \(stderr.trimmingCharacters(in: .newlines))")
     if process.terminationStatus != 0 {
-      let data = stderrPipe.fileHandleForReading.readDataToEndOfFile()
-      let message = String(data: data, encoding: .utf8) ?? "Unknown osascript error"
+      let message = stderr.isEmpty ? "Unknown osascript error" : stderr
       throw IMsgError.appleScriptFailure(message.trimmingCharacters(in: .whitespacesAndNewlines))
     }
   }
@@ -0,0 +1,51 @@
+import Foundation
+import SQLite
+
+/// A handle this Mac has sent from (Apple ID email or phone number), seen in outgoing messages.
+public struct SenderAlias: Sendable, Equatable {
+  public let handle: String
+  public let service: String
+  public let messagesSent: Int
+  public let lastUsedAt: Date
+
+  public init(handle: String, service: String, messagesSent: Int, lastUsedAt: Date) {
+    self.handle = handle
+    self.service = service
+    self.messagesSent = messagesSent
+    self.lastUsedAt = lastUsedAt
+  }
+
+  public var kind: String {
+    handle.contains("@") ? "email" : "phone"
+  }
+}
+
+extension MessageStore {
+  /// Aliases recorded in `message.destination_caller_id` for outgoing messages, newest first.
+  public func senderAliases() throws -> [SenderAlias] {
+    guard hasDestinationCallerID else { return [] }
+    let sql = """
+      SELECT m.destination_caller_id, IFNULL(m.service, '') AS service, COUNT(*) AS sent,
+             MAX(m.date) AS last_date
+      FROM message m
+      WHERE m.is_from_me = 1
+        AND m.destination_caller_id IS NOT NULL
+        AND m.destination_caller_id != ''
+      GROUP BY m.destination_caller_id, m.service
+      ORDER BY last_date DESC
+      """
+    return try withConnection { db in
+      var aliases: [SenderAlias] = []
+      for row in try db.prepare(sql) {
+        aliases.append(
+          SenderAlias(
+            handle: stringValue(row[0]),
+            service: stringValue(row[1]),
+            messagesSent: intValue(row[2]) ?? 0,
+            lastUsedAt: appleDate(from: int64Value(row[3]))
+          ))
+      }
+      return aliases
+    }
+  }
+}
@@ -0,0 +1,155 @@
+import Foundation
+import SQLite
+
+/// Storage used by one chat: attachment bytes are measured on disk, not from `total_bytes`.
+public struct ChatStorageUsage: Sendable, Equatable {
+  public let chatID: Int64
+  public let name: String
+  public let identifier: String
+  public let messages: Int
+  public let attachments: Int
+  public let bytes: Int64
+  public let missing: Int
+}
+
+public struct StorageAudit: Sendable, Equatable {
+  public let totalMessages: Int
+  public let totalAttachments: Int
+  /// On-disk bytes of referenced attachment files that exist.
+  public let attachmentBytes: Int64
+  /// Chats with at least one message, largest attachment usage first.
+  public let chats: [ChatStorageUsage]
+  /// Attachment paths chat.db references that are not on disk.
+  public let missing: [String]
+  /// Files under `attachmentsRoot` that no attachment row references; nil when not scanned.
+  public let orphaned: [String]?
+  public let orphanedBytes: Int64
+  public let attachmentsRoot: String?
+}
+
+extension MessageStore {
+  /// `~/Library/Messages/Attachments` next to the default chat.db, or `Attachments` beside `path`.
+  public var defaultAttachmentsRoot: String {
+    URL(fileURLWithPath: path).deletingLastPathComponent()
+      .appendingPathComponent("Attachments", isDirectory: true).path
+  }
+
+  /// Counts messages and attachments, measures attachment files on disk per chat, and, when
+  /// `attachmentsRoot` exists, lists files there that no attachment row points at.
+  public func storageAudit(attachmentsRoot: String? = nil) throws -> StorageAudit {
+    let root = attachmentsRoot ?? defaultAttachmentsRoot
+    let totalMessages = try withConnection { db in
+      int64Value(try db.scalar("SELECT COUNT(*) FROM message")) ?? 0
+    }
+    let chatSQL = """
+      SELECT c.ROWID, IFNULL(c.display_name, c.chat_identifier) AS name,
+             IFNULL(c.chat_identifier, '') AS identifier, COUNT(cmj.message_id) AS messages
+      FROM chat c
+      JOIN chat_message_join cmj ON cmj.chat_id = c.ROWID
+      GROUP BY c.ROWID
+      """
+    var chatRows: [(id: Int64, name: String, identifier: String, messages: Int)] = []
+    try withConnection { db in
+      for row in try db.prepare(chatSQL) {
+        chatRows.append(
+          (
+            int64Value(row[0]) ?? 0, stringValue(row[1]), stringValue(row[2]),
+            Int(int64Value(row[3]) ?? 0)
+          ))
+      }
+    }
+
+    // One row per (attachment, chat); an attachment forwarded into several chats counts in each.
+    let attachmentSQL = """
+      SELECT a.ROWID, IFNULL(a.filename, '') AS filename, cmj.chat_id
+      FROM attachment a
+      LEFT JOIN message_attachment_join maj ON maj.attachment_id = a.ROWID
+      LEFT JOIN chat_message_join cmj ON cmj.message_id = maj.message_id
+      """
+    var seen = Set<Int64>()
+    var sizes: [Int64: Int64] = [:]
+    var missing: [Int64: String] = [:]
+    var referenced = Set<String>()
+    var perChat: [Int64: (attachments: Int, bytes: Int64, missing: Int)] = [:]
+    try withConnection { db in
+      for row in try db.prepare(attachmentSQL) {
+        let attachmentID = int64Value(row[0]) ?? 0
+        let filename = stringValue(row[1])
+        if seen.insert(attachmentID).inserted {
+          let resolved = AttachmentResolver.resolve(filename, messagesDirectory: messagesDirectory)
+          if resolved.missing {
+            if !filename.isEmpty { missing[attachmentID] = resolved.resolved }
+          } else {
+            referenced.insert(MessageStore.standardizedPath(resolved.resolved))
+            sizes[attachmentID] = MessageStore.fileSize(atPath: resolved.resolved)
+          }
+        }
+        guard let chatID = int64Value(row[2]) else { continue }
+        var usage = perChat[chatID] ?? (0, 0, 0)
+        usage.attachments += 1
+        if let size = sizes[attachmentID] {
+          usage.bytes += size
+        } else if missing[attachmentID] != nil {
+          usage.missing += 1
+        }
+        perChat[chatID] = usage
+      }
+    }
+
+    let chats = chatRows.map { chat in
+      let usage = perChat[chat.id] ?? (0, 0, 0)
+      return ChatStorageUsage(
+        chatID: chat.id,
+        name: chat.name,
+        identifier: chat.identifier,
+        messages: chat.messages,
+        attachments: usage.attachments,
+        bytes: usage.bytes,
+        missing: usage.missing
+      )
+    }
+    .sorted { ($0.bytes, $0.messages, $0.chatID) > ($1.bytes, $1.messages, $1.chatID) }
+
+    var orphaned: [String]?
+    var orphanedBytes: Int64 = 0
+    var isDirectory: ObjCBool = false
+    if FileManager.default.fileExists(atPath: root, isDirectory: &isDirectory),
+      isDirectory.boolValue
+    {
+      var found: [String] = []
+      let enumerator = FileManager.default.enumerator(
+        at: URL(fileURLWithPath: root, isDirectory: true),
+        includingPropertiesForKeys: [.isRegularFileKey, .fileSizeKey]
+      )
+      while let url = enumerator?.nextObject() as? URL {
+        let values = try? url.resourceValues(forKeys: [.isRegularFileKey, .fileSizeKey])
+        guard values?.isRegularFile == true else { continue }
+        let filePath = MessageStore.standardizedPath(url.path)
+        if referenced.contains(filePath) { continue }
+        found.append(filePath)
+        orphanedBytes += Int64(values?.fileSize ?? 0)
+      }
+      orphaned = found.sorted()
+    }
+
+    return StorageAudit(
+      totalMessages: Int(totalMessages),
+      totalAttachments: seen.count,
+      attachmentBytes: sizes.values.reduce(0, +),
+      chats: chats,
+      missing: missing.values.sorted(),
+      orphaned: orphaned,
+      orphanedBytes: orphanedBytes,
+      attachmentsRoot: orphaned == nil ? nil : root
+    )
+  }
+
+  static func standardizedPath(_ path: String) -> String {
+    URL(fileURLWithPath: path).resolvingSymlinksInPath().standardizedFileURL.path
+  }
+
+  static func fileSize(atPath path: String) -> Int64 {
+    let attributes = try? FileManager.default.attributesOfItem(atPath: path)
+    return (attributes?[.size] as? NSNumber)?.int64Value ?? 0
+  }
+}
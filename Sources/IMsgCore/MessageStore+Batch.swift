@@ -0,0 +1,48 @@
+import Foundation
+import SQLite
+
+extension MessageStore {
+  /// Stays well under SQLite's default limit of 999 bound parameters.
+  static let batchChunkSize = 500
+
+  static func chunked<Value>(_ ids: [Value]) -> [[Value]] {
+    stride(from: 0, to: ids.count, by: batchChunkSize).map {
+      Array(ids[$0..<min($0 + batchChunkSize, ids.count)])
+    }
+  }
+
+  /// Attachments for many messages with one query per chunk of ids, keyed by message rowid.
+  /// Messages without attachments are absent from the result.
+  public func attachments(forMessageIDs messageIDs: [Int64]) throws -> [Int64: [AttachmentMeta]] {
+    var grouped: [Int64: [AttachmentMeta]] = [:]
+    for chunk in MessageStore.chunked(messageIDs) {
+      let placeholders = Array(repeating: "?", count: chunk.count).joined(separator: ",")
+      let sql = """
+        SELECT maj.message_id, a.filename, a.transfer_name, a.uti, a.mime_type, a.total_bytes,
+               a.is_sticker
+        FROM message_attachment_join maj
+        JOIN attachment a ON a.ROWID = maj.attachment_id
+        WHERE maj.message_id IN (\(placeholders))
+        """
+      try withConnection { db in
+        for row in try db.prepare(sql, chunk.map { $0 as Binding? }) {
+          let messageID = int64Value(row[0]) ?? 0
+          let filename = stringValue(row[1])
+          let resolved = AttachmentResolver.resolve(filename, messagesDirectory: messagesDirectory)
+          grouped[messageID, default: []].append(
+            AttachmentMeta(
+              filename: filename,
+              transferName: stringValue(row[2]),
+              uti: stringValue(row[3]),
+              mimeType: stringValue(row[4]),
+              totalBytes: int64Value(row[5]) ?? 0,
+              isSticker: boolValue(row[6]),
+              originalPath: resolved.resolved,
+              missing: resolved.missing
+            ))
+        }
+      }
+    }
+    return grouped
+  }
+}
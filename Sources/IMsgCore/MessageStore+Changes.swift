@@ -0,0 +1,120 @@
+import Foundation
+import SQLite
+
+/// The columns of a message row that change in place after it arrives, as raw chat.db times
+/// (0 when unset). The watcher compares snapshots of these to report edits, unsends and reads.
+struct MessageRowState: Sendable, Equatable {
+  let rowID: Int64
+  let editedAt: Int64
+  /// Only tracked for messages you sent.
+  let readAt: Int64
+}
+
+extension MessageStore {
+  /// Tapback rows after `afterRowID`, oldest first. Empty when chat.db predates tapbacks.
+  public func reactionEvents(afterRowID: Int64, chatID: Int64?, limit: Int) throws
+    -> [MessageReactionEvent]
+  {
+    guard hasReactionColumns else { return [] }
+    let bodyColumn = hasAttributedBody ? "r.attributedBody" : "NULL"
+    // associated_message_guid is "p:<part>/<guid>", "bp:<guid>", or a bare guid.
+    let targetGUID = """
+      CASE
+        WHEN instr(r.associated_message_guid, '/') > 0
+          THEN substr(r.associated_message_guid, instr(r.associated_message_guid, '/') + 1)
+        WHEN r.associated_message_guid LIKE 'bp:%' THEN substr(r.associated_message_guid, 4)
+        ELSE IFNULL(r.associated_message_guid, '')
+      END
+      """
+    var sql = """
+      SELECT r.ROWID, r.associated_message_type, IFNULL(h.id, ''), r.is_from_me, r.date,
+             IFNULL(r.text, ''), \(bodyColumn), IFNULL(cmj.chat_id, 0), \(targetGUID),
+             IFNULL(t.ROWID, 0)
+      FROM message r
+      LEFT JOIN chat_message_join cmj ON cmj.message_id = r.ROWID
+      LEFT JOIN handle h ON h.ROWID = r.handle_id
+      LEFT JOIN message t ON t.guid = \(targetGUID)
+      WHERE r.ROWID > ? AND r.associated_message_type BETWEEN 2000 AND 3006
+      """
+    var bindings: [Binding?] = [afterRowID]
+    if let chatID {
+      sql += " AND cmj.chat_id = ?"
+      bindings.append(chatID)
+    }
+    sql += " ORDER BY r.ROWID ASC LIMIT ?"
+    bindings.append(limit)
+
+    return try cachedRows(sql, bindings).compactMap { row in
+      let typeValue = intValue(row[1]) ?? 0
+      let text = stringValue(row[5])
+      let resolvedText =
+        text.isEmpty ? TypedStreamParser.parseAttributedBody(dataValue(row[6])) : text
+      let isRemoval = ReactionType.isReactionRemove(typeValue)
+      let customEmoji =
+        typeValue % 1000 == 6 ? extractCustomEmoji(from: resolvedText) : nil
+      let reactionType =
+        isRemoval
+        ? ReactionType.fromRemoval(typeValue, customEmoji: customEmoji)
+        : ReactionType(rawValue: typeValue, customEmoji: customEmoji)
+      // Sticker tapbacks and other types imsg doesn't model yet.
+      guard let reactionType else { return nil }
+      return MessageReactionEvent(
+        reaction: Reaction(
+          rowID: int64Value(row[0]) ?? 0, reactionType: reactionType,
+          sender: stringValue(row[2]), isFromMe: boolValue(row[3]),
+          date: appleDate(from: int64Value(row[4])), associatedMessageID: int64Value(row[9]) ?? 0),
+        isRemoval: isRemoval, chatID: int64Value(row[7]) ?? 0, messageGUID: stringValue(row[8]))
+    }
+  }
+
+  /// Edit and read times of the messages in `(afterRowID, throughRowID]`, tapbacks excluded.
+  /// Empty when chat.db records neither.
+  func messageRowStates(afterRowID: Int64, throughRowID: Int64, chatID: Int64?) throws
+    -> [MessageRowState]
+  {
+    guard hasEditColumns || hasReceiptColumns else { return [] }
+    let editedColumn = hasEditColumns ? "IFNULL(m.date_edited, 0)" : "0"
+    let readColumn =
+      hasReceiptColumns ? "CASE WHEN m.is_from_me = 1 THEN IFNULL(m.date_read, 0) ELSE 0 END" : "0"
+    let reactionFilter =
+      hasReactionColumns
+      ? " AND (m.associated_message_type IS NULL OR m.associated_message_type < 2000 OR m.associated_message_type > 3006)"
+      : ""
+    var sql = """
+      SELECT m.ROWID, \(editedColumn), \(readColumn)
+      FROM message m
+      """
+    var bindings: [Binding?] = []
+    if let chatID {
+      sql += " JOIN chat_message_join cmj ON cmj.message_id = m.ROWID AND cmj.chat_id = ?"
+      bindings.append(chatID)
+    }
+    sql += " WHERE m.ROWID > ? AND m.ROWID <= ?\(reactionFilter)"
+    bindings += [afterRowID, throughRowID]
+
+    return try cachedRows(sql, bindings).map { row in
+      MessageRowState(
+        rowID: int64Value(row[0]) ?? 0, editedAt: int64Value(row[1]) ?? 0,
+        readAt: int64Value(row[2]) ?? 0)
+    }
+  }
+
+  /// Whether the sender unsent (part of) the message; chat.db marks that in the summary plist.
+  func isUnsent(rowID: Int64) throws -> Bool {
+    guard hasEditColumns else { return false }
+    let sql = "SELECT message_summary_info FROM message WHERE ROWID = ?"
+    guard let row = try cachedRows(sql, [rowID]).first else { return false }
+    return !MessageStore.parseRetractedParts(dataValue(row[0])).isEmpty
+  }
+
+  /// Parts listed under `rp` in the summary plist: the ones the sender unsent.
+  static func parseRetractedParts(_ data: Data) -> [Int] {
+    guard !data.isEmpty,
+      let plist = try? PropertyListSerialization.propertyList(from: data, format: nil),
+      let parts = (plist as? [String: Any])?["rp"] as? [Any]
+    else {
+      return []
+    }
+    return parts.compactMap { ($0 as? NSNumber)?.intValue }
+  }
+}
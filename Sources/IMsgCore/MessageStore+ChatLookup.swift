@@ -0,0 +1,113 @@
+import Foundation
+import SQLite
+
+extension MessageStore {
+  /// Finds a chat by `chat_identifier` (e.g. `chat123456`) or full guid (`iMessage;+;chat123456`).
+  public func chatInfo(identifierOrGUID value: String) throws -> ChatInfo? {
+    let sql = """
+      SELECT c.ROWID
+      FROM chat c
+      WHERE c.chat_identifier = ? OR c.guid = ?
+      ORDER BY c.ROWID DESC
+      LIMIT 1
+      """
+    let chatID: Int64? = try withConnection { db in
+      for row in try db.prepare(sql, value, value) {
+        return int64Value(row[0])
+      }
+      return nil
+    }
+    guard let chatID else { return nil }
+    return try chatInfo(chatID: chatID)
+  }
+
+  /// The most recently active group chat whose participants are exactly `handles`.
+  /// Phone numbers are normalized to E.164 with `region`; emails compare case-insensitively.
+  /// With `name`, only a group with that display name matches.
+  public func groupChat(
+    participants handles: [String],
+    region: String = "US",
+    name: String? = nil
+  ) throws -> ChatInfo? {
+    let normalizer = PhoneNumberNormalizer.shared
+    let wanted = Set(handles.map { normalizer.normalizeHandle($0, region: region) })
+    guard wanted.count > 1 else { return nil }
+    let sql = """
+      SELECT chj.chat_id, MAX(IFNULL(m.date, 0)) AS last_date
+      FROM chat_handle_join chj
+      LEFT JOIN chat_message_join cmj ON cmj.chat_id = chj.chat_id
+      LEFT JOIN message m ON m.ROWID = cmj.message_id
+      GROUP BY chj.chat_id
+      HAVING COUNT(DISTINCT chj.handle_id) = ?
+      ORDER BY last_date DESC
+      """
+    let candidates: [Int64] = try withConnection { db in
+      var ids: [Int64] = []
+      for row in try db.prepare(sql, wanted.count) {
+        if let id = int64Value(row[0]) { ids.append(id) }
+      }
+      return ids
+    }
+    for chatID in candidates {
+      let members = try participants(chatID: chatID).map {
+        normalizer.normalizeHandle($0, region: region)
+      }
+      guard Set(members) == wanted, let info = try chatInfo(chatID: chatID) else { continue }
+      if let name, info.name != name { continue }
+      return info
+    }
+    return nil
+  }
+
+  /// Handle rowids whose id normalizes to the same value as `handle`.
+  func handleIDs(matching handle: String, region: String = "US") throws -> [Int64] {
+    let normalizer = PhoneNumberNormalizer.shared
+    let wanted = normalizer.normalizeHandle(handle, region: region)
+    // Pre-filter in SQL on the trailing digits so only plausible rows get parsed.
+    let digits = wanted.filter(\.isNumber)
+    let pattern = wanted.contains("@") ? wanted : "%" + String(digits.suffix(7))
+    guard wanted.contains("@") || !digits.isEmpty else { return [] }
+    let sql = "SELECT ROWID, id FROM handle WHERE LOWER(id) LIKE ?"
+    return try withConnection { db in
+      var ids: [Int64] = []
+      for row in try db.prepare(sql, pattern) {
+        guard let id = int64Value(row[0]) else { continue }
+        if normalizer.normalizeHandle(stringValue(row[1]), region: region) == wanted {
+          ids.append(id)
+        }
+      }
+      return ids
+    }
+  }
+
+  /// Handle rowids for `filter.participants`, to narrow message queries by sender in SQL; nil
+  /// when the filter has no participants. Participants matching no handle add nothing.
+  public func senderHandleIDs(for filter: MessageFilter) throws -> Set<Int64>? {
+    guard !filter.participants.isEmpty else { return nil }
+    var ids = Set<Int64>()
+    for participant in filter.participants {
+      ids.formUnion(try handleIDs(matching: participant, region: filter.region))
+    }
+    return ids
+  }
+
+  /// Handle ids (phone numbers, emails), most recently messaged first.
+  public func recentHandles(limit: Int) throws -> [String] {
+    let sql = """
+      SELECT h.id, MAX(IFNULL(m.date, 0)) AS last_date
+      FROM handle h
+      LEFT JOIN message m ON m.handle_id = h.ROWID
+      GROUP BY h.id
+      ORDER BY last_date DESC
+      LIMIT ?
+      """
+    return try withConnection { db in
+      var handles: [String] = []
+      for row in try db.prepare(sql, limit) {
+        let handle = stringValue(row[0])
+        if !handle.isEmpty { handles.append(handle) }
+      }
+      return handles
+    }
+  }
+}
@@ -0,0 +1,65 @@
+import Foundation
+import SQLite
+
+/// A message in Messages' Recently Deleted. Deleting moves the row from `chat_message_join` to
+/// `chat_recoverable_message_join` and keeps it there until it is recovered or purged.
+public struct RecoverableMessage: Sendable, Equatable {
+  /// With `chatID` set to the chat it was deleted from.
+  public let message: Message
+  public let deletedAt: Date
+
+  /// When Messages purges it, `MessageStore.recoveryWindow` after the deletion.
+  public var expiresAt: Date { deletedAt.addingTimeInterval(MessageStore.recoveryWindow) }
+
+  public func remaining(at now: Date) -> TimeInterval {
+    max(0, expiresAt.timeIntervalSince(now))
+  }
+}
+
+extension MessageStore {
+  /// How long Recently Deleted keeps a message. Apple documents 30 days ("up to 40" in some
+  /// cases), so a message can outlive its expiry for a while.
+  public static let recoveryWindow: TimeInterval = 30 * 86_400
+
+  /// Messages in Recently Deleted, newest deletion first, optionally from one chat. Empty on
+  /// macOS versions before Ventura, whose chat.db has no recoverable-message table.
+  public func recoverableMessages(chatID: Int64? = nil, limit: Int) throws
+    -> [RecoverableMessage]
+  {
+    let rows: [(chatID: Int64, messageID: Int64, deletedAt: Date)] = try withConnection { db in
+      let tables = Set(
+        try db.prepare("SELECT name FROM sqlite_master WHERE type = 'table'").map {
+          stringValue($0[0])
+        })
+      guard tables.contains("chat_recoverable_message_join") else { return [] }
+      var sql = "SELECT chat_id, message_id, delete_date FROM chat_recoverable_message_join"
+      var bindings: [Binding?] = []
+      if let chatID {
+        sql += " WHERE chat_id = ?"
+        bindings.append(chatID)
+      }
+      sql += " ORDER BY delete_date DESC, message_id DESC LIMIT ?"
+      bindings.append(limit)
+      return try db.prepare(sql, bindings).compactMap { row in
+        guard let chatID = int64Value(row[0]), let messageID = int64Value(row[1]) else {
+          return nil
+        }
+        return (chatID, messageID, appleDate(from: int64Value(row[2])))
+      }
+    }
+    let messages = Dictionary(
+      try messages(rowIDs: rows.map(\.messageID)).map { ($0.rowID, $0) },
+      uniquingKeysWith: { first, _ in first })
+    return rows.compactMap { row in
+      guard let message = messages[row.messageID] else { return nil }
+      return RecoverableMessage(
+        message: Message(
+          rowID: message.rowID, chatID: row.chatID, sender: message.sender, text: message.text,
+          date: message.date, isFromMe: message.isFromMe, service: message.service,
+          handleID: message.handleID, attachmentsCount: message.attachmentsCount,
+          guid: message.guid, replyToGUID: message.replyToGUID, app: message.app,
+          mentions: message.mentions, account: message.account, groupEvent: message.groupEvent),
+        deletedAt: row.deletedAt)
+    }
+  }
+}
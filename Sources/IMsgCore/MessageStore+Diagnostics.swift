@@ -0,0 +1,26 @@
+import Foundation
+import SQLite
+
+extension MessageStore {
+  /// Messages client schema version from `_SqliteDatabaseProperties`, falling back to
+  /// `PRAGMA user_version`. Returns nil when neither is set.
+  public func schemaVersion() throws -> String? {
+    return try withConnection { db in
+      let tableCount = try db.scalar(
+        """
+        SELECT COUNT(*) FROM sqlite_master
+        WHERE type = 'table' AND name = '_SqliteDatabaseProperties'
+        """
+      )
+      if (int64Value(tableCount) ?? 0) > 0 {
+        let sql = "SELECT value FROM _SqliteDatabaseProperties WHERE key = '_ClientVersion'"
+        for row in try db.prepare(sql) {
+          let value = stringValue(row[0])
+          if !value.isEmpty { return value }
+        }
+      }
+      let userVersion = int64Value(try db.scalar("PRAGMA user_version")) ?? 0
+      return userVersion > 0 ? String(userVersion) : nil
+    }
+  }
+}
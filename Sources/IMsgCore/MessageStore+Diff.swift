@@ -0,0 +1,98 @@
+import Foundation
+import SQLite
+
+/// Identifies a message across databases: rowids differ between Macs and backups, guids don't.
+public struct MessageKey: Sendable, Equatable {
+  public let guid: String
+  /// Rowid in the database the key came from.
+  public let rowID: Int64
+  /// Chat rowid in that database; 0 when the message is in no chat.
+  public let chatID: Int64
+  public let chatGUID: String
+  public let date: Date
+  public let isTapback: Bool
+
+  public init(
+    guid: String, rowID: Int64, chatID: Int64, chatGUID: String, date: Date,
+    isTapback: Bool = false
+  ) {
+    self.guid = guid
+    self.rowID = rowID
+    self.chatID = chatID
+    self.chatGUID = chatGUID
+    self.date = date
+    self.isTapback = isTapback
+  }
+}
+
+/// Messages one database has and the other lacks, each oldest first.
+public struct MessageDatabaseDiff: Sendable {
+  public let onlyInFirst: [MessageKey]
+  public let onlyInSecond: [MessageKey]
+  public let common: Int
+}
+
+extension MessageStore {
+  /// Visits every message that has a guid, tapbacks included; with `chatGUID` only that chat's.
+  /// Throws when chat.db is too old to record guids.
+  public func scanMessageKeys(chatGUID: String? = nil, _ body: (MessageKey) throws -> Void)
+    throws
+  {
+    guard hasReactionColumns else {
+      throw IMsgError.invalidBackup("\(path) has no message guids to compare")
+    }
+    var sql = """
+      SELECT m.guid, m.ROWID, IFNULL(cmj.chat_id, 0), IFNULL(c.guid, ''), m.date,
+             IFNULL(m.associated_message_type, 0) BETWEEN 2000 AND 3006
+      FROM message m
+      LEFT JOIN chat_message_join cmj ON cmj.message_id = m.ROWID
+      LEFT JOIN chat c ON c.ROWID = cmj.chat_id
+      WHERE IFNULL(m.guid, '') != ''
+      """
+    var bindings: [Binding?] = []
+    if let chatGUID {
+      sql += " AND c.guid = ?"
+      bindings.append(chatGUID)
+    }
+    try withConnection { db in
+      for row in try db.prepare(sql, bindings) {
+        try body(
+          MessageKey(
+            guid: stringValue(row[0]), rowID: int64Value(row[1]) ?? 0,
+            chatID: int64Value(row[2]) ?? 0, chatGUID: stringValue(row[3]),
+            date: appleDate(from: int64Value(row[4])), isTapback: boolValue(row[5])))
+      }
+    }
+  }
+
+  /// Compares two databases by message guid, e.g. a laptop's chat.db against a desktop's or a
+  /// backup, to find what iCloud sync lost.
+  public static func diff(
+    _ first: MessageStore, _ second: MessageStore, chatGUID: String? = nil
+  ) throws -> MessageDatabaseDiff {
+    // A message in two chats appears twice; the first row wins.
+    var unmatched: [String: MessageKey] = [:]
+    try first.scanMessageKeys(chatGUID: chatGUID) { key in
+      if unmatched[key.guid] == nil {
+        unmatched[key.guid] = key
+      }
+    }
+    var seen = Set<String>()
+    var onlyInSecond: [MessageKey] = []
+    var common = 0
+    try second.scanMessageKeys(chatGUID: chatGUID) { key in
+      guard seen.insert(key.guid).inserted else { return }
+      if unmatched.removeValue(forKey: key.guid) != nil {
+        common += 1
+      } else {
+        onlyInSecond.append(key)
+      }
+    }
+    let oldestFirst = { (lhs: MessageKey, rhs: MessageKey) in
+      lhs.date == rhs.date ? lhs.guid < rhs.guid : lhs.date < rhs.date
+    }
+    return MessageDatabaseDiff(
+      onlyInFirst: unmatched.values.sorted(by: oldestFirst),
+      onlyInSecond: onlyInSecond.sorted(by: oldestFirst), common: common)
+  }
+}
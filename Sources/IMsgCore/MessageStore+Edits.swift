@@ -0,0 +1,62 @@
+import Foundation
+import SQLite
+
+/// One version of an edited message part; a part's first revision is its original text.
+public struct MessageRevision: Sendable, Equatable {
+  /// Index of the message part (multi-part messages can edit parts separately).
+  public let part: Int
+  public let text: String
+  public let date: Date?
+
+  public init(part: Int, text: String, date: Date?) {
+    self.part = part
+    self.text = text
+    self.date = date
+  }
+}
+
+extension MessageStore {
+  /// Revisions from `message_summary_info`, original first. Empty when the message was never
+  /// edited or chat.db predates edit support.
+  public func editHistory(rowID: Int64) throws -> [MessageRevision] {
+    guard hasEditColumns else { return [] }
+    let sql = """
+      SELECT message_summary_info FROM message
+      WHERE ROWID = ? AND IFNULL(date_edited, 0) != 0
+      """
+    let data: Data = try withConnection { db in
+      for row in try db.prepare(sql, rowID) {
+        return dataValue(row[0])
+      }
+      return Data()
+    }
+    return MessageStore.parseEditHistory(data)
+  }
+
+  /// The summary plist keeps edits under `ec`: part index -> events of `d` (date) and
+  /// `t` (the revision's attributedBody typedstream).
+  static func parseEditHistory(_ data: Data) -> [MessageRevision] {
+    guard !data.isEmpty,
+      let plist = try? PropertyListSerialization.propertyList(from: data, format: nil),
+      let parts = (plist as? [String: Any])?["ec"] as? [String: Any]
+    else {
+      return []
+    }
+    var revisions: [MessageRevision] = []
+    for (key, value) in parts.sorted(by: { (Int($0.key) ?? 0) < (Int($1.key) ?? 0) }) {
+      guard let events = value as? [[String: Any]] else { continue }
+      for event in events {
+        let text = (event["t"] as? Data).map(TypedStreamParser.parseAttributedBody) ?? ""
+        revisions.append(
+          MessageRevision(part: Int(key) ?? 0, text: text, date: editDate(event["d"])))
+      }
+    }
+    return revisions
+  }
+
+  private static func editDate(_ value: Any?) -> Date? {
+    if let date = value as? Date { return date }
+    guard let raw = (value as? NSNumber)?.doubleValue, raw > 0 else { return nil }
+    return AppleTime.date(fromRaw: raw)
+  }
+}
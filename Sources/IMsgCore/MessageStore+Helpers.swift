@@ -18,6 +18,21 @@ extension MessageStore {
     return false
   }
 
+  /// `message.account` ("p:+15551234567" / "e:me@icloud.com"): the local account used.
+  static func detectAccountColumn(connection: Connection) -> Bool {
+    do {
+      let rows = try connection.prepare("PRAGMA table_info(message)")
+      for row in rows {
+        if let name = row[1] as? String, name.caseInsensitiveCompare("account") == .orderedSame {
+          return true
+        }
+      }
+    } catch {
+      return false
+    }
+    return false
+  }
+
   static func detectDestinationCallerID(connection: Connection) -> Bool {
     do {
       let rows = try connection.prepare("PRAGMA table_info(message)")
@@ -50,6 +65,71 @@ extension MessageStore {
     return false
   }
 
+  static func detectBalloonColumns(connection: Connection) -> Bool {
+    do {
+      let rows = try connection.prepare("PRAGMA table_info(message)")
+      var columns = Set<String>()
+      for row in rows {
+        if let name = row[1] as? String {
+          columns.insert(name.lowercased())
+        }
+      }
+      return columns.contains("balloon_bundle_id") && columns.contains("payload_data")
+    } catch {
+      return false
+    }
+  }
+
+  /// `item_type`, `group_action_type`, `other_handle` and `group_title` describe group events.
+  static func detectGroupEventColumns(connection: Connection) -> Bool {
+    do {
+      let rows = try connection.prepare("PRAGMA table_info(message)")
+      var columns = Set<String>()
+      for row in rows {
+        if let name = row[1] as? String {
+          columns.insert(name.lowercased())
+        }
+      }
+      return ["item_type", "group_action_type", "other_handle", "group_title"]
+        .allSatisfy(columns.contains)
+    } catch {
+      return false
+    }
+  }
+
+  /// `message_summary_info` (edit history plist) and `date_edited` arrived with macOS 13.
+  static func detectEditColumns(connection: Connection) -> Bool {
+    do {
+      let rows = try connection.prepare("PRAGMA table_info(message)")
+      var columns = Set<String>()
+      for row in rows {
+        if let name = row[1] as? String {
+          columns.insert(name.lowercased())
+        }
+      }
+      return columns.contains("message_summary_info") && columns.contains("date_edited")
+    } catch {
+      return false
+    }
+  }
+
+  /// `date_delivered` and `date_read`: when a sent message reached the recipient and was read,
+  /// or when you read a received one.
+  static func detectReceiptColumns(connection: Connection) -> Bool {
+    do {
+      let rows = try connection.prepare("PRAGMA table_info(message)")
+      var columns = Set<String>()
+      for row in rows {
+        if let name = row[1] as? String {
+          columns.insert(name.lowercased())
+        }
+      }
+      return columns.contains("date_delivered") && columns.contains("date_read")
+    } catch {
+      return false
+    }
+  }
+
   static func detectAttachmentUserInfo(connection: Connection) -> Bool {
     do {
       let rows = try connection.prepare("PRAGMA table_info(attachment)")
@@ -77,9 +157,7 @@ extension MessageStore {
   }
 
   func appleDate(from value: Int64?) -> Date {
-    guard let value else { return Date(timeIntervalSince1970: MessageStore.appleEpochOffset) }
-    return Date(
-      timeIntervalSince1970: (Double(value) / 1_000_000_000) + MessageStore.appleEpochOffset)
+    AppleTime.date(fromRaw: value ?? 0)
   }
 
   func stringValue(_ binding: Binding?) -> String {
@@ -113,6 +191,36 @@ extension MessageStore {
     return Data()
   }
 
+  /// Selects balloon_bundle_id and, only for app messages, the payload blob.
+  var balloonColumns: String {
+    hasBalloonColumns
+      ? "m.balloon_bundle_id, CASE WHEN m.balloon_bundle_id IS NOT NULL THEN m.payload_data END"
+      : "NULL, NULL"
+  }
+
+  /// item_type, group_action_type, the other handle's address and group_title.
+  var groupEventColumns: String {
+    hasGroupEventColumns
+      ? "m.item_type, m.group_action_type, "
+        + "(SELECT id FROM handle WHERE ROWID = m.other_handle), m.group_title"
+      : "0, 0, NULL, NULL"
+  }
+
+  func groupEvent(itemType: Binding?, actionType: Binding?, otherHandle: Binding?, title: Binding?)
+    -> GroupEvent?
+  {
+    GroupEvent(
+      itemType: intValue(itemType) ?? 0,
+      groupActionType: intValue(actionType) ?? 0,
+      otherHandle: stringValue(otherHandle),
+      title: stringValue(title))
+  }
+
+  func appMessageInfo(bundleID: String, payload: Data) -> AppMessageInfo? {
+    guard !bundleID.isEmpty else { return nil }
+    return AppMessage.info(bundleID: bundleID, payload: payload)
+  }
+
   func normalizeAssociatedGUID(_ guid: String) -> String {
     guard !guid.isEmpty else { return "" }
     guard let slash = guid.lastIndex(of: "/") else { return guid }
@@ -0,0 +1,160 @@
+import Foundation
+import SQLite
+
+/// A run of message rowids no message has.
+public struct RowIDGap: Sendable, Equatable {
+  /// The rowids on either side of the gap.
+  public let after: Int64
+  public let before: Int64
+
+  public var missing: Int64 { before - after - 1 }
+}
+
+/// What `imsg doctor --integrity` finds in chat.db. Some slack is normal: deleting messages
+/// and conversations leaves rowid gaps, and attachment files go missing when "Optimize Mac
+/// Storage" offloads them. Integrity errors, broken joins and a rowid sequence ahead of the
+/// newest message are the signs of a damaged or truncated database.
+public struct DatabaseIntegrity: Sendable, Equatable {
+  /// `PRAGMA integrity_check` errors; empty when SQLite reports `ok`.
+  public let integrityErrors: [String]
+  /// Messages no chat links to through `chat_message_join`. Tapbacks and group events
+  /// are included, since Messages joins those to their chat too.
+  public let messagesWithoutChat: Int
+  /// `chat_message_join` rows whose message or chat is gone.
+  public let danglingChatMessageJoins: Int
+  /// `message_attachment_join` rows whose message or attachment is gone.
+  public let danglingAttachmentJoins: Int
+  /// Messages pointing at a handle that doesn't exist.
+  public let messagesWithMissingHandle: Int
+  public let attachmentsWithFile: Int
+  /// Attachments whose file isn't on disk, and how many of those iCloud still holds.
+  public let attachmentsMissingFile: Int
+  public let attachmentsMissingFileInCloud: Int
+  public let messageCount: Int
+  public let minRowID: Int64
+  public let maxRowID: Int64
+  /// Rowids between the lowest and highest that no message has.
+  public let missingRowIDs: Int64
+  public let largestGap: RowIDGap?
+  /// `sqlite_sequence` for `message`: the highest rowid ever handed out.
+  public let rowIDSequence: Int64?
+
+  /// True when the sequence says newer messages existed than the newest one left.
+  public var sequenceAhead: Bool {
+    guard let rowIDSequence else { return false }
+    return rowIDSequence > maxRowID
+  }
+}
+
+extension MessageStore {
+  /// Runs `PRAGMA integrity_check` (reporting at most `maxErrors` problems) and cross-checks
+  /// the join tables, handles, attachment files and message rowids. Reads every row, so it
+  /// takes a while on large databases.
+  public func integrityReport(maxErrors: Int = 20) throws -> DatabaseIntegrity {
+    try withConnection { db in
+      var errors: [String] = []
+      for row in try db.prepare("PRAGMA integrity_check(\(max(1, maxErrors)))") {
+        let line = stringValue(row[0])
+        if line != "ok" { errors.append(line) }
+      }
+
+      let tables = Set(
+        try db.prepare("SELECT name FROM sqlite_master WHERE type = 'table'").map {
+          stringValue($0[0])
+        })
+      func count(_ sql: String, needs required: [String]) throws -> Int {
+        guard required.allSatisfy(tables.contains) else { return 0 }
+        return intValue(try db.scalar(sql)) ?? 0
+      }
+
+      let messagesWithoutChat = try count(
+        """
+        SELECT COUNT(*) FROM message m
+        WHERE NOT EXISTS (SELECT 1 FROM chat_message_join cmj WHERE cmj.message_id = m.ROWID)
+        """, needs: ["message", "chat_message_join"])
+      let danglingChatMessageJoins = try count(
+        """
+        SELECT COUNT(*) FROM chat_message_join cmj
+        WHERE NOT EXISTS (SELECT 1 FROM message m WHERE m.ROWID = cmj.message_id)
+           OR NOT EXISTS (SELECT 1 FROM chat c WHERE c.ROWID = cmj.chat_id)
+        """, needs: ["message", "chat", "chat_message_join"])
+      let danglingAttachmentJoins = try count(
+        """
+        SELECT COUNT(*) FROM message_attachment_join maj
+        WHERE NOT EXISTS (SELECT 1 FROM message m WHERE m.ROWID = maj.message_id)
+           OR NOT EXISTS (SELECT 1 FROM attachment a WHERE a.ROWID = maj.attachment_id)
+        """, needs: ["message", "attachment", "message_attachment_join"])
+      let messagesWithMissingHandle = try count(
+        """
+        SELECT COUNT(*) FROM message m
+        WHERE IFNULL(m.handle_id, 0) != 0
+          AND NOT EXISTS (SELECT 1 FROM handle h WHERE h.ROWID = m.handle_id)
+        """, needs: ["message", "handle"])
+
+      var withFile = 0
+      var missingFile = 0
+      var missingInCloud = 0
+      if tables.contains("attachment") {
+        let hasRecordID = try db.prepare("PRAGMA table_info(attachment)").contains {
+          stringValue($0[1]).caseInsensitiveCompare("ck_record_id") == .orderedSame
+        }
+        let recordID = hasRecordID ? "IFNULL(ck_record_id, '')" : "''"
+        let messagesDirectory = URL(fileURLWithPath: path).deletingLastPathComponent().path
+        let sql = "SELECT filename, \(recordID) FROM attachment WHERE IFNULL(filename, '') != ''"
+        for row in try db.prepare(sql) {
+          withFile += 1
+          let filename = stringValue(row[0])
+          if AttachmentResolver.resolve(filename, messagesDirectory: messagesDirectory).missing {
+            missingFile += 1
+            if !stringValue(row[1]).isEmpty { missingInCloud += 1 }
+          }
+        }
+      }
+
+      var messageCount = 0
+      var minRowID: Int64 = 0
+      var maxRowID: Int64 = 0
+      var largestGap: RowIDGap?
+      var sequence: Int64?
+      if tables.contains("message") {
+        for row in try db.prepare("SELECT COUNT(*), MIN(ROWID), MAX(ROWID) FROM message") {
+          messageCount = intValue(row[0]) ?? 0
+          minRowID = int64Value(row[1]) ?? 0
+          maxRowID = int64Value(row[2]) ?? 0
+        }
+        // Walks rowids in order rather than using window functions, which older SQLite
+        // builds lack.
+        var previous: Int64?
+        for row in try db.prepare("SELECT ROWID FROM message ORDER BY ROWID") {
+          guard let rowID = int64Value(row[0]) else { continue }
+          if let previous, rowID - previous - 1 > (largestGap?.missing ?? 0) {
+            largestGap = RowIDGap(after: previous, before: rowID)
+          }
+          previous = rowID
+        }
+        if tables.contains("sqlite_sequence") {
+          sequence = int64Value(
+            try db.scalar("SELECT seq FROM sqlite_sequence WHERE name = 'message'"))
+        }
+      }
+      let missingRowIDs = messageCount == 0 ? 0 : maxRowID - minRowID + 1 - Int64(messageCount)
+
+      return DatabaseIntegrity(
+        integrityErrors: errors,
+        messagesWithoutChat: messagesWithoutChat,
+        danglingChatMessageJoins: danglingChatMessageJoins,
+        danglingAttachmentJoins: danglingAttachmentJoins,
+        messagesWithMissingHandle: messagesWithMissingHandle,
+        attachmentsWithFile: withFile,
+        attachmentsMissingFile: missingFile,
+        attachmentsMissingFileInCloud: missingInCloud,
+        messageCount: messageCount,
+        minRowID: minRowID,
+        maxRowID: maxRowID,
+        missingRowIDs: missingRowIDs,
+        largestGap: largestGap,
+        rowIDSequence: sequence
+      )
+    }
+  }
+}
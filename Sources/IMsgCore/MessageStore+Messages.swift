@@ -1,34 +1,57 @@
 import Foundation
 import SQLite
 
+/// Visiting order for `MessageStore.scanMessages`.
+public enum MessageScanOrder: Sendable {
+  case newestFirst
+  case oldestFirst
+}
+
 extension MessageStore {
-  public func messages(chatID: Int64, limit: Int) throws -> [Message] {
+  /// The newest `limit` messages in a chat, newest first. `dateRange` and `handleIDs` (sender
+  /// handle rowids, see `senderHandleIDs(for:)`) are applied in SQL, so the limit counts only
+  /// messages matching them.
+  public func messages(
+    chatID: Int64, limit: Int, dateRange: Range<Date>? = nil, handleIDs: Set<Int64>? = nil
+  ) throws -> [Message] {
+    if handleIDs?.isEmpty == true { return [] }
     let bodyColumn = hasAttributedBody ? "m.attributedBody" : "NULL"
     let guidColumn = hasReactionColumns ? "m.guid" : "NULL"
     let associatedGuidColumn = hasReactionColumns ? "m.associated_message_guid" : "NULL"
     let associatedTypeColumn = hasReactionColumns ? "m.associated_message_type" : "NULL"
     let destinationCallerColumn = hasDestinationCallerID ? "m.destination_caller_id" : "NULL"
     let audioMessageColumn = hasAudioMessageColumn ? "m.is_audio_message" : "0"
+    let accountColumn = hasAccountColumn ? "m.account" : "NULL"
     let reactionFilter =
       hasReactionColumns
       ? " AND (m.associated_message_type IS NULL OR m.associated_message_type < 2000 OR m.associated_message_type > 3006)"
       : ""
+    var conditions = ""
+    var bindings: [Binding?] = [chatID]
+    if let dateRange {
+      conditions += MessageStore.dateCondition(dateRange, bindings: &bindings)
+    }
+    if let handleIDs {
+      conditions += MessageStore.senderCondition(handleIDs, bindings: &bindings)
+    }
+    bindings.append(limit)
     let sql = """
       SELECT m.ROWID, m.handle_id, h.id, IFNULL(m.text, '') AS text, m.date, m.is_from_me, m.service,
              \(audioMessageColumn) AS is_audio_message, \(destinationCallerColumn) AS destination_caller_id,
              \(guidColumn) AS guid, \(associatedGuidColumn) AS associated_guid, \(associatedTypeColumn) AS associated_type,
              (SELECT COUNT(*) FROM message_attachment_join maj WHERE maj.message_id = m.ROWID) AS attachments,
-             \(bodyColumn) AS body
+             \(bodyColumn) AS body, \(balloonColumns), \(accountColumn) AS account,
+             \(groupEventColumns)
       FROM message m
       JOIN chat_message_join cmj ON m.ROWID = cmj.message_id
       LEFT JOIN handle h ON m.handle_id = h.ROWID
-      WHERE cmj.chat_id = ?\(reactionFilter)
+      WHERE cmj.chat_id = ?\(reactionFilter)\(conditions)
       ORDER BY m.date DESC
       LIMIT ?
       """
-    return try withConnection { db in
+    return try withConnection { _ in
       var messages: [Message] = []
-      for row in try db.prepare(sql, chatID, limit) {
+      for row in try cachedRows(sql, bindings) {
         let rowID = int64Value(row[0]) ?? 0
         let handleID = int64Value(row[1])
         var sender = stringValue(row[2])
@@ -46,6 +69,10 @@ extension MessageStore {
         let associatedType = intValue(row[11])
         let attachments = intValue(row[12]) ?? 0
         let body = dataValue(row[13])
+        let app = appMessageInfo(bundleID: stringValue(row[14]), payload: dataValue(row[15]))
+        let account = stringValue(row[16])
+        let event = groupEvent(
+          itemType: row[17], actionType: row[18], otherHandle: row[19], title: row[20])
         var resolvedText = text.isEmpty ? TypedStreamParser.parseAttributedBody(body) : text
         if isAudioMessage, let transcription = try audioTranscription(for: rowID) {
           resolvedText = transcription
@@ -66,33 +93,168 @@ extension MessageStore {
             handleID: handleID,
             attachmentsCount: attachments,
             guid: guid,
-            replyToGUID: replyToGUID
+            replyToGUID: replyToGUID,
+            app: app,
+            mentions: MentionParser.mentions(in: body),
+            account: account,
+            groupEvent: event
           ))
       }
       return messages
     }
   }
 
+  /// Walks a chat's messages (tapbacks excluded) and hands them to `body` in batches of at most
+  /// `batchSize`, stepping one SQLite statement instead of materializing the whole result, so
+  /// exporting a 200k-message chat runs in constant memory. With a `limit` the newest `limit`
+  /// messages are visited in `order`. `dateRange`, `handleIDs` (sender handle rowids) and
+  /// `afterRowID` narrow the scan in SQL. Rows `matching` rejects are skipped without counting
+  /// toward `limit`, so a regex or language filter still yields the newest `limit` hits.
+  /// `body` and `matching` run on the store's queue and may query the store.
+  public func scanMessages(
+    chatID: Int64,
+    limit: Int? = nil,
+    order: MessageScanOrder = .newestFirst,
+    dateRange: Range<Date>? = nil,
+    handleIDs: Set<Int64>? = nil,
+    afterRowID: Int64? = nil,
+    batchSize: Int = 500,
+    matching: ((Message) throws -> Bool)? = nil,
+    _ body: ([Message]) throws -> Void
+  ) throws {
+    if handleIDs?.isEmpty == true { return }
+    let reactionFilter =
+      hasReactionColumns
+      ? " AND (m.associated_message_type IS NULL OR m.associated_message_type < 2000 OR m.associated_message_type > 3006)"
+      : ""
+    // A limit keeps the newest rows, so oldest-first then re-sorts just those.
+    let direction = limit == nil && order == .oldestFirst ? "ASC" : "DESC"
+    var conditions = "cmj.chat_id = ?\(reactionFilter)"
+    var bindings: [Binding?] = [chatID]
+    if let dateRange {
+      conditions += MessageStore.dateCondition(dateRange, bindings: &bindings)
+    }
+    if let handleIDs {
+      conditions += MessageStore.senderCondition(handleIDs, bindings: &bindings)
+    }
+    if let afterRowID {
+      conditions += " AND m.ROWID > ?"
+      bindings.append(afterRowID)
+    }
+    var sql = """
+      \(messageSelect())
+      WHERE \(conditions)
+      ORDER BY m.date \(direction)
+      """
+    if let limit, matching == nil {
+      sql += " LIMIT ?"
+      bindings.append(limit)
+      if order == .oldestFirst {
+        sql = "SELECT * FROM (\(sql)) ORDER BY date ASC"
+      }
+    }
+    // With `matching` the limit is counted here instead, walking newest-first until enough
+    // rows pass; oldest-first then holds those hits back and reverses them at the end.
+    let remaining = matching == nil ? nil : limit
+    let holdsHits = remaining != nil && order == .oldestFirst
+    try withConnection { db in
+      // Not a cached statement: `body` may run other queries while this one is mid-step.
+      let statement = try db.prepare(sql).bind(bindings)
+      var batch: [Message] = []
+      batch.reserveCapacity(max(batchSize, 1))
+      var hits = 0
+      while hits < remaining ?? .max, let row = try statement.failableNext() {
+        let message = try decodeMessage(row, fallbackChatID: chatID)
+        if let matching, try !matching(message) { continue }
+        batch.append(message)
+        hits += 1
+        if !holdsHits, batch.count >= batchSize {
+          try body(batch)
+          batch.removeAll(keepingCapacity: true)
+        }
+      }
+      if holdsHits {
+        batch.reverse()
+        for start in stride(from: 0, to: batch.count, by: max(batchSize, 1)) {
+          try body(Array(batch[start..<min(start + max(batchSize, 1), batch.count)]))
+        }
+      } else if !batch.isEmpty {
+        try body(batch)
+      }
+    }
+  }
+
+  /// Messages (tapbacks excluded) whose text contains `query`, case-insensitively, newest
+  /// first. Rows with only an attributedBody are decoded and checked in Swift, one at a time,
+  /// so the scan ends at the `limit`th hit; only the hits are then loaded in full.
+  public func searchMessages(query: String, chatID: Int64? = nil, limit: Int) throws
+    -> [Message]
+  {
+    guard limit > 0 else { return [] }
+    let reactionFilter =
+      hasReactionColumns
+      ? " AND (m.associated_message_type IS NULL OR m.associated_message_type < 2000 OR m.associated_message_type > 3006)"
+      : ""
+    let bodyColumn =
+      hasAttributedBody ? "CASE WHEN IFNULL(m.text, '') = '' THEN m.attributedBody END" : "NULL"
+    let bodyCondition =
+      hasAttributedBody ? " OR (IFNULL(m.text, '') = '' AND m.attributedBody IS NOT NULL)" : ""
+    var sql = "SELECT m.ROWID, IFNULL(m.text, ''), \(bodyColumn) FROM message m"
+    var bindings: [Binding?] = [MessageStore.containsPattern(query)]
+    var chatCondition = ""
+    if let chatID {
+      sql += " JOIN chat_message_join cmj ON m.ROWID = cmj.message_id"
+      chatCondition = " AND cmj.chat_id = ?"
+      bindings.append(chatID)
+    }
+    sql += """
+       WHERE (m.text LIKE ? ESCAPE '\\'\(bodyCondition))\(reactionFilter)\(chatCondition)
+      ORDER BY m.date DESC
+      """
+    let rowIDs: [Int64] = try withConnection { db in
+      let statement = try db.prepare(sql).bind(bindings)
+      var found: [Int64] = []
+      while found.count < limit, let row = try statement.failableNext() {
+        var text = stringValue(row[1])
+        if text.isEmpty {
+          text = TypedStreamParser.parseAttributedBody(dataValue(row[2]))
+        }
+        guard text.range(of: query, options: .caseInsensitive) != nil else { continue }
+        found.append(int64Value(row[0]) ?? 0)
+      }
+      return found
+    }
+    return try messages(rowIDs: rowIDs)
+  }
+
+  /// Dates of a chat's messages (tapbacks excluded), in no particular order, without decoding
+  /// the rows; e.g. to find which months a chat spans.
+  public func scanMessageDates(
+    chatID: Int64, afterRowID: Int64? = nil, _ body: (Date) throws -> Void
+  ) throws {
+    let reactionFilter =
+      hasReactionColumns
+      ? " AND (m.associated_message_type IS NULL OR m.associated_message_type < 2000 OR m.associated_message_type > 3006)"
+      : ""
+    let sql = """
+      SELECT m.date FROM message m
+      JOIN chat_message_join cmj ON m.ROWID = cmj.message_id
+      WHERE cmj.chat_id = ? AND m.ROWID > ?\(reactionFilter)
+      """
+    try withConnection { db in
+      for row in try db.prepare(sql, chatID, afterRowID ?? 0) {
+        try body(appleDate(from: int64Value(row[0])))
+      }
+    }
+  }
+
   public func messagesAfter(afterRowID: Int64, chatID: Int64?, limit: Int) throws -> [Message] {
-    let bodyColumn = hasAttributedBody ? "m.attributedBody" : "NULL"
-    let guidColumn = hasReactionColumns ? "m.guid" : "NULL"
-    let associatedGuidColumn = hasReactionColumns ? "m.associated_message_guid" : "NULL"
-    let associatedTypeColumn = hasReactionColumns ? "m.associated_message_type" : "NULL"
-    let destinationCallerColumn = hasDestinationCallerID ? "m.destination_caller_id" : "NULL"
-    let audioMessageColumn = hasAudioMessageColumn ? "m.is_audio_message" : "0"
     let reactionFilter =
       hasReactionColumns
       ? " AND (m.associated_message_type IS NULL OR m.associated_message_type < 2000 OR m.associated_message_type > 3006)"
       : ""
     var sql = """
-      SELECT m.ROWID, cmj.chat_id, m.handle_id, h.id, IFNULL(m.text, '') AS text, m.date, m.is_from_me, m.service,
-             \(audioMessageColumn) AS is_audio_message, \(destinationCallerColumn) AS destination_caller_id,
-             \(guidColumn) AS guid, \(associatedGuidColumn) AS associated_guid, \(associatedTypeColumn) AS associated_type,
-             (SELECT COUNT(*) FROM message_attachment_join maj WHERE maj.message_id = m.ROWID) AS attachments,
-             \(bodyColumn) AS body
-      FROM message m
-      LEFT JOIN chat_message_join cmj ON m.ROWID = cmj.message_id
-      LEFT JOIN handle h ON m.handle_id = h.ROWID
+      \(messageSelect())
       WHERE m.ROWID > ?\(reactionFilter)
       """
     var bindings: [Binding?] = [afterRowID]
@@ -103,51 +265,167 @@ extension MessageStore {
     sql += " ORDER BY m.ROWID ASC LIMIT ?"
     bindings.append(limit)
 
+    return try cachedRows(sql, bindings).map { try decodeMessage($0, fallbackChatID: chatID) }
+  }
+
+  /// Fetches one message by rowid, including reaction rows.
+  public func message(rowID: Int64) throws -> Message? {
+    try singleMessage(condition: "m.ROWID = ?", binding: rowID)
+  }
+
+  /// Fetches one message by guid, the only identifier that is stable across devices.
+  public func message(guid: String) throws -> Message? {
+    guard hasReactionColumns else { return nil }
+    return try singleMessage(condition: "m.guid = ?", binding: guid)
+  }
+
+  private func singleMessage(condition: String, binding: Binding) throws -> Message? {
+    let sql = """
+      \(messageSelect())
+      WHERE \(condition)
+      LIMIT 1
+      """
     return try withConnection { db in
-      var messages: [Message] = []
-      for row in try db.prepare(sql, bindings) {
-        let rowID = int64Value(row[0]) ?? 0
-        let resolvedChatID = int64Value(row[1]) ?? chatID ?? 0
-        let handleID = int64Value(row[2])
-        var sender = stringValue(row[3])
-        let text = stringValue(row[4])
-        let date = appleDate(from: int64Value(row[5]))
-        let isFromMe = boolValue(row[6])
-        let service = stringValue(row[7])
-        let isAudioMessage = boolValue(row[8])
-        let destinationCallerID = stringValue(row[9])
-        if sender.isEmpty && !destinationCallerID.isEmpty {
-          sender = destinationCallerID
-        }
-        let guid = stringValue(row[10])
-        let associatedGuid = stringValue(row[11])
-        let associatedType = intValue(row[12])
-        let attachments = intValue(row[13]) ?? 0
-        let body = dataValue(row[14])
-        var resolvedText = text.isEmpty ? TypedStreamParser.parseAttributedBody(body) : text
-        if isAudioMessage, let transcription = try audioTranscription(for: rowID) {
-          resolvedText = transcription
+      for row in try db.prepare(sql, binding) {
+        return try decodeMessage(row, fallbackChatID: nil)
+      }
+      return nil
+    }
+  }
+
+  /// ` AND m.date` within `range`, whose bounds are appended to `bindings`. Rows hold seconds
+  /// or nanoseconds (see `AppleTime.unit(of:)`), so this is one plain range per unit on the raw
+  /// column rather than a conversion inside the comparison, which would rule out the date index.
+  static func dateCondition(_ range: Range<Date>, bindings: inout [Binding?]) -> String {
+    let start = AppleTime.raw(from: range.lowerBound)
+    let end = AppleTime.raw(from: range.upperBound)
+    // Seconds rows are whole seconds: round both bounds up to keep `start <= date < end`.
+    func seconds(_ nanoseconds: Int64) -> Int64 {
+      let (quotient, remainder) = nanoseconds.quotientAndRemainder(dividingBy: 1_000_000_000)
+      return remainder > 0 ? quotient + 1 : quotient
+    }
+    bindings.append(max(start, Int64(AppleTime.nanosecondThreshold)))
+    bindings.append(end)
+    bindings.append(seconds(start))
+    bindings.append(seconds(end))
+    return " AND ((m.date >= ? AND m.date < ?) OR (m.date >= ? AND m.date < ?))"
+  }
+
+  /// ` AND m.handle_id IN (…)` for `handleIDs`, whose values are appended to `bindings`.
+  static func senderCondition(_ handleIDs: Set<Int64>, bindings: inout [Binding?]) -> String {
+    let sorted = handleIDs.sorted()
+    bindings.append(contentsOf: sorted.map { $0 as Binding? })
+    let placeholders = Array(repeating: "?", count: sorted.count).joined(separator: ",")
+    return " AND m.handle_id IN (\(placeholders))"
+  }
+
+  /// Fetches many messages by rowid with one query per chunk of ids, in the order given.
+  /// Rowids not in chat.db are left out and repeated ones come back once.
+  public func messages(rowIDs: [Int64]) throws -> [Message] {
+    let found = try messagesMatching(column: "m.ROWID", values: rowIDs)
+    let byRowID = Dictionary(found.map { ($0.rowID, $0) }, uniquingKeysWith: { first, _ in first })
+    var seen = Set<Int64>()
+    return rowIDs.compactMap { seen.insert($0).inserted ? byRowID[$0] : nil }
+  }
+
+  /// Like `messages(rowIDs:)`, by guid.
+  public func messages(guids: [String]) throws -> [Message] {
+    guard hasReactionColumns else { return [] }
+    let found = try messagesMatching(column: "m.guid", values: guids)
+    let byGUID = Dictionary(found.map { ($0.guid, $0) }, uniquingKeysWith: { first, _ in first })
+    var seen = Set<String>()
+    return guids.compactMap { seen.insert($0).inserted ? byGUID[$0] : nil }
+  }
+
+  /// A message in several chats matches once per chat; callers keep the first.
+  private func messagesMatching<Value: Binding>(column: String, values: [Value]) throws
+    -> [Message]
+  {
+    var messages: [Message] = []
+    for chunk in MessageStore.chunked(values) {
+      let placeholders = Array(repeating: "?", count: chunk.count).joined(separator: ",")
+      let sql = """
+        \(messageSelect())
+        WHERE \(column) IN (\(placeholders))
+        """
+      try withConnection { db in
+        for row in try db.prepare(sql, chunk.map { $0 as Binding? }) {
+          messages.append(try decodeMessage(row, fallbackChatID: nil))
         }
-        let replyToGUID = replyToGUID(
-          associatedGuid: associatedGuid,
-          associatedType: associatedType
-        )
-        messages.append(
-          Message(
-            rowID: rowID,
-            chatID: resolvedChatID,
-            sender: sender,
-            text: resolvedText,
-            date: date,
-            isFromMe: isFromMe,
-            service: service,
-            handleID: handleID,
-            attachmentsCount: attachments,
-            guid: guid,
-            replyToGUID: replyToGUID
-          ))
       }
-      return messages
     }
+    return messages
+  }
+
+  /// Columns decoded by `decodeMessage`, for queries not scoped to a single chat.
+  private func messageSelect() -> String {
+    let bodyColumn = hasAttributedBody ? "m.attributedBody" : "NULL"
+    let guidColumn = hasReactionColumns ? "m.guid" : "NULL"
+    let associatedGuidColumn = hasReactionColumns ? "m.associated_message_guid" : "NULL"
+    let associatedTypeColumn = hasReactionColumns ? "m.associated_message_type" : "NULL"
+    let destinationCallerColumn = hasDestinationCallerID ? "m.destination_caller_id" : "NULL"
+    let audioMessageColumn = hasAudioMessageColumn ? "m.is_audio_message" : "0"
+    let accountColumn = hasAccountColumn ? "m.account" : "NULL"
+    return """
+      SELECT m.ROWID, cmj.chat_id, m.handle_id, h.id, IFNULL(m.text, '') AS text, m.date, m.is_from_me, m.service,
+             \(audioMessageColumn) AS is_audio_message, \(destinationCallerColumn) AS destination_caller_id,
+             \(guidColumn) AS guid, \(associatedGuidColumn) AS associated_guid, \(associatedTypeColumn) AS associated_type,
+             (SELECT COUNT(*) FROM message_attachment_join maj WHERE maj.message_id = m.ROWID) AS attachments,
+             \(bodyColumn) AS body, \(balloonColumns), \(accountColumn) AS account,
+             \(groupEventColumns)
+      FROM message m
+      LEFT JOIN chat_message_join cmj ON m.ROWID = cmj.message_id
+      LEFT JOIN handle h ON m.handle_id = h.ROWID
+      """
+  }
+
+  private func decodeMessage(_ row: [Binding?], fallbackChatID: Int64?) throws -> Message {
+    let rowID = int64Value(row[0]) ?? 0
+    let resolvedChatID = int64Value(row[1]) ?? fallbackChatID ?? 0
+    let handleID = int64Value(row[2])
+    var sender = stringValue(row[3])
+    let text = stringValue(row[4])
+    let date = appleDate(from: int64Value(row[5]))
+    let isFromMe = boolValue(row[6])
+    let service = stringValue(row[7])
+    let isAudioMessage = boolValue(row[8])
+    let destinationCallerID = stringValue(row[9])
+    if sender.isEmpty && !destinationCallerID.isEmpty {
+      sender = destinationCallerID
+    }
+    let guid = stringValue(row[10])
+    let associatedGuid = stringValue(row[11])
+    let associatedType = intValue(row[12])
+    let attachments = intValue(row[13]) ?? 0
+    let body = dataValue(row[14])
+    let app = appMessageInfo(bundleID: stringValue(row[15]), payload: dataValue(row[16]))
+    let account = stringValue(row[17])
+    let event = groupEvent(
+      itemType: row[18], actionType: row[19], otherHandle: row[20], title: row[21])
+    var resolvedText = text.isEmpty ? TypedStreamParser.parseAttributedBody(body) : text
+    if isAudioMessage, let transcription = try audioTranscription(for: rowID) {
+      resolvedText = transcription
+    }
+    let replyToGUID = replyToGUID(
+      associatedGuid: associatedGuid,
+      associatedType: associatedType
+    )
+    return Message(
+      rowID: rowID,
+      chatID: resolvedChatID,
+      sender: sender,
+      text: resolvedText,
+      date: date,
+      isFromMe: isFromMe,
+      service: service,
+      handleID: handleID,
+      attachmentsCount: attachments,
+      guid: guid,
+      replyToGUID: replyToGUID,
+      app: app,
+      mentions: MentionParser.mentions(in: body),
+      account: account,
+      groupEvent: event
+    )
   }
 }
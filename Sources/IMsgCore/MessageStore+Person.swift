@@ -0,0 +1,141 @@
+import Foundation
+import SQLite
+
+/// One conversation someone takes part in, as `imsg person` lists it. Counts leave out
+/// tapbacks, like `imsg chats`.
+public struct PersonChat: Sendable, Equatable {
+  public let chat: ChatInfo
+  public let participants: [String]
+  public let messages: Int
+  /// Messages this person sent in the chat.
+  public let fromPerson: Int
+  /// Attachments this person sent in the chat or received from me; files between other
+  /// members of a group are left out.
+  public let attachments: Int
+  /// From `total_bytes`, so files offloaded to iCloud still count.
+  public let attachmentBytes: Int64
+  public let firstDate: Date?
+  public let lastDate: Date?
+
+  public var isGroup: Bool { participants.count > 1 }
+}
+
+/// Everything chat.db holds about one phone number or email across chats.
+public struct PersonSummary: Sendable, Equatable {
+  /// The handle normalized with the requested region.
+  public let handle: String
+  /// `handle.id` values that normalize to it, e.g. the same number stored two ways.
+  public let handleIDs: [String]
+  /// Most recently active first.
+  public let chats: [PersonChat]
+  /// Attachments this person sent or received in those chats by kind (image, video, audio,
+  /// other), each counted once even when its message sits in two chats.
+  public let attachmentKinds: [String: Int]
+  public let attachmentBytes: Int64
+
+  public var messages: Int { chats.reduce(0) { $0 + $1.messages } }
+  public var fromPerson: Int { chats.reduce(0) { $0 + $1.fromPerson } }
+  public var attachments: Int { attachmentKinds.values.reduce(0, +) }
+  public var firstDate: Date? { chats.compactMap(\.firstDate).min() }
+  public var lastDate: Date? { chats.compactMap(\.lastDate).max() }
+}
+
+extension MessageStore {
+  /// Every chat `handle` is a participant of or has sent a message in, 1:1 and group alike,
+  /// with message and attachment totals. Nil when no handle in chat.db matches.
+  public func person(handle: String, region: String = "US") throws -> PersonSummary? {
+    let ids = try handleIDs(matching: handle, region: region)
+    guard !ids.isEmpty else { return nil }
+    let placeholders = Array(repeating: "?", count: ids.count).joined(separator: ",")
+    let bindings = ids.map { $0 as Binding? }
+    let notReaction =
+      hasReactionColumns
+      ? "IFNULL(m.associated_message_type, 0) NOT BETWEEN 2000 AND 3006" : "1"
+
+    let chatSQL = """
+      SELECT chat_id FROM chat_handle_join WHERE handle_id IN (\(placeholders))
+      UNION
+      SELECT cmj.chat_id FROM message m
+      JOIN chat_message_join cmj ON cmj.message_id = m.ROWID
+      WHERE m.handle_id IN (\(placeholders))
+      """
+    let messageSQL = """
+      SELECT COUNT(*),
+             SUM(CASE WHEN m.is_from_me = 0 AND m.handle_id IN (\(placeholders))
+                 THEN 1 ELSE 0 END),
+             MIN(m.date), MAX(m.date)
+      FROM chat_message_join cmj
+      JOIN message m ON m.ROWID = cmj.message_id
+      WHERE cmj.chat_id = ? AND \(notReaction)
+      """
+    let attachmentSQL = """
+      SELECT a.ROWID, IFNULL(a.mime_type, ''), IFNULL(a.total_bytes, 0)
+      FROM chat_message_join cmj
+      JOIN message m ON m.ROWID = cmj.message_id
+      JOIN message_attachment_join maj ON maj.message_id = cmj.message_id
+      JOIN attachment a ON a.ROWID = maj.attachment_id
+      WHERE cmj.chat_id = ? AND (m.is_from_me = 1 OR m.handle_id IN (\(placeholders)))
+      """
+
+    let (handleNames, chatIDs): ([String], [Int64]) = try withConnection { db in
+      var names: [String] = []
+      for row in try db.prepare(
+        "SELECT DISTINCT id FROM handle WHERE ROWID IN (\(placeholders)) ORDER BY id", bindings)
+      {
+        names.append(stringValue(row[0]))
+      }
+      var chatIDs: [Int64] = []
+      for row in try db.prepare(chatSQL, bindings + bindings) {
+        if let id = int64Value(row[0]) { chatIDs.append(id) }
+      }
+      return (names, chatIDs)
+    }
+
+    var chats: [PersonChat] = []
+    var kinds: [String: Int] = [:]
+    var bytes: Int64 = 0
+    var seenAttachments = Set<Int64>()
+    for chatID in chatIDs {
+      guard let info = try chatInfo(chatID: chatID) else { continue }
+      var messages = 0
+      var fromPerson = 0
+      var firstDate: Date?
+      var lastDate: Date?
+      var attachments = 0
+      var chatBytes: Int64 = 0
+      try withConnection { db in
+        for row in try db.prepare(messageSQL, bindings + [chatID as Binding?]) {
+          messages = intValue(row[0]) ?? 0
+          fromPerson = intValue(row[1]) ?? 0
+          if messages > 0 {
+            firstDate = appleDate(from: int64Value(row[2]))
+            lastDate = appleDate(from: int64Value(row[3]))
+          }
+        }
+        for row in try db.prepare(attachmentSQL, [chatID as Binding?] + bindings) {
+          let size = int64Value(row[2]) ?? 0
+          attachments += 1
+          chatBytes += size
+          guard let id = int64Value(row[0]), seenAttachments.insert(id).inserted else { continue }
+          kinds[MessageStore.attachmentKind(mimeType: stringValue(row[1])), default: 0] += 1
+          bytes += size
+        }
+      }
+      chats.append(
+        PersonChat(
+          chat: info, participants: try participants(chatID: chatID), messages: messages,
+          fromPerson: fromPerson, attachments: attachments, attachmentBytes: chatBytes,
+          firstDate: firstDate, lastDate: lastDate))
+    }
+    chats.sort { ($0.lastDate ?? .distantPast) > ($1.lastDate ?? .distantPast) }
+    return PersonSummary(
+      handle: PhoneNumberNormalizer.shared.normalizeHandle(handle, region: region),
+      handleIDs: handleNames, chats: chats, attachmentKinds: kinds, attachmentBytes: bytes)
+  }
+
+  /// `image`, `video` or `audio` from the MIME type's top level; anything else is `other`.
+  static func attachmentKind(mimeType: String) -> String {
+    let top = mimeType.split(separator: "/").first.map { $0.lowercased() } ?? ""
+    return ["image", "video", "audio"].contains(top) ? top : "other"
+  }
+}
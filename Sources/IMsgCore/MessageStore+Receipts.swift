@@ -0,0 +1,52 @@
+import Foundation
+import SQLite
+
+/// Delivery and read state of a message for one participant (`me` for received messages).
+public struct MessageReceipt: Sendable, Equatable {
+  public let handle: String
+  public let deliveredAt: Date?
+  public let readAt: Date?
+  /// False in group chats: chat.db keeps one delivery time per message rather than one per
+  /// participant, so every participant shows the message's, and read times aren't recorded.
+  public let perParticipant: Bool
+
+  public init(handle: String, deliveredAt: Date?, readAt: Date?, perParticipant: Bool) {
+    self.handle = handle
+    self.deliveredAt = deliveredAt
+    self.readAt = readAt
+    self.perParticipant = perParticipant
+  }
+}
+
+extension MessageStore {
+  /// Receipts for `message`: each recipient of a message you sent, or just you for a received
+  /// one. Empty when chat.db has no receipt columns.
+  public func receipts(for message: Message) throws -> [MessageReceipt] {
+    guard hasReceiptColumns else { return [] }
+    let sql = """
+      SELECT IFNULL(date_delivered, 0), IFNULL(date_read, 0) FROM message WHERE ROWID = ?
+      """
+    let times: (delivered: Int64, read: Int64) = try withConnection { db in
+      for row in try db.prepare(sql, message.rowID) {
+        return (int64Value(row[0]) ?? 0, int64Value(row[1]) ?? 0)
+      }
+      return (0, 0)
+    }
+    let delivered = times.delivered > 0 ? appleDate(from: times.delivered) : nil
+    let read = times.read > 0 ? appleDate(from: times.read) : nil
+    guard message.isFromMe else {
+      return [
+        MessageReceipt(handle: "me", deliveredAt: message.date, readAt: read, perParticipant: true)
+      ]
+    }
+    let recipients = try participants(chatID: message.chatID)
+    guard recipients.count > 1 else {
+      return recipients.map {
+        MessageReceipt(handle: $0, deliveredAt: delivered, readAt: read, perParticipant: true)
+      }
+    }
+    return recipients.map {
+      MessageReceipt(handle: $0, deliveredAt: delivered, readAt: nil, perParticipant: false)
+    }
+  }
+}
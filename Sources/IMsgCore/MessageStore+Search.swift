@@ -0,0 +1,86 @@
+import Foundation
+import SQLite
+
+/// An attachment whose file name matched a search, with the message that carries it.
+public struct AttachmentMatch: Sendable, Equatable {
+  public let messageRowID: Int64
+  public let chatID: Int64
+  public let sender: String
+  public let isFromMe: Bool
+  public let date: Date
+  public let meta: AttachmentMeta
+
+  public init(
+    messageRowID: Int64, chatID: Int64, sender: String, isFromMe: Bool, date: Date,
+    meta: AttachmentMeta
+  ) {
+    self.messageRowID = messageRowID
+    self.chatID = chatID
+    self.sender = sender
+    self.isFromMe = isFromMe
+    self.date = date
+    self.meta = meta
+  }
+}
+
+extension MessageStore {
+  /// `%query%` for `LIKE ? ESCAPE '\'`, with the query's own wildcards escaped.
+  static func containsPattern(_ query: String) -> String {
+    var escaped = ""
+    for character in query {
+      if character == "%" || character == "_" || character == "\\" {
+        escaped.append("\\")
+      }
+      escaped.append(character)
+    }
+    return "%\(escaped)%"
+  }
+
+  /// Attachments whose transfer name or stored path contains `query` (ASCII letters compare
+  /// case-insensitively), newest first.
+  public func searchAttachments(query: String, chatID: Int64? = nil, limit: Int) throws
+    -> [AttachmentMatch]
+  {
+    let pattern = MessageStore.containsPattern(query)
+    var sql = """
+      SELECT m.ROWID, IFNULL(cmj.chat_id, 0), IFNULL(h.id, ''), m.is_from_me, m.date,
+             a.filename, a.transfer_name, a.uti, a.mime_type, a.total_bytes, a.is_sticker
+      FROM attachment a
+      JOIN message_attachment_join maj ON maj.attachment_id = a.ROWID
+      JOIN message m ON m.ROWID = maj.message_id
+      LEFT JOIN chat_message_join cmj ON cmj.message_id = m.ROWID
+      LEFT JOIN handle h ON h.ROWID = m.handle_id
+      WHERE (IFNULL(a.transfer_name, '') LIKE ? ESCAPE '\\'
+             OR IFNULL(a.filename, '') LIKE ? ESCAPE '\\')
+      """
+    var bindings: [Binding?] = [pattern, pattern]
+    if let chatID {
+      sql += " AND cmj.chat_id = ?"
+      bindings.append(chatID)
+    }
+    sql += " ORDER BY m.date DESC LIMIT ?"
+    bindings.append(limit)
+    return try withConnection { db in
+      try db.prepare(sql, bindings).map { row in
+        let filename = stringValue(row[5])
+        let resolved = AttachmentResolver.resolve(filename, messagesDirectory: messagesDirectory)
+        return AttachmentMatch(
+          messageRowID: int64Value(row[0]) ?? 0,
+          chatID: int64Value(row[1]) ?? 0,
+          sender: stringValue(row[2]),
+          isFromMe: boolValue(row[3]),
+          date: appleDate(from: int64Value(row[4])),
+          meta: AttachmentMeta(
+            filename: filename,
+            transferName: stringValue(row[6]),
+            uti: stringValue(row[7]),
+            mimeType: stringValue(row[8]),
+            totalBytes: int64Value(row[9]) ?? 0,
+            isSticker: boolValue(row[10]),
+            originalPath: resolved.resolved,
+            missing: resolved.missing
+          ))
+      }
+    }
+  }
+}
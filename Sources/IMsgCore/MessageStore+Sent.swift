@@ -0,0 +1,49 @@
+import Foundation
+import SQLite
+
+/// An attachment row Messages created for a file you sent, with the message that carries it.
+public struct SentAttachmentRecord: Sendable, Equatable {
+  public let messageRowID: Int64
+  public let messageGUID: String
+  public let chatID: Int64
+  public let attachmentGUID: String
+  public let transferName: String
+
+  public init(
+    messageRowID: Int64, messageGUID: String, chatID: Int64, attachmentGUID: String,
+    transferName: String
+  ) {
+    self.messageRowID = messageRowID
+    self.messageGUID = messageGUID
+    self.chatID = chatID
+    self.attachmentGUID = attachmentGUID
+    self.transferName = transferName
+  }
+}
+
+extension MessageStore {
+  /// Attachments on your own messages after `afterRowID`, oldest first; how `imsg send` finds
+  /// the rows a send created once Messages writes them.
+  public func sentAttachments(afterRowID: Int64) throws -> [SentAttachmentRecord] {
+    let sql = """
+      SELECT m.ROWID, IFNULL(m.guid, ''), IFNULL(cmj.chat_id, 0), IFNULL(a.guid, ''),
+             IFNULL(a.transfer_name, '')
+      FROM message m
+      JOIN message_attachment_join maj ON maj.message_id = m.ROWID
+      JOIN attachment a ON a.ROWID = maj.attachment_id
+      LEFT JOIN chat_message_join cmj ON cmj.message_id = m.ROWID
+      WHERE m.is_from_me = 1 AND m.ROWID > ?
+      ORDER BY m.ROWID, a.ROWID
+      """
+    return try withConnection { db in
+      try db.prepare(sql, afterRowID).map { row in
+        SentAttachmentRecord(
+          messageRowID: int64Value(row[0]) ?? 0,
+          messageGUID: stringValue(row[1]),
+          chatID: int64Value(row[2]) ?? 0,
+          attachmentGUID: stringValue(row[3]),
+          transferName: stringValue(row[4]))
+      }
+    }
+  }
+}
@@ -0,0 +1,164 @@
+import Foundation
+import SQLite
+
+/// Rows of one chat.db table by CloudKit sync state (`ck_sync_state`): 1 is synced, 0 has not
+/// been uploaded yet, and anything else is a state Messages uses in between (conflicts,
+/// pending deletes).
+public struct CloudSyncCounts: Sendable, Equatable {
+  public let total: Int
+  public let synced: Int
+  public let pendingUpload: Int
+
+  public var other: Int { total - synced - pendingUpload }
+
+  public init(total: Int, synced: Int, pendingUpload: Int) {
+    self.total = total
+    self.synced = synced
+    self.pendingUpload = pendingUpload
+  }
+}
+
+/// A `kvtable` entry Messages keeps for syncing, such as a CloudKit change token.
+public struct CloudSyncMarker: Sendable, Equatable {
+  public let key: String
+  /// Dates, numbers and strings as text; other values as their size in bytes.
+  public let value: String
+}
+
+/// What chat.db shows of Messages in iCloud. Only the local side is visible: messages that
+/// exist in iCloud but were never downloaded don't appear anywhere, so attachments kept only
+/// in iCloud are the measurable part of pending downloads.
+public struct CloudSyncStatus: Sendable, Equatable {
+  /// False for databases without the `ck_sync_state` columns (before Messages in iCloud).
+  public let hasCloudKitColumns: Bool
+  public let messages: CloudSyncCounts?
+  public let chats: CloudSyncCounts?
+  public let attachments: CloudSyncCounts?
+  /// Attachments with a CloudKit record whose file isn't on disk: fetched on demand when
+  /// "Optimize Mac Storage" removed them, or missing when never downloaded.
+  public let attachmentsInCloudOnly: Int
+  /// Newest message marked synced.
+  public let lastSyncedMessageAt: Date?
+  /// Deletions recorded in `sync_deleted_messages`, `_chats` and `_attachments` that have not
+  /// been pushed to iCloud yet.
+  public let pendingDeletions: Int
+  public let markers: [CloudSyncMarker]
+}
+
+extension MessageStore {
+  public func cloudSyncStatus() throws -> CloudSyncStatus {
+    try withConnection { db in
+      let tables = Set(
+        try db.prepare("SELECT name FROM sqlite_master WHERE type = 'table'").map {
+          stringValue($0[0])
+        })
+      func hasSyncState(_ table: String) throws -> Bool {
+        guard tables.contains(table) else { return false }
+        return try db.prepare("PRAGMA table_info(\(table))").contains {
+          stringValue($0[1]).caseInsensitiveCompare("ck_sync_state") == .orderedSame
+        }
+      }
+      func counts(_ table: String) throws -> CloudSyncCounts? {
+        guard try hasSyncState(table) else { return nil }
+        let sql = """
+          SELECT COUNT(*),
+                 IFNULL(SUM(CASE WHEN ck_sync_state = 1 THEN 1 ELSE 0 END), 0),
+                 IFNULL(SUM(CASE WHEN IFNULL(ck_sync_state, 0) = 0 THEN 1 ELSE 0 END), 0)
+          FROM \(table)
+          """
+        for row in try db.prepare(sql) {
+          return CloudSyncCounts(
+            total: intValue(row[0]) ?? 0, synced: intValue(row[1]) ?? 0,
+            pendingUpload: intValue(row[2]) ?? 0)
+        }
+        return nil
+      }
+
+      let messages = try counts("message")
+      var lastSynced: Date?
+      if messages != nil {
+        let raw = int64Value(try db.scalar("SELECT MAX(date) FROM message WHERE ck_sync_state = 1"))
+        lastSynced = raw.map { appleDate(from: $0) }
+      }
+
+      var inCloudOnly = 0
+      if tables.contains("attachment"),
+        try db.prepare("PRAGMA table_info(attachment)").contains({
+          stringValue($0[1]).caseInsensitiveCompare("ck_record_id") == .orderedSame
+        })
+      {
+        let messagesDirectory = URL(fileURLWithPath: path).deletingLastPathComponent().path
+        let sql = """
+          SELECT IFNULL(filename, '') FROM attachment WHERE IFNULL(ck_record_id, '') != ''
+          """
+        for row in try db.prepare(sql) {
+          let filename = stringValue(row[0])
+          if filename.isEmpty
+            || AttachmentResolver.resolve(filename, messagesDirectory: messagesDirectory).missing
+          {
+            inCloudOnly += 1
+          }
+        }
+      }
+
+      var pendingDeletions = 0
+      for table in ["sync_deleted_messages", "sync_deleted_chats", "sync_deleted_attachments"]
+      where tables.contains(table) {
+        pendingDeletions += intValue(try db.scalar("SELECT COUNT(*) FROM \(table)")) ?? 0
+      }
+
+      var markers: [CloudSyncMarker] = []
+      if tables.contains("kvtable") {
+        let sql = """
+          SELECT key, value FROM kvtable
+          WHERE LOWER(key) LIKE '%sync%' OR LOWER(key) LIKE '%token%'
+          ORDER BY key
+          """
+        for row in try db.prepare(sql) {
+          markers.append(
+            CloudSyncMarker(key: stringValue(row[0]), value: MessageStore.describe(row[1])))
+        }
+      }
+
+      return CloudSyncStatus(
+        hasCloudKitColumns: messages != nil,
+        messages: messages,
+        chats: try counts("chat"),
+        attachments: try counts("attachment"),
+        attachmentsInCloudOnly: inCloudOnly,
+        lastSyncedMessageAt: lastSynced,
+        pendingDeletions: pendingDeletions,
+        markers: markers
+      )
+    }
+  }
+
+  /// kvtable values are usually archived property lists; small scalars are shown as text.
+  static func describe(_ value: Binding?) -> String {
+    switch value {
+    case let blob as Blob:
+      let data = Data(blob.bytes)
+      if let plist = try? PropertyListSerialization.propertyList(from: data, format: nil) {
+        switch plist {
+        case let date as Date:
+          return ISO8601DateFormatter().string(from: date)
+        case let number as NSNumber:
+          return number.stringValue
+        case let string as String:
+          return string
+        default:
+          break
+        }
+      }
+      return "\(data.count) bytes"
+    case let string as String:
+      return string
+    case let number as Int64:
+      return String(number)
+    case let number as Double:
+      return String(number)
+    default:
+      return ""
+    }
+  }
+}
@@ -2,45 +2,71 @@ import Foundation
 import SQLite
 
 public final class MessageStore: @unchecked Sendable {
-  public static let appleEpochOffset: TimeInterval = 978_307_200
+  public static let appleEpochOffset: TimeInterval = AppleTime.epochOffset
 
   public static var defaultPath: String {
     let home = FileManager.default.homeDirectoryForCurrentUser.path
     return NSString(string: home).appendingPathComponent("Library/Messages/chat.db")
   }
 
+  /// chat.db in another account's ~/Library/Messages; reading it needs sudo (or Full Disk
+  /// Access for that account's files).
+  public static func defaultPath(forUser user: String) -> String {
+    let home = FileManager.default.homeDirectory(forUser: user)?.path ?? "/Users/\(user)"
+    return NSString(string: home).appendingPathComponent("Library/Messages/chat.db")
+  }
+
   public let path: String
+  /// The folder holding chat.db when it isn't the current user's own, where attachment paths
+  /// recorded under the owner's home are looked up; nil for the default database.
+  let messagesDirectory: String?
 
-  private let connection: Connection
-  private let queue: DispatchQueue
-  private let queueKey = DispatchSpecificKey<Void>()
+  private let pool: ConnectionPool
+  /// Chat info and participants already resolved; only touched holding `lookupLock`.
+  let lookups = LookupCache()
+  private let lookupLock = NSRecursiveLock()
   let hasAttributedBody: Bool
   let hasReactionColumns: Bool
   let hasDestinationCallerID: Bool
   let hasAudioMessageColumn: Bool
   let hasAttachmentUserInfo: Bool
+  let hasBalloonColumns: Bool
+  let hasEditColumns: Bool
+  let hasAccountColumn: Bool
+  let hasGroupEventColumns: Bool
+  let hasReceiptColumns: Bool
 
   public init(path: String = MessageStore.defaultPath) throws {
     let normalized = NSString(string: path).expandingTildeInPath
     self.path = normalized
-    self.queue = DispatchQueue(label: "imsg.db", qos: .userInitiated)
-    self.queue.setSpecific(key: queueKey, value: ())
+    let directory = (normalized as NSString).deletingLastPathComponent
+    let ownDirectory = (MessageStore.defaultPath as NSString).deletingLastPathComponent
+    self.messagesDirectory = directory == ownDirectory ? nil : directory
     do {
       let uri = URL(fileURLWithPath: normalized).absoluteString
+      // mode=ro, never immutable=1: SQLite still applies chat.db-wal, which holds the newest
+      // messages until Messages checkpoints.
       let location = Connection.Location.uri(uri, parameters: [.mode(.readOnly)])
-      self.connection = try Connection(location, readonly: true)
-      self.connection.busyTimeout = 5
-      self.hasAttributedBody = MessageStore.detectAttributedBody(connection: self.connection)
-      self.hasReactionColumns = MessageStore.detectReactionColumns(connection: self.connection)
+      let connection = try Connection(location, readonly: true)
+      self.pool = ConnectionPool(first: connection) {
+        try Connection(location, readonly: true)
+      }
+      self.hasAttributedBody = MessageStore.detectAttributedBody(connection: connection)
+      self.hasReactionColumns = MessageStore.detectReactionColumns(connection: connection)
       self.hasDestinationCallerID = MessageStore.detectDestinationCallerID(
-        connection: self.connection
+        connection: connection
       )
       self.hasAudioMessageColumn = MessageStore.detectAudioMessageColumn(
-        connection: self.connection
+        connection: connection
       )
       self.hasAttachmentUserInfo = MessageStore.detectAttachmentUserInfo(
-        connection: self.connection
+        connection: connection
       )
+      self.hasBalloonColumns = MessageStore.detectBalloonColumns(connection: connection)
+      self.hasEditColumns = MessageStore.detectEditColumns(connection: connection)
+      self.hasAccountColumn = MessageStore.detectAccountColumn(connection: connection)
+      self.hasGroupEventColumns = MessageStore.detectGroupEventColumns(connection: connection)
+      self.hasReceiptColumns = MessageStore.detectReceiptColumns(connection: connection)
     } catch {
       throw MessageStore.enhance(error: error, path: normalized)
     }
@@ -53,13 +79,15 @@ public final class MessageStore: @unchecked Sendable {
     hasReactionColumns: Bool? = nil,
     hasDestinationCallerID: Bool? = nil,
     hasAudioMessageColumn: Bool? = nil,
-    hasAttachmentUserInfo: Bool? = nil
+    hasAttachmentUserInfo: Bool? = nil,
+    hasBalloonColumns: Bool? = nil,
+    hasEditColumns: Bool? = nil,
+    hasAccountColumn: Bool? = nil,
+    hasGroupEventColumns: Bool? = nil,
+    hasReceiptColumns: Bool? = nil
   ) throws {
     self.path = path
-    self.queue = DispatchQueue(label: "imsg.db.test", qos: .userInitiated)
-    self.queue.setSpecific(key: queueKey, value: ())
-    self.connection = connection
-    self.connection.busyTimeout = 5
+    self.pool = ConnectionPool(first: connection)
     if let hasAttributedBody {
       self.hasAttributedBody = hasAttributedBody
     } else {
@@ -85,22 +113,94 @@ public final class MessageStore: @unchecked Sendable {
     } else {
       self.hasAttachmentUserInfo = MessageStore.detectAttachmentUserInfo(connection: connection)
     }
+    if let hasBalloonColumns {
+      self.hasBalloonColumns = hasBalloonColumns
+    } else {
+      self.hasBalloonColumns = MessageStore.detectBalloonColumns(connection: connection)
+    }
+    if let hasEditColumns {
+      self.hasEditColumns = hasEditColumns
+    } else {
+      self.hasEditColumns = MessageStore.detectEditColumns(connection: connection)
+    }
+    if let hasAccountColumn {
+      self.hasAccountColumn = hasAccountColumn
+    } else {
+      self.hasAccountColumn = MessageStore.detectAccountColumn(connection: connection)
+    }
+    if let hasGroupEventColumns {
+      self.hasGroupEventColumns = hasGroupEventColumns
+    } else {
+      self.hasGroupEventColumns = MessageStore.detectGroupEventColumns(connection: connection)
+    }
+    if let hasReceiptColumns {
+      self.hasReceiptColumns = hasReceiptColumns
+    } else {
+      self.hasReceiptColumns = MessageStore.detectReceiptColumns(connection: connection)
+    }
   }
 
-  public func listChats(limit: Int) throws -> [Chat] {
+  /// Recent chats, optionally limited to chats that include `participant` or use `service`.
+  /// `participant` is matched after E.164 normalization with `region` (emails case-insensitively).
+  public func listChats(
+    limit: Int,
+    participant: String? = nil,
+    service: MessageService? = nil,
+    region: String = "US",
+    matching query: String? = nil,
+    sort: ChatSortOrder = .lastMessage
+  ) throws -> [Chat] {
+    var conditions: [String] = []
+    var bindings: [Binding?] = []
+    if let query {
+      // Display name, identifier, or any participant's handle contains the query.
+      conditions.append(
+        """
+        (IFNULL(c.display_name, '') LIKE ? ESCAPE '\\' OR IFNULL(c.chat_identifier, '') LIKE ? ESCAPE '\\'
+         OR c.ROWID IN (SELECT chj.chat_id FROM chat_handle_join chj JOIN handle ph ON ph.ROWID = chj.handle_id
+                        WHERE ph.id LIKE ? ESCAPE '\\'))
+        """)
+      let pattern = MessageStore.containsPattern(query)
+      bindings.append(contentsOf: [pattern, pattern, pattern])
+    }
+    if let participant {
+      let handleIDs = try handleIDs(matching: participant, region: region)
+      if handleIDs.isEmpty { return [] }
+      let placeholders = Array(repeating: "?", count: handleIDs.count).joined(separator: ",")
+      conditions.append(
+        "c.ROWID IN (SELECT chat_id FROM chat_handle_join WHERE handle_id IN (\(placeholders)))")
+      bindings.append(contentsOf: handleIDs.map { $0 as Binding? })
+    }
+    if let service, service != .auto {
+      conditions.append("LOWER(IFNULL(c.service_name, '')) = ?")
+      bindings.append(service.rawValue)
+    }
+    let whereClause = conditions.isEmpty ? "" : "WHERE " + conditions.joined(separator: " AND ")
+    let countColumn =
+      hasReactionColumns
+      ? "SUM(CASE WHEN m.associated_message_type BETWEEN 2000 AND 3006 THEN 0 ELSE 1 END)"
+      : "COUNT(m.ROWID)"
+    let order: String
+    switch sort {
+    case .lastMessage: order = "last_date DESC"
+    case .name: order = "name COLLATE NOCASE ASC, last_date DESC"
+    case .messageCount: order = "message_count DESC, last_date DESC"
+    }
     let sql = """
       SELECT c.ROWID, IFNULL(c.display_name, c.chat_identifier) AS name, c.chat_identifier, c.service_name,
-             MAX(m.date) AS last_date
+             MAX(m.date) AS last_date, \(countColumn) AS message_count
       FROM chat c
       JOIN chat_message_join cmj ON c.ROWID = cmj.chat_id
       JOIN message m ON m.ROWID = cmj.message_id
+      \(whereClause)
       GROUP BY c.ROWID
-      ORDER BY last_date DESC
+      ORDER BY \(order)
       LIMIT ?
       """
+    bindings.append(limit)
     return try withConnection { db in
       var chats: [Chat] = []
-      for row in try db.prepare(sql, limit) {
+      for row in try db.prepare(sql, bindings) {
         let id = int64Value(row[0]) ?? 0
         let name = stringValue(row[1])
         let identifier = stringValue(row[2])
@@ -108,67 +208,126 @@ public final class MessageStore: @unchecked Sendable {
         let lastDate = appleDate(from: int64Value(row[4]))
         chats.append(
           Chat(
-            id: id, identifier: identifier, name: name, service: service, lastMessageAt: lastDate))
+            id: id, identifier: identifier, name: name, service: service, lastMessageAt: lastDate,
+            messageCount: intValue(row[5]) ?? 0))
       }
       return chats
     }
   }
 
+  /// Served from the lookup cache after the first call for a chat.
   public func chatInfo(chatID: Int64) throws -> ChatInfo? {
-    let sql = """
-      SELECT c.ROWID, IFNULL(c.chat_identifier, '') AS identifier, IFNULL(c.guid, '') AS guid,
-             IFNULL(c.display_name, c.chat_identifier) AS name, IFNULL(c.service_name, '') AS service
-      FROM chat c
-      WHERE c.ROWID = ?
-      LIMIT 1
-      """
-    return try withConnection { db in
-      for row in try db.prepare(sql, chatID) {
-        let id = int64Value(row[0]) ?? 0
-        let identifier = stringValue(row[1])
-        let guid = stringValue(row[2])
-        let name = stringValue(row[3])
-        let service = stringValue(row[4])
-        return ChatInfo(
-          id: id,
-          identifier: identifier,
-          guid: guid,
-          name: name,
-          service: service
-        )
+    try withLookups {
+      let caching = validateLookups()
+      if caching, let cached = lookups.chats[chatID] { return cached }
+      let sql = """
+        SELECT c.ROWID, IFNULL(c.chat_identifier, '') AS identifier, IFNULL(c.guid, '') AS guid,
+               IFNULL(c.display_name, c.chat_identifier) AS name,
+               IFNULL(c.service_name, '') AS service
+        FROM chat c
+        WHERE c.ROWID = ?
+        LIMIT 1
+        """
+      guard let row = try cachedRows(sql, [chatID]).first else { return nil }
+      let info = ChatInfo(
+        id: int64Value(row[0]) ?? 0,
+        identifier: stringValue(row[1]),
+        guid: stringValue(row[2]),
+        name: stringValue(row[3]),
+        service: stringValue(row[4])
+      )
+      if caching {
+        lookups.chats[chatID] = info
       }
-      return nil
+      return info
     }
   }
 
+  /// Served from the lookup cache after the first call for a chat.
   public func participants(chatID: Int64) throws -> [String] {
-    let sql = """
-      SELECT h.id
-      FROM chat_handle_join chj
-      JOIN handle h ON h.ROWID = chj.handle_id
-      WHERE chj.chat_id = ?
-      ORDER BY h.id ASC
-      """
-    return try withConnection { db in
+    try withLookups {
+      let caching = validateLookups()
+      if caching, let cached = lookups.participants[chatID] { return cached }
+      let sql = """
+        SELECT h.id
+        FROM chat_handle_join chj
+        JOIN handle h ON h.ROWID = chj.handle_id
+        WHERE chj.chat_id = ?
+        ORDER BY h.id ASC
+        """
       var results: [String] = []
       var seen = Set<String>()
-      for row in try db.prepare(sql, chatID) {
+      for row in try cachedRows(sql, [chatID]) {
         let handle = stringValue(row[0])
         if handle.isEmpty { continue }
         if seen.insert(handle).inserted {
           results.append(handle)
         }
       }
+      if caching {
+        lookups.participants[chatID] = results
+      }
       return results
     }
   }
 
-  func withConnection<T>(_ block: (Connection) throws -> T) throws -> T {
-    if DispatchQueue.getSpecific(key: queueKey) != nil {
-      return try block(connection)
+  /// Forgets cached chat info and participants, e.g. after a group rename, which changes no
+  /// rowids and so isn't noticed by the cache itself.
+  public func invalidateLookupCache() {
+    lookupLock.lock()
+    lookups.removeAll()
+    lookupLock.unlock()
+  }
+
+  /// Runs `block` on a connection while holding the lookup cache. The lock is taken after the
+  /// connection, never before, so a caller waiting for a connection can't hold it.
+  private func withLookups<T>(_ block: () throws -> T) throws -> T {
+    try withConnection { _ in
+      lookupLock.lock()
+      defer { lookupLock.unlock() }
+      return try block()
     }
-    return try queue.sync {
-      try block(connection)
+  }
+
+  /// Drops the lookup cache when chat, handle or chat_handle_join gained rows since it was
+  /// filled; false when this database can't be checked and lookups go uncached.
+  private func validateLookups() -> Bool {
+    lookups.validate {
+      let sql = """
+        SELECT (SELECT IFNULL(MAX(ROWID), 0) FROM chat),
+               (SELECT IFNULL(MAX(ROWID), 0) FROM handle),
+               (SELECT IFNULL(MAX(ROWID), 0) FROM chat_handle_join)
+        """
+      let row = try cachedRows(sql).first ?? [nil, nil, nil]
+      return LookupCache.Stamp(
+        chat: int64Value(row[0]) ?? 0, handle: int64Value(row[1]) ?? 0,
+        chatHandle: int64Value(row[2]) ?? 0)
+    }
+  }
+
+  /// Runs `block` on one of the pool's connections; see `ConnectionPool`.
+  func withConnection<T>(_ block: (Connection) throws -> T) throws -> T {
+    try pool.withSlot { try block($0.connection) }
+  }
+
+  /// Runs `sql` through a prepared statement kept for reuse, so repeated queries (watch
+  /// polling, RPC history) skip parsing. Rows are read to completion, which also releases the
+  /// statement's read snapshot before returning.
+  func cachedRows(_ sql: String, _ bindings: [Binding?] = []) throws -> [[Binding?]] {
+    try pool.withSlot { slot in
+      let statement: Statement
+      if let cached = slot.statements[sql] {
+        statement = cached
+      } else {
+        statement = try slot.connection.prepare(sql)
+        slot.statements[sql] = statement
+      }
+      let bound = bindings.isEmpty ? statement : statement.bind(bindings)
+      var rows: [[Binding?]] = []
+      while let row = try bound.failableNext() {
+        rows.append(row)
+      }
+      return rows
     }
   }
 }
@@ -181,16 +340,16 @@ extension MessageStore {
       JOIN attachment a ON a.ROWID = maj.attachment_id
       WHERE maj.message_id = ?
       """
-    return try withConnection { db in
+    return try withConnection { _ in
       var metas: [AttachmentMeta] = []
-      for row in try db.prepare(sql, messageID) {
+      for row in try cachedRows(sql, [messageID]) {
         let filename = stringValue(row[0])
         let transferName = stringValue(row[1])
         let uti = stringValue(row[2])
         let mimeType = stringValue(row[3])
         let totalBytes = int64Value(row[4]) ?? 0
         let isSticker = boolValue(row[5])
-        let resolved = AttachmentResolver.resolve(filename)
+        let resolved = AttachmentResolver.resolve(filename, messagesDirectory: messagesDirectory)
         metas.append(
           AttachmentMeta(
             filename: filename,
@@ -249,102 +408,128 @@ extension MessageStore {
   }
 
   public func maxRowID() throws -> Int64 {
-    return try withConnection { db in
-      let value = try db.scalar("SELECT MAX(ROWID) FROM message")
-      return int64Value(value) ?? 0
-    }
+    let row = try cachedRows("SELECT MAX(ROWID) FROM message").first
+    return int64Value(row?[0]) ?? 0
   }
 
   public func reactions(for messageID: Int64) throws -> [Reaction] {
-    guard hasReactionColumns else { return [] }
+    try reactions(forMessageIDs: [messageID])[messageID] ?? []
+  }
+
+  /// Reactions for many messages with one query per chunk of ids, keyed by message rowid.
+  public func reactions(forMessageIDs messageIDs: [Int64]) throws -> [Int64: [Reaction]] {
+    guard hasReactionColumns, !messageIDs.isEmpty else { return [:] }
     // Reactions are stored as messages with associated_message_type in range 2000-2006
     // 2000-2005 are standard tapbacks, 2006 is custom emoji reactions
     // They reference the original message via associated_message_guid which has format "p:X/GUID"
     // where X is the part index (0 for single-part messages) and GUID matches the original message's guid
     let bodyColumn = hasAttributedBody ? "r.attributedBody" : "NULL"
-    let sql = """
-      SELECT r.ROWID, r.associated_message_type, h.id, r.is_from_me, r.date, IFNULL(r.text, '') as text,
-             \(bodyColumn) AS body
-      FROM message m
-      JOIN message r ON r.associated_message_guid = m.guid
-        OR r.associated_message_guid LIKE '%/' || m.guid
-      LEFT JOIN handle h ON r.handle_id = h.ROWID
-      WHERE m.ROWID = ?
-        AND m.guid IS NOT NULL
-        AND m.guid != ''
-        AND r.associated_message_type >= 2000
-        AND r.associated_message_type <= 3006
-      ORDER BY r.date ASC
-      """
-    return try withConnection { db in
-      var reactions: [Reaction] = []
-      var reactionIndex: [ReactionKey: Int] = [:]
-      for row in try db.prepare(sql, messageID) {
-        let rowID = int64Value(row[0]) ?? 0
-        let typeValue = intValue(row[1]) ?? 0
-        let sender = stringValue(row[2])
-        let isFromMe = boolValue(row[3])
-        let date = appleDate(from: int64Value(row[4]))
-        let text = stringValue(row[5])
-        let body = dataValue(row[6])
-        let resolvedText = text.isEmpty ? TypedStreamParser.parseAttributedBody(body) : text
+    var grouped: [Int64: [ReactionRow]] = [:]
+    for chunk in MessageStore.chunked(messageIDs) {
+      let placeholders = Array(repeating: "?", count: chunk.count).joined(separator: ",")
+      let sql = """
+        SELECT r.ROWID, r.associated_message_type, h.id, r.is_from_me, r.date, IFNULL(r.text, '') as text,
+               \(bodyColumn) AS body, m.ROWID AS message_id
+        FROM message m
+        JOIN message r ON r.associated_message_guid = m.guid
+          OR r.associated_message_guid LIKE '%/' || m.guid
+        LEFT JOIN handle h ON r.handle_id = h.ROWID
+        WHERE m.ROWID IN (\(placeholders))
+          AND m.guid IS NOT NULL
+          AND m.guid != ''
+          AND r.associated_message_type >= 2000
+          AND r.associated_message_type <= 3006
+        ORDER BY r.date ASC
+        """
+      try withConnection { db in
+        for row in try db.prepare(sql, chunk.map { $0 as Binding? }) {
+          let text = stringValue(row[5])
+          let resolvedText =
+            text.isEmpty ? TypedStreamParser.parseAttributedBody(dataValue(row[6])) : text
+          let messageID = int64Value(row[7]) ?? 0
+          grouped[messageID, default: []].append(
+            ReactionRow(
+              rowID: int64Value(row[0]) ?? 0,
+              typeValue: intValue(row[1]) ?? 0,
+              sender: stringValue(row[2]),
+              isFromMe: boolValue(row[3]),
+              date: appleDate(from: int64Value(row[4])),
+              text: resolvedText
+            ))
+        }
+      }
+    }
+    var result: [Int64: [Reaction]] = [:]
+    for (messageID, rows) in grouped {
+      result[messageID] = foldReactions(rows, messageID: messageID)
+    }
+    return result
+  }
 
-        if ReactionType.isReactionRemove(typeValue) {
-          let customEmoji = typeValue == 3006 ? extractCustomEmoji(from: resolvedText) : nil
-          let reactionType = ReactionType.fromRemoval(typeValue, customEmoji: customEmoji)
-          if let reactionType {
-            let key = ReactionKey(sender: sender, isFromMe: isFromMe, reactionType: reactionType)
-            if let index = reactionIndex.removeValue(forKey: key) {
-              reactions.remove(at: index)
-              reactionIndex = ReactionKey.reindex(reactions: reactions)
-            }
-            continue
-          }
-          if typeValue == 3006 {
-            if let index = reactions.firstIndex(where: {
-              $0.sender == sender && $0.isFromMe == isFromMe && $0.reactionType.isCustom
-            }) {
-              reactions.remove(at: index)
-              reactionIndex = ReactionKey.reindex(reactions: reactions)
-            }
+  private struct ReactionRow {
+    let rowID: Int64
+    let typeValue: Int
+    let sender: String
+    let isFromMe: Bool
+    let date: Date
+    let text: String
+  }
+
+  /// Applies adds/removals in date order so only the current tapback per sender and type remains.
+  private func foldReactions(_ rows: [ReactionRow], messageID: Int64) -> [Reaction] {
+    var reactions: [Reaction] = []
+    var reactionIndex: [ReactionKey: Int] = [:]
+    for row in rows {
+      let typeValue = row.typeValue
+      let sender = row.sender
+      let isFromMe = row.isFromMe
+      if ReactionType.isReactionRemove(typeValue) {
+        let customEmoji = typeValue == 3006 ? extractCustomEmoji(from: row.text) : nil
+        let reactionType = ReactionType.fromRemoval(typeValue, customEmoji: customEmoji)
+        if let reactionType {
+          let key = ReactionKey(sender: sender, isFromMe: isFromMe, reactionType: reactionType)
+          if let index = reactionIndex.removeValue(forKey: key) {
+            reactions.remove(at: index)
+            reactionIndex = ReactionKey.reindex(reactions: reactions)
           }
           continue
         }
-
-        let customEmoji: String? = typeValue == 2006 ? extractCustomEmoji(from: resolvedText) : nil
-        guard let reactionType = ReactionType(rawValue: typeValue, customEmoji: customEmoji) else {
-          continue
+        if typeValue == 3006 {
+          if let index = reactions.firstIndex(where: {
+            $0.sender == sender && $0.isFromMe == isFromMe && $0.reactionType.isCustom
+          }) {
+            reactions.remove(at: index)
+            reactionIndex = ReactionKey.reindex(reactions: reactions)
+          }
         }
+        continue
+      }
 
-        let key = ReactionKey(sender: sender, isFromMe: isFromMe, reactionType: reactionType)
-        if let index = reactionIndex[key] {
-          reactions[index] = Reaction(
-            rowID: rowID,
-            reactionType: reactionType,
-            sender: sender,
-            isFromMe: isFromMe,
-            date: date,
-            associatedMessageID: messageID
-          )
-        } else {
-          reactionIndex[key] = reactions.count
-          reactions.append(
-            Reaction(
-              rowID: rowID,
-              reactionType: reactionType,
-              sender: sender,
-              isFromMe: isFromMe,
-              date: date,
-              associatedMessageID: messageID
-            ))
-        }
+      let customEmoji: String? = typeValue == 2006 ? extractCustomEmoji(from: row.text) : nil
+      guard let reactionType = ReactionType(rawValue: typeValue, customEmoji: customEmoji) else {
+        continue
+      }
+
+      let key = ReactionKey(sender: sender, isFromMe: isFromMe, reactionType: reactionType)
+      let reaction = Reaction(
+        rowID: row.rowID,
+        reactionType: reactionType,
+        sender: sender,
+        isFromMe: isFromMe,
+        date: row.date,
+        associatedMessageID: messageID
+      )
+      if let index = reactionIndex[key] {
+        reactions[index] = reaction
+      } else {
+        reactionIndex[key] = reactions.count
+        reactions.append(reaction)
       }
-      return reactions
     }
+    return reactions
   }
-
   /// Extract custom emoji from reaction message text like "Reacted 🎉 to "original message""
-  private func extractCustomEmoji(from text: String) -> String? {
+  func extractCustomEmoji(from text: String) -> String? {
     // Format: "Reacted X to "..." where X is the emoji. Fallback to first emoji in text.
     guard
       let reactedRange = text.range(of: "Reacted "),
@@ -0,0 +1,66 @@
+import Foundation
+
+public struct BenchmarkResult: Sendable, Equatable {
+  public let name: String
+  public let iterations: Int
+  public let rows: Int
+  public let minMilliseconds: Double
+  public let medianMilliseconds: Double
+  public let p95Milliseconds: Double
+}
+
+/// Times the read paths used by `chats`, `history`, `watch`, `search`, and text filters.
+public struct MessageStoreBenchmark {
+  public let store: MessageStore
+  public let iterations: Int
+
+  public init(store: MessageStore, iterations: Int = 5) {
+    self.store = store
+    self.iterations = max(1, iterations)
+  }
+
+  public func run() throws -> [BenchmarkResult] {
+    let chats = try store.listChats(limit: 1)
+    let busiestChat = chats.first?.id ?? 0
+    let maxRowID = try store.maxRowID()
+    let matcher = try MessageTextMatcher(pattern: "invoice|receipt", caseInsensitive: true)
+    return [
+      try measure("list_chats") { try store.listChats(limit: 50).count },
+      try measure("messages_by_chat") { try store.messages(chatID: busiestChat, limit: 500).count },
+      try measure("messages_after") {
+        try store.messagesAfter(afterRowID: max(0, maxRowID - 1000), chatID: nil, limit: 1000).count
+      },
+      try measure("text_match") {
+        try store.messages(chatID: busiestChat, limit: 5000).filter { matcher.matches($0.text) }
+          .count
+      },
+      // What `imsg search` runs for its default types.
+      try measure("search") {
+        try store.listChats(limit: 20, matching: "receipt").count
+          + store.searchMessages(query: "receipt", limit: 20).count
+          + store.searchAttachments(query: "receipt", limit: 20).count
+      },
+    ]
+  }
+
+  func measure(_ name: String, _ body: () throws -> Int) throws -> BenchmarkResult {
+    var samples: [Double] = []
+    var rows = 0
+    for _ in 0..<iterations {
+      let start = DispatchTime.now().uptimeNanoseconds
+      rows = try body()
+      let elapsed = DispatchTime.now().uptimeNanoseconds - start
+      samples.append(Double(elapsed) / 1_000_000)
+    }
+    samples.sort()
+    let p95Index = min(samples.count - 1, Int((Double(samples.count) * 0.95).rounded(.up)) - 1)
+    return BenchmarkResult(
+      name: name,
+      iterations: iterations,
+      rows: rows,
+      minMilliseconds: samples[0],
+      medianMilliseconds: samples[samples.count / 2],
+      p95Milliseconds: samples[max(0, p95Index)]
+    )
+  }
+}
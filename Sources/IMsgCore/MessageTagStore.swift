@@ -0,0 +1,111 @@
+import Foundation
+import SQLite
+
+/// A tag on one message, e.g. `followup`.
+public struct MessageTag: Sendable, Equatable {
+  public let messageGUID: String
+  public let tag: String
+  public let note: String?
+  public let createdAt: Date
+
+  public init(messageGUID: String, tag: String, note: String?, createdAt: Date) {
+    self.messageGUID = messageGUID
+    self.tag = tag
+    self.note = note
+    self.createdAt = createdAt
+  }
+}
+
+/// Local tags on messages, kept in a small SQLite sidecar (tags.db in the state directory)
+/// rather than in chat.db, which imsg never writes. Tags are keyed by message guid, which
+/// survives chat.db rebuilds and is the same on every Mac synced to the account.
+public final class MessageTagStore {
+  public let fileURL: URL
+  private let db: Connection
+
+  public init(fileURL: URL) throws {
+    self.fileURL = fileURL
+    try FileManager.default.createDirectory(
+      at: fileURL.deletingLastPathComponent(), withIntermediateDirectories: true)
+    db = try Connection(fileURL.path)
+    db.busyTimeout = 5
+    try db.execute(
+      """
+      CREATE TABLE IF NOT EXISTS message_tags (
+        message_guid TEXT NOT NULL,
+        tag TEXT NOT NULL,
+        note TEXT,
+        created_at REAL NOT NULL,
+        PRIMARY KEY (message_guid, tag)
+      );
+      CREATE INDEX IF NOT EXISTS message_tags_tag ON message_tags(tag, created_at);
+      """)
+  }
+
+  /// Tags are case-insensitive words: trimmed and lowercased; nil when empty or containing
+  /// whitespace or commas.
+  public static func normalize(_ tag: String) -> String? {
+    let trimmed = tag.trimmingCharacters(in: .whitespacesAndNewlines).lowercased()
+    let separators = CharacterSet.whitespacesAndNewlines.union(CharacterSet(charactersIn: ","))
+    guard !trimmed.isEmpty, trimmed.rangeOfCharacter(from: separators) == nil else {
+      return nil
+    }
+    return trimmed
+  }
+
+  /// Adds `tag` to the message; returns false when it was already there (its note is then
+  /// replaced if a new one is given).
+  @discardableResult
+  public func add(
+    _ tag: String, to messageGUID: String, note: String? = nil, at date: Date = Date()
+  ) throws -> Bool {
+    try db.run(
+      "INSERT OR IGNORE INTO message_tags VALUES (?, ?, ?, ?)", messageGUID, tag, note,
+      date.timeIntervalSince1970)
+    if db.changes > 0 { return true }
+    if let note {
+      try db.run(
+        "UPDATE message_tags SET note = ? WHERE message_guid = ? AND tag = ?", note, messageGUID,
+        tag)
+    }
+    return false
+  }
+
+  /// Returns false when the message did not have the tag.
+  @discardableResult
+  public func remove(_ tag: String, from messageGUID: String) throws -> Bool {
+    try db.run("DELETE FROM message_tags WHERE message_guid = ? AND tag = ?", messageGUID, tag)
+    return db.changes > 0
+  }
+
+  /// The message's tags, oldest first.
+  public func tags(for messageGUID: String) throws -> [MessageTag] {
+    try query("WHERE message_guid = ? ORDER BY created_at, tag", [messageGUID])
+  }
+
+  /// Guids of the messages carrying `tag` (any tag when nil), most recently tagged first.
+  public func taggedMessages(_ tag: String? = nil, limit: Int = Int.max) throws -> [String] {
+    let sql: String
+    var bindings: [Binding?] = []
+    if let tag {
+      sql = "SELECT message_guid FROM message_tags WHERE tag = ? ORDER BY created_at DESC LIMIT ?"
+      bindings.append(tag)
+    } else {
+      sql = """
+        SELECT message_guid FROM message_tags GROUP BY message_guid
+        ORDER BY MAX(created_at) DESC LIMIT ?
+        """
+    }
+    bindings.append(Int64(limit))
+    return try db.prepare(sql, bindings).compactMap { $0[0] as? String }
+  }
+
+  private func query(_ clause: String, _ bindings: [Binding?]) throws -> [MessageTag] {
+    let sql = "SELECT message_guid, tag, note, created_at FROM message_tags \(clause)"
+    return try db.prepare(sql, bindings).map {
+      MessageTag(
+        messageGUID: $0[0] as? String ?? "", tag: $0[1] as? String ?? "", note: $0[2] as? String,
+        createdAt: Date(timeIntervalSince1970: $0[3] as? Double ?? 0))
+    }
+  }
+}
@@ -0,0 +1,37 @@
+import Foundation
+
+/// Regex matcher for message text, compiled once and safe to share across watch tasks.
+public struct MessageTextMatcher: Sendable, Equatable {
+  public let pattern: String
+  public let caseInsensitive: Bool
+  private let box: RegexBox
+
+  public init(pattern: String, caseInsensitive: Bool = false) throws {
+    let options: NSRegularExpression.Options = caseInsensitive ? [.caseInsensitive] : []
+    do {
+      self.box = RegexBox(try NSRegularExpression(pattern: pattern, options: options))
+    } catch {
+      throw IMsgError.invalidPattern(pattern)
+    }
+    self.pattern = pattern
+    self.caseInsensitive = caseInsensitive
+  }
+
+  public func matches(_ text: String) -> Bool {
+    guard !text.isEmpty else { return false }
+    let range = NSRange(text.startIndex..<text.endIndex, in: text)
+    return box.regex.firstMatch(in: text, options: [], range: range) != nil
+  }
+
+  public static func == (lhs: MessageTextMatcher, rhs: MessageTextMatcher) -> Bool {
+    lhs.pattern == rhs.pattern && lhs.caseInsensitive == rhs.caseInsensitive
+  }
+}
+
+private final class RegexBox: @unchecked Sendable {
+  let regex: NSRegularExpression
+
+  init(_ regex: NSRegularExpression) {
+    self.regex = regex
+  }
+}
@@ -0,0 +1,123 @@
+import Foundation
+
+/// Cleans up artifacts that chat.db leaves in message text so downstream regexes see plain
+/// text: object replacement characters (U+FFFC) where attachments sat, zero-width characters,
+/// and decomposed Unicode.
+public struct MessageTextNormalizer: Sendable {
+  public enum Step: String, CaseIterable, Sendable {
+    /// Removes U+FFFC attachment placeholders.
+    case objectReplacement = "fffc"
+    /// Removes zero-width spaces, non-joiners, word joiners and byte order marks, and
+    /// zero-width joiners outside emoji sequences (so 👨‍👩‍👧 stays one emoji).
+    case zeroWidth = "zero-width"
+    /// Composes to Unicode normalization form C.
+    case nfc
+  }
+
+  public let steps: Set<Step>
+
+  public init(steps: Set<Step>) {
+    self.steps = steps
+  }
+
+  /// Each spec is `fffc`, `zero-width`, `nfc`, `all`, or a comma-separated list of those.
+  public init(specs: [String]) throws {
+    var steps: Set<Step> = []
+    for spec in specs {
+      for part in spec.split(separator: ",") {
+        let name = part.trimmingCharacters(in: .whitespaces).lowercased()
+        if name == "all" {
+          steps.formUnion(Step.allCases)
+        } else if let step = Step(rawValue: name) {
+          steps.insert(step)
+        } else {
+          throw IMsgError.invalidNormalization(name)
+        }
+      }
+    }
+    self.steps = steps
+  }
+
+  public var isEmpty: Bool { steps.isEmpty }
+
+  public func normalize(_ text: String) -> String {
+    var result = text
+    if steps.contains(.objectReplacement) {
+      result = result.replacingOccurrences(of: "\u{FFFC}", with: "")
+    }
+    if steps.contains(.zeroWidth) {
+      result = MessageTextNormalizer.removingZeroWidth(result)
+    }
+    if steps.contains(.nfc) {
+      result = result.precomposedStringWithCanonicalMapping
+    }
+    return result
+  }
+
+  /// A copy with normalized text. Mentions are kept, moved to where their text lands in the
+  /// normalized text.
+  public func normalize(_ message: Message) -> Message {
+    let text = normalize(message.text)
+    guard text != message.text else { return message }
+    return Message(
+      rowID: message.rowID,
+      chatID: message.chatID,
+      sender: message.sender,
+      text: text,
+      date: message.date,
+      isFromMe: message.isFromMe,
+      service: message.service,
+      handleID: message.handleID,
+      attachmentsCount: message.attachmentsCount,
+      guid: message.guid,
+      replyToGUID: message.replyToGUID,
+      app: message.app,
+      mentions: message.mentions.map { remap($0, in: message.text) },
+      account: message.account,
+      groupEvent: message.groupEvent
+    )
+  }
+
+  /// `mention` of the unnormalized `text`, with its offsets and display text as they are
+  /// after normalizing: everything before it and the mention itself shrink by what was removed.
+  func remap(_ mention: MessageMention, in text: String) -> MessageMention {
+    let utf16 = Array(text.utf16)
+    let prefix = utf16[..<min(max(mention.location, 0), utf16.count)]
+    let display = normalize(mention.text)
+    return MessageMention(
+      handle: mention.handle,
+      location: normalize(String(decoding: prefix, as: UTF16.self)).utf16.count,
+      length: display.utf16.count,
+      text: display)
+  }
+
+  private static let zeroWidth: Set<UInt32> = [0x200B, 0x200C, 0x2060, 0xFEFF]
+  private static let joiner: UInt32 = 0x200D
+
+  static func removingZeroWidth(_ text: String) -> String {
+    let scalars = Array(text.unicodeScalars)
+    var kept = String.UnicodeScalarView()
+    for (index, scalar) in scalars.enumerated() {
+      if zeroWidth.contains(scalar.value) { continue }
+      if scalar.value == joiner {
+        let previous = index > 0 ? scalars[index - 1] : nil
+        let next = index + 1 < scalars.count ? scalars[index + 1] : nil
+        guard let previous, let next, joinsEmoji(after: previous), isPictographic(next) else {
+          continue
+        }
+      }
+      kept.append(scalar)
+    }
+    return String(kept)
+  }
+
+  /// Emoji, or the variation selector and skin tones that end one, can precede a joiner.
+  private static func joinsEmoji(after scalar: Unicode.Scalar) -> Bool {
+    scalar.value == 0xFE0F || scalar.properties.isEmojiModifier || isPictographic(scalar)
+  }
+
+  /// `isEmoji` alone also covers digits, `#` and `*`, which only become emoji as keycaps.
+  private static func isPictographic(_ scalar: Unicode.Scalar) -> Bool {
+    scalar.properties.isEmoji && scalar.value > 0x7F
+  }
+}
@@ -0,0 +1,136 @@
+import Foundation
+
+/// What a watch reports. Reopen notices always arrive, heartbeats when
+/// `MessageWatcherConfiguration.heartbeatInterval` is set; everything else only for the kinds
+/// in `MessageWatcherConfiguration.events` (new messages by default).
+public enum MessageWatchEvent: Sendable {
+  case message(Message)
+  case reaction(MessageReactionEvent)
+  case edited(MessageEditEvent)
+  case deleted(MessageDeleteEvent)
+  case receipt(MessageReceiptEvent)
+  case reconnected(MessageWatchReconnect)
+  case heartbeat(MessageWatchHeartbeat)
+
+  /// The kind to ask for to get this event; empty for reopen notices and heartbeats.
+  public var kind: MessageWatchEventKinds {
+    switch self {
+    case .message: return .messages
+    case .reaction: return .reactions
+    case .edited: return .edits
+    case .deleted: return .deletes
+    case .receipt: return .receipts
+    case .reconnected, .heartbeat: return []
+    }
+  }
+}
+
+/// Event kinds a watch can report.
+public struct MessageWatchEventKinds: OptionSet, Sendable, Hashable {
+  public let rawValue: Int
+
+  public init(rawValue: Int) {
+    self.rawValue = rawValue
+  }
+
+  public static let messages = MessageWatchEventKinds(rawValue: 1 << 0)
+  /// Tapbacks added or removed.
+  public static let reactions = MessageWatchEventKinds(rawValue: 1 << 1)
+  public static let edits = MessageWatchEventKinds(rawValue: 1 << 2)
+  /// Messages unsent by their sender.
+  public static let deletes = MessageWatchEventKinds(rawValue: 1 << 3)
+  /// Messages you sent being read.
+  public static let receipts = MessageWatchEventKinds(rawValue: 1 << 4)
+  public static let all: MessageWatchEventKinds = [
+    .messages, .reactions, .edits, .deletes, .receipts,
+  ]
+
+  /// Names as used on the command line and over RPC.
+  public static let names: [(String, MessageWatchEventKinds)] = [
+    ("message", .messages), ("reaction", .reactions), ("edit", .edits),
+    ("delete", .deletes), ("receipt", .receipts),
+  ]
+
+  /// Parses `message,reaction,...` (or `all`); nil for an unknown name.
+  public static func parse(_ values: [String]) -> MessageWatchEventKinds? {
+    var kinds: MessageWatchEventKinds = []
+    for value in values.flatMap({ $0.split(separator: ",") }) {
+      let name = value.trimmingCharacters(in: .whitespaces).lowercased()
+      if name.isEmpty { continue }
+      if name == "all" {
+        kinds.formUnion(.all)
+      } else if let kind = names.first(where: { $0.0 == name || $0.0 + "s" == name })?.1 {
+        kinds.formUnion(kind)
+      } else {
+        return nil
+      }
+    }
+    return kinds
+  }
+}
+
+/// A tapback row: added, or (`isRemoval`) taken back.
+public struct MessageReactionEvent: Sendable, Equatable {
+  /// `associatedMessageID` is 0 when the reacted-to message isn't in this database.
+  public let reaction: Reaction
+  public let isRemoval: Bool
+  public let chatID: Int64
+  /// Guid of the reacted-to message.
+  public let messageGUID: String
+
+  public init(reaction: Reaction, isRemoval: Bool, chatID: Int64, messageGUID: String) {
+    self.reaction = reaction
+    self.isRemoval = isRemoval
+    self.chatID = chatID
+    self.messageGUID = messageGUID
+  }
+}
+
+/// A message whose text was edited; `message` has the new text.
+public struct MessageEditEvent: Sendable, Equatable {
+  public let message: Message
+  public let editedAt: Date
+  /// The text before this edit, when the edit history records it.
+  public let previousText: String?
+
+  public init(message: Message, editedAt: Date, previousText: String?) {
+    self.message = message
+    self.editedAt = editedAt
+    self.previousText = previousText
+  }
+}
+
+/// A message its sender unsent. chat.db keeps the row with the text cleared.
+public struct MessageDeleteEvent: Sendable, Equatable {
+  public let message: Message
+  public let deletedAt: Date
+
+  public init(message: Message, deletedAt: Date) {
+    self.message = message
+    self.deletedAt = deletedAt
+  }
+}
+
+/// A message you sent was read. chat.db only records this for 1:1 chats.
+public struct MessageReceiptEvent: Sendable, Equatable {
+  public let message: Message
+  public let readAt: Date
+
+  public init(message: Message, readAt: Date) {
+    self.message = message
+    self.readAt = readAt
+  }
+}
+
+/// Sent every `heartbeatInterval` after the watcher checked chat.db, whether or not anything
+/// arrived, so a supervisor can tell a stalled watch from a quiet one.
+public struct MessageWatchHeartbeat: Sendable, Equatable {
+  /// The newest rowid the watcher has read, including messages filtered out downstream.
+  public let lastRowID: Int64
+  public let date: Date
+
+  public init(lastRowID: Int64, date: Date) {
+    self.lastRowID = lastRowID
+    self.date = date
+  }
+}
@@ -0,0 +1,174 @@
+import Foundation
+
+/// Shares one `MessageWatcher` poll of chat.db among any number of subscribers, so a server
+/// with many watch clients reads the database once per change instead of once per client.
+/// Subscribers see every chat and filter on their own; each gets a message at most once.
+public final class MessageWatchHub: @unchecked Sendable {
+  private struct Subscriber {
+    let continuation: AsyncThrowingStream<MessageWatchEvent, Error>.Continuation
+    var lastRowID: Int64
+  }
+
+  private let watcher: MessageWatcher
+  private let configuration: MessageWatcherConfiguration
+  private let lock = NSLock()
+  private var store: MessageStore
+  private var subscribers: [Int: Subscriber] = [:]
+  private var nextSubscriberID = 0
+  private var upstream: Task<Void, Never>?
+  /// Bumped whenever the upstream watch stops, so a stale task can't touch newer subscribers.
+  private var generation = 0
+  private var cursor: Int64 = 0
+
+  public init(
+    store: MessageStore,
+    watcher: MessageWatcher? = nil,
+    configuration: MessageWatcherConfiguration = MessageWatcherConfiguration()
+  ) {
+    self.store = store
+    self.watcher = watcher ?? MessageWatcher(store: store)
+    self.configuration = configuration
+  }
+
+  public var subscriberCount: Int {
+    lock.lock()
+    defer { lock.unlock() }
+    return subscribers.count
+  }
+
+  /// New messages from now on. With `sinceRowID`, messages after that rowid are replayed first
+  /// from the database, then the stream continues live without gaps or repeats. Other event
+  /// kinds the hub's configuration asks for are only reported live. The shared
+  /// watch starts with the first subscriber and stops when the last one goes away.
+  public func subscribe(sinceRowID: Int64? = nil) throws
+    -> AsyncThrowingStream<MessageWatchEvent, Error>
+  {
+    var captured: AsyncThrowingStream<MessageWatchEvent, Error>.Continuation?
+    let stream = AsyncThrowingStream<MessageWatchEvent, Error> { captured = $0 }
+    guard let continuation = captured else { return stream }
+
+    lock.lock()
+    defer { lock.unlock() }
+    if upstream == nil {
+      cursor = try store.maxRowID()
+      startUpstream()
+    }
+    if let sinceRowID, sinceRowID < cursor {
+      do {
+        try replay(after: sinceRowID, through: cursor, into: continuation)
+      } catch {
+        if subscribers.isEmpty {
+          stopUpstream()
+        }
+        throw error
+      }
+    }
+    let id = nextSubscriberID
+    nextSubscriberID += 1
+    subscribers[id] = Subscriber(
+      continuation: continuation, lastRowID: max(cursor, sinceRowID ?? cursor))
+    continuation.onTermination = { [weak self] _ in
+      self?.remove(id)
+    }
+    return stream
+  }
+
+  /// Called with `lock` held.
+  private func startUpstream() {
+    let events = watcher.events(chatID: nil, sinceRowID: cursor, configuration: configuration)
+    let current = generation
+    upstream = Task { [weak self] in
+      do {
+        for try await event in events {
+          self?.deliver(event, generation: current)
+        }
+        self?.finishAll(throwing: nil, generation: current)
+      } catch {
+        self?.finishAll(throwing: error, generation: current)
+      }
+    }
+  }
+
+  /// Called with `lock` held.
+  private func replay(
+    after rowID: Int64,
+    through lastRowID: Int64,
+    into continuation: AsyncThrowingStream<MessageWatchEvent, Error>.Continuation
+  ) throws {
+    var after = rowID
+    while after < lastRowID {
+      let batch = try store.messagesAfter(
+        afterRowID: after, chatID: nil, limit: configuration.batchLimit)
+      guard let last = batch.last else { break }
+      for message in batch where message.rowID <= lastRowID {
+        continuation.yield(.message(message))
+      }
+      after = last.rowID
+    }
+  }
+
+  private func deliver(_ event: MessageWatchEvent, generation current: Int) {
+    lock.lock()
+    defer { lock.unlock() }
+    guard current == generation else { return }
+    switch event {
+    case .message(let message):
+      deliver(event, rowID: message.rowID)
+    case .reaction(let reaction):
+      deliver(event, rowID: reaction.reaction.rowID)
+    case .edited, .deleted, .receipt, .heartbeat:
+      // Changes to rows everyone has already seen.
+      for subscriber in subscribers.values {
+        subscriber.continuation.yield(event)
+      }
+    case .reconnected(let reconnect):
+      // A rebuilt database can restart rowids; everyone resumes from the watcher's cursor.
+      store = reconnect.store
+      cursor = reconnect.resumeRowID
+      for (id, subscriber) in subscribers {
+        subscribers[id]?.lastRowID = min(subscriber.lastRowID, reconnect.resumeRowID)
+        subscriber.continuation.yield(event)
+      }
+    }
+  }
+
+  /// Called with `lock` held.
+  private func deliver(_ event: MessageWatchEvent, rowID: Int64) {
+    cursor = max(cursor, rowID)
+    for (id, subscriber) in subscribers where rowID > subscriber.lastRowID {
+      subscriber.continuation.yield(event)
+      subscribers[id]?.lastRowID = rowID
+    }
+  }
+
+  private func finishAll(throwing error: Error?, generation current: Int) {
+    lock.lock()
+    guard current == generation else {
+      lock.unlock()
+      return
+    }
+    let finished = subscribers.values
+    subscribers.removeAll()
+    upstream = nil
+    generation += 1
+    lock.unlock()
+    // Outside the lock: finishing runs onTermination, which calls back into `remove`.
+    for subscriber in finished {
+      subscriber.continuation.finish(throwing: error)
+    }
+  }
+
+  private func remove(_ id: Int) {
+    lock.lock()
+    defer { lock.unlock() }
+    guard subscribers.removeValue(forKey: id) != nil, subscribers.isEmpty else { return }
+    stopUpstream()
+  }
+
+  /// Called with `lock` held.
+  private func stopUpstream() {
+    upstream?.cancel()
+    upstream = nil
+    generation += 1
+  }
+}
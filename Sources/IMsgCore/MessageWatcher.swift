@@ -1,21 +1,76 @@
 import Darwin
 import Foundation
+import SQLite
 
 public struct MessageWatcherConfiguration: Sendable, Equatable {
   public var debounceInterval: TimeInterval
   public var batchLimit: Int
+  /// How often to check whether chat.db was replaced (vacuum, OS update, sign-out).
+  public var healthCheckInterval: TimeInterval
+  /// Consecutive failed recoveries before the stream finishes with the last error.
+  public var maxReopenAttempts: Int
+  /// Event kinds to report; reopen notices are always reported.
+  public var events: MessageWatchEventKinds
+  /// How many of the newest messages are re-checked for edits, unsends and reads on each
+  /// poll. Changes to older messages go unreported.
+  public var changeWindow: Int
+  /// Poll and report a heartbeat this often; 0 disables heartbeats.
+  public var heartbeatInterval: TimeInterval
+  /// Poll on a timer as well as on file events, backing off from `minPollInterval` to
+  /// `maxPollInterval` while nothing happens; a `maxPollInterval` of 0 disables it.
+  public var minPollInterval: TimeInterval
+  public var maxPollInterval: TimeInterval
 
-  public init(debounceInterval: TimeInterval = 0.25, batchLimit: Int = 100) {
+  public init(
+    debounceInterval: TimeInterval = 0.25,
+    batchLimit: Int = 100,
+    healthCheckInterval: TimeInterval = 5,
+    maxReopenAttempts: Int = 5,
+    events: MessageWatchEventKinds = .messages,
+    changeWindow: Int = 1000,
+    heartbeatInterval: TimeInterval = 0,
+    minPollInterval: TimeInterval = 0.5,
+    maxPollInterval: TimeInterval = 0
+  ) {
     self.debounceInterval = debounceInterval
     self.batchLimit = batchLimit
+    self.healthCheckInterval = healthCheckInterval
+    self.maxReopenAttempts = maxReopenAttempts
+    self.events = events
+    self.changeWindow = changeWindow
+    self.heartbeatInterval = heartbeatInterval
+    self.minPollInterval = minPollInterval
+    self.maxPollInterval = maxPollInterval
   }
 }
 
+/// Emitted after the watcher reopened the database and resumed from `resumeRowID`.
+public struct MessageWatchReconnect: Sendable {
+  public enum Reason: String, Sendable {
+    /// chat.db was replaced on disk (different inode).
+    case replaced
+    /// A query failed with a SQLite error (schema change, corruption, missing table).
+    case error
+  }
+
+  public let reason: Reason
+  public let detail: String?
+  public let resumeRowID: Int64
+  /// The reopened store; use it for follow-up lookups (attachments, reactions).
+  public let store: MessageStore
+}
+
 public final class MessageWatcher: @unchecked Sendable {
   private let store: MessageStore
+  private let reopen: (@Sendable (String) throws -> MessageStore)?
 
-  public init(store: MessageStore) {
+  /// `reopen` recreates the store after chat.db is replaced; pass nil to disable recovery.
+  public init(
+    store: MessageStore,
+    reopen: (@Sendable (String) throws -> MessageStore)? = { try MessageStore(path: $0) }
+  ) {
     self.store = store
+    self.reopen = reopen
   }
 
   public func stream(
@@ -23,9 +78,37 @@ public final class MessageWatcher: @unchecked Sendable {
     sinceRowID: Int64? = nil,
     configuration: MessageWatcherConfiguration = MessageWatcherConfiguration()
   ) -> AsyncThrowingStream<Message, Error> {
+    let events = self.events(chatID: chatID, sinceRowID: sinceRowID, configuration: configuration)
+    return AsyncThrowingStream { continuation in
+      let task = Task {
+        do {
+          for try await event in events {
+            if case .message(let message) = event {
+              continuation.yield(message)
+            }
+          }
+          continuation.finish()
+        } catch {
+          continuation.finish(throwing: error)
+        }
+      }
+      continuation.onTermination = { _ in
+        task.cancel()
+      }
+    }
+  }
+
+  /// Like `stream`, but also reports database reopen events and the other kinds in
+  /// `configuration.events`.
+  public func events(
+    chatID: Int64? = nil,
+    sinceRowID: Int64? = nil,
+    configuration: MessageWatcherConfiguration = MessageWatcherConfiguration()
+  ) -> AsyncThrowingStream<MessageWatchEvent, Error> {
     AsyncThrowingStream { continuation in
       let state = WatchState(
         store: store,
+        reopen: reopen,
         chatID: chatID,
         sinceRowID: sinceRowID,
         configuration: configuration,
@@ -39,29 +122,61 @@ public final class MessageWatcher: @unchecked Sendable {
   }
 }
 
+private struct FileIdentity: Equatable {
+  let device: Int64
+  let inode: UInt64
+
+  init?(path: String) {
+    var info = stat()
+    guard stat(path, &info) == 0 else { return nil }
+    self.device = Int64(info.st_dev)
+    self.inode = UInt64(info.st_ino)
+  }
+}
+
 private final class WatchState: @unchecked Sendable {
-  private let store: MessageStore
+  private var store: MessageStore
+  private let reopen: (@Sendable (String) throws -> MessageStore)?
   private let chatID: Int64?
   private let configuration: MessageWatcherConfiguration
-  private let continuation: AsyncThrowingStream<Message, Error>.Continuation
+  private let continuation: AsyncThrowingStream<MessageWatchEvent, Error>.Continuation
   private let queue = DispatchQueue(label: "imsg.watch", qos: .userInitiated)
 
   private var cursor: Int64
   private var sources: [DispatchSourceFileSystemObject] = []
+  private var healthTimer: DispatchSourceTimer?
+  private var heartbeatTimer: DispatchSourceTimer?
+  private var pollTimer: DispatchWorkItem?
+  private var backoff: AdaptivePollBackoff?
+  /// Set when a poll reports anything, so the backoff knows to speed up.
+  private var sawActivity = false
+  private var identity: FileIdentity?
   private var pending = false
+  private var needsReopen = false
+  private var failedRecoveries = 0
+  private var finished = false
+  /// Last seen edit and read times of the newest messages, by rowid.
+  private var rowStates: [Int64: MessageRowState] = [:]
 
   init(
     store: MessageStore,
+    reopen: (@Sendable (String) throws -> MessageStore)?,
     chatID: Int64?,
     sinceRowID: Int64?,
     configuration: MessageWatcherConfiguration,
-    continuation: AsyncThrowingStream<Message, Error>.Continuation
+    continuation: AsyncThrowingStream<MessageWatchEvent, Error>.Continuation
   ) {
     self.store = store
+    self.reopen = reopen
     self.chatID = chatID
     self.configuration = configuration
     self.continuation = continuation
     self.cursor = sinceRowID ?? 0
+    self.identity = FileIdentity(path: store.path)
+    if configuration.maxPollInterval > 0 {
+      self.backoff = AdaptivePollBackoff(
+        min: configuration.minPollInterval, max: configuration.maxPollInterval)
+    }
   }
 
   func start() {
@@ -70,28 +185,152 @@ private final class WatchState: @unchecked Sendable {
         if self.cursor == 0 {
           self.cursor = try self.store.maxRowID()
         }
+        self.installSources()
+        self.startHealthTimer()
+        self.startHeartbeatTimer()
         self.poll()
       } catch {
-        self.continuation.finish(throwing: error)
+        self.finish(throwing: error)
       }
     }
+  }
+
+  func stop() {
+    queue.async {
+      self.finished = true
+      self.cancelSources()
+      self.cancelTimers()
+    }
+  }
 
+  private func installSources() {
     let paths = [store.path, store.path + "-wal", store.path + "-shm"]
     for path in paths {
       if let source = makeSource(path: path) {
         sources.append(source)
       }
     }
+  }
 
+  private func cancelSources() {
+    for source in sources {
+      source.cancel()
+    }
+    sources.removeAll()
   }
 
-  func stop() {
-    queue.async {
-      for source in self.sources {
-        source.cancel()
+  /// File events stop arriving once chat.db is swapped out, so check the inode on a timer too.
+  private func startHealthTimer() {
+    guard canRecover, configuration.healthCheckInterval > 0 else { return }
+    let timer = DispatchSource.makeTimerSource(queue: queue)
+    let interval = configuration.healthCheckInterval
+    timer.schedule(deadline: .now() + interval, repeating: interval)
+    timer.setEventHandler { [weak self] in
+      guard let self else { return }
+      if self.needsReopen {
+        self.recover(reason: .error, detail: nil)
+      } else if self.wasReplaced() {
+        self.recover(reason: .replaced, detail: nil)
       }
-      self.sources.removeAll()
     }
+    timer.resume()
+    healthTimer = timer
+  }
+
+  /// Polls on every tick too, so a heartbeat means chat.db was just read successfully and any
+  /// file event that went missing is caught up on.
+  private func startHeartbeatTimer() {
+    let interval = configuration.heartbeatInterval
+    guard interval > 0 else { return }
+    let timer = DispatchSource.makeTimerSource(queue: queue)
+    timer.schedule(deadline: .now() + interval, repeating: interval)
+    timer.setEventHandler { [weak self] in
+      guard let self, !self.finished else { return }
+      self.poll()
+      guard !self.finished, !self.needsReopen else { return }
+      self.continuation.yield(
+        .heartbeat(MessageWatchHeartbeat(lastRowID: self.cursor, date: Date())))
+    }
+    timer.resume()
+    heartbeatTimer = timer
+  }
+
+  private func cancelTimers() {
+    healthTimer?.cancel()
+    healthTimer = nil
+    heartbeatTimer?.cancel()
+    heartbeatTimer = nil
+    pollTimer?.cancel()
+    pollTimer = nil
+  }
+
+  /// Schedules the next fallback poll after every poll, however it was triggered, so the
+  /// timer only fires once chat.db has been quiet for the whole delay.
+  private func scheduleFallbackPoll(activity: Bool) {
+    guard var backoff, !finished else { return }
+    let delay = backoff.record(activity: activity)
+    self.backoff = backoff
+    pollTimer?.cancel()
+    let item = DispatchWorkItem { [weak self] in
+      self?.poll()
+    }
+    pollTimer = item
+    queue.asyncAfter(deadline: .now() + delay, execute: item)
+  }
+
+  /// Yields an event found by a poll.
+  private func report(_ event: MessageWatchEvent) {
+    sawActivity = true
+    continuation.yield(event)
+  }
+
+  /// Recovery needs a reopen closure and an on-disk database (not an in-memory test store).
+  private var canRecover: Bool {
+    reopen != nil && identity != nil
+  }
+
+  private func wasReplaced() -> Bool {
+    guard let identity, let current = FileIdentity(path: store.path) else { return false }
+    return current != identity
+  }
+
+  private func recover(reason: MessageWatchReconnect.Reason, detail: String?) {
+    guard !finished, canRecover, let reopen else { return }
+    do {
+      let reopened = try reopen(store.path)
+      let maxRowID = try reopened.maxRowID()
+      cancelSources()
+      store = reopened
+      rowStates = [:]
+      identity = FileIdentity(path: reopened.path)
+      installSources()
+      needsReopen = false
+      // A rebuilt database can restart rowids; resume from its tip instead of waiting forever.
+      if maxRowID < cursor {
+        cursor = maxRowID
+      }
+      failedRecoveries += 1
+      continuation.yield(
+        .reconnected(
+          MessageWatchReconnect(
+            reason: reason, detail: detail, resumeRowID: cursor, store: reopened)))
+      schedulePoll()
+    } catch {
+      // The file may be mid-replacement; retry on the next health check.
+      failedRecoveries += 1
+      needsReopen = true
+      if failedRecoveries >= configuration.maxReopenAttempts {
+        finish(throwing: error)
+      }
+    }
+  }
+
+  private func finish(throwing error: Error) {
+    guard !finished else { return }
+    finished = true
+    cancelSources()
+    cancelTimers()
+    continuation.finish(throwing: error)
   }
 
   private func makeSource(path: String) -> DispatchSourceFileSystemObject? {
@@ -124,20 +363,91 @@ private final class WatchState: @unchecked Sendable {
   }
 
   private func poll() {
+    guard !finished else { return }
+    sawActivity = false
+    defer { scheduleFallbackPoll(activity: sawActivity) }
+    if canRecover, wasReplaced() {
+      recover(reason: .replaced, detail: nil)
+      return
+    }
     do {
-      let messages = try store.messagesAfter(
-        afterRowID: cursor,
-        chatID: chatID,
-        limit: configuration.batchLimit
-      )
-      for message in messages {
-        continuation.yield(message)
-        if message.rowID > cursor {
-          cursor = message.rowID
+      let kinds = configuration.events
+      let limit = configuration.batchLimit
+      let messages = try store.messagesAfter(afterRowID: cursor, chatID: chatID, limit: limit)
+      var rows = messages.map { (rowID: $0.rowID, event: MessageWatchEvent.message($0)) }
+      // A full batch may stop short of the other query's rows; stop both at the lower end.
+      var through = messages.count == limit ? messages.last?.rowID : nil
+      if kinds.contains(.reactions) {
+        let reactions = try store.reactionEvents(afterRowID: cursor, chatID: chatID, limit: limit)
+        if reactions.count == limit, let last = reactions.last?.reaction.rowID {
+          through = min(through ?? last, last)
         }
+        rows += reactions.map { (rowID: $0.reaction.rowID, event: MessageWatchEvent.reaction($0)) }
+      }
+      failedRecoveries = 0
+      for row in rows.sorted(by: { $0.rowID < $1.rowID }) {
+        if let through, row.rowID > through { break }
+        if case .message(let message) = row.event {
+          if message.groupEvent != nil {
+            // Renames and member changes add no chat rows the lookup cache would notice.
+            store.invalidateLookupCache()
+          }
+          if kinds.contains(.messages) {
+            report(row.event)
+          }
+        } else {
+          report(row.event)
+        }
+        if row.rowID > cursor {
+          cursor = row.rowID
+        }
+      }
+      try reportChanges(kinds)
+    } catch let error as SQLite.Result where canRecover {
+      if failedRecoveries >= configuration.maxReopenAttempts {
+        finish(throwing: error)
+      } else {
+        recover(reason: .error, detail: String(describing: error))
       }
     } catch {
-      continuation.finish(throwing: error)
+      finish(throwing: error)
+    }
+  }
+
+  /// Compares the newest messages' edit and read times with the last poll's and reports what
+  /// changed. A message's first sighting only records it.
+  private func reportChanges(_ kinds: MessageWatchEventKinds) throws {
+    guard !kinds.isDisjoint(with: [.edits, .deletes, .receipts]) else { return }
+    let floor = max(0, cursor - Int64(configuration.changeWindow))
+    var next: [Int64: MessageRowState] = [:]
+    for state in try store.messageRowStates(
+      afterRowID: floor, throughRowID: cursor, chatID: chatID)
+    {
+      next[state.rowID] = state
+      guard let previous = rowStates[state.rowID] else { continue }
+      if state.editedAt != 0, state.editedAt != previous.editedAt,
+        let message = try store.message(rowID: state.rowID)
+      {
+        let date = AppleTime.date(fromRaw: state.editedAt)
+        if try store.isUnsent(rowID: state.rowID) {
+          if kinds.contains(.deletes) {
+            report(.deleted(MessageDeleteEvent(message: message, deletedAt: date)))
+          }
+        } else if kinds.contains(.edits) {
+          let history = try store.editHistory(rowID: state.rowID)
+          let part = history.last?.part
+          let previousText = history.filter { $0.part == part }.dropLast().last?.text
+          report(
+            .edited(MessageEditEvent(message: message, editedAt: date, previousText: previousText)))
+        }
+      }
+      if kinds.contains(.receipts), state.readAt != 0, previous.readAt == 0,
+        let message = try store.message(rowID: state.rowID)
+      {
+        let date = AppleTime.date(fromRaw: state.readAt)
+        report(.receipt(MessageReceiptEvent(message: message, readAt: date)))
+      }
     }
+    rowStates = next
   }
 }
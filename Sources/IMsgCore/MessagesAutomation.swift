@@ -0,0 +1,147 @@
+import Carbon
+import Foundation
+
+/// A Messages.app service/account as reported by AppleScript.
+public struct MessagesAccount: Sendable, Equatable {
+  public let id: String
+  public let serviceType: String
+  public let name: String
+  public let enabled: Bool
+  public let connectionStatus: String
+
+  public init(id: String, serviceType: String, name: String, enabled: Bool, connectionStatus: String)
+  {
+    self.id = id
+    self.serviceType = serviceType
+    self.name = name
+    self.enabled = enabled
+    self.connectionStatus = connectionStatus
+  }
+
+  public var isSMS: Bool {
+    serviceType.caseInsensitiveCompare("SMS") == .orderedSame
+  }
+
+  /// Whether `query` names this account: its id, or its name with or without the `E:`/`P:`
+  /// prefix Messages puts on Apple ID emails and phone numbers, ignoring case.
+  public func matches(_ query: String) -> Bool {
+    let query = query.trimmingCharacters(in: .whitespaces)
+    guard !query.isEmpty else { return false }
+    if id == query { return true }
+    return [id, name].map(MessagesAccount.strippingAddressPrefix).contains {
+      $0.caseInsensitiveCompare(MessagesAccount.strippingAddressPrefix(query)) == .orderedSame
+    }
+  }
+
+  private static func strippingAddressPrefix(_ value: String) -> String {
+    let lower = value.lowercased()
+    return lower.hasPrefix("e:") || lower.hasPrefix("p:") ? String(value.dropFirst(2)) : value
+  }
+}
+
+public enum AutomationPermissionStatus: String, Sendable, Codable {
+  case granted
+  case denied
+  case notDetermined = "not_determined"
+  case appNotRunning = "app_not_running"
+  case unknown
+}
+
+/// Read-only probes against Messages.app via Apple Events.
+public enum MessagesAutomation {
+  public static let bundleIdentifier = "com.apple.MobileSMS"
+
+  /// Checks the Automation (Apple Events) permission for Messages without prompting the user.
+  public static func permissionStatus() -> AutomationPermissionStatus {
+    let target = NSAppleEventDescriptor(bundleIdentifier: bundleIdentifier)
+    guard let address = target.aeDesc else { return .unknown }
+    let status = AEDeterminePermissionToAutomateTarget(
+      address,
+      AEEventClass(typeWildCard),
+      AEEventID(typeWildCard),
+      false
+    )
+    return permissionStatus(for: Int(status))
+  }
+
+  static func permissionStatus(for code: Int) -> AutomationPermissionStatus {
+    switch code {
+    case Int(noErr):
+      return .granted
+    case Int(errAEEventNotPermitted):
+      return .denied
+    case Int(errAEEventWouldRequireUserConsent):
+      return .notDetermined
+    case Int(procNotFound):
+      return .appNotRunning
+    default:
+      return .unknown
+    }
+  }
+
+  /// Number of enabled Messages services (iMessage, SMS relay, ...). Zero means signed out.
+  public static func enabledServiceCount() throws -> Int {
+    let result = try evaluate(
+      """
+      tell application "Messages"
+          return count of (every service whose enabled is true)
+      end tell
+      """)
+    return Int(result.int32Value)
+  }
+
+  /// Lists Messages services (iMessage, SMS relay, ...) with their enabled/connection state.
+  public static func accounts() throws -> [MessagesAccount] {
+    let result = try evaluate(
+      """
+      tell application "Messages"
+          set rows to {}
+          repeat with acct in services
+              set end of rows to (id of acct) & tab & (service type of acct as text) & tab & ¬
+                  (name of acct) & tab & (enabled of acct as text) & tab & ¬
+                  (connection status of acct as text)
+          end repeat
+          set AppleScript's text item delimiters to linefeed
+          return rows as text
+      end tell
+      """)
+    return parseAccounts(result.stringValue ?? "")
+  }
+
+  static func parseAccounts(_ output: String) -> [MessagesAccount] {
+    var accounts: [MessagesAccount] = []
+    for line in output.split(whereSeparator: \.isNewline) {
+      let fields = line.split(separator: "\t", omittingEmptySubsequences: false).map(String.init)
+      guard fields.count >= 5 else { continue }
+      accounts.append(
+        MessagesAccount(
+          id: fields[0],
+          serviceType: fields[1],
+          name: fields[2],
+          enabled: fields[3].lowercased() == "true",
+          connectionStatus: fields[4]
+        ))
+    }
+    return accounts
+  }
+
+  /// Runs `source` through `AppleScriptGate.shared`, like every other script aimed at Messages.
+  static func evaluate(_ source: String) throws -> NSAppleEventDescriptor {
+    guard let script = NSAppleScript(source: source) else {
+      throw IMsgError.appleScriptFailure("Unable to compile AppleScript")
+    }
+    return try AppleScriptGate.shared.run {
+      var errorInfo: NSDictionary?
+      let result = script.executeAndReturnError(&errorInfo)
+      if let errorInfo {
+        var message =
+          (errorInfo[NSAppleScript.errorMessage] as? String) ?? "Unknown AppleScript error"
+        if let number = errorInfo[NSAppleScript.errorNumber] as? Int {
+          message += " (\(number))"
+        }
+        throw IMsgError.appleScriptFailure(message)
+      }
+      return result
+    }
+  }
+}
@@ -190,16 +190,32 @@ public struct Chat: Sendable, Equatable {
   public let name: String
   public let service: String
   public let lastMessageAt: Date
+  /// Messages in the chat, tapbacks not counted.
+  public let messageCount: Int
 
-  public init(id: Int64, identifier: String, name: String, service: String, lastMessageAt: Date) {
+  public init(
+    id: Int64, identifier: String, name: String, service: String, lastMessageAt: Date,
+    messageCount: Int = 0
+  ) {
     self.id = id
     self.identifier = identifier
     self.name = name
     self.service = service
     self.lastMessageAt = lastMessageAt
+    self.messageCount = messageCount
   }
 }
 
+/// Order of `MessageStore.listChats`; raw values are the `chats --sort` names.
+public enum ChatSortOrder: String, Sendable, CaseIterable {
+  /// Most recently active first.
+  case lastMessage = "last-message"
+  /// By display name (or identifier), case-insensitively.
+  case name
+  /// Most messages first.
+  case messageCount = "message-count"
+}
+
 public struct ChatInfo: Sendable, Equatable {
   public let id: Int64
   public let identifier: String
@@ -228,6 +244,15 @@ public struct Message: Sendable, Equatable {
   public let service: String
   public let handleID: Int64?
   public let attachmentsCount: Int
+  /// Set for iMessage app/extension messages (games, Apple Pay, stickers, ...).
+  public let app: AppMessageInfo?
+  /// @-mentions decoded from `attributedBody`; empty outside group chats.
+  public let mentions: [MessageMention]
+  /// Local account the message went through, from `message.account`: "p:+15551234567" for a
+  /// phone number, "e:me@icloud.com" for an email; empty when Messages didn't record one.
+  public let account: String
+  /// Set for group system messages (joins, leaves, renames, photo changes).
+  public let groupEvent: GroupEvent?
 
   public init(
     rowID: Int64,
@@ -240,7 +265,11 @@ public struct Message: Sendable, Equatable {
     handleID: Int64?,
     attachmentsCount: Int,
     guid: String = "",
-    replyToGUID: String? = nil
+    replyToGUID: String? = nil,
+    app: AppMessageInfo? = nil,
+    mentions: [MessageMention] = [],
+    account: String = "",
+    groupEvent: GroupEvent? = nil
   ) {
     self.rowID = rowID
     self.chatID = chatID
@@ -253,6 +282,10 @@ public struct Message: Sendable, Equatable {
     self.service = service
     self.handleID = handleID
     self.attachmentsCount = attachmentsCount
+    self.app = app
+    self.mentions = mentions
+    self.account = account
+    self.groupEvent = groupEvent
   }
 }
 
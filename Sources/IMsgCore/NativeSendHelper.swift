@@ -0,0 +1,109 @@
+import Foundation
+
+/// How `MessageSender` hands a message to Messages.
+public enum SendBackend: String, Sendable, CaseIterable {
+  /// Apple events through NSAppleScript, falling back to osascript. Needs the Automation
+  /// permission for Messages.
+  case applescript
+  /// A separate `imsg-send-helper` binary that sends without Apple events.
+  case native
+}
+
+/// Runs the native send helper: one JSON request on stdin, exit status 0 once Messages
+/// accepted the message, an error message on stderr otherwise. The helper is the package's
+/// `imsg-send-helper` product, shipped next to imsg; `$IMSG_SEND_HELPER` points at another one.
+public struct NativeSendHelper: Sendable {
+  public static let environmentKey = "IMSG_SEND_HELPER"
+  public static let executableName = "imsg-send-helper"
+
+  struct Request: Encodable, Equatable {
+    let recipient: String?
+    let chatGUID: String?
+    let text: String
+    let attachments: [String]
+    let service: String
+    let groupRecipients: [String]?
+    let groupName: String?
+    let accountID: String?
+
+    enum CodingKeys: String, CodingKey {
+      case recipient
+      case chatGUID = "chat_guid"
+      case text
+      case attachments
+      case service
+      case groupRecipients = "group_recipients"
+      case groupName = "group_name"
+      case accountID = "account_id"
+    }
+  }
+
+  public let executableURL: URL
+
+  public init(executableURL: URL) {
+    self.executableURL = executableURL
+  }
+
+  /// `$IMSG_SEND_HELPER`, else `imsg-send-helper` beside the running executable; nil when
+  /// neither is an executable file.
+  public static func locate(
+    environment: [String: String] = ProcessInfo.processInfo.environment,
+    executableDirectory: URL? = Bundle.main.executableURL?.deletingLastPathComponent()
+  ) -> NativeSendHelper? {
+    var candidates: [URL] = []
+    if let override = environment[environmentKey], !override.isEmpty {
+      candidates.append(URL(fileURLWithPath: NSString(string: override).expandingTildeInPath))
+    } else if let executableDirectory {
+      candidates.append(executableDirectory.appendingPathComponent(executableName))
+    }
+    return candidates.first { FileManager.default.isExecutableFile(atPath: $0.path) }
+      .map(NativeSendHelper.init(executableURL:))
+  }
+
+  static func request(for options: MessageSendOptions, chatTarget: String) -> Request {
+    let group = chatTarget.isEmpty && !options.groupRecipients.isEmpty
+    return Request(
+      recipient: chatTarget.isEmpty && !group ? options.recipient : nil,
+      chatGUID: chatTarget.isEmpty ? nil : chatTarget,
+      text: options.text,
+      attachments: options.attachmentPaths,
+      service: options.service.rawValue,
+      groupRecipients: group ? options.groupRecipients : nil,
+      groupName: group && !options.groupName.isEmpty ? options.groupName : nil,
+      accountID: chatTarget.isEmpty && !options.accountID.isEmpty ? options.accountID : nil
+    )
+  }
+
+  func send(_ request: Request, logger: AutomationLogger) throws {
+    let encoder = JSONEncoder()
+    encoder.outputFormatting = [.sortedKeys]
+    // Stdin is a file rather than a pipe: a helper that exits without reading its request
+    // would otherwise kill imsg with SIGPIPE on the write.
+    let requestURL = FileManager.default.temporaryDirectory
+      .appendingPathComponent("imsg-send-\(UUID().uuidString).json")
+    try encoder.encode(request).write(to: requestURL)
+    defer { try? FileManager.default.removeItem(at: requestURL) }
+    let requestHandle = try FileHandle(forReadingFrom: requestURL)
+    defer { try? requestHandle.close() }
+    let process = Process()
+    process.executableURL = executableURL
+    let stderrPipe = Pipe()
+    process.standardInput = requestHandle
+    process.standardOutput = FileHandle.nullDevice
+    process.standardError = stderrPipe
+    let started = Date()
+    try process.run()
+    let stderr = String(
+      data: stderrPipe.fileHandleForReading.readDataToEndOfFile(), encoding: .utf8) ?? ""
+    process.waitUntilExit()
+    logger.log(
+      .info,
+      "\(executableURL.lastPathComponent) exited \(process.terminationStatus) in "
+        + "\(MessageSender.elapsedMilliseconds(since: started))ms")
+    if process.terminationStatus != 0 {
+      let message = stderr.trimmingCharacters(in: .whitespacesAndNewlines)
+      throw IMsgError.sendHelperFailure(
+        message.isEmpty ? "exited with status \(process.terminationStatus)" : message)
+    }
+  }
+}
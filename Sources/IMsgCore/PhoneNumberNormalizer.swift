@@ -1,15 +1,94 @@
 import Foundation
 import PhoneNumberKit
 
-final class PhoneNumberNormalizer {
+/// Canonical handle forms shared by send, participant filters, and group lookup:
+/// phone numbers become E.164 (using `region` when there is no country code), emails lowercase.
+public final class PhoneNumberNormalizer: @unchecked Sendable {
+  public static let shared = PhoneNumberNormalizer()
+
   private let phoneNumberUtility = PhoneNumberUtility()
+  private let lock = NSLock()
+  private var handleCache: [String: String] = [:]
+  private var regionCache: [String: String?] = [:]
+
+  public init() {}
 
-  func normalize(_ input: String, region: String) -> String {
-    do {
-      let number = try phoneNumberUtility.parse(input, withRegion: region, ignoreType: true)
-      return phoneNumberUtility.format(number, toType: .e164)
-    } catch {
-      return input
+  /// E.164 for a parseable phone number, otherwise `input` unchanged.
+  public func normalize(_ input: String, region: String) -> String {
+    lock.lock()
+    defer { lock.unlock() }
+    return parsePhone(input, region: region) ?? input
+  }
+
+  /// Comparison key for a phone number or email; unparseable handles compare case-insensitively.
+  public func normalizeHandle(_ handle: String, region: String = "US") -> String {
+    let trimmed = handle.trimmingCharacters(in: .whitespacesAndNewlines)
+    if trimmed.contains("@") { return trimmed.lowercased() }
+    let key = region + "\u{0}" + trimmed
+    lock.lock()
+    defer { lock.unlock() }
+    if let cached = handleCache[key] { return cached }
+    let normalized = parsePhone(trimmed, region: region) ?? trimmed.lowercased()
+    handleCache[key] = normalized
+    return normalized
+  }
+
+  /// Whether `handle` looks addressable: an email, a phone number, or an SMS short code.
+  public func isValidHandle(_ handle: String, region: String = "US") -> Bool {
+    let trimmed = handle.trimmingCharacters(in: .whitespacesAndNewlines)
+    if trimmed.contains("@") {
+      let parts = trimmed.split(separator: "@", omittingEmptySubsequences: false)
+      return parts.count == 2 && !parts[0].isEmpty && parts[1].contains(".")
+    }
+    if (3...8).contains(trimmed.count), trimmed.allSatisfy(\.isNumber) { return true }
+    // Metadata lags new number ranges, so accept anything shaped like a phone number too.
+    let phoneCharacters = Set("+0123456789 -().")
+    let digits = trimmed.filter(\.isNumber).count
+    if trimmed.allSatisfy({ phoneCharacters.contains($0) }), (7...15).contains(digits) {
+      return true
     }
+    lock.lock()
+    defer { lock.unlock() }
+    return parsePhone(trimmed, region: region) != nil
+  }
+
+  /// ISO region code (`GB`) of a phone handle written with its country code (`+44…`). Nil
+  /// for emails, short codes and local numbers, whose region can't be told from the handle.
+  public func region(of handle: String) -> String? {
+    let trimmed = handle.trimmingCharacters(in: .whitespacesAndNewlines)
+    guard trimmed.hasPrefix("+") else { return nil }
+    lock.lock()
+    defer { lock.unlock() }
+    if let cached = regionCache[trimmed] { return cached }
+    let region = (try? phoneNumberUtility.parse(trimmed, ignoreType: true)).flatMap {
+      phoneNumberUtility.getRegionCode(of: $0)
+    }
+    regionCache[trimmed] = region
+    return region
+  }
+
+  /// Flag emoji for a two-letter region code (`GB` → 🇬🇧), built from regional indicator
+  /// symbols; nil for anything else, such as `001` for non-geographic numbers.
+  public static func flag(forRegion region: String) -> String? {
+    let letters = region.uppercased().unicodeScalars
+    guard letters.count == 2, letters.allSatisfy({ ("A"..."Z").contains($0) }) else { return nil }
+    var flag = ""
+    for letter in letters {
+      guard let indicator = Unicode.Scalar(0x1F1E6 + letter.value - 65) else { return nil }
+      flag.unicodeScalars.append(indicator)
+    }
+    return flag
+  }
+
+  /// Normalized handles with duplicates removed, in first-seen order.
+  public func uniqueHandles(_ handles: [String], region: String = "US") -> [String] {
+    var seen = Set<String>()
+    return handles.map { normalizeHandle($0, region: region) }.filter { seen.insert($0).inserted }
+  }
+
+  private func parsePhone(_ input: String, region: String) -> String? {
+    guard let number = try? phoneNumberUtility.parse(input, withRegion: region, ignoreType: true)
+    else { return nil }
+    return phoneNumberUtility.format(number, toType: .e164)
   }
 }
@@ -0,0 +1,315 @@
+import CryptoKit
+import Foundation
+import SQLite
+
+/// Writes chats into a standalone SQLite file with a small, documented schema that does not
+/// depend on Apple's chat.db layout. Every table and column is described in the archive's own
+/// `schema_doc` table, generated from `PortableArchive.tables`.
+public final class PortableArchive {
+  public struct Column: Sendable {
+    public let name: String
+    public let definition: String
+    public let doc: String
+  }
+
+  public struct Table: Sendable {
+    public let name: String
+    public let doc: String
+    public let columns: [Column]
+    public let constraints: [String]
+
+    var createSQL: String {
+      let lines = columns.map { "  \($0.name) \($0.definition)" } + constraints.map { "  \($0)" }
+      return "CREATE TABLE \(name) (\n\(lines.joined(separator: ",\n"))\n)"
+    }
+  }
+
+  public struct Entry: Sendable {
+    public let message: Message
+    public let attachments: [AttachmentMeta]
+    public let reactions: [Reaction]
+
+    public init(message: Message, attachments: [AttachmentMeta], reactions: [Reaction]) {
+      self.message = message
+      self.attachments = attachments
+      self.reactions = reactions
+    }
+  }
+
+  /// Totals for the `blobs` table.
+  public struct BlobStats: Sendable, Equatable {
+    /// Distinct files stored.
+    public let blobs: Int
+    public let storedBytes: Int64
+    /// Bytes the repeated copies would have taken had each attachment kept its own.
+    public let savedBytes: Int64
+  }
+
+  /// Bumped on incompatible schema changes; stored as `meta.format_version`. Version 2 moved
+  /// attachment contents into the deduplicated `blobs` table.
+  public static let formatVersion = 2
+
+  public static let tables: [Table] = [
+    Table(
+      name: "meta", doc: "Archive-level facts as key/value pairs.",
+      columns: [
+        Column(name: "key", definition: "TEXT PRIMARY KEY", doc: "format_version, generator, "
+          + "exported_at (ISO 8601), includes_blobs (0/1)"),
+        Column(name: "value", definition: "TEXT NOT NULL", doc: "Value for the key."),
+      ], constraints: []),
+    Table(
+      name: "handles", doc: "Phone numbers and email addresses seen in the archive.",
+      columns: [
+        Column(name: "id", definition: "INTEGER PRIMARY KEY", doc: "Archive-local id."),
+        Column(
+          name: "address", definition: "TEXT NOT NULL UNIQUE",
+          doc: "Phone number or email as Messages recorded it."),
+      ], constraints: []),
+    Table(
+      name: "chats", doc: "One row per conversation.",
+      columns: [
+        Column(name: "id", definition: "INTEGER PRIMARY KEY", doc: "chat.db chat rowid."),
+        Column(name: "guid", definition: "TEXT NOT NULL", doc: "Messages chat guid."),
+        Column(
+          name: "identifier", definition: "TEXT NOT NULL",
+          doc: "Handle for 1:1 chats, chatNNN for groups."),
+        Column(name: "name", definition: "TEXT", doc: "Group name, if set."),
+        Column(name: "service", definition: "TEXT", doc: "iMessage, SMS, ..."),
+        Column(name: "is_group", definition: "INTEGER NOT NULL", doc: "1 for group chats."),
+      ], constraints: []),
+    Table(
+      name: "chat_participants", doc: "Handles in each chat, excluding yourself.",
+      columns: [
+        Column(
+          name: "chat_id", definition: "INTEGER NOT NULL REFERENCES chats(id)", doc: "Chat."),
+        Column(
+          name: "handle_id", definition: "INTEGER NOT NULL REFERENCES handles(id)",
+          doc: "Participant."),
+      ], constraints: ["PRIMARY KEY (chat_id, handle_id)"]),
+    Table(
+      name: "messages", doc: "Messages, excluding tapback rows (see reactions).",
+      columns: [
+        Column(name: "id", definition: "INTEGER PRIMARY KEY", doc: "chat.db message rowid."),
+        Column(
+          name: "guid", definition: "TEXT", doc: "Messages guid, stable across devices."),
+        Column(
+          name: "chat_id", definition: "INTEGER NOT NULL REFERENCES chats(id)", doc: "Chat."),
+        Column(
+          name: "sender_handle_id", definition: "INTEGER REFERENCES handles(id)",
+          doc: "Sender; NULL when is_from_me."),
+        Column(name: "is_from_me", definition: "INTEGER NOT NULL", doc: "1 if you sent it."),
+        Column(name: "text", definition: "TEXT NOT NULL", doc: "Plain-text body."),
+        Column(name: "sent_at", definition: "TEXT NOT NULL", doc: "ISO 8601 timestamp, UTC."),
+        Column(name: "sent_at_unix", definition: "REAL NOT NULL", doc: "Seconds since 1970."),
+        Column(name: "service", definition: "TEXT", doc: "iMessage, SMS, ..."),
+        Column(
+          name: "reply_to_guid", definition: "TEXT",
+          doc: "guid of the message this replies to, if any."),
+      ], constraints: []),
+    Table(
+      name: "blobs", doc: "Attachment contents, stored once per distinct file.",
+      columns: [
+        Column(
+          name: "sha256", definition: "TEXT PRIMARY KEY", doc: "Hex SHA-256 of the contents."),
+        Column(name: "size", definition: "INTEGER NOT NULL", doc: "Length in bytes."),
+        Column(
+          name: "ref_count", definition: "INTEGER NOT NULL",
+          doc: "Number of attachments rows that point here."),
+        Column(name: "data", definition: "BLOB NOT NULL", doc: "File contents."),
+      ], constraints: []),
+    Table(
+      name: "attachments", doc: "Files attached to messages.",
+      columns: [
+        Column(name: "id", definition: "INTEGER PRIMARY KEY", doc: "Archive-local id."),
+        Column(
+          name: "message_id", definition: "INTEGER NOT NULL REFERENCES messages(id)",
+          doc: "Message."),
+        Column(name: "position", definition: "INTEGER NOT NULL", doc: "Order within the message."),
+        Column(name: "filename", definition: "TEXT", doc: "Name shown to the user."),
+        Column(name: "mime_type", definition: "TEXT", doc: "MIME type, if known."),
+        Column(name: "uti", definition: "TEXT", doc: "Uniform type identifier."),
+        Column(name: "total_bytes", definition: "INTEGER", doc: "Size Messages recorded."),
+        Column(name: "is_sticker", definition: "INTEGER NOT NULL", doc: "1 for stickers."),
+        Column(name: "original_path", definition: "TEXT", doc: "Path on the exporting Mac."),
+        Column(
+          name: "missing", definition: "INTEGER NOT NULL",
+          doc: "1 if the file was not on disk at export time."),
+        Column(
+          name: "blob_sha256", definition: "TEXT REFERENCES blobs(sha256)",
+          doc: "Contents in blobs when exported with blobs; otherwise NULL."),
+      ], constraints: []),
+    Table(
+      name: "reactions", doc: "Tapbacks on messages.",
+      columns: [
+        Column(name: "id", definition: "INTEGER PRIMARY KEY", doc: "chat.db message rowid."),
+        Column(
+          name: "message_id", definition: "INTEGER NOT NULL REFERENCES messages(id)",
+          doc: "Message reacted to."),
+        Column(
+          name: "sender_handle_id", definition: "INTEGER REFERENCES handles(id)",
+          doc: "Who reacted; NULL when is_from_me."),
+        Column(name: "is_from_me", definition: "INTEGER NOT NULL", doc: "1 if you reacted."),
+        Column(name: "type", definition: "TEXT NOT NULL", doc: "love, like, laugh, ..."),
+        Column(name: "emoji", definition: "TEXT NOT NULL", doc: "Emoji for the tapback."),
+        Column(name: "reacted_at", definition: "TEXT NOT NULL", doc: "ISO 8601 timestamp, UTC."),
+      ], constraints: []),
+    Table(
+      name: "schema_doc", doc: "This documentation.",
+      columns: [
+        Column(name: "table_name", definition: "TEXT NOT NULL", doc: "Table."),
+        Column(
+          name: "column_name", definition: "TEXT",
+          doc: "Column; NULL for the table description."),
+        Column(name: "description", definition: "TEXT NOT NULL", doc: "What it holds."),
+      ], constraints: []),
+  ]
+
+  public let path: String
+  public let includesBlobs: Bool
+  private let db: Connection
+  private var handleIDs: [String: Int64] = [:]
+  public private(set) var messageCount = 0
+
+  /// Creates the archive at `path`, which must not exist yet: an archive is built beside its
+  /// destination and moved into place once complete, so a failed run never costs the old one.
+  public init(path: String, includeBlobs: Bool, generator: String) throws {
+    guard !FileManager.default.fileExists(atPath: path) else {
+      throw CocoaError(.fileWriteFileExists, userInfo: [NSFilePathErrorKey: path])
+    }
+    self.path = path
+    self.includesBlobs = includeBlobs
+    db = try Connection(path)
+    try db.transaction {
+      for table in PortableArchive.tables {
+        try db.run(table.createSQL)
+      }
+      try db.run("CREATE INDEX messages_chat_sent ON messages(chat_id, sent_at_unix)")
+      try db.run("CREATE INDEX attachments_message ON attachments(message_id)")
+      try db.run("CREATE INDEX reactions_message ON reactions(message_id)")
+      for table in PortableArchive.tables {
+        try db.run("INSERT INTO schema_doc VALUES (?, NULL, ?)", table.name, table.doc)
+        for column in table.columns {
+          try db.run(
+            "INSERT INTO schema_doc VALUES (?, ?, ?)", table.name, column.name, column.doc)
+        }
+      }
+      let meta: [(String, String)] = [
+        ("format_version", String(PortableArchive.formatVersion)),
+        ("generator", generator),
+        ("exported_at", ISO8601Parser.format(Date())),
+        ("includes_blobs", includeBlobs ? "1" : "0"),
+      ]
+      for (key, value) in meta {
+        try db.run("INSERT INTO meta VALUES (?, ?)", key, value)
+      }
+    }
+  }
+
+  /// Records the chat and its participants; its messages follow through `add(entries:chatID:)`.
+  public func add(chat: ChatInfo, isGroup: Bool, participants: [String]) throws {
+    try db.transaction {
+      try db.run(
+        "INSERT OR REPLACE INTO chats VALUES (?, ?, ?, ?, ?, ?)",
+        chat.id, chat.guid, chat.identifier, chat.name.isEmpty ? nil : chat.name, chat.service,
+        isGroup ? 1 : 0)
+      for participant in participants {
+        try db.run(
+          "INSERT OR IGNORE INTO chat_participants VALUES (?, ?)", chat.id,
+          try handleID(participant))
+      }
+    }
+  }
+
+  /// Appends one batch of a chat's messages in a single transaction.
+  public func add(entries: [Entry], chatID: Int64) throws {
+    try db.transaction {
+      for entry in entries {
+        let message = entry.message
+        var sender: Int64?
+        if !message.isFromMe && !message.sender.isEmpty {
+          sender = try handleID(message.sender)
+        }
+        try db.run(
+          "INSERT OR REPLACE INTO messages VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+          message.rowID, message.guid.isEmpty ? nil : message.guid, chatID, sender,
+          message.isFromMe ? 1 : 0, message.text, ISO8601Parser.format(message.date),
+          message.date.timeIntervalSince1970, message.service, message.replyToGUID)
+        try releaseBlobs(messageID: message.rowID)
+        try db.run("DELETE FROM attachments WHERE message_id = ?", message.rowID)
+        for (position, meta) in entry.attachments.enumerated() {
+          var blob: String?
+          if includesBlobs, !meta.missing,
+            let contents = FileManager.default.contents(atPath: meta.originalPath)
+          {
+            blob = try storeBlob(contents)
+          }
+          let name = meta.transferName.isEmpty ? meta.filename : meta.transferName
+          try db.run(
+            """
+            INSERT INTO attachments(message_id, position, filename, mime_type, uti, total_bytes,
+              is_sticker, original_path, missing, blob_sha256)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            """,
+            message.rowID, position, name, meta.mimeType, meta.uti, meta.totalBytes,
+            meta.isSticker ? 1 : 0, meta.originalPath, meta.missing ? 1 : 0, blob)
+        }
+        for reaction in entry.reactions {
+          var reactor: Int64?
+          if !reaction.isFromMe && !reaction.sender.isEmpty {
+            reactor = try handleID(reaction.sender)
+          }
+          try db.run(
+            "INSERT OR REPLACE INTO reactions VALUES (?, ?, ?, ?, ?, ?, ?)",
+            reaction.rowID, message.rowID, reactor, reaction.isFromMe ? 1 : 0,
+            reaction.reactionType.name, reaction.reactionType.emoji,
+            ISO8601Parser.format(reaction.date))
+        }
+      }
+    }
+    messageCount += entries.count
+  }
+
+  public func blobStats() throws -> BlobStats {
+    let row = try db.prepare(
+      "SELECT COUNT(*), IFNULL(SUM(size), 0), IFNULL(SUM((ref_count - 1) * size), 0) FROM blobs"
+    ).makeIterator().next()
+    return BlobStats(
+      blobs: Int(row?[0] as? Int64 ?? 0), storedBytes: row?[1] as? Int64 ?? 0,
+      savedBytes: row?[2] as? Int64 ?? 0)
+  }
+
+  /// Stores `contents` unless an identical file is already in `blobs`, counts the reference,
+  /// and returns the hash. Group chats pass the same images around a lot.
+  private func storeBlob(_ contents: Data) throws -> String {
+    let hash = SHA256.hash(data: contents).map { String(format: "%02x", $0) }.joined()
+    try db.run("UPDATE blobs SET ref_count = ref_count + 1 WHERE sha256 = ?", hash)
+    if db.changes == 0 {
+      try db.run(
+        "INSERT INTO blobs VALUES (?, ?, 1, ?)", hash, Int64(contents.count),
+        Blob(bytes: [UInt8](contents)))
+    }
+    return hash
+  }
+
+  /// Drops the references held by a message's attachments before they are rewritten, and
+  /// the blobs nothing points to anymore.
+  private func releaseBlobs(messageID: Int64) throws {
+    let hashes = try db.prepare(
+      "SELECT blob_sha256 FROM attachments WHERE message_id = ? AND blob_sha256 IS NOT NULL",
+      messageID
+    ).compactMap { $0[0] as? String }
+    guard !hashes.isEmpty else { return }
+    for hash in hashes {
+      try db.run("UPDATE blobs SET ref_count = ref_count - 1 WHERE sha256 = ?", hash)
+    }
+    try db.run("DELETE FROM blobs WHERE ref_count <= 0")
+  }
+
+  private func handleID(_ address: String) throws -> Int64 {
+    if let id = handleIDs[address] { return id }
+    try db.run("INSERT OR IGNORE INTO handles(address) VALUES (?)", address)
+    let id = try db.scalar("SELECT id FROM handles WHERE address = ?", address) as? Int64 ?? 0
+    handleIDs[address] = id
+    return id
+  }
+}
@@ -0,0 +1,45 @@
+import Foundation
+
+/// A daily do-not-disturb window such as `22:00-08:00` in local time; it may wrap past
+/// midnight. Sends that fall inside it wait for the window to end.
+public struct QuietHours: Sendable, Equatable {
+  /// Minutes after midnight.
+  public let start: Int
+  public let end: Int
+
+  public init?(_ spec: String) {
+    let parts = spec.split(separator: "-", maxSplits: 1).map {
+      $0.trimmingCharacters(in: .whitespaces)
+    }
+    guard parts.count == 2, let start = QuietHours.minutes(parts[0]),
+      let end = QuietHours.minutes(parts[1]), start != end
+    else {
+      return nil
+    }
+    self.start = start
+    self.end = end
+  }
+
+  /// When the window containing `date` ends, or nil when `date` is outside quiet hours.
+  public func end(containing date: Date, calendar: Calendar = .current) -> Date? {
+    let components = calendar.dateComponents([.hour, .minute], from: date)
+    let minute = (components.hour ?? 0) * 60 + (components.minute ?? 0)
+    let inside = start < end ? (start..<end).contains(minute) : (minute >= start || minute < end)
+    guard inside else { return nil }
+    return calendar.nextDate(
+      after: date,
+      matching: DateComponents(hour: end / 60, minute: end % 60, second: 0),
+      matchingPolicy: .nextTime
+    )
+  }
+
+  private static func minutes(_ value: String) -> Int? {
+    let parts = value.split(separator: ":", maxSplits: 1)
+    guard parts.count == 2, let hour = Int(parts[0]), let minute = Int(parts[1]),
+      (0..<24).contains(hour), (0..<60).contains(minute)
+    else {
+      return nil
+    }
+    return hour * 60 + minute
+  }
+}
@@ -0,0 +1,87 @@
+import Darwin
+import Foundation
+
+/// Last processed rowid per database and per key, so a restarted `imsg watch --resume` picks up
+/// what arrived while it was down (keyed by filter set, in watch.json) and `imsg export
+/// --since-last` only exports what is new (keyed by chat and output, in export.json).
+public class RowCursorStore {
+  private struct Snapshot: Codable {
+    var databases: [String: [String: Int64]] = [:]
+  }
+
+  public let fileURL: URL
+  private let databasePath: String
+  private var snapshot: Snapshot
+  /// Cursors recorded since the last save. Only these are written back, so runs with other
+  /// keys sharing the file (two watches with different filters) keep theirs.
+  private var pending: [String: Int64] = [:]
+  private var lastSaved: Date?
+
+  public init(databasePath: String, fileURL: URL) throws {
+    self.fileURL = fileURL
+    self.databasePath = databasePath
+    self.snapshot = try RowCursorStore.load(fileURL)
+  }
+
+  /// nil until a run with this key has recorded a rowid.
+  public func cursor(for key: String) -> Int64? {
+    pending[key] ?? snapshot.databases[databasePath]?[key]
+  }
+
+  /// Replaces the cursor rather than keeping the maximum: after chat.db is rebuilt, rowids can
+  /// start over lower.
+  public func record(_ rowID: Int64, for key: String) {
+    pending[key] = rowID
+  }
+
+  /// Merges the recorded cursors into the file: re-read and rewritten under a lock, so
+  /// concurrent runs don't overwrite each other's keys.
+  public func save() throws {
+    guard !pending.isEmpty else { return }
+    try FileManager.default.createDirectory(
+      at: fileURL.deletingLastPathComponent(), withIntermediateDirectories: true)
+    try withLock {
+      var latest = try RowCursorStore.load(fileURL)
+      latest.databases[databasePath, default: [:]].merge(pending) { $1 }
+      let encoder = JSONEncoder()
+      encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+      try encoder.encode(latest).write(to: fileURL, options: .atomic)
+      snapshot = latest
+    }
+    pending = [:]
+  }
+
+  /// `save()`, unless the previous one was less than `interval` ago; a busy watch then writes
+  /// about once per interval instead of once per message. Returns whether it saved.
+  @discardableResult
+  public func saveIfDue(every interval: TimeInterval = 1, now: Date = Date()) throws -> Bool {
+    if let lastSaved, now.timeIntervalSince(lastSaved) < interval { return false }
+    try save()
+    lastSaved = now
+    return true
+  }
+
+  private static func load(_ fileURL: URL) throws -> Snapshot {
+    guard FileManager.default.fileExists(atPath: fileURL.path) else { return Snapshot() }
+    return try JSONDecoder().decode(Snapshot.self, from: Data(contentsOf: fileURL))
+  }
+
+  private func withLock<T>(_ body: () throws -> T) throws -> T {
+    let lockPath = fileURL.path + ".lock"
+    let fd = open(lockPath, O_CREAT | O_RDWR, 0o644)
+    guard fd >= 0 else {
+      throw CocoaError(.fileWriteUnknown, userInfo: [NSFilePathErrorKey: lockPath])
+    }
+    defer { close(fd) }
+    flock(fd, LOCK_EX)
+    defer { flock(fd, LOCK_UN) }
+    return try body()
+  }
+}
+
+/// The `imsg watch --resume` cursors, in watch.json in the state directory.
+public final class WatchCursorStore: RowCursorStore {
+  public init(databasePath: String, fileURL: URL = StateDirectory.fileURL("watch.json")) throws {
+    try super.init(databasePath: databasePath, fileURL: fileURL)
+  }
+}
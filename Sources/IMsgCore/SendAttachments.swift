@@ -0,0 +1,122 @@
+import Foundation
+import UniformTypeIdentifiers
+
+/// A file accepted for sending, with its size at validation time.
+public struct SendAttachment: Sendable, Equatable {
+  public enum Kind: String, Sendable {
+    case image
+    case video
+    case audio
+    case contact
+    case other
+
+    init(path: String) {
+      let ext = (path as NSString).pathExtension
+      guard let type = UTType(filenameExtension: ext) else {
+        self = .other
+        return
+      }
+      if type.conforms(to: .image) {
+        self = .image
+      } else if type.conforms(to: .movie) {
+        self = .video
+      } else if type.conforms(to: .audio) {
+        self = .audio
+      } else if type.conforms(to: .vCard) {
+        self = .contact
+      } else {
+        self = .other
+      }
+    }
+
+    /// Kinds Messages can shrink to fit a size limit.
+    public var isTranscodable: Bool { self == .image || self == .video }
+  }
+
+  public let path: String
+  public let bytes: Int64
+  public let kind: Kind
+  /// The file this one was transcoded from, when it had to be shrunk to fit.
+  public let originalPath: String?
+
+  public init(path: String, bytes: Int64, kind: Kind? = nil, originalPath: String? = nil) {
+    self.path = path
+    self.bytes = bytes
+    self.kind = kind ?? Kind(path: path)
+    self.originalPath = originalPath
+  }
+}
+
+public enum SendAttachments {
+  /// Messages rejects larger files over iMessage; SMS/MMS carriers cap far lower.
+  public static let maxBytes: Int64 = 100 * 1024 * 1024
+
+  /// Expands `~` and glob patterns (`~/Desktop/*.jpg`) and checks every file before anything is
+  /// sent: it must exist, be a regular non-empty file, and fit under `maxBytes`. Over SMS only
+  /// media and contact cards are accepted. With `allowOversizedMedia`, images and videos over
+  /// the limit pass so `AttachmentTranscoder` can shrink them.
+  public static func resolve(
+    _ patterns: [String],
+    maxBytes: Int64 = maxBytes,
+    service: MessageService = .auto,
+    allowOversizedMedia: Bool = false
+  ) throws -> [SendAttachment] {
+    var seen = Set<String>()
+    var accepted: [SendAttachment] = []
+    for pattern in patterns where !pattern.isEmpty {
+      for path in try expand(pattern) where seen.insert(path).inserted {
+        let attachment = try validate(
+          path, maxBytes: maxBytes, allowOversizedMedia: allowOversizedMedia)
+        if service == .sms && attachment.kind == .other {
+          throw IMsgError.invalidAttachment(
+            "\(path) can't be sent over SMS; MMS carries images, video, audio, and contacts")
+        }
+        accepted.append(attachment)
+      }
+    }
+    return accepted
+  }
+
+  static func expand(_ pattern: String) throws -> [String] {
+    let expanded = (pattern as NSString).expandingTildeInPath
+    guard expanded.contains(where: { "*?[".contains($0) }) else { return [expanded] }
+    var result = glob_t()
+    defer { globfree(&result) }
+    guard glob(expanded, 0, nil, &result) == 0 else {
+      throw IMsgError.invalidAttachment("no files match \(pattern)")
+    }
+    return (0..<Int(result.gl_pathc)).compactMap { index in
+      result.gl_pathv[index].map { String(cString: $0) }
+    }
+  }
+
+  static func validate(_ path: String, maxBytes: Int64, allowOversizedMedia: Bool = false) throws
+    -> SendAttachment
+  {
+    var isDirectory: ObjCBool = false
+    guard FileManager.default.fileExists(atPath: path, isDirectory: &isDirectory) else {
+      throw IMsgError.invalidAttachment("\(path) does not exist")
+    }
+    guard !isDirectory.boolValue else {
+      throw IMsgError.invalidAttachment("\(path) is a directory")
+    }
+    guard !path.contains("\n") else {
+      throw IMsgError.invalidAttachment("\(path) has a newline in its name")
+    }
+    let attributes = try FileManager.default.attributesOfItem(atPath: path)
+    let bytes = (attributes[.size] as? NSNumber)?.int64Value ?? 0
+    guard bytes > 0 else {
+      throw IMsgError.invalidAttachment("\(path) is empty")
+    }
+    let attachment = SendAttachment(path: path, bytes: bytes)
+    guard bytes <= maxBytes || (allowOversizedMedia && attachment.kind.isTranscodable) else {
+      throw IMsgError.invalidAttachment(
+        "\(path) is \(formatBytes(bytes)); the limit is \(formatBytes(maxBytes))")
+    }
+    return attachment
+  }
+
+  static func formatBytes(_ bytes: Int64) -> String {
+    ByteCountFormatter.string(fromByteCount: bytes, countStyle: .file)
+  }
+}
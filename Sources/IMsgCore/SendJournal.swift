@@ -0,0 +1,171 @@
+import Darwin
+import Foundation
+
+public struct SendJournalEntry: Codable, Sendable, Equatable {
+  public enum Status: String, Codable, Sendable {
+    case sent
+    case failed
+    /// Skipped because the idempotency key already has a `sent` entry.
+    case duplicate
+  }
+
+  public let at: Date
+  public let idempotencyKey: String?
+  /// Recipient handle(s) or chat identifier/guid.
+  public let target: String
+  public let service: String
+  /// Message bodies are not journaled, only their length.
+  public let textLength: Int
+  public let attachment: String?
+  public let status: Status
+  public let error: String?
+
+  public init(
+    at: Date = Date(),
+    idempotencyKey: String?,
+    target: String,
+    service: String,
+    textLength: Int,
+    attachment: String?,
+    status: Status,
+    error: String? = nil
+  ) {
+    self.at = at
+    self.idempotencyKey = idempotencyKey
+    self.target = target
+    self.service = service
+    self.textLength = textLength
+    self.attachment = attachment
+    self.status = status
+    self.error = error
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case at
+    case idempotencyKey = "idempotency_key"
+    case target
+    case service
+    case textLength = "text_length"
+    case attachment
+    case status
+    case error
+  }
+}
+
+/// Append-only JSON-lines log of send attempts (`sends.jsonl` in the state directory).
+/// A send with an idempotency key that already has a `sent` entry becomes a no-op. When an
+/// append would take the log past `maxBytes` it is renamed to `sends.jsonl.1`, replacing the
+/// previous one, so checking a key reads at most two logs and keys are remembered for at
+/// least `maxBytes` of attempts.
+public final class SendJournal {
+  public static let defaultMaxBytes: Int64 = 1024 * 1024
+
+  public let fileURL: URL
+  public let maxBytes: Int64
+
+  public init(
+    fileURL: URL = StateDirectory.fileURL("sends.jsonl"),
+    maxBytes: Int64 = SendJournal.defaultMaxBytes
+  ) {
+    self.fileURL = fileURL
+    self.maxBytes = maxBytes
+  }
+
+  /// Where the log goes once it fills up.
+  public var rotatedURL: URL {
+    URL(fileURLWithPath: fileURL.path + ".1")
+  }
+
+  /// The rotated log's entries followed by the current log's, oldest first.
+  public func entries() throws -> [SendJournalEntry] {
+    try entries(in: rotatedURL) + entries(in: fileURL)
+  }
+
+  private func entries(in url: URL) throws -> [SendJournalEntry] {
+    guard FileManager.default.fileExists(atPath: url.path) else { return [] }
+    let decoder = JSONDecoder()
+    decoder.dateDecodingStrategy = .iso8601
+    let contents = try String(contentsOf: url, encoding: .utf8)
+    // Skip torn or hand-edited lines instead of refusing to send.
+    return contents.split(separator: "\n").compactMap {
+      try? decoder.decode(SendJournalEntry.self, from: Data($0.utf8))
+    }
+  }
+
+  public func hasSent(idempotencyKey key: String) throws -> Bool {
+    try entries().contains { $0.idempotencyKey == key && $0.status == .sent }
+  }
+
+  /// Appends `entry`, rotating the log first when it would pass `maxBytes`.
+  public func append(_ entry: SendJournalEntry) throws {
+    let fileManager = FileManager.default
+    try fileManager.createDirectory(
+      at: fileURL.deletingLastPathComponent(), withIntermediateDirectories: true)
+    let encoder = JSONEncoder()
+    encoder.dateEncodingStrategy = .iso8601
+    encoder.outputFormatting = [.sortedKeys]
+    var line = try encoder.encode(entry)
+    line.append(contentsOf: Data("\n".utf8))
+    let size = (try? fileManager.attributesOfItem(atPath: fileURL.path)[.size] as? NSNumber)?
+      .int64Value ?? 0
+    if size > 0 && size + Int64(line.count) > maxBytes {
+      try? fileManager.removeItem(at: rotatedURL)
+      try fileManager.moveItem(at: fileURL, to: rotatedURL)
+    }
+    if !fileManager.fileExists(atPath: fileURL.path) {
+      fileManager.createFile(atPath: fileURL.path, contents: nil)
+    }
+    let handle = try FileHandle(forWritingTo: fileURL)
+    defer { try? handle.close() }
+    try handle.seekToEnd()
+    try handle.write(contentsOf: line)
+  }
+
+  /// Runs `send` unless `idempotencyKey` was already sent, and journals the outcome.
+  /// Holds an exclusive lock for the whole attempt so concurrent retries cannot both send.
+  /// Returns the status; rethrows the send error after recording it. Failing to journal an
+  /// outcome never fails the call, since the message has been sent (or skipped) by then.
+  @discardableResult
+  public func record(
+    idempotencyKey: String?,
+    target: String,
+    service: String,
+    textLength: Int,
+    attachment: String?,
+    send: () throws -> Void
+  ) throws -> SendJournalEntry.Status {
+    func entry(_ status: SendJournalEntry.Status, error: String? = nil) -> SendJournalEntry {
+      SendJournalEntry(
+        idempotencyKey: idempotencyKey, target: target, service: service,
+        textLength: textLength, attachment: attachment, status: status, error: error)
+    }
+    return try withLock {
+      if let idempotencyKey, try hasSent(idempotencyKey: idempotencyKey) {
+        try? append(entry(.duplicate))
+        return .duplicate
+      }
+      do {
+        try send()
+      } catch {
+        try? append(entry(.failed, error: String(describing: error)))
+        throw error
+      }
+      try? append(entry(.sent))
+      return .sent
+    }
+  }
+
+  private func withLock<T>(_ body: () throws -> T) throws -> T {
+    try FileManager.default.createDirectory(
+      at: fileURL.deletingLastPathComponent(), withIntermediateDirectories: true)
+    let lockPath = fileURL.path + ".lock"
+    let fd = open(lockPath, O_CREAT | O_RDWR, 0o644)
+    guard fd >= 0 else {
+      throw CocoaError(.fileWriteUnknown, userInfo: [NSFilePathErrorKey: lockPath])
+    }
+    defer { close(fd) }
+    flock(fd, LOCK_EX)
+    defer { flock(fd, LOCK_UN) }
+    return try body()
+  }
+}
@@ -0,0 +1,63 @@
+import Foundation
+
+/// How often and how patiently to retry a send that failed for a transient reason (Messages
+/// not running yet, an Apple event timing out). Delays double from `backoff` up to
+/// `maxDelay`, each spread by ±`jitter` so parallel senders don't retry in lockstep.
+public struct SendRetryPolicy: Sendable, Equatable {
+  /// Retries after the first attempt; 0 fails on the first error.
+  public let retries: Int
+  public let backoff: TimeInterval
+  /// Fraction of each delay to randomize, 0...1.
+  public let jitter: Double
+  public let maxDelay: TimeInterval
+
+  public init(
+    retries: Int = 0, backoff: TimeInterval = 1, jitter: Double = 0.25, maxDelay: TimeInterval = 60
+  ) {
+    self.retries = max(0, retries)
+    self.backoff = max(0, backoff)
+    self.jitter = min(max(jitter, 0), 1)
+    self.maxDelay = maxDelay
+  }
+
+  /// Wait before retry number `retry` (1-based). `random` in 0...1 picks the jitter; 0.5 is
+  /// the unjittered delay.
+  public func delay(beforeRetry retry: Int, random: Double = .random(in: 0...1)) -> TimeInterval {
+    let base = min(backoff * pow(2, Double(max(retry, 1) - 1)), maxDelay)
+    return max(0, base * (1 + jitter * (random * 2 - 1)))
+  }
+
+  /// Apple event error numbers that say Messages wasn't ready rather than that the send was
+  /// wrong: -600 application isn't running, -609 connection invalid (Messages quit mid-send),
+  /// -1712 Apple event timed out.
+  public static let transientCodes: Set<Int> = [-600, -609, -1712]
+  /// A timed-out Apple event may still have been delivered.
+  public static let timeoutCode = -1712
+
+  /// The Apple event error number an AppleScript or send helper failure ends with, as in
+  /// `Messages got an error: AppleEvent timed out. (-1712)`; nil for other errors.
+  public static func errorCode(of error: Error) -> Int? {
+    let message: String
+    switch error {
+    case IMsgError.appleScriptFailure(let text), IMsgError.sendHelperFailure(let text):
+      message = text.trimmingCharacters(in: .whitespacesAndNewlines)
+    default:
+      return nil
+    }
+    guard message.hasSuffix(")"), let open = message.lastIndex(of: "(") else { return nil }
+    return Int(message[message.index(after: open)..<message.index(before: message.endIndex)])
+  }
+
+  /// Whether `error` is one of `transientCodes`. Anything else, such as an invalid recipient
+  /// or a missing attachment, fails the same way every time.
+  public static func isTransient(_ error: Error) -> Bool {
+    errorCode(of: error).map(transientCodes.contains) ?? false
+  }
+
+  /// Whether a send that failed with `error` may be tried again: a transient failure, except
+  /// a timeout, which is only retried for an `idempotent` send (one with an idempotency key).
+  public static func isRetryable(_ error: Error, idempotent: Bool) -> Bool {
+    guard let code = errorCode(of: error), transientCodes.contains(code) else { return false }
+    return code != timeoutCode || idempotent
+  }
+}
@@ -0,0 +1,75 @@
+import Foundation
+import SQLite
+
+/// A conversation moved between services (iMessage to SMS or back) at `rowID`.
+public struct ServiceChange: Sendable, Equatable {
+  public let chatID: Int64
+  public let rowID: Int64
+  public let from: String
+  public let to: String
+  /// `Message.account` of the first message on the new service.
+  public let account: String
+  public let date: Date
+
+  public init(chatID: Int64, rowID: Int64, from: String, to: String, account: String, date: Date)
+  {
+    self.chatID = chatID
+    self.rowID = rowID
+    self.from = from
+    self.to = to
+    self.account = account
+    self.date = date
+  }
+}
+
+/// Remembers the last service seen per chat in a message stream and reports switches. The
+/// first message of a chat is compared with the chat's history through `previousService`.
+public struct ServiceChangeTracker {
+  private let previousService: (Message) throws -> String?
+  private var lastService: [Int64: String] = [:]
+
+  public init(previousService: @escaping (Message) throws -> String? = { _ in nil }) {
+    self.previousService = previousService
+  }
+
+  /// Seeds each chat from `store`'s history before the first message seen.
+  public init(store: MessageStore) {
+    self.init { message in
+      try store.lastService(chatID: message.chatID, beforeRowID: message.rowID)
+    }
+  }
+
+  public mutating func observe(_ message: Message) throws -> ServiceChange? {
+    guard !message.service.isEmpty else { return nil }
+    let previous: String?
+    if let known = lastService[message.chatID] {
+      previous = known
+    } else {
+      previous = try previousService(message)
+    }
+    lastService[message.chatID] = message.service
+    guard let previous, !previous.isEmpty,
+      previous.caseInsensitiveCompare(message.service) != .orderedSame
+    else {
+      return nil
+    }
+    return ServiceChange(
+      chatID: message.chatID, rowID: message.rowID, from: previous, to: message.service,
+      account: message.account, date: message.date)
+  }
+}
+
+extension MessageStore {
+  /// Service of the newest message in `chatID` before `beforeRowID`, if any.
+  public func lastService(chatID: Int64, beforeRowID: Int64) throws -> String? {
+    let sql = """
+      SELECT m.service
+      FROM message m
+      JOIN chat_message_join cmj ON m.ROWID = cmj.message_id
+      WHERE cmj.chat_id = ? AND m.ROWID < ? AND IFNULL(m.service, '') != ''
+      ORDER BY m.ROWID DESC
+      LIMIT 1
+      """
+    return try cachedRows(sql, [chatID, beforeRowID]).first.map { stringValue($0[0]) }
+  }
+}
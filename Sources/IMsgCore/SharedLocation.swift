@@ -0,0 +1,111 @@
+import Foundation
+
+/// A location shared from Messages ("Send My Current Location" or a Maps pin). It arrives as
+/// a `.loc.vcf` vCard attachment whose URL line points at Apple Maps.
+public struct SharedLocation: Sendable, Equatable {
+  public let latitude: Double
+  public let longitude: Double
+  public let name: String?
+  public let url: String
+
+  public init(latitude: Double, longitude: Double, name: String?, url: String) {
+    self.latitude = latitude
+    self.longitude = longitude
+    self.name = name
+    self.url = url
+  }
+
+  /// `37.7955,-122.3937 Ferry Building`
+  public var summary: String {
+    let coordinates = "\(SharedLocation.format(latitude)),\(SharedLocation.format(longitude))"
+    guard let name, !name.isEmpty else { return coordinates }
+    return "\(coordinates) \(name)"
+  }
+
+  private static func format(_ value: Double) -> String {
+    var text = String(format: "%.5f", value)
+    while text.hasSuffix("0") { text.removeLast() }
+    if text.hasSuffix(".") { text.removeLast() }
+    return text
+  }
+}
+
+public enum SharedLocationDecoder {
+  public static func isLocation(_ meta: AttachmentMeta) -> Bool {
+    let lowered = [meta.transferName, meta.filename].map { $0.lowercased() }
+    return lowered.contains { $0.hasSuffix(".loc.vcf") }
+      || meta.uti == "public.vlocation"
+      || meta.mimeType.lowercased() == "text/x-vlocation"
+  }
+
+  /// Reads and decodes a location attachment; nil for other attachments or missing files.
+  public static func decode(_ meta: AttachmentMeta) -> SharedLocation? {
+    guard isLocation(meta), !meta.missing,
+      let contents = try? String(contentsOfFile: meta.originalPath, encoding: .utf8)
+    else {
+      return nil
+    }
+    return decode(vcard: contents, fileName: meta.transferName)
+  }
+
+  static func decode(vcard: String, fileName: String = "") -> SharedLocation? {
+    // Unfold continuation lines (RFC 6350 §3.2) before looking for the Maps URL.
+    let unfolded = vcard.replacingOccurrences(of: "\r\n", with: "\n")
+      .replacingOccurrences(of: "\n ", with: "")
+      .replacingOccurrences(of: "\n\t", with: "")
+    var fullName: String?
+    var location: (latitude: Double, longitude: Double, query: String?, url: String)?
+    for line in unfolded.split(separator: "\n").map(String.init) {
+      if line.uppercased().hasPrefix("FN:") {
+        fullName = unescape(String(line.dropFirst(3))).trimmingCharacters(in: .whitespaces)
+        continue
+      }
+      guard location == nil, let start = line.range(of: "http", options: .caseInsensitive) else {
+        continue
+      }
+      let url = unescape(String(line[start.lowerBound...]))
+      guard let components = URLComponents(string: url),
+        components.host?.lowercased().hasSuffix("maps.apple.com") == true
+      else {
+        continue
+      }
+      let items = components.queryItems ?? []
+      func item(_ name: String) -> String? {
+        items.first { $0.name == name }?.value
+      }
+      guard let coordinates = (item("ll") ?? item("sll") ?? item("q")).flatMap(parseCoordinates)
+      else {
+        continue
+      }
+      location = (coordinates.0, coordinates.1, item("q"), url)
+    }
+    guard let location else { return nil }
+
+    // Prefer a place query, then the card name; the file is named after the place too.
+    var candidates = [location.query, fullName]
+    let base = fileName.lowercased().hasSuffix(".loc.vcf") ? String(fileName.dropLast(8)) : ""
+    candidates.append(base == "CL" ? nil : base)
+    let name = candidates.compactMap { $0 }.first {
+      !$0.isEmpty && parseCoordinates($0) == nil && $0 != "Current Location"
+    }
+    return SharedLocation(
+      latitude: location.latitude, longitude: location.longitude,
+      name: name ?? (fullName == "Current Location" ? fullName : nil), url: location.url)
+  }
+
+  private static func parseCoordinates(_ value: String) -> (Double, Double)? {
+    let parts = value.split(separator: ",").map { $0.trimmingCharacters(in: .whitespaces) }
+    guard parts.count == 2, let latitude = Double(parts[0]), let longitude = Double(parts[1]),
+      (-90...90).contains(latitude), (-180...180).contains(longitude)
+    else {
+      return nil
+    }
+    return (latitude, longitude)
+  }
+
+  private static func unescape(_ value: String) -> String {
+    value.replacingOccurrences(of: "\\,", with: ",")
+      .replacingOccurrences(of: "\\;", with: ";")
+      .replacingOccurrences(of: "\\:", with: ":")
+  }
+}
@@ -0,0 +1,20 @@
+import Foundation
+
+/// Where imsg keeps its own small state files (cursors, journals). Never inside chat.db.
+public enum StateDirectory {
+  public static let environmentKey = "IMSG_STATE_DIR"
+
+  /// `$IMSG_STATE_DIR`, else `~/Library/Application Support/imsg`.
+  public static var url: URL {
+    if let override = ProcessInfo.processInfo.environment[environmentKey], !override.isEmpty {
+      let expanded = NSString(string: override).expandingTildeInPath
+      return URL(fileURLWithPath: expanded, isDirectory: true)
+    }
+    let home = FileManager.default.homeDirectoryForCurrentUser
+    return home.appendingPathComponent("Library/Application Support/imsg", isDirectory: true)
+  }
+
+  public static func fileURL(_ name: String) -> URL {
+    url.appendingPathComponent(name, isDirectory: false)
+  }
+}
@@ -0,0 +1,154 @@
+import Foundation
+
+/// Where a tapback goes: the conversation to open and how to find the message's bubble in it.
+/// The Messages UI doesn't expose guids, so a message is found by its text, counting bubbles
+/// with that text from the bottom of the transcript.
+public struct TapbackTarget: Sendable, Equatable {
+  /// `imessage://` URL that opens the conversation.
+  public let conversationURL: String
+  /// The start of the message's text, as it appears in its bubble.
+  public let text: String
+  /// 1 for the newest bubble containing `text`, 2 for the one above it, and so on.
+  public let occurrence: Int
+
+  public init(conversationURL: String, text: String, occurrence: Int) {
+    self.conversationURL = conversationURL
+    self.text = text
+    self.occurrence = occurrence
+  }
+
+  /// The target for `message`, given the chat's newest messages (newest first, as
+  /// `MessageStore.messages(chatID:limit:)` returns them) and its participants. Nil when the
+  /// message has no text to find it by or isn't among `recent`.
+  public static func locate(
+    _ message: Message, recent: [Message], participants: [String]
+  ) -> TapbackTarget? {
+    let needle = bubbleText(message.text)
+    guard !needle.isEmpty, let index = recent.firstIndex(where: { $0.rowID == message.rowID })
+    else {
+      return nil
+    }
+    let newer = recent[..<index].filter { bubbleText($0.text, limit: nil).contains(needle) }
+    return TapbackTarget(
+      conversationURL: conversationURL(handles: participants),
+      text: needle,
+      occurrence: newer.count + 1)
+  }
+
+  /// The first line of `text` without attachment placeholders, cut to `limit` characters.
+  public static func bubbleText(_ text: String, limit: Int? = 80) -> String {
+    let cleaned = text.replacingOccurrences(of: "\u{FFFC}", with: "")
+      .trimmingCharacters(in: .whitespacesAndNewlines)
+    guard let limit else { return cleaned }
+    let firstLine = cleaned.split(whereSeparator: \.isNewline).first.map(String.init) ?? ""
+    return String(firstLine.prefix(limit))
+  }
+
+  /// `imessage://+1555…` for one person, `imessage://open?addresses=a,b` for a group.
+  static func conversationURL(handles: [String]) -> String {
+    let encoded = handles.map {
+      $0.addingPercentEncoding(withAllowedCharacters: .urlHostAllowed) ?? $0
+    }
+    if encoded.count == 1 {
+      return "imessage://\(encoded[0])"
+    }
+    return "imessage://open?addresses=\(encoded.joined(separator: ","))"
+  }
+}
+
+/// Applies a tapback by driving Messages.app's UI, since its AppleScript dictionary has no
+/// reaction command. Opens the conversation, finds the message's bubble in the transcript,
+/// opens its context menu and picks Tapback, then presses the picker's number key. Needs
+/// Accessibility permission for the calling terminal, and the message has to be loaded in the
+/// transcript (recent enough that Messages shows it without scrolling back).
+public struct TapbackSender {
+  private let runner: (String, [String]) throws -> Void
+  private let logger: AutomationLogger
+
+  public init(logger: AutomationLogger = .disabled) {
+    self.runner = { source, arguments in
+      try MessageSender.runAppleScript(source: source, arguments: arguments, logger: logger)
+    }
+    self.logger = logger
+  }
+
+  init(runner: @escaping (String, [String]) throws -> Void) {
+    self.runner = runner
+    self.logger = .disabled
+  }
+
+  /// Applies `reaction` to the message `target` describes.
+  public func react(_ reaction: ReactionType, to target: TapbackTarget) throws {
+    guard let key = TapbackSender.pickerKey(for: reaction) else {
+      throw IMsgError.appleScriptFailure("Custom emoji tapbacks cannot be sent via UI automation")
+    }
+    logger.log(
+      .debug,
+      "tapback \(reaction.name) text=\(AutomationLogger.redactText(target.text)) "
+        + "occurrence=\(target.occurrence) key=\(key)")
+    do {
+      try runner(
+        TapbackSender.script,
+        [target.conversationURL, target.text, String(target.occurrence), key])
+    } catch IMsgError.appleScriptFailure(let message)
+      where message.localizedCaseInsensitiveContains("not allowed")
+      || message.localizedCaseInsensitiveContains("assistive")
+    {
+      throw IMsgError.appleScriptFailure(
+        "\(message) (grant Accessibility to your terminal in System Settings → Privacy & "
+          + "Security → Accessibility)")
+    }
+  }
+
+  /// Number keys in the tapback picker, left to right.
+  static func pickerKey(for reaction: ReactionType) -> String? {
+    switch reaction {
+    case .love: return "1"
+    case .like: return "2"
+    case .dislike: return "3"
+    case .laugh: return "4"
+    case .emphasis: return "5"
+    case .question: return "6"
+    case .custom: return nil
+    }
+  }
+
+  // Bubbles are the transcript's text elements; the sidebar's previews come earlier in the
+  // window's contents, so counting from the end reaches the transcript first.
+  static let script = """
+    on run argv
+        set theURL to item 1 of argv
+        set theText to item 2 of argv
+        set theOccurrence to (item 3 of argv) as integer
+        set theKey to item 4 of argv
+
+        tell application "Messages" to activate
+        open location theURL
+        delay 1.0
+        tell application "System Events"
+            tell process "Messages"
+                set frontmost to true
+                set found to {}
+                repeat with anItem in (entire contents of window 1)
+                    try
+                        if role of anItem is in {"AXTextArea", "AXStaticText"} then
+                            set theValue to value of anItem
+                            if theValue is missing value then set theValue to description of anItem
+                            if theValue contains theText then set end of found to contents of anItem
+                        end if
+                    end try
+                end repeat
+                if (count of found) < theOccurrence then
+                    error "message not found in the Messages window; scroll it into view and retry"
+                end if
+                set theBubble to item (-theOccurrence) of found
+                perform action "AXShowMenu" of theBubble
+                delay 0.3
+                click (first menu item of menu 1 of theBubble whose name starts with "Tapback")
+                delay 0.5
+                keystroke theKey
+            end tell
+        end tell
+    end run
+    """
+}
@@ -0,0 +1,254 @@
+import Foundation
+
+/// Structural reader for NeXTSTEP typedstream archives, the format of `message.attributedBody`.
+/// Every group of values carries its own type encoding, so objects of any class decode into a
+/// flat list of values without class-specific knowledge. `TypedStreamParser` stays the fast
+/// path for plain text; this is for callers that need attribute runs.
+final class TypedStreamReader {
+  enum Failure: Error {
+    case truncated
+    case malformed
+  }
+
+  final class Object {
+    var className = ""
+    var values: [Value] = []
+  }
+
+  enum Value {
+    case integer(Int64)
+    case double(Double)
+    case bytes([UInt8])
+    case string(String?)
+    case object(Object?)
+    case list([Value])
+
+    var object: Object? {
+      if case .object(let object) = self { return object }
+      return nil
+    }
+
+    var integer: Int64? {
+      if case .integer(let value) = self { return value }
+      return nil
+    }
+
+    /// Contents of an NSString/NSMutableString object.
+    var stringObject: String? {
+      guard let object, object.className.hasSuffix("String"),
+        case .bytes(let bytes)? = object.values.first
+      else {
+        return nil
+      }
+      return String(bytes: bytes, encoding: .utf8)
+    }
+  }
+
+  private enum Tag {
+    static let integer2: UInt8 = 0x81
+    static let integer4: UInt8 = 0x82
+    static let floating: UInt8 = 0x83
+    static let new: UInt8 = 0x84
+    static let null: UInt8 = 0x85
+    static let endOfObject: UInt8 = 0x86
+    /// Reference numbers are stored offset by this (as a signed byte, -110).
+    static let referenceBase: Int64 = -110
+  }
+
+  private enum Shared {
+    case classInfo(String)
+    case object(Object)
+  }
+
+  private let bytes: [UInt8]
+  private var offset = 0
+  private var strings: [String] = []
+  private var shared: [Shared] = []
+
+  init(data: Data) {
+    self.bytes = [UInt8](data)
+  }
+
+  /// Reads the archive header and returns the top-level object.
+  func readRoot() throws -> Object? {
+    _ = try readByte()  // streamer version
+    let signatureLength = Int(try readInteger(head: try readByte(), signed: false))
+    guard String(decoding: try readBytes(signatureLength), as: UTF8.self) == "streamtyped" else {
+      throw Failure.malformed
+    }
+    _ = try readInteger(head: try readByte(), signed: true)  // system version
+    guard let encoding = try readSharedString(head: try readByte()) else {
+      throw Failure.malformed
+    }
+    return try readValues(encoding: encoding).first?.object
+  }
+
+  private func readByte() throws -> UInt8 {
+    guard offset < bytes.count else { throw Failure.truncated }
+    defer { offset += 1 }
+    return bytes[offset]
+  }
+
+  private func readBytes(_ count: Int) throws -> [UInt8] {
+    guard count >= 0, offset + count <= bytes.count else { throw Failure.truncated }
+    defer { offset += count }
+    return Array(bytes[offset..<offset + count])
+  }
+
+  private func readLittleEndian(_ count: Int) throws -> UInt64 {
+    try readBytes(count).reversed().reduce(UInt64(0)) { ($0 << 8) | UInt64($1) }
+  }
+
+  private func readInteger(head: UInt8, signed: Bool) throws -> Int64 {
+    switch head {
+    case Tag.integer2:
+      let raw = UInt16(try readLittleEndian(2))
+      return signed ? Int64(Int16(bitPattern: raw)) : Int64(raw)
+    case Tag.integer4:
+      let raw = UInt32(try readLittleEndian(4))
+      return signed ? Int64(Int32(bitPattern: raw)) : Int64(raw)
+    default:
+      return signed ? Int64(Int8(bitPattern: head)) : Int64(head)
+    }
+  }
+
+  private func readReference(head: UInt8) throws -> Int {
+    let index = try readInteger(head: head, signed: true) - Tag.referenceBase
+    guard index >= 0 else { throw Failure.malformed }
+    return Int(index)
+  }
+
+  private func readSharedString(head: UInt8) throws -> String? {
+    switch head {
+    case Tag.null:
+      return nil
+    case Tag.new:
+      let length = Int(try readInteger(head: try readByte(), signed: false))
+      let string = String(decoding: try readBytes(length), as: UTF8.self)
+      strings.append(string)
+      return string
+    default:
+      let index = try readReference(head: head)
+      guard index < strings.count else { throw Failure.malformed }
+      return strings[index]
+    }
+  }
+
+  private func readClass(head: UInt8) throws -> String? {
+    switch head {
+    case Tag.null:
+      return nil
+    case Tag.new:
+      guard let name = try readSharedString(head: try readByte()) else {
+        throw Failure.malformed
+      }
+      _ = try readInteger(head: try readByte(), signed: true)  // class version
+      shared.append(.classInfo(name))
+      _ = try readClass(head: try readByte())  // superclass chain
+      return name
+    default:
+      let index = try readReference(head: head)
+      guard index < shared.count, case .classInfo(let name) = shared[index] else {
+        throw Failure.malformed
+      }
+      return name
+    }
+  }
+
+  private func readObject(head: UInt8) throws -> Object? {
+    switch head {
+    case Tag.null:
+      return nil
+    case Tag.new:
+      let object = Object()
+      shared.append(.object(object))
+      object.className = try readClass(head: try readByte()) ?? ""
+      while true {
+        let next = try readByte()
+        if next == Tag.endOfObject { break }
+        guard let encoding = try readSharedString(head: next) else { throw Failure.malformed }
+        object.values.append(contentsOf: try readValues(encoding: encoding))
+      }
+      return object
+    default:
+      let index = try readReference(head: head)
+      guard index < shared.count, case .object(let object) = shared[index] else {
+        throw Failure.malformed
+      }
+      return object
+    }
+  }
+
+  private func readValues(encoding: String) throws -> [Value] {
+    try TypedStreamReader.splitTypes(Array(encoding.utf8)).map { try readValue(type: $0) }
+  }
+
+  private func readValue(type: [UInt8]) throws -> Value {
+    guard let code = type.first else { throw Failure.malformed }
+    switch code {
+    case UInt8(ascii: "@"):
+      return .object(try readObject(head: try readByte()))
+    case UInt8(ascii: "#"):
+      return .string(try readClass(head: try readByte()))
+    case UInt8(ascii: "*"), UInt8(ascii: ":"), UInt8(ascii: "%"):
+      return .string(try readSharedString(head: try readByte()))
+    case UInt8(ascii: "+"):
+      let length = Int(try readInteger(head: try readByte(), signed: false))
+      return .bytes(try readBytes(length))
+    case UInt8(ascii: "c"), UInt8(ascii: "s"), UInt8(ascii: "i"), UInt8(ascii: "l"),
+      UInt8(ascii: "q"):
+      return .integer(try readInteger(head: try readByte(), signed: true))
+    case UInt8(ascii: "C"), UInt8(ascii: "S"), UInt8(ascii: "I"), UInt8(ascii: "L"),
+      UInt8(ascii: "Q"), UInt8(ascii: "B"):
+      return .integer(try readInteger(head: try readByte(), signed: false))
+    case UInt8(ascii: "f"), UInt8(ascii: "d"):
+      let head = try readByte()
+      guard head == Tag.floating else {
+        return .double(Double(try readInteger(head: head, signed: true)))
+      }
+      if code == UInt8(ascii: "f") {
+        return .double(Double(Float(bitPattern: UInt32(try readLittleEndian(4)))))
+      }
+      return .double(Double(bitPattern: try readLittleEndian(8)))
+    case UInt8(ascii: "["):
+      // "[12c]": fixed-size array; byte arrays are stored raw.
+      let inner = type.dropFirst().dropLast()
+      let digits = inner.prefix { (UInt8(ascii: "0")...UInt8(ascii: "9")).contains($0) }
+      guard let count = Int(String(decoding: digits, as: UTF8.self)) else {
+        throw Failure.malformed
+      }
+      let element = Array(inner.dropFirst(digits.count))
+      if element == [UInt8(ascii: "c")] || element == [UInt8(ascii: "C")] {
+        return .bytes(try readBytes(count))
+      }
+      return .list(try (0..<count).map { _ in try readValue(type: element) })
+    case UInt8(ascii: "{"):
+      // "{name=fields}": the fields follow in order.
+      let inner = type.dropFirst().dropLast()
+      let fields = inner.firstIndex(of: UInt8(ascii: "=")).map { inner[($0 + 1)...] } ?? []
+      return .list(try TypedStreamReader.splitTypes(Array(fields)).map { try readValue(type: $0) })
+    default:
+      throw Failure.malformed
+    }
+  }
+
+  /// Splits an encoding such as "iI" or "{_NSRange=QQ}@" into one entry per value.
+  static func splitTypes(_ encoding: [UInt8]) -> [[UInt8]] {
+    var types: [[UInt8]] = []
+    var index = 0
+    while index < encoding.count {
+      let start = index
+      var depth = 0
+      repeat {
+        switch encoding[index] {
+        case UInt8(ascii: "["), UInt8(ascii: "{"): depth += 1
+        case UInt8(ascii: "]"), UInt8(ascii: "}"): depth -= 1
+        default: break
+        }
+        index += 1
+      } while depth > 0 && index < encoding.count
+      types.append(Array(encoding[start..<index]))
+    }
+    return types
+  }
+}
@@ -0,0 +1,64 @@
+import Foundation
+
+/// Per-chat "seen up to rowid" cursors for `imsg unread`, kept separately for each database.
+/// The effective cursor of a chat is the larger of its own cursor and the all-chats cursor.
+public final class UnreadCursorStore {
+  private struct Snapshot: Codable {
+    var databases: [String: Cursors] = [:]
+  }
+
+  private struct Cursors: Codable {
+    var all: Int64 = 0
+    var chats: [String: Int64] = [:]
+  }
+
+  public let fileURL: URL
+  private let databasePath: String
+  private var snapshot: Snapshot
+
+  public init(databasePath: String, fileURL: URL = StateDirectory.fileURL("unread.json")) throws {
+    self.fileURL = fileURL
+    self.databasePath = databasePath
+    if FileManager.default.fileExists(atPath: fileURL.path) {
+      let data = try Data(contentsOf: fileURL)
+      self.snapshot = try JSONDecoder().decode(Snapshot.self, from: data)
+    } else {
+      self.snapshot = Snapshot()
+    }
+  }
+
+  private var cursors: Cursors {
+    get { snapshot.databases[databasePath] ?? Cursors() }
+    set { snapshot.databases[databasePath] = newValue }
+  }
+
+  /// The all-chats cursor; no chat's effective cursor is lower than this.
+  public var floor: Int64 {
+    cursors.all
+  }
+
+  public func cursor(chatID: Int64) -> Int64 {
+    max(cursors.all, cursors.chats[String(chatID)] ?? 0)
+  }
+
+  /// Advances a chat's cursor (or the all-chats cursor when `chatID` is nil). Never moves back.
+  public func acknowledge(through rowID: Int64, chatID: Int64?) {
+    var updated = cursors
+    if let chatID {
+      let key = String(chatID)
+      updated.chats[key] = max(updated.chats[key] ?? 0, rowID)
+    } else {
+      updated.all = max(updated.all, rowID)
+      updated.chats = updated.chats.filter { $0.value > updated.all }
+    }
+    cursors = updated
+  }
+
+  public func save() throws {
+    try FileManager.default.createDirectory(
+      at: fileURL.deletingLastPathComponent(), withIntermediateDirectories: true)
+    let encoder = JSONEncoder()
+    encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+    try encoder.encode(snapshot).write(to: fileURL, options: .atomic)
+  }
+}
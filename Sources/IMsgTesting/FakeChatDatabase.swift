@@ -0,0 +1,403 @@
+import CryptoKit
+import Foundation
+import IMsgCore
+import SQLite
+
+/// A file attached to a fake message. `path` does not have to exist; imsg reports missing
+/// files as such.
+public struct FakeAttachment: Sendable {
+  public var guid: String?
+  public var path: String
+  public var transferName: String
+  public var mimeType: String
+  public var uti: String
+  public var totalBytes: Int64
+  public var isSticker: Bool
+  /// The attachment's `user_info` plist, e.g. an audio message's transcription.
+  public var userInfo: Data?
+
+  public init(
+    guid: String? = nil,
+    path: String,
+    transferName: String? = nil,
+    mimeType: String = "application/octet-stream",
+    uti: String = "public.data",
+    totalBytes: Int64 = 0,
+    isSticker: Bool = false,
+    userInfo: Data? = nil
+  ) {
+    self.guid = guid
+    self.path = path
+    self.transferName = transferName ?? URL(fileURLWithPath: path).lastPathComponent
+    self.mimeType = mimeType
+    self.uti = uti
+    self.totalBytes = totalBytes
+    self.isSticker = isSticker
+    self.userInfo = userInfo
+  }
+}
+
+/// Builds a chat.db with the tables and columns imsg reads, so code built on IMsgCore can be
+/// tested without a Mac signed into Messages. The database is a real file (in a temporary
+/// directory unless `directory` is given), opened by `MessageStore(path:)` like the real one.
+///
+///     let fake = try FakeChatDatabase()
+///     let chat = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+///     try fake.addMessage(chatID: chat, text: "hello", sender: "+15551234567")
+///     let store = try fake.makeStore()
+///
+/// `fingerprint()` hashes the database and its WAL; compare it before and after the code
+/// under test to check that it never wrote to chat.db.
+///
+/// `columns:` on `addMessage`, and `run`/`execute`, reach the rows and tables the builders
+/// don't model: balloon payloads, group events, CloudKit state, or an older macOS schema with
+/// a column dropped.
+public final class FakeChatDatabase {
+  public let path: String
+  private let db: Connection
+  /// The temporary directory created for the database, removed by `remove()`.
+  private let ownedDirectory: URL?
+  private var handleIDs: [String: Int64] = [:]
+
+  public init(directory: URL? = nil) throws {
+    let fileManager = FileManager.default
+    let dir: URL
+    if let directory {
+      dir = directory
+      ownedDirectory = nil
+    } else {
+      dir = fileManager.temporaryDirectory.appendingPathComponent("imsg-fake-\(UUID().uuidString)")
+      ownedDirectory = dir
+    }
+    try fileManager.createDirectory(at: dir, withIntermediateDirectories: true)
+    path = dir.appendingPathComponent("chat.db").path
+    try? fileManager.removeItem(atPath: path)
+    db = try Connection(path)
+    try db.execute(FakeChatDatabase.schema)
+  }
+
+  /// The subset of the macOS chat.db schema imsg queries, reactions and send accounts included.
+  public static let schema = """
+    CREATE TABLE message (
+      ROWID INTEGER PRIMARY KEY AUTOINCREMENT,
+      guid TEXT UNIQUE NOT NULL,
+      text TEXT,
+      attributedBody BLOB,
+      handle_id INTEGER DEFAULT 0,
+      service TEXT,
+      date INTEGER,
+      is_from_me INTEGER DEFAULT 0,
+      destination_caller_id TEXT,
+      associated_message_guid TEXT,
+      associated_message_type INTEGER DEFAULT 0,
+      date_delivered INTEGER DEFAULT 0,
+      date_read INTEGER DEFAULT 0,
+      date_edited INTEGER DEFAULT 0,
+      message_summary_info BLOB,
+      account TEXT,
+      is_audio_message INTEGER DEFAULT 0,
+      balloon_bundle_id TEXT,
+      payload_data BLOB,
+      item_type INTEGER DEFAULT 0,
+      group_action_type INTEGER DEFAULT 0,
+      other_handle INTEGER DEFAULT 0,
+      group_title TEXT
+    );
+    CREATE TABLE chat (
+      ROWID INTEGER PRIMARY KEY AUTOINCREMENT,
+      guid TEXT UNIQUE NOT NULL,
+      chat_identifier TEXT,
+      display_name TEXT,
+      service_name TEXT
+    );
+    CREATE TABLE handle (
+      ROWID INTEGER PRIMARY KEY AUTOINCREMENT,
+      id TEXT NOT NULL,
+      service TEXT
+    );
+    CREATE TABLE attachment (
+      ROWID INTEGER PRIMARY KEY AUTOINCREMENT,
+      guid TEXT UNIQUE NOT NULL,
+      filename TEXT,
+      transfer_name TEXT,
+      uti TEXT,
+      mime_type TEXT,
+      total_bytes INTEGER DEFAULT 0,
+      is_sticker INTEGER DEFAULT 0,
+      user_info BLOB
+    );
+    CREATE TABLE chat_handle_join (chat_id INTEGER, handle_id INTEGER, UNIQUE(chat_id, handle_id));
+    CREATE TABLE chat_message_join (
+      chat_id INTEGER, message_id INTEGER, message_date INTEGER DEFAULT 0,
+      PRIMARY KEY (chat_id, message_id)
+    );
+    CREATE TABLE message_attachment_join (
+      message_id INTEGER, attachment_id INTEGER, UNIQUE(message_id, attachment_id)
+    );
+    CREATE INDEX message_idx_date ON message(date);
+    CREATE INDEX chat_message_join_idx_message_date ON chat_message_join(chat_id, message_date);
+    """
+
+  /// Adds a chat and returns its rowid. A 1:1 chat's identifier is the other person's handle;
+  /// group chats use `chatNNN` and a `name`.
+  @discardableResult
+  public func addChat(
+    identifier: String,
+    guid: String? = nil,
+    name: String = "",
+    service: String = "iMessage",
+    participants: [String] = []
+  ) throws -> Int64 {
+    let isGroup = participants.count > 1
+    try db.run(
+      "INSERT INTO chat(guid, chat_identifier, display_name, service_name) VALUES (?, ?, ?, ?)",
+      guid ?? "\(service);\(isGroup ? "+" : "-");\(identifier)", identifier, name, service)
+    let chatID = db.lastInsertRowid
+    for participant in participants {
+      try db.run(
+        "INSERT OR IGNORE INTO chat_handle_join(chat_id, handle_id) VALUES (?, ?)", chatID,
+        try handleID(participant, service: service))
+    }
+    return chatID
+  }
+
+  /// Adds a message to `chatID` and returns its rowid. `sender` nil means you sent it, from
+  /// `account` (`p:+1555…`/`e:you@icloud.com`) when given. A nil `text` with an
+  /// `attributedBody` is how newer macOS stores most messages. `columns` sets any other message
+  /// column, e.g. `["item_type": 1]`.
+  @discardableResult
+  public func addMessage(
+    chatID: Int64,
+    text: String?,
+    sender: String? = nil,
+    date: Date = Date(),
+    service: String = "iMessage",
+    guid: String? = nil,
+    account: String? = nil,
+    attributedBody: Data? = nil,
+    attachments: [FakeAttachment] = [],
+    columns: [String: Binding?] = [:]
+  ) throws -> Int64 {
+    let handle = try sender.map { try handleID($0, service: service) } ?? 0
+    let callerID = account.map { String($0.drop(while: { $0 != ":" }).dropFirst()) }
+    let appleDate = FakeChatDatabase.appleTimestamp(date)
+    try db.run(
+      """
+      INSERT INTO message(guid, text, attributedBody, handle_id, service, date, is_from_me,
+        destination_caller_id, account)
+      VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+      """,
+      guid ?? UUID().uuidString, text, attributedBody.map { Blob(bytes: [UInt8]($0)) }, handle,
+      service, appleDate, sender == nil ? 1 : 0, callerID, account)
+    let messageID = db.lastInsertRowid
+    try db.run(
+      "INSERT INTO chat_message_join(chat_id, message_id, message_date) VALUES (?, ?, ?)",
+      chatID, messageID, appleDate)
+    for attachment in attachments {
+      try addAttachment(attachment, to: messageID)
+    }
+    if !columns.isEmpty {
+      let names = columns.keys.sorted()
+      var bindings: [Binding?] = names.map { columns[$0] ?? nil }
+      bindings.append(messageID)
+      let assignments = names.map { "\($0) = ?" }.joined(separator: ", ")
+      try db.run("UPDATE message SET \(assignments) WHERE ROWID = ?", bindings)
+    }
+    return messageID
+  }
+
+  /// Attaches a file to an existing message and returns the attachment's rowid. The same file
+  /// may be attached to several messages, as when a photo is sent twice.
+  @discardableResult
+  public func addAttachment(_ attachment: FakeAttachment, to messageID: Int64) throws -> Int64 {
+    try db.run(
+      """
+      INSERT INTO attachment(guid, filename, transfer_name, uti, mime_type, total_bytes,
+        is_sticker, user_info)
+      VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+      """,
+      attachment.guid ?? UUID().uuidString, attachment.path, attachment.transferName,
+      attachment.uti, attachment.mimeType, attachment.totalBytes, attachment.isSticker ? 1 : 0,
+      attachment.userInfo.map { Blob(bytes: [UInt8]($0)) })
+    let attachmentID = db.lastInsertRowid
+    try db.run(
+      "INSERT INTO message_attachment_join(message_id, attachment_id) VALUES (?, ?)",
+      messageID, attachmentID)
+    return attachmentID
+  }
+
+  /// Adds a tapback on `messageID` the way Messages stores it: a message row pointing at the
+  /// target's guid with `associated_message_type` 2000–2006 (3000+ removes it).
+  @discardableResult
+  public func addReaction(
+    to messageID: Int64,
+    type: ReactionType,
+    sender: String? = nil,
+    removed: Bool = false,
+    date: Date = Date()
+  ) throws -> Int64 {
+    guard
+      let row = try db.prepare(
+        "SELECT guid, IFNULL(text, '') FROM message WHERE ROWID = ?", messageID
+      ).makeIterator().next(),
+      let target = row[0] as? String,
+      let chatID = try db.scalar(
+        "SELECT chat_id FROM chat_message_join WHERE message_id = ?", messageID) as? Int64
+    else {
+      throw IMsgError.messageNotFound("rowid \(messageID)")
+    }
+    let quoted = "\u{201C}\(row[1] as? String ?? "")\u{201D}"
+    let text =
+      removed ? "Removed a reaction from \(quoted)" : FakeChatDatabase.verb(for: type, quoted)
+    // One transaction, so a watcher never sees the row before it is a tapback.
+    var rowID: Int64 = 0
+    try db.transaction {
+      rowID = try addMessage(chatID: chatID, text: text, sender: sender, date: date)
+      try db.run(
+        """
+        UPDATE message SET associated_message_guid = ?, associated_message_type = ?
+        WHERE ROWID = ?
+        """,
+        "p:0/\(target)", removed ? type.removalAssociatedMessageType : type.associatedMessageType,
+        rowID)
+    }
+    return rowID
+  }
+
+  /// Records when a message was delivered and read, as Messages does for receipts.
+  public func setReceipt(messageID: Int64, delivered: Date?, read: Date? = nil) throws {
+    try db.run(
+      "UPDATE message SET date_delivered = ?, date_read = ? WHERE ROWID = ?",
+      delivered.map(FakeChatDatabase.appleTimestamp) ?? 0,
+      read.map(FakeChatDatabase.appleTimestamp) ?? 0, messageID)
+  }
+
+  /// Edits a message's text the way Messages records it: the new text in place, and each
+  /// revision (the original first) in `message_summary_info`.
+  public func editMessage(_ messageID: Int64, text: String, date: Date = Date()) throws {
+    var summary = try summaryInfo(messageID)
+    var parts = summary["ec"] as? [String: Any] ?? [:]
+    var revisions = parts["0"] as? [[String: Any]] ?? []
+    if revisions.isEmpty,
+      let row = try db.prepare(
+        "SELECT IFNULL(text, ''), date FROM message WHERE ROWID = ?", messageID
+      ).makeIterator().next()
+    {
+      revisions.append(
+        FakeChatDatabase.revision(row[0] as? String ?? "", raw: row[1] as? Int64 ?? 0))
+    }
+    let raw = FakeChatDatabase.appleTimestamp(date)
+    revisions.append(FakeChatDatabase.revision(text, raw: raw))
+    parts["0"] = revisions
+    summary["ec"] = parts
+    try db.run(
+      "UPDATE message SET text = ?, date_edited = ?, message_summary_info = ? WHERE ROWID = ?",
+      text, raw, try FakeChatDatabase.blob(summary), messageID)
+  }
+
+  /// Unsends a message: Messages clears the text and lists the part under `rp`.
+  public func unsendMessage(_ messageID: Int64, date: Date = Date()) throws {
+    var summary = try summaryInfo(messageID)
+    summary["rp"] = [0]
+    try db.run(
+      "UPDATE message SET text = NULL, date_edited = ?, message_summary_info = ? WHERE ROWID = ?",
+      FakeChatDatabase.appleTimestamp(date), try FakeChatDatabase.blob(summary), messageID)
+  }
+
+  /// Rowid of the first chat whose guid or identifier is `target`.
+  public func chatID(matching target: String) throws -> Int64? {
+    try db.scalar(
+      "SELECT ROWID FROM chat WHERE guid = ? OR chat_identifier = ? ORDER BY ROWID LIMIT 1",
+      target, target) as? Int64
+  }
+
+  /// Rowid of the handle for `address`, added on first use as `addChat` and `addMessage` do.
+  public func handleID(_ address: String, service: String = "iMessage") throws -> Int64 {
+    if let id = handleIDs[address] { return id }
+    try db.run("INSERT INTO handle(id, service) VALUES (?, ?)", address, service)
+    handleIDs[address] = db.lastInsertRowid
+    return db.lastInsertRowid
+  }
+
+  /// Runs one statement against the database, for rows the builders don't model.
+  public func run(_ sql: String, _ bindings: Binding?...) throws {
+    try db.run(sql, bindings)
+  }
+
+  /// Runs SQL that may hold several statements, e.g. creating a table a newer macOS adds or
+  /// dropping a column an older one lacks.
+  public func execute(_ sql: String) throws {
+    try db.execute(sql)
+  }
+
+  /// Opens the database read-only, as imsg opens chat.db.
+  public func makeStore() throws -> MessageStore {
+    try MessageStore(path: path)
+  }
+
+  /// SHA-256 over the database file and its -wal and -shm, when present.
+  public func fingerprint() throws -> String {
+    var hasher = SHA256()
+    for suffix in ["", "-wal", "-shm"] {
+      if let data = FileManager.default.contents(atPath: path + suffix) {
+        hasher.update(data: Data(suffix.utf8))
+        hasher.update(data: data)
+      }
+    }
+    return hasher.finalize().map { String(format: "%02x", $0) }.joined()
+  }
+
+  /// Deletes the database, and its directory when this created it.
+  public func remove() {
+    let fileManager = FileManager.default
+    if let ownedDirectory {
+      try? fileManager.removeItem(at: ownedDirectory)
+      return
+    }
+    for suffix in ["", "-wal", "-shm"] {
+      try? fileManager.removeItem(atPath: path + suffix)
+    }
+  }
+
+  /// The summary text Messages stores on tapback rows, e.g. `Loved “hello”`.
+  private static func verb(for type: ReactionType, _ quoted: String) -> String {
+    switch type {
+    case .love: return "Loved \(quoted)"
+    case .like: return "Liked \(quoted)"
+    case .dislike: return "Disliked \(quoted)"
+    case .laugh: return "Laughed at \(quoted)"
+    case .emphasis: return "Emphasized \(quoted)"
+    case .question: return "Questioned \(quoted)"
+    case .custom(let emoji): return "Reacted \(emoji) to \(quoted)"
+    }
+  }
+
+  private func summaryInfo(_ messageID: Int64) throws -> [String: Any] {
+    guard
+      let blob = try db.scalar(
+        "SELECT message_summary_info FROM message WHERE ROWID = ?", messageID) as? Blob,
+      let plist = try? PropertyListSerialization.propertyList(
+        from: Data(blob.bytes), format: nil) as? [String: Any]
+    else {
+      return [:]
+    }
+    return plist
+  }
+
+  /// An edit event: `t` is the text as a minimal attributedBody typedstream, `d` seconds since
+  /// 2001.
+  private static func revision(_ text: String, raw: Int64) -> [String: Any] {
+    let body = Data([0x01, 0x2b] + Array(text.utf8) + [0x86, 0x84])
+    return ["t": body, "d": Double(raw) / 1_000_000_000]
+  }
+
+  private static func blob(_ plist: [String: Any]) throws -> Blob {
+    let data = try PropertyListSerialization.data(
+      fromPropertyList: plist, format: .binary, options: 0)
+    return Blob(bytes: [UInt8](data))
+  }
+
+  static func appleTimestamp(_ date: Date) -> Int64 {
+    Int64((date.timeIntervalSince1970 - MessageStore.appleEpochOffset) * 1_000_000_000)
+  }
+}
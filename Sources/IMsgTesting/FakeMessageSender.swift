@@ -0,0 +1,77 @@
+import Foundation
+import IMsgCore
+
+/// Stands in for Messages.app wherever imsg takes a `(MessageSendOptions) throws -> Void`
+/// send function (RPC and MCP servers, `imsg send`): records every send and, with a
+/// `database`, writes it back as a sent message the way Messages would.
+///
+///     let sender = FakeMessageSender(database: fake)
+///     let server = RPCServer(store: store, sendMessage: sender.send)
+public final class FakeMessageSender: @unchecked Sendable {
+  public let database: FakeChatDatabase?
+  /// Thrown by the next sends instead of recording them, when set.
+  public var failure: Error? {
+    get { withLock { storedFailure } }
+    set { withLock { storedFailure = newValue } }
+  }
+
+  /// Every successful send, in order.
+  public var sent: [MessageSendOptions] {
+    withLock { storedSent }
+  }
+
+  private let lock = NSLock()
+  private var storedSent: [MessageSendOptions] = []
+  private var storedFailure: Error?
+
+  public init(database: FakeChatDatabase? = nil) {
+    self.database = database
+  }
+
+  public func send(_ options: MessageSendOptions) throws {
+    try withLock {
+      if let storedFailure { throw storedFailure }
+      if let database {
+        let chatID = try database.deliveryChat(for: options)
+        let attachments = options.attachmentPaths.map { FakeAttachment(path: $0) }
+        try database.addMessage(
+          chatID: chatID, text: options.text, service: options.service.deliveredService,
+          attachments: attachments)
+      }
+      storedSent.append(options)
+    }
+  }
+
+  private func withLock<T>(_ body: () throws -> T) rethrows -> T {
+    lock.lock()
+    defer { lock.unlock() }
+    return try body()
+  }
+}
+
+extension FakeChatDatabase {
+  /// The chat a send lands in: the chat guid or identifier it targets, else the 1:1 chat with
+  /// the recipient, created on first use like Messages does.
+  func deliveryChat(for options: MessageSendOptions) throws -> Int64 {
+    if !options.chatGUID.isEmpty || !options.chatIdentifier.isEmpty {
+      let target = options.chatGUID.isEmpty ? options.chatIdentifier : options.chatGUID
+      guard let existing = try chatID(matching: target) else {
+        throw IMsgError.invalidChatTarget("Unknown chat \(target)")
+      }
+      return existing
+    }
+    if let existing = try chatID(matching: options.recipient) {
+      return existing
+    }
+    return try addChat(
+      identifier: options.recipient, service: options.service.deliveredService,
+      participants: [options.recipient])
+  }
+}
+
+extension MessageService {
+  /// `message.service` for a send on this service; auto goes out as iMessage.
+  fileprivate var deliveredService: String {
+    self == .sms ? "SMS" : "iMessage"
+  }
+}
@@ -0,0 +1,181 @@
+import Foundation
+import ScriptingBridge
+
+// The native send backend for `imsg send --backend native`: reads one JSON request on stdin
+// (see `NativeSendHelper.Request`), sends it through Messages' scripting interface with
+// ScriptingBridge, and exits 0 once Messages accepted every part, or 1 with the reason on
+// stderr. No script is compiled or run, so there is no osascript process and no AppleScript
+// source to get wrong; Messages still asks once for the Automation permission.
+
+struct Request: Decodable {
+  let recipient: String?
+  let chatGUID: String?
+  let text: String
+  let attachments: [String]
+  let service: String
+  let groupRecipients: [String]?
+  let groupName: String?
+  let accountID: String?
+
+  enum CodingKeys: String, CodingKey {
+    case recipient
+    case chatGUID = "chat_guid"
+    case text
+    case attachments
+    case service
+    case groupRecipients = "group_recipients"
+    case groupName = "group_name"
+    case accountID = "account_id"
+  }
+}
+
+struct HelperError: Error {
+  let message: String
+}
+
+// Codes from Messages' scripting dictionary (`sdef /System/Applications/Messages.app`).
+enum ServiceType {
+  static let iMessage = FourCharCode(0x7369_6D73)  // 'sims'
+  static let sms = FourCharCode(0x7373_6D73)  // 'ssms'
+}
+
+@objc protocol MessagesApplication {
+  @objc optional func chats() -> SBElementArray
+  @objc optional func send(_ item: Any, to target: Any)
+}
+
+extension SBApplication: MessagesApplication {}
+
+/// Remembers the Apple event error ScriptingBridge would otherwise only log.
+final class EventErrors: NSObject, SBApplicationDelegate {
+  var last: String?
+
+  func eventDidFail(
+    _ event: UnsafePointer<AppleEvent>, withError error: Error
+  ) -> Any? {
+    let info = (error as NSError).userInfo
+    last = (info["ErrorString"] as? String) ?? error.localizedDescription
+    if let number = info["ErrorNumber"] as? Int {
+      last = "\(last ?? "Apple event failed") (\(number))"
+    }
+    return nil
+  }
+}
+
+struct Sender {
+  let app: SBApplication
+  let errors: EventErrors
+
+  var messages: MessagesApplication { app }
+
+  func check(_ what: String) throws {
+    if let message = errors.last {
+      errors.last = nil
+      throw HelperError(message: "\(what): \(message)")
+    }
+  }
+
+  /// Messages calls them accounts since macOS 12 and services before.
+  func accounts() -> SBElementArray? {
+    for key in ["accounts", "services"] where app.responds(to: NSSelectorFromString(key)) {
+      return app.value(forKey: key) as? SBElementArray
+    }
+    return nil
+  }
+
+  func account(for request: Request) throws -> SBObject {
+    guard let accounts = accounts() else {
+      throw HelperError(message: "Messages has no accounts")
+    }
+    if let id = request.accountID {
+      let account = accounts.object(withID: id) as? SBObject
+      guard let account, account.get() != nil else {
+        throw HelperError(message: "no Messages account \(id)")
+      }
+      return account
+    }
+    let wanted = request.service == "sms" ? ServiceType.sms : ServiceType.iMessage
+    for case let account as SBObject in accounts {
+      let type = (account.value(forKey: "serviceType") as? NSNumber)?.uint32Value
+      if type == wanted { return account }
+    }
+    throw HelperError(message: "no \(request.service) account is set up in Messages")
+  }
+
+  func buddy(_ handle: String, of account: SBObject) throws -> SBObject {
+    for key in ["participants", "buddies"] where account.responds(to: NSSelectorFromString(key)) {
+      if let buddies = account.value(forKey: key) as? SBElementArray,
+        let buddy = buddies.object(withName: handle) as? SBObject
+      {
+        return buddy
+      }
+    }
+    throw HelperError(message: "Messages can't address \(handle)")
+  }
+
+  func target(for request: Request) throws -> Any {
+    if let guid = request.chatGUID {
+      guard let chat = messages.chats?().object(withID: guid) as? SBObject, chat.get() != nil else {
+        throw HelperError(message: "no Messages chat \(guid)")
+      }
+      return chat
+    }
+    let account = try account(for: request)
+    if let handles = request.groupRecipients {
+      let buddies = try handles.map { try buddy($0, of: account) }
+      guard let chats = messages.chats?(),
+        let chatClass = app.class(forScriptingClass: "text chat") as? SBObject.Type
+      else {
+        throw HelperError(message: "Messages can't start group chats")
+      }
+      let chat = chatClass.init(properties: ["participants": buddies])
+      chats.add(chat)
+      try check("starting the group")
+      if let name = request.groupName {
+        // Best effort, as with AppleScript: Messages may not allow naming the chat.
+        chat.setValue(name, forKey: "name")
+        errors.last = nil
+      }
+      return chat
+    }
+    return try buddy(request.recipient ?? "", of: account)
+  }
+
+  func send(_ request: Request) throws {
+    let target = try target(for: request)
+    try check("finding the recipient")
+    if !request.text.isEmpty {
+      messages.send?(request.text, to: target)
+      try check("sending the text")
+    }
+    for path in request.attachments {
+      messages.send?(URL(fileURLWithPath: path), to: target)
+      try check("sending \(URL(fileURLWithPath: path).lastPathComponent)")
+    }
+  }
+}
+
+func fail(_ message: String) -> Never {
+  FileHandle.standardError.write(Data((message + "\n").utf8))
+  exit(1)
+}
+
+let input = FileHandle.standardInput.readDataToEndOfFile()
+let request: Request
+do {
+  request = try JSONDecoder().decode(Request.self, from: input)
+} catch {
+  fail("invalid request: \(error)")
+}
+guard let app = SBApplication(bundleIdentifier: "com.apple.MobileSMS") else {
+  fail("Messages is not installed")
+}
+let errors = EventErrors()
+app.delegate = errors
+do {
+  try Sender(app: app, errors: errors).send(request)
+} catch let error as HelperError {
+  fail(error.message)
+} catch {
+  fail(error.localizedDescription)
+}
@@ -9,3 +9,40 @@ func displayName(for meta: AttachmentMeta) -> String {
   if !meta.filename.isEmpty { return meta.filename }
   return "(unknown)"
 }
+
+/// Phone handle with its country flag for plain-text output (`🇬🇧 +447700900123`); other
+/// handles unchanged.
+func displayHandle(_ handle: String) -> String {
+  guard let region = PhoneNumberNormalizer.shared.region(of: handle),
+    let flag = PhoneNumberNormalizer.flag(forRegion: region)
+  else { return handle }
+  return "\(flag) \(handle)"
+}
+
+/// Message body for plain-text output; app messages without text show their app label, and
+/// group events read like Messages shows them ("Alice left the conversation").
+func displayText(for message: Message) -> String {
+  if let event = message.groupEvent {
+    return event.summary(actor: message.isFromMe ? "You" : message.sender)
+  }
+  guard let app = message.app else { return message.text }
+  if message.text.isEmpty || message.text == "\u{FFFC}" { return "[\(app.displayText)]" }
+  return message.text
+}
+
+/// Like `displayText(for:)`, but a shared location attachment renders as
+/// `[location: 37.7955,-122.3937 Ferry Building]` and a drawing as `[Handwriting: <path>]`.
+func displayText(for message: Message, attachments: [AttachmentMeta]) -> String {
+  guard message.text.isEmpty || message.text == "\u{FFFC}" else {
+    return displayText(for: message)
+  }
+  if let location = attachments.lazy.compactMap(SharedLocationDecoder.decode).first {
+    return "[location: \(location.summary)]"
+  }
+  if let kind = DrawnMessageKind.detect(bundleID: message.app?.bundleID, attachments: attachments)
+  {
+    let asset = DrawnMessageKind.assetPath(in: attachments).map { ": \($0)" } ?? ""
+    return "[\(kind.label)\(asset)]"
+  }
+  return displayText(for: message)
+}
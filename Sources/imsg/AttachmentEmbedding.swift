@@ -0,0 +1,60 @@
+import Commander
+import Foundation
+
+/// `--embed-attachments`: inlines attachment files up to `--embed-max-size` (default 1MB) in
+/// JSON output as base64 `data`, next to their `mime_type`, so one NDJSON stream carries the
+/// whole conversation. Larger and missing files keep only their metadata.
+struct AttachmentEmbedding {
+  static let defaultMaxBytes: Int64 = 1024 * 1024
+
+  let maxBytes: Int64
+
+  init(maxBytes: Int64 = AttachmentEmbedding.defaultMaxBytes) {
+    self.maxBytes = maxBytes
+  }
+
+  static func options() -> [OptionDefinition] {
+    [
+      .make(
+        label: "embedMaxSize", names: [.long("embed-max-size")],
+        help: "largest attachment --embed-attachments inlines (default 1MB)")
+    ]
+  }
+
+  /// Nil without `--embed-attachments`; `--embed-max-size` alone is an error.
+  static func from(values: ParsedValues) throws -> AttachmentEmbedding? {
+    let raw = values.option("embedMaxSize")
+    guard values.flag("embedAttachments") else {
+      if raw != nil {
+        throw ParsedValuesError.invalidOption("embed-max-size")
+      }
+      return nil
+    }
+    guard let raw else { return AttachmentEmbedding() }
+    guard let maxBytes = ByteSizeParser.parse(raw) else {
+      throw ParsedValuesError.invalidOption("embed-max-size")
+    }
+    return AttachmentEmbedding(maxBytes: maxBytes)
+  }
+
+  func embed(_ payload: MessagePayload) -> MessagePayload {
+    var payload = payload
+    payload.attachments = payload.attachments.map(embed)
+    return payload
+  }
+
+  /// The size on disk decides, since `total_bytes` is sometimes zero or stale in chat.db.
+  func embed(_ attachment: AttachmentPayload) -> AttachmentPayload {
+    guard !attachment.missing, !attachment.originalPath.isEmpty,
+      let attributes = try? FileManager.default.attributesOfItem(
+        atPath: attachment.originalPath),
+      let size = (attributes[.size] as? NSNumber)?.int64Value, size <= maxBytes,
+      let data = FileManager.default.contents(atPath: attachment.originalPath)
+    else {
+      return attachment
+    }
+    var attachment = attachment
+    attachment.data = data.base64EncodedString()
+    return attachment
+  }
+}
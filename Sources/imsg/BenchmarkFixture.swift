@@ -0,0 +1,89 @@
+import Foundation
+import IMsgCore
+import SQLite
+
+/// Writes a synthetic chat.db with the columns imsg reads, for repeatable benchmarks.
+enum BenchmarkFixture {
+  static func generate(at path: String, messages: Int, chats: Int = 200) throws {
+    let fileManager = FileManager.default
+    if fileManager.fileExists(atPath: path) {
+      try fileManager.removeItem(atPath: path)
+    }
+    let db = try Connection(path)
+    try db.execute(
+      """
+      PRAGMA journal_mode = OFF;
+      PRAGMA synchronous = OFF;
+      CREATE TABLE message (
+        ROWID INTEGER PRIMARY KEY,
+        guid TEXT,
+        handle_id INTEGER,
+        text TEXT,
+        attributedBody BLOB,
+        date INTEGER,
+        is_from_me INTEGER,
+        service TEXT,
+        associated_message_guid TEXT,
+        associated_message_type INTEGER,
+        destination_caller_id TEXT
+      );
+      CREATE TABLE chat (
+        ROWID INTEGER PRIMARY KEY,
+        chat_identifier TEXT,
+        guid TEXT,
+        display_name TEXT,
+        service_name TEXT
+      );
+      CREATE TABLE handle (ROWID INTEGER PRIMARY KEY, id TEXT);
+      CREATE TABLE chat_handle_join (chat_id INTEGER, handle_id INTEGER);
+      CREATE TABLE chat_message_join (chat_id INTEGER, message_id INTEGER);
+      CREATE TABLE attachment (
+        ROWID INTEGER PRIMARY KEY,
+        filename TEXT,
+        transfer_name TEXT,
+        uti TEXT,
+        mime_type TEXT,
+        total_bytes INTEGER,
+        is_sticker INTEGER
+      );
+      CREATE TABLE message_attachment_join (message_id INTEGER, attachment_id INTEGER);
+      """
+    )
+
+    let chatCount = max(1, chats)
+    let words = ["lunch", "invoice", "see you soon", "ok", "receipt attached", "call me", "😂"]
+    let start = AppleTime.raw(from: Date(), unit: .seconds) * 1_000_000_000
+    try db.transaction {
+      for index in 1...chatCount {
+        try db.run(
+          "INSERT INTO chat VALUES (?, ?, ?, ?, 'iMessage')",
+          Int64(index), "+1555000\(index)", "iMessage;-;+1555000\(index)", "Chat \(index)")
+        try db.run("INSERT INTO handle VALUES (?, ?)", Int64(index), "+1555000\(index)")
+        try db.run("INSERT INTO chat_handle_join VALUES (?, ?)", Int64(index), Int64(index))
+      }
+      let insertMessage = try db.prepare(
+        """
+        INSERT INTO message(ROWID, guid, handle_id, text, date, is_from_me, service)
+        VALUES (?, ?, ?, ?, ?, ?, 'iMessage')
+        """)
+      let insertJoin = try db.prepare("INSERT INTO chat_message_join VALUES (?, ?)")
+      for index in 0..<max(0, messages) {
+        let rowID = Int64(index + 1)
+        // Skew traffic so chat 1 is the busiest, like a real inbox.
+        let chatID = Int64(index % 3 == 0 ? 1 : (index % chatCount) + 1)
+        let date = start - Int64(messages - index) * 60_000_000_000
+        try insertMessage.run(
+          rowID, "BENCH-\(rowID)", chatID, "\(words[index % words.count]) #\(index)", date,
+          Int64(index % 2))
+        try insertJoin.run(chatID, rowID)
+      }
+    }
+    try db.execute(
+      """
+      CREATE INDEX chat_message_join_idx_chat ON chat_message_join(chat_id, message_id);
+      CREATE INDEX chat_message_join_idx_message ON chat_message_join(message_id);
+      CREATE INDEX message_idx_date ON message(date);
+      """
+    )
+  }
+}
@@ -0,0 +1,122 @@
+import Commander
+import Foundation
+import IMsgCore
+
+/// Mirrors chats into Matrix rooms: new chat.db messages in a bridged chat are posted to its
+/// room, and text that other Matrix users post there is sent back through Messages.
+actor MatrixBridge {
+  struct Room: Equatable {
+    let chat: ChatInfo
+    let roomID: String
+  }
+
+  private let client: MatrixClient
+  private let roomsByChat: [Int64: Room]
+  private let roomsByID: [String: Room]
+  private let journal: SendJournal
+  private let sendMessage: (MessageSendOptions) throws -> Void
+  /// Texts relayed from Matrix that chat.db will report back as our own messages.
+  private var pendingEchoes: [Int64: [String]] = [:]
+
+  init(
+    client: MatrixClient,
+    rooms: [Room],
+    journal: SendJournal,
+    sendMessage: @escaping (MessageSendOptions) throws -> Void
+  ) {
+    self.client = client
+    self.roomsByChat = Dictionary(rooms.map { ($0.chat.id, $0) }, uniquingKeysWith: { $1 })
+    self.roomsByID = Dictionary(rooms.map { ($0.roomID, $0) }, uniquingKeysWith: { $1 })
+    self.journal = journal
+    self.sendMessage = sendMessage
+  }
+
+  /// Parses a `--room <chat-id>=<room-id>` mapping.
+  static func parseMapping(_ raw: String) throws -> (chatID: Int64, roomID: String) {
+    let parts = raw.split(separator: "=", maxSplits: 1).map {
+      $0.trimmingCharacters(in: .whitespaces)
+    }
+    guard parts.count == 2, let chatID = Int64(parts[0]), parts[1].hasPrefix("!"),
+      parts[1].contains(":")
+    else {
+      throw ParsedValuesError.invalidOption("room")
+    }
+    return (chatID, parts[1])
+  }
+
+  /// Room text for a chat.db message, or "" when there is nothing to show.
+  static func body(for message: Message, attachments: [AttachmentMeta]) -> String {
+    var lines: [String] = []
+    let text = displayText(for: message)
+    if !text.isEmpty && text != "\u{FFFC}" {
+      lines.append(text)
+    }
+    for meta in attachments {
+      lines.append("[attachment: \(displayName(for: meta))]")
+    }
+    guard !lines.isEmpty else { return "" }
+    let sender = message.isFromMe ? "me" : message.sender
+    return "\(sender): \(lines.joined(separator: "\n"))"
+  }
+
+  /// Posts a chat.db message to its room. Our own messages are mirrored too, except the ones
+  /// that are echoes of text relayed from Matrix.
+  func mirror(_ message: Message, store: MessageStore) async throws {
+    guard let room = roomsByChat[message.chatID] else { return }
+    if message.isFromMe, consumeEcho(chatID: message.chatID, text: message.text) {
+      return
+    }
+    let attachments =
+      message.attachmentsCount > 0 ? try store.attachments(for: message.rowID) : []
+    let body = MatrixBridge.body(for: message, attachments: attachments)
+    guard !body.isEmpty else { return }
+    let transactionID = "imsg-" + (message.guid.isEmpty ? String(message.rowID) : message.guid)
+    try await client.sendText(body, roomID: room.roomID, transactionID: transactionID)
+  }
+
+  /// Sends text posted by other Matrix users into the bridged chat. Each event is journaled
+  /// under `matrix:<event id>`, so a replayed sync never sends it twice.
+  @discardableResult
+  func relay(_ event: MatrixRoomEvent, ownUserID: String) throws -> SendJournalEntry.Status? {
+    guard event.sender != ownUserID, let room = roomsByID[event.roomID] else { return nil }
+    // m.notice is what bots post; relaying it invites loops between bridges.
+    guard event.msgtype == "m.text" || event.msgtype == "m.emote" else { return nil }
+    let text = event.msgtype == "m.emote" ? "* \(event.body)" : event.body
+    guard !text.isEmpty else { return nil }
+    let options = MessageSendOptions(
+      recipient: "",
+      text: text,
+      chatIdentifier: room.chat.identifier,
+      chatGUID: room.chat.guid
+    )
+    pendingEchoes[room.chat.id, default: []].append(text)
+    let status: SendJournalEntry.Status
+    do {
+      status = try journal.record(
+        idempotencyKey: "matrix:\(event.eventID)",
+        target: SendCommand.journalTarget(for: options),
+        service: MessageService.auto.rawValue,
+        textLength: text.count,
+        attachment: nil
+      ) {
+        try sendMessage(options)
+      }
+    } catch {
+      _ = consumeEcho(chatID: room.chat.id, text: text)
+      throw error
+    }
+    if status == .duplicate {
+      _ = consumeEcho(chatID: room.chat.id, text: text)
+    }
+    return status
+  }
+
+  private func consumeEcho(chatID: Int64, text: String) -> Bool {
+    guard var pending = pendingEchoes[chatID], let index = pending.firstIndex(of: text) else {
+      return false
+    }
+    pending.remove(at: index)
+    pendingEchoes[chatID] = pending.isEmpty ? nil : pending
+    return true
+  }
+}
@@ -0,0 +1,219 @@
+import Foundation
+
+enum MatrixError: Error, CustomStringConvertible {
+  case http(status: Int, errcode: String, message: String)
+  case invalidResponse(String)
+
+  var description: String {
+    switch self {
+    case .http(let status, let errcode, let message):
+      return "Matrix request failed (\(status) \(errcode)): \(message)"
+    case .invalidResponse(let detail):
+      return "Unexpected Matrix response: \(detail)"
+    }
+  }
+}
+
+/// A text message posted to one of the bridged rooms.
+struct MatrixRoomEvent: Equatable {
+  let roomID: String
+  let eventID: String
+  let sender: String
+  let msgtype: String
+  let body: String
+}
+
+struct MatrixSyncBatch: Equatable {
+  let nextBatch: String
+  let events: [MatrixRoomEvent]
+}
+
+/// Just enough of the Matrix client-server API to post text into rooms and long-poll `/sync`
+/// for replies. The token may belong to a bot user or be an application service `as_token`.
+struct MatrixClient {
+  typealias Transport = (URLRequest) async throws -> (Data, URLResponse)
+
+  let homeserver: URL
+  let token: String
+  private let transport: Transport
+
+  init(
+    homeserver: URL,
+    token: String,
+    transport: @escaping Transport = { try await URLSession.shared.data(for: $0) }
+  ) {
+    self.homeserver = homeserver
+    self.token = token
+    self.transport = transport
+  }
+
+  /// The Matrix user the token authenticates as.
+  func whoami() async throws -> String {
+    let data = try await request("GET", "/account/whoami")
+    return try JSONDecoder().decode(WhoamiResponse.self, from: data).userID
+  }
+
+  /// Posts `body` as an `m.text` message and returns the new event id. Reusing
+  /// `transactionID` makes the homeserver return the original event instead of posting twice.
+  @discardableResult
+  func sendText(_ body: String, roomID: String, transactionID: String) async throws -> String {
+    let payload = try JSONSerialization.data(withJSONObject: ["msgtype": "m.text", "body": body])
+    let path =
+      "/rooms/\(MatrixClient.escape(roomID))/send/m.room.message/"
+      + MatrixClient.escape(transactionID)
+    let data = try await request("PUT", path, body: payload)
+    return try JSONDecoder().decode(SendResponse.self, from: data).eventID
+  }
+
+  /// One `/sync` round limited to `roomIDs`; returns message events in timeline order.
+  func sync(since: String?, timeout: Int, roomIDs: [String]) async throws -> MatrixSyncBatch {
+    let filter: [String: Any] = [
+      "presence": ["types": [String]()],
+      "account_data": ["types": [String]()],
+      "room": [
+        "rooms": roomIDs,
+        "timeline": ["types": ["m.room.message"], "limit": 50],
+        "state": ["types": [String]()],
+        "ephemeral": ["types": [String]()],
+        "account_data": ["types": [String]()],
+      ],
+    ]
+    let filterJSON = try JSONSerialization.data(withJSONObject: filter, options: [.sortedKeys])
+    var query = [
+      URLQueryItem(name: "timeout", value: String(timeout)),
+      URLQueryItem(name: "filter", value: String(decoding: filterJSON, as: UTF8.self)),
+    ]
+    if let since {
+      query.append(URLQueryItem(name: "since", value: since))
+    }
+    let data = try await request("GET", "/sync", query: query)
+    let response = try JSONDecoder().decode(SyncResponse.self, from: data)
+    var events: [MatrixRoomEvent] = []
+    for (roomID, room) in (response.rooms?.join ?? [:]).sorted(by: { $0.key < $1.key }) {
+      for event in room.timeline?.events ?? [] where event.type == "m.room.message" {
+        guard let eventID = event.eventID, let sender = event.sender,
+          let body = event.content?.body
+        else { continue }
+        events.append(
+          MatrixRoomEvent(
+            roomID: roomID,
+            eventID: eventID,
+            sender: sender,
+            msgtype: event.content?.msgtype ?? "",
+            body: body
+          ))
+      }
+    }
+    return MatrixSyncBatch(nextBatch: response.nextBatch, events: events)
+  }
+
+  private func request(
+    _ method: String,
+    _ path: String,
+    query: [URLQueryItem] = [],
+    body: Data? = nil
+  ) async throws -> Data {
+    guard var components = URLComponents(url: homeserver, resolvingAgainstBaseURL: false) else {
+      throw MatrixError.invalidResponse("bad homeserver URL \(homeserver)")
+    }
+    var base = components.percentEncodedPath
+    while base.hasSuffix("/") { base.removeLast() }
+    components.percentEncodedPath = base + "/_matrix/client/v3" + path
+    components.queryItems = query.isEmpty ? nil : query
+    // URLComponents leaves "+" alone, which servers decode as a space.
+    components.percentEncodedQuery = components.percentEncodedQuery?
+      .replacingOccurrences(of: "+", with: "%2B")
+    guard let url = components.url else {
+      throw MatrixError.invalidResponse("bad request path \(path)")
+    }
+    var request = URLRequest(url: url)
+    request.httpMethod = method
+    request.setValue("Bearer \(token)", forHTTPHeaderField: "Authorization")
+    if let body {
+      request.setValue("application/json", forHTTPHeaderField: "Content-Type")
+      request.httpBody = body
+    }
+    let (data, response) = try await transport(request)
+    guard let http = response as? HTTPURLResponse else {
+      throw MatrixError.invalidResponse("no HTTP response for \(path)")
+    }
+    guard (200..<300).contains(http.statusCode) else {
+      let error = try? JSONDecoder().decode(ErrorResponse.self, from: data)
+      throw MatrixError.http(
+        status: http.statusCode,
+        errcode: error?.errcode ?? "M_UNKNOWN",
+        message: error?.error ?? String(decoding: data, as: UTF8.self)
+      )
+    }
+    return data
+  }
+
+  /// Room ids (`!abc:example.org`) and transaction ids as single path segments.
+  static func escape(_ component: String) -> String {
+    var allowed = CharacterSet.alphanumerics
+    allowed.insert(charactersIn: "-._~")
+    return component.addingPercentEncoding(withAllowedCharacters: allowed) ?? component
+  }
+}
+
+private struct WhoamiResponse: Decodable {
+  let userID: String
+
+  enum CodingKeys: String, CodingKey {
+    case userID = "user_id"
+  }
+}
+
+private struct SendResponse: Decodable {
+  let eventID: String
+
+  enum CodingKeys: String, CodingKey {
+    case eventID = "event_id"
+  }
+}
+
+private struct ErrorResponse: Decodable {
+  let errcode: String?
+  let error: String?
+}
+
+private struct SyncResponse: Decodable {
+  struct Rooms: Decodable {
+    let join: [String: JoinedRoom]?
+  }
+
+  struct JoinedRoom: Decodable {
+    let timeline: Timeline?
+  }
+
+  struct Timeline: Decodable {
+    let events: [Event]?
+  }
+
+  struct Event: Decodable {
+    struct Content: Decodable {
+      let msgtype: String?
+      let body: String?
+    }
+
+    let type: String
+    let eventID: String?
+    let sender: String?
+    let content: Content?
+
+    enum CodingKeys: String, CodingKey {
+      case type
+      case eventID = "event_id"
+      case sender
+      case content
+    }
+  }
+
+  let nextBatch: String
+  let rooms: Rooms?
+
+  enum CodingKeys: String, CodingKey {
+    case nextBatch = "next_batch"
+    case rooms
+  }
+}
@@ -0,0 +1,41 @@
+import Foundation
+import IMsgCore
+
+/// The `/sync` position (`next_batch`) the bridge reached, per homeserver and Matrix user, so a
+/// restarted bridge picks up the replies posted while it was down instead of skipping them.
+final class MatrixSyncPosition {
+  private struct Snapshot: Codable {
+    var accounts: [String: String] = [:]
+  }
+
+  let fileURL: URL
+  private let account: String
+  private var snapshot: Snapshot
+
+  init(
+    homeserver: URL, userID: String, fileURL: URL = StateDirectory.fileURL("matrix-sync.json")
+  ) throws {
+    self.fileURL = fileURL
+    self.account = "\(userID) \(homeserver.absoluteString)"
+    if FileManager.default.fileExists(atPath: fileURL.path) {
+      let data = try Data(contentsOf: fileURL)
+      self.snapshot = try JSONDecoder().decode(Snapshot.self, from: data)
+    } else {
+      self.snapshot = Snapshot()
+    }
+  }
+
+  /// The saved `next_batch`, or nil before the first sync.
+  var since: String? {
+    snapshot.accounts[account]
+  }
+
+  func save(_ since: String) throws {
+    snapshot.accounts[account] = since
+    try FileManager.default.createDirectory(
+      at: fileURL.deletingLastPathComponent(), withIntermediateDirectories: true)
+    let encoder = JSONEncoder()
+    encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+    try encoder.encode(snapshot).write(to: fileURL, options: .atomic)
+  }
+}
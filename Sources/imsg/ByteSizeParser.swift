@@ -0,0 +1,27 @@
+import Foundation
+
+/// Parses sizes like `100MB`, `512KB`, `1.5GB`, or plain bytes (1024-based units).
+enum ByteSizeParser {
+  static func parse(_ value: String) -> Int64? {
+    let trimmed = value.trimmingCharacters(in: .whitespacesAndNewlines).uppercased()
+    guard !trimmed.isEmpty else { return nil }
+
+    let units: [(suffix: String, multiplier: Double)] = [
+      ("GB", 1024 * 1024 * 1024),
+      ("MB", 1024 * 1024),
+      ("KB", 1024),
+      ("G", 1024 * 1024 * 1024),
+      ("M", 1024 * 1024),
+      ("K", 1024),
+      ("B", 1),
+    ]
+    for unit in units where trimmed.hasSuffix(unit.suffix) {
+      let number = String(trimmed.dropLast(unit.suffix.count))
+        .trimmingCharacters(in: .whitespaces)
+      guard let value = Double(number), value > 0 else { return nil }
+      return Int64(value * unit.multiplier)
+    }
+    guard let value = Int64(trimmed), value > 0 else { return nil }
+    return value
+  }
+}
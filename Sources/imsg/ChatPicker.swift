@@ -0,0 +1,197 @@
+import Commander
+import Foundation
+import IMsgCore
+
+/// Interactive, fuzzy-filtered chat list for commands run on a terminal without --chat-id.
+/// The list is drawn on stderr so stdout stays clean for the command's own output.
+enum ChatPicker {
+  enum Key: Equatable {
+    case character(Character)
+    case backspace
+    case up
+    case down
+    case enter
+    case cancel
+  }
+
+  struct State {
+    let chats: [Chat]
+    var query = ""
+    var selection = 0
+
+    init(chats: [Chat]) {
+      self.chats = chats
+    }
+
+    var matches: [Chat] { ChatPicker.filter(chats, query: query) }
+
+    /// Applies `key`; returns `.some(chat)` when picked, `.some(nil)` when cancelled.
+    mutating func handle(_ key: Key) -> Chat?? {
+      let count = matches.count
+      switch key {
+      case .character(let char):
+        query.append(char)
+        selection = 0
+      case .backspace:
+        if !query.isEmpty { query.removeLast() }
+        selection = 0
+      case .up:
+        selection = max(0, selection - 1)
+      case .down:
+        selection = min(max(0, count - 1), selection + 1)
+      case .enter:
+        guard count > 0 else { return nil }
+        return .some(matches[min(selection, count - 1)])
+      case .cancel:
+        return .some(nil)
+      }
+      return nil
+    }
+  }
+
+  static let visibleRows = 10
+
+  /// Chats whose name or identifier contains `query` as a subsequence (case-insensitive),
+  /// tightest and earliest matches first; recency breaks ties.
+  static func filter(_ chats: [Chat], query: String) -> [Chat] {
+    let needle = Array(query.lowercased().filter { !$0.isWhitespace })
+    guard !needle.isEmpty else { return chats }
+    let scored = chats.enumerated().compactMap { index, chat -> (Int, Int, Chat)? in
+      let haystack = Array("\(chat.name) \(chat.identifier)".lowercased())
+      guard let score = subsequenceScore(needle, in: haystack) else { return nil }
+      return (score, index, chat)
+    }
+    return scored.sorted { ($0.0, $0.1) < ($1.0, $1.1) }.map(\.2)
+  }
+
+  /// Span of the first match plus its start; lower is better. nil when `needle` isn't found.
+  private static func subsequenceScore(_ needle: [Character], in haystack: [Character]) -> Int? {
+    var best: Int?
+    for start in haystack.indices where haystack[start] == needle[0] {
+      var position = start
+      var matched = 1
+      while matched < needle.count {
+        position += 1
+        guard position < haystack.count else { break }
+        if haystack[position] == needle[matched] { matched += 1 }
+      }
+      guard matched == needle.count else { break }
+      let score = (position - start) * 4 + start
+      best = min(best ?? score, score)
+    }
+    return best
+  }
+
+  static func decodeKeys(_ bytes: [UInt8]) -> [Key] {
+    var keys: [Key] = []
+    var index = 0
+    while index < bytes.count {
+      let byte = bytes[index]
+      switch byte {
+      case 0x1b:
+        if index + 2 < bytes.count, bytes[index + 1] == UInt8(ascii: "[") {
+          switch bytes[index + 2] {
+          case UInt8(ascii: "A"): keys.append(.up)
+          case UInt8(ascii: "B"): keys.append(.down)
+          default: break
+          }
+          index += 3
+          continue
+        }
+        keys.append(.cancel)
+      case 0x03, 0x04:
+        keys.append(.cancel)
+      case 0x0d, 0x0a:
+        keys.append(.enter)
+      case 0x7f, 0x08:
+        keys.append(.backspace)
+      case 0x10:
+        keys.append(.up)
+      case 0x0e:
+        keys.append(.down)
+      case 0x20...0x7e:
+        keys.append(.character(Character(UnicodeScalar(byte))))
+      case 0xc0...0xff:
+        // Multi-byte UTF-8; take the whole sequence as one character.
+        let length = byte >= 0xf0 ? 4 : byte >= 0xe0 ? 3 : 2
+        let end = min(bytes.count, index + length)
+        if let text = String(bytes: bytes[index..<end], encoding: .utf8), let char = text.first {
+          keys.append(.character(char))
+        }
+        index = end
+        continue
+      default:
+        break
+      }
+      index += 1
+    }
+    return keys
+  }
+
+  static var isInteractive: Bool {
+    isatty(STDIN_FILENO) == 1 && isatty(STDERR_FILENO) == 1
+  }
+
+  /// `--chat-id` if given; otherwise a chat picked on the terminal, or a missing-option error
+  /// when not interactive. The picked id is echoed on stderr for reuse in scripts.
+  static func chatID(from values: ParsedValues, store: MessageStore) throws -> Int64 {
+    if let chatID = values.optionInt64("chatID") { return chatID }
+    guard isInteractive else {
+      throw ParsedValuesError.missingOption("chat-id")
+    }
+    guard let chat = try pick(from: store.listChats(limit: 200)) else {
+      throw ParsedValuesError.missingOption("chat-id")
+    }
+    let label = chat.name.isEmpty ? chat.identifier : chat.name
+    FileHandle.standardError.write(Data("imsg: chat \(label) is --chat-id \(chat.id)\n".utf8))
+    return chat.id
+  }
+
+  static func pick(from chats: [Chat]) throws -> Chat? {
+    guard !chats.isEmpty else { return nil }
+    var original = termios()
+    guard tcgetattr(STDIN_FILENO, &original) == 0 else { return nil }
+    var raw = original
+    raw.c_lflag &= ~tcflag_t(ICANON | ECHO | ISIG)
+    tcsetattr(STDIN_FILENO, TCSAFLUSH, &raw)
+    var state = State(chats: chats)
+    var drawnLines = 0
+    defer {
+      clear(lines: drawnLines)
+      tcsetattr(STDIN_FILENO, TCSAFLUSH, &original)
+    }
+    while true {
+      clear(lines: drawnLines)
+      drawnLines = draw(state)
+      var buffer = [UInt8](repeating: 0, count: 16)
+      let count = read(STDIN_FILENO, &buffer, buffer.count)
+      guard count > 0 else { return nil }
+      for key in decodeKeys(Array(buffer[0..<count])) {
+        if let outcome = state.handle(key) {
+          return outcome
+        }
+      }
+    }
+  }
+
+  private static func draw(_ state: State) -> Int {
+    let matches = state.matches
+    let first = max(0, state.selection - visibleRows + 1)
+    var lines = ["pick a chat (type to filter, ↑/↓, enter; esc cancels): \(state.query)"]
+    for (offset, chat) in matches.dropFirst(first).prefix(visibleRows).enumerated() {
+      let marker = first + offset == state.selection ? ">" : " "
+      let name = chat.name.isEmpty || chat.name == chat.identifier ? "" : "\(chat.name)  "
+      lines.append("\(marker) \(chat.id)\t\(name)\(chat.identifier)")
+    }
+    if matches.isEmpty {
+      lines.append("  (no matches)")
+    }
+    FileHandle.standardError.write(Data((lines.joined(separator: "\n") + "\n").utf8))
+    return lines.count
+  }
+
+  private static func clear(lines: Int) {
+    guard lines > 0 else { return }
+    FileHandle.standardError.write(Data("\u{1b}[\(lines)A\u{1b}[J".utf8))
+  }
+}
@@ -11,11 +11,44 @@ struct CommandRouter {
     self.version = CommandRouter.resolveVersion()
     self.specs = [
       ChatsCommand.spec,
+      PersonCommand.spec,
       HistoryCommand.spec,
+      MessageCommand.spec,
+      MessagesCommand.spec,
+      ContextCommand.spec,
+      EventsCommand.spec,
+      ExtractCommand.spec,
+      ExportCommand.spec,
+      AttachmentsCommand.spec,
       WatchCommand.spec,
+      UnreadCommand.spec,
+      CallsCommand.spec,
+      SearchCommand.spec,
+      DeletedCommand.spec,
+      TagCommand.spec,
+      TaggedCommand.spec,
+      DiffCommand.spec,
+      MuteCommand.spec,
+      UnmuteCommand.spec,
       SendCommand.spec,
+      ForwardCommand.spec,
+      AutoreplyCommand.spec,
+      OTPForwardCommand.spec,
+      WebhookQueueCommand.spec,
+      ReactCommand.spec,
       RpcCommand.spec,
+      McpCommand.spec,
+      BridgeCommand.spec,
       HelperServerCommand.spec,
+      ServiceCommand.spec,
+      SelfUpdateCommand.spec,
+      DoctorCommand.spec,
+      AccountsCommand.spec,
+      SyncStatusCommand.spec,
+      AuditCommand.spec,
+      BenchCommand.spec,
+      CompletionsCommand.spec,
+      CompleteCommand.spec,
     ]
     let descriptor = CommandDescriptor(
       name: rootName,
@@ -52,11 +85,20 @@ struct CommandRouter {
         return 1
       }
       let runtime = RuntimeOptions(parsedValues: invocation.parsedValues)
+      let logger = runtime.automationLogger
+      logger.log(.debug, "running \(commandName)")
+      logger.log(.trace, "argv: \(argv.joined(separator: " "))")
       do {
         try await spec.run(invocation.parsedValues, runtime)
         return 0
       } catch {
-        Swift.print(error)
+        logger.log(
+          .error, String(describing: error),
+          fields: AutomationLogger.context(of: error).merging(["command": commandName]) { $1 })
+        if runtime.logFile != nil || !logger.isEnabled(.error) {
+          // The log went elsewhere (or nowhere); the person at the terminal still needs it.
+          FileHandle.standardError.write(Data("imsg \(commandName): \(error)\n".utf8))
+        }
         return 1
       }
     } catch let error as CommanderProgramError {
@@ -8,11 +8,49 @@ enum CommandSignatures {
         label: "db",
         names: [.long("db")],
         help: "Path to chat.db (defaults to ~/Library/Messages/chat.db)"
-      )
+      ),
+      .make(
+        label: "dbBackup",
+        names: [.long("db-backup")],
+        help: "Read from an iOS backup folder or Time Machine snapshot instead"
+      ),
+      .make(
+        label: "user",
+        names: [.long("user")],
+        help: "Read another account's chat.db (run with sudo; picks the user in --db-backup)"
+      ),
     ]
   }
 
+  static func databasePath(from values: ParsedValues) throws -> String {
+    let path = values.option("db")
+    let user = values.option("user")
+    guard let backup = values.option("dbBackup") else {
+      guard let user else { return path ?? MessageStore.defaultPath }
+      if path != nil {
+        throw ParsedValuesError.invalidOption("user")
+      }
+      return MessageStore.defaultPath(forUser: user)
+    }
+    if path != nil {
+      throw ParsedValuesError.invalidOption("db-backup")
+    }
+    return try BackupLocator.chatDatabasePath(in: backup, userName: user ?? NSUserName())
+  }
+
+  /// The standard `--json`, `--verbose` and `--log-level` plus `--log-json` and `--log-file`.
   static func withRuntimeFlags(_ signature: CommandSignature) -> CommandSignature {
-    signature.withStandardRuntimeFlags()
+    let standard = signature.withStandardRuntimeFlags()
+    return CommandSignature(
+      arguments: standard.arguments,
+      options: standard.options + [
+        .make(
+          label: "logFile", names: [.long("log-file")],
+          help: "write logs to this file instead of stderr, rotated at 10MB (3 kept)")
+      ],
+      flags: standard.flags + [
+        .make(label: "logJSON", names: [.long("log-json")], help: "log one JSON object per line")
+      ]
+    )
   }
 }
@@ -6,6 +6,8 @@ struct CommandSpec: @unchecked Sendable {
   let discussion: String?
   let signature: CommandSignature
   let usageExamples: [String]
+  /// Hidden commands run normally but are left out of the root help listing.
+  var isHidden = false
   let run: (ParsedValues, RuntimeOptions) async throws -> Void
 
   var descriptor: CommandDescriptor {
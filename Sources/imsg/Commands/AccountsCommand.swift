@@ -0,0 +1,133 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct AccountPayload: Codable, Equatable {
+  let id: String
+  let service: String
+  let name: String
+  let enabled: Bool
+  let status: String
+
+  init(account: MessagesAccount) {
+    self.id = account.id
+    self.service = account.serviceType
+    self.name = account.name
+    self.enabled = account.enabled
+    self.status = account.connectionStatus
+  }
+}
+
+struct AliasPayload: Codable, Equatable {
+  let handle: String
+  let kind: String
+  let service: String
+  let messagesSent: Int
+  let lastUsedAt: String
+
+  init(alias: SenderAlias) {
+    self.handle = alias.handle
+    self.kind = alias.kind
+    self.service = alias.service
+    self.messagesSent = alias.messagesSent
+    self.lastUsedAt = CLIISO8601.format(alias.lastUsedAt)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case handle
+    case kind
+    case service
+    case messagesSent = "messages_sent"
+    case lastUsedAt = "last_used_at"
+  }
+}
+
+struct AccountsReport: Codable {
+  let accounts: [AccountPayload]
+  let aliases: [AliasPayload]
+  let smsRelay: Bool?
+  let automationError: String?
+
+  enum CodingKeys: String, CodingKey {
+    case accounts
+    case aliases
+    case smsRelay = "sms_relay"
+    case automationError = "automation_error"
+  }
+}
+
+enum AccountsCommand {
+  static let spec = CommandSpec(
+    name: "accounts",
+    abstract: "List Messages accounts and sending aliases",
+    discussion: """
+      Services (iMessage, SMS relay) come from Messages.app via AppleScript and need
+      Automation permission. Aliases are the Apple ID emails and phone numbers this
+      Mac has sent from, read from chat.db. Pass an account's id or name to
+      imsg send --from to send from it.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(options: CommandSignatures.baseOptions())
+    ),
+    usageExamples: [
+      "imsg accounts",
+      "imsg accounts --json | jq -r '.aliases[].handle'",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    accountsProvider: @escaping () throws -> [MessagesAccount] = {
+      try MessagesAutomation.accounts()
+    },
+    output: (String) -> Void = { Swift.print($0) }
+  ) async throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let store = try storeFactory(dbPath)
+    let aliases = try store.senderAliases()
+
+    var accounts: [MessagesAccount] = []
+    var automationError: String?
+    do {
+      accounts = try accountsProvider()
+    } catch {
+      automationError = String(describing: error)
+    }
+    let smsRelay: Bool? =
+      automationError == nil ? accounts.contains { $0.isSMS && $0.enabled } : nil
+
+    let report = AccountsReport(
+      accounts: accounts.map(AccountPayload.init(account:)),
+      aliases: aliases.map(AliasPayload.init(alias:)),
+      smsRelay: smsRelay,
+      automationError: automationError
+    )
+    if runtime.jsonOutput {
+      output(try JSONLines.encode(report))
+      return
+    }
+
+    if let automationError {
+      output("accounts: unavailable (\(automationError))")
+    } else if report.accounts.isEmpty {
+      output("accounts: none (is Messages signed in?)")
+    }
+    for account in report.accounts {
+      let state = account.enabled ? "enabled" : "disabled"
+      output(
+        "[\(account.service)] \(account.name) \(state) status=\(account.status) id=\(account.id)")
+    }
+    if let smsRelay {
+      output("sms relay: \(smsRelay ? "available" : "unavailable")")
+    }
+    for alias in report.aliases {
+      output(
+        "\(alias.handle) (\(alias.kind), \(alias.service)) sent=\(alias.messagesSent) "
+          + "last=\(alias.lastUsedAt)")
+    }
+  }
+}
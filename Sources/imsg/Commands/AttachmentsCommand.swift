@@ -0,0 +1,225 @@
+import Commander
+import Foundation
+import IMsgCore
+
+/// Folder layout for `imsg attachments`.
+enum AttachmentLayout: String, CaseIterable {
+  /// `2025/03/IMG_0001.jpeg`, by the month the message was sent.
+  case date
+  /// `12 Family/IMG_0001.jpeg`, one folder per chat.
+  case chat
+  /// Everything in the output directory.
+  case flat
+
+  /// The folder under the output directory, relative; empty for `flat`.
+  func folder(for message: Message, chat: ChatInfo, calendar: Calendar) -> String {
+    switch self {
+    case .date:
+      let parts = calendar.dateComponents([.year, .month], from: message.date)
+      return String(format: "%04d/%02d", parts.year ?? 0, parts.month ?? 0)
+    case .chat:
+      let title = chat.name.isEmpty ? chat.identifier : chat.name
+      return AttachmentLayout.safeName("\(chat.id) \(title)")
+    case .flat:
+      return ""
+    }
+  }
+
+  /// A path component without separators or leading dots, at most 80 characters.
+  static func safeName(_ name: String) -> String {
+    let cleaned = name.map { "/:\\".contains($0) || $0.isNewline ? "-" : String($0) }.joined()
+      .trimmingCharacters(in: .whitespaces.union(CharacterSet(charactersIn: ".")))
+    return cleaned.isEmpty ? "attachment" : String(cleaned.prefix(80))
+  }
+}
+
+struct AttachmentCopyResult: Codable, Equatable {
+  let directory: String
+  let layout: String
+  let copied: Int
+  /// Already in place from an earlier run (same name and contents).
+  let existing: Int
+  /// Not on disk, e.g. kept only in iCloud.
+  let missing: Int
+  let index: String
+}
+
+enum AttachmentsCommand {
+  static let indexHeader = [
+    "path", "message_id", "message_guid", "chat_id", "sender", "is_from_me", "date",
+    "mime_type", "original_path",
+  ]
+
+  static let spec = CommandSpec(
+    name: "attachments",
+    abstract: "Copy attachment files out of Messages into folders",
+    discussion: """
+      Copies the attachment files of one chat (--chat-id) or every chat into --out (default
+      imsg-attachments), oldest first. --layout date (default) files them in YYYY/MM folders
+      by the month they were sent, chat in one folder per chat ("12 Family"), flat all in one
+      directory. Files keep their original names; a different file with the same name gets
+      " (2)", " (3)" and so on, while an identical one already there is left alone, so
+      running it again only copies what is new. index.csv in --out maps every file back to
+      its message id and guid, chat, sender (me for your own) and date; each run updates the
+      rows of the files it copied or found and keeps the rest. Attachments not on disk, such
+      as those kept only in iCloud, are counted and skipped.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "chatID", names: [.long("chat-id")], help: "only this chat"),
+          .make(
+            label: "out", names: [.long("out")],
+            help: "directory to copy into (default imsg-attachments)"),
+          .make(
+            label: "layout", names: [.long("layout")],
+            help: "folders: date|chat|flat (default date)"),
+        ] + MessageFilterOptions.options()
+      )
+    ),
+    usageExamples: [
+      "imsg attachments --out ~/Pictures/Messages",
+      "imsg attachments --chat-id 1 --layout flat --out ~/Desktop/mom",
+      "imsg attachments --layout chat --start 2025-01-01T00:00:00Z --json",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    calendar: Calendar = .current
+  ) throws {
+    let layoutRaw = values.option("layout") ?? AttachmentLayout.date.rawValue
+    guard let layout = AttachmentLayout(rawValue: layoutRaw.lowercased()) else {
+      throw ParsedValuesError.invalidOption("layout")
+    }
+    let filter = try MessageFilterOptions.filter(from: values)
+    let outPath = values.option("out") ?? "imsg-attachments"
+    let directory = URL(fileURLWithPath: NSString(string: outPath).expandingTildeInPath)
+    let store = try storeFactory(try CommandSignatures.databasePath(from: values))
+
+    var chats: [ChatInfo] = []
+    if let chatID = values.optionInt64("chatID") {
+      guard let chat = try store.chatInfo(chatID: chatID) else {
+        throw IMsgError.invalidChatTarget("Unknown chat id \(chatID)")
+      }
+      chats = [chat]
+    } else {
+      chats = try store.listChats(limit: Int.max).compactMap { try store.chatInfo(chatID: $0.id) }
+    }
+
+    let fileManager = FileManager.default
+    try fileManager.createDirectory(at: directory, withIntermediateDirectories: true)
+    let tabular = TabularFormat.csv
+    var index: [(path: String, line: String)] = []
+    var copied = 0
+    var existing = 0
+    var missing = 0
+    let handleIDs = try store.senderHandleIDs(for: filter)
+    for chat in chats {
+      try store.scanMessages(
+        chatID: chat.id, order: .oldestFirst, dateRange: filter.dateRange, handleIDs: handleIDs
+      ) { batch in
+        let messages = batch.filter { $0.attachmentsCount > 0 && filter.allows($0) }
+        if messages.isEmpty { return }
+        let attachments = try store.attachments(forMessageIDs: messages.map(\.rowID))
+        for message in messages {
+          for meta in attachments[message.rowID] ?? [] {
+            guard !meta.missing, fileManager.fileExists(atPath: meta.originalPath) else {
+              missing += 1
+              continue
+            }
+            let folder = layout.folder(for: message, chat: chat, calendar: calendar)
+            let target = folder.isEmpty ? directory : directory.appendingPathComponent(folder)
+            let (destination, isNew) = try copy(
+              URL(fileURLWithPath: meta.originalPath), into: target,
+              name: meta.transferName.isEmpty ? nil : meta.transferName)
+            if isNew { copied += 1 } else { existing += 1 }
+            let relative = folder.isEmpty
+              ? destination.lastPathComponent : "\(folder)/\(destination.lastPathComponent)"
+            index.append(
+              (
+                relative,
+                tabular.line([
+                  relative, String(message.rowID), message.guid, String(chat.id),
+                  message.isFromMe ? "me" : message.sender, message.isFromMe ? "1" : "0",
+                  CLIISO8601.format(message.date), meta.mimeType, meta.originalPath,
+                ])
+              ))
+          }
+        }
+      }
+    }
+    let indexURL = directory.appendingPathComponent("index.csv")
+    let lines = try mergedIndex(at: indexURL, with: index)
+    try Data(([tabular.line(indexHeader)] + lines).map { $0 + "\n" }.joined().utf8)
+      .write(to: indexURL, options: .atomic)
+
+    let result = AttachmentCopyResult(
+      directory: directory.path, layout: layout.rawValue, copied: copied, existing: existing,
+      missing: missing, index: indexURL.path)
+    if runtime.jsonOutput {
+      try JSONLines.print(result)
+      return
+    }
+    var line = "copied \(copied) attachment\(pluralSuffix(for: copied)) to \(directory.path)"
+    if existing > 0 {
+      line += " (\(existing) already there)"
+    }
+    Swift.print(line)
+    if missing > 0 {
+      Swift.print("\(missing) not on disk (kept in iCloud or deleted)")
+    }
+  }
+
+  /// The rows of the index already at `url` with `rows` merged in by path: a file copied again
+  /// gets its new row in place, new files are appended, and rows from earlier runs (other
+  /// chats, other date ranges) are kept.
+  static func mergedIndex(
+    at url: URL, with rows: [(path: String, line: String)]
+  ) throws -> [String] {
+    var order: [String] = []
+    var lines: [String: String] = [:]
+    if FileManager.default.fileExists(atPath: url.path) {
+      let text = try String(contentsOf: url, encoding: .utf8)
+      for record in TabularFormat.parseCSV(text).dropFirst() {
+        guard let path = record.first, !path.isEmpty else { continue }
+        if lines[path] == nil { order.append(path) }
+        lines[path] = TabularFormat.csv.line(record)
+      }
+    }
+    for row in rows {
+      if lines[row.path] == nil { order.append(row.path) }
+      lines[row.path] = row.line
+    }
+    return order.compactMap { lines[$0] }
+  }
+
+  /// Copies `source` into `directory` under `name` (the file's own name by default), numbering
+  /// the name when a different file already has it. Returns where the file is and whether it
+  /// was copied now rather than found from an earlier run.
+  static func copy(_ source: URL, into directory: URL, name: String?) throws -> (URL, Bool) {
+    let fileManager = FileManager.default
+    try fileManager.createDirectory(at: directory, withIntermediateDirectories: true)
+    let fileName = AttachmentLayout.safeName(name ?? source.lastPathComponent)
+    let base = (fileName as NSString).deletingPathExtension
+    let ext = (fileName as NSString).pathExtension
+    var number = 1
+    while true {
+      let suffix = ext.isEmpty ? "" : ".\(ext)"
+      let candidate = number == 1 ? fileName : "\(base) (\(number))\(suffix)"
+      let destination = directory.appendingPathComponent(candidate)
+      if !fileManager.fileExists(atPath: destination.path) {
+        try fileManager.copyItem(at: source, to: destination)
+        return (destination, true)
+      }
+      if fileManager.contentsEqual(atPath: source.path, andPath: destination.path) {
+        return (destination, false)
+      }
+      number += 1
+    }
+  }
+}
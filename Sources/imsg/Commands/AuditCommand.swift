@@ -0,0 +1,159 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct ChatUsagePayload: Codable, Equatable {
+  let chatID: Int64
+  let name: String
+  let identifier: String
+  let messages: Int
+  let attachments: Int
+  let bytes: Int64
+  let missing: Int
+
+  init(usage: ChatStorageUsage) {
+    self.chatID = usage.chatID
+    self.name = usage.name
+    self.identifier = usage.identifier
+    self.messages = usage.messages
+    self.attachments = usage.attachments
+    self.bytes = usage.bytes
+    self.missing = usage.missing
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case chatID = "chat_id"
+    case name
+    case identifier
+    case messages
+    case attachments
+    case bytes
+    case missing
+  }
+}
+
+struct AuditReport: Codable {
+  let messages: Int
+  let attachments: Int
+  let attachmentBytes: Int64
+  let chats: [ChatUsagePayload]
+  let missing: [String]
+  let orphaned: [String]?
+  let orphanedBytes: Int64
+  let attachmentsDir: String?
+
+  init(audit: StorageAudit, chatLimit: Int) {
+    self.messages = audit.totalMessages
+    self.attachments = audit.totalAttachments
+    self.attachmentBytes = audit.attachmentBytes
+    self.chats = audit.chats.prefix(chatLimit).map(ChatUsagePayload.init(usage:))
+    self.missing = audit.missing
+    self.orphaned = audit.orphaned
+    self.orphanedBytes = audit.orphanedBytes
+    self.attachmentsDir = audit.attachmentsRoot
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case messages
+    case attachments
+    case attachmentBytes = "attachment_bytes"
+    case chats
+    case missing
+    case orphaned
+    case orphanedBytes = "orphaned_bytes"
+    case attachmentsDir = "attachments_dir"
+  }
+}
+
+enum AuditCommand {
+  static let spec = CommandSpec(
+    name: "audit",
+    abstract: "Report message counts and attachment storage",
+    discussion: """
+      Counts messages and attachments, measures attachment files on disk per chat, lists
+      attachments chat.db references but that are missing (not downloaded or lost in sync),
+      and files under the attachments folder that nothing references. Read-only: imsg never
+      deletes anything.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(
+            label: "limit", names: [.long("limit")],
+            help: "chats and paths to list (default 20; --json lists every path)"),
+          .make(
+            label: "attachmentsDir", names: [.long("attachments-dir")],
+            help: "attachments folder to scan for orphans (default: Attachments beside chat.db)"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg audit",
+      "imsg audit --json | jq '.chats[0]'",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) }
+  ) async throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    var limit = 20
+    if values.option("limit") != nil {
+      guard let parsed = values.optionInt("limit"), parsed > 0 else {
+        throw ParsedValuesError.invalidOption("limit")
+      }
+      limit = parsed
+    }
+    let store = try storeFactory(dbPath)
+    let attachmentsDir = values.option("attachmentsDir").map {
+      ($0 as NSString).expandingTildeInPath
+    }
+    let audit = try store.storageAudit(attachmentsRoot: attachmentsDir)
+    let report = AuditReport(audit: audit, chatLimit: limit)
+    if runtime.jsonOutput {
+      try JSONLines.print(report)
+      return
+    }
+
+    Swift.print("messages: \(report.messages)")
+    Swift.print(
+      "attachments: \(report.attachments) (\(formatBytes(report.attachmentBytes)) on disk, "
+        + "\(report.missing.count) missing)")
+    if let orphaned = report.orphaned, let dir = report.attachmentsDir {
+      Swift.print(
+        "orphaned files: \(orphaned.count) (\(formatBytes(report.orphanedBytes))) in \(dir)")
+    } else {
+      Swift.print("orphaned files: not scanned (no attachments folder; pass --attachments-dir)")
+    }
+    if !report.chats.isEmpty {
+      Swift.print("chats by attachment size:")
+    }
+    for chat in report.chats {
+      let missing = chat.missing > 0 ? ", \(chat.missing) missing" : ""
+      Swift.print(
+        "  [\(chat.chatID)] \(chat.name) (\(chat.identifier)): \(formatBytes(chat.bytes)) in "
+          + "\(chat.attachments) attachments\(missing), \(chat.messages) messages")
+    }
+    printPaths("missing", report.missing, limit: limit)
+    printPaths("orphaned", report.orphaned ?? [], limit: limit)
+  }
+
+  private static func printPaths(_ title: String, _ paths: [String], limit: Int) {
+    guard !paths.isEmpty else { return }
+    Swift.print("\(title):")
+    for path in paths.prefix(limit) {
+      Swift.print("  \(path)")
+    }
+    if paths.count > limit {
+      Swift.print("  … \(paths.count - limit) more (use --json for the full list)")
+    }
+  }
+
+  static func formatBytes(_ bytes: Int64) -> String {
+    ByteCountFormatter.string(fromByteCount: bytes, countStyle: .file)
+  }
+}
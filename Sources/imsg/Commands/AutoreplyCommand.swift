@@ -0,0 +1,184 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct AutoReplyPayload: Codable, Equatable {
+  let chatID: Int64
+  let messageID: Int64
+  let sender: String
+  /// `sent`, or `duplicate` when the journal shows this message was already answered.
+  let status: String
+  let createdAt: String
+
+  enum CodingKeys: String, CodingKey {
+    case chatID = "chat_id"
+    case messageID = "message_id"
+    case sender
+    case status
+    case createdAt = "created_at"
+  }
+}
+
+enum AutoreplyCommand {
+  static let spec = CommandSpec(
+    name: "autoreply",
+    abstract: "Answer incoming messages automatically",
+    discussion: """
+      Watches for new incoming messages (from now on) and answers each sender in the same
+      chat with --text, at most once per --once-per (default 24h) per sender and chat. The
+      last reply times are kept in autoreply.json in the state directory, so a restart
+      doesn't answer everyone again. Without --chat-id every 1:1 chat is covered; group chats
+      only with --include-groups. --allow limits replies to those handles, --deny skips them
+      (any phone format). Replies go through the send journal keyed by the incoming message.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "chatID", names: [.long("chat-id")], help: "only this chat"),
+          .make(label: "text", names: [.long("text")], help: "reply text"),
+          .make(
+            label: "oncePer", names: [.long("once-per")],
+            help: "minimum time between replies to one sender (default 24h)"),
+          .make(
+            label: "allow", names: [.long("allow")],
+            help: "only answer these handles (repeatable or comma-separated)"),
+          .make(
+            label: "deny", names: [.long("deny")],
+            help: "never answer these handles (repeatable or comma-separated)"),
+          .make(
+            label: "debounce", names: [.long("debounce")],
+            help: "debounce interval for filesystem events (e.g. 250ms)"),
+        ],
+        flags: [
+          .make(
+            label: "includeGroups", names: [.long("include-groups")],
+            help: "also answer in group chats when --chat-id is not given")
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg autoreply --text \"I'm away until Monday\" --once-per 24h",
+      "imsg autoreply --chat-id 1 --text 'Driving, will call back' --once-per 1h",
+      "imsg autoreply --text 'Out of office' --deny +14155551212 --json",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    sendMessage: ((MessageSendOptions) throws -> Void)? = nil,
+    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    journal: SendJournal = SendJournal(),
+    limiterFactory: () throws -> AutoReplyLimiter = { try AutoReplyLimiter() },
+    muteListFactory: () throws -> ChatMuteList = { try ChatMuteList() },
+    now: @escaping () -> Date = Date.init,
+    streamProvider:
+      @escaping (
+        MessageWatcher,
+        Int64?,
+        Int64?,
+        MessageWatcherConfiguration
+      ) -> AsyncThrowingStream<MessageWatchEvent, Error> = {
+        watcher, chatID, sinceRowID, config in
+        watcher.events(chatID: chatID, sinceRowID: sinceRowID, configuration: config)
+      }
+  ) async throws {
+    let logger = runtime.automationLogger
+    let sendMessage = sendMessage ?? { try MessageSender(logger: logger).send($0) }
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let chatID = values.optionInt64("chatID")
+    guard let text = values.option("text"), !text.isEmpty else {
+      throw ParsedValuesError.missingOption("text")
+    }
+    guard let interval = DurationParser.parse(values.option("oncePer") ?? "24h") else {
+      throw ParsedValuesError.invalidOption("once-per")
+    }
+    guard let debounceInterval = DurationParser.parse(values.option("debounce") ?? "250ms") else {
+      throw ParsedValuesError.invalidOption("debounce")
+    }
+    let allow = handleKeys(values.optionValues("allow"))
+    let deny = handleKeys(values.optionValues("deny"))
+    let includeGroups = values.flag("includeGroups") || chatID != nil
+    let limiter = try limiterFactory()
+
+    var store = try storeFactory(dbPath)
+    // A chat named with --chat-id gets replies even when muted.
+    let muteList = chatID == nil ? try muteListFactory() : nil
+    var chats: [Int64: ChatInfo?] = [:]
+    let watcher = MessageWatcher(store: store)
+    let config = MessageWatcherConfiguration(debounceInterval: debounceInterval, batchLimit: 100)
+    for try await event in streamProvider(watcher, chatID, nil, config) {
+      let message: Message
+      switch event {
+      case .message(let next):
+        message = next
+      case .reconnected(let reconnect):
+        store = reconnect.store
+        continue
+      case .reaction, .edited, .deleted, .receipt, .heartbeat:
+        continue
+      }
+      guard !message.isFromMe, !message.sender.isEmpty else { continue }
+      try muteList?.reloadIfChanged()
+      if try muteList?.isMuted(chatID: message.chatID, in: store) == true { continue }
+      let sender = PhoneNumberNormalizer.shared.normalizeHandle(message.sender)
+      if deny.contains(sender) || (!allow.isEmpty && !allow.contains(sender)) { continue }
+      if chats[message.chatID] == nil {
+        chats[message.chatID] = try store.chatInfo(chatID: message.chatID)
+      }
+      guard let chat = chats[message.chatID] ?? nil else { continue }
+      if !includeGroups && isGroupHandle(identifier: chat.identifier, guid: chat.guid) {
+        continue
+      }
+      let date = now()
+      guard limiter.allows(chatID: chat.id, sender: sender, interval: interval, now: date) else {
+        continue
+      }
+
+      let options = MessageSendOptions(
+        recipient: "", text: text, chatIdentifier: chat.identifier, chatGUID: chat.guid)
+      let messageKey = message.guid.isEmpty ? String(message.rowID) : message.guid
+      let status: SendJournalEntry.Status
+      do {
+        status = try journal.record(
+          idempotencyKey: "autoreply:\(messageKey)",
+          target: SendCommand.journalTarget(for: options),
+          service: MessageService.auto.rawValue,
+          textLength: text.count,
+          attachment: nil
+        ) {
+          try sendMessage(options)
+        }
+      } catch {
+        // One failed send shouldn't end the away message for everyone else.
+        logger.log(
+          error, "reply to message \(message.rowID) failed",
+          fields: ["command": "autoreply", "chat_id": String(chat.id)])
+        continue
+      }
+      limiter.record(chatID: chat.id, sender: sender, at: date)
+      try limiter.save()
+
+      if runtime.jsonOutput {
+        try JSONLines.print(
+          AutoReplyPayload(
+            chatID: chat.id, messageID: message.rowID, sender: message.sender,
+            status: status.rawValue, createdAt: CLIISO8601.format(date)))
+      } else if status == .duplicate {
+        Swift.print("already answered \(message.sender) in chat \(chat.id)")
+      } else {
+        Swift.print("replied to \(message.sender) in chat \(chat.id)")
+      }
+    }
+  }
+
+  private static func handleKeys(_ values: [String]) -> Set<String> {
+    Set(
+      values.flatMap { $0.split(separator: ",") }
+        .map { $0.trimmingCharacters(in: .whitespaces) }
+        .filter { !$0.isEmpty }
+        .map { PhoneNumberNormalizer.shared.normalizeHandle($0) })
+  }
+}
@@ -0,0 +1,135 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct BenchmarkPayload: Codable, Equatable {
+  let name: String
+  let iterations: Int
+  let rows: Int
+  let minMs: Double
+  let medianMs: Double
+  let p95Ms: Double
+
+  init(result: BenchmarkResult) {
+    self.name = result.name
+    self.iterations = result.iterations
+    self.rows = result.rows
+    self.minMs = result.minMilliseconds
+    self.medianMs = result.medianMilliseconds
+    self.p95Ms = result.p95Milliseconds
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case name
+    case iterations
+    case rows
+    case minMs = "min_ms"
+    case medianMs = "median_ms"
+    case p95Ms = "p95_ms"
+  }
+}
+
+struct BenchmarkReport: Codable {
+  let version: String
+  let database: String
+  let messages: Int64
+  let results: [BenchmarkPayload]
+}
+
+enum BenchError: Error, CustomStringConvertible {
+  case tooSlow([String])
+
+  var description: String {
+    switch self {
+    case .tooSlow(let names):
+      return "bench: over budget: \(names.joined(separator: ", "))"
+    }
+  }
+}
+
+enum BenchCommand {
+  static let spec = CommandSpec(
+    name: "bench",
+    abstract: "Measure database query performance",
+    discussion: """
+      Times the queries behind chats, history, watch, search and --match against your chat.db
+      (read-only). Attach the --json output when reporting slowness. --fixture N benchmarks
+      a generated database with N messages instead; --fail-over-ms turns the run into a gate.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(
+            label: "iterations", names: [.long("iterations")],
+            help: "runs per query (default 5)"),
+          .make(
+            label: "fixture", names: [.long("fixture")],
+            help: "generate a synthetic database with N messages and benchmark it"),
+          .make(
+            label: "failOverMs", names: [.long("fail-over-ms")],
+            help: "exit non-zero if any median exceeds this many milliseconds"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg bench --json",
+      "imsg bench --fixture 1000000 --fail-over-ms 250",
+    ],
+    isHidden: true
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(values: ParsedValues, runtime: RuntimeOptions) async throws {
+    let iterations = values.optionInt("iterations") ?? 5
+    let dbPath: String
+    // A generated database is large and only good for this run.
+    var fixtureDirectory: URL?
+    defer {
+      if let fixtureDirectory {
+        try? FileManager.default.removeItem(at: fixtureDirectory)
+      }
+    }
+    if let fixture = values.optionInt("fixture") {
+      let directory = FileManager.default.temporaryDirectory
+        .appendingPathComponent("imsg-bench-\(UUID().uuidString)", isDirectory: true)
+      try FileManager.default.createDirectory(at: directory, withIntermediateDirectories: true)
+      fixtureDirectory = directory
+      dbPath = directory.appendingPathComponent("chat.db").path
+      try BenchmarkFixture.generate(at: dbPath, messages: fixture)
+    } else {
+      dbPath = try CommandSignatures.databasePath(from: values)
+    }
+
+    let store = try MessageStore(path: dbPath)
+    let results = try MessageStoreBenchmark(store: store, iterations: iterations).run()
+    let report = BenchmarkReport(
+      version: IMsgVersion.current,
+      database: dbPath,
+      messages: try store.maxRowID(),
+      results: results.map(BenchmarkPayload.init(result:))
+    )
+
+    if runtime.jsonOutput {
+      try JSONLines.print(report)
+    } else {
+      Swift.print("imsg \(report.version) bench: \(report.database) (max rowid \(report.messages))")
+      for result in report.results {
+        Swift.print(
+          "\(result.name): median=\(format(result.medianMs))ms p95=\(format(result.p95Ms))ms "
+            + "min=\(format(result.minMs))ms rows=\(result.rows)")
+      }
+    }
+
+    if let budget = values.optionInt("failOverMs") {
+      let slow = report.results.filter { $0.medianMs > Double(budget) }.map(\.name)
+      if !slow.isEmpty {
+        throw BenchError.tooSlow(slow)
+      }
+    }
+  }
+
+  private static func format(_ value: Double) -> String {
+    String(format: "%.1f", value)
+  }
+}
@@ -0,0 +1,167 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum BridgeCommand {
+  static let tokenEnvironmentKey = "IMSG_MATRIX_TOKEN"
+
+  static let spec = CommandSpec(
+    name: "bridge",
+    abstract: "Mirror chats into Matrix rooms and relay replies back",
+    discussion: """
+      `imsg bridge matrix` posts new messages from each --room chat into its Matrix room and
+      sends text that other room members post back through Messages. It is a Matrix client
+      that long-polls /sync, not an application service: there is no registration file and
+      no per-contact puppets. It logs in with a bot user's access token passed via --token or
+      $IMSG_MATRIX_TOKEN; invite that user to the rooms first. Messages are relayed as that
+      user with a "sender:" prefix. The sync position is saved in matrix-sync.json in the
+      state directory, so replies posted while the bridge was stopped are relayed when it
+      starts again; on the very first run, room history is not replayed. Relayed sends go
+      through the send journal.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        arguments: [.make(label: "network", help: "bridge to run (matrix)")],
+        options: CommandSignatures.baseOptions() + [
+          .make(
+            label: "homeserver", names: [.long("homeserver")],
+            help: "homeserver URL (e.g. https://matrix.example.org)"),
+          .make(
+            label: "token", names: [.long("token")],
+            help: "bot user's access token (default: $IMSG_MATRIX_TOKEN)"),
+          .make(
+            label: "room", names: [.long("room")],
+            help: "<chat-id>=<room-id> to bridge; repeatable"),
+          .make(
+            label: "debounce", names: [.long("debounce")],
+            help: "debounce interval for filesystem events (e.g. 250ms)"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg bridge matrix --homeserver https://matrix.example.org --room 1='!abc:example.org'",
+      "IMSG_MATRIX_TOKEN=syt_... imsg bridge matrix --homeserver https://matrix.org "
+        + "--room 1='!a:matrix.org' --room 7='!b:matrix.org'",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    environment: [String: String] = ProcessInfo.processInfo.environment
+  ) async throws {
+    guard values.argument(0) == "matrix" else {
+      throw ParsedValuesError.invalidOption("network")
+    }
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let homeserverRaw = try values.optionRequired("homeserver")
+    guard let homeserver = URL(string: homeserverRaw), homeserver.scheme?.hasPrefix("http") == true
+    else {
+      throw ParsedValuesError.invalidOption("homeserver")
+    }
+    guard let token = values.option("token") ?? environment[tokenEnvironmentKey], !token.isEmpty
+    else {
+      throw ParsedValuesError.missingOption("token")
+    }
+    let mappings = try values.optionValues("room").map(MatrixBridge.parseMapping)
+    guard !mappings.isEmpty else {
+      throw ParsedValuesError.missingOption("room")
+    }
+    let debounceString = values.option("debounce") ?? "250ms"
+    guard let debounceInterval = DurationParser.parse(debounceString) else {
+      throw ParsedValuesError.invalidOption("debounce")
+    }
+
+    let store = try storeFactory(dbPath)
+    var rooms: [MatrixBridge.Room] = []
+    for mapping in mappings {
+      guard let chat = try store.chatInfo(chatID: mapping.chatID) else {
+        throw ParsedValuesError.invalidOption("room")
+      }
+      rooms.append(MatrixBridge.Room(chat: chat, roomID: mapping.roomID))
+    }
+
+    let client = MatrixClient(homeserver: homeserver, token: token)
+    let ownUserID = try await client.whoami()
+    let position = try MatrixSyncPosition(homeserver: homeserver, userID: ownUserID)
+    let sender = MessageSender(logger: runtime.automationLogger)
+    let bridge = MatrixBridge(
+      client: client,
+      rooms: rooms,
+      journal: SendJournal(),
+      sendMessage: { try sender.send($0) }
+    )
+    let roomIDs = rooms.map(\.roomID)
+    let logger = runtime.automationLogger
+    let fields = ["command": "bridge"]
+    logger.log(
+      .info, "bridging \(rooms.count) chat\(pluralSuffix(for: rooms.count)) as \(ownUserID)",
+      fields: fields)
+
+    let muteList = try ChatMuteList()
+    let watcher = MessageWatcher(store: store)
+    let config = MessageWatcherConfiguration(debounceInterval: debounceInterval, batchLimit: 100)
+    try await withThrowingTaskGroup(of: Void.self) { group in
+      group.addTask {
+        var current = store
+        for try await event in watcher.events(configuration: config) {
+          switch event {
+          case .message(let message):
+            try muteList.reloadIfChanged()
+            if try muteList.isMuted(chatID: message.chatID, in: current) { continue }
+            do {
+              try await bridge.mirror(message, store: current)
+            } catch {
+              logger.log(error, "mirror of message \(message.rowID) failed", fields: fields)
+            }
+          case .reconnected(let reconnect):
+            current = reconnect.store
+            logger.log(
+              .info, "reopened database (\(reconnect.reason.rawValue))", fields: fields)
+          case .reaction, .edited, .deleted, .receipt, .heartbeat:
+            break
+          }
+        }
+      }
+      group.addTask {
+        var since: String
+        if let saved = position.since {
+          since = saved
+        } else {
+          // The first sync only fetches a position so older room history is not replayed.
+          since = try await client.sync(since: nil, timeout: 0, roomIDs: roomIDs).nextBatch
+          try position.save(since)
+        }
+        while !Task.isCancelled {
+          let batch: MatrixSyncBatch
+          do {
+            batch = try await client.sync(since: since, timeout: 30_000, roomIDs: roomIDs)
+          } catch {
+            logger.log(error, "sync failed, retrying in 5s", fields: fields)
+            try await Task.sleep(nanoseconds: 5_000_000_000)
+            continue
+          }
+          for event in batch.events {
+            do {
+              try await bridge.relay(event, ownUserID: ownUserID)
+            } catch {
+              logger.log(error, "relay of \(event.eventID) failed", fields: fields)
+            }
+          }
+          since = batch.nextBatch
+          do {
+            try position.save(since)
+          } catch {
+            logger.log(error, "could not save the sync position", fields: fields)
+          }
+        }
+      }
+      // Either side finishing (watch stream ended or an error) stops the bridge.
+      _ = try await group.next()
+      group.cancelAll()
+    }
+  }
+}
@@ -0,0 +1,105 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct CallPayload: Codable, Equatable {
+  let id: Int64
+  let handle: String
+  let name: String?
+  let type: String
+  let direction: String
+  let answered: Bool
+  let durationSeconds: Int
+  let createdAt: String
+
+  init(call: CallRecord) {
+    self.id = call.id
+    self.handle = call.handle
+    self.name = call.name.isEmpty ? nil : call.name
+    self.type = call.kind.rawValue
+    self.direction = call.isOutgoing ? "outgoing" : "incoming"
+    self.answered = call.answered
+    self.durationSeconds = Int(call.duration.rounded())
+    self.createdAt = CLIISO8601.format(call.date)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case id
+    case handle
+    case name
+    case type
+    case direction
+    case answered
+    case durationSeconds = "duration_seconds"
+    case createdAt = "created_at"
+  }
+}
+
+enum CallsCommand {
+  static let spec = CommandSpec(
+    name: "calls",
+    abstract: "List recent phone and FaceTime calls",
+    discussion: """
+      Reads the system call log (~/Library/Application Support/CallHistoryDB, or
+      --call-db), which includes calls synced from your iPhone. Like chat.db it needs Full
+      Disk Access. Missed incoming calls are marked missed; unanswered outgoing calls are
+      marked no answer.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: [
+          .make(label: "limit", names: [.long("limit")], help: "Number of calls to list"),
+          .make(
+            label: "with", names: [.long("with")],
+            help: "only calls with this phone number or email"),
+          .make(
+            label: "region", names: [.long("region")],
+            help: "default region for --with phone numbers (default US)"),
+          .make(
+            label: "callDB", names: [.long("call-db")],
+            help: "path to CallHistory.storedata"),
+        ] + TimestampFormatter.options()
+      )
+    ),
+    usageExamples: [
+      "imsg calls --limit 50",
+      "imsg calls --with +14155551212 --json",
+    ]
+  ) { values, runtime in
+    let limit = values.optionInt("limit") ?? 50
+    let timestamps = try TimestampFormatter.from(values: values)
+    let store = try CallHistoryStore(path: values.option("callDB") ?? CallHistoryStore.defaultPath)
+    let calls = try store.calls(
+      limit: max(limit, 1), handle: values.option("with"), region: values.option("region") ?? "US")
+
+    if runtime.jsonOutput {
+      for call in calls {
+        try JSONLines.print(CallPayload(call: call))
+      }
+      return
+    }
+    for call in calls {
+      Swift.print(textLine(for: call, timestamps: timestamps))
+    }
+  }
+
+  static func textLine(for call: CallRecord, timestamps: TimestampFormatter) -> String {
+    let direction = call.isOutgoing ? "out" : "in"
+    let who = call.name.isEmpty ? call.handle : "\(call.name) (\(call.handle))"
+    let outcome: String
+    if call.answered {
+      outcome = formatDuration(call.duration)
+    } else {
+      outcome = call.isOutgoing ? "no answer" : "missed"
+    }
+    return "\(timestamps.format(call.date)) [\(direction)] \(who) \(call.kind.label) \(outcome)"
+  }
+
+  /// `42s`, `3m12s`, `1h05m`.
+  static func formatDuration(_ duration: TimeInterval) -> String {
+    let seconds = Int(duration.rounded())
+    if seconds < 60 { return "\(seconds)s" }
+    if seconds < 3600 { return "\(seconds / 60)m\(String(format: "%02d", seconds % 60))s" }
+    return "\(seconds / 3600)h\(String(format: "%02d", seconds % 3600 / 60))m"
+  }
+}
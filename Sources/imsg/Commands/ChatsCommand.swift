@@ -6,34 +6,134 @@ enum ChatsCommand {
   static let spec = CommandSpec(
     name: "chats",
     abstract: "List recent conversations",
-    discussion: nil,
+    discussion: """
+      --search keeps chats whose display name, identifier or a participant's handle contains
+      the text, case-insensitively. --sort orders by last-message (default, newest first),
+      name, or message-count (most messages first; tapbacks aren't counted). Chats muted with
+      imsg mute are left out; --all lists them too, marked [muted] ("muted": true with --json).
+      """,
     signature: CommandSignatures.withRuntimeFlags(
       CommandSignature(
         options: CommandSignatures.baseOptions() + [
-          .make(label: "limit", names: [.long("limit")], help: "Number of chats to list")
+          .make(label: "limit", names: [.long("limit")], help: "Number of chats to list"),
+          .make(
+            label: "with", names: [.long("with")],
+            help: "only chats that include this phone number or email"),
+          .make(
+            label: "service", names: [.long("service")],
+            help: "only chats on service: imessage|sms"),
+          .make(
+            label: "region", names: [.long("region")],
+            help: "default region for --with phone numbers (default US)"),
+          .make(
+            label: "search", names: [.long("search")],
+            help: "only chats whose name, identifier or a participant contains this text"),
+          .make(
+            label: "sort", names: [.long("sort")],
+            help: "last-message (default), name, or message-count"),
+        ] + TimestampFormatter.options() + [OutputTemplate.option(), TabularFormat.option()],
+        flags: [
+          .make(label: "all", names: [.long("all")], help: "include chats muted with imsg mute")
         ]
       )
     ),
     usageExamples: [
       "imsg chats --limit 5",
       "imsg chats --limit 5 --json",
+      "imsg chats --limit 50 --format csv > chats.csv",
+      "imsg chats --with +14155551212 --service imessage",
+      "imsg chats --search mom",
+      "imsg chats --sort message-count --limit 10",
+      "imsg chats --template '{{.ID}} {{.Name}} ({{.Service}})'",
+      "imsg chats --all",
     ]
   ) { values, runtime in
-    let dbPath = values.option("db") ?? MessageStore.defaultPath
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    muteListFactory: () throws -> ChatMuteList = { try ChatMuteList() },
+    output: (String) -> Void = { Swift.print($0) }
+  ) throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
     let limit = values.optionInt("limit") ?? 20
+    let timestamps = try TimestampFormatter.from(values: values)
+    let tabular = try TabularFormat.from(values: values, runtime: runtime)
+    let template = try values.option("template").map {
+      try OutputTemplate($0, fields: OutputTemplate.chatFields)
+    }
+    var service: MessageService?
+    if let serviceRaw = values.option("service") {
+      guard let parsed = MessageService(rawValue: serviceRaw.lowercased()), parsed != .auto else {
+        throw IMsgError.invalidService(serviceRaw)
+      }
+      service = parsed
+    }
+    var sort = ChatSortOrder.lastMessage
+    if let sortRaw = values.option("sort") {
+      guard let parsed = ChatSortOrder(rawValue: sortRaw.lowercased()) else {
+        throw ParsedValuesError.invalidOption("sort")
+      }
+      sort = parsed
+    }
+    let search = values.option("search").flatMap { $0.isEmpty ? nil : $0 }
     let store = try MessageStore(path: dbPath)
-    let chats = try store.listChats(limit: limit)
+    let muteList = try muteListFactory()
+    let showMuted = values.flag("all")
+    // Ask for enough extra rows that hiding muted chats still fills the limit.
+    var chats = try store.listChats(
+      limit: showMuted ? limit : limit + muteList.entries.count,
+      participant: values.option("with"),
+      service: service,
+      region: values.option("region") ?? "US",
+      matching: search,
+      sort: sort
+    )
+    var muted = Set<Int64>()
+    for chat in chats {
+      if try muteList.isMuted(chatID: chat.id, in: store) {
+        muted.insert(chat.id)
+      }
+    }
+    if !showMuted {
+      chats = Array(chats.filter { !muted.contains($0.id) }.prefix(limit))
+    }
 
     if runtime.jsonOutput {
       for chat in chats {
-        try JSONLines.print(ChatPayload(chat: chat))
+        var payload = ChatPayload(chat: chat)
+        payload.muted = muted.contains(chat.id) ? true : nil
+        output(try JSONLines.encode(payload))
       }
       return
     }
+    if let tabular {
+      tabular.print(header: TabularRows.chatHeader, rows: chats.map(TabularRows.chat))
+      return
+    }
 
     for chat in chats {
-      let last = CLIISO8601.format(chat.lastMessageAt)
-      Swift.print("[\(chat.id)] \(chat.name) (\(chat.identifier)) last=\(last)")
+      let last = timestamps.format(chat.lastMessageAt)
+      if let template {
+        output(
+          template.render { field in
+            switch field {
+            case "ID": return String(chat.id)
+            case "Name": return chat.name
+            case "Identifier": return chat.identifier
+            case "Service": return chat.service
+            case "MessageCount": return String(chat.messageCount)
+            default: return last
+            }
+          })
+        continue
+      }
+      let mark = muted.contains(chat.id) ? " [muted]" : ""
+      output(
+        "[\(chat.id)] \(chat.name) (\(displayHandle(chat.identifier))) last=\(last) "
+          + "messages=\(chat.messageCount)\(mark)")
     }
   }
 }
@@ -0,0 +1,60 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum CompletionsCommand {
+  static let spec = CommandSpec(
+    name: "completions",
+    abstract: "Print a shell completion script (bash, zsh, fish)",
+    discussion: """
+      Completes commands and options, and completes --chat-id, --chat-identifier, --chat-guid,
+      --participants, --with, and --to from your chat.db (or the --db already on the command
+      line) each time you press tab.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        arguments: [.make(label: "shell", help: "bash|zsh|fish")]
+      )
+    ),
+    usageExamples: [
+      "source <(imsg completions bash)",
+      "imsg completions zsh > \"${fpath[1]}/_imsg\"",
+      "imsg completions fish > ~/.config/fish/completions/imsg.fish",
+    ]
+  ) { values, _ in
+    guard let raw = values.argument(0), let shell = ShellCompletion.Shell(rawValue: raw) else {
+      throw ParsedValuesError.invalidOption("shell")
+    }
+    let router = CommandRouter()
+    Swift.print(
+      ShellCompletion.script(for: shell, rootName: router.rootName, specs: router.specs),
+      terminator: "")
+  }
+}
+
+/// Backs the dynamic parts of the completion scripts; prints `value<TAB>description` lines.
+enum CompleteCommand {
+  static let spec = CommandSpec(
+    name: "__complete",
+    abstract: "List completion candidates from chat.db",
+    discussion: nil,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        arguments: [.make(label: "kind", help: "chat-id|chat-identifier|chat-guid|handle")],
+        options: CommandSignatures.baseOptions()
+      )
+    ),
+    usageExamples: [
+      "imsg __complete chat-id"
+    ],
+    isHidden: true
+  ) { values, _ in
+    guard let raw = values.argument(0), let source = ShellCompletion.Source(rawValue: raw) else {
+      throw ParsedValuesError.invalidOption("kind")
+    }
+    let store = try MessageStore(path: try CommandSignatures.databasePath(from: values))
+    for line in try ShellCompletion.candidates(source, store: store) {
+      Swift.print(line)
+    }
+  }
+}
@@ -0,0 +1,115 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct ContextTurnPayload: Codable, Equatable {
+  let role: String
+  let name: String?
+  let content: String
+  let createdAt: String
+
+  enum CodingKeys: String, CodingKey {
+    case role
+    case name
+    case content
+    case createdAt = "created_at"
+  }
+}
+
+struct ContextPayload: Codable, Equatable {
+  let chatID: Int64
+  let estimatedTokens: Int
+  let messages: [ContextTurnPayload]
+
+  init(chatID: Int64, context: ConversationContext) {
+    self.chatID = chatID
+    self.estimatedTokens = context.estimatedTokens
+    self.messages = context.turns.map { turn in
+      ContextTurnPayload(
+        role: ConversationContext.role(for: turn),
+        name: turn.isFromMe || turn.sender.isEmpty ? nil : turn.sender,
+        content: turn.content,
+        createdAt: CLIISO8601.format(turn.date))
+    }
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case chatID = "chat_id"
+    case estimatedTokens = "estimated_tokens"
+    case messages
+  }
+}
+
+enum ContextCommand {
+  static let spec = CommandSpec(
+    name: "context",
+    abstract: "Print the recent conversation trimmed to a token budget for an LLM prompt",
+    discussion: """
+      Emits the newest messages of a chat, oldest first, that fit in --tokens (default 4000,
+      estimated at about four characters per token). --format plain labels lines me: and
+      them: (them (+1555...): in group chats); --format chatml wraps each message in
+      <|im_start|>/<|im_end|> with your messages as the assistant role and everyone else's
+      as user. --json prints OpenAI-style {role, name, content} messages instead.
+      Attachments show as [attachment]; tapbacks are left out.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "chatID", names: [.long("chat-id")], help: "chat rowid from 'imsg chats'"),
+          .make(
+            label: "tokens", names: [.long("tokens")],
+            help: "token budget for the output (default 4000)"),
+          .make(
+            label: "format", names: [.long("format")], help: "plain|chatml (default plain)"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg context --chat-id 1 --tokens 4000",
+      "imsg context --chat-id 1 --tokens 2000 --format chatml | llm -s 'Draft my reply'",
+      "imsg context --chat-id 1 --json | jq '.messages'",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) }
+  ) throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    var tokens = 4000
+    if values.option("tokens") != nil {
+      guard let parsed = values.optionInt("tokens"), parsed > 0 else {
+        throw ParsedValuesError.invalidOption("tokens")
+      }
+      tokens = parsed
+    }
+    let formatRaw = values.option("format") ?? ConversationContext.Format.plain.rawValue
+    guard let format = ConversationContext.Format(rawValue: formatRaw.lowercased()) else {
+      throw ParsedValuesError.invalidOption("format")
+    }
+
+    let store = try storeFactory(dbPath)
+    let chatID = try ChatPicker.chatID(from: values, store: store)
+    guard let chat = try store.chatInfo(chatID: chatID) else {
+      throw IMsgError.invalidChatTarget("Unknown chat id \(chatID)")
+    }
+    // Every turn costs at least the role overhead, so this many messages always fill the budget.
+    let limit = tokens / ConversationContext.turnOverhead + 1
+    let context = ConversationContext(
+      messages: try store.messages(chatID: chatID, limit: limit),
+      isGroup: isGroupHandle(identifier: chat.identifier, guid: chat.guid),
+      tokens: tokens)
+
+    if runtime.jsonOutput {
+      try JSONLines.print(ContextPayload(chatID: chatID, context: context))
+      return
+    }
+    let rendered = context.render(format)
+    if !rendered.isEmpty {
+      Swift.print(rendered)
+    }
+  }
+}
@@ -0,0 +1,124 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct DeletedMessagePayload: Codable, Equatable {
+  let id: Int64
+  let chatID: Int64
+  let guid: String
+  let sender: String
+  let isFromMe: Bool
+  let text: String
+  let attachments: Int
+  let createdAt: String
+  let deletedAt: String
+  let expiresAt: String
+  let remainingSeconds: Int
+
+  init(deleted: RecoverableMessage, now: Date) {
+    let message = deleted.message
+    self.id = message.rowID
+    self.chatID = message.chatID
+    self.guid = message.guid
+    self.sender = message.sender
+    self.isFromMe = message.isFromMe
+    self.text = message.text
+    self.attachments = message.attachmentsCount
+    self.createdAt = CLIISO8601.format(message.date)
+    self.deletedAt = CLIISO8601.format(deleted.deletedAt)
+    self.expiresAt = CLIISO8601.format(deleted.expiresAt)
+    self.remainingSeconds = Int(deleted.remaining(at: now))
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case id
+    case chatID = "chat_id"
+    case guid
+    case sender
+    case isFromMe = "is_from_me"
+    case text
+    case attachments
+    case createdAt = "created_at"
+    case deletedAt = "deleted_at"
+    case expiresAt = "expires_at"
+    case remainingSeconds = "remaining_seconds"
+  }
+}
+
+enum DeletedCommand {
+  static let spec = CommandSpec(
+    name: "deleted",
+    abstract: "List messages in Recently Deleted",
+    discussion: """
+      Messages keeps deleted conversations and messages in Recently Deleted for about 30
+      days, where they can still be recovered from the Messages app. This lists them, newest
+      deletion first, with when each was deleted and how long is left before Messages purges
+      it (Apple says up to 40 days in some cases, so an expired one may linger). --chat-id
+      keeps one chat. Needs macOS 13 or later; older chat.db files have no Recently Deleted.
+      Messages the sender unsent are not here; watch --events delete reports those.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "chatID", names: [.long("chat-id")], help: "only this chat"),
+          .make(label: "limit", names: [.long("limit")], help: "Number of messages (default 50)"),
+        ] + TimestampFormatter.options()
+      )
+    ),
+    usageExamples: [
+      "imsg deleted",
+      "imsg deleted --chat-id 7 --json",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    now: () -> Date = Date.init
+  ) throws {
+    let limit = values.optionInt("limit") ?? 50
+    guard limit > 0 else {
+      throw ParsedValuesError.invalidOption("limit")
+    }
+    let timestamps = try TimestampFormatter.from(values: values)
+    let store = try storeFactory(try CommandSignatures.databasePath(from: values))
+    let deleted = try store.recoverableMessages(chatID: values.optionInt64("chatID"), limit: limit)
+    let current = now()
+    if runtime.jsonOutput {
+      for item in deleted {
+        try JSONLines.print(DeletedMessagePayload(deleted: item, now: current))
+      }
+      return
+    }
+    if deleted.isEmpty {
+      Swift.print("nothing in Recently Deleted")
+      return
+    }
+    for item in deleted {
+      let message = item.message
+      let sender = message.isFromMe ? "me" : displayHandle(message.sender)
+      var text = TextTruncation.truncate(message.text, to: 80)
+      let count = message.attachmentsCount
+      if count > 0 {
+        text += " [\(count) attachment\(pluralSuffix(for: count))]"
+      }
+      Swift.print(
+        "\(timestamps.format(message.date)) chat=\(message.chatID) \(bidiIsolated(sender)): "
+          + "\(bidiIsolated(text))")
+      let remaining = remainingText(item.remaining(at: current))
+      Swift.print("  deleted \(timestamps.format(item.deletedAt)), \(remaining)")
+    }
+  }
+
+  /// `12 days left`, `5 hours left`, or `expired` once the window has passed.
+  static func remainingText(_ seconds: TimeInterval) -> String {
+    if seconds <= 0 { return "expired" }
+    let days = Int(seconds / 86_400)
+    if days > 0 { return "\(days) day\(pluralSuffix(for: days)) left" }
+    let hours = max(1, Int(seconds / 3_600))
+    return "\(hours) hour\(pluralSuffix(for: hours)) left"
+  }
+}
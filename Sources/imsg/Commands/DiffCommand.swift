@@ -0,0 +1,202 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct MessageKeyPayload: Codable, Equatable {
+  let guid: String
+  let id: Int64
+  let chatID: Int64?
+  let chatGUID: String?
+  let createdAt: String
+
+  init(key: MessageKey) {
+    self.guid = key.guid
+    self.id = key.rowID
+    self.chatID = key.chatID == 0 ? nil : key.chatID
+    self.chatGUID = key.chatGUID.isEmpty ? nil : key.chatGUID
+    self.createdAt = CLIISO8601.format(key.date)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case guid
+    case id
+    case chatID = "chat_id"
+    case chatGUID = "chat_guid"
+    case createdAt = "created_at"
+  }
+}
+
+struct DiffReport: Codable {
+  let db: String
+  let db2: String
+  let common: Int
+  /// Rowids and chat ids are each side's own.
+  let onlyInDB: [MessageKeyPayload]
+  let onlyInDB2: [MessageKeyPayload]
+  /// Set with --out.
+  var exported: ExportResult?
+
+  init(db: String, db2: String, diff: MessageDatabaseDiff) {
+    self.db = db
+    self.db2 = db2
+    self.common = diff.common
+    self.onlyInDB = diff.onlyInFirst.map(MessageKeyPayload.init)
+    self.onlyInDB2 = diff.onlyInSecond.map(MessageKeyPayload.init)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case db
+    case db2
+    case common
+    case onlyInDB = "only_in_db"
+    case onlyInDB2 = "only_in_db2"
+    case exported
+  }
+}
+
+enum DiffCommand {
+  static let spec = CommandSpec(
+    name: "diff",
+    abstract: "Compare two chat.db files by message guid",
+    discussion: """
+      Reports the messages one database has and the other lacks, e.g. a laptop's chat.db
+      against a desktop's copy, or the live database against a backup, to diagnose messages
+      lost in iCloud sync. Messages are matched by guid, which is the same on every device;
+      rowids are not. --chat-guid compares one conversation. --out writes the messages only
+      in --db (the ones --db2 is missing) to a portable SQLite archive, as export --format
+      sqlite does; swap --db and --db2 for the other direction. Tapbacks are compared like
+      messages; in the archive they appear as reactions on the messages they belong to.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "db2", names: [.long("db2")], help: "chat.db to compare against"),
+          .make(
+            label: "chatGUID", names: [.long("chat-guid")],
+            help: "only compare this chat (guid, e.g. iMessage;-;+15551234567)"),
+          .make(
+            label: "limit", names: [.long("limit")],
+            help: "messages to list per side (default 20; --json lists all)"),
+          .make(
+            label: "out", names: [.long("out")],
+            help: "write the messages --db2 is missing to this archive"),
+        ] + TimestampFormatter.options()
+      )
+    ),
+    usageExamples: [
+      "imsg diff --db ~/Desktop/laptop-chat.db --db2 ~/Library/Messages/chat.db",
+      "imsg diff --db-backup ~/Backups/iPhone --db2 ~/Library/Messages/chat.db --out lost.db",
+      "imsg diff --db2 ~/old/chat.db --chat-guid 'iMessage;-;+15551234567' --json",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) }
+  ) throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    guard let raw = values.option("db2") else {
+      throw ParsedValuesError.missingOption("db2")
+    }
+    let db2Path = NSString(string: raw).expandingTildeInPath
+    var limit = 20
+    if values.option("limit") != nil {
+      guard let parsed = values.optionInt("limit"), parsed >= 0 else {
+        throw ParsedValuesError.invalidOption("limit")
+      }
+      limit = parsed
+    }
+    let timestamps = try TimestampFormatter.from(values: values)
+    let store = try storeFactory(dbPath)
+    let store2 = try storeFactory(db2Path)
+    let diff = try MessageStore.diff(store, store2, chatGUID: values.option("chatGUID"))
+
+    var report = DiffReport(db: store.path, db2: store2.path, diff: diff)
+    if let out = values.option("out") {
+      let path = NSString(string: out).expandingTildeInPath
+      let written = try exportMissing(diff.onlyInFirst, from: store, to: path)
+      report.exported = ExportResult(
+        path: path, format: ExportFormat.sqlite.rawValue, chatID: nil, chats: written.chats,
+        messages: written.messages)
+    }
+    if runtime.jsonOutput {
+      try JSONLines.print(report)
+      return
+    }
+
+    let name = URL(fileURLWithPath: report.db).lastPathComponent
+    let name2 = URL(fileURLWithPath: report.db2).lastPathComponent
+    Swift.print(
+      "\(report.db): \(diff.common + diff.onlyInFirst.count) messages; \(report.db2): "
+        + "\(diff.common + diff.onlyInSecond.count) messages; \(diff.common) in both")
+    try printMissing(
+      "only in \(name)", diff.onlyInFirst, store: store, limit: limit, timestamps: timestamps)
+    try printMissing(
+      "only in \(name2)", diff.onlyInSecond, store: store2, limit: limit, timestamps: timestamps)
+    if let exported = report.exported {
+      Swift.print(
+        "exported \(exported.messages) messages from \(exported.chats ?? 0) chat"
+          + "\(pluralSuffix(for: exported.chats ?? 0)) missing from \(name2) to \(exported.path)")
+    }
+  }
+
+  /// Writes the messages behind `keys` to a portable archive. Tapbacks and messages in no chat
+  /// are skipped; the archive keeps tapbacks as reactions of their messages. The archive is
+  /// built beside `path` and replaces a file there only once it is complete.
+  static func exportMissing(_ keys: [MessageKey], from store: MessageStore, to path: String)
+    throws -> (chats: Int, messages: Int)
+  {
+    try PartialFile.write(to: URL(fileURLWithPath: path)) { partialURL in
+      try writeMissing(keys, from: store, to: partialURL.path)
+    }
+  }
+
+  private static func writeMissing(_ keys: [MessageKey], from store: MessageStore, to path: String)
+    throws -> (chats: Int, messages: Int)
+  {
+    let archive = try PortableArchive(
+      path: path, includeBlobs: false, generator: "imsg \(IMsgVersion.current)")
+    var chats = 0
+    let byChat = Dictionary(grouping: keys.filter { $0.chatID != 0 && !$0.isTapback }, by: \.chatID)
+    for (chatID, chatKeys) in byChat.sorted(by: { $0.key < $1.key }) {
+      guard let chat = try store.chatInfo(chatID: chatID) else { continue }
+      try archive.add(
+        chat: chat, isGroup: isGroupHandle(identifier: chat.identifier, guid: chat.guid),
+        participants: try store.participants(chatID: chatID))
+      chats += 1
+      for start in stride(from: 0, to: chatKeys.count, by: 500) {
+        let entries = try chatKeys[start..<min(start + 500, chatKeys.count)].compactMap { key in
+          try store.message(rowID: key.rowID).map {
+            PortableArchive.Entry(
+              message: $0, attachments: try store.attachments(for: key.rowID),
+              reactions: try store.reactions(for: key.rowID))
+          }
+        }
+        try archive.add(entries: entries, chatID: chatID)
+      }
+    }
+    return (chats, archive.messageCount)
+  }
+
+  private static func printMissing(
+    _ title: String, _ keys: [MessageKey], store: MessageStore, limit: Int,
+    timestamps: TimestampFormatter
+  ) throws {
+    Swift.print("\(title): \(keys.count)")
+    for key in keys.prefix(limit) {
+      let message = try store.message(rowID: key.rowID)
+      let sender = message.map { $0.isFromMe ? "me" : $0.sender } ?? ""
+      let text = message.map { displayText(for: $0) } ?? ""
+      let chat = key.chatGUID.isEmpty ? "no chat" : key.chatGUID
+      Swift.print(
+        "  \(timestamps.format(key.date)) [\(chat)] \(bidiIsolated(sender)): "
+          + "\(bidiIsolated(text)) (\(key.guid))")
+    }
+    if keys.count > limit {
+      Swift.print("  … \(keys.count - limit) more (use --json for the full list)")
+    }
+  }
+}
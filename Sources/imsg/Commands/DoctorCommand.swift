@@ -0,0 +1,403 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct DoctorCheck: Codable, Equatable {
+  enum Status: String, Codable {
+    case ok
+    case warn
+    case fail
+  }
+
+  let name: String
+  let status: Status
+  let detail: String
+  let remediation: [String]
+
+  init(name: String, status: Status, detail: String, remediation: [String] = []) {
+    self.name = name
+    self.status = status
+    self.detail = detail
+    self.remediation = remediation
+  }
+}
+
+struct DoctorReport: Codable {
+  let ok: Bool
+  let checks: [DoctorCheck]
+
+  init(checks: [DoctorCheck]) {
+    self.ok = !checks.contains { $0.status == .fail }
+    self.checks = checks
+  }
+}
+
+enum DoctorError: Error, CustomStringConvertible {
+  case checksFailed(Int)
+
+  var description: String {
+    switch self {
+    case .checksFailed(let count):
+      return "doctor: \(count) check\(pluralSuffix(for: count)) failed"
+    }
+  }
+}
+
+enum DoctorCommand {
+  static let spec = CommandSpec(
+    name: "doctor",
+    abstract: "Check permissions and database access",
+    discussion: """
+      Verifies Full Disk Access to chat.db, Automation permission for Messages.app,
+      that Messages is signed in, and reports the database schema version.
+      --check-wal also inspects chat.db-wal/-shm: unreadable or missing files hide the newest
+      messages, and a WAL Messages hasn't checkpointed in a while is reported as lag.
+      --integrity runs SQLite's integrity_check and cross-checks the database: messages no
+      chat links to, join rows pointing at deleted messages, chats or attachments, messages
+      with unknown handles, attachment files missing from disk, and gaps in message rowids.
+      Gaps alone are normal (deleted messages leave them); a rowid sequence past the newest
+      message means recent messages were lost. It reads every row, so it can take a while.
+      Failed checks include remediation steps.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions(),
+        flags: [
+          .make(
+            label: "checkWAL", names: [.long("check-wal")],
+            help: "also check chat.db-wal/-shm access and checkpoint lag"),
+          .make(
+            label: "integrity", names: [.long("integrity")],
+            help: "also run integrity_check and look for broken joins and missing files"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg doctor",
+      "imsg doctor --json",
+      "imsg doctor --check-wal",
+      "imsg doctor --integrity --json",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    automationStatus: @escaping () -> AutomationPermissionStatus = {
+      MessagesAutomation.permissionStatus()
+    },
+    enabledServiceCount: @escaping () throws -> Int = {
+      try MessagesAutomation.enabledServiceCount()
+    },
+    output: (String) -> Void = { Swift.print($0) }
+  ) async throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let automation = automationStatus()
+    var checks = databaseChecks(path: dbPath)
+    if values.flag("checkWAL") {
+      checks += walChecks(status: DatabaseWAL.inspect(path: dbPath))
+    }
+    if values.flag("integrity") {
+      do {
+        let store = try MessageStore(path: NSString(string: dbPath).expandingTildeInPath)
+        checks += integrityChecks(report: try store.integrityReport())
+      } catch {
+        checks.append(
+          DoctorCheck(
+            name: "integrity", status: .fail, detail: "cannot check: \(error)",
+            remediation: fullDiskAccessSteps))
+      }
+    }
+    checks.append(automationCheck(status: automation))
+    checks.append(signedInCheck(automation: automation, enabledServiceCount: enabledServiceCount))
+    let report = DoctorReport(checks: checks)
+
+    if runtime.jsonOutput {
+      output(try JSONLines.encode(report))
+    } else {
+      for check in report.checks {
+        output("[\(check.status.rawValue)] \(check.name): \(check.detail)")
+        for step in check.remediation {
+          output("  - \(step)")
+        }
+      }
+    }
+
+    let failures = report.checks.filter { $0.status == .fail }.count
+    if failures > 0 {
+      throw DoctorError.checksFailed(failures)
+    }
+  }
+
+  static func databaseChecks(path: String) -> [DoctorCheck] {
+    let expanded = NSString(string: path).expandingTildeInPath
+    guard FileManager.default.fileExists(atPath: expanded) else {
+      return [
+        DoctorCheck(
+          name: "database",
+          status: .fail,
+          detail: "not found at \(expanded)",
+          remediation: [
+            "Open Messages.app and sign in so the database is created.",
+            "Pass --db if your chat.db lives somewhere else.",
+          ]
+        )
+      ]
+    }
+
+    let store: MessageStore
+    let maxRowID: Int64
+    do {
+      store = try MessageStore(path: expanded)
+      maxRowID = try store.maxRowID()
+    } catch {
+      return [
+        DoctorCheck(
+          name: "database",
+          status: .fail,
+          detail: "cannot read \(expanded)",
+          remediation: fullDiskAccessSteps
+        )
+      ]
+    }
+
+    var checks = [
+      DoctorCheck(name: "database", status: .ok, detail: "readable (max rowid \(maxRowID))")
+    ]
+    if let version = try? store.schemaVersion() {
+      checks.append(DoctorCheck(name: "schema", status: .ok, detail: "version \(version)"))
+    } else {
+      checks.append(
+        DoctorCheck(
+          name: "schema",
+          status: .warn,
+          detail: "schema version not recorded",
+          remediation: ["Output may be incomplete if this is not a Messages database."]
+        ))
+    }
+    return checks
+  }
+
+  static func walChecks(status: WALStatus) -> [DoctorCheck] {
+    if status.isWAL == false {
+      return [DoctorCheck(name: "wal", status: .ok, detail: "rollback journal (no WAL in use)")]
+    }
+    let size = ByteCountFormatter.string(fromByteCount: status.walBytes, countStyle: .file)
+    guard !status.issues.isEmpty else {
+      let pending = status.pendingFrames ?? status.walFrames
+      let detail =
+        status.walBytes > 0 && pending > 0
+        ? "readable (\(pending) frame\(pluralSuffix(for: Int(pending))) to checkpoint, \(size))"
+        : "readable (fully checkpointed)"
+      return [DoctorCheck(name: "wal", status: .ok, detail: detail)]
+    }
+    return status.issues.map { issue in
+      switch issue {
+      case .walUnreadable:
+        return DoctorCheck(
+          name: "wal",
+          status: .fail,
+          detail: "chat.db-wal is not readable; the newest messages are missing",
+          remediation: fullDiskAccessSteps + ["Check ownership with: ls -l ~/Library/Messages"]
+        )
+      case .shmUnreadable:
+        return DoctorCheck(
+          name: "wal",
+          status: .fail,
+          detail: "chat.db-shm is not readable; SQLite cannot read the WAL",
+          remediation: fullDiskAccessSteps + ["Check ownership with: ls -l ~/Library/Messages"]
+        )
+      case .shmMissing:
+        return DoctorCheck(
+          name: "wal",
+          status: .fail,
+          detail: "chat.db-shm is missing and cannot be created read-only",
+          remediation: [
+            "Open Messages.app; it recreates chat.db-shm.",
+            "For a copied database, copy chat.db-wal and chat.db-shm next to it in a writable "
+              + "directory.",
+          ]
+        )
+      case .checkpointLag(let frames):
+        return DoctorCheck(
+          name: "wal",
+          status: .warn,
+          detail: "\(frames) frames not checkpointed; imsg reads them, "
+            + "but copies of chat.db without its -wal file miss recent messages",
+          remediation: [
+            "Quit and reopen Messages.app so it checkpoints the WAL.",
+            "Back up chat.db together with chat.db-wal and chat.db-shm.",
+          ]
+        )
+      }
+    }
+  }
+
+  static func integrityChecks(report: DatabaseIntegrity) -> [DoctorCheck] {
+    var checks: [DoctorCheck] = []
+    if report.integrityErrors.isEmpty {
+      checks.append(DoctorCheck(name: "integrity", status: .ok, detail: "integrity_check ok"))
+    } else {
+      let count = report.integrityErrors.count
+      checks.append(
+        DoctorCheck(
+          name: "integrity",
+          status: .fail,
+          detail: "\(count) problem\(pluralSuffix(for: count)) found: "
+            + report.integrityErrors.prefix(3).joined(separator: "; "),
+          remediation: rebuildSteps
+        ))
+    }
+
+    var broken: [String] = []
+    func note(_ count: Int, _ what: String) {
+      if count > 0 { broken.append("\(count) \(what)") }
+    }
+    note(report.messagesWithoutChat, "messages without a chat")
+    note(report.danglingChatMessageJoins, "chat joins to missing messages or chats")
+    note(report.danglingAttachmentJoins, "attachment joins to missing messages or attachments")
+    note(report.messagesWithMissingHandle, "messages with an unknown handle")
+    checks.append(
+      broken.isEmpty
+        ? DoctorCheck(name: "joins", status: .ok, detail: "every message belongs to a chat")
+        : DoctorCheck(
+          name: "joins", status: .warn, detail: broken.joined(separator: ", "),
+          remediation: [
+            "imsg skips these rows; a few are harmless leftovers of deleted conversations.",
+            "Many of them alongside missing history point to a damaged database.",
+          ] + rebuildSteps))
+
+    let missing = report.attachmentsMissingFile
+    if missing == 0 {
+      checks.append(
+        DoctorCheck(
+          name: "attachment files", status: .ok,
+          detail: "all \(report.attachmentsWithFile) on disk"))
+    } else {
+      let inCloud = report.attachmentsMissingFileInCloud
+      checks.append(
+        DoctorCheck(
+          name: "attachment files",
+          status: .warn,
+          detail: "\(missing) of \(report.attachmentsWithFile) missing from disk, "
+            + "\(inCloud) of them kept in iCloud",
+          remediation: [
+            "Files kept in iCloud download when you open the conversation in Messages.",
+            "Others are gone unless a backup or another device still has them.",
+          ]))
+    }
+
+    var rowids = "\(report.messageCount) messages, rowids \(report.minRowID)-\(report.maxRowID)"
+    if report.missingRowIDs > 0 {
+      rowids += ", \(report.missingRowIDs) unused"
+      if let gap = report.largestGap {
+        rowids += " (largest gap \(gap.missing) after \(gap.after))"
+      }
+    }
+    if report.sequenceAhead, let sequence = report.rowIDSequence {
+      checks.append(
+        DoctorCheck(
+          name: "rowids",
+          status: .warn,
+          detail: rowids + "; rowids up to \(sequence) were handed out, so the newest "
+            + "\(sequence - report.maxRowID) are gone",
+          remediation: [
+            "Deleting your latest messages also does this; otherwise recent history was lost."
+          ] + rebuildSteps))
+    } else {
+      checks.append(DoctorCheck(name: "rowids", status: .ok, detail: rowids))
+    }
+    return checks
+  }
+
+  static func automationCheck(status: AutomationPermissionStatus) -> DoctorCheck {
+    switch status {
+    case .granted:
+      return DoctorCheck(name: "automation", status: .ok, detail: "Messages automation allowed")
+    case .denied:
+      return DoctorCheck(
+        name: "automation",
+        status: .fail,
+        detail: "Messages automation denied",
+        remediation: automationSteps
+      )
+    case .notDetermined:
+      return DoctorCheck(
+        name: "automation",
+        status: .warn,
+        detail: "not requested yet; the first send will prompt",
+        remediation: ["Run a test send and click OK on the Automation prompt."]
+      )
+    case .appNotRunning:
+      return DoctorCheck(
+        name: "automation",
+        status: .warn,
+        detail: "Messages.app is not running",
+        remediation: ["Open Messages.app and run imsg doctor again."]
+      )
+    case .unknown:
+      return DoctorCheck(
+        name: "automation",
+        status: .warn,
+        detail: "unable to determine permission",
+        remediation: automationSteps
+      )
+    }
+  }
+
+  static func signedInCheck(
+    automation: AutomationPermissionStatus,
+    enabledServiceCount: () throws -> Int
+  ) -> DoctorCheck {
+    guard automation == .granted else {
+      return DoctorCheck(
+        name: "account",
+        status: .warn,
+        detail: "skipped (needs Automation permission)"
+      )
+    }
+    do {
+      let count = try enabledServiceCount()
+      if count > 0 {
+        return DoctorCheck(
+          name: "account",
+          status: .ok,
+          detail: "\(count) enabled service\(pluralSuffix(for: count))"
+        )
+      }
+      return DoctorCheck(
+        name: "account",
+        status: .fail,
+        detail: "Messages is not signed in",
+        remediation: ["Open Messages → Settings → iMessage and sign in with your Apple ID."]
+      )
+    } catch {
+      return DoctorCheck(
+        name: "account",
+        status: .warn,
+        detail: "unable to query Messages: \(error.localizedDescription)"
+      )
+    }
+  }
+
+  private static let fullDiskAccessSteps = [
+    "Open System Settings → Privacy & Security → Full Disk Access.",
+    "Add your terminal application (Terminal.app, iTerm, etc.).",
+    "Restart the terminal and run imsg doctor again.",
+  ]
+
+  private static let rebuildSteps = [
+    "Quit Messages and back up ~/Library/Messages before changing anything.",
+    "With Messages in iCloud on, move chat.db* aside and reopen Messages to rebuild it "
+      + "from iCloud.",
+    "Without iCloud, restore ~/Library/Messages from a Time Machine backup.",
+  ]
+
+  private static let automationSteps = [
+    "Open System Settings → Privacy & Security → Automation.",
+    "Enable Messages under your terminal application.",
+    "Or reset with: tccutil reset AppleEvents",
+  ]
+}
@@ -0,0 +1,107 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct CalendarEventPayload: Codable, Equatable {
+  let uid: String
+  let summary: String
+  let start: String
+  let end: String
+  let allDay: Bool
+  let location: String?
+  let source: String
+  let messageID: Int64
+  let messageGUID: String
+
+  init(event: CalendarEvent) {
+    self.uid = event.uid
+    self.summary = event.summary
+    self.start = CLIISO8601.format(event.start)
+    self.end = CLIISO8601.format(event.end)
+    self.allDay = event.allDay
+    self.location = event.location
+    self.source = event.source.rawValue
+    self.messageID = event.messageRowID
+    self.messageGUID = event.messageGUID
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case uid
+    case summary
+    case start
+    case end
+    case allDay = "all_day"
+    case location
+    case source
+    case messageID = "message_id"
+    case messageGUID = "message_guid"
+  }
+}
+
+enum EventsCommand {
+  static let spec = CommandSpec(
+    name: "events",
+    abstract: "Extract candidate calendar events from a chat as ICS",
+    discussion: """
+      Looks through the last --limit messages of a chat (default 500) for plans: attached
+      .ics files are passed through, and messages naming a time ("dinner Friday at 7") or a
+      date alongside a plan word ("flight on Oct 24") become one-hour or all-day events.
+      Weekdays and words like "tomorrow" count from the day the message was sent; bare hours
+      are read as afternoon or evening unless the message mentions the morning. Prints one
+      VCALENDAR on stdout, or one event per line with --json. These are guesses; review them
+      before importing.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "chatID", names: [.long("chat-id")], help: "chat rowid from 'imsg chats'"),
+          .make(
+            label: "limit", names: [.long("limit")],
+            help: "number of recent messages to look through (default 500)"),
+        ] + MessageFilterOptions.options()
+      )
+    ),
+    usageExamples: [
+      "imsg events --chat-id 1 > plans.ics",
+      "imsg events --chat-id 1 --start 2026-10-01T00:00:00Z --json",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    calendar: Calendar = .current
+  ) throws {
+    guard let chatID = values.optionInt64("chatID") else {
+      throw ParsedValuesError.missingOption("chat-id")
+    }
+    let limit = values.optionInt("limit") ?? 500
+    let filter = try MessageFilterOptions.filter(from: values)
+    let store = try storeFactory(try CommandSignatures.databasePath(from: values))
+
+    var events: [CalendarEvent] = []
+    try store.scanMessages(
+      chatID: chatID, limit: limit, order: .oldestFirst, dateRange: filter.dateRange,
+      handleIDs: try store.senderHandleIDs(for: filter)
+    ) { batch in
+      let messages = batch.filter { filter.allows($0) }
+      let attachments = try store.attachments(
+        forMessageIDs: messages.filter { $0.attachmentsCount > 0 }.map(\.rowID))
+      for message in messages {
+        events += CalendarEventExtractor.events(
+          in: message, attachments: attachments[message.rowID] ?? [], calendar: calendar)
+      }
+    }
+
+    if runtime.jsonOutput {
+      for event in events {
+        try JSONLines.print(CalendarEventPayload(event: event))
+      }
+    } else {
+      Swift.print(ICalendar.document(for: events, calendar: calendar), terminator: "")
+    }
+  }
+}
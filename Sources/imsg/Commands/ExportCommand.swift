@@ -0,0 +1,694 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum ExportFormat: String, CaseIterable {
+  case htmlBubbles = "html-bubbles"
+  case sqlite
+  case eml
+  case txtCompat = "txt-compat"
+  case jsonl
+  case pdf
+
+  /// `chat-1.html`; eml writes a directory of messages, `chat-1-eml`.
+  func defaultOutput(chatID: Int64) -> String {
+    switch self {
+    case .htmlBubbles: return "chat-\(chatID).html"
+    case .sqlite: return "chat-\(chatID).db"
+    case .eml: return "chat-\(chatID)-eml"
+    case .txtCompat: return "chat-\(chatID).txt"
+    case .jsonl: return "chat-\(chatID).jsonl"
+    case .pdf: return "chat-\(chatID).pdf"
+    }
+  }
+}
+
+enum ExportCommand {
+  static let spec = CommandSpec(
+    name: "export",
+    abstract: "Export a chat to a file",
+    discussion: """
+      html-bubbles renders a Messages-style page: bubbles aligned by sender, inline
+      images/video/audio, reaction badges, and day separators. Media is embedded as
+      data URIs (--assets embed, default) or copied next to the page (--assets dir).
+      sqlite writes a portable archive (chats, handles, messages, attachments, reactions)
+      whose schema is documented in its own schema_doc table; without --chat-id it holds
+      every chat, and --blobs stores attachment contents in it, once per distinct file (by
+      SHA-256), reporting the space that saved. --redact masks phone numbers,
+      emails, SSNs or a custom regex in message text before it is written.
+      eml writes a directory with one RFC 5322 message per iMessage (attachments as MIME
+      parts, the sender as From, replies threaded by Message-ID) for mail archives and
+      eDiscovery tools; phone numbers become addresses like +15551234567@imessage.invalid.
+      txt-compat writes plain text in imessage-exporter's TXT layout (timestamp, sender or
+      Me, text, attachment paths, Tapbacks:, blank line), so outputs of both tools diff
+      cleanly and parsers written for one read the other. jsonl writes one message per line
+      in the shape of 'imsg history --json'; --embed-attachments inlines attachments up to
+      --embed-max-size (default 1MB) as base64 data next to their mime_type, so the file can
+      be shipped to another system without the attachment files. pdf lays the conversation
+      out for printing or handing over: bubbles by sender, day separators, times and tapbacks,
+      images scaled inline and other attachments named, on numbered Letter (A4 in metric
+      locales) pages footed with the chat title and export date.
+
+      --split monthly|yearly writes one file per period, named after --out with the period
+      appended (chat-1-2025-01.html). --since-last only exports messages that arrived after
+      the previous --since-last run with the same chat, format, split and --out (tracked in
+      export.json in the state directory). eml adds a file per new message; other formats
+      rewrite the file (with --split, each period) holding new messages in full, so it stays
+      complete. Periods and runs without messages leave existing files alone.
+
+      Without --chat-id, html-bubbles, eml, txt-compat, jsonl and pdf export every chat into the
+      --out directory (default imsg-export), one chat-<id> file each, and sqlite archives every
+      chat. Up to --jobs chats (default 4) are read at once, each on its own connection to
+      chat.db. On a terminal each running chat gets a progress bar on stderr; --progress json
+      prints start/progress/done events and a closing summary instead, and --quiet or
+      --progress none turns progress off. A chat that fails is reported and the rest still
+      export; the run then exits with that error.
+
+      --manifest also writes manifest.json in the --out directory, or <out>.manifest.json
+      beside a single file. It lists each file with its SHA-256, size, chats, message count
+      and date range, the SHA-256 of every attachment the messages reference, the imsg
+      version, and the SHA-256 of chat.db and chat.db-wal at the time. Hashing reads chat.db
+      and every attachment in full, so it is opt-in. Before writing, a --manifest run checks
+      the files the previous manifest lists and warns about any that changed or are missing
+      (recorded as drift); files a --split or --since-last run leaves alone stay in the
+      manifest. With --redact, attachments are listed without their paths.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "chatID", names: [.long("chat-id")], help: "chat rowid from 'imsg chats'"),
+          .make(
+            label: "format", names: [.long("format")],
+            help: "export format: \(ExportFormat.allCases.map(\.rawValue).joined(separator: "|"))"),
+          .make(
+            label: "out", names: [.long("out")],
+            help: "output file, or directory for eml (default chat-<id>.<ext>)"),
+          .make(
+            label: "assets", names: [.long("assets")],
+            help: "html media handling: embed|dir (default embed)"),
+          .make(label: "limit", names: [.long("limit")], help: "only export the newest N messages"),
+          .make(
+            label: "split", names: [.long("split")],
+            help: "one file per period: monthly|yearly"),
+          .make(
+            label: "jobs", names: [.long("jobs")],
+            help: "chats to export at once without --chat-id (default 4)"),
+          RedactionOptions.option(),
+        ] + AttachmentEmbedding.options() + ExportProgress.options()
+          + MessageFilterOptions.options(),
+        flags: [
+          .make(
+            label: "blobs", names: [.long("blobs")],
+            help: "sqlite: copy attachment files into the archive"),
+          .make(
+            label: "sinceLast", names: [.long("since-last")],
+            help: "only export messages newer than the previous --since-last run"),
+          .make(label: "quiet", names: [.long("quiet")], help: "no progress output"),
+          .make(
+            label: "manifest", names: [.long("manifest")],
+            help: "write a manifest with file, attachment and chat.db checksums"),
+          .make(
+            label: "embedAttachments", names: [.long("embed-attachments")],
+            help: "jsonl: inline small attachments as base64"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg export --chat-id 1 --format html-bubbles",
+      "imsg export --chat-id 1 --format html-bubbles --assets dir --out ~/Desktop/mom.html",
+      "imsg export --format sqlite --out archive.db",
+      "imsg export --format html-bubbles --out ~/Archive/chats --jobs 8",
+      "imsg export --format txt-compat --since-last --progress json --out ~/Archive/txt",
+      "imsg export --chat-id 1 --format sqlite --blobs --out mom.db",
+      "imsg export --chat-id 1 --format eml --out ~/Archive/mom-eml",
+      "imsg export --chat-id 1 --format txt-compat --out ~/Archive/mom.txt",
+      "imsg export --chat-id 1 --format pdf --start 2025-01-01T00:00:00Z --out ~/Desktop/mom.pdf",
+      "imsg export --chat-id 1 --format jsonl --embed-attachments --embed-max-size 512KB",
+      "imsg export --chat-id 1 --redact phone --redact email --out chat.html",
+      "imsg export --chat-id 1 --split monthly --out ~/Archive/mom.html",
+      "imsg export --format sqlite --split yearly --since-last --out ~/Archive/imsg.db",
+      "imsg export --format jsonl --manifest --out ~/Archive/jsonl",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    cursorFactory: (String) throws -> RowCursorStore = {
+      try RowCursorStore(databasePath: $0, fileURL: StateDirectory.fileURL("export.json"))
+    }
+  ) async throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let formatRaw = values.option("format") ?? ExportFormat.htmlBubbles.rawValue
+    guard let format = ExportFormat(rawValue: formatRaw) else {
+      throw ParsedValuesError.invalidOption("format")
+    }
+    let chatID = values.optionInt64("chatID")
+    if format != .jsonl, values.flag("embedAttachments") {
+      throw ParsedValuesError.invalidOption("embed-attachments")
+    }
+    if format == .sqlite {
+      try await runArchive(
+        values: values, runtime: runtime, chatID: chatID, dbPath: dbPath,
+        storeFactory: storeFactory, cursorFactory: cursorFactory)
+      return
+    }
+    guard let chatID else {
+      try await runAll(
+        values: values, runtime: runtime, format: format, dbPath: dbPath,
+        storeFactory: storeFactory, cursorFactory: cursorFactory)
+      return
+    }
+    let assets = try assetMode(from: values)
+    let embedding = try AttachmentEmbedding.from(values: values)
+    let filter = try MessageFilterOptions.filter(from: values)
+    let redactor = try RedactionOptions.redactor(from: values)
+    let outPath = values.option("out") ?? format.defaultOutput(chatID: chatID)
+    let outputURL = URL(fileURLWithPath: NSString(string: outPath).expandingTildeInPath)
+
+    let store = try storeFactory(dbPath)
+    guard let chat = try store.chatInfo(chatID: chatID) else {
+      throw IMsgError.invalidChatTarget("Unknown chat id \(chatID)")
+    }
+    let plan = try ExportPlan(
+      values: values, format: format, chat: String(chatID), chatIDs: [chatID],
+      outputURL: outputURL, store: store, cursors: { try cursorFactory(dbPath) })
+    let manifest = manifestRun(values: values, output: outputURL, isDirectory: false)
+
+    var results: [ExportResult] = []
+    for target in plan.targets {
+      var export = try ChatExport.load(
+        store: store,
+        chat: chat,
+        limit: values.optionInt("limit"),
+        filter: filter,
+        redactor: redactor,
+        dateRange: target.dateRange,
+        afterRowID: target.afterRowID
+      )
+      export.onItems = { manifest?.recorder.record($0, chatID: chatID, file: target.url) }
+      let count = try write(
+        export, format: format, to: target.url, assets: assets, embedding: embedding,
+        skipEmpty: plan.skipEmpty)
+      if count == 0, plan.skipEmpty { continue }
+      results.append(
+        ExportResult(
+          path: target.url.path,
+          format: format.rawValue,
+          chatID: chatID,
+          messages: count
+        ))
+    }
+    try plan.commit()
+    try manifest?.finish(
+      format: format, databasePath: dbPath, written: results.map { URL(fileURLWithPath: $0.path) })
+    try report(results, runtime: runtime)
+  }
+
+  /// Every chat into its own file under the `--out` directory, `--jobs` chats at a time.
+  static func runAll(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    format: ExportFormat,
+    dbPath: String,
+    storeFactory: @escaping (String) throws -> MessageStore,
+    cursorFactory: (String) throws -> RowCursorStore
+  ) async throws {
+    let assets = try assetMode(from: values)
+    let embedding = try AttachmentEmbedding.from(values: values)
+    let filter = try MessageFilterOptions.filter(from: values)
+    let redactor = try RedactionOptions.redactor(from: values)
+    let jobs = try jobLimit(from: values)
+    let limit = values.optionInt("limit")
+    let outPath = values.option("out") ?? "imsg-export"
+    let directory = URL(fileURLWithPath: NSString(string: outPath).expandingTildeInPath)
+    try FileManager.default.createDirectory(at: directory, withIntermediateDirectories: true)
+    let manifest = manifestRun(values: values, output: directory, isDirectory: true)
+
+    let store = try storeFactory(dbPath)
+    // One cursor file shared by every chat's plan, so their commits don't overwrite each other.
+    var cursors: RowCursorStore?
+    func sharedCursors() throws -> RowCursorStore {
+      if let cursors { return cursors }
+      let loaded = try cursorFactory(dbPath)
+      cursors = loaded
+      return loaded
+    }
+    var work: [(chat: ChatInfo, total: Int?, plan: ExportPlan)] = []
+    for listed in try store.listChats(limit: Int.max) {
+      guard let chat = try store.chatInfo(chatID: listed.id) else { continue }
+      let plan = try ExportPlan(
+        values: values, format: format, chat: String(chat.id), chatIDs: [chat.id],
+        outputURL: directory.appendingPathComponent(format.defaultOutput(chatID: chat.id)),
+        store: store, cursors: sharedCursors)
+      let total = values.flag("sinceLast") ? nil : min(listed.messageCount, limit ?? Int.max)
+      work.append((chat, total, plan))
+    }
+
+    let progress = ExportProgress(mode: try ExportProgress.mode(from: values), chats: work.count)
+    let started = Date()
+    let outcomes = await ExportWorkers.run(work, limit: jobs) { item -> [ExportResult] in
+      let chat = item.chat
+      progress.start(
+        chatID: chat.id, title: chat.name.isEmpty ? chat.identifier : chat.name,
+        total: item.total)
+      do {
+        let store = try storeFactory(dbPath)
+        var results: [ExportResult] = []
+        for target in item.plan.targets {
+          var export = try ChatExport.load(
+            store: store, chat: chat, limit: limit, filter: filter, redactor: redactor,
+            dateRange: target.dateRange, afterRowID: target.afterRowID)
+          export.onBatch = { progress.advance(chatID: chat.id, by: $0) }
+          export.onItems = { manifest?.recorder.record($0, chatID: chat.id, file: target.url) }
+          let count = try write(
+            export, format: format, to: target.url, assets: assets, embedding: embedding,
+            skipEmpty: item.plan.skipEmpty)
+          if count == 0, item.plan.skipEmpty { continue }
+          results.append(
+            ExportResult(
+              path: target.url.path, format: format.rawValue, chatID: chat.id, messages: count))
+        }
+        progress.finish(chatID: chat.id)
+        return results
+      } catch {
+        progress.finish(chatID: chat.id, error: error)
+        throw error
+      }
+    }
+    progress.close()
+
+    var results: [ExportResult] = []
+    var failures: [(chatID: Int64, error: Error)] = []
+    for (item, outcome) in zip(work, outcomes) {
+      switch outcome {
+      case .success(let written):
+        results += written
+        // Failed chats keep their cursor, so the next --since-last run retries them.
+        try item.plan.commit()
+      case .failure(let error):
+        failures.append((item.chat.id, error))
+      }
+    }
+    try manifest?.finish(
+      format: format, databasePath: dbPath, written: results.map { URL(fileURLWithPath: $0.path) })
+    let messages = results.reduce(0) { $0 + $1.messages }
+    let chats = Set(results.compactMap(\.chatID)).count
+    let seconds = Date().timeIntervalSince(started)
+    progress.summary(chats: chats, messages: messages, failed: failures.count, seconds: seconds)
+    if runtime.jsonOutput {
+      try report(results, runtime: runtime)
+    } else if results.isEmpty {
+      Swift.print("no new messages to export")
+    } else {
+      Swift.print(
+        "exported \(messages) messages from \(chats) chat\(pluralSuffix(for: chats)) into "
+          + "\(results.count) file\(pluralSuffix(for: results.count)) in \(directory.path) "
+          + String(format: "(%.1fs)", seconds))
+    }
+    for failure in failures {
+      FileHandle.standardError.write(
+        Data("imsg export: chat \(failure.chatID) failed: \(failure.error)\n".utf8))
+    }
+    if let failure = failures.first {
+      throw failure.error
+    }
+  }
+
+  /// Renders one file (or eml directory) and returns how many messages it holds.
+  static func write(
+    _ export: ChatExport, format: ExportFormat, to url: URL, assets: HTMLAssetMode,
+    embedding: AttachmentEmbedding? = nil, skipEmpty: Bool
+  ) throws -> Int {
+    switch format {
+    case .eml:
+      return try EMLRenderer(outputURL: url).write(export, skipEmpty: skipEmpty)
+    case .txtCompat:
+      return try TXTCompatRenderer(outputURL: url).write(export, skipEmpty: skipEmpty)
+    case .jsonl:
+      return try JSONLRenderer(outputURL: url, embedding: embedding)
+        .write(export, skipEmpty: skipEmpty)
+    case .pdf:
+      return try PDFRenderer(outputURL: url).write(export, skipEmpty: skipEmpty)
+    case .htmlBubbles:
+      return try HTMLBubbleRenderer(assets: assets, outputURL: url)
+        .write(export, skipEmpty: skipEmpty)
+    case .sqlite:
+      preconditionFailure("sqlite archives are written by runArchive, not per chat")
+    }
+  }
+
+  static func assetMode(from values: ParsedValues) throws -> HTMLAssetMode {
+    let raw = values.option("assets") ?? HTMLAssetMode.embed.rawValue
+    guard let assets = HTMLAssetMode(rawValue: raw) else {
+      throw ParsedValuesError.invalidOption("assets")
+    }
+    return assets
+  }
+
+  static func jobLimit(from values: ParsedValues) throws -> Int {
+    guard let raw = values.option("jobs") else { return ExportWorkers.defaultLimit }
+    guard let jobs = Int(raw), jobs > 0 else {
+      throw ParsedValuesError.invalidOption("jobs")
+    }
+    return jobs
+  }
+
+  /// `--format sqlite`: one chat, or every chat when `chatID` is nil, into a portable archive.
+  static func runArchive(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    chatID: Int64?,
+    dbPath: String,
+    storeFactory: @escaping (String) throws -> MessageStore,
+    cursorFactory: (String) throws -> RowCursorStore
+  ) async throws {
+    let filter = try MessageFilterOptions.filter(from: values)
+    let redactor = try RedactionOptions.redactor(from: values)
+    let jobs = try jobLimit(from: values)
+    let defaultName = chatID.map { "chat-\($0).db" } ?? "imsg-archive.db"
+    let outPath = values.option("out") ?? defaultName
+    let outputURL = URL(fileURLWithPath: NSString(string: outPath).expandingTildeInPath)
+
+    let store = try storeFactory(dbPath)
+    var chats: [ArchiveChat] = []
+    if let chatID {
+      guard let chat = try store.chatInfo(chatID: chatID) else {
+        throw IMsgError.invalidChatTarget("Unknown chat id \(chatID)")
+      }
+      chats = [ArchiveChat(info: chat, total: nil)]
+    } else {
+      let limit = values.optionInt("limit") ?? Int.max
+      chats = try store.listChats(limit: Int.max).compactMap { listed in
+        try store.chatInfo(chatID: listed.id).map {
+          ArchiveChat(info: $0, total: min(listed.messageCount, limit))
+        }
+      }
+    }
+    let plan = try ExportPlan(
+      values: values, format: .sqlite, chat: chatID.map(String.init) ?? "all",
+      chatIDs: chats.map(\.info.id), outputURL: outputURL, store: store,
+      cursors: { try cursorFactory(dbPath) })
+    let manifest = manifestRun(values: values, output: outputURL, isDirectory: false)
+    // Per-chat totals only hold when every message of the chat lands in one archive.
+    if plan.targets.count > 1 || values.flag("sinceLast") {
+      chats = chats.map { ArchiveChat(info: $0.info, total: nil) }
+    }
+    let progress = ExportProgress(
+      mode: chatID == nil ? try ExportProgress.mode(from: values) : .none,
+      chats: chats.count * plan.targets.count)
+    let started = Date()
+
+    let fileManager = FileManager.default
+    var results: [ExportResult] = []
+    for target in plan.targets {
+      // Built beside the target, so an empty or failed run leaves the previous archive alone.
+      let partialURL = PartialFile.url(for: target.url)
+      // Left over from a run that was killed before it could clean up.
+      try? fileManager.removeItem(at: partialURL)
+      let written: (chats: Int, messages: Int, blobs: PortableArchive.BlobStats?)
+      do {
+        written = try await writeArchive(
+          path: partialURL.path, chats: chats, target: target, skipEmpty: plan.skipEmpty,
+          filter: filter, redactor: redactor, values: values, jobs: jobs, progress: progress,
+          openStore: { try storeFactory(dbPath) },
+          record: { manifest?.recorder.record($0, chatID: $1, file: target.url) })
+      } catch {
+        progress.close()
+        try? fileManager.removeItem(at: partialURL)
+        throw error
+      }
+      if written.messages == 0, plan.skipEmpty {
+        try? fileManager.removeItem(at: partialURL)
+        continue
+      }
+      try PartialFile.commit(partialURL, to: target.url)
+      var result = ExportResult(
+        path: target.url.path,
+        format: ExportFormat.sqlite.rawValue,
+        chatID: chatID,
+        chats: written.chats,
+        messages: written.messages
+      )
+      if let blobs = written.blobs {
+        result.blobs = blobs.blobs
+        result.blobBytes = blobs.storedBytes
+        result.blobBytesSaved = blobs.savedBytes
+      }
+      results.append(result)
+    }
+    progress.close()
+    try plan.commit()
+    try manifest?.finish(
+      format: .sqlite, databasePath: dbPath,
+      written: results.map { URL(fileURLWithPath: $0.path) })
+    progress.summary(
+      chats: chats.count, messages: results.reduce(0) { $0 + $1.messages }, failed: 0,
+      seconds: Date().timeIntervalSince(started))
+    try report(results, runtime: runtime)
+  }
+
+  /// A chat to archive, with its message count for the progress bar when that is known.
+  struct ArchiveChat {
+    let info: ChatInfo
+    let total: Int?
+  }
+
+  /// Fills one archive and returns how many chats and messages it holds, plus its blob totals
+  /// with --blobs. With `skipEmpty` chats without messages in range are left out. Up to `jobs`
+  /// chats are read at once, each from its own store; writes to the archive take turns.
+  private static func writeArchive(
+    path: String,
+    chats: [ArchiveChat],
+    target: ExportPlan.Target,
+    skipEmpty: Bool,
+    filter: MessageFilter,
+    redactor: MessageRedactor?,
+    values: ParsedValues,
+    jobs: Int,
+    progress: ExportProgress,
+    openStore: @escaping () throws -> MessageStore,
+    record: @escaping ([ExportedMessage], Int64) -> Void
+  ) async throws -> (chats: Int, messages: Int, blobs: PortableArchive.BlobStats?) {
+    let archive = try PortableArchive(
+      path: path, includeBlobs: values.flag("blobs"),
+      generator: "imsg \(IMsgVersion.current)")
+    let archiveLock = NSLock()
+    func locked(_ body: () throws -> Void) throws {
+      archiveLock.lock()
+      defer { archiveLock.unlock() }
+      try body()
+    }
+    let limit = values.optionInt("limit")
+    let outcomes = await ExportWorkers.run(chats, limit: jobs) { item -> Bool in
+      let chat = item.info
+      progress.start(
+        chatID: chat.id, title: chat.name.isEmpty ? chat.identifier : chat.name,
+        total: item.total)
+      do {
+        var export = try ChatExport.load(
+          store: try openStore(), chat: chat, limit: limit, filter: filter,
+          redactor: redactor, dateRange: target.dateRange, afterRowID: target.afterRowID)
+        export.onBatch = { progress.advance(chatID: chat.id, by: $0) }
+        export.onItems = { record($0, chat.id) }
+        var included = false
+        func include() throws {
+          if included { return }
+          included = true
+          try locked {
+            try archive.add(
+              chat: chat, isGroup: export.isGroup, participants: export.participants)
+          }
+        }
+        if !skipEmpty {
+          try include()
+        }
+        try export.scan { items in
+          try include()
+          try locked {
+            try archive.add(
+              entries: items.map {
+                PortableArchive.Entry(
+                  message: $0.message, attachments: $0.attachments, reactions: $0.reactions)
+              },
+              chatID: chat.id
+            )
+          }
+        }
+        progress.finish(chatID: chat.id)
+        return included
+      } catch {
+        progress.finish(chatID: chat.id, error: error)
+        throw error
+      }
+    }
+    var added = 0
+    for outcome in outcomes {
+      if try outcome.get() {
+        added += 1
+      }
+    }
+    return (added, archive.messageCount, archive.includesBlobs ? try archive.blobStats() : nil)
+  }
+
+  /// The manifest run for `output` with `--manifest`, after warning on stderr about files that
+  /// changed or vanished since the previous export wrote its manifest; nil without it.
+  static func manifestRun(
+    values: ParsedValues, output: URL, isDirectory: Bool
+  ) -> ExportManifestRun? {
+    guard values.flag("manifest") else { return nil }
+    let redacted = values.optionValues("redact").contains { !$0.isEmpty }
+    let manifest = ExportManifestRun(
+      url: ExportManifest.url(for: output, isDirectory: isDirectory), includesPaths: !redacted)
+    for drift in manifest.drift {
+      let what = drift.actual == nil ? "is missing" : "changed"
+      FileHandle.standardError.write(
+        Data(
+          ("imsg export: \(drift.path) \(what) since the last export "
+            + "(\(manifest.url.lastPathComponent))\n").utf8))
+    }
+    return manifest
+  }
+
+  private static func report(_ results: [ExportResult], runtime: RuntimeOptions) throws {
+    if runtime.jsonOutput {
+      for result in results {
+        try JSONLines.print(result)
+      }
+      return
+    }
+    if results.isEmpty {
+      Swift.print("no new messages to export")
+    }
+    for result in results {
+      var line = "exported \(result.messages) messages"
+      if let chats = result.chats {
+        line += " from \(chats) chat\(pluralSuffix(for: chats))"
+      }
+      line += " to \(result.path)"
+      if let blobs = result.blobs, let stored = result.blobBytes {
+        line += " (\(blobs) attachment file\(pluralSuffix(for: blobs)), "
+          + AuditCommand.formatBytes(stored)
+        if let saved = result.blobBytesSaved, saved > 0 {
+          line += "; \(AuditCommand.formatBytes(saved)) saved by deduplication"
+        }
+        line += ")"
+      }
+      Swift.print(line)
+    }
+  }
+}
+
+/// The files one export run writes: the `--out` path, or one per period with `--split`,
+/// limited to what is new since the previous run with `--since-last`.
+struct ExportPlan {
+  struct Target {
+    let url: URL
+    let dateRange: Range<Date>?
+    let afterRowID: Int64?
+  }
+
+  let targets: [Target]
+  /// Split and incremental runs skip files that would hold no messages instead of writing
+  /// (or overwriting with) empty ones.
+  let skipEmpty: Bool
+  private let cursors: RowCursorStore?
+  private let cursorKey: String
+  private let cursorRowID: Int64
+
+  /// `chat` names the chat (or `all`) in the `--since-last` cursor key.
+  init(
+    values: ParsedValues,
+    format: ExportFormat,
+    chat: String,
+    chatIDs: [Int64],
+    outputURL: URL,
+    store: MessageStore,
+    cursors cursorFactory: () throws -> RowCursorStore
+  ) throws {
+    var split: ExportSplit?
+    if let raw = values.option("split") {
+      guard let parsed = ExportSplit(rawValue: raw.lowercased()) else {
+        throw ParsedValuesError.invalidOption("split")
+      }
+      split = parsed
+    }
+    cursorKey = [
+      "chat=\(chat)", "format=\(format.rawValue)", "split=\(split?.rawValue ?? "none")",
+      "out=\(outputURL.path)",
+    ].joined(separator: " ")
+    // Taken before scanning: a message that lands mid-run is exported again next time rather
+    // than skipped.
+    cursorRowID = try store.maxRowID()
+    var afterRowID: Int64?
+    if values.flag("sinceLast") {
+      let loaded = try cursorFactory()
+      afterRowID = loaded.cursor(for: cursorKey)
+      cursors = loaded
+    } else {
+      cursors = nil
+    }
+    skipEmpty = split != nil || cursors != nil
+
+    if let split {
+      // A period with anything new is exported again in full, so each file stays complete.
+      targets = try split.periods(store: store, chatIDs: chatIDs, afterRowID: afterRowID).map {
+        Target(
+          url: split.url(for: $0, base: outputURL), dateRange: $0.start..<$0.end,
+          afterRowID: nil)
+      }
+    } else if let afterRowID, format != .eml {
+      // One file can't take just the new messages without losing the old ones (eml writes a
+      // file per message, so it can), so it is written again in full when anything is new.
+      var changed = false
+      for chatID in chatIDs where !changed {
+        try store.scanMessageDates(chatID: chatID, afterRowID: afterRowID) { _ in changed = true }
+      }
+      targets = changed ? [Target(url: outputURL, dateRange: nil, afterRowID: nil)] : []
+    } else {
+      targets = [Target(url: outputURL, dateRange: nil, afterRowID: afterRowID)]
+    }
+  }
+
+  /// Moves the `--since-last` cursor past this run; call once every target is written.
+  func commit() throws {
+    guard let cursors else { return }
+    cursors.record(cursorRowID, for: cursorKey)
+    try cursors.save()
+  }
+}
+
+struct ExportResult: Codable {
+  let path: String
+  let format: String
+  /// Nil for archives of every chat.
+  let chatID: Int64?
+  var chats: Int?
+  let messages: Int
+  /// Archive blob totals, set with --blobs.
+  var blobs: Int?
+  var blobBytes: Int64?
+  var blobBytesSaved: Int64?
+
+  init(path: String, format: String, chatID: Int64?, chats: Int? = nil, messages: Int) {
+    self.path = path
+    self.format = format
+    self.chatID = chatID
+    self.chats = chats
+    self.messages = messages
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case path
+    case format
+    case chatID = "chat_id"
+    case chats
+    case messages
+    case blobs
+    case blobBytes = "blob_bytes"
+    case blobBytesSaved = "blob_bytes_saved"
+  }
+}
@@ -0,0 +1,134 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum ForwardCommand {
+  static let spec = CommandSpec(
+    name: "forward",
+    abstract: "Re-send an existing message to another recipient",
+    discussion: """
+      Looks the message up by --message-guid (or --rowid) and sends its text and attachments
+      through the same path as imsg send, so recipients, --service, the send journal,
+      --idempotency-key, quiet hours, --retries and the confirmation on a terminal (--yes) all
+      behave the same. Attachments must still be on disk; files Messages offloaded to iCloud
+      have to be downloaded first.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "messageGUID", names: [.long("message-guid")], help: "message guid"),
+          .make(label: "rowid", names: [.long("rowid")], help: "message rowid"),
+          .make(
+            label: "to", names: [.long("to")],
+            help: "phone number, email, comma-separated handles, or group chat identifier"),
+          .make(label: "chatID", names: [.long("chat-id")], help: "chat rowid"),
+          .make(
+            label: "chatIdentifier", names: [.long("chat-identifier")],
+            help: "chat identifier (e.g. iMessage;+;chat...)"),
+          .make(label: "chatGUID", names: [.long("chat-guid")], help: "chat guid"),
+          .make(
+            label: "service", names: [.long("service")], help: "service to use: imessage|sms|auto"),
+          .make(
+            label: "region", names: [.long("region")],
+            help: "default region for phone normalization"),
+          .make(
+            label: "idempotencyKey", names: [.long("idempotency-key")],
+            help: "skip the send if this key was already sent successfully"),
+          .make(
+            label: "quietHours", names: [.long("quiet-hours")],
+            help: "local window to refuse sends in, e.g. 22:00-08:00 (default: config.yaml)"),
+        ] + SendCommand.retryOptions(),
+        flags: [
+          .make(
+            label: "group", names: [.long("group")],
+            help: "send to one group thread with all --to participants"),
+          .make(
+            label: "ignoreQuietHours", names: [.long("ignore-quiet-hours")],
+            help: "send now even inside quiet hours"),
+          .make(
+            label: "yes", names: [.long("yes"), .short("y")],
+            help: "send without asking for confirmation on a terminal"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg forward --message-guid 5A1B2C3D-0000-4E5F-8A9B-112233445566 --to +14155551212",
+      "imsg forward --rowid 4211 --chat-id 7",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    sendMessage: ((MessageSendOptions) throws -> Void)? = nil,
+    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    journal: SendJournal = SendJournal()
+  ) async throws {
+    let guid = values.option("messageGUID")
+    let rowID = values.optionInt64("rowid")
+    if guid != nil && rowID != nil {
+      throw ParsedValuesError.invalidOption("rowid")
+    }
+    if guid == nil && rowID == nil {
+      throw ParsedValuesError.missingOption("message-guid")
+    }
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let store = try storeFactory(dbPath)
+    let found: Message?
+    if let guid {
+      found = try store.message(guid: guid)
+    } else if let rowID {
+      found = try store.message(rowID: rowID)
+    } else {
+      found = nil
+    }
+    guard let message = found else {
+      throw IMsgError.messageNotFound(guid ?? "rowid \(rowID ?? 0)")
+    }
+
+    let attachments = try store.attachments(for: message.rowID)
+    if let missing = attachments.first(where: \.missing) {
+      let name = missing.transferName.isEmpty ? missing.filename : missing.transferName
+      throw IMsgError.invalidAttachment(
+        "\(name) is not on disk; open the message in Messages to download it first")
+    }
+    let text = forwardedText(message.text)
+    if text.isEmpty && attachments.isEmpty {
+      throw IMsgError.invalidAttachment("message has no text or attachments to forward")
+    }
+
+    var options = values.options
+    options["messageGUID"] = nil
+    options["rowid"] = nil
+    options["text"] = text.isEmpty ? nil : [text]
+    options["file"] = attachments.map { escapingGlob($0.originalPath) }
+    try await SendCommand.run(
+      values: ParsedValues(positional: values.positional, options: options, flags: values.flags),
+      runtime: runtime,
+      sendMessage: sendMessage,
+      storeFactory: storeFactory,
+      journal: journal
+    )
+  }
+
+  /// Drops the U+FFFC placeholders Messages leaves in the text where attachments sat.
+  static func forwardedText(_ text: String) -> String {
+    text.replacingOccurrences(of: "\u{FFFC}", with: "")
+      .trimmingCharacters(in: .whitespacesAndNewlines)
+  }
+
+  /// `send --file` globs paths containing `*?[`; escape those so stored paths stay literal.
+  static func escapingGlob(_ path: String) -> String {
+    guard path.contains(where: { "*?[".contains($0) }) else { return path }
+    var escaped = ""
+    for char in path {
+      if "*?[\\".contains(char) {
+        escaped.append("\\")
+      }
+      escaped.append(char)
+    }
+    return escaped
+  }
+}
@@ -6,80 +6,137 @@ enum HistoryCommand {
   static let spec = CommandSpec(
     name: "history",
     abstract: "Show recent messages for a chat",
-    discussion: nil,
+    discussion: """
+      Without --chat-id on a terminal, pick the chat from a filterable list; the chosen id is
+      printed on stderr for reuse in scripts. --compact prints a transcript for reading:
+      oldest first, consecutive messages from one sender under a single header, tapbacks
+      after the message they react to, and relative times unless --time-format is given.
+      """,
     signature: CommandSignatures.withRuntimeFlags(
       CommandSignature(
         options: CommandSignatures.baseOptions() + [
           .make(label: "chatID", names: [.long("chat-id")], help: "chat rowid from 'imsg chats'"),
           .make(label: "limit", names: [.long("limit")], help: "Number of messages to show"),
-          .make(
-            label: "participants", names: [.long("participants")],
-            help: "filter by participant handles", parsing: .upToNextOption),
-          .make(label: "start", names: [.long("start")], help: "ISO8601 start (inclusive)"),
-          .make(label: "end", names: [.long("end")], help: "ISO8601 end (exclusive)"),
-        ],
+        ] + MessageFilterOptions.options() + TimestampFormatter.options() + [
+          OutputLabels.option(), OutputTemplate.option(), TabularFormat.option(),
+          RedactionOptions.option(), NormalizationOptions.option(), TextTruncation.option(),
+        ] + AttachmentEmbedding.options(),
         flags: [
           .make(
             label: "attachments", names: [.long("attachments")], help: "include attachment metadata"
-          )
+          ),
+          .make(
+            label: "compact", names: [.long("compact")],
+            help: "readable transcript: group by sender, inline tapbacks, relative times"),
+          .make(
+            label: "embedAttachments", names: [.long("embed-attachments")],
+            help: "with --json, inline small attachments as base64"),
+          .make(
+            label: "detectLang", names: [.long("detect-lang")],
+            help: "with --json, add each message's detected language"),
         ]
       )
     ),
     usageExamples: [
       "imsg history --chat-id 1 --limit 10 --attachments",
       "imsg history --chat-id 1 --start 2025-01-01T00:00:00Z --json",
+      "imsg history --chat-id 1 --limit 1000 --format tsv > chat1.tsv",
+      "imsg history --chat-id 1 --match-icase 'code is [0-9]+'",
+      "imsg history --chat-id 1 --text-lang de --json",
+      "imsg history --chat-id 1 --tz local --time-format '%a %H:%M'",
+      "imsg history --chat-id 1 --template '{{.Date}} {{.Sender}}: {{.Text}}'",
+      "imsg history --chat-id 1 --redact phone,email --redact 'order #[0-9]+'",
+      "imsg history --chat-id 1 --limit 100 --compact",
+      "imsg history --chat-id 1 --truncate 60",
+      "imsg history --chat-id 1 --normalize all --json",
+      "imsg history --chat-id 1 --json --embed-attachments > chat1.jsonl",
     ]
   ) { values, runtime in
-    guard let chatID = values.optionInt64("chatID") else {
-      throw ParsedValuesError.missingOption("chat-id")
-    }
-    let dbPath = values.option("db") ?? MessageStore.defaultPath
+    let dbPath = try CommandSignatures.databasePath(from: values)
     let limit = values.optionInt("limit") ?? 50
     let showAttachments = values.flag("attachments")
-    let participants = values.optionValues("participants")
-      .flatMap { $0.split(separator: ",").map { String($0) } }
-      .filter { !$0.isEmpty }
-    let filter = try MessageFilter.fromISO(
-      participants: participants,
-      startISO: values.option("start"),
-      endISO: values.option("end")
-    )
+    let filter = try MessageFilterOptions.filter(from: values)
+    let includeLanguage = MessageFilterOptions.includesLanguage(values)
+    let redactor = try RedactionOptions.redactor(from: values)
+    let normalizer = try NormalizationOptions.normalizer(from: values)
+    let timestamps = try TimestampFormatter.from(values: values)
+    let labels = try OutputLabels.from(values: values)
+    let tabular = try TabularFormat.from(values: values, runtime: runtime)
+    let template = try MessageTemplateRenderer.from(values: values, timestamps: timestamps)
+    let compact = values.flag("compact")
+    let truncate = try TextTruncation.limit(from: values)
+    let embedding = try AttachmentEmbedding.from(values: values)
+    if embedding != nil, !runtime.jsonOutput {
+      throw ParsedValuesError.invalidOption("embed-attachments")
+    }
+    if compact && (runtime.jsonOutput || tabular != nil || template != nil) {
+      throw ParsedValuesError.invalidOption("compact")
+    }
 
     let store = try MessageStore(path: dbPath)
-    let messages = try store.messages(chatID: chatID, limit: limit)
-    let filtered = messages.filter { filter.allows($0) }
-
-    if runtime.jsonOutput {
-      for message in filtered {
-        let attachments = try store.attachments(for: message.rowID)
-        let reactions = try store.reactions(for: message.rowID)
-        let payload = MessagePayload(
-          message: message,
-          attachments: attachments,
-          reactions: reactions
-        )
-        try JSONLines.print(payload)
-      }
-      return
+    let chatID = try ChatPicker.chatID(from: values, store: store)
+    var printer = MessageTextPrinter(
+      store: store,
+      timestamps: timestamps,
+      showAttachments: showAttachments
+    )
+    printer.template = template
+    printer.labels = labels
+    printer.truncate = truncate
+    if let tabular {
+      Swift.print(tabular.line(TabularRows.messageHeader))
     }
 
-    for message in filtered {
-      let direction = message.isFromMe ? "sent" : "recv"
-      let timestamp = CLIISO8601.format(message.date)
-      Swift.print("\(timestamp) [\(direction)] \(message.sender): \(message.text)")
-      if message.attachmentsCount > 0 {
-        if showAttachments {
-          let metas = try store.attachments(for: message.rowID)
-          for meta in metas {
-            let name = displayName(for: meta)
-            Swift.print(
-              "  attachment: name=\(name) mime=\(meta.mimeType) missing=\(meta.missing) path=\(meta.originalPath)"
-            )
-          }
-        } else {
-          Swift.print(
-            "  (\(message.attachmentsCount) attachment\(pluralSuffix(for: message.attachmentsCount)))"
+    var transcript: CompactTranscript?
+    if compact {
+      let relative = values.option("timeFormat") == nil
+      transcript = CompactTranscript(
+        timestamps: relative
+          ? TimestampFormatter(
+            style: .relative, timeZone: timestamps.timeZone, locale: timestamps.locale)
+          : timestamps)
+      transcript?.showAttachments = showAttachments
+      transcript?.truncate = truncate
+      transcript?.labels = labels
+    }
+    // Streamed in batches so long histories print in constant memory. --start/--end and
+    // --participants narrow the query itself and the text filters run inside the scan, so
+    // --limit counts only matching messages.
+    try store.scanMessages(
+      chatID: chatID, limit: limit, order: compact ? .oldestFirst : .newestFirst,
+      dateRange: filter.dateRange, handleIDs: try store.senderHandleIDs(for: filter),
+      // Filters see normalized but unmasked text; only what gets printed is masked.
+      matching: { try store.allows(normalizer?.normalize($0) ?? $0, by: filter) }
+    ) { batch in
+      let filtered = batch.map { normalizer?.normalize($0) ?? $0 }
+        .map { redactor?.redact($0) ?? $0 }
+      if var current = transcript {
+        let extras = try MessageExtras.load(store: store, messages: filtered)
+        for message in filtered {
+          let lines = current.lines(
+            for: message, attachments: extras.attachments(for: message.rowID),
+            reactions: extras.reactions(for: message.rowID))
+          Swift.print(lines.joined(separator: "\n"))
+        }
+        transcript = current
+      } else if runtime.jsonOutput {
+        let extras = try MessageExtras.load(store: store, messages: filtered)
+        for message in filtered {
+          let payload = MessagePayload(
+            message: message,
+            attachments: extras.attachments(for: message.rowID),
+            reactions: extras.reactions(for: message.rowID),
+            includeLanguage: includeLanguage
           )
+          try JSONLines.print(embedding?.embed(payload) ?? payload)
+        }
+      } else if let tabular {
+        for message in filtered {
+          Swift.print(tabular.line(TabularRows.message(message)))
+        }
+      } else {
+        for message in filtered {
+          try printer.print(message)
         }
       }
     }
@@ -0,0 +1,35 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum McpCommand {
+  static let spec = CommandSpec(
+    name: "mcp",
+    abstract: "Run a Model Context Protocol server over stdin/stdout",
+    discussion: """
+      Lets MCP clients (desktop assistants, IDE agents, ...) use Messages directly. Tools:
+      list_chats, get_history, send_message, subscribe_messages and unsubscribe_messages;
+      subscriptions deliver new messages as notifications/messages/new. Each tool takes the
+      same parameters as the matching imsg rpc method (see docs/rpc.md), and sends go
+      through the send journal. Add it to a client as the command `imsg mcp`.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(options: CommandSignatures.baseOptions())
+    ),
+    usageExamples: [
+      "imsg mcp",
+      "imsg mcp --db ~/Library/Messages/chat.db",
+    ]
+  ) { values, runtime in
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let store = try MessageStore(path: dbPath)
+    let sender = MessageSender(logger: runtime.automationLogger)
+    let server = MCPServer(
+      store: store,
+      logger: runtime.automationLogger,
+      sendMessage: { try sender.send($0) },
+      journal: SendJournal()
+    )
+    try await server.run()
+  }
+}
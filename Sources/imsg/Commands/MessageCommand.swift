@@ -0,0 +1,159 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum MessageCommand {
+  static let spec = CommandSpec(
+    name: "message",
+    abstract: "Show a single message by guid or rowid",
+    discussion: """
+      Prints one message with its attachments and reactions. The guid is stable across
+      devices and backups; rowids are local to this chat.db. --edits adds the edit history
+      (original text, then each revision with its time) recorded since macOS 13.
+      --receipts lists delivery and read times per recipient of a message you sent (or your
+      read time for a received one). In group chats chat.db records one delivery time for the
+      whole message and no read times, so those are marked as not per participant.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "guid", names: [.long("guid")], help: "message guid"),
+          .make(label: "rowid", names: [.long("rowid")], help: "message rowid"),
+        ] + TimestampFormatter.options() + [OutputLabels.option()],
+        flags: [
+          .make(
+            label: "edits", names: [.long("edits")],
+            help: "include the edit history (original text and each revision)"),
+          .make(
+            label: "receipts", names: [.long("receipts")],
+            help: "include delivered/read times per participant"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg message --guid 5A1B2C3D-0000-4E5F-8A9B-112233445566",
+      "imsg message --rowid 4211 --json",
+      "imsg message --guid 5A1B2C3D-0000-4E5F-8A9B-112233445566 --edits",
+      "imsg message --guid 5A1B2C3D-0000-4E5F-8A9B-112233445566 --receipts --json",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    output: (String) -> Void = { Swift.print($0) }
+  ) async throws {
+    let guid = values.option("guid")
+    let rowID = values.optionInt64("rowid")
+    if guid != nil && rowID != nil {
+      throw ParsedValuesError.invalidOption("rowid")
+    }
+    if guid == nil && rowID == nil {
+      throw ParsedValuesError.missingOption("guid or rowid")
+    }
+    let timestamps = try TimestampFormatter.from(values: values)
+    let labels = try OutputLabels.from(values: values)
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let store = try storeFactory(dbPath)
+
+    let found: Message?
+    if let guid {
+      found = try store.message(guid: guid)
+    } else if let rowID {
+      found = try store.message(rowID: rowID)
+    } else {
+      found = nil
+    }
+    guard let message = found else {
+      throw IMsgError.messageNotFound(guid ?? "rowid \(rowID ?? 0)")
+    }
+    let attachments = try store.attachments(for: message.rowID)
+    let reactions = try store.reactions(for: message.rowID)
+    let showEdits = values.flag("edits")
+    let revisions = showEdits ? try store.editHistory(rowID: message.rowID) : []
+    let showReceipts = values.flag("receipts")
+    let receipts = showReceipts ? try store.receipts(for: message) : []
+    var seenParts = Set<Int>()
+    let edits = revisions.map { revision in
+      MessageRevisionPayload(
+        revision: revision, original: seenParts.insert(revision.part).inserted)
+    }
+
+    if runtime.jsonOutput {
+      var payload = MessagePayload(
+        message: message, attachments: attachments, reactions: reactions)
+      if showEdits {
+        payload.edits = edits
+      }
+      if showReceipts {
+        payload.receipts = receipts.map(MessageReceiptPayload.init)
+      }
+      output(try JSONLines.encode(payload))
+      return
+    }
+
+    printDetails(
+      message, attachments: attachments, reactions: reactions, timestamps: timestamps,
+      labels: labels, output: output)
+    if showReceipts {
+      printReceipts(receipts, timestamps: timestamps, output: output)
+    }
+    guard showEdits else { return }
+    if revisions.isEmpty {
+      output("  edits: none")
+      return
+    }
+    output("  edits:")
+    let multipart = Set(revisions.map(\.part)).count > 1
+    for (revision, payload) in zip(revisions, edits) {
+      let when = revision.date.map(timestamps.format) ?? "unknown time"
+      let label = payload.original ? "original" : "edited"
+      let part = multipart ? " part \(revision.part)" : ""
+      output("    \(when) \(label)\(part): \(revision.text)")
+    }
+  }
+
+  /// The message line, then its ids, attachments and reactions indented below it.
+  static func printDetails(
+    _ message: Message, attachments: [AttachmentMeta], reactions: [Reaction],
+    timestamps: TimestampFormatter, labels: OutputLabels,
+    output: (String) -> Void = { Swift.print($0) }
+  ) {
+    let direction = bidiIsolated(labels.direction(isFromMe: message.isFromMe))
+    let timestamp = timestamps.format(message.date)
+    let body = bidiIsolated(displayText(for: message, attachments: attachments))
+    output("\(timestamp) [\(direction)] \(bidiIsolated(message.sender)): \(body)")
+    output("  id=\(message.rowID) chat=\(message.chatID) guid=\(message.guid)")
+    if let replyToGUID = message.replyToGUID {
+      output("  reply_to=\(replyToGUID)")
+    }
+    for meta in attachments {
+      output(attachmentLine(for: meta, labels: labels))
+    }
+    for reaction in reactions {
+      let who = reaction.isFromMe ? "me" : reaction.sender
+      output("  reaction: \(reaction.reactionType.emoji) \(who)")
+    }
+  }
+
+  /// `  receipts:` then one `handle delivered <time>, read <time>` line per participant.
+  static func printReceipts(
+    _ receipts: [MessageReceipt], timestamps: TimestampFormatter,
+    output: (String) -> Void = { Swift.print($0) }
+  ) {
+    guard !receipts.isEmpty else {
+      output("  receipts: none recorded")
+      return
+    }
+    let shared = receipts.contains { !$0.perParticipant }
+    output(shared ? "  receipts (group, for the whole message):" : "  receipts:")
+    for receipt in receipts {
+      let delivered = receipt.deliveredAt.map(timestamps.format) ?? "not delivered"
+      let read = receipt.readAt.map(timestamps.format) ?? (shared ? "unknown" : "not read")
+      output("    \(bidiIsolated(receipt.handle)) delivered \(delivered), read \(read)")
+    }
+  }
+}
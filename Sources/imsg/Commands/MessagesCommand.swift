@@ -0,0 +1,96 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum MessagesCommand {
+  static let spec = CommandSpec(
+    name: "messages",
+    abstract: "Show many messages by rowid or guid",
+    discussion: """
+      Fetches a list of messages in one go, with their attachments and reactions, for tools
+      that keep rowids or guids and need the messages back later. Messages are printed in
+      the order given; --ids and --guids take comma-separated lists and can be repeated.
+      Ids that aren't in chat.db are skipped and listed on stderr. With --json each message
+      is one line shaped like imsg message --json.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "ids", names: [.long("ids")], help: "message rowids (100,101,102)"),
+          .make(label: "guids", names: [.long("guids")], help: "message guids, comma-separated"),
+        ] + TimestampFormatter.options() + [OutputLabels.option()]
+      )
+    ),
+    usageExamples: [
+      "imsg messages --ids 100,101,102 --json",
+      "imsg messages --ids 4211 --ids 4212,4213",
+      "imsg messages --guids 5A1B2C3D-0000-4E5F-8A9B-112233445566 --json",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) }
+  ) throws {
+    let ids = list(values, "ids")
+    let guids = list(values, "guids")
+    if !ids.isEmpty && !guids.isEmpty {
+      throw ParsedValuesError.invalidOption("guids")
+    }
+    if ids.isEmpty && guids.isEmpty {
+      throw ParsedValuesError.missingOption("ids or guids")
+    }
+    let rowIDs = try ids.map { id in
+      guard let rowID = Int64(id) else { throw ParsedValuesError.invalidOption("ids") }
+      return rowID
+    }
+    let timestamps = try TimestampFormatter.from(values: values)
+    let labels = try OutputLabels.from(values: values)
+    let store = try storeFactory(try CommandSignatures.databasePath(from: values))
+
+    let messages: [Message]
+    let missing: [String]
+    if guids.isEmpty {
+      messages = try store.messages(rowIDs: rowIDs)
+      let found = Set(messages.map(\.rowID))
+      missing = ids.filter { !found.contains(Int64($0) ?? 0) }
+    } else {
+      messages = try store.messages(guids: guids)
+      let found = Set(messages.map(\.guid))
+      missing = guids.filter { !found.contains($0) }
+    }
+    let messageIDs = messages.map(\.rowID)
+    let attachments = try store.attachments(forMessageIDs: messageIDs)
+    let reactions = try store.reactions(forMessageIDs: messageIDs)
+
+    for message in messages {
+      let messageAttachments = attachments[message.rowID] ?? []
+      let messageReactions = reactions[message.rowID] ?? []
+      if runtime.jsonOutput {
+        try JSONLines.print(
+          MessagePayload(
+            message: message, attachments: messageAttachments, reactions: messageReactions))
+      } else {
+        MessageCommand.printDetails(
+          message, attachments: messageAttachments, reactions: messageReactions,
+          timestamps: timestamps, labels: labels)
+      }
+    }
+    if !missing.isEmpty {
+      let unique = missing.reduce(into: [String]()) { if !$0.contains($1) { $0.append($1) } }
+      FileHandle.standardError.write(
+        Data("imsg messages: not found: \(unique.joined(separator: ", "))\n".utf8))
+    }
+  }
+
+  /// All values of a repeatable comma-separated option, trimmed, in order.
+  private static func list(_ values: ParsedValues, _ label: String) -> [String] {
+    values.optionValues(label)
+      .flatMap { $0.split(separator: ",") }
+      .map { $0.trimmingCharacters(in: .whitespaces) }
+      .filter { !$0.isEmpty }
+  }
+}
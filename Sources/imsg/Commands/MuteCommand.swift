@@ -0,0 +1,119 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct MutedChatPayload: Codable, Equatable {
+  /// Nil for a muted chat that is no longer in chat.db.
+  let chatID: Int64?
+  let guid: String
+  let name: String
+  let mutedAt: String?
+  /// Set by mute and unmute: false when the chat already was (or wasn't) muted.
+  var changed: Bool?
+
+  init(entry: ChatMuteList.Entry, chatID: Int64?) {
+    self.chatID = chatID
+    self.guid = entry.guid
+    self.name = entry.name
+    self.mutedAt = CLIISO8601.format(entry.mutedAt)
+  }
+
+  /// A `chat.id` of 0 stands for a chat known only by guid.
+  init(chat: ChatInfo, changed: Bool) {
+    self.chatID = chat.id == 0 ? nil : chat.id
+    self.guid = chat.guid
+    self.name = chat.name
+    self.mutedAt = nil
+    self.changed = changed
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case chatID = "chat_id"
+    case guid
+    case name
+    case mutedAt = "muted_at"
+    case changed
+  }
+}
+
+enum MuteCommand {
+  static let spec = CommandSpec(
+    name: "mute",
+    abstract: "Hide a noisy chat from listings and automations",
+    discussion: """
+      Adds the chat to muted.json in the state directory, keyed by chat guid; chat.db is never
+      written. imsg chats hides muted chats unless --all is given, and watch, autoreply, the
+      Matrix bridge and RPC watch.subscribe skip their messages, so rules, webhooks, --exec
+      and notifications never fire for them, even for a chat mapped with bridge --room. Naming
+      a muted chat explicitly (watch or autoreply --chat-id, watch.subscribe chat_ids) still
+      works. Without --chat-id the muted chats are listed. Undo with imsg unmute.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "chatID", names: [.long("chat-id")], help: "chat rowid to mute")
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg mute --chat-id 42",
+      "imsg mute",
+      "imsg mute --json",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    muteListFactory: () throws -> ChatMuteList = { try ChatMuteList() }
+  ) throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let store = try storeFactory(dbPath)
+    let muted = try muteListFactory()
+    guard values.option("chatID") != nil else {
+      try printMuted(muted, store: store, runtime: runtime)
+      return
+    }
+    let chat = try chat(values: values, store: store)
+    let changed = muted.mute(chat)
+    try muted.save()
+    if runtime.jsonOutput {
+      try JSONLines.print(MutedChatPayload(chat: chat, changed: changed))
+    } else {
+      Swift.print(
+        changed ? "muted [\(chat.id)] \(chat.name)" : "[\(chat.id)] \(chat.name) is already muted")
+    }
+  }
+
+  /// The chat `--chat-id` names; throws when it isn't in chat.db.
+  static func chat(values: ParsedValues, store: MessageStore) throws -> ChatInfo {
+    guard let chatID = values.optionInt64("chatID") else {
+      throw ParsedValuesError.invalidOption("chatID")
+    }
+    guard let chat = try store.chatInfo(chatID: chatID) else {
+      throw IMsgError.invalidChatTarget("Unknown chat id \(chatID)")
+    }
+    return chat
+  }
+
+  private static func printMuted(
+    _ muted: ChatMuteList, store: MessageStore, runtime: RuntimeOptions
+  ) throws {
+    for entry in muted.entries {
+      let chatID = try store.chatInfo(identifierOrGUID: entry.guid)?.id
+      if runtime.jsonOutput {
+        try JSONLines.print(MutedChatPayload(entry: entry, chatID: chatID))
+      } else {
+        let id = chatID.map { "[\($0)]" } ?? "[not in chat.db]"
+        Swift.print(
+          "\(id) \(entry.name) (\(entry.guid)) muted \(CLIISO8601.format(entry.mutedAt))")
+      }
+    }
+    if muted.isEmpty && !runtime.jsonOutput {
+      Swift.print("no muted chats")
+    }
+  }
+}
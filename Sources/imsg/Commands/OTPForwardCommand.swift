@@ -0,0 +1,247 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct OTPPayload: Codable, Equatable {
+  let code: String
+  let sender: String
+  let chatID: Int64
+  let messageID: Int64
+  let messageGUID: String
+  let service: String
+  let date: String
+  let expiresAt: String
+
+  init(code: ExtractedItem, service: String, expiresAt: Date) {
+    self.code = code.value
+    self.sender = code.sender
+    self.chatID = code.chatID
+    self.messageID = code.messageRowID
+    self.messageGUID = code.messageGUID
+    self.service = service
+    self.date = CLIISO8601.format(code.date)
+    self.expiresAt = CLIISO8601.format(expiresAt)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case code
+    case sender
+    case chatID = "chat_id"
+    case messageID = "message_id"
+    case messageGUID = "message_guid"
+    case service
+    case date
+    case expiresAt = "expires_at"
+  }
+}
+
+enum OTPForwardError: Error, CustomStringConvertible {
+  case failed(String)
+
+  var description: String {
+    switch self {
+    case .failed(let detail):
+      return detail
+    }
+  }
+}
+
+enum OTPForwardCommand {
+  typealias RunProcess = (
+    _ executable: String, _ arguments: [String], _ environment: [String: String],
+    _ input: String?
+  ) throws -> Void
+
+  static let spec = CommandSpec(
+    name: "otp-forward",
+    abstract: "Forward verification codes from incoming SMS",
+    discussion: """
+      Watches for new incoming messages (from now on), picks out one-time codes with the same
+      patterns as 'imsg extract --kind codes', and delivers just the code: printed, copied to
+      the clipboard with --copy (pbcopy), run through --exec (the code in IMSG_OTP_CODE, the
+      message in the usual IMSG_* variables and the --json line on stdin; like watch --exec,
+      at most --exec-concurrency run at once and each is stopped after --exec-timeout) and
+      POSTed as JSON to --webhook through the webhook queue, so a code sent while the
+      endpoint is down goes out once it answers (see 'imsg webhook-queue'). Only SMS and RCS
+      messages are checked unless --any-service is given. A code whose message is
+      older than --ttl (default 5m), say because the Mac was asleep when it arrived, is
+      dropped rather than delivered, and the same code from the same sender is delivered only
+      once within the TTL. A failed delivery is reported on stderr and never stops the watch.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "chatID", names: [.long("chat-id")], help: "only this chat"),
+          .make(
+            label: "exec", names: [.long("exec")],
+            help: "shell command to run for each code (code in $IMSG_OTP_CODE)"),
+          .make(
+            label: "execConcurrency", names: [.long("exec-concurrency")],
+            help: "max --exec commands running at once (default 4)"),
+          .make(
+            label: "execTimeout", names: [.long("exec-timeout")],
+            help: "terminate an --exec command after this long (default 30s)"),
+          .make(
+            label: "webhook", names: [.long("webhook")],
+            help: "http(s) URL to POST each code to as JSON"),
+          .make(
+            label: "ttl", names: [.long("ttl")],
+            help: "drop codes from messages older than this (default 5m)"),
+          .make(
+            label: "debounce", names: [.long("debounce")],
+            help: "debounce interval for filesystem events (e.g. 250ms)"),
+        ],
+        flags: [
+          .make(label: "copy", names: [.long("copy")], help: "copy each code to the clipboard"),
+          .make(
+            label: "anyService", names: [.long("any-service")],
+            help: "also check iMessage, not only SMS and RCS"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg otp-forward --copy",
+      "imsg otp-forward --webhook https://example.com/otp --ttl 2m",
+      "imsg otp-forward --exec 'echo \"$IMSG_OTP_CODE\" | ssh laptop pbcopy' --json",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    now: @escaping () -> Date = Date.init,
+    runProcess: @escaping RunProcess = OTPForwardCommand.launch,
+    webhooks: WebhookQueue = WebhookQueue(),
+    streamProvider:
+      @escaping (
+        MessageWatcher,
+        Int64?,
+        Int64?,
+        MessageWatcherConfiguration
+      ) -> AsyncThrowingStream<MessageWatchEvent, Error> = {
+        watcher, chatID, sinceRowID, config in
+        watcher.events(chatID: chatID, sinceRowID: sinceRowID, configuration: config)
+      }
+  ) async throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let chatID = values.optionInt64("chatID")
+    guard let ttl = DurationParser.parse(values.option("ttl") ?? "5m"), ttl > 0 else {
+      throw ParsedValuesError.invalidOption("ttl")
+    }
+    guard let debounceInterval = DurationParser.parse(values.option("debounce") ?? "250ms") else {
+      throw ParsedValuesError.invalidOption("debounce")
+    }
+    let execHook = try WatchExecHook.from(
+      values: values, owner: "otp-forward", logger: runtime.automationLogger)
+    var webhook: URL?
+    if let raw = values.option("webhook") {
+      guard let url = URL(string: raw), ["http", "https"].contains(url.scheme?.lowercased())
+      else {
+        throw ParsedValuesError.invalidOption("webhook")
+      }
+      webhook = url
+    }
+    let copy = values.flag("copy")
+    let anyService = values.flag("anyService")
+
+    var store = try storeFactory(dbPath)
+    let watcher = MessageWatcher(store: store)
+    let config = MessageWatcherConfiguration(debounceInterval: debounceInterval, batchLimit: 100)
+    var delivered: [String: Date] = [:]
+    for try await event in streamProvider(watcher, chatID, nil, config) {
+      let message: Message
+      switch event {
+      case .message(let next):
+        message = next
+      case .reconnected(let reconnect):
+        store = reconnect.store
+        continue
+      case .reaction, .edited, .deleted, .receipt, .heartbeat:
+        continue
+      }
+      guard !message.isFromMe else { continue }
+      guard anyService || ["sms", "rcs"].contains(message.service.lowercased()) else { continue }
+      guard let code = MessageExtractor.oneTimeCode(in: message) else { continue }
+
+      let date = now()
+      let expiresAt = message.date.addingTimeInterval(ttl)
+      guard expiresAt > date else {
+        runtime.automationLogger.log(
+          .info, "dropped stale code (message \(message.rowID), older than the TTL)",
+          fields: ["command": "otp-forward"])
+        continue
+      }
+      delivered = delivered.filter { $0.value > date }
+      let key = "\(PhoneNumberNormalizer.shared.normalizeHandle(message.sender))|\(code.value)"
+      guard delivered[key] == nil else { continue }
+      delivered[key] = expiresAt
+
+      let payload = OTPPayload(code: code, service: message.service, expiresAt: expiresAt)
+      if runtime.jsonOutput {
+        try JSONLines.print(payload)
+      } else {
+        Swift.print("\(code.value) from \(bidiIsolated(displayHandle(message.sender)))")
+      }
+      func report(_ action: String, _ error: Error) {
+        runtime.automationLogger.log(
+          error, "\(action) for message \(message.rowID) failed",
+          fields: ["command": "otp-forward"])
+      }
+      if copy {
+        do {
+          try runProcess("/usr/bin/pbcopy", [], ProcessInfo.processInfo.environment, code.value)
+        } catch {
+          report("--copy", error)
+        }
+      }
+      if let execHook {
+        await execHook.submit(message, payload: payload, environment: ["IMSG_OTP_CODE": code.value])
+      }
+      if let webhook {
+        do {
+          let outcome = try await webhooks.deliver(
+            url: webhook, body: try JSONEncoder().encode(payload), rule: nil,
+            messageID: message.rowID)
+          switch outcome {
+          case .delivered:
+            break
+          case .queued(let pending, let error):
+            // Nothing to say when another flush of the same URL simply has it next.
+            guard let error else { break }
+            throw OTPForwardError.failed("\(error); queued, \(pending) waiting")
+          case .rejected(let statusCode):
+            throw OTPForwardError.failed("returned \(statusCode); not retrying")
+          }
+        } catch {
+          report("--webhook", error)
+        }
+      }
+    }
+    await execHook?.finish()
+  }
+
+  /// Runs `executable` to completion with `input` on stdin; throws when it exits non-zero.
+  static func launch(
+    executable: String, arguments: [String], environment: [String: String], input: String?
+  ) throws {
+    let process = Process()
+    process.executableURL = URL(fileURLWithPath: executable)
+    process.arguments = arguments
+    process.environment = environment
+    let pipe = Pipe()
+    process.standardInput = input == nil ? FileHandle.nullDevice : pipe
+    try process.run()
+    if let input {
+      pipe.fileHandleForWriting.write(Data(input.utf8))
+      try? pipe.fileHandleForWriting.close()
+    }
+    process.waitUntilExit()
+    if process.terminationStatus != 0 {
+      throw OTPForwardError.failed(
+        "\(executable) exited with status \(process.terminationStatus)")
+    }
+  }
+}
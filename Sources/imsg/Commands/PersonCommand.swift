@@ -0,0 +1,177 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct PersonChatPayload: Codable, Equatable {
+  let id: Int64
+  let name: String
+  let identifier: String
+  let service: String
+  let isGroup: Bool
+  let participants: [String]
+  let messages: Int
+  let fromPerson: Int
+  let attachments: Int
+  let attachmentBytes: Int64
+  let firstMessageAt: String?
+  let lastMessageAt: String?
+
+  init(chat: PersonChat) {
+    self.id = chat.chat.id
+    self.name = chat.chat.name
+    self.identifier = chat.chat.identifier
+    self.service = chat.chat.service
+    self.isGroup = chat.isGroup
+    self.participants = chat.participants
+    self.messages = chat.messages
+    self.fromPerson = chat.fromPerson
+    self.attachments = chat.attachments
+    self.attachmentBytes = chat.attachmentBytes
+    self.firstMessageAt = chat.firstDate.map(CLIISO8601.format)
+    self.lastMessageAt = chat.lastDate.map(CLIISO8601.format)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case id
+    case name
+    case identifier
+    case service
+    case isGroup = "is_group"
+    case participants
+    case messages
+    case fromPerson = "from_person"
+    case attachments
+    case attachmentBytes = "attachment_bytes"
+    case firstMessageAt = "first_message_at"
+    case lastMessageAt = "last_message_at"
+  }
+}
+
+struct PersonPayload: Codable, Equatable {
+  let handle: String
+  let handles: [String]
+  let messages: Int
+  let fromPerson: Int
+  let firstMessageAt: String?
+  let lastMessageAt: String?
+  let attachments: Int
+  let attachmentBytes: Int64
+  let attachmentKinds: [String: Int]
+  let chats: [PersonChatPayload]
+
+  init(person: PersonSummary) {
+    self.handle = person.handle
+    self.handles = person.handleIDs
+    self.messages = person.messages
+    self.fromPerson = person.fromPerson
+    self.firstMessageAt = person.firstDate.map(CLIISO8601.format)
+    self.lastMessageAt = person.lastDate.map(CLIISO8601.format)
+    self.attachments = person.attachments
+    self.attachmentBytes = person.attachmentBytes
+    self.attachmentKinds = person.attachmentKinds
+    self.chats = person.chats.map(PersonChatPayload.init)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case handle
+    case handles
+    case messages
+    case fromPerson = "from_person"
+    case firstMessageAt = "first_message_at"
+    case lastMessageAt = "last_message_at"
+    case attachments
+    case attachmentBytes = "attachment_bytes"
+    case attachmentKinds = "attachment_kinds"
+    case chats
+  }
+}
+
+enum PersonCommand {
+  static let spec = CommandSpec(
+    name: "person",
+    abstract: "Show every chat with one person",
+    discussion: """
+      Looks up --handle (a phone number, normalized with --region, or an email) and lists
+      every chat it is part of, one-to-one and group alike, most recently active first, with
+      the number of messages (tapbacks not counted), how many of them the person sent, the
+      first and last message dates, and the attachments in the chat. The summary on top
+      totals them and breaks the attachments down into images, video, audio and other; an
+      attachment in two chats counts once there. Handles stored in different forms (+1 415…
+      and 415…) are combined.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(
+            label: "handle", names: [.long("handle")], help: "phone number or email to look up"),
+          .make(
+            label: "region", names: [.long("region")],
+            help: "default region for phone numbers (default US)"),
+        ] + TimestampFormatter.options()
+      )
+    ),
+    usageExamples: [
+      "imsg person --handle +14155551212",
+      "imsg person --handle friend@example.com --json",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) }
+  ) throws {
+    guard let handle = values.option("handle"), !handle.isEmpty else {
+      throw ParsedValuesError.missingOption("handle")
+    }
+    let timestamps = try TimestampFormatter.from(values: values)
+    let store = try storeFactory(try CommandSignatures.databasePath(from: values))
+    guard
+      let person = try store.person(handle: handle, region: values.option("region") ?? "US")
+    else {
+      throw IMsgError.invalidChatTarget("No chats with \(handle)")
+    }
+    if runtime.jsonOutput {
+      try JSONLines.print(PersonPayload(person: person))
+      return
+    }
+
+    let others = person.handleIDs.filter { $0 != person.handle }
+    Swift.print(
+      displayHandle(person.handle)
+        + (others.isEmpty ? "" : " (also stored as \(others.joined(separator: ", ")))"))
+    var summary =
+      "\(person.chats.count) chat\(pluralSuffix(for: person.chats.count)), "
+      + "\(person.messages) message\(pluralSuffix(for: person.messages)) "
+      + "(\(person.fromPerson) from them)"
+    if let first = person.firstDate, let last = person.lastDate {
+      summary += ", \(timestamps.format(first)) to \(timestamps.format(last))"
+    }
+    Swift.print(summary)
+    if person.attachments > 0 {
+      let kinds = ["image", "video", "audio", "other"].compactMap { kind in
+        person.attachmentKinds[kind].map { "\($0) \(kind)" }
+      }
+      Swift.print(
+        "attachments: \(person.attachments) (\(kinds.joined(separator: ", "))), "
+          + AuditCommand.formatBytes(person.attachmentBytes))
+    }
+    for chat in person.chats {
+      let title = chat.chat.name.isEmpty ? chat.chat.identifier : chat.chat.name
+      var line = "[\(chat.chat.id)] \(displayHandle(title))"
+      if chat.isGroup {
+        line += " (group, \(chat.participants.count) people)"
+      }
+      line += " messages=\(chat.messages) from-them=\(chat.fromPerson)"
+      if chat.attachments > 0 {
+        line += " attachments=\(chat.attachments)"
+      }
+      if let first = chat.firstDate, let last = chat.lastDate {
+        line += " first=\(timestamps.format(first)) last=\(timestamps.format(last))"
+      }
+      Swift.print(line)
+    }
+  }
+}
@@ -0,0 +1,105 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum ReactError: Error, CustomStringConvertible {
+  case noText(String)
+  case tooOld(String, window: Int)
+
+  var description: String {
+    switch self {
+    case .noText(let guid):
+      return "react: \(guid) has no text to find its bubble by in the Messages window"
+    case .tooOld(let guid, let window):
+      return "react: \(guid) is not among the newest \(window) messages of its chat, so "
+        + "Messages doesn't show it without scrolling back"
+    }
+  }
+}
+
+struct ReactResult: Codable {
+  let status: String
+  let messageGUID: String
+  let type: String
+
+  enum CodingKeys: String, CodingKey {
+    case status
+    case messageGUID = "message_guid"
+    case type
+  }
+}
+
+enum ReactCommand {
+  /// Messages only keeps the recent part of a transcript in its window.
+  static let recentWindow = 200
+
+  static let spec = CommandSpec(
+    name: "react",
+    abstract: "Send a tapback to a message",
+    discussion: """
+      Messages has no AppleScript command for tapbacks, so react drives the Messages UI
+      through System Events: it opens the chat (one-to-one or group), finds the message's
+      bubble by its text, counting repeats from the bottom, and picks Tapback from the
+      bubble's menu. Your terminal needs Accessibility permission and Messages comes to the
+      front. The message needs text and has to be among the newest \(recentWindow) in its chat.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "messageGUID", names: [.long("message-guid")], help: "message guid"),
+          .make(
+            label: "type", names: [.long("type")],
+            help: "like|love|laugh|emphasize|question|dislike"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg react --message-guid 5A1B2C3D-0000-4E5F-8A9B-112233445566 --type love"
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    sendTapback: ((ReactionType, TapbackTarget) throws -> Void)? = nil
+  ) async throws {
+    guard let guid = values.option("messageGUID") else {
+      throw ParsedValuesError.missingOption("message-guid")
+    }
+    guard let typeRaw = values.option("type") else {
+      throw ParsedValuesError.missingOption("type")
+    }
+    guard let reaction = ReactionType.parse(typeRaw), !reaction.isCustom else {
+      throw ParsedValuesError.invalidOption("type")
+    }
+    let logger = runtime.automationLogger
+    let sendTapback =
+      sendTapback ?? { try TapbackSender(logger: logger).react($0, to: $1) }
+
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let store = try storeFactory(dbPath)
+    guard let message = try store.message(guid: guid) else {
+      throw IMsgError.messageNotFound(guid)
+    }
+    guard !TapbackTarget.bubbleText(message.text).isEmpty else {
+      throw ReactError.noText(guid)
+    }
+    let recent = try store.messages(chatID: message.chatID, limit: recentWindow)
+    guard
+      let target = TapbackTarget.locate(
+        message, recent: recent, participants: try store.participants(chatID: message.chatID))
+    else {
+      throw ReactError.tooOld(guid, window: recentWindow)
+    }
+
+    try sendTapback(reaction, target)
+    if runtime.jsonOutput {
+      try JSONLines.print(ReactResult(status: "sent", messageGUID: guid, type: reaction.name))
+    } else {
+      Swift.print("sent \(reaction.emoji) to \(guid)")
+    }
+  }
+}
@@ -8,16 +8,38 @@ enum RpcCommand {
     abstract: "Run JSON-RPC over stdin/stdout",
     discussion: nil,
     signature: CommandSignatures.withRuntimeFlags(
-      CommandSignature(options: CommandSignatures.baseOptions())
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(
+            label: "warmChats", names: [.long("warm-chats")],
+            help: "preload metadata for this many recent chats at startup (default 50, 0 disables)"
+          ),
+          .make(
+            label: "warmMessages", names: [.long("warm-messages")],
+            help: "with --warm-chats, also read each chat's last N messages (default 20)"),
+        ]
+      )
     ),
     usageExamples: [
       "imsg rpc",
       "imsg rpc --db ~/Library/Messages/chat.db",
+      "imsg rpc --warm-chats 200 --verbose",
+      "imsg rpc --warm-chats 20 --warm-messages 100",
     ]
   ) { values, runtime in
-    let dbPath = values.option("db") ?? MessageStore.defaultPath
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let warmChats = values.optionInt("warmChats") ?? 50
+    let warmMessages = values.optionInt("warmMessages") ?? 20
     let store = try MessageStore(path: dbPath)
-    let server = RPCServer(store: store, verbose: runtime.verbose)
+    let sender = MessageSender(logger: runtime.automationLogger)
+    let server = RPCServer(
+      store: store,
+      logger: runtime.automationLogger,
+      warmChatLimit: warmChats,
+      warmMessageLimit: warmMessages,
+      sendMessage: { try sender.send($0) },
+      journal: SendJournal()
+    )
     try await server.run()
   }
 }
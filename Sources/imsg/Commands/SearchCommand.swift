@@ -0,0 +1,195 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum SearchType: String, CaseIterable {
+  case chats
+  case messages
+  case attachments
+}
+
+struct AttachmentHitPayload: Codable {
+  let messageID: Int64
+  let chatID: Int64
+  let sender: String
+  let isFromMe: Bool
+  let createdAt: String
+  let file: AttachmentPayload
+
+  init(match: AttachmentMatch) {
+    self.messageID = match.messageRowID
+    self.chatID = match.chatID
+    self.sender = match.sender
+    self.isFromMe = match.isFromMe
+    self.createdAt = CLIISO8601.format(match.date)
+    self.file = AttachmentPayload(meta: match.meta)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case messageID = "message_id"
+    case chatID = "chat_id"
+    case sender
+    case isFromMe = "is_from_me"
+    case createdAt = "created_at"
+    case file
+  }
+}
+
+/// One search result as JSON: `type` says which of the other fields is set.
+struct SearchHitPayload: Codable {
+  let type: String
+  var chat: ChatPayload?
+  var message: MessagePayload?
+  var attachment: AttachmentHitPayload?
+}
+
+enum SearchHit {
+  case chat(Chat)
+  case message(Message)
+  case attachment(AttachmentMatch)
+
+  var payload: SearchHitPayload {
+    switch self {
+    case .chat(let chat):
+      return SearchHitPayload(type: "chat", chat: ChatPayload(chat: chat))
+    case .message(let message):
+      return SearchHitPayload(
+        type: "message", message: MessagePayload(message: message, attachments: []))
+    case .attachment(let match):
+      return SearchHitPayload(type: "attachment", attachment: AttachmentHitPayload(match: match))
+    }
+  }
+}
+
+enum SearchCommand {
+  static let spec = CommandSpec(
+    name: "search",
+    abstract: "Search chats, messages, and attachment file names",
+    discussion: """
+      Matches the query as a case-insensitive substring against chat display names,
+      identifiers and participant handles (chats), message text (messages), and attachment
+      file names (attachments). Chats also match when a participant's name in Contacts does
+      (asked for Contacts access once on a terminal). Without --type all three are searched,
+      each up to --limit results (default 20), newest first. --json prints one object per
+      result with a type of chat, message or attachment and the matching object under that
+      key.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        arguments: [.make(label: "query", help: "text to look for")],
+        options: CommandSignatures.baseOptions() + [
+          .make(
+            label: "type", names: [.long("type")],
+            help: "what to search: chats|messages|attachments (default all; repeatable)"),
+          .make(
+            label: "chatID", names: [.long("chat-id")],
+            help: "only messages and attachments in this chat"),
+          .make(label: "limit", names: [.long("limit")], help: "results per type (default 20)"),
+        ] + TimestampFormatter.options()
+      )
+    ),
+    usageExamples: [
+      "imsg search dinner",
+      "imsg search '+44' --type chats",
+      "imsg search invoice --type attachments --json",
+      "imsg search 'flight' --type messages --chat-id 1 --limit 5",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) }
+  ) throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    guard let query = values.argument(0)?.trimmingCharacters(in: .whitespaces), !query.isEmpty
+    else {
+      throw ParsedValuesError.missingOption("query")
+    }
+    var types = SearchType.allCases
+    let requested = values.optionValues("type").flatMap { $0.split(separator: ",") }
+    if !requested.isEmpty {
+      types = try requested.map { raw in
+        guard let type = SearchType(rawValue: raw.trimmingCharacters(in: .whitespaces)) else {
+          throw ParsedValuesError.invalidOption("type")
+        }
+        return type
+      }
+      types = SearchType.allCases.filter(types.contains)
+    }
+    var limit = 20
+    if values.option("limit") != nil {
+      guard let parsed = values.optionInt("limit"), parsed > 0 else {
+        throw ParsedValuesError.invalidOption("limit")
+      }
+      limit = parsed
+    }
+    let chatID = values.optionInt64("chatID")
+    let timestamps = try TimestampFormatter.from(values: values)
+    let store = try storeFactory(dbPath)
+    if types.contains(.chats), ChatPicker.isInteractive {
+      ContactNames.requestAccess()
+    }
+    let hits = try search(query, types: types, chatID: chatID, limit: limit, store: store)
+
+    if runtime.jsonOutput {
+      for hit in hits {
+        try JSONLines.print(hit.payload)
+      }
+      return
+    }
+    for hit in hits {
+      Swift.print(textLine(for: hit, timestamps: timestamps))
+    }
+  }
+
+  /// Chats, then messages, then attachments, each newest first. `contactHandles` gives the
+  /// handles of the contacts whose name matches the query, whose chats are matched too.
+  static func search(
+    _ query: String, types: [SearchType], chatID: Int64?, limit: Int, store: MessageStore,
+    contactHandles: (String) -> [String] = ContactNames.handles(matchingName:)
+  ) throws -> [SearchHit] {
+    var hits: [SearchHit] = []
+    for type in types {
+      switch type {
+      case .chats:
+        // --chat-id narrows messages and attachments; chats are matched on their own.
+        var chats = try store.listChats(limit: limit, matching: query)
+        var seen = Set(chats.map(\.id))
+        for handle in contactHandles(query) {
+          for chat in try store.listChats(limit: limit, participant: handle)
+          where seen.insert(chat.id).inserted {
+            chats.append(chat)
+          }
+        }
+        chats.sort { $0.lastMessageAt > $1.lastMessageAt }
+        hits += chats.prefix(limit).map(SearchHit.chat)
+      case .messages:
+        hits += try store.searchMessages(query: query, chatID: chatID, limit: limit)
+          .map(SearchHit.message)
+      case .attachments:
+        hits += try store.searchAttachments(query: query, chatID: chatID, limit: limit)
+          .map(SearchHit.attachment)
+      }
+    }
+    return hits
+  }
+
+  static func textLine(for hit: SearchHit, timestamps: TimestampFormatter) -> String {
+    switch hit {
+    case .chat(let chat):
+      return "chat [\(chat.id)] \(chat.name) (\(displayHandle(chat.identifier)))"
+    case .message(let message):
+      let sender = message.isFromMe ? "me" : displayHandle(message.sender)
+      return "message \(timestamps.format(message.date)) chat=\(message.chatID) "
+        + "id=\(message.rowID) \(sender): \(displayText(for: message))"
+    case .attachment(let match):
+      let missing = match.meta.missing ? " (missing)" : ""
+      return "attachment \(timestamps.format(match.date)) chat=\(match.chatID) "
+        + "id=\(match.messageRowID) \(displayName(for: match.meta)) "
+        + "\(match.meta.originalPath)\(missing)"
+    }
+  }
+}
@@ -0,0 +1,113 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct SelfUpdatePayload: Codable, Equatable {
+  let channel: String
+  let currentVersion: String
+  let latestVersion: String
+  let status: String
+  let releaseURL: String?
+  let path: String
+
+  enum CodingKeys: String, CodingKey {
+    case channel
+    case currentVersion = "current_version"
+    case latestVersion = "latest_version"
+    case status
+    case releaseURL = "release_url"
+    case path
+  }
+}
+
+enum SelfUpdateCommand {
+  static let spec = CommandSpec(
+    name: "selfupdate",
+    abstract: "Update imsg to the newest GitHub release",
+    discussion: """
+      Checks github.com/\(SelfUpdater.repository) for a newer release and installs it over the
+      running binary. The download must match the SHA-256 published with the release and be
+      signed with the imsg Developer ID (checked with codesign), or nothing is replaced. The
+      new binary is written next to the old one and renamed over it, so an interrupted update
+      leaves the old imsg in place. --channel edge also considers prereleases. --check only
+      reports whether an update is available. An imsg installed with Homebrew is left to
+      `brew upgrade imsg`.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: [
+          .make(
+            label: "channel", names: [.long("channel")],
+            help: "stable|edge (default stable; edge includes prereleases)")
+        ],
+        flags: [
+          .make(label: "check", names: [.long("check")], help: "only report available updates")
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg selfupdate",
+      "imsg selfupdate --check --json",
+      "imsg selfupdate --channel edge",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    currentVersion: String = IMsgVersion.current,
+    updater: SelfUpdater = SelfUpdater(
+      executableURL: URL(fileURLWithPath: ServiceCommand.currentExecutablePath()))
+  ) async throws {
+    let rawChannel = values.option("channel") ?? ReleaseChannel.stable.rawValue
+    guard let channel = ReleaseChannel(rawValue: rawChannel.lowercased()) else {
+      throw ParsedValuesError.invalidOption("channel")
+    }
+    let check = values.flag("check")
+    let path = updater.executableURL.path
+    let homebrew = SelfUpdater.isHomebrewManaged(updater.executableURL)
+    if homebrew && !check {
+      throw SelfUpdateError.homebrew(path: path)
+    }
+
+    guard let release = try await updater.latestRelease(channel: channel),
+      let latest = release.version
+    else {
+      throw SelfUpdateError.noRelease(channel: channel)
+    }
+    let current = ReleaseVersion(currentVersion)
+    let status: String
+    if let current, latest <= current {
+      status = "up_to_date"
+    } else if check {
+      status = "available"
+    } else {
+      try await updater.install(release)
+      status = "updated"
+    }
+
+    if runtime.jsonOutput {
+      try JSONLines.print(
+        SelfUpdatePayload(
+          channel: channel.rawValue, currentVersion: currentVersion,
+          latestVersion: latest.description, status: status,
+          releaseURL: release.htmlURL?.absoluteString, path: path))
+      return
+    }
+    switch status {
+    case "up_to_date":
+      Swift.print("imsg \(currentVersion) is up to date (\(channel.rawValue))")
+    case "available":
+      var line = "imsg \(latest) is available (\(channel.rawValue); you have \(currentVersion))"
+      if let url = release.htmlURL { line += ": \(url.absoluteString)" }
+      Swift.print(line)
+      if homebrew {
+        Swift.print("  installed with Homebrew; run `brew upgrade imsg`")
+      }
+    default:
+      Swift.print("updated imsg \(currentVersion) → \(latest) at \(path)")
+    }
+  }
+}
@@ -2,27 +2,120 @@ import Commander
 import Foundation
 import IMsgCore
 
+enum QuietHoursError: Error, CustomStringConvertible {
+  /// A send made inside `--quiet-hours`, which end at `until`.
+  case active(until: Date)
+
+  var description: String {
+    switch self {
+    case .active(let until):
+      let formatter = DateFormatter()
+      formatter.dateFormat = "HH:mm"
+      return
+        "quiet hours until \(formatter.string(from: until)); nothing was sent (send again "
+        + "then, or pass --ignore-quiet-hours to send now)"
+    }
+  }
+}
+
 enum SendCommand {
   static let spec = CommandSpec(
     name: "send",
     abstract: "Send a message (text and/or attachment)",
-    discussion: nil,
+    discussion: """
+      --to accepts one handle, several comma-separated handles, or a group chat identifier
+      (chat123456 / iMessage;+;chat123456), and may be repeated. Several handles that exactly
+      match an existing group's participants reuse that thread; --force-new starts a new group
+      instead. --group requires at least two participants; --group-name names a new group and
+      only reuses an existing group with that name.
+      Every attempt is journaled to sends.jsonl in ~/Library/Application Support/imsg (or
+      $IMSG_STATE_DIR). Repeating a send with the same --idempotency-key after it succeeded
+      is a no-op, so retries from cron or scripts never double-send.
+      --quiet-hours (or quiet_hours in config.yaml in the state directory) refuses a send made
+      inside the window and says when it ends; --ignore-quiet-hours sends right away.
+      --file may be repeated and accepts globs (quote them so imsg expands them); every file
+      is checked up front (exists, not empty, at most --max-size, default 100MB; over SMS only
+      media and contacts) and sent after the text in order. --transcode re-encodes images and
+      videos over --max-size (JPEG at --image-quality, default 80; smaller MP4 presets) instead
+      of refusing them, once quiet hours and --idempotency-key have let the send through, and
+      deletes the re-encoded copies afterwards. Once sent, imsg waits up to 10s for Messages
+      to record the files and prints each one's message and attachment guid.
+      --retries retries a send that failed because Messages wasn't running or quit mid-send,
+      waiting --retry-backoff (default 1s) and doubling it each time, with jitter. An Apple
+      event timeout may still have delivered the message, so it is only retried when the send
+      has an --idempotency-key. Invalid recipients and other permanent errors fail at once.
+      Each attempt is journaled. Scripts run one at a time, at least 0.25s apart, across imsg
+      processes; after 5 transient failures in a row imsg stops sending for 30s and fails with
+      E_SEND_BACKOFF.
+      --backend native (or $IMSG_SEND_BACKEND=native) sends through the imsg-send-helper
+      binary shipped next to imsg, which drives Messages with ScriptingBridge instead of
+      compiled AppleScript; $IMSG_SEND_HELPER points at a different helper.
+      --from picks the Messages account a new conversation is sent from when several are
+      signed in, by the id or name imsg accounts lists (an Apple ID email works). It sets
+      --service to match the account. Existing chats keep the account they were started on,
+      so --from can't be combined with a chat target or a reused group (add --force-new).
+      On a terminal imsg shows who the message goes to (the normalized number or email, with
+      the contact's name when Contacts access is granted), the service and a preview, and
+      sends only after you answer y. --yes skips the question; scripts and pipes never see it.
+      """,
     signature: CommandSignatures.withRuntimeFlags(
       CommandSignature(
         options: CommandSignatures.baseOptions() + [
-          .make(label: "to", names: [.long("to")], help: "phone number or email"),
+          .make(
+            label: "to", names: [.long("to")],
+            help: "phone number, email, comma-separated handles, or group chat identifier"),
+          .make(
+            label: "groupName", names: [.long("group-name")],
+            help: "name for the group thread (with --group)"),
           .make(label: "chatID", names: [.long("chat-id")], help: "chat rowid"),
           .make(
             label: "chatIdentifier", names: [.long("chat-identifier")],
             help: "chat identifier (e.g. iMessage;+;chat...)"),
           .make(label: "chatGUID", names: [.long("chat-guid")], help: "chat guid"),
           .make(label: "text", names: [.long("text")], help: "message body"),
-          .make(label: "file", names: [.long("file")], help: "path to attachment"),
+          .make(
+            label: "file", names: [.long("file")],
+            help: "path or glob of a file to attach; repeatable"),
+          .make(
+            label: "maxSize", names: [.long("max-size")],
+            help: "largest attachment to send (default 100MB)"),
+          .make(
+            label: "imageQuality", names: [.long("image-quality")],
+            help: "JPEG quality 1-100 for --transcode (default 80)"),
           .make(
             label: "service", names: [.long("service")], help: "service to use: imessage|sms|auto"),
+          .make(
+            label: "from", names: [.long("from")],
+            help: "account id or name to send from (see imsg accounts)"),
           .make(
             label: "region", names: [.long("region")],
             help: "default region for phone normalization"),
+          .make(
+            label: "backend", names: [.long("backend")],
+            help: "how to send: applescript|native (default applescript, $IMSG_SEND_BACKEND)"),
+          .make(
+            label: "idempotencyKey", names: [.long("idempotency-key")],
+            help: "skip the send if this key was already sent successfully"),
+          .make(
+            label: "quietHours", names: [.long("quiet-hours")],
+            help: "local window to refuse sends in, e.g. 22:00-08:00 (default: config.yaml)"),
+        ] + retryOptions(),
+        flags: [
+          .make(
+            label: "group", names: [.long("group")],
+            help: "send to one group thread with all --to participants"),
+          .make(
+            label: "forceNew", names: [.long("force-new")],
+            help: "start a new group thread even if one with these participants exists"),
+          .make(
+            label: "ignoreQuietHours", names: [.long("ignore-quiet-hours")],
+            help: "send now even inside quiet hours"),
+          .make(
+            label: "transcode", names: [.long("transcode")],
+            help: "shrink images/videos over --max-size instead of refusing them"),
+          .make(
+            label: "yes", names: [.long("yes"), .short("y")],
+            help: "send without asking for confirmation on a terminal"),
         ]
       )
     ),
@@ -30,6 +123,17 @@ enum SendCommand {
       "imsg send --to +14155551212 --text \"hi\"",
       "imsg send --to +14155551212 --text \"hi\" --file ~/Desktop/pic.jpg --service imessage",
       "imsg send --chat-id 1 --text \"hi\"",
+      "imsg send --chat-id 1 --text \"trip\" --file ~/Desktop/a.jpg --file '~/Trip/*.heic'",
+      "imsg send --to +14155551212 --file ~/Movies/clip.mov --transcode --max-size 50MB",
+      "imsg send --to +14155551212,+14155550000 --text \"dinner?\"",
+      "imsg send --to +14155551212 --to a@example.com --group --group-name Dinner --text hi",
+      "imsg send --to +14155551212 --text \"hi\" --log-level trace",
+      "imsg send --to +14155551212 --text \"standup\" --idempotency-key standup-2026-10-19",
+      "imsg send --to +14155551212 --text \"report ready\" --quiet-hours 22:00-08:00",
+      "imsg send --to +14155551212 --text \"hi\" --retries 3 --retry-backoff 2s",
+      "imsg send --to +14155551212 --text \"hi\" --backend native",
+      "imsg send --to +14155551212 --text \"hi\" --from work@example.com",
+      "imsg send --to +14155551212 --text \"on my way\" --yes",
     ]
   ) { values, runtime in
     try await run(values: values, runtime: runtime)
@@ -38,35 +142,141 @@ enum SendCommand {
   static func run(
     values: ParsedValues,
     runtime: RuntimeOptions,
-    sendMessage: @escaping (MessageSendOptions) throws -> Void = { try MessageSender().send($0) },
-    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) }
+    sendMessage: ((MessageSendOptions) throws -> Void)? = nil,
+    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    accountsProvider: () throws -> [MessagesAccount] = { try MessagesAutomation.accounts() },
+    journal: SendJournal = SendJournal(),
+    confirm: ((String) -> Bool)? = nil,
+    environment: [String: String] = ProcessInfo.processInfo.environment,
+    config: () throws -> IMsgConfig = { try IMsgConfig.load() },
+    now: @escaping () -> Date = Date.init,
+    sleep: @escaping (TimeInterval) async throws -> Void = {
+      try await Task.sleep(nanoseconds: UInt64($0 * 1_000_000_000))
+    }
   ) async throws {
-    let dbPath = values.option("db") ?? MessageStore.defaultPath
-    let recipient = values.option("to") ?? ""
+    let logger = runtime.automationLogger
+    let backendRaw =
+      values.option("backend") ?? environment[backendEnvironmentKey]
+      ?? SendBackend.applescript.rawValue
+    guard let backend = SendBackend(rawValue: backendRaw.lowercased()) else {
+      throw ParsedValuesError.invalidOption("backend")
+    }
+    // A stubbed sender sends nothing, so only the real one asks on a terminal.
+    let asksOnTerminal = confirm == nil && sendMessage == nil && ChatPicker.isInteractive
+    let confirm = confirm ?? (asksOnTerminal ? askOnTerminal : nil)
+    let sendMessage =
+      sendMessage ?? { try MessageSender(logger: logger, backend: backend).send($0) }
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let region = values.option("region") ?? "US"
+    // Drop repeats like "+1 555 123 4567" vs "+15551234567" but keep what the user typed.
+    let normalizer = PhoneNumberNormalizer.shared
+    var seenHandles = Set<String>()
+    let handles = values.optionValues("to")
+      .flatMap { $0.split(separator: ",") }
+      .map { $0.trimmingCharacters(in: .whitespaces) }
+      .filter { !$0.isEmpty }
+      .filter {
+        seenHandles.insert(normalizer.normalizeHandle($0, region: region)).inserted
+      }
+    let forceNew = values.flag("forceNew")
+    let groupName = values.option("groupName") ?? ""
+    if values.flag("group") && handles.count < 2 {
+      throw ParsedValuesError.invalidOption("group")
+    }
+    if !groupName.isEmpty && handles.count < 2 {
+      throw ParsedValuesError.invalidOption("group-name")
+    }
+    var recipient = handles.count == 1 ? handles[0] : ""
     let chatID = values.optionInt64("chatID")
     let chatIdentifier = values.option("chatIdentifier") ?? ""
     let chatGUID = values.option("chatGUID") ?? ""
     let hasChatTarget = chatID != nil || !chatIdentifier.isEmpty || !chatGUID.isEmpty
-    if hasChatTarget && !recipient.isEmpty {
+    if hasChatTarget && !handles.isEmpty {
       throw ParsedValuesError.invalidOption("to")
     }
-    if !hasChatTarget && recipient.isEmpty {
+    if !hasChatTarget && handles.isEmpty {
       throw ParsedValuesError.missingOption("to")
     }
 
     let text = values.option("text") ?? ""
-    let file = values.option("file") ?? ""
-    if text.isEmpty && file.isEmpty {
-      throw ParsedValuesError.missingOption("text or file")
-    }
     let serviceRaw = values.option("service") ?? "auto"
-    guard let service = MessageService(rawValue: serviceRaw) else {
+    guard var service = MessageService(rawValue: serviceRaw) else {
       throw IMsgError.invalidService(serviceRaw)
     }
-    let region = values.option("region") ?? "US"
+    var account: MessagesAccount?
+    if let from = values.option("from") {
+      if hasChatTarget || (handles.count == 1 && looksLikeChatIdentifier(recipient)) {
+        throw ParsedValuesError.invalidOption("from")
+      }
+      let resolved = try sendingAccount(from, service: service, accounts: accountsProvider())
+      service = resolved.isSMS ? .sms : .imessage
+      account = resolved
+    }
+    var maxBytes = SendAttachments.maxBytes
+    if let raw = values.option("maxSize") {
+      guard let parsed = ByteSizeParser.parse(raw) else {
+        throw ParsedValuesError.invalidOption("max-size")
+      }
+      maxBytes = parsed
+    }
+    let imageQuality = values.optionInt("imageQuality") ?? 80
+    guard (1...100).contains(imageQuality) else {
+      throw ParsedValuesError.invalidOption("image-quality")
+    }
+    let transcode = values.flag("transcode")
+    var attachments = try SendAttachments.resolve(
+      values.optionValues("file"), maxBytes: maxBytes, service: service,
+      allowOversizedMedia: transcode)
+    if text.isEmpty && attachments.isEmpty {
+      throw ParsedValuesError.missingOption("text or file")
+    }
+    var quietHours: QuietHours?
+    if let spec = values.option("quietHours") {
+      guard let parsed = QuietHours(spec) else {
+        throw ParsedValuesError.invalidOption("quiet-hours")
+      }
+      quietHours = parsed
+    } else if let spec = try config().quietHours, !spec.isEmpty {
+      guard let parsed = QuietHours(spec) else {
+        throw IMsgConfigError.invalid("quiet_hours must look like 22:00-08:00, not \(spec)")
+      }
+      quietHours = parsed
+    }
+    let retryPolicy = try retryPolicy(from: values)
 
     var resolvedChatIdentifier = chatIdentifier
     var resolvedChatGUID = chatGUID
+    var groupRecipients: [String] = []
+    var chatName = ""
+    if handles.count == 1 && looksLikeChatIdentifier(recipient) {
+      if forceNew {
+        throw ParsedValuesError.invalidOption("force-new")
+      }
+      let store = try storeFactory(dbPath)
+      guard let info = try store.chatInfo(identifierOrGUID: recipient) else {
+        throw IMsgError.invalidChatTarget("No chat matches \(recipient)")
+      }
+      recipient = ""
+      resolvedChatIdentifier = info.identifier
+      resolvedChatGUID = info.guid
+      chatName = info.name
+    } else if handles.count > 1 {
+      var existing: ChatInfo?
+      if !forceNew {
+        existing = try storeFactory(dbPath).groupChat(
+          participants: handles, region: region, name: groupName.isEmpty ? nil : groupName)
+      }
+      if let existing {
+        if account != nil {
+          throw ParsedValuesError.invalidOption("from")
+        }
+        resolvedChatIdentifier = existing.identifier
+        resolvedChatGUID = existing.guid
+        chatName = existing.name
+      } else {
+        groupRecipients = handles
+      }
+    }
     if let chatID {
       let store = try storeFactory(dbPath)
       guard let info = try store.chatInfo(chatID: chatID) else {
@@ -74,26 +284,280 @@ enum SendCommand {
       }
       resolvedChatIdentifier = info.identifier
       resolvedChatGUID = info.guid
+      chatName = info.name
     }
     if hasChatTarget && resolvedChatIdentifier.isEmpty && resolvedChatGUID.isEmpty {
       throw IMsgError.invalidChatTarget("Missing chat identifier or guid")
     }
 
-    try sendMessage(
-      MessageSendOptions(
-        recipient: recipient,
-        text: text,
-        attachmentPath: file,
-        service: service,
-        region: region,
-        chatIdentifier: resolvedChatIdentifier,
-        chatGUID: resolvedChatGUID
-      ))
+    var options = MessageSendOptions(
+      recipient: recipient,
+      text: text,
+      attachmentPaths: attachments.map(\.path),
+      service: service,
+      region: region,
+      chatIdentifier: resolvedChatIdentifier,
+      chatGUID: resolvedChatGUID,
+      groupRecipients: groupRecipients,
+      groupName: groupRecipients.isEmpty ? "" : groupName,
+      accountID: account?.id ?? ""
+    )
+    // Refused rather than waited out: a process sleeping for hours is easy to kill or forget,
+    // and whoever scheduled the send can run it again once the window ends.
+    if !values.flag("ignoreQuietHours"), let quietHours,
+      let end = quietHours.end(containing: now())
+    {
+      throw QuietHoursError.active(until: end)
+    }
+    let idempotencyKey = values.option("idempotencyKey")
+    if let idempotencyKey, try journal.hasSent(idempotencyKey: idempotencyKey) {
+      try printDuplicate(idempotencyKey, runtime: runtime)
+      return
+    }
+    // Asked last, so a send that quiet hours or the journal would stop never prompts.
+    if !values.flag("yes"), let confirm {
+      if asksOnTerminal {
+        ContactNames.requestAccess()
+      }
+      let prompt = confirmationPrompt(
+        for: options, account: account, chatName: chatName, nameLookup: ContactNames.name(for:))
+      guard confirm(prompt) else {
+        throw IMsgError.sendCancelled
+      }
+    }
+    // Transcoding waits until the send is certain to happen. Messages sends from its own
+    // staged copy, so the transcoded files go once the attempts are over.
+    defer {
+      for attachment in attachments {
+        AttachmentTranscoder.removeOutput(attachment)
+      }
+    }
+    if transcode {
+      let transcoder = AttachmentTranscoder(
+        maxBytes: maxBytes, imageQuality: Double(imageQuality) / 100)
+      for index in attachments.indices {
+        attachments[index] = try await transcoder.fit(attachments[index])
+      }
+      options.attachmentPaths = attachments.map(\.path)
+    }
+    // Where to look for the rows Messages creates for sent files; skipped when chat.db
+    // can't be read.
+    let sentStore = attachments.isEmpty ? nil : try? storeFactory(dbPath)
+    let baselineRowID = try? sentStore?.maxRowID()
+    var attempts = 0
+    let status: SendJournalEntry.Status
+    while true {
+      attempts += 1
+      do {
+        status = try journal.record(
+          idempotencyKey: idempotencyKey,
+          target: journalTarget(for: options),
+          service: service.rawValue,
+          textLength: text.count,
+          attachment: attachments.isEmpty ? nil : attachments.map(\.path).joined(separator: ", ")
+        ) {
+          try sendMessage(options)
+        }
+        break
+      } catch {
+        let retryable = SendRetryPolicy.isRetryable(error, idempotent: idempotencyKey != nil)
+        guard retryable, attempts <= retryPolicy.retries else {
+          if attempts > 1 {
+            let kind = retryable ? "" : " (not retryable)"
+            let note = "imsg send: giving up after \(attempts) attempts\(kind)\n"
+            FileHandle.standardError.write(Data(note.utf8))
+          }
+          throw error
+        }
+        let delay = retryPolicy.delay(beforeRetry: attempts)
+        let note =
+          "imsg send: attempt \(attempts) failed (\(error.localizedDescription)); "
+          + "retrying in \(String(format: "%.1f", delay))s\n"
+        FileHandle.standardError.write(Data(note.utf8))
+        try await sleep(delay)
+      }
+    }
+
+    if status == .duplicate, let idempotencyKey {
+      try printDuplicate(idempotencyKey, runtime: runtime)
+      return
+    }
+    var sent: [SentAttachmentRecord?] = attachments.map { _ in nil }
+    if let sentStore, let baselineRowID {
+      sent = try await locateSent(
+        attachments, store: sentStore, afterRowID: baselineRowID, sleep: sleep)
+      let missing = sent.filter { $0 == nil }.count
+      if missing > 0 {
+        let note =
+          "imsg send: \(missing) attachment\(pluralSuffix(for: missing)) not in chat.db after "
+          + "\(Int(sentLookupTimeout))s; no guids to report\n"
+        FileHandle.standardError.write(Data(note.utf8))
+      }
+    }
+    if runtime.jsonOutput {
+      let accepted = zip(attachments, sent).map { SentAttachmentPayload(attachment: $0, sent: $1) }
+      try JSONLines.print(
+        SendStatusPayload(
+          status: "sent", attempts: attempts, attachments: accepted.isEmpty ? nil : accepted))
+    } else {
+      Swift.print(attempts > 1 ? "sent after \(attempts) attempts" : "sent")
+      for (attachment, record) in zip(attachments, sent) {
+        let source = attachment.originalPath.map { ", transcoded from \($0)" } ?? ""
+        let guids = record.map { " message=\($0.messageGUID) attachment=\($0.attachmentGUID)" }
+        Swift.print(
+          "  attached: \(attachment.path) (\(attachment.bytes) bytes\(source))\(guids ?? "")")
+      }
+    }
+  }
 
+  private static func printDuplicate(_ idempotencyKey: String, runtime: RuntimeOptions) throws {
     if runtime.jsonOutput {
-      try JSONLines.print(["status": "sent"])
+      try JSONLines.print(["status": "duplicate", "idempotency_key": idempotencyKey])
     } else {
-      Swift.print("sent")
+      Swift.print("skipped: already sent with idempotency key \(idempotencyKey)")
     }
   }
+
+  static let sentLookupTimeout: TimeInterval = 10
+  static let sentLookupInterval: TimeInterval = 0.5
+
+  /// Polls chat.db until every sent file has an attachment row on one of your messages after
+  /// `afterRowID`, matched by file name in send order, or `sentLookupTimeout` passes. Files
+  /// that never show up stay nil.
+  static func locateSent(
+    _ attachments: [SendAttachment],
+    store: MessageStore,
+    afterRowID: Int64,
+    sleep: (TimeInterval) async throws -> Void
+  ) async throws -> [SentAttachmentRecord?] {
+    var waited: TimeInterval = 0
+    while true {
+      // A chat.db this query can't read won't start working mid-poll.
+      guard var records = try? store.sentAttachments(afterRowID: afterRowID) else {
+        return attachments.map { _ in nil }
+      }
+      let matched: [SentAttachmentRecord?] = attachments.map { attachment in
+        let name = URL(fileURLWithPath: attachment.path).lastPathComponent
+        guard let index = records.firstIndex(where: { $0.transferName == name }) else {
+          return nil
+        }
+        return records.remove(at: index)
+      }
+      if !matched.contains(where: { $0 == nil }) || waited >= sentLookupTimeout {
+        return matched
+      }
+      try await sleep(sentLookupInterval)
+      waited += sentLookupInterval
+    }
+  }
+
+  static let backendEnvironmentKey = "IMSG_SEND_BACKEND"
+
+  /// `--retries` / `--retry-backoff`, shared with commands that send through `run`.
+  static func retryOptions() -> [OptionDefinition] {
+    [
+      .make(
+        label: "retries", names: [.long("retries")],
+        help: "retry a send that found Messages not running (timeouts need --idempotency-key)"
+      ),
+      .make(
+        label: "retryBackoff", names: [.long("retry-backoff")],
+        help: "wait before the first retry, doubled each time (default 1s)"),
+    ]
+  }
+
+  static func retryPolicy(from values: ParsedValues) throws -> SendRetryPolicy {
+    var retries = 0
+    if values.option("retries") != nil {
+      guard let parsed = values.optionInt("retries"), parsed >= 0 else {
+        throw ParsedValuesError.invalidOption("retries")
+      }
+      retries = parsed
+    }
+    var backoff: TimeInterval = 1
+    if let raw = values.option("retryBackoff") {
+      guard let parsed = DurationParser.parse(raw), parsed >= 0 else {
+        throw ParsedValuesError.invalidOption("retry-backoff")
+      }
+      backoff = parsed
+    }
+    return SendRetryPolicy(retries: retries, backoff: backoff)
+  }
+
+  /// The enabled account `from` names, checked against an explicit `--service`.
+  static func sendingAccount(
+    _ from: String, service: MessageService, accounts: [MessagesAccount]
+  ) throws -> MessagesAccount {
+    guard let account = accounts.first(where: { $0.matches(from) }) else {
+      let known = accounts.map { "\($0.name) (\($0.serviceType), id \($0.id))" }
+      let list = known.isEmpty ? "none signed in" : "available: " + known.joined(separator: ", ")
+      throw IMsgError.invalidAccount("\(from) is not a Messages account; \(list)")
+    }
+    guard account.enabled else {
+      throw IMsgError.invalidAccount("\(account.name) is disabled in Messages")
+    }
+    if service != .auto && (service == .sms) != account.isSMS {
+      throw IMsgError.invalidAccount(
+        "\(account.name) is a \(account.serviceType) account, not \(service.rawValue)")
+    }
+    return account
+  }
+
+  /// What `send` shows before asking: recipients with their contact names, the service and
+  /// account, a one-line preview of the text and the files.
+  static func confirmationPrompt(
+    for options: MessageSendOptions,
+    account: MessagesAccount?,
+    chatName: String,
+    nameLookup: (String) -> String?
+  ) -> String {
+    func label(_ handle: String) -> String {
+      let normalized = PhoneNumberNormalizer.shared.normalizeHandle(handle, region: options.region)
+      guard let name = nameLookup(normalized) else { return normalized }
+      return "\(name) (\(normalized))"
+    }
+    let target: String
+    if !options.recipient.isEmpty {
+      target = label(options.recipient)
+    } else if !options.groupRecipients.isEmpty {
+      target = "new group: " + options.groupRecipients.map(label).joined(separator: ", ")
+    } else {
+      let identifier = options.chatIdentifier.isEmpty ? options.chatGUID : options.chatIdentifier
+      target = chatName.isEmpty ? identifier : "\(chatName) (\(identifier))"
+    }
+    var lines = ["To:      \(target)", "Service: \(options.service.rawValue)"]
+    if let account {
+      lines.append("From:    \(account.name)")
+    }
+    if !options.text.isEmpty {
+      lines.append("Text:    \(TextTruncation.truncate(options.text, to: 80))")
+    }
+    if !options.attachmentPaths.isEmpty {
+      let names = options.attachmentPaths.map { URL(fileURLWithPath: $0).lastPathComponent }
+      lines.append("Files:   \(TextTruncation.truncate(names.joined(separator: ", "), to: 80))")
+    }
+    return lines.joined(separator: "\n")
+  }
+
+  /// Prints `prompt` on stderr and reads the answer from stdin; only y or yes sends.
+  static func askOnTerminal(_ prompt: String) -> Bool {
+    FileHandle.standardError.write(Data((prompt + "\nSend? [y/N] ").utf8))
+    let answer = readLine()?.trimmingCharacters(in: .whitespaces).lowercased() ?? ""
+    return answer == "y" || answer == "yes"
+  }
+
+  static func journalTarget(for options: MessageSendOptions) -> String {
+    if !options.chatGUID.isEmpty { return options.chatGUID }
+    if !options.chatIdentifier.isEmpty { return options.chatIdentifier }
+    if !options.groupRecipients.isEmpty { return options.groupRecipients.joined(separator: ",") }
+    return options.recipient
+  }
+
+  /// `chat123456` style identifiers and `service;+;identifier` guids name group chats.
+  static func looksLikeChatIdentifier(_ value: String) -> Bool {
+    if value.contains(";+;") || value.contains(";-;") { return true }
+    guard value.hasPrefix("chat") else { return false }
+    let suffix = value.dropFirst(4)
+    return !suffix.isEmpty && suffix.allSatisfy(\.isNumber)
+  }
 }
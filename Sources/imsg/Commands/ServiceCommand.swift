@@ -0,0 +1,230 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct ServiceStatusPayload: Codable, Equatable {
+  let label: String
+  let installed: Bool
+  let loaded: Bool
+  let plist: String
+  let programArguments: [String]?
+  let state: String?
+  let pid: Int?
+  let lastExitCode: Int?
+  let stdoutLog: String?
+  let stderrLog: String?
+
+  enum CodingKeys: String, CodingKey {
+    case label
+    case installed
+    case loaded
+    case plist
+    case programArguments = "program_arguments"
+    case state
+    case pid
+    case lastExitCode = "last_exit_code"
+    case stdoutLog = "stdout_log"
+    case stderrLog = "stderr_log"
+  }
+}
+
+enum ServiceError: Error, CustomStringConvertible {
+  case launchctlFailed(action: String, status: Int32, output: String)
+
+  var description: String {
+    switch self {
+    case .launchctlFailed(let action, let status, let output):
+      let detail = output.trimmingCharacters(in: .whitespacesAndNewlines)
+      return "service: launchctl \(action) failed (\(status))\(detail.isEmpty ? "" : ": \(detail)")"
+    }
+  }
+}
+
+enum ServiceCommand {
+  /// Runs `launchctl` with the given arguments and returns its exit status and combined output.
+  typealias Launchctl = ([String]) throws -> (status: Int32, output: String)
+
+  static let spec = CommandSpec(
+    name: "service",
+    abstract: "Install, remove, or inspect a launchd agent that keeps imsg running",
+    discussion: """
+      `imsg service install` writes ~/Library/LaunchAgents/<label>.plist and loads it, so the
+      --run command (default "watch --json") starts at login and is restarted if it exits.
+      Output goes to ~/Library/Logs/imsg/<label>.out.log and .err.log (or --log-dir), and
+      imsg's own log to <label>.log there, rotated at 10MB, unless --run sets --log-file.
+      Installing again replaces the agent. Use a different --label per command to run
+      several, e.g. a bridge next to a watcher. The imsg binary launchd starts needs Full
+      Disk Access of its own; grant it in System Settings if the error log says so.
+      `uninstall` unloads the agent and deletes its plist; `status` shows whether it is
+      loaded and its pid and last exit code.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        arguments: [.make(label: "action", help: "install|uninstall|status")],
+        options: [
+          .make(
+            label: "label", names: [.long("label")],
+            help: "launchd label (default \(LaunchAgent.defaultLabel))"),
+          .make(
+            label: "run", names: [.long("run")],
+            help: "imsg arguments to keep running (default \"watch --json\")"),
+          .make(
+            label: "logDir", names: [.long("log-dir")],
+            help: "directory for the agent's stdout/stderr logs (default ~/Library/Logs/imsg)"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg service install",
+      "imsg service install --label com.imsg.bridge --run \"bridge matrix --homeserver "
+        + "https://matrix.example.org --room 1='!abc:example.org'\"",
+      "imsg service status --json",
+      "imsg service uninstall --label com.imsg.bridge",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    agentsDirectory: URL = LaunchAgent.agentsDirectory,
+    executablePath: String = currentExecutablePath(),
+    environment: [String: String] = ProcessInfo.processInfo.environment,
+    launchctl: Launchctl = runLaunchctl
+  ) throws {
+    let label = values.option("label") ?? LaunchAgent.defaultLabel
+    guard !label.isEmpty, !label.contains("/") else {
+      throw ParsedValuesError.invalidOption("label")
+    }
+    let plistURL = LaunchAgent.plistURL(label: label, in: agentsDirectory)
+    let domain = "gui/\(getuid())"
+
+    switch values.argument(0) {
+    case "install":
+      guard let arguments = LaunchAgent.splitArguments(values.option("run") ?? "watch --json"),
+        let command = arguments.first, command != "service", !command.hasPrefix("-")
+      else {
+        throw ParsedValuesError.invalidOption("run")
+      }
+      var logDirectory = LaunchAgent.defaultLogDirectory
+      if let raw = values.option("logDir") {
+        logDirectory = URL(
+          fileURLWithPath: NSString(string: raw).expandingTildeInPath, isDirectory: true)
+      }
+      // launchd starts jobs with a bare environment; keep imsg's own settings.
+      let carried = environment.filter {
+        $0.key.hasPrefix("IMSG_") && $0.key != "IMSG_VERSION"
+      }
+      var programArguments = [executablePath] + arguments
+      if !arguments.contains(where: { $0 == "--log-file" || $0.hasPrefix("--log-file=") }) {
+        programArguments += [
+          "--log-file", logDirectory.appendingPathComponent("\(label).log").path,
+        ]
+      }
+      let agent = LaunchAgent(
+        label: label, programArguments: programArguments,
+        logDirectory: logDirectory, environment: carried)
+      try FileManager.default.createDirectory(
+        at: agentsDirectory, withIntermediateDirectories: true)
+      try FileManager.default.createDirectory(at: logDirectory, withIntermediateDirectories: true)
+      try agent.propertyList().write(to: plistURL, options: .atomic)
+      // A previous install may still be loaded; bootstrap refuses to load a label twice.
+      _ = try launchctl(["bootout", "\(domain)/\(label)"])
+      let result = try launchctl(["bootstrap", domain, plistURL.path])
+      guard result.status == 0 else {
+        throw ServiceError.launchctlFailed(
+          action: "bootstrap", status: result.status, output: result.output)
+      }
+      if runtime.jsonOutput {
+        try JSONLines.print(try status(label: label, plistURL: plistURL, launchctl: launchctl))
+      } else {
+        Swift.print("installed \(label): \(agent.programArguments.joined(separator: " "))")
+        Swift.print("  plist: \(plistURL.path)")
+        Swift.print("  logs: \(agent.standardOutPath), \(agent.standardErrorPath)")
+      }
+    case "uninstall":
+      let installed = FileManager.default.fileExists(atPath: plistURL.path)
+      let result = try launchctl(["bootout", "\(domain)/\(label)"])
+      if installed {
+        try FileManager.default.removeItem(at: plistURL)
+      }
+      let removed = installed || result.status == 0
+      if runtime.jsonOutput {
+        try JSONLines.print(["label": label, "status": removed ? "removed" : "not_installed"])
+      } else {
+        Swift.print(removed ? "removed \(label)" : "\(label) is not installed")
+      }
+    case "status":
+      let payload = try status(label: label, plistURL: plistURL, launchctl: launchctl)
+      if runtime.jsonOutput {
+        try JSONLines.print(payload)
+        return
+      }
+      guard payload.installed || payload.loaded else {
+        Swift.print("\(label): not installed")
+        return
+      }
+      var line = "\(label): \(payload.loaded ? payload.state ?? "loaded" : "not loaded")"
+      if let pid = payload.pid {
+        line += " pid=\(pid)"
+      }
+      if let code = payload.lastExitCode {
+        line += " last_exit=\(code)"
+      }
+      Swift.print(line)
+      if let arguments = payload.programArguments {
+        Swift.print("  runs: \(arguments.joined(separator: " "))")
+      }
+      Swift.print("  plist: \(payload.plist)")
+      if let stderrLog = payload.stderrLog {
+        Swift.print("  errors: \(stderrLog)")
+      }
+    default:
+      throw ParsedValuesError.invalidOption("action")
+    }
+  }
+
+  static func status(label: String, plistURL: URL, launchctl: Launchctl) throws
+    -> ServiceStatusPayload
+  {
+    var plist: [String: Any]?
+    if let data = try? Data(contentsOf: plistURL) {
+      plist =
+        try? PropertyListSerialization.propertyList(from: data, format: nil) as? [String: Any]
+    }
+    let result = try launchctl(["print", "gui/\(getuid())/\(label)"])
+    let loaded = result.status == 0
+    let parsed = loaded ? LaunchAgentStatus(launchctlPrint: result.output) : nil
+    return ServiceStatusPayload(
+      label: label,
+      installed: plist != nil,
+      loaded: loaded,
+      plist: plistURL.path,
+      programArguments: plist?["ProgramArguments"] as? [String],
+      state: parsed?.state,
+      pid: parsed?.pid,
+      lastExitCode: parsed?.lastExitCode,
+      stdoutLog: plist?["StandardOutPath"] as? String,
+      stderrLog: plist?["StandardErrorPath"] as? String
+    )
+  }
+
+  static func currentExecutablePath() -> String {
+    let path = Bundle.main.executablePath ?? CommandLine.arguments.first ?? "imsg"
+    return URL(fileURLWithPath: path).resolvingSymlinksInPath().path
+  }
+
+  static func runLaunchctl(_ arguments: [String]) throws -> (status: Int32, output: String) {
+    let process = Process()
+    process.executableURL = URL(fileURLWithPath: "/bin/launchctl")
+    process.arguments = arguments
+    let pipe = Pipe()
+    process.standardOutput = pipe
+    process.standardError = pipe
+    try process.run()
+    let data = pipe.fileHandleForReading.readDataToEndOfFile()
+    process.waitUntilExit()
+    return (process.terminationStatus, String(data: data, encoding: .utf8) ?? "")
+  }
+}
@@ -0,0 +1,175 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct SyncCountsPayload: Codable, Equatable {
+  let total: Int
+  let synced: Int
+  let pendingUpload: Int
+  let other: Int
+
+  init(counts: CloudSyncCounts) {
+    self.total = counts.total
+    self.synced = counts.synced
+    self.pendingUpload = counts.pendingUpload
+    self.other = counts.other
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case total
+    case synced
+    case pendingUpload = "pending_upload"
+    case other
+  }
+}
+
+struct SyncMarkerPayload: Codable, Equatable {
+  let key: String
+  let value: String
+}
+
+struct SyncStatusPayload: Codable, Equatable {
+  /// nil when the preference can't be read.
+  let icloudEnabled: Bool?
+  let cloudKitColumns: Bool
+  let messages: SyncCountsPayload?
+  let chats: SyncCountsPayload?
+  let attachments: SyncCountsPayload?
+  let attachmentsInCloudOnly: Int
+  let lastSyncedMessageAt: String?
+  let pendingDeletions: Int
+  let markers: [SyncMarkerPayload]
+  let hints: [String]
+
+  init(status: CloudSyncStatus, icloudEnabled: Bool?) {
+    self.icloudEnabled = icloudEnabled
+    self.cloudKitColumns = status.hasCloudKitColumns
+    self.messages = status.messages.map(SyncCountsPayload.init(counts:))
+    self.chats = status.chats.map(SyncCountsPayload.init(counts:))
+    self.attachments = status.attachments.map(SyncCountsPayload.init(counts:))
+    self.attachmentsInCloudOnly = status.attachmentsInCloudOnly
+    self.lastSyncedMessageAt = status.lastSyncedMessageAt.map { CLIISO8601.format($0) }
+    self.pendingDeletions = status.pendingDeletions
+    self.markers = status.markers.map { SyncMarkerPayload(key: $0.key, value: $0.value) }
+    self.hints = SyncStatusCommand.hints(for: status, icloudEnabled: icloudEnabled)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case icloudEnabled = "icloud_enabled"
+    case cloudKitColumns = "cloudkit_columns"
+    case messages
+    case chats
+    case attachments
+    case attachmentsInCloudOnly = "attachments_in_cloud_only"
+    case lastSyncedMessageAt = "last_synced_message_at"
+    case pendingDeletions = "pending_deletions"
+    case markers
+    case hints
+  }
+}
+
+enum SyncStatusCommand {
+  static let spec = CommandSpec(
+    name: "sync-status",
+    abstract: "Show Messages in iCloud sync state from chat.db",
+    discussion: """
+      For debugging missing history. Reports whether Messages in iCloud is turned on (the
+      CloudKitSyncingEnabled preference of com.apple.madrid on this Mac), the newest message
+      chat.db marks as synced, and messages, chats and attachments by CloudKit sync state:
+      synced, pending upload, or in between. Attachments with an iCloud record but no file on
+      disk are the ones still to download. Deletions waiting to reach iCloud and the sync
+      markers Messages keeps in kvtable are listed too. Only the local side is visible:
+      messages that never reached this Mac don't show up anywhere in chat.db.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(options: CommandSignatures.baseOptions())
+    ),
+    usageExamples: [
+      "imsg sync-status",
+      "imsg sync-status --json | jq .messages.pending_upload",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    icloudEnabled: () -> Bool? = { SyncStatusCommand.icloudPreference() }
+  ) throws {
+    let store = try storeFactory(try CommandSignatures.databasePath(from: values))
+    let payload = SyncStatusPayload(
+      status: try store.cloudSyncStatus(), icloudEnabled: icloudEnabled())
+    if runtime.jsonOutput {
+      try JSONLines.print(payload)
+      return
+    }
+    defer {
+      for hint in payload.hints {
+        Swift.print("hint: \(hint)")
+      }
+    }
+
+    let state = payload.icloudEnabled.map { $0 ? "enabled" : "disabled" } ?? "unknown"
+    Swift.print("messages in icloud: \(state)")
+    guard payload.cloudKitColumns else {
+      Swift.print("chat.db has no CloudKit sync columns")
+      return
+    }
+    Swift.print("last synced message: \(payload.lastSyncedMessageAt ?? "none")")
+    for (name, counts) in [
+      ("messages", payload.messages), ("chats", payload.chats),
+      ("attachments", payload.attachments),
+    ] {
+      guard let counts else { continue }
+      Swift.print(
+        "\(name): \(counts.synced) synced, \(counts.pendingUpload) pending upload, "
+          + "\(counts.other) other (\(counts.total) total)")
+    }
+    Swift.print("attachments only in icloud: \(payload.attachmentsInCloudOnly)")
+    Swift.print("pending deletions: \(payload.pendingDeletions)")
+    for marker in payload.markers {
+      Swift.print("marker \(marker.key): \(marker.value)")
+    }
+  }
+
+  /// nil when the preference isn't set or readable, e.g. with sandboxed preferences.
+  static func icloudPreference() -> Bool? {
+    UserDefaults(suiteName: "com.apple.madrid")?.object(forKey: "CloudKitSyncingEnabled")
+      as? Bool
+  }
+
+  static func hints(for status: CloudSyncStatus, icloudEnabled: Bool?) -> [String] {
+    guard status.hasCloudKitColumns else {
+      return ["this chat.db predates Messages in iCloud; history only exists on this Mac"]
+    }
+    var hints: [String] = []
+    let synced = status.messages?.synced ?? 0
+    let pending = status.messages?.pendingUpload ?? 0
+    if icloudEnabled == false {
+      if synced > 0 {
+        hints.append(
+          "Messages in iCloud is off; synced messages date from when it was on and new ones "
+            + "stay on this Mac")
+      } else {
+        hints.append("Messages in iCloud is off; turn it on in Messages > Settings > iMessage")
+      }
+    } else if synced == 0 && pending > 0 {
+      hints.append(
+        "no message has synced yet; the first sync can take hours, keep Messages open on "
+          + "power and Wi-Fi")
+    } else if pending > 0 {
+      hints.append(
+        "\(pending) message\(pluralSuffix(for: pending)) not uploaded yet; they sync while "
+          + "Messages is open")
+    }
+    let cloudOnly = status.attachmentsInCloudOnly
+    if cloudOnly > 0 {
+      hints.append(
+        "\(cloudOnly) attachment\(pluralSuffix(for: cloudOnly)) only in iCloud; open the "
+          + "conversation in Messages to download them")
+    }
+    return hints
+  }
+}
@@ -0,0 +1,140 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct MessageTagPayload: Codable, Equatable {
+  let tag: String
+  let note: String?
+  let createdAt: String
+
+  init(tag: MessageTag) {
+    self.tag = tag.tag
+    self.note = tag.note
+    self.createdAt = CLIISO8601.format(tag.createdAt)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case tag
+    case note
+    case createdAt = "created_at"
+  }
+}
+
+struct MessageTagsPayload: Codable {
+  let messageGUID: String
+  let tags: [MessageTagPayload]
+  /// Set by `imsg tagged`; nil when the message is no longer in chat.db.
+  var message: MessagePayload?
+
+  enum CodingKeys: String, CodingKey {
+    case messageGUID = "message_guid"
+    case tags
+    case message
+  }
+}
+
+enum TagCommand {
+  static let spec = CommandSpec(
+    name: "tag",
+    abstract: "Add or remove local tags on a message",
+    discussion: """
+      Tags such as followup or pinned are kept in tags.db in the state directory, keyed by
+      message guid; chat.db is never written. Tags are single words, compared case-
+      insensitively. --add and --remove take one tag or a comma-separated list and can be
+      repeated; --note stores a short note with the tags added. Without --add or --remove
+      the message's tags are printed. List tagged messages with imsg tagged.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "messageGUID", names: [.long("message-guid")], help: "message guid"),
+          .make(label: "rowid", names: [.long("rowid")], help: "message rowid"),
+          .make(label: "add", names: [.long("add")], help: "tag to add (repeatable)"),
+          .make(label: "remove", names: [.long("remove")], help: "tag to remove (repeatable)"),
+          .make(label: "note", names: [.long("note")], help: "note stored with added tags"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg tag --message-guid 5A1B2C3D-0000-4E5F-8A9B-112233445566 --add followup",
+      "imsg tag --rowid 4211 --add pinned,recipes --note 'lasagna'",
+      "imsg tag --rowid 4211 --remove followup --json",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    tagStoreFactory: () throws -> MessageTagStore = {
+      try MessageTagStore(fileURL: StateDirectory.fileURL("tags.db"))
+    }
+  ) throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let adds = try tags(values: values, label: "add")
+    let removes = try tags(values: values, label: "remove")
+    let note = values.option("note")
+    if note != nil && adds.isEmpty {
+      throw ParsedValuesError.invalidOption("note")
+    }
+    let guid = try messageGUID(values: values, store: try storeFactory(dbPath))
+
+    let tagStore = try tagStoreFactory()
+    for tag in removes {
+      try tagStore.remove(tag, from: guid)
+    }
+    for tag in adds {
+      try tagStore.add(tag, to: guid, note: note)
+    }
+    let tags = try tagStore.tags(for: guid)
+
+    if runtime.jsonOutput {
+      try JSONLines.print(
+        MessageTagsPayload(messageGUID: guid, tags: tags.map(MessageTagPayload.init)))
+      return
+    }
+    Swift.print("\(guid): \(tagList(tags))")
+  }
+
+  /// `--message-guid`, or the guid of the `--rowid` message. Either way the message has to be
+  /// in chat.db, so a typo doesn't tag nothing.
+  static func messageGUID(values: ParsedValues, store: MessageStore) throws -> String {
+    let guid = values.option("messageGUID")
+    let rowID = values.optionInt64("rowid")
+    if guid != nil && rowID != nil {
+      throw ParsedValuesError.invalidOption("rowid")
+    }
+    let found: Message?
+    if let guid {
+      found = try store.message(guid: guid)
+    } else if let rowID {
+      found = try store.message(rowID: rowID)
+    } else {
+      throw ParsedValuesError.missingOption("message-guid or rowid")
+    }
+    guard let message = found, !message.guid.isEmpty else {
+      throw IMsgError.messageNotFound(guid ?? "rowid \(rowID ?? 0)")
+    }
+    return message.guid
+  }
+
+  /// Normalized tags from a repeatable, comma-separated option.
+  static func tags(values: ParsedValues, label: String) throws -> [String] {
+    try values.optionValues(label).flatMap { $0.split(separator: ",") }.map { raw in
+      guard let tag = MessageTagStore.normalize(String(raw)) else {
+        throw ParsedValuesError.invalidOption(label)
+      }
+      return tag
+    }
+  }
+
+  /// `followup, pinned (lasagna)`, or `no tags`.
+  static func tagList(_ tags: [MessageTag]) -> String {
+    guard !tags.isEmpty else { return "no tags" }
+    return tags.map { tag in
+      tag.note.map { "\(tag.tag) (\(bidiIsolated($0)))" } ?? tag.tag
+    }.joined(separator: ", ")
+  }
+}
@@ -0,0 +1,92 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum TaggedCommand {
+  static let spec = CommandSpec(
+    name: "tagged",
+    abstract: "List messages carrying a local tag",
+    discussion: """
+      Lists messages tagged with imsg tag, most recently tagged first: every tagged message,
+      or only those with --tag. Each message prints like history, followed by its tags.
+      Tagged messages that are no longer in chat.db (deleted, or tagged on another Mac) are
+      listed by guid. --json prints {"message_guid", "tags", "message"} per message.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "tag", names: [.long("tag")], help: "only messages with this tag"),
+          .make(label: "limit", names: [.long("limit")], help: "max messages (default 50)"),
+        ] + TimestampFormatter.options() + [OutputLabels.option(), TextTruncation.option()],
+        flags: [
+          .make(
+            label: "attachments", names: [.long("attachments")], help: "include attachment metadata"
+          )
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg tagged --tag followup",
+      "imsg tagged --json | jq -r '.message.text'",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    tagStoreFactory: () throws -> MessageTagStore = {
+      try MessageTagStore(fileURL: StateDirectory.fileURL("tags.db"))
+    }
+  ) throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    var tag: String?
+    if let raw = values.option("tag") {
+      guard let normalized = MessageTagStore.normalize(raw) else {
+        throw ParsedValuesError.invalidOption("tag")
+      }
+      tag = normalized
+    }
+    var limit = 50
+    if values.option("limit") != nil {
+      guard let parsed = values.optionInt("limit"), parsed > 0 else {
+        throw ParsedValuesError.invalidOption("limit")
+      }
+      limit = parsed
+    }
+    var printer = MessageTextPrinter(
+      store: try storeFactory(dbPath),
+      timestamps: try TimestampFormatter.from(values: values),
+      showAttachments: values.flag("attachments")
+    )
+    printer.labels = try OutputLabels.from(values: values)
+    printer.truncate = try TextTruncation.limit(from: values)
+    printer.showChatID = true
+    let store = printer.store
+
+    let tagStore = try tagStoreFactory()
+    for guid in try tagStore.taggedMessages(tag, limit: limit) {
+      let tags = try tagStore.tags(for: guid)
+      let message = try store.message(guid: guid)
+      if runtime.jsonOutput {
+        var payload = MessageTagsPayload(
+          messageGUID: guid, tags: tags.map(MessageTagPayload.init))
+        if let message {
+          payload.message = MessagePayload(
+            message: message, attachments: try store.attachments(for: message.rowID),
+            reactions: try store.reactions(for: message.rowID))
+        }
+        try JSONLines.print(payload)
+        continue
+      }
+      if let message {
+        try printer.print(message)
+      } else {
+        Swift.print("\(guid) (not in this chat.db)")
+      }
+      Swift.print("  tags: \(TagCommand.tagList(tags))")
+    }
+  }
+}
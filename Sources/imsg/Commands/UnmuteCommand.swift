@@ -0,0 +1,68 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum UnmuteCommand {
+  static let spec = CommandSpec(
+    name: "unmute",
+    abstract: "Undo imsg mute for a chat",
+    discussion: """
+      Removes the chat from muted.json, so imsg chats lists it again and watch, autoreply,
+      the bridge and RPC subscriptions see its messages. --chat-guid unmutes a chat that is
+      no longer in chat.db (imsg mute lists the guids).
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "chatID", names: [.long("chat-id")], help: "chat rowid to unmute"),
+          .make(label: "chatGUID", names: [.long("chat-guid")], help: "chat guid to unmute"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg unmute --chat-id 42",
+      "imsg unmute --chat-guid 'iMessage;+;chat123456789'",
+    ]
+  ) { values, runtime in
+    try run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    muteListFactory: () throws -> ChatMuteList = { try ChatMuteList() }
+  ) throws {
+    let muted = try muteListFactory()
+    if let guid = values.option("chatGUID") {
+      guard values.option("chatID") == nil else {
+        throw ParsedValuesError.invalidOption("chatGUID")
+      }
+      let name = muted.entries.first { $0.guid == guid }?.name ?? ""
+      let changed = muted.unmute(guid: guid)
+      try muted.save()
+      try report(
+        ChatInfo(id: 0, identifier: "", guid: guid, name: name, service: ""), changed: changed,
+        runtime: runtime)
+      return
+    }
+    guard values.option("chatID") != nil else {
+      throw ParsedValuesError.missingOption("chatID")
+    }
+    let store = try storeFactory(try CommandSignatures.databasePath(from: values))
+    let chat = try MuteCommand.chat(values: values, store: store)
+    let changed = muted.unmute(guid: chat.guid)
+    try muted.save()
+    try report(chat, changed: changed, runtime: runtime)
+  }
+
+  /// `chat.id` is 0 for a chat named by --chat-guid.
+  private static func report(_ chat: ChatInfo, changed: Bool, runtime: RuntimeOptions) throws {
+    if runtime.jsonOutput {
+      try JSONLines.print(MutedChatPayload(chat: chat, changed: changed))
+      return
+    }
+    let label = chat.id == 0 ? chat.guid : "[\(chat.id)] \(chat.name)"
+    Swift.print(changed ? "unmuted \(label)" : "\(label) was not muted")
+  }
+}
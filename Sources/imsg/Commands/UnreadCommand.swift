@@ -0,0 +1,130 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct UnreadAckResult: Codable {
+  let ackedThrough: Int64
+  let chatID: Int64?
+
+  enum CodingKeys: String, CodingKey {
+    case ackedThrough = "acked_through"
+    case chatID = "chat_id"
+  }
+}
+
+enum UnreadCommand {
+  static let spec = CommandSpec(
+    name: "unread",
+    abstract: "List messages newer than a local per-chat cursor",
+    discussion: """
+      Cursors live in ~/Library/Application Support/imsg/unread.json (or $IMSG_STATE_DIR)
+      and are independent of Messages' read state. List, process, then --ack with the
+      highest rowid you handled (--through) for at-least-once consumption. --ack without
+      --through marks everything up to the newest message as seen.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: CommandSignatures.baseOptions() + [
+          .make(label: "chatID", names: [.long("chat-id")], help: "limit to chat rowid"),
+          .make(
+            label: "limit", names: [.long("limit")], help: "max messages to list (default 100)"),
+          .make(
+            label: "through", names: [.long("through")],
+            help: "with --ack: advance the cursor to this rowid"),
+        ] + TimestampFormatter.options() + [OutputLabels.option(), TextTruncation.option()],
+        flags: [
+          .make(label: "ack", names: [.long("ack")], help: "advance the cursor instead of listing"),
+          .make(
+            label: "attachments", names: [.long("attachments")], help: "include attachment metadata"
+          ),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg unread --json",
+      "imsg unread --chat-id 1 --ack --through 4211",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    cursorFactory: @escaping (String) throws -> UnreadCursorStore = {
+      try UnreadCursorStore(databasePath: $0)
+    }
+  ) async throws {
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    let chatID = values.optionInt64("chatID")
+    let store = try storeFactory(dbPath)
+    let cursors = try cursorFactory(store.path)
+
+    if values.flag("ack") {
+      let through = try values.optionInt64("through") ?? store.maxRowID()
+      cursors.acknowledge(through: through, chatID: chatID)
+      try cursors.save()
+      if runtime.jsonOutput {
+        try JSONLines.print(UnreadAckResult(ackedThrough: through, chatID: chatID))
+      } else {
+        Swift.print("acked through \(through)")
+      }
+      return
+    }
+    if values.option("through") != nil {
+      throw ParsedValuesError.invalidOption("through")
+    }
+
+    let limit = values.optionInt("limit") ?? 100
+    let pending = try unreadMessages(store: store, cursors: cursors, chatID: chatID, limit: limit)
+    var printer = MessageTextPrinter(
+      store: store,
+      timestamps: try TimestampFormatter.from(values: values),
+      showAttachments: values.flag("attachments")
+    )
+    printer.showChatID = true
+    printer.labels = try OutputLabels.from(values: values)
+    printer.truncate = try TextTruncation.limit(from: values)
+    let extras =
+      try runtime.jsonOutput ? MessageExtras.load(store: store, messages: pending) : .empty
+    for message in pending {
+      if runtime.jsonOutput {
+        let payload = MessagePayload(
+          message: message,
+          attachments: extras.attachments(for: message.rowID),
+          reactions: extras.reactions(for: message.rowID)
+        )
+        try JSONLines.print(payload)
+        continue
+      }
+      try printer.print(message)
+    }
+    if !runtime.jsonOutput, let last = pending.last {
+      let chatFlag = chatID.map { " --chat-id \($0)" } ?? ""
+      Swift.print(
+        "\(pending.count) unread; ack with: imsg unread\(chatFlag) --ack --through \(last.rowID)")
+    }
+  }
+
+  static func unreadMessages(
+    store: MessageStore,
+    cursors: UnreadCursorStore,
+    chatID: Int64?,
+    limit: Int
+  ) throws -> [Message] {
+    let batchSize = 500
+    var pending: [Message] = []
+    var after = chatID.map { cursors.cursor(chatID: $0) } ?? cursors.floor
+    while pending.count < limit {
+      let batch = try store.messagesAfter(afterRowID: after, chatID: chatID, limit: batchSize)
+      for message in batch where message.rowID > cursors.cursor(chatID: message.chatID) {
+        pending.append(message)
+        if pending.count == limit { break }
+      }
+      guard let last = batch.last, batch.count == batchSize else { break }
+      after = last.rowID
+    }
+    return pending
+  }
+}
@@ -6,7 +6,48 @@ enum WatchCommand {
   static let spec = CommandSpec(
     name: "watch",
     abstract: "Stream incoming messages",
-    discussion: nil,
+    discussion: """
+      If chat.db is replaced or starts failing (vacuum, OS update, sign-out), watch reopens it
+      and resumes after the last seen rowid. --json emits {"event":"reconnect",...} when that
+      happens; text output notes it on stderr. At startup it warns on stderr when chat.db-wal
+      or chat.db-shm can't be read (see imsg doctor --check-wal).
+      Without --chat-id it streams every chat; --pick chooses one from a filterable list on the
+      terminal and prints its id on stderr.
+      --mentions-me keeps only group messages that @-mention one of your own handles (the
+      addresses you send from, as listed by imsg accounts).
+      When a conversation switches between iMessage and SMS, watch notes it before the first
+      message on the new service ({"event":"service_change",...} with --json). JSON messages
+      carry the service and the account they used (p:+1555... or e:you@icloud.com).
+      --resume saves the last processed rowid for this database, chat and filter set in
+      watch.json in the state directory; the next --resume with the same filters first
+      replays what arrived while watch was down. The first run starts at the newest message.
+      --rules runs a YAML rules file against each message that passes the filters: match on
+      chat, sender, text, attachment type, direction or time of day, then exec a command,
+      POST a webhook, show a notification, or auto-reply (see README). Webhooks whose endpoint
+      is down are queued on disk and replayed in order once it answers; see imsg webhook-queue.
+      --stats-interval 1m also emits an activity summary every interval: messages per minute
+      for each chat and the top senders among the messages watch printed
+      ({"event":"stats",...} with --json).
+      --exec runs a shell command for each message watch prints, with IMSG_TEXT, IMSG_SENDER,
+      IMSG_CHAT_ID (and the other IMSG_* variables rules use) in its environment and the
+      message's JSON line on stdin. Up to --exec-concurrency commands (default 4) run at once;
+      one still running after --exec-timeout (default 30s) is terminated.
+      Without --chat-id, chats muted with imsg mute are skipped, rules and --exec included.
+      --events adds other changes to the stream: reaction (tapbacks added or removed), edit,
+      delete (messages unsent by their sender) and receipt (a message you sent was read), e.g.
+      --events message,reaction,edit or --events all. They print as -- ... -- lines, or as
+      {"event":"reaction",...} with --json, and pass the same filters as the message they
+      are about. Edits, unsends and reads are noticed on the newest 1000 messages; rules,
+      --exec and --stats-interval only see new messages.
+      --heartbeat 30s (with --json) re-reads chat.db every interval and then emits
+      {"event":"heartbeat","last_rowid":N,"at":...}, even when nothing arrived; a supervisor
+      that stops seeing heartbeats can restart the watch. last_rowid is the newest rowid read,
+      filtered-out messages included.
+      Watch wakes up on file events for chat.db and its WAL. Where those go missing (chat.db
+      on a network or external volume, some sandboxes), --poll-max 30s polls as well: every
+      --poll-min (default 500ms) right after something arrived, doubling while the chat is
+      quiet, up to --poll-max. --poll-min alone uses a 30s maximum.
+      """,
     signature: CommandSignatures.withRuntimeFlags(
       CommandSignature(
         options: CommandSignatures.baseOptions() + [
@@ -18,21 +59,74 @@ enum WatchCommand {
             label: "sinceRowID", names: [.long("since-rowid")],
             help: "start watching after this rowid"),
           .make(
-            label: "participants", names: [.long("participants")],
-            help: "filter by participant handles", parsing: .upToNextOption),
-          .make(label: "start", names: [.long("start")], help: "ISO8601 start (inclusive)"),
-          .make(label: "end", names: [.long("end")], help: "ISO8601 end (exclusive)"),
-        ],
+            label: "pollMin", names: [.long("poll-min")],
+            help: "fallback poll interval right after activity (default 500ms)"),
+          .make(
+            label: "pollMax", names: [.long("poll-max")],
+            help: "longest fallback poll interval when idle (e.g. 30s; off by default)"),
+          .make(
+            label: "rules", names: [.long("rules")],
+            help: "YAML rules file of match conditions and actions to run"),
+          .make(
+            label: "statsInterval", names: [.long("stats-interval")],
+            help: "emit per-chat activity stats this often (e.g. 1m)"),
+          .make(
+            label: "exec", names: [.long("exec")],
+            help: "shell command to run for each message (message JSON on stdin)"),
+          .make(
+            label: "execConcurrency", names: [.long("exec-concurrency")],
+            help: "max --exec commands running at once (default 4)"),
+          .make(
+            label: "execTimeout", names: [.long("exec-timeout")],
+            help: "terminate an --exec command after this long (default 30s)"),
+          .make(
+            label: "events", names: [.long("events")],
+            help: "message,reaction,edit,delete,receipt or all (default message)"),
+          .make(
+            label: "heartbeat", names: [.long("heartbeat")],
+            help: "with --json, emit a heartbeat event this often (e.g. 30s)"),
+        ] + MessageFilterOptions.options() + TimestampFormatter.options() + [
+          OutputLabels.option(), OutputTemplate.option(), NormalizationOptions.option(),
+          TextTruncation.option(),
+        ] + AttachmentEmbedding.options(),
         flags: [
           .make(
             label: "attachments", names: [.long("attachments")], help: "include attachment metadata"
-          )
+          ),
+          .make(
+            label: "pick", names: [.long("pick")],
+            help: "choose the chat interactively instead of passing --chat-id"),
+          .make(
+            label: "mentionsMe", names: [.long("mentions-me")],
+            help: "only messages that @-mention you"),
+          .make(
+            label: "resume", names: [.long("resume")],
+            help: "continue after the last message a previous --resume watch processed"),
+          .make(
+            label: "embedAttachments", names: [.long("embed-attachments")],
+            help: "with --json, inline small attachments as base64"),
+          .make(
+            label: "detectLang", names: [.long("detect-lang")],
+            help: "with --json, add each message's detected language"),
         ]
       )
     ),
     usageExamples: [
       "imsg watch --chat-id 1 --attachments --debounce 250ms",
       "imsg watch --chat-id 1 --participants +15551234567",
+      "imsg watch --match-icase '(otp|code is)' --json",
+      "imsg watch --mentions-me --json",
+      "imsg watch --chat-id 1 --resume --json",
+      "imsg watch --rules ~/.config/imsg/rules.yaml --resume",
+      "imsg watch --stats-interval 1m --json",
+      "imsg watch --chat-id 1 --exec 'notify-send \"$IMSG_SENDER\" \"$IMSG_TEXT\"'",
+      "imsg watch --exec 'jq -r .text >> ~/inbox.log' --exec-concurrency 1",
+      "imsg watch --template '{{.Chat.Name}} | {{.Sender}}: {{.Text}}'",
+      "imsg watch --events message,reaction,edit,delete --json",
+      "imsg watch --resume --json --heartbeat 30s",
+      "imsg watch --db /Volumes/Backup/chat.db --poll-min 500ms --poll-max 1m",
+      "imsg watch --normalize fffc,zero-width --match 'code is [0-9]+' --json",
+      "imsg watch --chat-id 1 --json --embed-attachments --embed-max-size 256KB",
     ]
   ) { values, runtime in
     try await run(values: values, runtime: runtime)
@@ -42,74 +136,364 @@ enum WatchCommand {
     values: ParsedValues,
     runtime: RuntimeOptions,
     storeFactory: @escaping (String) throws -> MessageStore = { try MessageStore(path: $0) },
+    cursorFactory: (String) throws -> WatchCursorStore = {
+      try WatchCursorStore(databasePath: $0)
+    },
+    muteListFactory: () throws -> ChatMuteList = { try ChatMuteList() },
     streamProvider:
       @escaping (
         MessageWatcher,
         Int64?,
         Int64?,
         MessageWatcherConfiguration
-      ) -> AsyncThrowingStream<Message, Error> = { watcher, chatID, sinceRowID, config in
-        watcher.stream(chatID: chatID, sinceRowID: sinceRowID, configuration: config)
+      ) -> AsyncThrowingStream<MessageWatchEvent, Error> = {
+        watcher, chatID, sinceRowID, config in
+        watcher.events(chatID: chatID, sinceRowID: sinceRowID, configuration: config)
       }
   ) async throws {
-    let dbPath = values.option("db") ?? MessageStore.defaultPath
-    let chatID = values.optionInt64("chatID")
+    let dbPath = try CommandSignatures.databasePath(from: values)
+    var chatID = values.optionInt64("chatID")
     let debounceString = values.option("debounce") ?? "250ms"
     guard let debounceInterval = DurationParser.parse(debounceString) else {
       throw ParsedValuesError.invalidOption("debounce")
     }
-    let sinceRowID = values.optionInt64("sinceRowID")
+    var statsInterval: TimeInterval?
+    if let raw = values.option("statsInterval") {
+      guard let parsed = DurationParser.parse(raw), parsed > 0 else {
+        throw ParsedValuesError.invalidOption("statsInterval")
+      }
+      statsInterval = parsed
+    }
+    var heartbeatInterval: TimeInterval = 0
+    if let raw = values.option("heartbeat") {
+      guard runtime.jsonOutput, let parsed = DurationParser.parse(raw), parsed > 0 else {
+        throw ParsedValuesError.invalidOption("heartbeat")
+      }
+      heartbeatInterval = parsed
+    }
+    let polling = try pollIntervals(from: values)
+    var events = MessageWatchEventKinds.messages
+    if !values.optionValues("events").isEmpty {
+      guard let parsed = MessageWatchEventKinds.parse(values.optionValues("events")),
+        !parsed.isEmpty
+      else {
+        throw ParsedValuesError.invalidOption("events")
+      }
+      events = parsed
+    }
+    var sinceRowID = values.optionInt64("sinceRowID")
     let showAttachments = values.flag("attachments")
-    let participants = values.optionValues("participants")
-      .flatMap { $0.split(separator: ",").map { String($0) } }
-      .filter { !$0.isEmpty }
-    let filter = try MessageFilter.fromISO(
-      participants: participants,
-      startISO: values.option("start"),
-      endISO: values.option("end")
-    )
+    let filter = try MessageFilterOptions.filter(from: values)
+    let includeLanguage = MessageFilterOptions.includesLanguage(values)
+    let normalizer = try NormalizationOptions.normalizer(from: values)
+    let embedding = try AttachmentEmbedding.from(values: values)
+    if embedding != nil, !runtime.jsonOutput {
+      throw ParsedValuesError.invalidOption("embed-attachments")
+    }
+    let timestamps = try TimestampFormatter.from(values: values)
+    let labels = try OutputLabels.from(values: values)
+    let template = try MessageTemplateRenderer.from(values: values, timestamps: timestamps)
+    let logger = runtime.automationLogger
+    let execHook = try WatchExecHook.from(values: values, logger: logger)
+    let rules = try values.option("rules").map {
+      MessageRuleEngine(
+        ruleSet: try MessageRuleSet.load(path: $0), timestamps: timestamps, logger: logger)
+    }
 
-    let store = try storeFactory(dbPath)
+    var store = try storeFactory(dbPath)
+    if chatID == nil && values.flag("pick") {
+      chatID = try ChatPicker.chatID(from: values, store: store)
+    }
+    var cursors: WatchCursorStore?
+    let cursorKey = resumeKey(values: values, chatID: chatID)
+    if values.flag("resume") {
+      if sinceRowID != nil {
+        throw ParsedValuesError.invalidOption("resume")
+      }
+      let loaded = try cursorFactory(dbPath)
+      sinceRowID = loaded.cursor(for: cursorKey)
+      cursors = loaded
+    }
+    var mentionMatcher: MentionMatcher?
+    if values.flag("mentionsMe") {
+      let handles = try store.senderAliases().map(\.handle)
+      if handles.isEmpty {
+        logger.log(
+          .error, "no sending handles found; --mentions-me will match nothing",
+          fields: ["command": "watch"])
+      }
+      mentionMatcher = MentionMatcher(handles: handles, region: filter.region)
+    }
+    // A chat named with --chat-id is watched even when muted.
+    let muteList = chatID == nil ? try muteListFactory() : nil
+    // A WAL we can't read means watch would sit silently while new messages arrive.
+    for check in DoctorCommand.walChecks(status: DatabaseWAL.inspect(path: dbPath))
+    where check.status != .ok {
+      var fields = ["command": "watch"]
+      if !check.remediation.isEmpty {
+        fields["remediation"] = check.remediation.joined(separator: "; ")
+      }
+      logger.log(.error, check.detail, fields: fields)
+    }
     let watcher = MessageWatcher(store: store)
     let config = MessageWatcherConfiguration(
       debounceInterval: debounceInterval,
-      batchLimit: 100
+      batchLimit: 100,
+      events: events,
+      heartbeatInterval: heartbeatInterval,
+      minPollInterval: polling.min,
+      maxPollInterval: polling.max
     )
 
+    var printer = MessageTextPrinter(
+      store: store,
+      timestamps: timestamps,
+      showAttachments: showAttachments
+    )
+    printer.template = template
+    printer.labels = labels
+    printer.truncate = try TextTruncation.limit(from: values)
+    var serviceChanges = ServiceChangeTracker(store: store)
+    var activity: ActivityTracker?
+    var statsTask: Task<Void, Never>?
+    if let statsInterval {
+      // Ticks on its own so quiet intervals still report, with zero messages.
+      let tracker = ActivityTracker()
+      activity = tracker
+      statsTask = Task {
+        while !Task.isCancelled {
+          try? await Task.sleep(nanoseconds: UInt64(statsInterval * 1_000_000_000))
+          if Task.isCancelled { break }
+          printStats(tracker.snapshot(), runtime: runtime, timestamps: timestamps)
+        }
+      }
+    }
+    defer { statsTask?.cancel() }
+    var webhookTask: Task<Void, Never>?
+    if let rules, rules.hasWebhooks {
+      // Replays what earlier runs queued and retries endpoints that were down, even while no
+      // new message comes in to trigger a delivery.
+      let queue = rules.webhooks
+      webhookTask = Task {
+        while !Task.isCancelled {
+          if let sent = try? await queue.flush(), sent > 0 {
+            logger.log(
+              .info, "delivered \(sent) queued webhook\(pluralSuffix(for: sent))",
+              fields: ["command": "watch"])
+          }
+          try? await Task.sleep(nanoseconds: 5_000_000_000)
+        }
+      }
+    }
+    defer { webhookTask?.cancel() }
     let stream = streamProvider(watcher, chatID, sinceRowID, config)
-    for try await message in stream {
-      if !filter.allows(message) {
+    for try await event in stream {
+      try muteList?.reloadIfChanged()
+      let message: Message
+      switch event {
+      case .message(let next):
+        message = normalizer?.normalize(next) ?? next
+      case .reconnected(let reconnect):
+        store = reconnect.store
+        printer.store = reconnect.store
+        serviceChanges = ServiceChangeTracker(store: reconnect.store)
+        if runtime.jsonOutput {
+          try JSONLines.print(WatchReconnectPayload(reconnect: reconnect))
+        } else {
+          logger.log(
+            .info,
+            "reopened database (\(reconnect.reason.rawValue)), "
+              + "resuming after rowid \(reconnect.resumeRowID)",
+            fields: ["command": "watch"])
+        }
         continue
-      }
-      if runtime.jsonOutput {
-        let attachments = try store.attachments(for: message.rowID)
-        let reactions = try store.reactions(for: message.rowID)
-        let payload = MessagePayload(
-          message: message,
-          attachments: attachments,
-          reactions: reactions
-        )
-        try JSONLines.print(payload)
+      case .heartbeat(let heartbeat):
+        try JSONLines.print(WatchHeartbeatPayload(heartbeat: heartbeat))
+        try cursors?.save()
+        continue
+      case .reaction, .edited, .deleted, .receipt:
+        if let about = try changedMessage(for: event, store: store),
+          try muteList?.isMuted(chatID: about.chatID, in: store) != true,
+          try store.allows(about, by: filter), mentionMatcher?.matches(about) ?? true
+        {
+          if runtime.jsonOutput, let payload = WatchChangePayload(event: event) {
+            try JSONLines.print(payload)
+          } else if let line = try changeLine(for: event, store: store, timestamps: timestamps) {
+            Swift.print(line)
+          }
+        }
+        if let cursors, case .reaction(let change) = event {
+          cursors.record(change.reaction.rowID, for: cursorKey)
+          try cursors.saveIfDue()
+        }
         continue
       }
-      let direction = message.isFromMe ? "sent" : "recv"
-      let timestamp = CLIISO8601.format(message.date)
-      Swift.print("\(timestamp) [\(direction)] \(message.sender): \(message.text)")
-      if message.attachmentsCount > 0 {
-        if showAttachments {
-          let metas = try store.attachments(for: message.rowID)
-          for meta in metas {
-            let name = displayName(for: meta)
+      // Track every message so a filtered-out switch still updates the chat's service.
+      let serviceChange = try serviceChanges.observe(message)
+      let isMuted = try muteList?.isMuted(chatID: message.chatID, in: store) ?? false
+      if !isMuted, try store.allows(message, by: filter), mentionMatcher?.matches(message) ?? true {
+        if let serviceChange {
+          if runtime.jsonOutput {
+            try JSONLines.print(ServiceChangePayload(change: serviceChange))
+          } else {
+            let account = serviceChange.account.isEmpty ? "" : " via \(serviceChange.account)"
             Swift.print(
-              "  attachment: name=\(name) mime=\(meta.mimeType) missing=\(meta.missing) path=\(meta.originalPath)"
-            )
+              "-- chat \(serviceChange.chatID) switched from \(serviceChange.from) to "
+                + "\(serviceChange.to)\(account) --")
           }
-        } else {
-          Swift.print(
-            "  (\(message.attachmentsCount) attachment\(pluralSuffix(for: message.attachmentsCount)))"
+        }
+        var payload: MessagePayload?
+        if runtime.jsonOutput || execHook != nil {
+          let built = MessagePayload(
+            message: message,
+            attachments: try store.attachments(for: message.rowID),
+            reactions: try store.reactions(for: message.rowID),
+            includeLanguage: includeLanguage
           )
+          payload = embedding?.embed(built) ?? built
+        }
+        if runtime.jsonOutput, let payload {
+          try JSONLines.print(payload)
+        } else {
+          try printer.print(message)
+        }
+        activity?.record(message)
+        await rules?.handle(message, store: store)
+        if let execHook, let payload {
+          await execHook.submit(message, payload: payload)
         }
       }
+      // Saved after printing, so a crash mid-message replays it rather than dropping it. A
+      // burst is written about once a second; heartbeats and the end of the stream flush the rest.
+      if let cursors {
+        cursors.record(message.rowID, for: cursorKey)
+        try cursors.saveIfDue()
+      }
+    }
+    try cursors?.save()
+    await execHook?.finish()
+  }
+
+  /// The message a change event is about, which watch filters on; for a tapback on a message
+  /// missing from chat.db, the tapback itself.
+  static func changedMessage(for event: MessageWatchEvent, store: MessageStore) throws
+    -> Message?
+  {
+    switch event {
+    case .message(let message):
+      return message
+    case .reaction(let change):
+      let target = change.reaction.associatedMessageID
+      return try store.message(rowID: target == 0 ? change.reaction.rowID : target)
+    case .edited(let change):
+      return change.message
+    case .deleted(let change):
+      return change.message
+    case .receipt(let change):
+      return change.message
+    case .reconnected, .heartbeat:
+      return nil
+    }
+  }
+
+  /// `-- chat 3: +1555… reacted ❤️ to "hello" --` and the like for `--events` in text output.
+  static func changeLine(
+    for event: MessageWatchEvent, store: MessageStore, timestamps: TimestampFormatter
+  ) throws -> String? {
+    let who = { (sender: String, isFromMe: Bool) in
+      isFromMe ? "you" : bidiIsolated(displayHandle(sender))
+    }
+    let quoted = { (message: Message) in "\"\(bidiIsolated(displayText(for: message)))\"" }
+    let line: String
+    switch event {
+    case .message, .reconnected, .heartbeat:
+      return nil
+    case .reaction(let change):
+      let reaction = change.reaction
+      let target =
+        try store.message(rowID: reaction.associatedMessageID).map(quoted) ?? "a message"
+      let emoji = reaction.reactionType.emoji
+      let verb = change.isRemoval ? "removed \(emoji) from" : "reacted \(emoji) to"
+      line =
+        "\(timestamps.format(reaction.date)) chat \(change.chatID): "
+        + "\(who(reaction.sender, reaction.isFromMe)) \(verb) \(target)"
+    case .edited(let change):
+      let before = change.previousText.map { "\"\(bidiIsolated($0))\"" } ?? "a message"
+      line =
+        "\(timestamps.format(change.editedAt)) chat \(change.message.chatID): "
+        + "\(who(change.message.sender, change.message.isFromMe)) edited \(before) to "
+        + quoted(change.message)
+    case .deleted(let change):
+      line =
+        "\(timestamps.format(change.deletedAt)) chat \(change.message.chatID): "
+        + "\(who(change.message.sender, change.message.isFromMe)) unsent a message"
+    case .receipt(let change):
+      line =
+        "\(timestamps.format(change.readAt)) chat \(change.message.chatID): read "
+        + quoted(change.message)
+    }
+    return "-- \(line) --"
+  }
+
+  static func printStats(
+    _ snapshot: ActivitySnapshot, runtime: RuntimeOptions, timestamps: TimestampFormatter
+  ) {
+    if runtime.jsonOutput {
+      try? JSONLines.print(WatchStatsPayload(snapshot: snapshot))
+    } else {
+      Swift.print(statsLine(for: snapshot, timestamps: timestamps))
+    }
+  }
+
+  /// `-- stats <start> to <end>: 5 messages; chat 1 3.00/min; top senders +1555… (3) --`
+  static func statsLine(for snapshot: ActivitySnapshot, timestamps: TimestampFormatter) -> String {
+    var line =
+      "-- stats \(timestamps.format(snapshot.start)) to \(timestamps.format(snapshot.end)): "
+      + "\(snapshot.messages) message\(snapshot.messages == 1 ? "" : "s")"
+    if !snapshot.chats.isEmpty {
+      line +=
+        "; "
+        + snapshot.chats.map {
+          "chat \($0.chatID) \(String(format: "%.2f", $0.perMinute))/min"
+        }.joined(separator: ", ")
+    }
+    if !snapshot.topSenders.isEmpty {
+      line +=
+        "; top senders "
+        + snapshot.topSenders.map { "\(displayHandle($0.sender)) (\($0.messages))" }
+        .joined(separator: ", ")
+    }
+    return line + " --"
+  }
+
+  /// Names a filter set for --resume: watches with the same chat and filters share a cursor.
+  static func resumeKey(values: ParsedValues, chatID: Int64?) -> String {
+    var parts = ["chat=\(chatID.map(String.init) ?? "all")"]
+    for label in ["participants", "start", "end", "match", "matchIcase", "textLang"] {
+      let given = values.optionValues(label)
+      if !given.isEmpty {
+        parts.append("\(label)=\(given.joined(separator: ","))")
+      }
+    }
+    if values.flag("mentionsMe") {
+      parts.append("mentionsMe")
+    }
+    return parts.joined(separator: " ")
+  }
+
+  /// `--poll-min`/`--poll-max`; a max of 0 (neither given) leaves polling off.
+  static func pollIntervals(from values: ParsedValues) throws -> (
+    min: TimeInterval, max: TimeInterval
+  ) {
+    let minRaw = values.option("pollMin")
+    let maxRaw = values.option("pollMax")
+    guard minRaw != nil || maxRaw != nil else { return (0.5, 0) }
+    guard let min = DurationParser.parse(minRaw ?? "500ms"), min > 0 else {
+      throw ParsedValuesError.invalidOption("poll-min")
+    }
+    guard let max = DurationParser.parse(maxRaw ?? "30s"), max >= min else {
+      throw ParsedValuesError.invalidOption("poll-max")
     }
+    return (min, max)
   }
 }
@@ -0,0 +1,184 @@
+import Commander
+import Foundation
+import IMsgCore
+
+struct WebhookEventPayload: Codable, Equatable {
+  let id: String
+  let url: String
+  let rule: String?
+  let messageID: Int64?
+  let queuedAt: String
+  let attempts: Int
+  let lastError: String?
+  let nextAttemptAt: String?
+
+  init(event: WebhookEvent) {
+    self.id = event.id
+    self.url = event.url.absoluteString
+    self.rule = event.rule
+    self.messageID = event.messageID
+    self.queuedAt = CLIISO8601.format(event.queuedAt)
+    self.attempts = event.attempts
+    self.lastError = event.lastError
+    self.nextAttemptAt = event.nextAttemptAt.map(CLIISO8601.format)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case id
+    case url
+    case rule
+    case messageID = "message_id"
+    case queuedAt = "queued_at"
+    case attempts
+    case lastError = "last_error"
+    case nextAttemptAt = "next_attempt_at"
+  }
+}
+
+struct WebhookReceiptPayload: Codable, Equatable {
+  let id: String
+  let url: String
+  let rule: String?
+  let messageID: Int64?
+  let status: String
+  let at: String
+  let queuedAt: String
+  let attempts: Int
+  let statusCode: Int?
+  let error: String?
+
+  init(receipt: WebhookReceipt) {
+    self.id = receipt.id
+    self.url = receipt.url.absoluteString
+    self.rule = receipt.rule
+    self.messageID = receipt.messageID
+    self.status = receipt.status.rawValue
+    self.at = CLIISO8601.format(receipt.at)
+    self.queuedAt = CLIISO8601.format(receipt.queuedAt)
+    self.attempts = receipt.attempts
+    self.statusCode = receipt.statusCode
+    self.error = receipt.error
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case id
+    case url
+    case rule
+    case messageID = "message_id"
+    case status
+    case at
+    case queuedAt = "queued_at"
+    case attempts
+    case statusCode = "status_code"
+    case error
+  }
+}
+
+enum WebhookQueueCommand {
+  static let spec = CommandSpec(
+    name: "webhook-queue",
+    abstract: "Inspect or drain queued rule webhooks",
+    discussion: """
+      watch --rules and otp-forward --webhook write every webhook to its own file in
+      webhook-queue/ in the state directory before POSTing it and remove it once the
+      endpoint answers 2xx; a running watch retries the rest in order, backing off from 5s
+      to 5 minutes, and only one process sends a URL's events at a time. A 4xx other than
+      408 or 429 is not retried. At most 1000 events are kept; the oldest are
+      dropped first. Each request carries X-Imsg-Event-Id, so a receiver can skip a repeat
+      after a crash mid-request. This lists the queued events, oldest first. --drain sends
+      them now, ignoring the backoff, and exits non-zero if any are left. --receipts lists
+      what happened to the newest --limit events (delivered, rejected or dropped) from
+      webhook-receipts.jsonl, which is rotated to webhook-receipts.jsonl.1 past 1MB.
+      """,
+    signature: CommandSignatures.withRuntimeFlags(
+      CommandSignature(
+        options: [
+          .make(
+            label: "limit", names: [.long("limit")],
+            help: "Number of receipts with --receipts (default 20)")
+        ],
+        flags: [
+          .make(label: "drain", names: [.long("drain")], help: "deliver queued webhooks now"),
+          .make(
+            label: "receipts", names: [.long("receipts")],
+            help: "list delivery receipts instead of the queue"),
+        ]
+      )
+    ),
+    usageExamples: [
+      "imsg webhook-queue",
+      "imsg webhook-queue --drain",
+      "imsg webhook-queue --receipts --limit 50 --json",
+    ]
+  ) { values, runtime in
+    try await run(values: values, runtime: runtime)
+  }
+
+  static func run(
+    values: ParsedValues,
+    runtime: RuntimeOptions,
+    queue: WebhookQueue = WebhookQueue()
+  ) async throws {
+    if values.flag("receipts") {
+      let limit = values.optionInt("limit") ?? 20
+      guard limit > 0 else {
+        throw ParsedValuesError.invalidOption("limit")
+      }
+      let receipts = try queue.receipts().suffix(limit)
+      for receipt in receipts {
+        if runtime.jsonOutput {
+          try JSONLines.print(WebhookReceiptPayload(receipt: receipt))
+        } else {
+          var line =
+            "\(CLIISO8601.format(receipt.at)) \(receipt.status.rawValue) \(receipt.url) "
+            + "id=\(receipt.id) attempts=\(receipt.attempts)"
+          if let rule = receipt.rule { line += " rule=\(rule)" }
+          if let messageID = receipt.messageID { line += " message=\(messageID)" }
+          if let error = receipt.error { line += " (\(error))" }
+          Swift.print(line)
+        }
+      }
+      if receipts.isEmpty && !runtime.jsonOutput {
+        Swift.print("no webhook receipts")
+      }
+      return
+    }
+
+    if values.flag("drain") {
+      let sent = try await queue.flush(force: true)
+      let left = try queue.pending()
+      if !runtime.jsonOutput {
+        Swift.print("sent \(sent) webhook\(pluralSuffix(for: sent)), \(left.count) still queued")
+      }
+      try printEvents(left, runtime: runtime)
+      if let first = left.first {
+        throw MessageRuleError.actionFailed(
+          "webhook \(first.url.absoluteString) still failing (\(first.lastError ?? "unknown"))")
+      }
+      return
+    }
+
+    let events = try queue.pending()
+    try printEvents(events, runtime: runtime)
+    if events.isEmpty && !runtime.jsonOutput {
+      Swift.print("no queued webhooks")
+    }
+  }
+
+  private static func printEvents(_ events: [WebhookEvent], runtime: RuntimeOptions) throws {
+    for event in events {
+      if runtime.jsonOutput {
+        try JSONLines.print(WebhookEventPayload(event: event))
+        continue
+      }
+      var line =
+        "\(CLIISO8601.format(event.queuedAt)) \(event.url) id=\(event.id) "
+        + "attempts=\(event.attempts)"
+      if let rule = event.rule { line += " rule=\(rule)" }
+      if let messageID = event.messageID { line += " message=\(messageID)" }
+      if let error = event.lastError { line += " (\(error))" }
+      if let next = event.nextAttemptAt { line += " next=\(CLIISO8601.format(next))" }
+      Swift.print(line)
+    }
+  }
+}
@@ -0,0 +1,54 @@
+import Foundation
+import IMsgCore
+
+/// `history --compact`: a transcript for reading rather than parsing. Consecutive messages
+/// from one sender share a `sender · time` header, tapbacks are shown after the message they
+/// react to, and a pause longer than `gap` starts a new header even within one sender's run.
+struct CompactTranscript {
+  let timestamps: TimestampFormatter
+  var showAttachments = false
+  var labels = OutputLabels.english
+  var gap: TimeInterval = 3600
+  /// `--truncate`.
+  var truncate: Int?
+  private var lastSpeaker: String?
+  private var lastDate: Date?
+
+  init(timestamps: TimestampFormatter) {
+    self.timestamps = timestamps
+  }
+
+  /// The lines for `message`, which must come after the previous one in time.
+  mutating func lines(
+    for message: Message, attachments: [AttachmentMeta], reactions: [Reaction]
+  ) -> [String] {
+    let speaker = message.isFromMe ? "me" : bidiIsolated(displayHandle(message.sender))
+    var lines: [String] = []
+    let paused = lastDate.map { message.date.timeIntervalSince($0) > gap } ?? true
+    if speaker != lastSpeaker || paused {
+      lines.append("\(speaker) · \(timestamps.format(message.date))")
+    }
+    lastSpeaker = speaker
+    lastDate = message.date
+    var text = displayText(for: message, attachments: attachments)
+    if let truncate {
+      text = TextTruncation.truncate(text, to: truncate)
+    }
+    let body = bidiIsolated(text)
+    lines.append("  \(body)\(CompactTranscript.tapbacks(reactions))")
+    if showAttachments {
+      lines += attachments.map { "  " + attachmentLine(for: $0, labels: labels) }
+    }
+    return lines
+  }
+
+  /// `  ❤️ Ana, 👍 me`, or empty without reactions.
+  static func tapbacks(_ reactions: [Reaction]) -> String {
+    guard !reactions.isEmpty else { return "" }
+    let list = reactions.map { reaction in
+      let who = reaction.isFromMe ? "me" : bidiIsolated(displayHandle(reaction.sender))
+      return "\(reaction.reactionType.emoji) \(who)"
+    }
+    return "  " + list.joined(separator: ", ")
+  }
+}
@@ -0,0 +1,61 @@
+import Contacts
+import Foundation
+
+/// Names from the Contacts app for phone numbers and email addresses. Without Contacts access
+/// every lookup returns nil; `requestAccess` asks for it once (the system remembers the
+/// answer), so only interactive commands should call it.
+enum ContactNames {
+  private static let store = CNContactStore()
+
+  static var isAuthorized: Bool {
+    CNContactStore.authorizationStatus(for: .contacts) == .authorized
+  }
+
+  /// Shows the system prompt when access was never asked for; returns whether it's granted.
+  @discardableResult
+  static func requestAccess() -> Bool {
+    guard CNContactStore.authorizationStatus(for: .contacts) == .notDetermined else {
+      return isAuthorized
+    }
+    let done = DispatchSemaphore(value: 0)
+    var granted = false
+    store.requestAccess(for: .contacts) { result, _ in
+      granted = result
+      done.signal()
+    }
+    done.wait()
+    return granted
+  }
+
+  /// The full name (or company) of the first contact with this phone number or email.
+  static func name(for handle: String) -> String? {
+    guard isAuthorized, !handle.isEmpty else { return nil }
+    let predicate =
+      handle.contains("@")
+      ? CNContact.predicateForContacts(matchingEmailAddress: handle)
+      : CNContact.predicateForContacts(matching: CNPhoneNumber(stringValue: handle))
+    let keys = [CNContactFormatter.descriptorForRequiredKeys(for: .fullName)]
+    guard let contact = try? store.unifiedContacts(matching: predicate, keysToFetch: keys).first
+    else {
+      return nil
+    }
+    let name = CNContactFormatter.string(from: contact, style: .fullName) ?? ""
+    return name.isEmpty ? nil : name
+  }
+
+  /// Phone numbers and emails of the contacts whose name matches `query` (Contacts matches
+  /// the start of any word of the name, case-insensitively).
+  static func handles(matchingName query: String) -> [String] {
+    guard isAuthorized, !query.isEmpty else { return [] }
+    let predicate = CNContact.predicateForContacts(matchingName: query)
+    let keys = [CNContactPhoneNumbersKey, CNContactEmailAddressesKey] as [CNKeyDescriptor]
+    guard let contacts = try? store.unifiedContacts(matching: predicate, keysToFetch: keys)
+    else {
+      return []
+    }
+    return contacts.flatMap { contact in
+      contact.phoneNumbers.map(\.value.stringValue)
+        + contact.emailAddresses.map { $0.value as String }
+    }
+  }
+}
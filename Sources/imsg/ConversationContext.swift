@@ -0,0 +1,99 @@
+import Foundation
+import IMsgCore
+
+/// The tail of a conversation cut to a token budget, rendered for an LLM prompt. Tokens are
+/// estimated at about four characters each plus a few per turn for role markup, which is
+/// close enough for budgeting without shipping a tokenizer.
+struct ConversationContext {
+  enum Format: String, CaseIterable {
+    case plain
+    case chatml
+  }
+
+  struct Turn: Equatable {
+    let isFromMe: Bool
+    let sender: String
+    let content: String
+    let date: Date
+  }
+
+  static let turnOverhead = 4
+
+  let turns: [Turn]
+  let isGroup: Bool
+
+  /// `messages` newest first, as `MessageStore.messages(chatID:limit:)` returns them. Keeps the
+  /// newest turns that fit in `tokens`, oldest first; the newest is always kept, its start cut
+  /// off if it alone is over budget.
+  init(messages: [Message], isGroup: Bool, tokens: Int) {
+    var kept: [Turn] = []
+    var used = 0
+    for message in messages {
+      let content = ConversationContext.content(of: message)
+      guard !content.isEmpty else { continue }
+      var turn = Turn(
+        isFromMe: message.isFromMe, sender: message.sender, content: content, date: message.date)
+      let cost = ConversationContext.estimateTokens(content) + ConversationContext.turnOverhead
+      if used + cost > tokens {
+        guard kept.isEmpty else { break }
+        let room = max(0, tokens - ConversationContext.turnOverhead) * 4
+        turn = Turn(
+          isFromMe: turn.isFromMe, sender: turn.sender, content: "…" + content.suffix(room),
+          date: turn.date)
+        kept.append(turn)
+        used = tokens
+        break
+      }
+      kept.append(turn)
+      used += cost
+    }
+    self.turns = kept.reversed()
+    self.isGroup = isGroup
+  }
+
+  var estimatedTokens: Int {
+    turns.reduce(0) {
+      $0 + ConversationContext.estimateTokens($1.content) + ConversationContext.turnOverhead
+    }
+  }
+
+  static func estimateTokens(_ text: String) -> Int {
+    (text.count + 3) / 4
+  }
+
+  /// Message text without attachment placeholders, with a note for what was attached.
+  static func content(of message: Message) -> String {
+    var text = ForwardCommand.forwardedText(message.text)
+    if message.attachmentsCount > 0 {
+      let count = message.attachmentsCount
+      let note = count == 1 ? "[attachment]" : "[\(count) attachments]"
+      text = text.isEmpty ? note : "\(text) \(note)"
+    }
+    return text
+  }
+
+  /// `me` / `them`; group chats name the other sender, e.g. `them (+15551234567)`.
+  func label(for turn: Turn) -> String {
+    if turn.isFromMe { return "me" }
+    return isGroup && !turn.sender.isEmpty ? "them (\(turn.sender))" : "them"
+  }
+
+  /// ChatML role: your messages are the assistant's, everyone else's the user's, so a bot
+  /// continuing the transcript answers as you.
+  static func role(for turn: Turn) -> String {
+    turn.isFromMe ? "assistant" : "user"
+  }
+
+  func render(_ format: Format) -> String {
+    switch format {
+    case .plain:
+      return turns.map { "\(label(for: $0)): \($0.content)" }.joined(separator: "\n")
+    case .chatml:
+      return turns.map { turn in
+        let content =
+          isGroup && !turn.isFromMe ? "\(label(for: turn)): \(turn.content)" : turn.content
+        return "<|im_start|>\(ConversationContext.role(for: turn))\n\(content)<|im_end|>"
+      }.joined(separator: "\n")
+    }
+  }
+}
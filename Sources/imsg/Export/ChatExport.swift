@@ -0,0 +1,80 @@
+import Foundation
+import IMsgCore
+
+struct ExportedMessage {
+  let message: Message
+  let attachments: [AttachmentMeta]
+  let reactions: [Reaction]
+}
+
+/// A chat plus a scan of its messages (oldest first), streamed to an export renderer a batch
+/// at a time so large chats never sit in memory whole.
+struct ChatExport {
+  let chat: ChatInfo
+  let participants: [String]
+  let store: MessageStore
+  let limit: Int?
+  let filter: MessageFilter
+  let redactor: MessageRedactor?
+  /// `--split`: only messages in this period.
+  var dateRange: Range<Date>? = nil
+  /// `--since-last`: only messages after the previous run's cursor.
+  var afterRowID: Int64? = nil
+  /// Called with the size of each batch handed to `scan`, for progress reporting.
+  var onBatch: ((Int) -> Void)? = nil
+  /// Called with each batch handed to `scan`, for the export manifest.
+  var onItems: (([ExportedMessage]) -> Void)? = nil
+
+  var isGroup: Bool {
+    isGroupHandle(identifier: chat.identifier, guid: chat.guid)
+  }
+
+  var title: String {
+    chat.name.isEmpty ? chat.identifier : chat.name
+  }
+
+  static func load(
+    store: MessageStore,
+    chat: ChatInfo,
+    limit: Int?,
+    filter: MessageFilter,
+    redactor: MessageRedactor? = nil,
+    dateRange: Range<Date>? = nil,
+    afterRowID: Int64? = nil
+  ) throws -> ChatExport {
+    ChatExport(
+      chat: chat,
+      participants: try store.participants(chatID: chat.id),
+      store: store,
+      limit: limit,
+      filter: filter,
+      redactor: redactor,
+      dateRange: dateRange,
+      afterRowID: afterRowID
+    )
+  }
+
+  /// Hands the filtered messages to `body` oldest first, with their attachments and reactions.
+  /// The filter runs inside the scan, so `limit` counts only messages it keeps.
+  func scan(_ body: ([ExportedMessage]) throws -> Void) throws {
+    try store.scanMessages(
+      chatID: chat.id, limit: limit, order: .oldestFirst, dateRange: dateRange,
+      handleIDs: try store.senderHandleIDs(for: filter), afterRowID: afterRowID,
+      matching: { try store.allows($0, by: filter) }
+    ) { batch in
+      let rows = batch.map { redactor?.redact($0) ?? $0 }
+      if rows.isEmpty { return }
+      let extras = try MessageExtras.load(store: store, messages: rows)
+      let items = rows.map { message in
+        ExportedMessage(
+          message: message,
+          attachments: extras.attachments(for: message.rowID),
+          reactions: extras.reactions(for: message.rowID)
+        )
+      }
+      try body(items)
+      onItems?(items)
+      onBatch?(rows.count)
+    }
+  }
+}
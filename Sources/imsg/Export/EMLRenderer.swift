@@ -0,0 +1,186 @@
+import Foundation
+import IMsgCore
+
+/// `--format eml`: one RFC 5322 message per iMessage in an output directory, for mail
+/// archives and eDiscovery tools. Handles become addresses (`+15551234567@imessage.invalid`
+/// for phone numbers; email handles as they are), text is quoted-printable, and attachments
+/// are base64 MIME parts. Files are named `<UTC time>-<rowid>.eml`, so a directory listing
+/// is in order and repeated `--since-last` runs only add files.
+struct EMLRenderer {
+  let outputURL: URL
+
+  /// Writes every message of `export` and returns how many. With `skipEmpty` a directory this
+  /// run created but left empty is removed again.
+  func write(_ export: ChatExport, skipEmpty: Bool = false) throws -> Int {
+    let fileManager = FileManager.default
+    let existed = fileManager.fileExists(atPath: outputURL.path)
+    try fileManager.createDirectory(at: outputURL, withIntermediateDirectories: true)
+    var count = 0
+    try export.scan { items in
+      for item in items {
+        let url = outputURL.appendingPathComponent(EMLRenderer.fileName(for: item.message))
+        try Data(EMLRenderer.message(for: item, in: export).utf8).write(to: url, options: .atomic)
+        count += 1
+      }
+    }
+    if count == 0, skipEmpty, !existed {
+      try? fileManager.removeItem(at: outputURL)
+    }
+    return count
+  }
+
+  static func fileName(for message: Message) -> String {
+    "\(fileTimeFormatter.string(from: message.date))-\(message.rowID).eml"
+  }
+
+  /// The whole message, CRLF line endings.
+  static func message(for item: ExportedMessage, in export: ChatExport) -> String {
+    let message = item.message
+    let sender = message.isFromMe ? me(account: message.account) : address(for: message.sender)
+    var recipients = export.participants.filter { $0 != message.sender }.map(address(for:))
+    if !message.isFromMe {
+      recipients.insert(me(account: ""), at: 0)
+    }
+    var headers = [
+      "From: \(sender)",
+      "To: \(recipients.isEmpty ? me(account: "") : recipients.joined(separator: ", "))",
+      "Subject: \(encodedWord(export.isGroup ? export.title : "Messages with \(export.title)"))",
+      "Date: \(dateFormatter.string(from: message.date))",
+    ]
+    if !message.guid.isEmpty {
+      headers.append("Message-ID: <\(message.guid)@imessage.invalid>")
+    }
+    if let reply = message.replyToGUID, !reply.isEmpty {
+      headers.append("In-Reply-To: <\(reply)@imessage.invalid>")
+      headers.append("References: <\(reply)@imessage.invalid>")
+    }
+    headers += [
+      "X-iMessage-Chat: \(export.chat.guid)",
+      "X-iMessage-Service: \(message.service)",
+      "X-iMessage-RowID: \(message.rowID)",
+      "MIME-Version: 1.0",
+    ]
+
+    var text = displayText(for: message, attachments: item.attachments)
+    if text == "\u{FFFC}" { text = "" }
+    var notes: [String] = []
+    let files = item.attachments.compactMap { meta -> (AttachmentMeta, Data)? in
+      guard !meta.missing, let data = FileManager.default.contents(atPath: meta.originalPath)
+      else {
+        notes.append("[missing attachment: \(displayName(for: meta))]")
+        return nil
+      }
+      return (meta, data)
+    }
+    notes += item.reactions.map { reaction in
+      "[\(reaction.reactionType.name) \(reaction.reactionType.emoji) from "
+        + "\(reaction.isFromMe ? "me" : reaction.sender)]"
+    }
+    let body = ([text] + notes).filter { !$0.isEmpty }.joined(separator: "\n")
+    let textPart = [
+      "Content-Type: text/plain; charset=utf-8",
+      "Content-Transfer-Encoding: quoted-printable",
+      "",
+      quotedPrintable(body),
+    ]
+
+    var lines = headers
+    if files.isEmpty {
+      lines += textPart
+    } else {
+      // "=_" never occurs in quoted-printable or base64 output, so no part can contain it.
+      let boundary = "=_imsg_\(message.rowID)"
+      lines += ["Content-Type: multipart/mixed; boundary=\"\(boundary)\"", "", "--\(boundary)"]
+      lines += textPart
+      for (meta, data) in files {
+        let name = displayName(for: meta)
+        let mime = meta.mimeType.isEmpty ? "application/octet-stream" : meta.mimeType
+        lines += [
+          "--\(boundary)",
+          "Content-Type: \(mime); name=\"\(asciiFallback(name))\"",
+          "Content-Disposition: attachment; \(filenameParameter(name))",
+          "Content-Transfer-Encoding: base64",
+          "",
+          data.base64EncodedString(
+            options: [.lineLength76Characters, .endLineWithCarriageReturn, .endLineWithLineFeed]),
+        ]
+      }
+      lines.append("--\(boundary)--")
+    }
+    return lines.joined(separator: "\r\n") + "\r\n"
+  }
+
+  /// Email handles as they are; phone numbers and anything else under `imessage.invalid`.
+  static func address(for handle: String) -> String {
+    if handle.contains("@") { return "<\(handle)>" }
+    let local = handle.filter { $0.isLetter || $0.isNumber || $0 == "+" }
+    return "<\(local.isEmpty ? "unknown" : local)@imessage.invalid>"
+  }
+
+  /// Your own side: the account the message went out on (`p:+1555…` / `e:you@icloud.com`)
+  /// when chat.db recorded it.
+  static func me(account: String) -> String {
+    let handle = account.split(separator: ":", maxSplits: 1).last.map(String.init) ?? ""
+    return "Me \(address(for: handle.isEmpty ? "me" : handle))"
+  }
+
+  /// RFC 2047 `=?UTF-8?B?…?=` for non-ASCII header text.
+  static func encodedWord(_ text: String) -> String {
+    guard !text.unicodeScalars.allSatisfy(\.isASCII) else { return text }
+    return "=?UTF-8?B?\(Data(text.utf8).base64EncodedString())?="
+  }
+
+  /// Quoted-printable (RFC 2045) with CRLF line breaks and soft breaks before 76 columns.
+  static func quotedPrintable(_ text: String) -> String {
+    var output: [String] = []
+    for line in text.components(separatedBy: "\n") {
+      var encoded = ""
+      var width = 0
+      let bytes = Array(line.replacingOccurrences(of: "\r", with: "").utf8)
+      for (index, byte) in bytes.enumerated() {
+        let isLast = index == bytes.count - 1
+        let literal =
+          (byte >= 33 && byte <= 126 && byte != 61) || ((byte == 32 || byte == 9) && !isLast)
+        let piece = literal ? String(UnicodeScalar(byte)) : String(format: "=%02X", byte)
+        if width + piece.count > 75 {
+          encoded += "=\r\n"
+          width = 0
+        }
+        encoded += piece
+        width += piece.count
+      }
+      output.append(encoded)
+    }
+    return output.joined(separator: "\r\n")
+  }
+
+  /// `filename="x.jpg"`, plus an RFC 2231 `filename*` for names that aren't plain ASCII.
+  private static func filenameParameter(_ name: String) -> String {
+    let plain = "filename=\"\(asciiFallback(name))\""
+    guard !name.unicodeScalars.allSatisfy(\.isASCII) else { return plain }
+    let allowed = CharacterSet.alphanumerics.union(CharacterSet(charactersIn: "-._~"))
+    let encoded = name.addingPercentEncoding(withAllowedCharacters: allowed) ?? ""
+    return "\(plain); filename*=UTF-8''\(encoded)"
+  }
+
+  private static func asciiFallback(_ name: String) -> String {
+    String(
+      name.unicodeScalars.map { $0.isASCII && $0 != "\"" && $0 != "\\" ? Character($0) : "_" })
+  }
+
+  private static let dateFormatter: DateFormatter = {
+    let formatter = DateFormatter()
+    formatter.locale = Locale(identifier: "en_US_POSIX")
+    formatter.timeZone = TimeZone(identifier: "UTC")
+    formatter.dateFormat = "EEE, dd MMM yyyy HH:mm:ss Z"
+    return formatter
+  }()
+
+  private static let fileTimeFormatter: DateFormatter = {
+    let formatter = DateFormatter()
+    formatter.locale = Locale(identifier: "en_US_POSIX")
+    formatter.timeZone = TimeZone(identifier: "UTC")
+    formatter.dateFormat = "yyyyMMdd'T'HHmmss'Z'"
+    return formatter
+  }()
+}
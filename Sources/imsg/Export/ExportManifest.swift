@@ -0,0 +1,317 @@
+import CryptoKit
+import Foundation
+import IMsgCore
+
+/// `manifest.json` written beside an export run with `--manifest`: what each file holds
+/// (messages, date range, attachments with their SHA-256), the checksum of each file, the imsg
+/// version and the checksum of chat.db and its -wal at export time. A later `--manifest` run
+/// over the same output first checks the files the previous manifest lists and reports any
+/// that changed or vanished as drift.
+struct ExportManifest: Codable {
+  static let version = 1
+
+  struct Source: Codable {
+    let path: String
+    /// Nil when chat.db couldn't be read for hashing.
+    let sha256: String?
+    let bytes: Int64?
+    /// chat.db-wal, which holds writes not yet checkpointed into chat.db; nil when there is none.
+    let walSHA256: String?
+    let walBytes: Int64?
+
+    enum CodingKeys: String, CodingKey {
+      case path
+      case sha256
+      case bytes
+      case walSHA256 = "wal_sha256"
+      case walBytes = "wal_bytes"
+    }
+  }
+
+  struct Attachment: Codable, Equatable {
+    let messageGUID: String
+    /// Nil in `--redact` exports, whose file paths would give away names and accounts.
+    let path: String?
+    /// Nil for files not on disk (kept only in iCloud).
+    let sha256: String?
+    let bytes: Int64?
+
+    enum CodingKeys: String, CodingKey {
+      case messageGUID = "message_guid"
+      case path
+      case sha256
+      case bytes
+    }
+  }
+
+  struct File: Codable {
+    /// Relative to the manifest's directory.
+    let path: String
+    /// For an eml directory, a hash over every file's relative path and SHA-256.
+    let sha256: String
+    let bytes: Int64
+    let chatIDs: [Int64]
+    let messages: Int
+    let firstDate: String?
+    let lastDate: String?
+    let attachments: [Attachment]
+
+    enum CodingKeys: String, CodingKey {
+      case path
+      case sha256
+      case bytes
+      case chatIDs = "chat_ids"
+      case messages
+      case firstDate = "first_date"
+      case lastDate = "last_date"
+      case attachments
+    }
+  }
+
+  /// A file the previous manifest lists whose contents no longer match; `actual` is nil when
+  /// the file is gone.
+  struct Drift: Codable, Equatable {
+    let path: String
+    let expected: String
+    let actual: String?
+  }
+
+  let manifestVersion: Int
+  let generator: String
+  let createdAt: String
+  let format: String
+  let source: Source
+  let chats: Int
+  let messages: Int
+  let attachments: Int
+  let firstDate: String?
+  let lastDate: String?
+  let files: [File]
+  let drift: [Drift]
+
+  enum CodingKeys: String, CodingKey {
+    case manifestVersion = "manifest_version"
+    case generator
+    case createdAt = "created_at"
+    case format
+    case source
+    case chats
+    case messages
+    case attachments
+    case firstDate = "first_date"
+    case lastDate = "last_date"
+    case files
+    case drift
+  }
+
+  /// `manifest.json` inside directory outputs, `<file>.manifest.json` beside single files.
+  static func url(for output: URL, isDirectory: Bool) -> URL {
+    isDirectory
+      ? output.appendingPathComponent("manifest.json")
+      : output.deletingLastPathComponent()
+        .appendingPathComponent("\(output.lastPathComponent).manifest.json")
+  }
+
+  /// The manifest at `url`, or nil when there is none or it can't be read.
+  static func load(from url: URL) -> ExportManifest? {
+    guard let data = try? Data(contentsOf: url) else { return nil }
+    return try? JSONDecoder().decode(ExportManifest.self, from: data)
+  }
+
+  /// Re-hashes every file this manifest lists, relative to `directory`.
+  func drift(in directory: URL) -> [Drift] {
+    files.compactMap { file in
+      let actual = try? ExportManifest.checksum(of: directory.appendingPathComponent(file.path))
+      return actual?.sha256 == file.sha256
+        ? nil : Drift(path: file.path, expected: file.sha256, actual: actual?.sha256)
+    }
+  }
+
+  /// The manifest for a run that wrote `written`. Files from `previous` this run didn't
+  /// rewrite are kept when they still match, so incremental and split runs describe the
+  /// whole output.
+  static func build(
+    format: ExportFormat,
+    databasePath: String,
+    written: [URL],
+    recorder: ExportManifestRecorder,
+    directory: URL,
+    previous: ExportManifest?,
+    drift: [Drift],
+    now: Date = Date()
+  ) throws -> ExportManifest {
+    var files: [File] = []
+    for url in written {
+      let checksum = try checksum(of: url)
+      let stats = recorder.stats(for: url)
+      files.append(
+        File(
+          path: relativePath(of: url, in: directory), sha256: checksum.sha256,
+          bytes: checksum.bytes, chatIDs: stats.chatIDs.sorted(), messages: stats.messages,
+          firstDate: stats.firstDate.map(CLIISO8601.format),
+          lastDate: stats.lastDate.map(CLIISO8601.format), attachments: stats.attachments))
+    }
+    let rewritten = Set(files.map(\.path))
+    let drifted = Set(drift.map(\.path))
+    files += (previous?.files ?? []).filter {
+      !rewritten.contains($0.path) && !drifted.contains($0.path)
+    }
+    files.sort { $0.path < $1.path }
+
+    let source = try? checksum(of: URL(fileURLWithPath: databasePath))
+    let wal = try? checksum(of: URL(fileURLWithPath: databasePath + "-wal"))
+    return ExportManifest(
+      manifestVersion: version,
+      generator: "imsg \(IMsgVersion.current)",
+      createdAt: CLIISO8601.format(now),
+      format: format.rawValue,
+      source: Source(
+        path: databasePath, sha256: source?.sha256, bytes: source?.bytes,
+        walSHA256: wal?.sha256, walBytes: wal?.bytes),
+      chats: Set(files.flatMap(\.chatIDs)).count,
+      messages: files.reduce(0) { $0 + $1.messages },
+      attachments: files.reduce(0) { $0 + $1.attachments.count },
+      firstDate: files.compactMap(\.firstDate).min(),
+      lastDate: files.compactMap(\.lastDate).max(),
+      files: files,
+      drift: drift
+    )
+  }
+
+  func write(to url: URL) throws {
+    let encoder = JSONEncoder()
+    encoder.outputFormatting = [.prettyPrinted, .sortedKeys, .withoutEscapingSlashes]
+    try encoder.encode(self).write(to: url, options: .atomic)
+  }
+
+  /// Hex SHA-256 and size of a file, read in 1MB chunks; for a directory, a hash over each
+  /// file's relative path and SHA-256 in path order, with the total size.
+  static func checksum(of url: URL) throws -> (sha256: String, bytes: Int64) {
+    var isDirectory: ObjCBool = false
+    guard FileManager.default.fileExists(atPath: url.path, isDirectory: &isDirectory) else {
+      throw CocoaError(.fileNoSuchFile, userInfo: [NSFilePathErrorKey: url.path])
+    }
+    var hasher = SHA256()
+    var bytes: Int64 = 0
+    if isDirectory.boolValue {
+      let paths = (FileManager.default.subpaths(atPath: url.path) ?? []).sorted()
+      for path in paths {
+        let child = url.appendingPathComponent(path)
+        var childIsDirectory: ObjCBool = false
+        FileManager.default.fileExists(atPath: child.path, isDirectory: &childIsDirectory)
+        if childIsDirectory.boolValue { continue }
+        let file = try checksum(of: child)
+        hasher.update(data: Data("\(path)\u{0}\(file.sha256)\n".utf8))
+        bytes += file.bytes
+      }
+    } else {
+      let handle = try FileHandle(forReadingFrom: url)
+      defer { try? handle.close() }
+      while let chunk = try handle.read(upToCount: 1 << 20), !chunk.isEmpty {
+        hasher.update(data: chunk)
+        bytes += Int64(chunk.count)
+      }
+    }
+    return (hasher.finalize().map { String(format: "%02x", $0) }.joined(), bytes)
+  }
+
+  static func relativePath(of url: URL, in directory: URL) -> String {
+    let base = directory.standardizedFileURL.path
+    let path = url.standardizedFileURL.path
+    guard path.hasPrefix(base + "/") else { return path }
+    return String(path.dropFirst(base.count + 1))
+  }
+}
+
+/// Collects what went into each export file while the renderers scan; safe to call from the
+/// export workers at once. Attachment files are hashed once per path.
+final class ExportManifestRecorder: @unchecked Sendable {
+  /// False for `--redact` exports; attachments are then listed by checksum only.
+  let includesPaths: Bool
+
+  struct Stats {
+    var chatIDs: Set<Int64> = []
+    var messages = 0
+    var firstDate: Date?
+    var lastDate: Date?
+    var attachments: [ExportManifest.Attachment] = []
+  }
+
+  private let lock = NSLock()
+  private var files: [String: Stats] = [:]
+  private var hashes: [String: (sha256: String, bytes: Int64)] = [:]
+
+  init(includesPaths: Bool = true) {
+    self.includesPaths = includesPaths
+  }
+
+  func record(_ items: [ExportedMessage], chatID: Int64, file: URL) {
+    var attachments: [ExportManifest.Attachment] = []
+    for item in items {
+      for meta in item.attachments {
+        let checksum = meta.missing ? nil : checksum(of: meta.originalPath)
+        attachments.append(
+          ExportManifest.Attachment(
+            messageGUID: item.message.guid, path: includesPaths ? meta.originalPath : nil,
+            sha256: checksum?.sha256, bytes: checksum?.bytes))
+      }
+    }
+    let dates = items.map(\.message.date)
+    lock.lock()
+    defer { lock.unlock() }
+    var stats = files[file.standardizedFileURL.path, default: Stats()]
+    stats.chatIDs.insert(chatID)
+    stats.messages += items.count
+    if let first = dates.min() {
+      stats.firstDate = min(stats.firstDate ?? first, first)
+    }
+    if let last = dates.max() {
+      stats.lastDate = max(stats.lastDate ?? last, last)
+    }
+    stats.attachments += attachments
+    files[file.standardizedFileURL.path] = stats
+  }
+
+  func stats(for file: URL) -> Stats {
+    lock.lock()
+    defer { lock.unlock() }
+    return files[file.standardizedFileURL.path] ?? Stats()
+  }
+
+  private func checksum(of path: String) -> (sha256: String, bytes: Int64)? {
+    lock.lock()
+    let cached = hashes[path]
+    lock.unlock()
+    if let cached { return cached }
+    guard let computed = try? ExportManifest.checksum(of: URL(fileURLWithPath: path)) else {
+      return nil
+    }
+    lock.lock()
+    hashes[path] = computed
+    lock.unlock()
+    return computed
+  }
+}
+
+/// The manifest side of one `--manifest` export run: the previous manifest and its drift,
+/// checked before anything is overwritten, and the recorder the renderers feed.
+struct ExportManifestRun {
+  let url: URL
+  let recorder: ExportManifestRecorder
+  let previous: ExportManifest?
+  let drift: [ExportManifest.Drift]
+
+  init(url: URL, includesPaths: Bool = true) {
+    self.url = url
+    recorder = ExportManifestRecorder(includesPaths: includesPaths)
+    previous = ExportManifest.load(from: url)
+    drift = previous?.drift(in: url.deletingLastPathComponent()) ?? []
+  }
+
+  func finish(format: ExportFormat, databasePath: String, written: [URL]) throws {
+    try ExportManifest.build(
+      format: format, databasePath: databasePath, written: written, recorder: recorder,
+      directory: url.deletingLastPathComponent(), previous: previous, drift: drift
+    ).write(to: url)
+  }
+}
@@ -0,0 +1,183 @@
+import Commander
+import Foundation
+
+/// Progress on stderr for exports of many chats, which can take a long time. `bars` redraws
+/// one bar per chat being exported plus a running total (the default on a terminal); `json`
+/// writes one event per line for scripts; `none` stays silent. Totals come from chat.db's
+/// message counts, so a bar can finish short of full when filters or --split drop messages.
+final class ExportProgress: @unchecked Sendable {
+  enum Mode: String, CaseIterable {
+    case bars
+    case json
+    case none
+  }
+
+  struct Event: Codable, Equatable {
+    /// `start`, `progress`, `done` or `failed`.
+    let event: String
+    let chatID: Int64
+    let messages: Int
+    let total: Int?
+    var error: String?
+
+    enum CodingKeys: String, CodingKey {
+      case event
+      case chatID = "chat_id"
+      case messages
+      case total
+      case error
+    }
+  }
+
+  /// The last `json` event: totals for the whole run.
+  struct Summary: Codable, Equatable {
+    let event: String
+    let chats: Int
+    let messages: Int
+    let failed: Int
+    let seconds: Double
+  }
+
+  private struct Row {
+    let chatID: Int64
+    let title: String
+    var messages: Int
+    let total: Int?
+  }
+
+  let mode: Mode
+  private let chatCount: Int
+  private let write: (String) -> Void
+  private let lock = NSLock()
+  private var rows: [Row] = []
+  private var finishedChats = 0
+  private var finishedMessages = 0
+  private var drawnLines = 0
+  private var lastDraw = Date.distantPast
+
+  init(
+    mode: Mode,
+    chats: Int,
+    write: @escaping (String) -> Void = { FileHandle.standardError.write(Data($0.utf8)) }
+  ) {
+    self.mode = mode
+    self.chatCount = chats
+    self.write = write
+  }
+
+  static func options() -> [OptionDefinition] {
+    [
+      .make(
+        label: "progress", names: [.long("progress")],
+        help: "progress on stderr for multi-chat exports: bars|json|none")
+    ]
+  }
+
+  /// `--quiet` wins over `--progress`; without either, bars on a terminal and nothing otherwise.
+  static func mode(from values: ParsedValues) throws -> Mode {
+    if values.flag("quiet") { return .none }
+    if let raw = values.option("progress") {
+      guard let mode = Mode(rawValue: raw.lowercased()) else {
+        throw ParsedValuesError.invalidOption("progress")
+      }
+      return mode
+    }
+    return isatty(STDERR_FILENO) == 1 ? .bars : .none
+  }
+
+  func start(chatID: Int64, title: String, total: Int?) {
+    lock.lock()
+    defer { lock.unlock() }
+    rows.append(Row(chatID: chatID, title: title, messages: 0, total: total))
+    emit(Event(event: "start", chatID: chatID, messages: 0, total: total), force: true)
+  }
+
+  func advance(chatID: Int64, by count: Int) {
+    lock.lock()
+    defer { lock.unlock() }
+    guard let index = rows.firstIndex(where: { $0.chatID == chatID }) else { return }
+    rows[index].messages += count
+    let row = rows[index]
+    emit(Event(event: "progress", chatID: chatID, messages: row.messages, total: row.total))
+  }
+
+  func finish(chatID: Int64, error: Error? = nil) {
+    lock.lock()
+    defer { lock.unlock() }
+    guard let index = rows.firstIndex(where: { $0.chatID == chatID }) else { return }
+    let row = rows.remove(at: index)
+    finishedChats += 1
+    finishedMessages += row.messages
+    var event = Event(
+      event: error == nil ? "done" : "failed", chatID: chatID, messages: row.messages,
+      total: row.total)
+    event.error = error.map { String(describing: $0) }
+    emit(event, force: true)
+  }
+
+  func summary(chats: Int, messages: Int, failed: Int, seconds: TimeInterval) {
+    guard mode == .json else { return }
+    let summary = Summary(
+      event: "summary", chats: chats, messages: messages, failed: failed,
+      seconds: (seconds * 10).rounded() / 10)
+    lock.lock()
+    defer { lock.unlock() }
+    if let line = try? JSONLines.encode(summary) {
+      write(line + "\n")
+    }
+  }
+
+  /// Clears the bars so the summary prints on a clean terminal.
+  func close() {
+    lock.lock()
+    defer { lock.unlock() }
+    guard mode == .bars, drawnLines > 0 else { return }
+    write("\u{1B}[\(drawnLines)A\u{1B}[J")
+    drawnLines = 0
+  }
+
+  /// Bars redraw at most ten times a second; starts and finishes always redraw.
+  private func emit(_ event: Event, force: Bool = false) {
+    switch mode {
+    case .none:
+      return
+    case .json:
+      if let line = try? JSONLines.encode(event) {
+        write(line + "\n")
+      }
+    case .bars:
+      let now = Date()
+      if !force && now.timeIntervalSince(lastDraw) < 0.1 { return }
+      lastDraw = now
+      draw()
+    }
+  }
+
+  private func draw() {
+    let running = rows.reduce(0) { $0 + $1.messages }
+    var lines = rows.map(ExportProgress.line(for:))
+    lines.append(
+      "[\(finishedChats)/\(chatCount) chats] \(finishedMessages + running) messages exported")
+    var output = drawnLines > 0 ? "\u{1B}[\(drawnLines)A" : ""
+    for line in lines {
+      output += "\u{1B}[2K\(line)\n"
+    }
+    // Erases leftover lines when fewer chats are running than at the last draw.
+    output += "\u{1B}[J"
+    write(output)
+    drawnLines = lines.count
+  }
+
+  private static func line(for row: Row) -> String {
+    let width = 24
+    let title = row.title.count > width ? String(row.title.prefix(width - 1)) + "…" : row.title
+    let label = title.padding(toLength: width, withPad: " ", startingAt: 0)
+    guard let total = row.total, total > 0 else {
+      return "\(label) \(row.messages)"
+    }
+    let filled = min(width, row.messages * width / total)
+    let bar = String(repeating: "#", count: filled)
+      + String(repeating: "-", count: width - filled)
+    return "\(label) [\(bar)] \(min(row.messages, total))/\(total)"
+  }
+}
@@ -0,0 +1,37 @@
+import Foundation
+import IMsgCore
+
+/// `--split monthly|yearly`: one export file per calendar period in local time, named
+/// `<name>-2025-01.<ext>` or `<name>-2025.<ext>` after the `--out` path.
+enum ExportSplit: String, CaseIterable {
+  case monthly
+  case yearly
+
+  func period(containing date: Date, calendar: Calendar = .current) -> DateInterval {
+    let component: Calendar.Component = self == .monthly ? .month : .year
+    return calendar.dateInterval(of: component, for: date) ?? DateInterval(start: date, duration: 0)
+  }
+
+  func url(for period: DateInterval, base: URL, calendar: Calendar = .current) -> URL {
+    let parts = calendar.dateComponents([.year, .month], from: period.start)
+    let year = String(format: "%04d", parts.year ?? 0)
+    let label = self == .monthly ? "\(year)-\(String(format: "%02d", parts.month ?? 0))" : year
+    let stem = base.deletingPathExtension().lastPathComponent
+    let name = "\(stem)-\(label)"
+    let file = base.pathExtension.isEmpty ? name : "\(name).\(base.pathExtension)"
+    return base.deletingLastPathComponent().appendingPathComponent(file)
+  }
+
+  /// The periods holding messages of `chatIDs` after `afterRowID`, oldest first.
+  func periods(store: MessageStore, chatIDs: [Int64], afterRowID: Int64?) throws
+    -> [DateInterval]
+  {
+    var periods: Set<DateInterval> = []
+    for chatID in chatIDs {
+      try store.scanMessageDates(chatID: chatID, afterRowID: afterRowID) { date in
+        periods.insert(period(containing: date))
+      }
+    }
+    return periods.sorted { $0.start < $1.start }
+  }
+}
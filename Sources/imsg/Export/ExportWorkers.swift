@@ -0,0 +1,36 @@
+import Foundation
+
+/// Exports chats in parallel, each worker on its own database connection.
+enum ExportWorkers {
+  /// The default for `--jobs`: enough to keep the disk busy without starving the machine.
+  static var defaultLimit: Int {
+    min(4, max(1, ProcessInfo.processInfo.activeProcessorCount))
+  }
+
+  /// Runs `work` for every item with at most `limit` running at once and returns the outcomes
+  /// in item order. One item failing does not stop the others.
+  static func run<Item, Output: Sendable>(
+    _ items: [Item],
+    limit: Int,
+    _ work: @escaping (Item) throws -> Output
+  ) async -> [Result<Output, Error>] {
+    await withTaskGroup(of: (Int, Result<Output, Error>).self) { group in
+      var outcomes = [Result<Output, Error>?](repeating: nil, count: items.count)
+      var next = 0
+      while next < min(max(1, limit), items.count) {
+        let index = next
+        group.addTask { (index, Result { try work(items[index]) }) }
+        next += 1
+      }
+      while let (index, outcome) = await group.next() {
+        outcomes[index] = outcome
+        if next < items.count {
+          let index = next
+          group.addTask { (index, Result { try work(items[index]) }) }
+          next += 1
+        }
+      }
+      return outcomes.compactMap { $0 }
+    }
+  }
+}
@@ -0,0 +1,224 @@
+import Foundation
+import IMsgCore
+
+enum HTMLAssetMode: String {
+  case embed
+  case dir
+}
+
+enum AttachmentMediaKind {
+  case image
+  case video
+  case audio
+  case file
+
+  static func of(_ meta: AttachmentMeta) -> AttachmentMediaKind {
+    let mime = meta.mimeType.lowercased()
+    if mime.hasPrefix("image/") { return .image }
+    if mime.hasPrefix("video/") { return .video }
+    if mime.hasPrefix("audio/") { return .audio }
+    let ext = (displayName(for: meta) as NSString).pathExtension.lowercased()
+    switch ext {
+    case "jpg", "jpeg", "png", "gif", "heic", "webp": return .image
+    case "mov", "mp4", "m4v": return .video
+    case "m4a", "caf", "mp3", "aac", "amr": return .audio
+    default: return .file
+    }
+  }
+}
+
+/// Renders a chat as a single Messages-style HTML page.
+struct HTMLBubbleRenderer {
+  let assets: HTMLAssetMode
+  let outputURL: URL
+  /// Receives a line for each attachment that couldn't be embedded or copied.
+  var warn: (String) -> Void = { FileHandle.standardError.write(Data($0.utf8)) }
+
+  /// Sibling directory used for `--assets dir` (e.g. `chat-1_files/` next to `chat-1.html`).
+  var assetsDirectoryURL: URL {
+    let base = outputURL.deletingPathExtension().lastPathComponent
+    return outputURL.deletingLastPathComponent().appendingPathComponent(
+      "\(base)_files", isDirectory: true)
+  }
+
+  /// Streams the page to `outputURL` a batch of messages at a time and returns how many
+  /// messages it holds. It is written beside the target first, so a failed export leaves any
+  /// earlier file in place. With `skipEmpty` an export that finds no messages does the same.
+  func write(_ export: ChatExport, skipEmpty: Bool = false) throws -> Int {
+    try PartialFile.stream(to: outputURL, keep: { $0 > 0 || !skipEmpty }) { handle in
+      var count = 0
+      func emit(_ line: String) {
+        handle.write(Data((line + "\n").utf8))
+      }
+      emit(header(for: export))
+      let calendar = Calendar.current
+      var lastDay: DateComponents?
+      try export.scan { items in
+        for item in items {
+          let day = calendar.dateComponents([.year, .month, .day], from: item.message.date)
+          if day != lastDay {
+            lastDay = day
+            let label = HTMLBubbleRenderer.dayFormatter.string(from: item.message.date)
+            emit("<div class=\"day\">\(htmlEscape(label))</div>")
+          }
+          emit(bubble(for: item, showSender: export.isGroup))
+        }
+        count += items.count
+      }
+      emit("</main>\n</body>\n</html>")
+      return count
+    }
+  }
+
+  private func header(for export: ChatExport) -> String {
+    let title = htmlEscape(export.title)
+    let subtitle = htmlEscape(export.participants.joined(separator: ", "))
+    return """
+      <!DOCTYPE html>
+      <html lang="en">
+      <head>
+      <meta charset="utf-8">
+      <meta name="viewport" content="width=device-width, initial-scale=1">
+      <title>\(title)</title>
+      <style>\(HTMLBubbleRenderer.stylesheet)</style>
+      </head>
+      <body>
+      <header><h1>\(title)</h1><p>\(subtitle)</p></header>
+      <main>
+      """
+  }
+
+  private func bubble(for item: ExportedMessage, showSender: Bool) -> String {
+    let message = item.message
+    if message.groupEvent != nil {
+      let summary = htmlEscape(displayText(for: message))
+      return "<div class=\"event\" id=\"m\(message.rowID)\">\(summary)</div>"
+    }
+    let side = message.isFromMe ? "me" : "them"
+    var parts: [String] = []
+    parts.append("<div class=\"row \(side)\" id=\"m\(message.rowID)\">")
+    if showSender && !message.isFromMe && !message.sender.isEmpty {
+      parts.append("<div class=\"sender\">\(htmlEscape(message.sender))</div>")
+    }
+    parts.append("<div class=\"bubble\">")
+    for (index, meta) in item.attachments.enumerated() {
+      parts.append(attachmentHTML(meta, messageID: message.rowID, index: index))
+    }
+    let body = displayText(for: message)
+    if !body.isEmpty {
+      let text = htmlEscape(body).replacingOccurrences(of: "\n", with: "<br>")
+      parts.append("<div class=\"text\">\(text)</div>")
+    }
+    if !item.reactions.isEmpty {
+      let emojis = item.reactions.map { htmlEscape($0.reactionType.emoji) }.joined()
+      let who = item.reactions.map { htmlEscape($0.isFromMe ? "me" : $0.sender) }
+        .joined(separator: ", ")
+      parts.append("<span class=\"reactions\" title=\"\(who)\">\(emojis)</span>")
+    }
+    parts.append("</div>")
+    let time = HTMLBubbleRenderer.timeFormatter.string(from: message.date)
+    parts.append("<div class=\"time\">\(htmlEscape(time))</div>")
+    parts.append("</div>")
+    return parts.joined()
+  }
+
+  private func attachmentHTML(_ meta: AttachmentMeta, messageID: Int64, index: Int) -> String {
+    let name = htmlEscape(displayName(for: meta))
+    if meta.missing {
+      return "<div class=\"missing\">[missing attachment: \(name)]</div>"
+    }
+    let source: String
+    do {
+      source = htmlEscape(try assetURL(for: meta, messageID: messageID, index: index))
+    } catch {
+      // One unreadable file (permissions, iCloud placeholder) shouldn't cost the whole page.
+      warn("imsg export: skipped attachment \(meta.originalPath): \(error.localizedDescription)\n")
+      return "<div class=\"missing\">[unreadable attachment: \(name)]</div>"
+    }
+    switch AttachmentMediaKind.of(meta) {
+    case .image:
+      return "<img class=\"media\" src=\"\(source)\" alt=\"\(name)\">"
+    case .video:
+      return "<video class=\"media\" controls preload=\"metadata\" src=\"\(source)\"></video>"
+    case .audio:
+      return "<audio controls src=\"\(source)\"></audio>"
+    case .file:
+      return "<a class=\"file\" href=\"\(source)\" download=\"\(name)\">\(name)</a>"
+    }
+  }
+
+  private func assetURL(for meta: AttachmentMeta, messageID: Int64, index: Int) throws -> String {
+    let source = URL(fileURLWithPath: meta.originalPath)
+    switch assets {
+    case .embed:
+      let data = try Data(contentsOf: source)
+      let mime = meta.mimeType.isEmpty ? "application/octet-stream" : meta.mimeType
+      return "data:\(mime);base64,\(data.base64EncodedString())"
+    case .dir:
+      let fileManager = FileManager.default
+      let directory = assetsDirectoryURL
+      try fileManager.createDirectory(at: directory, withIntermediateDirectories: true)
+      let fileName = "\(messageID)-\(index)-\(source.lastPathComponent)"
+      let destination = directory.appendingPathComponent(fileName)
+      if !fileManager.fileExists(atPath: destination.path) {
+        try fileManager.copyItem(at: source, to: destination)
+      }
+      let relative = "\(directory.lastPathComponent)/\(fileName)"
+      return relative.addingPercentEncoding(withAllowedCharacters: .urlPathAllowed) ?? relative
+    }
+  }
+
+  static let dayFormatter: DateFormatter = {
+    let formatter = DateFormatter()
+    formatter.dateStyle = .full
+    formatter.timeStyle = .none
+    return formatter
+  }()
+
+  static let timeFormatter: DateFormatter = {
+    let formatter = DateFormatter()
+    formatter.dateStyle = .none
+    formatter.timeStyle = .short
+    return formatter
+  }()
+
+  private static let stylesheet = """
+    body{margin:0;font:15px -apple-system,BlinkMacSystemFont,"Helvetica Neue",sans-serif;\
+    background:#fff;color:#000}
+    header{position:sticky;top:0;background:rgba(246,246,246,.95);border-bottom:1px solid #ddd;\
+    text-align:center;padding:8px}
+    header h1{font-size:16px;margin:0}header p{font-size:12px;color:#888;margin:2px 0 0}
+    main{max-width:760px;margin:0 auto;padding:12px 16px 40px}
+    .day{text-align:center;color:#888;font-size:12px;margin:18px 0 8px}
+    .event{text-align:center;color:#888;font-size:12px;margin:6px 0}
+    .row{display:flex;flex-direction:column;margin:2px 0}
+    .row.me{align-items:flex-end}.row.them{align-items:flex-start}
+    .sender{font-size:11px;color:#888;margin:6px 12px 1px}
+    .bubble{position:relative;max-width:70%;padding:7px 12px;border-radius:18px;\
+    overflow-wrap:anywhere}
+    .me .bubble{background:#0b84ff;color:#fff}.them .bubble{background:#e9e9eb}
+    .media{display:block;max-width:100%;border-radius:12px;margin:3px 0}
+    .me .file{color:#fff}
+    .missing{font-style:italic;opacity:.7}
+    .reactions{position:absolute;top:-12px;background:#fff;border:1px solid #ddd;\
+    border-radius:12px;padding:0 5px;font-size:13px}
+    .me .reactions{left:-14px}.them .reactions{right:-14px}
+    .time{font-size:10px;color:#aaa;margin:1px 10px 0}
+    """
+}
+
+func htmlEscape(_ value: String) -> String {
+  var escaped = ""
+  escaped.reserveCapacity(value.count)
+  for character in value {
+    switch character {
+    case "&": escaped += "&amp;"
+    case "<": escaped += "&lt;"
+    case ">": escaped += "&gt;"
+    case "\"": escaped += "&quot;"
+    case "'": escaped += "&#39;"
+    default: escaped.append(character)
+    }
+  }
+  return escaped
+}
@@ -0,0 +1,31 @@
+import Foundation
+import IMsgCore
+
+/// `--format jsonl`: one message per line, oldest first, in the same shape as
+/// `imsg history --json` (attachments and reactions included). With `--embed-attachments`
+/// small files ride along as base64, so the file can be shipped on its own.
+struct JSONLRenderer {
+  let outputURL: URL
+  var embedding: AttachmentEmbedding?
+
+  /// Writes every message of `export` and returns how many. Built beside `outputURL` and swapped
+  /// into place at the end; with `skipEmpty` nothing is written when there are no messages.
+  func write(_ export: ChatExport, skipEmpty: Bool = false) throws -> Int {
+    try PartialFile.stream(to: outputURL, keep: { $0 > 0 || !skipEmpty }) { handle in
+      var count = 0
+      try export.scan { items in
+        for item in items {
+          handle.write(Data((try line(for: item) + "\n").utf8))
+        }
+        count += items.count
+      }
+      return count
+    }
+  }
+
+  func line(for item: ExportedMessage) throws -> String {
+    let payload = MessagePayload(
+      message: item.message, attachments: item.attachments, reactions: item.reactions)
+    return try JSONLines.encode(embedding?.embed(payload) ?? payload)
+  }
+}
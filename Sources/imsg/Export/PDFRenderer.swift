@@ -0,0 +1,476 @@
+import CoreGraphics
+import CoreText
+import Foundation
+import IMsgCore
+import ImageIO
+
+/// Renders a chat as a paginated PDF, the "copy of the conversation" lawyers, HR and family
+/// ask for: Messages-style bubbles, sender names in groups, day separators, the time and
+/// tapbacks under each bubble, and images scaled inline. Other attachments are named in their
+/// bubble. Every page is footed with the chat title, the export date and the page number.
+/// Drawn with CoreGraphics and CoreText, so it needs no window server and streams page by page.
+struct PDFRenderer {
+  let outputURL: URL
+  /// US Letter, or A4 where the locale uses the metric system.
+  var pageSize: CGSize =
+    Locale.current.usesMetricSystem
+    ? CGSize(width: 595, height: 842) : CGSize(width: 612, height: 792)
+  var exportedAt = Date()
+
+  /// Writes the PDF beside `outputURL` first and swaps it in once complete (see `PartialFile`);
+  /// returns how many messages it holds.
+  func write(_ export: ChatExport, skipEmpty: Bool = false) throws -> Int {
+    try PartialFile.write(to: outputURL, keep: { $0 > 0 || !skipEmpty }) { partialURL in
+      var count = 0
+      let exported = PDFRenderer.exportFormatter.string(from: exportedAt)
+      let layout = try PDFLayout(
+        url: partialURL, pageSize: pageSize, title: export.title,
+        footer: "\(export.title) · exported \(exported)")
+      // Closed on the way out either way: a failed scan must release the file before
+      // PartialFile deletes it.
+      defer { layout.close() }
+      layout.header(
+        title: export.title, participants: export.participants.joined(separator: ", "),
+        note: "Exported from Messages on \(exported)")
+      let calendar = Calendar.current
+      var lastDay: DateComponents?
+      try export.scan { items in
+        for item in items {
+          let day = calendar.dateComponents([.year, .month, .day], from: item.message.date)
+          if day != lastDay {
+            lastDay = day
+            layout.day(HTMLBubbleRenderer.dayFormatter.string(from: item.message.date))
+          }
+          layout.message(item, showSender: export.isGroup)
+        }
+        count += items.count
+      }
+      return count
+    }
+  }
+
+  private static let exportFormatter: DateFormatter = {
+    let formatter = DateFormatter()
+    formatter.dateStyle = .long
+    formatter.timeStyle = .short
+    return formatter
+  }()
+}
+
+/// Lays content out top to bottom, starting a new page when the next block doesn't fit.
+/// Positions are measured from the top of the page and flipped when drawing.
+private final class PDFLayout {
+  private enum Piece {
+    case image(CGImage, CGSize)
+    /// `framesetter`'s text from `start`; long text continues on the next page.
+    case text(CTFramesetter, start: Int, length: Int)
+  }
+
+  private static let margin: CGFloat = 48
+  private static let bubblePadding = CGSize(width: 10, height: 6)
+  private static let pieceGap: CGFloat = 4
+  private static let maxImageHeight: CGFloat = 240
+  private static let gray = CGColor(red: 0.53, green: 0.53, blue: 0.53, alpha: 1)
+  private static let myBubble = CGColor(red: 0.04, green: 0.52, blue: 1, alpha: 1)
+  private static let theirBubble = CGColor(red: 0.91, green: 0.91, blue: 0.92, alpha: 1)
+  private static let white = CGColor(red: 1, green: 1, blue: 1, alpha: 1)
+  private static let black = CGColor(red: 0, green: 0, blue: 0, alpha: 1)
+
+  private let context: CGContext
+  private let pageSize: CGSize
+  private let footer: String
+  private var pageNumber = 0
+  /// Distance from the top of the page to the next free line.
+  private var top: CGFloat = 0
+  private var pageIsEmpty = true
+
+  init(url: URL, pageSize: CGSize, title: String, footer: String) throws {
+    var mediaBox = CGRect(origin: .zero, size: pageSize)
+    let info =
+      [
+        kCGPDFContextTitle as String: title,
+        kCGPDFContextCreator as String: "imsg \(IMsgVersion.current)",
+      ] as CFDictionary
+    guard let context = CGContext(url as CFURL, mediaBox: &mediaBox, info) else {
+      throw CocoaError(.fileWriteUnknown, userInfo: [NSFilePathErrorKey: url.path])
+    }
+    self.context = context
+    self.pageSize = pageSize
+    self.footer = footer
+    beginPage()
+  }
+
+  private var contentWidth: CGFloat { pageSize.width - 2 * PDFLayout.margin }
+  /// Lowest point content may reach, above the footer.
+  private var bottom: CGFloat { pageSize.height - PDFLayout.margin }
+  private var remaining: CGFloat { bottom - top }
+  private var pageContentHeight: CGFloat { bottom - PDFLayout.margin }
+
+  func close() {
+    context.endPDFPage()
+    context.closePDF()
+  }
+
+  func header(title: String, participants: String, note: String) {
+    wrapped(text(title, size: 16, color: PDFLayout.black, bold: true), gapAfter: 2)
+    if !participants.isEmpty {
+      wrapped(text(participants, size: 9, color: PDFLayout.gray), gapAfter: 2)
+    }
+    wrapped(text(note, size: 9, color: PDFLayout.gray), gapAfter: 8)
+    context.setStrokeColor(PDFLayout.theirBubble)
+    context.setLineWidth(0.5)
+    context.move(to: CGPoint(x: PDFLayout.margin, y: pageSize.height - top))
+    context.addLine(to: CGPoint(x: pageSize.width - PDFLayout.margin, y: pageSize.height - top))
+    context.strokePath()
+    top += 6
+  }
+
+  func day(_ label: String) {
+    let line = text(label, size: 9, color: PDFLayout.gray)
+    // Keep the separator with at least the first line of that day.
+    ensure(lineHeight(line) + 40)
+    top += 10
+    centered(line)
+    top += 6
+  }
+
+  func message(_ item: ExportedMessage, showSender: Bool) {
+    let message = item.message
+    if message.groupEvent != nil {
+      let line = text(displayText(for: message), size: 9, color: PDFLayout.gray)
+      ensure(lineHeight(line) + 6)
+      top += 3
+      centered(line)
+      top += 3
+      return
+    }
+    let padding = PDFLayout.bubblePadding
+    let maxWidth = (contentWidth * 0.7).rounded(.down)
+    let foreground = message.isFromMe ? PDFLayout.white : PDFLayout.black
+    var pieces: [Piece] = []
+    for meta in item.attachments {
+      pieces.append(piece(for: meta, color: foreground, maxWidth: maxWidth - 2 * padding.width))
+    }
+    let body = displayText(for: message)
+    if !body.isEmpty {
+      let framesetter = CTFramesetterCreateWithAttributedString(
+        text(body, size: 11, color: foreground))
+      pieces.append(.text(framesetter, start: 0, length: body.utf16.count))
+    }
+
+    var natural: CGFloat = 0
+    var height: CGFloat = 0
+    for piece in pieces {
+      let size = measure(piece, width: maxWidth - 2 * padding.width)
+      natural = max(natural, size.width)
+      height += size.height
+    }
+    height += CGFloat(max(0, pieces.count - 1)) * PDFLayout.pieceGap + 2 * padding.height
+    let bubbleWidth = min(maxWidth, natural.rounded(.up) + 1 + 2 * padding.width)
+    let x =
+      message.isFromMe ? pageSize.width - PDFLayout.margin - bubbleWidth : PDFLayout.margin
+
+    var label: CFAttributedString?
+    if showSender && !message.isFromMe && !message.sender.isEmpty {
+      label = text(message.sender, size: 8, color: PDFLayout.gray)
+    }
+    let labelHeight = label.map { lineHeight($0) + 2 } ?? 0
+    let meta = text(metaLine(for: item), size: 8, color: PDFLayout.gray)
+    let whole = labelHeight + height + lineHeight(meta) + 8
+    // A bubble that fits on a page is never split; a longer one starts where it is.
+    ensure(whole <= pageContentHeight ? whole : labelHeight + 60)
+    if let label {
+      top += 4
+      line(label, x: x + padding.width)
+      top += lineHeight(label) + 2
+    }
+    if !pieces.isEmpty {
+      drawBubble(pieces, x: x, width: bubbleWidth, isFromMe: message.isFromMe)
+    }
+    ensure(lineHeight(meta) + 6)
+    top += 2
+    let metaWidth = width(of: meta)
+    line(
+      meta,
+      x: message.isFromMe
+        ? pageSize.width - PDFLayout.margin - metaWidth - padding.width
+        : x + padding.width)
+    top += lineHeight(meta) + 6
+    pageIsEmpty = false
+  }
+
+  // MARK: - Bubbles
+
+  private func drawBubble(_ pieces: [Piece], x: CGFloat, width: CGFloat, isFromMe: Bool) {
+    let padding = PDFLayout.bubblePadding
+    let innerWidth = width - 2 * padding.width
+    var queue = pieces
+    while !queue.isEmpty {
+      let available = remaining - 2 * padding.height
+      var fitted: [(piece: Piece, height: CGFloat)] = []
+      var used: CGFloat = 0
+      fill: while let piece = queue.first {
+        let gap = fitted.isEmpty ? 0 : PDFLayout.pieceGap
+        switch piece {
+        case .image(let image, let size):
+          if fitted.isEmpty, pageIsEmpty, size.height > available {
+            // Taller than an empty page: scale it down to the page instead of running off it.
+            let scale = max(0, available) / size.height
+            let scaled = CGSize(
+              width: (size.width * scale).rounded(.down),
+              height: (size.height * scale).rounded(.down))
+            fitted.append((.image(image, scaled), scaled.height))
+            used += scaled.height
+            queue.removeFirst()
+            break fill
+          }
+          guard used + gap + size.height <= available else { break fill }
+          fitted.append((piece, size.height))
+          used += gap + size.height
+          queue.removeFirst()
+        case .text(let framesetter, let start, let length):
+          var range = CFRange()
+          let size = CTFramesetterSuggestFrameSizeWithConstraints(
+            framesetter, CFRange(location: start, length: 0), nil,
+            CGSize(width: innerWidth, height: max(0, available - used - gap)), &range)
+          guard range.length > 0 else {
+            // Not even one line fits on an empty page: take the next line anyway and clip it
+            // to the page, so the rest of the message still follows.
+            guard fitted.isEmpty, pageIsEmpty else { break fill }
+            let lineLength = CTTypesetterSuggestLineBreak(
+              CTFramesetterGetTypesetter(framesetter), start, Double(innerWidth))
+            let end = min(length, start + max(1, lineLength))
+            used = max(0, available)
+            fitted.append((.text(framesetter, start: start, length: end - start), used))
+            if end >= length {
+              queue.removeFirst()
+            } else {
+              queue[0] = .text(framesetter, start: end, length: length)
+            }
+            break fill
+          }
+          let height = size.height.rounded(.up)
+          fitted.append((.text(framesetter, start: start, length: range.length), height))
+          used += gap + height
+          if start + range.length >= length {
+            queue.removeFirst()
+          } else {
+            queue[0] = .text(framesetter, start: start + range.length, length: length)
+            break fill
+          }
+        }
+      }
+      if fitted.isEmpty {
+        // An empty page always takes at least part of the next piece, so this moves on.
+        newPage()
+        continue
+      }
+
+      let bubble = flipped(x: x, top: top, width: width, height: used + 2 * padding.height)
+      let radius = min(12, bubble.height / 2, bubble.width / 2)
+      context.setFillColor(isFromMe ? PDFLayout.myBubble : PDFLayout.theirBubble)
+      context.addPath(
+        CGPath(roundedRect: bubble, cornerWidth: radius, cornerHeight: radius, transform: nil))
+      context.fillPath()
+      var y = top + padding.height
+      for (index, entry) in fitted.enumerated() {
+        if index > 0 { y += PDFLayout.pieceGap }
+        switch entry.piece {
+        case .image(let image, let size):
+          let rect = flipped(x: x + padding.width, top: y, width: size.width, height: size.height)
+          context.saveGState()
+          context.addPath(
+            CGPath(roundedRect: rect, cornerWidth: 8, cornerHeight: 8, transform: nil))
+          context.clip()
+          context.draw(image, in: rect)
+          context.restoreGState()
+        case .text(let framesetter, let start, let length):
+          // Laid out at its natural height and clipped to its slot, so a line cut short by
+          // the page is drawn in part rather than dropped by CoreText. A point of slack so
+          // CoreText doesn't drop the last line to rounding.
+          let slot = flipped(
+            x: x + padding.width, top: y, width: innerWidth + 1, height: entry.height + 1)
+          let natural = measure(entry.piece, width: innerWidth).height
+          let rect = flipped(
+            x: x + padding.width, top: y, width: innerWidth + 1,
+            height: max(natural, entry.height) + 1)
+          let frame = CTFramesetterCreateFrame(
+            framesetter, CFRange(location: start, length: length),
+            CGPath(rect: rect, transform: nil), nil)
+          context.saveGState()
+          context.clip(to: slot)
+          CTFrameDraw(frame, context)
+          context.restoreGState()
+        }
+        y += entry.height
+      }
+      top += used + 2 * padding.height
+      pageIsEmpty = false
+      if !queue.isEmpty {
+        newPage()
+      }
+    }
+  }
+
+  private func piece(for meta: AttachmentMeta, color: CGColor, maxWidth: CGFloat) -> Piece {
+    let name = displayName(for: meta)
+    let kind = AttachmentMediaKind.of(meta)
+    if !meta.missing, kind == .image, let image = PDFLayout.thumbnail(at: meta.originalPath) {
+      let scale = min(
+        1, maxWidth / CGFloat(image.width), PDFLayout.maxImageHeight / CGFloat(image.height))
+      let size = CGSize(
+        width: (CGFloat(image.width) * scale).rounded(.down),
+        height: (CGFloat(image.height) * scale).rounded(.down))
+      return .image(image, size)
+    }
+    let label: String
+    if meta.missing {
+      label = "[missing attachment: \(name)]"
+    } else {
+      switch kind {
+      case .image: label = "[image: \(name)]"
+      case .video: label = "[video: \(name)]"
+      case .audio: label = "[audio: \(name)]"
+      case .file: label = "[file: \(name)]"
+      }
+    }
+    let framesetter = CTFramesetterCreateWithAttributedString(text(label, size: 10, color: color))
+    return .text(framesetter, start: 0, length: label.utf16.count)
+  }
+
+  /// Decoded at most 1000px on the long side (enough for print at the size it is drawn),
+  /// rotated upright. Nil when ImageIO can't read the file.
+  private static func thumbnail(at path: String) -> CGImage? {
+    guard let source = CGImageSourceCreateWithURL(URL(fileURLWithPath: path) as CFURL, nil)
+    else {
+      return nil
+    }
+    let options =
+      [
+        kCGImageSourceCreateThumbnailFromImageAlways: true,
+        kCGImageSourceCreateThumbnailWithTransform: true,
+        kCGImageSourceThumbnailMaxPixelSize: 1000,
+      ] as CFDictionary
+    return CGImageSourceCreateThumbnailAtIndex(source, 0, options)
+  }
+
+  private func measure(_ piece: Piece, width: CGFloat) -> CGSize {
+    switch piece {
+    case .image(_, let size):
+      return size
+    case .text(let framesetter, let start, let length):
+      let size = CTFramesetterSuggestFrameSizeWithConstraints(
+        framesetter, CFRange(location: start, length: length), nil,
+        CGSize(width: width, height: .greatestFiniteMagnitude), nil)
+      return CGSize(width: size.width, height: size.height.rounded(.up))
+    }
+  }
+
+  /// `3:04 PM`, followed by tapbacks and who left them.
+  private func metaLine(for item: ExportedMessage) -> String {
+    var parts = [HTMLBubbleRenderer.timeFormatter.string(from: item.message.date)]
+    if !item.reactions.isEmpty {
+      parts.append(
+        item.reactions.map { "\($0.reactionType.emoji) \($0.isFromMe ? "me" : $0.sender)" }
+          .joined(separator: ", "))
+    }
+    return parts.joined(separator: "  ")
+  }
+
+  // MARK: - Pages and text
+
+  private func beginPage() {
+    context.beginPDFPage(nil)
+    context.textMatrix = .identity
+    pageNumber += 1
+    top = PDFLayout.margin
+    pageIsEmpty = true
+    let baseline = PDFLayout.margin / 2
+    let number = CTLineCreateWithAttributedString(
+      text("Page \(pageNumber)", size: 8, color: PDFLayout.gray))
+    let numberWidth = CGFloat(CTLineGetTypographicBounds(number, nil, nil, nil))
+    context.textPosition = CGPoint(
+      x: pageSize.width - PDFLayout.margin - numberWidth, y: baseline)
+    CTLineDraw(number, context)
+    let title = CTLineCreateWithAttributedString(text(footer, size: 8, color: PDFLayout.gray))
+    let ellipsis = CTLineCreateWithAttributedString(text("…", size: 8, color: PDFLayout.gray))
+    if let truncated = CTLineCreateTruncatedLine(
+      title, Double(contentWidth - numberWidth - 16), .end, ellipsis)
+    {
+      context.textPosition = CGPoint(x: PDFLayout.margin, y: baseline)
+      CTLineDraw(truncated, context)
+    }
+  }
+
+  private func newPage() {
+    context.endPDFPage()
+    beginPage()
+  }
+
+  /// Starts a new page unless `height` still fits on this one or it is empty.
+  private func ensure(_ height: CGFloat) {
+    if height > remaining && !pageIsEmpty {
+      newPage()
+    }
+  }
+
+  private func text(_ string: String, size: CGFloat, color: CGColor, bold: Bool = false)
+    -> CFAttributedString
+  {
+    let font =
+      CTFontCreateUIFontForLanguage(bold ? .emphasizedSystem : .system, size, nil)
+      ?? CTFontCreateWithName("Helvetica" as CFString, size, nil)
+    return NSAttributedString(
+      string: string,
+      attributes: [
+        NSAttributedString.Key(kCTFontAttributeName as String): font,
+        NSAttributedString.Key(kCTForegroundColorAttributeName as String): color,
+      ]) as CFAttributedString
+  }
+
+  private func lineHeight(_ string: CFAttributedString) -> CGFloat {
+    var ascent: CGFloat = 0
+    var descent: CGFloat = 0
+    var leading: CGFloat = 0
+    _ = CTLineGetTypographicBounds(
+      CTLineCreateWithAttributedString(string), &ascent, &descent, &leading)
+    return (ascent + descent + leading).rounded(.up)
+  }
+
+  private func width(of string: CFAttributedString) -> CGFloat {
+    CGFloat(CTLineGetTypographicBounds(CTLineCreateWithAttributedString(string), nil, nil, nil))
+  }
+
+  /// Draws one line with its top at `top`.
+  private func line(_ string: CFAttributedString, x: CGFloat) {
+    let line = CTLineCreateWithAttributedString(string)
+    var ascent: CGFloat = 0
+    _ = CTLineGetTypographicBounds(line, &ascent, nil, nil)
+    context.textPosition = CGPoint(x: x, y: pageSize.height - top - ascent)
+    CTLineDraw(line, context)
+  }
+
+  private func centered(_ string: CFAttributedString) {
+    line(string, x: max(PDFLayout.margin, (pageSize.width - width(of: string)) / 2))
+    top += lineHeight(string)
+    pageIsEmpty = false
+  }
+
+  /// Full-width text wrapped onto as many lines as it needs.
+  private func wrapped(_ string: CFAttributedString, gapAfter: CGFloat) {
+    let framesetter = CTFramesetterCreateWithAttributedString(string)
+    let size = CTFramesetterSuggestFrameSizeWithConstraints(
+      framesetter, CFRange(), nil, CGSize(width: contentWidth, height: remaining), nil)
+    let rect = flipped(
+      x: PDFLayout.margin, top: top, width: contentWidth, height: size.height.rounded(.up) + 1)
+    CTFrameDraw(
+      CTFramesetterCreateFrame(framesetter, CFRange(), CGPath(rect: rect, transform: nil), nil),
+      context)
+    top += size.height.rounded(.up) + gapAfter
+    pageIsEmpty = false
+  }
+
+  private func flipped(x: CGFloat, top: CGFloat, width: CGFloat, height: CGFloat) -> CGRect {
+    CGRect(x: x, y: pageSize.height - top - height, width: width, height: height)
+  }
+}
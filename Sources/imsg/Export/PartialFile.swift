@@ -0,0 +1,64 @@
+import Foundation
+
+/// Builds an export beside its destination, as `.<name>.partial`, and swaps it in only once it
+/// is complete: a failed or empty run leaves the previous file alone, and nothing reading the
+/// destination ever sees half a file.
+enum PartialFile {
+  static func url(for destination: URL) -> URL {
+    destination.deletingLastPathComponent()
+      .appendingPathComponent(".\(destination.lastPathComponent).partial")
+  }
+
+  /// Runs `body` on the partial path and, unless it throws or `keep` turns its result down,
+  /// replaces `destination` with what it wrote. The partial never outlives the call.
+  static func write<Result>(
+    to destination: URL,
+    keep: (Result) -> Bool = { _ in true },
+    _ body: (URL) throws -> Result
+  ) throws -> Result {
+    let fileManager = FileManager.default
+    let partial = url(for: destination)
+    // Left over from a run that was killed before it could clean up.
+    try? fileManager.removeItem(at: partial)
+    do {
+      let result = try body(partial)
+      if keep(result) {
+        try commit(partial, to: destination)
+      } else {
+        try? fileManager.removeItem(at: partial)
+      }
+      return result
+    } catch {
+      try? fileManager.removeItem(at: partial)
+      throw error
+    }
+  }
+
+  /// `write(to:keep:_:)` for text formats: the partial is created empty and handed to `body`
+  /// open for writing.
+  static func stream<Result>(
+    to destination: URL,
+    keep: (Result) -> Bool = { _ in true },
+    _ body: (FileHandle) throws -> Result
+  ) throws -> Result {
+    try write(to: destination, keep: keep) { partial in
+      guard FileManager.default.createFile(atPath: partial.path, contents: nil) else {
+        throw CocoaError(.fileWriteNoPermission, userInfo: [NSFilePathErrorKey: partial.path])
+      }
+      let handle = try FileHandle(forWritingTo: partial)
+      defer { try? handle.close() }
+      return try body(handle)
+    }
+  }
+
+  /// Puts the finished `partial` in place of `destination` with `replaceItemAt`, which swaps
+  /// the two in one step instead of deleting the old file first; a first export just moves.
+  static func commit(_ partial: URL, to destination: URL) throws {
+    let fileManager = FileManager.default
+    if fileManager.fileExists(atPath: destination.path) {
+      _ = try fileManager.replaceItemAt(destination, withItemAt: partial)
+    } else {
+      try fileManager.moveItem(at: partial, to: destination)
+    }
+  }
+}
@@ -0,0 +1,83 @@
+import Foundation
+import IMsgCore
+
+/// `--format txt-compat`: plain text laid out like imessage-exporter's TXT export, so files
+/// from either tool can be diffed and fed to the same parsers. Each message is its timestamp
+/// (`May 17, 2022  5:29:42 PM`), the sender (`Me` or the handle), the text, one line per
+/// attachment path, and any tapbacks under `Tapbacks:`, followed by a blank line. Group
+/// events are the timestamp and the event.
+struct TXTCompatRenderer {
+  let outputURL: URL
+  var timeZone: TimeZone = .current
+
+  /// Writes every message of `export` and returns how many. Built beside `outputURL` and swapped
+  /// into place at the end; with `skipEmpty` nothing is written when there are no messages.
+  func write(_ export: ChatExport, skipEmpty: Bool = false) throws -> Int {
+    try PartialFile.stream(to: outputURL, keep: { $0 > 0 || !skipEmpty }) { handle in
+      var count = 0
+      try export.scan { items in
+        for item in items {
+          handle.write(Data(lines(for: item).map { $0 + "\n" }.joined().utf8))
+        }
+        count += items.count
+      }
+      return count
+    }
+  }
+
+  /// One message, ending with its blank separator line.
+  func lines(for item: ExportedMessage) -> [String] {
+    let message = item.message
+    var lines = [timestamp(message.date)]
+    if let event = message.groupEvent {
+      lines.append(event.summary(actor: message.isFromMe ? "Me" : message.sender))
+      return lines + [""]
+    }
+    lines.append(message.isFromMe ? "Me" : message.sender)
+    let text = message.text.replacingOccurrences(of: "\u{FFFC}", with: "")
+      .trimmingCharacters(in: .whitespacesAndNewlines)
+    if !text.isEmpty {
+      lines.append(text)
+    } else if item.attachments.isEmpty, let app = message.app {
+      lines.append(app.displayText)
+    }
+    lines += item.attachments.map(\.originalPath)
+    if !item.reactions.isEmpty {
+      lines.append("Tapbacks:")
+      lines += item.reactions.map { reaction in
+        let who = reaction.isFromMe ? "Me" : reaction.sender
+        return "    \(TXTCompatRenderer.verb(for: reaction.reactionType)) by \(who)"
+      }
+    }
+    return lines + [""]
+  }
+
+  /// `May 17, 2022  5:29:42 PM`: imessage-exporter pads the hour with a space, not a zero.
+  func timestamp(_ date: Date) -> String {
+    var calendar = Calendar(identifier: .gregorian)
+    calendar.timeZone = timeZone
+    let parts = calendar.dateComponents([.year, .month, .day, .hour, .minute, .second], from: date)
+    let month = TXTCompatRenderer.months[(parts.month ?? 1) - 1]
+    let hour = parts.hour ?? 0
+    let twelveHour = hour % 12 == 0 ? 12 : hour % 12
+    return String(
+      format: "%@ %02d, %04d %2d:%02d:%02d %@", month, parts.day ?? 0, parts.year ?? 0,
+      twelveHour, parts.minute ?? 0, parts.second ?? 0, hour < 12 ? "AM" : "PM")
+  }
+
+  static func verb(for type: ReactionType) -> String {
+    switch type {
+    case .love: return "Loved"
+    case .like: return "Liked"
+    case .dislike: return "Disliked"
+    case .laugh: return "Laughed at"
+    case .emphasis: return "Emphasized"
+    case .question: return "Questioned"
+    case .custom(let emoji): return "Reacted \(emoji)"
+    }
+  }
+
+  private static let months = [
+    "Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec",
+  ]
+}
@@ -23,7 +23,7 @@ struct HelpPrinter {
     lines.append("  \(rootName) <command> [options]")
     lines.append("")
     lines.append("Commands:")
-    for command in commands {
+    for command in commands where !command.isHidden {
       lines.append("  \(command.name)\t\(command.abstract)")
     }
     lines.append("")
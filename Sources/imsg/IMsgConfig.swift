@@ -0,0 +1,50 @@
+import Foundation
+import IMsgCore
+import Yams
+
+/// Defaults read from `config.yaml` in the state directory, for settings that belong to the
+/// machine rather than to one command line. Flags given on the command line win.
+///
+///     quiet_hours: "22:00-08:00"
+struct IMsgConfig: Decodable, Equatable {
+  /// Local window `send` and `forward` refuse to send in, as `--quiet-hours`.
+  var quietHours: String?
+
+  enum CodingKeys: String, CodingKey {
+    case quietHours = "quiet_hours"
+  }
+
+  init(quietHours: String? = nil) {
+    self.quietHours = quietHours
+  }
+
+  static var defaultURL: URL {
+    StateDirectory.fileURL("config.yaml")
+  }
+
+  /// The settings in `url`; all defaults when it doesn't exist. A file that is there but
+  /// can't be read or parsed is an error rather than silently ignored.
+  static func load(from url: URL = defaultURL) throws -> IMsgConfig {
+    guard FileManager.default.fileExists(atPath: url.path) else { return IMsgConfig() }
+    let source = try String(contentsOf: url, encoding: .utf8)
+    if source.trimmingCharacters(in: .whitespacesAndNewlines).isEmpty {
+      return IMsgConfig()
+    }
+    do {
+      return try YAMLDecoder().decode(IMsgConfig.self, from: source)
+    } catch {
+      throw IMsgConfigError.invalid("\(url.path): \(error)")
+    }
+  }
+}
+
+enum IMsgConfigError: Error, CustomStringConvertible {
+  case invalid(String)
+
+  var description: String {
+    switch self {
+    case .invalid(let detail):
+      return "Invalid config file: \(detail)"
+    }
+  }
+}
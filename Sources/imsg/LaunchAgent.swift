@@ -0,0 +1,141 @@
+import Foundation
+
+/// A per-user launchd job that keeps one imsg command running from login, e.g.
+/// `imsg watch --json` or `imsg bridge matrix ...`, with stdout and stderr in
+/// `~/Library/Logs/imsg`.
+struct LaunchAgent: Equatable {
+  static let defaultLabel = "com.imsg.agent"
+
+  let label: String
+  /// Absolute path of the imsg binary followed by the command's arguments.
+  let programArguments: [String]
+  let logDirectory: URL
+  let environment: [String: String]
+
+  init(
+    label: String,
+    programArguments: [String],
+    logDirectory: URL = LaunchAgent.defaultLogDirectory,
+    environment: [String: String] = [:]
+  ) {
+    self.label = label
+    self.programArguments = programArguments
+    self.logDirectory = logDirectory
+    self.environment = environment
+  }
+
+  static var defaultLogDirectory: URL {
+    FileManager.default.homeDirectoryForCurrentUser
+      .appendingPathComponent("Library/Logs/imsg", isDirectory: true)
+  }
+
+  static var agentsDirectory: URL {
+    FileManager.default.homeDirectoryForCurrentUser
+      .appendingPathComponent("Library/LaunchAgents", isDirectory: true)
+  }
+
+  static func plistURL(label: String, in directory: URL = agentsDirectory) -> URL {
+    directory.appendingPathComponent("\(label).plist", isDirectory: false)
+  }
+
+  var standardOutPath: String {
+    logDirectory.appendingPathComponent("\(label).out.log").path
+  }
+
+  var standardErrorPath: String {
+    logDirectory.appendingPathComponent("\(label).err.log").path
+  }
+
+  /// Restarted whenever it exits, throttled so a crash loop (e.g. no Full Disk Access) doesn't
+  /// spin; launchd ignores relaunches within 10s of the last start.
+  func propertyList() throws -> Data {
+    var plist: [String: Any] = [
+      "Label": label,
+      "ProgramArguments": programArguments,
+      "RunAtLoad": true,
+      "KeepAlive": true,
+      "ThrottleInterval": 10,
+      "ProcessType": "Background",
+      "StandardOutPath": standardOutPath,
+      "StandardErrorPath": standardErrorPath,
+    ]
+    if !environment.isEmpty {
+      plist["EnvironmentVariables"] = environment
+    }
+    return try PropertyListSerialization.data(fromPropertyList: plist, format: .xml, options: 0)
+  }
+
+  /// Splits `--run` into arguments: whitespace separates, single and double quotes group, and a
+  /// backslash escapes the next character outside single quotes. nil on an unclosed quote.
+  static func splitArguments(_ command: String) -> [String]? {
+    var arguments: [String] = []
+    var current = ""
+    var hasCurrent = false
+    var quote: Character?
+    var escaping = false
+    for char in command {
+      if escaping {
+        current.append(char)
+        escaping = false
+        continue
+      }
+      switch char {
+      case "\\" where quote != "'":
+        escaping = true
+        hasCurrent = true
+      case "'", "\"":
+        if quote == nil {
+          quote = char
+          hasCurrent = true
+        } else if quote == char {
+          quote = nil
+        } else {
+          current.append(char)
+        }
+      case " ", "\t", "\n":
+        if quote != nil {
+          current.append(char)
+        } else if hasCurrent {
+          arguments.append(current)
+          current = ""
+          hasCurrent = false
+        }
+      default:
+        current.append(char)
+        hasCurrent = true
+      }
+    }
+    guard quote == nil, !escaping else { return nil }
+    if hasCurrent {
+      arguments.append(current)
+    }
+    return arguments
+  }
+}
+
+/// What `launchctl print` reports for a loaded job.
+struct LaunchAgentStatus: Equatable {
+  var state: String?
+  var pid: Int?
+  var lastExitCode: Int?
+
+  /// Picks `state = running`, `pid = 123` and `last exit code = 0` out of `launchctl print`.
+  init(launchctlPrint output: String) {
+    for line in output.split(separator: "\n") {
+      let parts = line.split(separator: "=", maxSplits: 1).map {
+        $0.trimmingCharacters(in: .whitespaces)
+      }
+      guard parts.count == 2 else { continue }
+      switch parts[0] {
+      case "state" where state == nil:
+        state = parts[1]
+      case "pid" where pid == nil:
+        pid = Int(parts[1])
+      case "last exit code" where lastExitCode == nil:
+        lastExitCode = Int(parts[1].split(separator: " ").first ?? "")
+      default:
+        continue
+      }
+    }
+  }
+}
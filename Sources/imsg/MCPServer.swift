@@ -0,0 +1,241 @@
+import Foundation
+import IMsgCore
+
+/// Model Context Protocol over stdio: newline-delimited JSON-RPC with `initialize`,
+/// `tools/list` and `tools/call`. Each tool is a thin wrapper over the matching `imsg rpc`
+/// method, so both servers read and send the same way. New messages for a subscription
+/// arrive as `notifications/messages/new`.
+final class MCPServer {
+  static let supportedProtocolVersions = ["2025-06-18", "2025-03-26", "2024-11-05"]
+
+  struct Tool {
+    let name: String
+    let description: String
+    let inputSchema: [String: Any]
+    /// The `imsg rpc` method that does the work.
+    let method: String
+  }
+
+  static let tools: [Tool] = [
+    Tool(
+      name: "list_chats",
+      description: "List recent iMessage/SMS conversations, newest first.",
+      inputSchema: schema([
+        "limit": ["type": "integer", "description": "How many chats (default 20)."]
+      ]),
+      method: "chats.list"),
+    Tool(
+      name: "get_history",
+      description: "Recent messages in one chat, newest first.",
+      inputSchema: schema(
+        [
+          "chat_id": ["type": "integer", "description": "Chat id from list_chats."],
+          "limit": ["type": "integer", "description": "How many messages (default 50)."],
+          "start": ["type": "string", "description": "Only messages at or after (ISO 8601)."],
+          "end": ["type": "string", "description": "Only messages before (ISO 8601)."],
+          "match_icase": ["type": "string", "description": "Case-insensitive text regex."],
+          "attachments": ["type": "boolean", "description": "Include attachment metadata."],
+        ], required: ["chat_id"]),
+      method: "messages.history"),
+    Tool(
+      name: "send_message",
+      description:
+        "Send a message through Messages.app to a phone number or email (to) or an existing "
+        + "chat (chat_id). Sends are journaled; repeat an idempotency_key to avoid doubles.",
+      inputSchema: schema([
+        "to": ["type": "string", "description": "Phone number or email."],
+        "chat_id": ["type": "integer", "description": "Chat id from list_chats."],
+        "text": ["type": "string", "description": "Message body."],
+        "file": ["type": "string", "description": "Path of a file to attach."],
+        "service": ["type": "string", "enum": ["auto", "imessage", "sms"]],
+        "idempotency_key": ["type": "string", "description": "Skip if already sent."],
+      ]),
+      method: "send"),
+    Tool(
+      name: "subscribe_messages",
+      description:
+        "Start streaming new messages as notifications/messages/new notifications. "
+        + "Returns a subscription id.",
+      inputSchema: schema([
+        "chat_id": ["type": "integer", "description": "Only this chat."],
+        "since_rowid": ["type": "integer", "description": "Replay messages after this rowid."],
+        "match_icase": ["type": "string", "description": "Case-insensitive text regex."],
+      ]),
+      method: "watch.subscribe"),
+    Tool(
+      name: "unsubscribe_messages",
+      description: "Stop a subscription started with subscribe_messages.",
+      inputSchema: schema(
+        ["subscription": ["type": "integer"]], required: ["subscription"]),
+      method: "watch.unsubscribe"),
+  ]
+
+  private let output: RPCOutput
+  private let forwarding: MCPForwardingOutput
+  private let rpc: RPCServer
+
+  init(
+    store: MessageStore,
+    logger: AutomationLogger = .disabled,
+    output: RPCOutput = RPCWriter(),
+    sendMessage: @escaping (MessageSendOptions) throws -> Void = { try MessageSender().send($0) },
+    journal: SendJournal? = nil
+  ) {
+    self.output = output
+    self.forwarding = MCPForwardingOutput(upstream: output)
+    self.rpc = RPCServer(
+      store: store, logger: logger, output: forwarding, sendMessage: sendMessage,
+      journal: journal)
+  }
+
+  func run() async throws {
+    while let line = readLine() {
+      let trimmed = line.trimmingCharacters(in: .whitespacesAndNewlines)
+      if trimmed.isEmpty { continue }
+      await handleLine(trimmed)
+    }
+  }
+
+  func handleLineForTesting(_ line: String) async {
+    await handleLine(line)
+  }
+
+  private func handleLine(_ line: String) async {
+    guard let data = line.data(using: .utf8),
+      let json = try? JSONSerialization.jsonObject(with: data, options: [])
+    else {
+      output.sendError(id: nil, error: RPCError.parseError("invalid JSON"))
+      return
+    }
+    guard let request = json as? [String: Any], let method = request["method"] as? String else {
+      // Responses to server-initiated requests are not used.
+      return
+    }
+    let params = request["params"] as? [String: Any] ?? [:]
+    let id = request["id"]
+    switch method {
+    case "initialize":
+      let requested = params["protocolVersion"] as? String ?? ""
+      let version =
+        MCPServer.supportedProtocolVersions.contains(requested)
+        ? requested : MCPServer.supportedProtocolVersions[0]
+      respond(
+        id: id,
+        result: [
+          "protocolVersion": version,
+          "capabilities": ["tools": ["listChanged": false]],
+          "serverInfo": ["name": "imsg", "version": IMsgVersion.current],
+        ])
+    case "ping":
+      respond(id: id, result: [String: Any]())
+    case "tools/list":
+      respond(
+        id: id,
+        result: [
+          "tools": MCPServer.tools.map {
+            ["name": $0.name, "description": $0.description, "inputSchema": $0.inputSchema]
+          }
+        ])
+    case "tools/call":
+      await callTool(params: params, id: id)
+    default:
+      if method.hasPrefix("notifications/") { return }
+      if id != nil {
+        output.sendError(id: id, error: RPCError.methodNotFound(method))
+      }
+    }
+  }
+
+  private func callTool(params: [String: Any], id: Any?) async {
+    guard let name = params["name"] as? String,
+      let tool = MCPServer.tools.first(where: { $0.name == name })
+    else {
+      output.sendError(
+        id: id, error: RPCError.invalidParams("unknown tool \(params["name"] ?? "")"))
+      return
+    }
+    let arguments = params["arguments"] as? [String: Any] ?? [:]
+    let outcome = await forwarding.capture {
+      await rpc.handle(method: tool.method, params: arguments, id: 0)
+    }
+    switch outcome {
+    case .success(let result):
+      let content: [String: Any] = ["type": "text", "text": MCPServer.jsonText(result)]
+      if let structured = result as? [String: Any] {
+        respond(
+          id: id,
+          result: ["content": [content], "structuredContent": structured, "isError": false])
+      } else {
+        respond(id: id, result: ["content": [content], "isError": false])
+      }
+    case .failure(let error):
+      // Tool failures are results the model can read, not protocol errors.
+      let message = error.data.map { "\(error.message): \($0)" } ?? error.message
+      respond(id: id, result: ["content": [["type": "text", "text": message]], "isError": true])
+    }
+  }
+
+  private func respond(id: Any?, result: Any) {
+    guard let id else { return }
+    output.sendResponse(id: id, result: result)
+  }
+
+  static func jsonText(_ value: Any) -> String {
+    guard JSONSerialization.isValidJSONObject(value),
+      let data = try? JSONSerialization.data(
+        withJSONObject: value, options: [.sortedKeys, .withoutEscapingSlashes])
+    else {
+      return String(describing: value)
+    }
+    return String(data: data, encoding: .utf8) ?? ""
+  }
+
+  private static func schema(_ properties: [String: Any], required: [String] = [])
+    -> [String: Any]
+  {
+    var schema: [String: Any] = ["type": "object", "properties": properties]
+    if !required.isEmpty {
+      schema["required"] = required
+    }
+    return schema
+  }
+}
+
+/// Sits between the MCP server and the `imsg rpc` dispatcher: keeps the one response to the
+/// call being forwarded, and turns subscription notifications into MCP notifications.
+private final class MCPForwardingOutput: RPCOutput, @unchecked Sendable {
+  private let upstream: RPCOutput
+  private let lock = NSLock()
+  private var outcome: Result<Any, RPCError>?
+
+  init(upstream: RPCOutput) {
+    self.upstream = upstream
+  }
+
+  func capture(_ call: () async -> Void) async -> Result<Any, RPCError> {
+    lock.lock()
+    outcome = nil
+    lock.unlock()
+    await call()
+    lock.lock()
+    defer { lock.unlock() }
+    return outcome ?? .failure(RPCError.internalError("no response"))
+  }
+
+  func sendResponse(id: Any, result: Any) {
+    lock.lock()
+    defer { lock.unlock() }
+    outcome = .success(result)
+  }
+
+  func sendError(id: Any?, error: RPCError) {
+    lock.lock()
+    defer { lock.unlock() }
+    outcome = .failure(error)
+  }
+
+  func sendNotification(method: String, params: Any) {
+    let name = method == "message" ? "new" : method
+    upstream.sendNotification(method: "notifications/messages/\(name)", params: params)
+  }
+}
@@ -0,0 +1,26 @@
+import IMsgCore
+
+/// Attachments and reactions for a page of messages, loaded with batched queries instead of
+/// two queries per message.
+struct MessageExtras {
+  private let attachmentsByMessage: [Int64: [AttachmentMeta]]
+  private let reactionsByMessage: [Int64: [Reaction]]
+
+  static let empty = MessageExtras(attachmentsByMessage: [:], reactionsByMessage: [:])
+
+  static func load(store: MessageStore, messages: [Message]) throws -> MessageExtras {
+    let withAttachments = messages.filter { $0.attachmentsCount > 0 }.map(\.rowID)
+    return MessageExtras(
+      attachmentsByMessage: try store.attachments(forMessageIDs: withAttachments),
+      reactionsByMessage: try store.reactions(forMessageIDs: messages.map(\.rowID))
+    )
+  }
+
+  func attachments(for messageID: Int64) -> [AttachmentMeta] {
+    attachmentsByMessage[messageID] ?? []
+  }
+
+  func reactions(for messageID: Int64) -> [Reaction] {
+    reactionsByMessage[messageID] ?? []
+  }
+}
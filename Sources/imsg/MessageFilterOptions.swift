@@ -0,0 +1,57 @@
+import Commander
+import IMsgCore
+
+/// Filter options shared by `history` and `watch`.
+enum MessageFilterOptions {
+  static func options() -> [OptionDefinition] {
+    [
+      .make(
+        label: "participants", names: [.long("participants")],
+        help: "filter by participant handles (any phone format)", parsing: .upToNextOption),
+      .make(label: "start", names: [.long("start")], help: "ISO8601 start (inclusive)"),
+      .make(label: "end", names: [.long("end")], help: "ISO8601 end (exclusive)"),
+      .make(
+        label: "match", names: [.long("match")],
+        help: "only messages whose text or an attachment name matches this regex"),
+      .make(
+        label: "matchIcase", names: [.long("match-icase")],
+        help: "like --match, case-insensitive"),
+      .make(
+        label: "textLang", names: [.long("text-lang")],
+        help: "only messages detected as these languages (en,de; und for unknown)",
+        parsing: .upToNextOption),
+    ]
+  }
+
+  /// Whether JSON output carries each message's detected `language`: with `--detect-lang`, or
+  /// when `--text-lang` filters on it anyway.
+  static func includesLanguage(_ values: ParsedValues) -> Bool {
+    values.flag("detectLang") || !values.optionValues("textLang").isEmpty
+  }
+
+  static func filter(from values: ParsedValues) throws -> MessageFilter {
+    let participants = values.optionValues("participants")
+      .flatMap { $0.split(separator: ",").map { String($0) } }
+      .filter { !$0.isEmpty }
+    let match = values.option("match")
+    let matchIcase = values.option("matchIcase")
+    if match != nil && matchIcase != nil {
+      throw ParsedValuesError.invalidOption("match-icase")
+    }
+    var languages: [String] = []
+    for raw in values.optionValues("textLang").flatMap({ $0.split(separator: ",") }) {
+      guard let code = MessageLanguage.normalizedCode(String(raw)) else {
+        throw ParsedValuesError.invalidOption("text-lang")
+      }
+      languages.append(code)
+    }
+    return try MessageFilter.fromISO(
+      participants: participants,
+      startISO: values.option("start"),
+      endISO: values.option("end"),
+      textPattern: matchIcase ?? match,
+      caseInsensitive: matchIcase != nil,
+      languages: languages
+    )
+  }
+}
@@ -0,0 +1,52 @@
+import Foundation
+import IMsgCore
+
+/// Plain-text message lines shared by history, watch, and unread.
+struct MessageTextPrinter {
+  var store: MessageStore
+  let timestamps: TimestampFormatter
+  let showAttachments: Bool
+  var showChatID = false
+  /// `--template`; replaces the default line (and attachment lines) when set.
+  var template: MessageTemplateRenderer?
+  /// `--lang`.
+  var labels = OutputLabels.english
+  /// `--truncate`; the body is cut to this many characters.
+  var truncate: Int?
+
+  func print(_ message: Message) throws {
+    if let template {
+      Swift.print(try template.render(message, store: store))
+      return
+    }
+    let direction = bidiIsolated(labels.direction(isFromMe: message.isFromMe))
+    let timestamp = timestamps.format(message.date)
+    let chat = showChatID ? " chat=\(message.chatID)" : ""
+    // Placeholder-only bodies may be a shared location, which needs the attachment rows.
+    let placeholder = message.text.isEmpty || message.text == "\u{FFFC}"
+    let attachments =
+      message.attachmentsCount > 0 && (showAttachments || placeholder)
+      ? try store.attachments(for: message.rowID) : []
+    var text = displayText(for: message, attachments: attachments)
+    if let truncate {
+      text = TextTruncation.truncate(text, to: truncate)
+    }
+    let body = bidiIsolated(text)
+    let sender = bidiIsolated(displayHandle(message.sender))
+    Swift.print("\(timestamp) [\(direction)]\(chat) \(sender): \(body)")
+    guard message.attachmentsCount > 0 else { return }
+    if showAttachments {
+      for meta in attachments {
+        Swift.print(attachmentLine(for: meta, labels: labels))
+      }
+    } else {
+      Swift.print(labels.attachmentCount(message.attachmentsCount))
+    }
+  }
+}
+
+func attachmentLine(for meta: AttachmentMeta, labels: OutputLabels = .english) -> String {
+  let name = bidiIsolated(displayName(for: meta))
+  return "  \(labels.attachment): name=\(name) mime=\(meta.mimeType) missing=\(meta.missing) "
+    + "path=\(meta.originalPath)"
+}
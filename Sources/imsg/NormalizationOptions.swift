@@ -0,0 +1,18 @@
+import Commander
+import IMsgCore
+
+/// `--normalize` for commands whose text feeds scripts (`history`, `watch`).
+enum NormalizationOptions {
+  static func option() -> OptionDefinition {
+    .make(
+      label: "normalize", names: [.long("normalize")],
+      help: "clean message text: fffc,zero-width,nfc or all (repeatable)")
+  }
+
+  /// nil when `--normalize` wasn't given.
+  static func normalizer(from values: ParsedValues) throws -> MessageTextNormalizer? {
+    let specs = values.optionValues("normalize").filter { !$0.isEmpty }
+    if specs.isEmpty { return nil }
+    return try MessageTextNormalizer(specs: specs)
+  }
+}
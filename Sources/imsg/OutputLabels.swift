@@ -0,0 +1,77 @@
+import Commander
+import Foundation
+
+/// Words in plain-text message lines, translated with `--lang`. JSON, CSV/TSV, and templates
+/// keep their English field values.
+struct OutputLabels: Equatable {
+  let sent: String
+  let received: String
+  let attachment: String
+  let attachments: String
+
+  static let english = OutputLabels(
+    sent: "sent", received: "recv", attachment: "attachment", attachments: "attachments")
+
+  static let languages: [String: OutputLabels] = [
+    "en": english,
+    "ar": OutputLabels(
+      sent: "مرسلة", received: "مستلمة", attachment: "مرفق", attachments: "مرفقات"),
+    "de": OutputLabels(
+      sent: "gesendet", received: "empfangen", attachment: "Anhang", attachments: "Anhänge"),
+    "es": OutputLabels(
+      sent: "enviado", received: "recibido", attachment: "adjunto", attachments: "adjuntos"),
+    "fr": OutputLabels(
+      sent: "envoyé", received: "reçu", attachment: "pièce jointe", attachments: "pièces jointes"),
+    "he": OutputLabels(
+      sent: "נשלחה", received: "התקבלה", attachment: "קובץ מצורף", attachments: "קבצים מצורפים"),
+  ]
+
+  static func option() -> OptionDefinition {
+    .make(
+      label: "lang", names: [.long("lang")],
+      help: "language for text labels and relative times: "
+        + "\(languages.keys.sorted().joined(separator: "|")) (default en)")
+  }
+
+  static func from(values: ParsedValues) throws -> OutputLabels {
+    guard let raw = values.option("lang") else { return .english }
+    guard let labels = languages[languageCode(raw)] else {
+      throw ParsedValuesError.invalidOption("lang")
+    }
+    return labels
+  }
+
+  /// `he`, `he_IL` and `he-IL` all mean Hebrew.
+  static func languageCode(_ value: String) -> String {
+    String(value.lowercased().prefix { $0 != "_" && $0 != "-" })
+  }
+
+  func direction(isFromMe: Bool) -> String {
+    isFromMe ? sent : received
+  }
+
+  /// `(2 attachments)` summary line under a message.
+  func attachmentCount(_ count: Int) -> String {
+    "  (\(count) \(count == 1 ? attachment : attachments))"
+  }
+}
+
+/// Wraps `text` in first-strong isolates (U+2068 … U+2069) when it contains right-to-left
+/// script, so a Hebrew or Arabic body or name keeps its own direction instead of reordering
+/// the timestamp, label and punctuation around it. Other text is returned unchanged, so
+/// left-to-right output stays byte-for-byte the same.
+func bidiIsolated(_ text: String) -> String {
+  guard containsRightToLeft(text) else { return text }
+  return "\u{2068}\(text)\u{2069}"
+}
+
+func containsRightToLeft(_ text: String) -> Bool {
+  text.unicodeScalars.contains { scalar in
+    switch scalar.value {
+    // Hebrew, Arabic, Syriac, Arabic Supplement, Thaana, NKo, Samaritan, Mandaic, Arabic
+    // Extended, then the Hebrew and Arabic presentation forms.
+    case 0x0590...0x08FF, 0xFB1D...0xFDFF, 0xFE70...0xFEFF: return true
+    default: return false
+    }
+  }
+}
@@ -7,6 +7,11 @@ struct ChatPayload: Codable {
   let identifier: String
   let service: String
   let lastMessageAt: String
+  let messageCount: Int
+  /// Region code of a one-to-one chat with an international phone number.
+  let region: String?
+  /// True for a chat muted with imsg mute (listed with chats --all); omitted otherwise.
+  var muted: Bool?
 
   init(chat: Chat) {
     self.id = chat.id
@@ -14,6 +19,8 @@ struct ChatPayload: Codable {
     self.identifier = chat.identifier
     self.service = chat.service
     self.lastMessageAt = CLIISO8601.format(chat.lastMessageAt)
+    self.messageCount = chat.messageCount
+    self.region = PhoneNumberNormalizer.shared.region(of: chat.identifier)
   }
 
   enum CodingKeys: String, CodingKey {
@@ -22,6 +29,199 @@ struct ChatPayload: Codable {
     case identifier
     case service
     case lastMessageAt = "last_message_at"
+    case messageCount = "message_count"
+    case region
+    case muted
+  }
+}
+
+struct WatchReconnectPayload: Codable {
+  let event: String
+  let reason: String
+  let resumeRowID: Int64
+  let detail: String?
+
+  init(reconnect: MessageWatchReconnect) {
+    self.event = "reconnect"
+    self.reason = reconnect.reason.rawValue
+    self.resumeRowID = reconnect.resumeRowID
+    self.detail = reconnect.detail
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case event
+    case reason
+    case resumeRowID = "resume_rowid"
+    case detail
+  }
+}
+
+struct WatchHeartbeatPayload: Codable {
+  let event: String
+  let lastRowID: Int64
+  let at: String
+
+  init(heartbeat: MessageWatchHeartbeat) {
+    self.event = "heartbeat"
+    self.lastRowID = heartbeat.lastRowID
+    self.at = CLIISO8601.format(heartbeat.date)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case event
+    case lastRowID = "last_rowid"
+    case at
+  }
+}
+
+struct ServiceChangePayload: Codable {
+  let event: String
+  let chatID: Int64
+  let rowID: Int64
+  let from: String
+  let to: String
+  let account: String?
+  let createdAt: String
+
+  init(change: ServiceChange) {
+    self.event = "service_change"
+    self.chatID = change.chatID
+    self.rowID = change.rowID
+    self.from = change.from
+    self.to = change.to
+    self.account = change.account.isEmpty ? nil : change.account
+    self.createdAt = CLIISO8601.format(change.date)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case event
+    case chatID = "chat_id"
+    case rowID = "rowid"
+    case from
+    case to
+    case account
+    case createdAt = "created_at"
+  }
+}
+
+/// A `watch --events` line for anything but a new message:
+/// `{"event":"reaction|edit|delete|receipt",...}`.
+struct WatchChangePayload: Codable {
+  let event: String
+  let chatID: Int64
+  /// Rowid of the message the change is about; nil for a tapback on a message not in chat.db.
+  let messageID: Int64?
+  let messageGUID: String
+  /// Sender of the tapback, or of the message edited, unsent or read.
+  let sender: String
+  let isFromMe: Bool
+  /// When the change happened.
+  let createdAt: String
+  var reaction: ReactionPayload?
+  var removed: Bool?
+  var text: String?
+  var previousText: String?
+
+  init?(event: MessageWatchEvent) {
+    switch event {
+    case .message, .reconnected, .heartbeat:
+      return nil
+    case .reaction(let change):
+      let target = change.reaction.associatedMessageID
+      self.init(
+        event: "reaction", chatID: change.chatID, messageID: target == 0 ? nil : target,
+        messageGUID: change.messageGUID, sender: change.reaction.sender,
+        isFromMe: change.reaction.isFromMe, date: change.reaction.date)
+      self.reaction = ReactionPayload(reaction: change.reaction)
+      self.removed = change.isRemoval
+    case .edited(let change):
+      self.init(event: "edit", message: change.message, date: change.editedAt)
+      self.text = change.message.text
+      self.previousText = change.previousText
+    case .deleted(let change):
+      self.init(event: "delete", message: change.message, date: change.deletedAt)
+    case .receipt(let change):
+      self.init(event: "receipt", message: change.message, date: change.readAt)
+    }
+  }
+
+  private init(event: String, message: Message, date: Date) {
+    self.init(
+      event: event, chatID: message.chatID, messageID: message.rowID, messageGUID: message.guid,
+      sender: message.sender, isFromMe: message.isFromMe, date: date)
+  }
+
+  private init(
+    event: String, chatID: Int64, messageID: Int64?, messageGUID: String, sender: String,
+    isFromMe: Bool, date: Date
+  ) {
+    self.event = event
+    self.chatID = chatID
+    self.messageID = messageID
+    self.messageGUID = messageGUID
+    self.sender = sender
+    self.isFromMe = isFromMe
+    self.createdAt = CLIISO8601.format(date)
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case event
+    case chatID = "chat_id"
+    case messageID = "message_id"
+    case messageGUID = "message_guid"
+    case sender
+    case isFromMe = "is_from_me"
+    case createdAt = "created_at"
+    case reaction
+    case removed
+    case text
+    case previousText = "previous_text"
+  }
+}
+
+struct WatchStatsPayload: Codable {
+  struct Chat: Codable {
+    let chatID: Int64
+    let messages: Int
+    let perMinute: Double
+
+    enum CodingKeys: String, CodingKey {
+      case chatID = "chat_id"
+      case messages
+      case perMinute = "per_minute"
+    }
+  }
+
+  struct Sender: Codable {
+    let sender: String
+    let messages: Int
+  }
+
+  let event: String
+  let start: String
+  let end: String
+  let messages: Int
+  let chats: [Chat]
+  let topSenders: [Sender]
+
+  init(snapshot: ActivitySnapshot) {
+    self.event = "stats"
+    self.start = CLIISO8601.format(snapshot.start)
+    self.end = CLIISO8601.format(snapshot.end)
+    self.messages = snapshot.messages
+    self.chats = snapshot.chats.map {
+      Chat(chatID: $0.chatID, messages: $0.messages, perMinute: $0.perMinute)
+    }
+    self.topSenders = snapshot.topSenders.map { Sender(sender: $0.sender, messages: $0.messages) }
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case event
+    case start
+    case end
+    case messages
+    case chats
+    case topSenders = "top_senders"
   }
 }
 
@@ -31,23 +231,62 @@ struct MessagePayload: Codable {
   let guid: String
   let replyToGUID: String?
   let sender: String
+  /// Region code of the sender's phone number, when it has a country code.
+  let senderRegion: String?
   let isFromMe: Bool
   let text: String
+  /// Detected language of `text` (`en`, `zh-Hans`), when asked for and it can be told.
+  let language: String?
   let createdAt: String
-  let attachments: [AttachmentPayload]
+  let service: String
+  let account: String?
+  var attachments: [AttachmentPayload]
   let reactions: [ReactionPayload]
+  let balloonBundleID: String?
+  let appDescription: String?
+  let appSummary: String?
+  let location: LocationPayload?
+  let mentions: [MentionPayload]?
+  /// `digital_touch` or `handwriting` for drawn messages, `group_event` for group events.
+  let kind: String?
+  let assetPath: String?
+  let groupEvent: GroupEventPayload?
+  /// Set by `imsg message --edits`.
+  var edits: [MessageRevisionPayload]?
+  /// Set by `imsg message --receipts`.
+  var receipts: [MessageReceiptPayload]?
 
-  init(message: Message, attachments: [AttachmentMeta], reactions: [Reaction] = []) {
+  /// `includeLanguage` runs language detection for `language`; it's left out otherwise, since
+  /// detection costs more than the rest of the payload together.
+  init(
+    message: Message, attachments: [AttachmentMeta], reactions: [Reaction] = [],
+    includeLanguage: Bool = false
+  ) {
     self.id = message.rowID
     self.chatID = message.chatID
     self.guid = message.guid
     self.replyToGUID = message.replyToGUID
     self.sender = message.sender
+    self.senderRegion = PhoneNumberNormalizer.shared.region(of: message.sender)
     self.isFromMe = message.isFromMe
     self.text = message.text
+    self.language = includeLanguage ? MessageLanguage.detect(message.text) : nil
     self.createdAt = CLIISO8601.format(message.date)
+    self.service = message.service
+    self.account = message.account.isEmpty ? nil : message.account
     self.attachments = attachments.map { AttachmentPayload(meta: $0) }
     self.reactions = reactions.map { ReactionPayload(reaction: $0) }
+    self.balloonBundleID = message.app?.bundleID
+    self.appDescription = message.app?.displayText
+    self.appSummary = message.app?.summary
+    self.location = attachments.lazy.compactMap(SharedLocationDecoder.decode).first
+      .map { LocationPayload(location: $0) }
+    self.mentions =
+      message.mentions.isEmpty ? nil : message.mentions.map { MentionPayload(mention: $0) }
+    let kind = DrawnMessageKind.detect(bundleID: message.app?.bundleID, attachments: attachments)
+    self.kind = message.groupEvent == nil ? kind?.rawValue : "group_event"
+    self.assetPath = kind == nil ? nil : DrawnMessageKind.assetPath(in: attachments)
+    self.groupEvent = message.groupEvent.map { GroupEventPayload(event: $0) }
   }
 
   enum CodingKeys: String, CodingKey {
@@ -56,11 +295,142 @@ struct MessagePayload: Codable {
     case guid
     case replyToGUID = "reply_to_guid"
     case sender
+    case senderRegion = "sender_region"
     case isFromMe = "is_from_me"
     case text
+    case language
     case createdAt = "created_at"
+    case service
+    case account
     case attachments
     case reactions
+    case balloonBundleID = "balloon_bundle_id"
+    case appDescription = "app_description"
+    case appSummary = "app_summary"
+    case location
+    case mentions
+    case kind
+    case assetPath = "asset_path"
+    case groupEvent = "group_event"
+    case edits
+    case receipts
+  }
+}
+
+struct MessageReceiptPayload: Codable {
+  let handle: String
+  let deliveredAt: String?
+  let readAt: String?
+  let perParticipant: Bool
+
+  init(receipt: MessageReceipt) {
+    self.handle = receipt.handle
+    self.deliveredAt = receipt.deliveredAt.map(CLIISO8601.format)
+    self.readAt = receipt.readAt.map(CLIISO8601.format)
+    self.perParticipant = receipt.perParticipant
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case handle
+    case deliveredAt = "delivered_at"
+    case readAt = "read_at"
+    case perParticipant = "per_participant"
+  }
+}
+
+struct GroupEventPayload: Codable {
+  /// added|removed|left|renamed|photo_changed|photo_removed
+  let action: String
+  /// The person added or removed.
+  let handle: String?
+  /// The new name for `renamed` (empty when it was cleared).
+  let title: String?
+
+  init(event: GroupEvent) {
+    self.action = event.action.rawValue
+    self.handle = event.handle.isEmpty ? nil : event.handle
+    self.title = event.action == .renamed ? event.title : nil
+  }
+}
+
+struct LocationPayload: Codable {
+  let latitude: Double
+  let longitude: Double
+  let name: String?
+  let url: String
+
+  init(location: SharedLocation) {
+    self.latitude = location.latitude
+    self.longitude = location.longitude
+    self.name = location.name
+    self.url = location.url
+  }
+}
+
+/// `start` and `length` are in UTF-16 code units, matching NSRange and JavaScript strings.
+struct MentionPayload: Codable {
+  let handle: String
+  let text: String
+  let start: Int
+  let length: Int
+
+  init(mention: MessageMention) {
+    self.handle = mention.handle
+    self.text = mention.text
+    self.start = mention.location
+    self.length = mention.length
+  }
+}
+
+struct MessageRevisionPayload: Codable {
+  let part: Int
+  let text: String
+  let createdAt: String?
+  let original: Bool
+
+  init(revision: MessageRevision, original: Bool) {
+    self.part = revision.part
+    self.text = revision.text
+    self.createdAt = revision.date.map(CLIISO8601.format)
+    self.original = original
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case part
+    case text
+    case createdAt = "created_at"
+    case original
+  }
+}
+
+struct SendStatusPayload: Codable {
+  let status: String
+  let attempts: Int
+  let attachments: [SentAttachmentPayload]?
+}
+
+struct SentAttachmentPayload: Codable {
+  let path: String
+  let bytes: Int64
+  let transcodedFrom: String?
+  /// The message and attachment rows Messages created, once they showed up in chat.db.
+  let messageGUID: String?
+  let attachmentGUID: String?
+
+  init(attachment: SendAttachment, sent: SentAttachmentRecord? = nil) {
+    self.path = attachment.path
+    self.bytes = attachment.bytes
+    self.transcodedFrom = attachment.originalPath
+    self.messageGUID = sent?.messageGUID
+    self.attachmentGUID = sent?.attachmentGUID
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case path
+    case bytes
+    case transcodedFrom = "transcoded_from"
+    case messageGUID = "message_guid"
+    case attachmentGUID = "attachment_guid"
   }
 }
 
@@ -100,6 +470,8 @@ struct AttachmentPayload: Codable {
   let isSticker: Bool
   let originalPath: String
   let missing: Bool
+  /// Base64 file contents, set by --embed-attachments.
+  var data: String?
 
   init(meta: AttachmentMeta) {
     self.filename = meta.filename
@@ -121,6 +493,7 @@ struct AttachmentPayload: Codable {
     case isSticker = "is_sticker"
     case originalPath = "original_path"
     case missing = "missing"
+    case data = "data"
   }
 }
 
@@ -0,0 +1,142 @@
+import Commander
+import Foundation
+import IMsgCore
+
+/// `--template` for text output: Go-template-style `{{.Field}}` placeholders, e.g.
+/// `'{{.Date}} {{.Sender}}: {{.Text}}'`. Unknown fields are rejected when parsing.
+struct OutputTemplate: Equatable {
+  enum Segment: Equatable {
+    case literal(String)
+    case field(String)
+  }
+
+  let segments: [Segment]
+
+  static let messageFields: Set<String> = [
+    "ID", "ChatID", "GUID", "ReplyToGUID", "Sender", "Text", "Date", "IsFromMe", "Direction",
+    "Service", "AttachmentCount", "Attachments", "AttachmentPaths", "Reactions", "Chat.Name",
+    "Chat.Identifier", "Chat.GUID", "Chat.Service",
+  ]
+  static let chatFields: Set<String> = [
+    "ID", "Name", "Identifier", "Service", "Date", "MessageCount",
+  ]
+
+  static func option() -> OptionDefinition {
+    .make(
+      label: "template", names: [.long("template")],
+      help: "text output template, e.g. '{{.Date}} {{.Sender}}: {{.Text}}'")
+  }
+
+  init(_ source: String, fields: Set<String>) throws {
+    var segments: [Segment] = []
+    var rest = Substring(source)
+    while let open = rest.range(of: "{{") {
+      if open.lowerBound > rest.startIndex {
+        segments.append(.literal(String(rest[rest.startIndex..<open.lowerBound])))
+      }
+      guard let close = rest.range(of: "}}", range: open.upperBound..<rest.endIndex) else {
+        throw ParsedValuesError.invalidOption("template")
+      }
+      let name = rest[open.upperBound..<close.lowerBound]
+        .trimmingCharacters(in: .whitespaces)
+      guard name.hasPrefix("."), fields.contains(String(name.dropFirst())) else {
+        throw ParsedValuesError.invalidOption("template")
+      }
+      segments.append(.field(String(name.dropFirst())))
+      rest = rest[close.upperBound...]
+    }
+    if !rest.isEmpty {
+      segments.append(.literal(String(rest)))
+    }
+    self.segments = segments
+  }
+
+  var fields: Set<String> {
+    Set(
+      segments.compactMap {
+        if case .field(let name) = $0 { return name }
+        return nil
+      })
+  }
+
+  func render(_ value: (String) throws -> String) rethrows -> String {
+    var output = ""
+    for segment in segments {
+      switch segment {
+      case .literal(let text): output += text
+      case .field(let name): output += try value(name)
+      }
+    }
+    return output
+  }
+}
+
+/// Renders messages through an `OutputTemplate`, loading attachments, reactions, and chat
+/// metadata only when the template uses them.
+final class MessageTemplateRenderer {
+  let template: OutputTemplate
+  let timestamps: TimestampFormatter
+  /// `--truncate`, applied to `{{.Text}}`.
+  var truncate: Int?
+  private var chats: [Int64: ChatInfo?] = [:]
+
+  init(template: OutputTemplate, timestamps: TimestampFormatter) {
+    self.template = template
+    self.timestamps = timestamps
+  }
+
+  static func from(values: ParsedValues, timestamps: TimestampFormatter) throws
+    -> MessageTemplateRenderer?
+  {
+    guard let source = values.option("template") else { return nil }
+    let template = try OutputTemplate(source, fields: OutputTemplate.messageFields)
+    let renderer = MessageTemplateRenderer(template: template, timestamps: timestamps)
+    renderer.truncate = try TextTruncation.limit(from: values)
+    return renderer
+  }
+
+  func render(_ message: Message, store: MessageStore) throws -> String {
+    try template.render { field in
+      switch field {
+      case "ID": return String(message.rowID)
+      case "ChatID": return String(message.chatID)
+      case "GUID": return message.guid
+      case "ReplyToGUID": return message.replyToGUID ?? ""
+      case "Sender": return message.sender
+      case "Text":
+        let text = displayText(for: message)
+        return truncate.map { TextTruncation.truncate(text, to: $0) } ?? text
+      case "Date": return timestamps.format(message.date)
+      case "IsFromMe": return String(message.isFromMe)
+      case "Direction": return message.isFromMe ? "sent" : "recv"
+      case "Service": return message.service
+      case "AttachmentCount": return String(message.attachmentsCount)
+      case "Attachments", "AttachmentPaths":
+        guard message.attachmentsCount > 0 else { return "" }
+        let metas = try store.attachments(for: message.rowID)
+        return metas.map { field == "Attachments" ? displayName(for: $0) : $0.originalPath }
+          .joined(separator: ", ")
+      case "Reactions":
+        return try store.reactions(for: message.rowID)
+          .map { "\($0.reactionType.emoji) \($0.isFromMe ? "me" : $0.sender)" }
+          .joined(separator: ", ")
+      default:
+        let info = try chat(message.chatID, store: store)
+        switch field {
+        case "Chat.Name": return info?.name ?? ""
+        case "Chat.Identifier": return info?.identifier ?? ""
+        case "Chat.GUID": return info?.guid ?? ""
+        case "Chat.Service": return info?.service ?? ""
+        default: return ""
+        }
+      }
+    }
+  }
+
+  private func chat(_ chatID: Int64, store: MessageStore) throws -> ChatInfo? {
+    if let cached = chats[chatID] { return cached }
+    let info = try store.chatInfo(chatID: chatID)
+    chats[chatID] = info
+    return info
+  }
+}
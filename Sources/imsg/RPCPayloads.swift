@@ -10,7 +10,7 @@ func chatPayload(
   lastMessageAt: Date,
   participants: [String]
 ) -> [String: Any] {
-  return [
+  var payload: [String: Any] = [
     "id": id,
     "identifier": identifier,
     "guid": guid,
@@ -20,6 +20,53 @@ func chatPayload(
     "participants": participants,
     "is_group": isGroupHandle(identifier: identifier, guid: guid),
   ]
+  if let region = PhoneNumberNormalizer.shared.region(of: identifier) {
+    payload["region"] = region
+  }
+  return payload
+}
+
+func serviceChangePayload(_ change: ServiceChange) -> [String: Any] {
+  var payload: [String: Any] = [
+    "chat_id": change.chatID,
+    "rowid": change.rowID,
+    "from": change.from,
+    "to": change.to,
+    "created_at": CLIISO8601.format(change.date),
+  ]
+  if !change.account.isEmpty {
+    payload["account"] = change.account
+  }
+  return payload
+}
+
+/// Notification method and params for a change event: `reaction`, `edit`, `delete` or
+/// `receipt`, with the fields `watch --events --json` prints.
+func watchChangeNotification(_ event: MessageWatchEvent)
+  -> (method: String, params: [String: Any])?
+{
+  guard let change = WatchChangePayload(event: event) else { return nil }
+  var payload: [String: Any] = [
+    "chat_id": change.chatID,
+    "message_guid": change.messageGUID,
+    "sender": change.sender,
+    "is_from_me": change.isFromMe,
+    "created_at": change.createdAt,
+  ]
+  if let messageID = change.messageID {
+    payload["message_id"] = messageID
+  }
+  if case .reaction(let reaction) = event {
+    payload["reaction"] = reactionPayload(reaction.reaction)
+    payload["removed"] = reaction.isRemoval
+  }
+  if let text = change.text {
+    payload["text"] = text
+  }
+  if let previousText = change.previousText {
+    payload["previous_text"] = previousText
+  }
+  return (change.event, payload)
 }
 
 func messagePayload(
@@ -27,7 +74,8 @@ func messagePayload(
   chatInfo: ChatInfo?,
   participants: [String],
   attachments: [AttachmentMeta],
-  reactions: [Reaction]
+  reactions: [Reaction],
+  includeLanguage: Bool = false
 ) -> [String: Any] {
   let identifier = chatInfo?.identifier ?? ""
   let guid = chatInfo?.guid ?? ""
@@ -40,6 +88,7 @@ func messagePayload(
     "is_from_me": message.isFromMe,
     "text": message.text,
     "created_at": CLIISO8601.format(message.date),
+    "service": message.service,
     "attachments": attachments.map { attachmentPayload($0) },
     "reactions": reactions.map { reactionPayload($0) },
     "chat_identifier": identifier,
@@ -48,9 +97,64 @@ func messagePayload(
     "participants": participants,
     "is_group": isGroupHandle(identifier: identifier, guid: guid),
   ]
+  if let region = PhoneNumberNormalizer.shared.region(of: message.sender) {
+    payload["sender_region"] = region
+  }
+  if includeLanguage, let language = MessageLanguage.detect(message.text) {
+    payload["language"] = language
+  }
+  if !message.account.isEmpty {
+    payload["account"] = message.account
+  }
   if let replyToGUID = message.replyToGUID, !replyToGUID.isEmpty {
     payload["reply_to_guid"] = replyToGUID
   }
+  if let app = message.app {
+    payload["balloon_bundle_id"] = app.bundleID
+    payload["app_description"] = app.displayText
+    if let summary = app.summary {
+      payload["app_summary"] = summary
+    }
+  }
+  if let location = attachments.lazy.compactMap(SharedLocationDecoder.decode).first {
+    var object: [String: Any] = [
+      "latitude": location.latitude,
+      "longitude": location.longitude,
+      "url": location.url,
+    ]
+    if let name = location.name {
+      object["name"] = name
+    }
+    payload["location"] = object
+  }
+  if !message.mentions.isEmpty {
+    payload["mentions"] = message.mentions.map { mention -> [String: Any] in
+      [
+        "handle": mention.handle,
+        "text": mention.text,
+        "start": mention.location,
+        "length": mention.length,
+      ]
+    }
+  }
+  if let kind = DrawnMessageKind.detect(bundleID: message.app?.bundleID, attachments: attachments)
+  {
+    payload["kind"] = kind.rawValue
+    if let assetPath = DrawnMessageKind.assetPath(in: attachments) {
+      payload["asset_path"] = assetPath
+    }
+  }
+  if let event = message.groupEvent {
+    payload["kind"] = "group_event"
+    var object: [String: Any] = ["action": event.action.rawValue]
+    if !event.handle.isEmpty {
+      object["handle"] = event.handle
+    }
+    if event.action == .renamed {
+      object["title"] = event.title
+    }
+    payload["group_event"] = object
+  }
   return payload
 }
 
@@ -104,6 +208,18 @@ func int64Param(_ value: Any?) -> Int64? {
   return nil
 }
 
+func int64ArrayParam(_ value: Any?) -> [Int64] {
+  if let list = value as? [Any] {
+    return list.compactMap { int64Param($0) }
+  }
+  if let str = value as? String {
+    return str.split(separator: ",").compactMap {
+      Int64($0.trimmingCharacters(in: .whitespacesAndNewlines))
+    }
+  }
+  return int64Param(value).map { [$0] } ?? []
+}
+
 func boolParam(_ value: Any?) -> Bool? {
   if let value = value as? Bool { return value }
   if let value = value as? NSNumber { return value.boolValue }
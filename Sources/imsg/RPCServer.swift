@@ -9,34 +9,50 @@ protocol RPCOutput: Sendable {
 
 final class RPCServer {
   private let store: MessageStore
-  private let watcher: MessageWatcher
+  private let hub: MessageWatchHub
   private let output: RPCOutput
   private let cache: ChatCache
-  private let verbose: Bool
+  private let logger: AutomationLogger
+  private let warmChatLimit: Int
+  private let warmMessageLimit: Int
   private let sendMessage: (MessageSendOptions) throws -> Void
+  private let journal: SendJournal?
+  private let muteListFactory: () throws -> ChatMuteList
   private var nextSubscriptionID = 1
   private var subscriptions: [Int: Task<Void, Never>] = [:]
 
   init(
     store: MessageStore,
-    verbose: Bool,
+    logger: AutomationLogger = .disabled,
+    warmChatLimit: Int = 0,
+    warmMessageLimit: Int = 0,
     output: RPCOutput = RPCWriter(),
-    sendMessage: @escaping (MessageSendOptions) throws -> Void = { try MessageSender().send($0) }
+    sendMessage: @escaping (MessageSendOptions) throws -> Void = { try MessageSender().send($0) },
+    journal: SendJournal? = nil,
+    muteListFactory: @escaping () throws -> ChatMuteList = { try ChatMuteList() }
   ) {
     self.store = store
-    self.watcher = MessageWatcher(store: store)
+    // Subscriptions pick the kinds they want from the shared watch.
+    self.hub = MessageWatchHub(
+      store: store, configuration: MessageWatcherConfiguration(events: .all))
     self.cache = ChatCache(store: store)
-    self.verbose = verbose
+    self.logger = logger
+    self.warmChatLimit = warmChatLimit
+    self.warmMessageLimit = warmMessageLimit
     self.output = output
     self.sendMessage = sendMessage
+    self.journal = journal
+    self.muteListFactory = muteListFactory
   }
 
   func run() async throws {
+    let warmTask = startWarmUp()
     while let line = readLine() {
       let trimmed = line.trimmingCharacters(in: .whitespacesAndNewlines)
       if trimmed.isEmpty { continue }
       await handleLine(trimmed)
     }
+    warmTask?.cancel()
     for task in subscriptions.values {
       task.cancel()
     }
@@ -46,6 +62,27 @@ final class RPCServer {
     await handleLine(line)
   }
 
+  /// Runs `RPCWarmUp` off the request path, so the first `chats.list` / `messages.history` on
+  /// a large database doesn't pay for it.
+  private func startWarmUp() -> Task<Void, Never>? {
+    guard warmChatLimit > 0 else { return nil }
+    let warmUp = RPCWarmUp(
+      store: store, cache: cache, chatLimit: warmChatLimit, messageLimit: warmMessageLimit)
+    let localLogger = logger
+    return Task.detached(priority: .utility) {
+      let started = Date()
+      do {
+        let (chats, messages) = try warmUp.run()
+        let elapsed = Int(Date().timeIntervalSince(started) * 1000)
+        localLogger.log(
+          .info, "warmed \(chats) chats and \(messages) messages in \(elapsed)ms",
+          fields: ["command": "rpc"])
+      } catch {
+        localLogger.log(error, "cache warm-up failed", fields: ["command": "rpc"])
+      }
+    }
+  }
+
   private func handleLine(_ line: String) async {
     guard let data = line.data(using: .utf8) else {
       output.sendError(id: nil, error: RPCError.parseError("invalid utf8"))
@@ -72,8 +109,11 @@ final class RPCServer {
       return
     }
     let params = request["params"] as? [String: Any] ?? [:]
-    let id = request["id"]
+    await handle(method: method, params: params, id: request["id"])
+  }
 
+  /// Runs one method and answers through `output`; `id` nil makes it a notification.
+  func handle(method: String, params: [String: Any], id: Any?) async {
     do {
       switch method {
       case "chats.list":
@@ -106,60 +146,129 @@ final class RPCServer {
         let startISO = stringParam(params["start"])
         let endISO = stringParam(params["end"])
         let includeAttachments = boolParam(params["attachments"]) ?? false
-        let filter = try MessageFilter.fromISO(
+        let filter = try messageFilter(
+          params: params,
           participants: participants,
           startISO: startISO,
           endISO: endISO
         )
-        let messages = try store.messages(chatID: chatID, limit: max(limit, 1))
-        let filtered = messages.filter { filter.allows($0) }
+        let includeLanguage = boolParam(params["language"]) ?? !filter.languages.isEmpty
+        var filtered: [Message] = []
+        try store.scanMessages(
+          chatID: chatID, limit: max(limit, 1), dateRange: filter.dateRange,
+          handleIDs: try store.senderHandleIDs(for: filter),
+          matching: { try store.allows($0, by: filter) }
+        ) { filtered += $0 }
+        let extras =
+          try includeAttachments ? MessageExtras.load(store: store, messages: filtered) : nil
         let payloads = try filtered.map { message in
           try buildMessagePayload(
             store: store,
             cache: cache,
             message: message,
-            includeAttachments: includeAttachments
+            includeAttachments: includeAttachments,
+            includeLanguage: includeLanguage,
+            extras: extras
           )
         }
         respond(id: id, result: ["messages": payloads])
       case "watch.subscribe":
-        let chatID = int64Param(params["chat_id"])
+        var chatIDs = Set(int64ArrayParam(params["chat_ids"]))
+        if let chatID = int64Param(params["chat_id"]) {
+          chatIDs.insert(chatID)
+        }
         let sinceRowID = int64Param(params["since_rowid"])
         let participants = stringArrayParam(params["participants"])
         let startISO = stringParam(params["start"])
         let endISO = stringParam(params["end"])
         let includeAttachments = boolParam(params["attachments"]) ?? false
-        let filter = try MessageFilter.fromISO(
+        let filter = try messageFilter(
+          params: params,
           participants: participants,
           startISO: startISO,
           endISO: endISO
         )
-        let config = MessageWatcherConfiguration()
+        let includeLanguage = boolParam(params["language"]) ?? !filter.languages.isEmpty
+        var kinds = MessageWatchEventKinds.messages
+        if params["events"] != nil {
+          guard let parsed = MessageWatchEventKinds.parse(stringArrayParam(params["events"])),
+            !parsed.isEmpty
+          else {
+            throw RPCError.invalidParams("events: use message, reaction, edit, delete, receipt")
+          }
+          kinds = parsed
+        }
+        // Every subscription reads from the one shared watch; filtering happens per subscriber.
+        let events = try hub.subscribe(sinceRowID: sinceRowID)
         let subID = nextSubscriptionID
         nextSubscriptionID += 1
         let localStore = store
-        let localWatcher = watcher
         let localCache = cache
         let localWriter = output
         let localFilter = filter
-        let localChatID = chatID
-        let localSinceRowID = sinceRowID
-        let localConfig = config
+        let localChatIDs = chatIDs
         let localIncludeAttachments = includeAttachments
+        let localIncludeLanguage = includeLanguage
+        let localKinds = kinds
+        // Subscriptions naming chat_ids get them even when muted.
+        let localMuteList = chatIDs.isEmpty ? try muteListFactory() : nil
         let task = Task {
+          var currentStore = localStore
+          var serviceChanges = ServiceChangeTracker(store: localStore)
           do {
-            for try await message in localWatcher.stream(
-              chatID: localChatID,
-              sinceRowID: localSinceRowID,
-              configuration: localConfig
-            ) {
+            for try await event in events {
               if Task.isCancelled { return }
-              if !localFilter.allows(message) { continue }
+              let message: Message
+              switch event {
+              case .message(let next):
+                message = next
+              case .reconnected(let reconnect):
+                currentStore = reconnect.store
+                serviceChanges = ServiceChangeTracker(store: reconnect.store)
+                localWriter.sendNotification(
+                  method: "reconnect",
+                  params: [
+                    "subscription": subID,
+                    "reason": reconnect.reason.rawValue,
+                    "resume_rowid": reconnect.resumeRowID,
+                  ]
+                )
+                continue
+              case .heartbeat:
+                continue
+              case .reaction, .edited, .deleted, .receipt:
+                try localMuteList?.reloadIfChanged()
+                guard localKinds.contains(event.kind),
+                  let about = try WatchCommand.changedMessage(for: event, store: currentStore),
+                  localChatIDs.isEmpty || localChatIDs.contains(about.chatID),
+                  try localMuteList?.isMuted(chatID: about.chatID, in: currentStore) != true,
+                  try currentStore.allows(about, by: localFilter),
+                  var notification = watchChangeNotification(event)
+                else { continue }
+                notification.params["subscription"] = subID
+                localWriter.sendNotification(
+                  method: notification.method, params: notification.params)
+                continue
+              }
+              let serviceChange = try serviceChanges.observe(message)
+              if !localKinds.contains(.messages) { continue }
+              if !localChatIDs.isEmpty && !localChatIDs.contains(message.chatID) { continue }
+              try localMuteList?.reloadIfChanged()
+              if try localMuteList?.isMuted(chatID: message.chatID, in: currentStore) == true {
+                continue
+              }
+              if try !currentStore.allows(message, by: localFilter) { continue }
+              if let serviceChange {
+                var params = serviceChangePayload(serviceChange)
+                params["subscription"] = subID
+                localWriter.sendNotification(method: "service_change", params: params)
+              }
               let payload = try buildMessagePayload(
-                store: localStore,
+                store: currentStore,
                 cache: localCache,
                 message: message,
-                includeAttachments: localIncludeAttachments
+                includeAttachments: localIncludeAttachments,
+                includeLanguage: localIncludeLanguage
               )
               localWriter.sendNotification(
                 method: "message",
@@ -195,11 +304,13 @@ final class RPCServer {
       output.sendError(id: id, error: err)
     } catch let err as IMsgError {
       switch err {
-      case .invalidService, .invalidChatTarget:
+      case .invalidService, .invalidChatTarget, .invalidHandle, .invalidPattern:
         output.sendError(
           id: id,
           error: RPCError.invalidParams(err.errorDescription ?? "invalid params")
         )
+      case .sendBackoff:
+        output.sendError(id: id, error: RPCError.sendBackoff(err.localizedDescription))
       default:
         output.sendError(id: id, error: RPCError.internalError(err.localizedDescription))
       }
@@ -208,6 +319,32 @@ final class RPCServer {
     }
   }
 
+  private func messageFilter(
+    params: [String: Any],
+    participants: [String],
+    startISO: String?,
+    endISO: String?
+  ) throws -> MessageFilter {
+    let match = stringParam(params["match"])
+    let matchIcase = stringParam(params["match_icase"])
+    if match != nil && matchIcase != nil {
+      throw RPCError.invalidParams("use match or match_icase; not both")
+    }
+    return try MessageFilter.fromISO(
+      participants: participants,
+      startISO: startISO,
+      endISO: endISO,
+      textPattern: matchIcase ?? match,
+      caseInsensitive: matchIcase != nil,
+      languages: try stringArrayParam(params["text_lang"]).map { raw in
+        guard let code = MessageLanguage.normalizedCode(raw) else {
+          throw RPCError.invalidParams("text_lang must be language codes such as en or pt-BR")
+        }
+        return code
+      }
+    )
+  }
+
   private func respond(id: Any?, result: Any) {
     guard let id else { return }
     output.sendResponse(id: id, result: result)
@@ -251,18 +388,34 @@ final class RPCServer {
       throw RPCError.invalidParams("missing chat identifier or guid")
     }
 
-    try sendMessage(
-      MessageSendOptions(
-        recipient: recipient,
-        text: text,
-        attachmentPath: file,
-        service: service,
-        region: region,
-        chatIdentifier: resolvedChatIdentifier,
-        chatGUID: resolvedChatGUID
-      )
+    let options = MessageSendOptions(
+      recipient: recipient,
+      text: text,
+      attachmentPath: file,
+      service: service,
+      region: region,
+      chatIdentifier: resolvedChatIdentifier,
+      chatGUID: resolvedChatGUID
     )
-    respond(id: id, result: ["ok": true])
+    let idempotencyKey = stringParam(params["idempotency_key"])
+    guard let journal else {
+      if idempotencyKey != nil {
+        throw RPCError.invalidParams("idempotency_key needs the send journal")
+      }
+      try sendMessage(options)
+      respond(id: id, result: ["ok": true, "status": "sent"])
+      return
+    }
+    let status = try journal.record(
+      idempotencyKey: idempotencyKey,
+      target: SendCommand.journalTarget(for: options),
+      service: service.rawValue,
+      textLength: text.count,
+      attachment: file.isEmpty ? nil : file
+    ) {
+      try sendMessage(options)
+    }
+    respond(id: id, result: ["ok": true, "status": status.rawValue])
   }
 
 }
@@ -271,22 +424,32 @@ private func buildMessagePayload(
   store: MessageStore,
   cache: ChatCache,
   message: Message,
-  includeAttachments: Bool
+  includeAttachments: Bool,
+  includeLanguage: Bool = false,
+  extras: MessageExtras? = nil
 ) throws -> [String: Any] {
   let chatInfo = try cache.info(chatID: message.chatID)
   let participants = try cache.participants(chatID: message.chatID)
-  let attachments = includeAttachments ? try store.attachments(for: message.rowID) : []
-  let reactions = includeAttachments ? try store.reactions(for: message.rowID) : []
+  var attachments: [AttachmentMeta] = []
+  var reactions: [Reaction] = []
+  if let extras {
+    attachments = extras.attachments(for: message.rowID)
+    reactions = extras.reactions(for: message.rowID)
+  } else if includeAttachments {
+    attachments = try store.attachments(for: message.rowID)
+    reactions = try store.reactions(for: message.rowID)
+  }
   return messagePayload(
     message: message,
     chatInfo: chatInfo,
     participants: participants,
     attachments: attachments,
-    reactions: reactions
+    reactions: reactions,
+    includeLanguage: includeLanguage
   )
 }
 
-private final class RPCWriter: RPCOutput, @unchecked Sendable {
+final class RPCWriter: RPCOutput, @unchecked Sendable {
   private let queue = DispatchQueue(label: "imsg.rpc.writer")
 
   func sendResponse(id: Any, result: Any) {
@@ -351,6 +514,11 @@ struct RPCError: Error {
     RPCError(code: -32603, message: "Internal error", data: message)
   }
 
+  /// Server-defined: Messages kept failing and sends are paused; retry after the cooldown.
+  static func sendBackoff(_ message: String) -> RPCError {
+    RPCError(code: -32001, message: "Send backoff", data: message)
+  }
+
   func asDictionary() -> [String: Any] {
     var dict: [String: Any] = [
       "code": code,
@@ -363,8 +531,9 @@ struct RPCError: Error {
   }
 }
 
-private final class ChatCache: @unchecked Sendable {
+final class ChatCache: @unchecked Sendable {
   private let store: MessageStore
+  private let lock = NSLock()
   private var infoCache: [Int64: ChatInfo] = [:]
   private var participantsCache: [Int64: [String]] = [:]
 
@@ -373,18 +542,73 @@ private final class ChatCache: @unchecked Sendable {
   }
 
   func info(chatID: Int64) throws -> ChatInfo? {
-    if let cached = infoCache[chatID] { return cached }
+    if let cached = cachedInfo(chatID: chatID) { return cached }
     if let info = try store.chatInfo(chatID: chatID) {
+      lock.lock()
       infoCache[chatID] = info
+      lock.unlock()
       return info
     }
     return nil
   }
 
   func participants(chatID: Int64) throws -> [String] {
-    if let cached = participantsCache[chatID] { return cached }
+    if let cached = cachedParticipants(chatID: chatID) { return cached }
     let participants = try store.participants(chatID: chatID)
+    lock.lock()
     participantsCache[chatID] = participants
+    lock.unlock()
     return participants
   }
+
+  private func cachedInfo(chatID: Int64) -> ChatInfo? {
+    lock.lock()
+    defer { lock.unlock() }
+    return infoCache[chatID]
+  }
+
+  private func cachedParticipants(chatID: Int64) -> [String]? {
+    lock.lock()
+    defer { lock.unlock() }
+    return participantsCache[chatID]
+  }
+}
+
+/// Startup preload for `imsg rpc`: info and participants of the `chatLimit` most recent chats
+/// go into the chat cache, and each chat's last `messageLimit` messages are read so their pages
+/// and the history query's prepared statements are ready. Chats are loaded concurrently, as
+/// many at a time as the store has connections.
+struct RPCWarmUp: Sendable {
+  let store: MessageStore
+  let cache: ChatCache
+  let chatLimit: Int
+  let messageLimit: Int
+
+  /// The number of chats and messages loaded.
+  func run() throws -> (chats: Int, messages: Int) {
+    guard chatLimit > 0 else { return (0, 0) }
+    let chats = try store.listChats(limit: chatLimit)
+    let lock = NSLock()
+    var messages = 0
+    var failure: Error?
+    DispatchQueue.concurrentPerform(iterations: chats.count) { index in
+      if Task.isCancelled { return }
+      let chatID = chats[index].id
+      do {
+        _ = try cache.info(chatID: chatID)
+        _ = try cache.participants(chatID: chatID)
+        let loaded =
+          messageLimit > 0 ? try store.messages(chatID: chatID, limit: messageLimit).count : 0
+        lock.lock()
+        messages += loaded
+        lock.unlock()
+      } catch {
+        lock.lock()
+        failure = failure ?? error
+        lock.unlock()
+      }
+    }
+    if let failure { throw failure }
+    return (chats.count, messages)
+  }
 }
@@ -0,0 +1,18 @@
+import Commander
+import IMsgCore
+
+/// `--redact` for `history` and `export`: masks message text only (see `MessageRedactor`).
+enum RedactionOptions {
+  static func option() -> OptionDefinition {
+    .make(
+      label: "redact", names: [.long("redact")],
+      help: "mask phone|email|ssn or a custom regex in message text (repeatable)")
+  }
+
+  /// nil when `--redact` wasn't given.
+  static func redactor(from values: ParsedValues) throws -> MessageRedactor? {
+    let specs = values.optionValues("redact").filter { !$0.isEmpty }
+    if specs.isEmpty { return nil }
+    return try MessageRedactor(specs: specs)
+  }
+}
@@ -0,0 +1,171 @@
+import Foundation
+import IMsgCore
+
+struct RuleWebhookPayload: Codable {
+  let rule: String
+  let message: MessagePayload
+}
+
+/// Runs the actions of the rules a watched message matches, in file order. A failing action
+/// is reported on stderr and never stops the watch; actions run one at a time, so slow
+/// `exec` commands should background themselves. Webhooks go through `WebhookQueue`, so one
+/// whose endpoint is down is kept and replayed instead of lost.
+final class MessageRuleEngine {
+  typealias RunProcess = (
+    _ executable: String, _ arguments: [String], _ environment: [String: String]
+  ) throws -> Void
+
+  let ruleSet: MessageRuleSet
+  private let timestamps: TimestampFormatter
+  private let journal: SendJournal
+  private let sendMessage: (MessageSendOptions) throws -> Void
+  private let runProcess: RunProcess
+  private let logger: AutomationLogger
+  let webhooks: WebhookQueue
+
+  init(
+    ruleSet: MessageRuleSet,
+    timestamps: TimestampFormatter,
+    journal: SendJournal = SendJournal(),
+    sendMessage: @escaping (MessageSendOptions) throws -> Void = { try MessageSender().send($0) },
+    runProcess: @escaping RunProcess = MessageRuleEngine.launch,
+    webhooks: WebhookQueue = WebhookQueue(),
+    logger: AutomationLogger = .disabled
+  ) {
+    self.ruleSet = ruleSet
+    self.timestamps = timestamps
+    self.journal = journal
+    self.sendMessage = sendMessage
+    self.runProcess = runProcess
+    self.webhooks = webhooks
+    self.logger = logger
+  }
+
+  /// Whether any rule has a webhook action, and so whether watch should retry the queue.
+  var hasWebhooks: Bool {
+    ruleSet.rules.contains { rule in
+      rule.actions.contains {
+        if case .webhook = $0 { return true }
+        return false
+      }
+    }
+  }
+
+  /// Returns the names of the rules that matched.
+  @discardableResult
+  func handle(_ message: Message, store: MessageStore) async -> [String] {
+    var attachments: [AttachmentMeta]?
+    func loadAttachments() throws -> [AttachmentMeta] {
+      if let attachments { return attachments }
+      let loaded = try store.attachments(for: message.rowID)
+      attachments = loaded
+      return loaded
+    }
+    var matched: [String] = []
+    for rule in ruleSet.rules {
+      do {
+        guard try rule.matches(message, attachments: loadAttachments) else { continue }
+      } catch {
+        report(rule, error)
+        continue
+      }
+      matched.append(rule.name)
+      for action in rule.actions {
+        do {
+          try await run(action, rule: rule, message: message, store: store)
+        } catch {
+          report(rule, error)
+        }
+      }
+      if rule.stop { break }
+    }
+    return matched
+  }
+
+  private func run(
+    _ action: MessageRule.Action, rule: MessageRule, message: Message, store: MessageStore
+  ) async throws {
+    let renderer = { (template: OutputTemplate) in
+      try MessageTemplateRenderer(template: template, timestamps: self.timestamps)
+        .render(message, store: store)
+    }
+    switch action {
+    case .exec(let command):
+      var environment = ProcessInfo.processInfo.environment.merging(
+        WatchExecHook.environment(for: message)
+      ) { _, new in new }
+      environment["IMSG_RULE"] = rule.name
+      try runProcess("/bin/sh", ["-c", command], environment)
+    case .webhook(let url):
+      let payload = RuleWebhookPayload(
+        rule: rule.name,
+        message: MessagePayload(
+          message: message,
+          attachments: try store.attachments(for: message.rowID),
+          reactions: try store.reactions(for: message.rowID)))
+      let outcome = try await webhooks.deliver(
+        url: url, body: try JSONEncoder().encode(payload), rule: rule.name,
+        messageID: message.rowID)
+      switch outcome {
+      case .delivered:
+        break
+      case .queued(let pending, let error):
+        // Nothing to say when another flush of the same URL simply has it next.
+        guard let error else { break }
+        throw MessageRuleError.actionFailed(
+          "webhook \(url.absoluteString) failed (\(error)); queued, \(pending) waiting")
+      case .rejected(let statusCode):
+        throw MessageRuleError.actionFailed(
+          "webhook \(url.absoluteString) returned \(statusCode); not retrying")
+      }
+    case .notify(let template):
+      let script = [
+        "on run argv", "display notification (item 1 of argv) with title (item 2 of argv)",
+        "end run",
+      ]
+      let arguments = script.flatMap { ["-e", $0] } + [try renderer(template), "imsg: \(rule.name)"]
+      // Through the gate, so a burst of matches doesn't interleave with sends.
+      try AppleScriptGate.shared.run {
+        try runProcess("/usr/bin/osascript", arguments, ProcessInfo.processInfo.environment)
+      }
+    case .reply(let template):
+      guard !message.isFromMe, let chat = try store.chatInfo(chatID: message.chatID) else {
+        return
+      }
+      let text = try renderer(template)
+      guard !text.isEmpty else { return }
+      let options = MessageSendOptions(
+        recipient: "", text: text, chatIdentifier: chat.identifier, chatGUID: chat.guid)
+      // Keyed by message, so a replayed --resume watch doesn't answer twice.
+      let messageKey = message.guid.isEmpty ? String(message.rowID) : message.guid
+      try journal.record(
+        idempotencyKey: "rule:\(rule.name):\(messageKey)",
+        target: SendCommand.journalTarget(for: options),
+        service: MessageService.auto.rawValue,
+        textLength: text.count,
+        attachment: nil
+      ) {
+        try sendMessage(options)
+      }
+    }
+  }
+
+  private func report(_ rule: MessageRule, _ error: Error) {
+    logger.log(error, "rule \(rule.name) failed", fields: ["command": "watch", "rule": rule.name])
+  }
+
+  static func launch(executable: String, arguments: [String], environment: [String: String])
+    throws
+  {
+    let process = Process()
+    process.executableURL = URL(fileURLWithPath: executable)
+    process.arguments = arguments
+    process.environment = environment
+    try process.run()
+    process.waitUntilExit()
+    if process.terminationStatus != 0 {
+      throw MessageRuleError.actionFailed(
+        "\(executable) exited with status \(process.terminationStatus)")
+    }
+  }
+}
@@ -0,0 +1,238 @@
+import Foundation
+import IMsgCore
+import Yams
+
+/// A rules file for `imsg watch --rules`: each rule matches incoming messages on chat, sender,
+/// text, attachment type, direction and time of day, and lists actions to run.
+///
+///     rules:
+///       - name: codes
+///         match: {sender: "+14155551212", text: "code is [0-9]+"}
+///         actions:
+///           - notify: "{{.Sender}}: {{.Text}}"
+///       - name: away
+///         match: {chat_id: [1, 7], between: "22:00-07:00"}
+///         actions:
+///           - reply: "Asleep, will answer in the morning."
+///         stop: true
+struct MessageRuleSet {
+  let rules: [MessageRule]
+
+  static func load(path: String) throws -> MessageRuleSet {
+    let expanded = NSString(string: path).expandingTildeInPath
+    let source = try String(contentsOfFile: expanded, encoding: .utf8)
+    return try parse(source, origin: path)
+  }
+
+  static func parse(_ source: String, origin: String = "rules") throws -> MessageRuleSet {
+    let file: RulesFile
+    do {
+      file = try YAMLDecoder().decode(RulesFile.self, from: source)
+    } catch {
+      throw MessageRuleError.invalid("\(origin): \(error)")
+    }
+    return MessageRuleSet(
+      rules: try file.rules.enumerated().map { try MessageRule(spec: $1, index: $0) })
+  }
+}
+
+enum MessageRuleError: Error, CustomStringConvertible {
+  case invalid(String)
+  case actionFailed(String)
+
+  var description: String {
+    switch self {
+    case .invalid(let detail):
+      return "Invalid rules file: \(detail)"
+    case .actionFailed(let detail):
+      return "Rule action failed: \(detail)"
+    }
+  }
+}
+
+struct MessageRule {
+  enum AttachmentKind: String {
+    case any
+    case image
+    case video
+    case audio
+    case file
+  }
+
+  enum Action {
+    /// Run with `/bin/sh -c`; the message is passed in `IMSG_*` environment variables, never
+    /// spliced into the command line.
+    case exec(String)
+    /// POST the message as JSON.
+    case webhook(URL)
+    /// Show a macOS notification with this text.
+    case notify(OutputTemplate)
+    /// Answer in the same chat. Never fires for your own messages, so rules can't loop.
+    case reply(OutputTemplate)
+  }
+
+  let name: String
+  let chatIDs: Set<Int64>
+  /// Sender, text and language conditions.
+  let filter: MessageFilter
+  let attachment: AttachmentKind?
+  let fromMe: Bool?
+  /// Local time window such as `09:00-18:00` the message was sent in; may wrap past midnight.
+  /// Judged by the message's date, so a `--resume` replay or a late poll sees the same window.
+  let window: QuietHours?
+  let actions: [Action]
+  /// Skip the rules after this one when it matches.
+  let stop: Bool
+
+  fileprivate init(spec: RuleSpec, index: Int) throws {
+    let name = spec.name ?? "rule \(index + 1)"
+    func invalid(_ detail: String) -> MessageRuleError {
+      .invalid("\(name): \(detail)")
+    }
+    let match = spec.match ?? MatchSpec()
+    self.name = name
+    self.chatIDs = Set(match.chatID?.values ?? [])
+    do {
+      self.filter = MessageFilter(
+        participants: match.sender?.values ?? [],
+        textMatcher: try match.text.map { try MessageTextMatcher(pattern: $0) },
+        languages: try (match.lang?.values ?? []).map { raw in
+          guard let code = MessageLanguage.normalizedCode(raw) else {
+            throw invalid("lang must be language codes such as en or pt-BR")
+          }
+          return code
+        })
+    } catch let error as MessageRuleError {
+      throw error
+    } catch {
+      throw invalid("\(error)")
+    }
+    if let raw = match.attachment {
+      guard let kind = AttachmentKind(rawValue: raw.lowercased()) else {
+        throw invalid("attachment must be any|image|video|audio|file")
+      }
+      self.attachment = kind
+    } else {
+      self.attachment = nil
+    }
+    self.fromMe = match.fromMe
+    if let raw = match.between {
+      guard let window = QuietHours(raw) else {
+        throw invalid("between must look like 09:00-18:00")
+      }
+      self.window = window
+    } else {
+      self.window = nil
+    }
+    guard !spec.actions.isEmpty else {
+      throw invalid("no actions")
+    }
+    self.actions = try spec.actions.map { action in
+      let given = [action.exec, action.webhook, action.notify, action.reply].compactMap { $0 }
+      guard given.count == 1 else {
+        throw invalid("each action needs exactly one of exec, webhook, notify, reply")
+      }
+      do {
+        if let command = action.exec {
+          return .exec(command)
+        }
+        if let notify = action.notify {
+          return .notify(try OutputTemplate(notify, fields: OutputTemplate.messageFields))
+        }
+        if let reply = action.reply {
+          return .reply(try OutputTemplate(reply, fields: OutputTemplate.messageFields))
+        }
+      } catch {
+        throw invalid("unknown template field in \(given[0])")
+      }
+      guard let url = URL(string: given[0]), url.scheme?.hasPrefix("http") == true else {
+        throw invalid("webhook must be an http(s) URL")
+      }
+      return .webhook(url)
+    }
+    self.stop = spec.stop ?? false
+  }
+
+  /// `attachments` is only called when the rule filters on attachment type.
+  func matches(
+    _ message: Message,
+    attachments: () throws -> [AttachmentMeta],
+    calendar: Calendar = .current
+  ) rethrows -> Bool {
+    if !chatIDs.isEmpty && !chatIDs.contains(message.chatID) { return false }
+    if let fromMe, message.isFromMe != fromMe { return false }
+    if let window, window.end(containing: message.date, calendar: calendar) == nil { return false }
+    if !filter.allows(message) { return false }
+    if let attachment {
+      guard message.attachmentsCount > 0 else { return false }
+      if attachment != .any {
+        let kinds = try attachments().map { AttachmentMediaKind.of($0) }
+        if !kinds.contains(where: { $0.ruleKind == attachment }) { return false }
+      }
+    }
+    return true
+  }
+}
+
+extension AttachmentMediaKind {
+  fileprivate var ruleKind: MessageRule.AttachmentKind {
+    switch self {
+    case .image: return .image
+    case .video: return .video
+    case .audio: return .audio
+    case .file: return .file
+    }
+  }
+}
+
+private struct RulesFile: Decodable {
+  let rules: [RuleSpec]
+}
+
+private struct RuleSpec: Decodable {
+  let name: String?
+  let match: MatchSpec?
+  let actions: [ActionSpec]
+  let stop: Bool?
+}
+
+private struct MatchSpec: Decodable {
+  var chatID: OneOrMany<Int64>?
+  var sender: OneOrMany<String>?
+  var text: String?
+  var lang: OneOrMany<String>?
+  var attachment: String?
+  var fromMe: Bool?
+  var between: String?
+
+  enum CodingKeys: String, CodingKey {
+    case chatID = "chat_id"
+    case sender
+    case text
+    case lang
+    case attachment
+    case fromMe = "from_me"
+    case between
+  }
+}
+
+private struct ActionSpec: Decodable {
+  let exec: String?
+  let webhook: String?
+  let notify: String?
+  let reply: String?
+}
+
+/// `chat_id: 1` or `chat_id: [1, 2]`.
+private struct OneOrMany<Value: Decodable>: Decodable {
+  let values: [Value]
+
+  init(from decoder: Decoder) throws {
+    let container = try decoder.singleValueContainer()
+    if let many = try? container.decode([Value].self) {
+      self.values = many
+    } else {
+      self.values = [try container.decode(Value.self)]
+    }
+  }
+}
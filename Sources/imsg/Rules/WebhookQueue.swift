@@ -0,0 +1,384 @@
+import CryptoKit
+import Darwin
+import Foundation
+import IMsgCore
+
+/// A rule or `otp-forward` webhook waiting in `webhook-queue/` for its endpoint to answer.
+struct WebhookEvent: Codable, Equatable {
+  /// Sent as `X-Imsg-Event-Id`, so a receiver can drop the duplicates at-least-once allows.
+  let id: String
+  let url: URL
+  let rule: String?
+  let messageID: Int64?
+  /// The JSON that is POSTed, kept as text so the event file stays readable.
+  let body: String
+  let queuedAt: Date
+  var attempts: Int
+  var lastError: String?
+  /// Nil until the first failure; retries back off from 5s to 5m.
+  var nextAttemptAt: Date?
+
+  enum CodingKeys: String, CodingKey {
+    case id
+    case url
+    case rule
+    case messageID = "message_id"
+    case body
+    case queuedAt = "queued_at"
+    case attempts
+    case lastError = "last_error"
+    case nextAttemptAt = "next_attempt_at"
+  }
+}
+
+/// What became of one webhook event, appended to `webhook-receipts.jsonl` (rotated to
+/// `webhook-receipts.jsonl.1` past `WebhookQueue.receiptsMaxBytes`).
+struct WebhookReceipt: Codable, Equatable {
+  enum Status: String, Codable {
+    case delivered
+    /// The endpoint answered with a 4xx that retrying won't fix.
+    case rejected
+    /// Pushed out of a full queue before it could be delivered.
+    case dropped
+  }
+
+  let id: String
+  let url: URL
+  let rule: String?
+  let messageID: Int64?
+  let status: Status
+  let at: Date
+  let queuedAt: Date
+  let attempts: Int
+  let statusCode: Int?
+  let error: String?
+
+  init(event: WebhookEvent, status: Status, at: Date, statusCode: Int?, error: String? = nil) {
+    self.id = event.id
+    self.url = event.url
+    self.rule = event.rule
+    self.messageID = event.messageID
+    self.status = status
+    self.at = at
+    self.queuedAt = event.queuedAt
+    self.attempts = event.attempts
+    self.statusCode = statusCode
+    self.error = error
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case id
+    case url
+    case rule
+    case messageID = "message_id"
+    case status
+    case at
+    case queuedAt = "queued_at"
+    case attempts
+    case statusCode = "status_code"
+    case error
+  }
+}
+
+/// Delivers rule and `otp-forward` webhooks at least once. Every event is written to its own
+/// file in `webhook-queue/` in the state directory before it is POSTed and removed only once
+/// the endpoint answers 2xx, so an endpoint that is down (or an imsg that crashes mid-request)
+/// leaves it queued for the next attempt. One file per event keeps each change to a single
+/// small write, however long the queue. Events to one URL go out in the order they were
+/// queued; a failing one holds back the ones behind it, and only one process flushes a URL at
+/// a time. The queue keeps at most `capacity` events, dropping the oldest.
+final class WebhookQueue: @unchecked Sendable {
+  typealias Transport = (URLRequest) async throws -> (Data, URLResponse)
+
+  static let defaultReceiptsMaxBytes: Int64 = 1_000_000
+
+  enum Outcome: Equatable {
+    case delivered
+    /// Left in the queue behind an unreachable endpoint, with this many events for its URL.
+    case queued(pending: Int, error: String?)
+    case rejected(statusCode: Int)
+  }
+
+  /// Holds the events, named `<sequence>-<id>.json` so they sort in queue order, and one
+  /// `<url hash>.claim` file (the flushing process's pid) per URL being flushed.
+  let directoryURL: URL
+  let receiptsURL: URL
+  let capacity: Int
+  let receiptsMaxBytes: Int64
+  private let transport: Transport
+  private let now: () -> Date
+  private let lock = NSLock()
+  /// URLs a flush in this process is working through, so two never send the same event.
+  private var flushing = Set<URL>()
+
+  init(
+    directoryURL: URL = StateDirectory.fileURL("webhook-queue"),
+    receiptsURL: URL = StateDirectory.fileURL("webhook-receipts.jsonl"),
+    capacity: Int = 1000,
+    receiptsMaxBytes: Int64 = WebhookQueue.defaultReceiptsMaxBytes,
+    transport: @escaping Transport = { try await URLSession.shared.data(for: $0) },
+    now: @escaping () -> Date = Date.init
+  ) {
+    self.directoryURL = directoryURL
+    self.receiptsURL = receiptsURL
+    self.capacity = max(1, capacity)
+    self.receiptsMaxBytes = receiptsMaxBytes
+    self.transport = transport
+    self.now = now
+  }
+
+  var rotatedReceiptsURL: URL {
+    URL(fileURLWithPath: receiptsURL.path + ".1")
+  }
+
+  /// Queued events, oldest first.
+  func pending() throws -> [WebhookEvent] {
+    try withLock { try eventFiles().compactMap(load) }
+  }
+
+  /// Receipts from the rotated file and then the current one, oldest first.
+  func receipts() throws -> [WebhookReceipt] {
+    let decoder = JSONDecoder()
+    decoder.dateDecodingStrategy = .iso8601
+    var receipts: [WebhookReceipt] = []
+    for url in [rotatedReceiptsURL, receiptsURL]
+    where FileManager.default.fileExists(atPath: url.path) {
+      let contents = try String(contentsOf: url, encoding: .utf8)
+      receipts += contents.split(separator: "\n").compactMap {
+        try? decoder.decode(WebhookReceipt.self, from: Data($0.utf8))
+      }
+    }
+    return receipts
+  }
+
+  /// Queues `body` for `url`, then sends it along with anything queued ahead of it.
+  func deliver(url: URL, body: Data, rule: String?, messageID: Int64?) async throws -> Outcome {
+    let event = WebhookEvent(
+      id: UUID().uuidString.lowercased(), url: url, rule: rule, messageID: messageID,
+      body: String(decoding: body, as: UTF8.self), queuedAt: now(), attempts: 0)
+    try withLock {
+      var files = try eventFiles()
+      while files.count >= capacity {
+        let oldest = files.removeFirst()
+        if let dropped = load(oldest) {
+          try appendReceipt(
+            WebhookReceipt(event: dropped, status: .dropped, at: now(), statusCode: nil))
+        }
+        try FileManager.default.removeItem(at: oldest)
+      }
+      try write(event, to: eventFileURL(sequence: nextSequence(after: files), id: event.id))
+    }
+    let finished = try await flush(url: url, force: false)
+    if let receipt = finished.first(where: { $0.id == event.id }) {
+      return receipt.status == .rejected
+        ? .rejected(statusCode: receipt.statusCode ?? 0) : .delivered
+    }
+    let waiting = try pending().filter { $0.url == url }
+    return .queued(
+      pending: waiting.count, error: waiting.first(where: { $0.lastError != nil })?.lastError)
+  }
+
+  /// Tries every URL with queued events, in queue order. Without `force`, URLs still backing
+  /// off from a failure are left for later. Returns how many events went out (delivered or
+  /// rejected).
+  @discardableResult
+  func flush(force: Bool = false) async throws -> Int {
+    var urls: [URL] = []
+    for event in try pending() where !urls.contains(event.url) {
+      urls.append(event.url)
+    }
+    var sent = 0
+    for url in urls {
+      sent += try await flush(url: url, force: force).count
+    }
+    return sent
+  }
+
+  /// Sends `url`'s events until one fails or is still backing off; returns their receipts.
+  private func flush(url: URL, force: Bool) async throws -> [WebhookReceipt] {
+    guard try claim(url) else { return [] }
+    defer { release(url) }
+    var finished: [WebhookReceipt] = []
+    while let event = try pending().first(where: { $0.url == url }) {
+      if !force, let next = event.nextAttemptAt, next > now() { break }
+      var request = URLRequest(url: url)
+      request.httpMethod = "POST"
+      request.setValue("application/json", forHTTPHeaderField: "Content-Type")
+      request.setValue(event.id, forHTTPHeaderField: "X-Imsg-Event-Id")
+      request.httpBody = Data(event.body.utf8)
+      var statusCode: Int?
+      var failure: String?
+      do {
+        let (_, response) = try await transport(request)
+        statusCode = (response as? HTTPURLResponse)?.statusCode
+        if let statusCode, !(200..<300).contains(statusCode) {
+          failure = "returned \(statusCode)"
+        }
+      } catch {
+        failure = error.localizedDescription
+      }
+      let attempted = now()
+      // A 4xx (other than timeouts and rate limits) will fail the same way every time.
+      let permanent = statusCode.map { (400..<500).contains($0) && $0 != 408 && $0 != 429 }
+      var done = event
+      done.attempts += 1
+      if failure != nil, permanent != true {
+        done.lastError = failure
+        done.nextAttemptAt = attempted.addingTimeInterval(
+          WebhookQueue.retryDelay(afterAttempts: done.attempts))
+        try withLock {
+          // Gone when it was pushed out of a full queue meanwhile.
+          guard let file = try eventFile(id: event.id) else { return }
+          try write(done, to: file)
+        }
+        break
+      }
+      let receipt = WebhookReceipt(
+        event: done, status: failure == nil ? .delivered : .rejected, at: attempted,
+        statusCode: statusCode, error: failure)
+      try withLock {
+        if let file = try eventFile(id: event.id) {
+          try FileManager.default.removeItem(at: file)
+        }
+        try appendReceipt(receipt)
+      }
+      finished.append(receipt)
+    }
+    return finished
+  }
+
+  /// 5s after the first failure, doubling up to 5 minutes.
+  static func retryDelay(afterAttempts attempts: Int) -> TimeInterval {
+    min(300, 5 * pow(2, Double(max(0, attempts - 1))))
+  }
+
+  /// Takes `url` for this flush unless another flush has it, here or in a live imsg process
+  /// (a `watch` and `imsg webhook-queue --drain` would otherwise both send its next event).
+  /// A claim left by a process that died is taken over.
+  private func claim(_ url: URL) throws -> Bool {
+    try withLock {
+      guard !flushing.contains(url) else { return false }
+      let claimURL = self.claimURL(for: url)
+      if let owner = try? String(contentsOf: claimURL, encoding: .utf8),
+        let pid = pid_t(owner.trimmingCharacters(in: .whitespacesAndNewlines)),
+        pid != getpid(), kill(pid, 0) == 0 || errno == EPERM
+      {
+        return false
+      }
+      try String(getpid()).write(to: claimURL, atomically: true, encoding: .utf8)
+      flushing.insert(url)
+      return true
+    }
+  }
+
+  private func release(_ url: URL) {
+    try? withLock {
+      flushing.remove(url)
+      try? FileManager.default.removeItem(at: claimURL(for: url))
+    }
+  }
+
+  func claimURL(for url: URL) -> URL {
+    let digest = SHA256.hash(data: Data(url.absoluteString.utf8))
+    let name = digest.prefix(16).map { String(format: "%02x", $0) }.joined()
+    return directoryURL.appendingPathComponent("\(name).claim")
+  }
+
+  /// Event files in queue order. Call with the lock held.
+  private func eventFiles() throws -> [URL] {
+    try FileManager.default.contentsOfDirectory(
+      at: directoryURL, includingPropertiesForKeys: nil
+    )
+    .filter { $0.pathExtension == "json" }
+    .sorted { $0.lastPathComponent < $1.lastPathComponent }
+  }
+
+  /// `<sequence>-<id>.json`, the sequence zero-padded so names sort numerically.
+  private func eventFileURL(sequence: Int, id: String) -> URL {
+    let digits = String(sequence)
+    let padded = String(repeating: "0", count: max(0, 12 - digits.count)) + digits
+    return directoryURL.appendingPathComponent("\(padded)-\(id).json")
+  }
+
+  private func nextSequence(after files: [URL]) -> Int {
+    (files.last.flatMap { Int($0.lastPathComponent.prefix { $0 != "-" }) } ?? 0) + 1
+  }
+
+  private func eventFile(id: String) throws -> URL? {
+    try eventFiles().first { $0.lastPathComponent.hasSuffix("-\(id).json") }
+  }
+
+  private func load(_ file: URL) -> WebhookEvent? {
+    let decoder = JSONDecoder()
+    decoder.dateDecodingStrategy = .iso8601
+    guard let data = try? Data(contentsOf: file) else { return nil }
+    return try? decoder.decode(WebhookEvent.self, from: data)
+  }
+
+  private func write(_ event: WebhookEvent, to file: URL) throws {
+    let encoder = JSONEncoder()
+    encoder.outputFormatting = [.prettyPrinted, .sortedKeys]
+    encoder.dateEncodingStrategy = .iso8601
+    try encoder.encode(event).write(to: file, options: .atomic)
+  }
+
+  /// Appends to the receipts file, rotating it first when it would pass `receiptsMaxBytes`.
+  private func appendReceipt(_ receipt: WebhookReceipt) throws {
+    let fileManager = FileManager.default
+    try fileManager.createDirectory(
+      at: receiptsURL.deletingLastPathComponent(), withIntermediateDirectories: true)
+    let encoder = JSONEncoder()
+    encoder.dateEncodingStrategy = .iso8601
+    encoder.outputFormatting = [.sortedKeys]
+    var line = try encoder.encode(receipt)
+    line.append(contentsOf: Data("\n".utf8))
+    let size = (try? fileManager.attributesOfItem(atPath: receiptsURL.path)[.size] as? NSNumber)?
+      .int64Value ?? 0
+    if size > 0 && size + Int64(line.count) > receiptsMaxBytes {
+      try? fileManager.removeItem(at: rotatedReceiptsURL)
+      try fileManager.moveItem(at: receiptsURL, to: rotatedReceiptsURL)
+    }
+    if !fileManager.fileExists(atPath: receiptsURL.path) {
+      fileManager.createFile(atPath: receiptsURL.path, contents: nil)
+    }
+    let handle = try FileHandle(forWritingTo: receiptsURL)
+    defer { try? handle.close() }
+    try handle.seekToEnd()
+    try handle.write(contentsOf: line)
+  }
+
+  /// Runs `body` holding both this process's lock and `webhook-queue.lock`, so a watch and
+  /// `imsg webhook-queue --drain` see each other's changes and claims. Moves the events of a
+  /// `webhook-queue.json` left by an older imsg into the directory first.
+  private func withLock<T>(_ body: () throws -> T) throws -> T {
+    try FileManager.default.createDirectory(at: directoryURL, withIntermediateDirectories: true)
+    lock.lock()
+    defer { lock.unlock() }
+    let lockPath = directoryURL.path + ".lock"
+    let fd = open(lockPath, O_CREAT | O_RDWR, 0o644)
+    guard fd >= 0 else {
+      throw CocoaError(.fileWriteUnknown, userInfo: [NSFilePathErrorKey: lockPath])
+    }
+    defer { close(fd) }
+    flock(fd, LOCK_EX)
+    defer { flock(fd, LOCK_UN) }
+    try migrateLegacyQueue()
+    return try body()
+  }
+
+  private func migrateLegacyQueue() throws {
+    struct Snapshot: Decodable {
+      var events: [WebhookEvent] = []
+    }
+    let legacyURL = directoryURL.appendingPathExtension("json")
+    guard FileManager.default.fileExists(atPath: legacyURL.path) else { return }
+    let decoder = JSONDecoder()
+    decoder.dateDecodingStrategy = .iso8601
+    let snapshot = try decoder.decode(Snapshot.self, from: Data(contentsOf: legacyURL))
+    let first = nextSequence(after: try eventFiles())
+    for (offset, event) in snapshot.events.enumerated() {
+      try write(event, to: eventFileURL(sequence: first + offset, id: event.id))
+    }
+    try FileManager.default.removeItem(at: legacyURL)
+  }
+}
@@ -1,13 +1,41 @@
 import Commander
+import IMsgCore
 
 struct RuntimeOptions: Sendable {
   let jsonOutput: Bool
   let verbose: Bool
   let logLevel: String?
+  let logJSON: Bool
+  let logFile: String?
+  let automationLogger: AutomationLogger
 
   init(parsedValues: ParsedValues) {
     self.jsonOutput = parsedValues.flags.contains("jsonOutput")
     self.verbose = parsedValues.flags.contains("verbose")
     self.logLevel = parsedValues.options["logLevel"]?.last
+    self.logJSON = parsedValues.flags.contains("logJSON")
+    self.logFile = parsedValues.options["logFile"]?.last.flatMap { $0.isEmpty ? nil : $0 }
+    let level = RuntimeOptions.logLevel(logLevel, verbose: verbose)
+    let format: AutomationLogger.Format = logJSON ? .json : .text
+    if let logFile {
+      let file = LogFile(path: logFile)
+      self.automationLogger = AutomationLogger(
+        level: level, format: format, sink: { file.write($0) })
+    } else {
+      self.automationLogger = AutomationLogger(level: level, format: format)
+    }
+  }
+
+  /// `--log-level` wins; `--verbose` alone means debug (redacted script arguments + output).
+  /// Without either only errors are logged.
+  var automationLogLevel: AutomationLogLevel {
+    automationLogger.level
+  }
+
+  private static func logLevel(_ name: String?, verbose: Bool) -> AutomationLogLevel {
+    if let name, let level = AutomationLogLevel(name: name) {
+      return level
+    }
+    return verbose ? .debug : .error
   }
 }
@@ -0,0 +1,330 @@
+import CryptoKit
+import Darwin
+import Foundation
+import IMsgCore
+
+/// Which GitHub releases `imsg selfupdate` considers: `stable` only full releases, `edge` also
+/// prereleases (`v0.5.0-beta.1`).
+enum ReleaseChannel: String, CaseIterable {
+  case stable
+  case edge
+}
+
+/// A release tag such as `v0.4.1` or `v0.5.0-beta.2`, ordered like SemVer: a prerelease sorts
+/// before the release it leads up to.
+struct ReleaseVersion: Comparable, CustomStringConvertible {
+  let numbers: [Int]
+  let prerelease: [String]
+
+  init?(_ tag: String) {
+    var text = Substring(tag.trimmingCharacters(in: .whitespaces))
+    if text.hasPrefix("v") { text = text.dropFirst() }
+    let core = text.prefix { $0 != "-" && $0 != "+" }
+    let numbers = core.split(separator: ".", omittingEmptySubsequences: false).map { Int($0) }
+    guard (1...3).contains(numbers.count), !numbers.contains(nil) else { return nil }
+    self.numbers = numbers.compactMap { $0 } + Array(repeating: 0, count: 3 - numbers.count)
+    var rest = text.dropFirst(core.count)
+    if let build = rest.firstIndex(of: "+") { rest = rest[..<build] }
+    self.prerelease =
+      rest.hasPrefix("-") ? rest.dropFirst().split(separator: ".").map(String.init) : []
+  }
+
+  var isPrerelease: Bool { !prerelease.isEmpty }
+
+  var description: String {
+    numbers.map(String.init).joined(separator: ".")
+      + (prerelease.isEmpty ? "" : "-" + prerelease.joined(separator: "."))
+  }
+
+  static func < (lhs: ReleaseVersion, rhs: ReleaseVersion) -> Bool {
+    if lhs.numbers != rhs.numbers {
+      return lhs.numbers.lexicographicallyPrecedes(rhs.numbers)
+    }
+    switch (lhs.prerelease.isEmpty, rhs.prerelease.isEmpty) {
+    case (true, _): return false
+    case (false, true): return true
+    case (false, false): break
+    }
+    for (left, right) in zip(lhs.prerelease, rhs.prerelease) where left != right {
+      switch (Int(left), Int(right)) {
+      case (let left?, let right?): return left < right
+      case (.some, nil): return true
+      case (nil, .some): return false
+      case (nil, nil): return left < right
+      }
+    }
+    return lhs.prerelease.count < rhs.prerelease.count
+  }
+}
+
+/// The parts of a GitHub release (`GET /repos/{owner}/{repo}/releases`) the updater reads.
+struct GitHubRelease: Decodable, Equatable {
+  struct Asset: Decodable, Equatable {
+    let name: String
+    let downloadURL: URL
+
+    enum CodingKeys: String, CodingKey {
+      case name
+      case downloadURL = "browser_download_url"
+    }
+  }
+
+  let tagName: String
+  let htmlURL: URL?
+  let draft: Bool
+  let prerelease: Bool
+  let assets: [Asset]
+
+  var version: ReleaseVersion? { ReleaseVersion(tagName) }
+
+  func asset(named name: String) -> Asset? {
+    assets.first { $0.name == name }
+  }
+
+  enum CodingKeys: String, CodingKey {
+    case tagName = "tag_name"
+    case htmlURL = "html_url"
+    case draft
+    case prerelease
+    case assets
+  }
+}
+
+enum SelfUpdateError: Error, CustomStringConvertible {
+  case homebrew(path: String)
+  case requestFailed(url: URL, status: Int)
+  case noRelease(channel: ReleaseChannel)
+  case missingAsset(tag: String, name: String)
+  case checksumMismatch(expected: String, actual: String)
+  case signatureInvalid(output: String)
+  case unpackFailed(output: String)
+  case notWritable(path: String)
+
+  var description: String {
+    switch self {
+    case .homebrew(let path):
+      return "selfupdate: \(path) is managed by Homebrew; run `brew upgrade imsg` instead"
+    case .requestFailed(let url, let status):
+      return "selfupdate: \(url.absoluteString) returned \(status)"
+    case .noRelease(let channel):
+      return "selfupdate: no \(channel.rawValue) release with \(SelfUpdater.assetName) found"
+    case .missingAsset(let tag, let name):
+      return "selfupdate: release \(tag) has no \(name); not installing an unverified build"
+    case .checksumMismatch(let expected, let actual):
+      return "selfupdate: checksum mismatch (expected \(expected), got \(actual))"
+    case .signatureInvalid(let output):
+      let detail = output.trimmingCharacters(in: .whitespacesAndNewlines)
+      return "selfupdate: downloaded imsg is not signed by the imsg developer"
+        + (detail.isEmpty ? "" : ": \(detail)")
+    case .unpackFailed(let output):
+      let detail = output.trimmingCharacters(in: .whitespacesAndNewlines)
+      return "selfupdate: could not unpack the release" + (detail.isEmpty ? "" : ": \(detail)")
+    case .notWritable(let path):
+      return "selfupdate: can't write to \(path); rerun with permission to replace it"
+    }
+  }
+}
+
+/// Finds the newest imsg release on GitHub and swaps it in for the running binary. A download
+/// is only installed when it matches the SHA-256 published next to it (`imsg-macos.zip.sha256`)
+/// and `codesign` confirms the binary is signed with the imsg Developer ID, the identity
+/// `scripts/sign-and-notarize.sh` signs and notarizes with. The binary is staged beside the old
+/// one and renamed over it, so an interrupted update never leaves a half-written imsg.
+struct SelfUpdater {
+  typealias Transport = (URLRequest) async throws -> (Data, URLResponse)
+  /// Runs the executable at the path with the given arguments; returns exit status and output.
+  typealias Tool = (String, [String]) throws -> (status: Int32, output: String)
+
+  static let repository = "steipete/imsg"
+  static let assetName = "imsg-macos.zip"
+  static let checksumName = assetName + ".sha256"
+  static let teamIdentifier = "Y5PE65HELJ"
+  static let signingRequirement =
+    "=anchor apple generic and certificate leaf[subject.OU] = \"\(teamIdentifier)\""
+
+  let executableURL: URL
+  private let transport: Transport
+  private let tool: Tool
+
+  init(
+    executableURL: URL,
+    transport: @escaping Transport = { try await URLSession.shared.data(for: $0) },
+    tool: @escaping Tool = SelfUpdater.runTool
+  ) {
+    self.executableURL = executableURL
+    self.transport = transport
+    self.tool = tool
+  }
+
+  /// Whether `url` lives in a Homebrew Cellar (or Caskroom), where `brew` owns the binary.
+  static func isHomebrewManaged(_ url: URL) -> Bool {
+    let path = url.resolvingSymlinksInPath().path
+    return path.contains("/Cellar/") || path.contains("/Caskroom/")
+  }
+
+  /// The newest release on `channel` that ships the macOS zip and its checksum, or nil when
+  /// there is none. Releases rebuilt by CI carry no checksum (their zip is only ad-hoc signed),
+  /// so they are skipped.
+  func latestRelease(channel: ReleaseChannel) async throws -> GitHubRelease? {
+    var components = URLComponents()
+    components.scheme = "https"
+    components.host = "api.github.com"
+    components.path = "/repos/\(SelfUpdater.repository)/releases"
+    components.queryItems = [URLQueryItem(name: "per_page", value: "30")]
+    guard let url = components.url else { throw URLError(.badURL) }
+    let data = try await fetch(url, accept: "application/vnd.github+json")
+    let releases = try JSONDecoder().decode([GitHubRelease].self, from: data)
+    let candidates = releases.compactMap { release -> (GitHubRelease, ReleaseVersion)? in
+      guard !release.draft, let version = release.version,
+        release.asset(named: SelfUpdater.assetName) != nil,
+        release.asset(named: SelfUpdater.checksumName) != nil,
+        channel == .edge || !(release.prerelease || version.isPrerelease)
+      else {
+        return nil
+      }
+      return (release, version)
+    }
+    return candidates.max { $0.1 < $1.1 }?.0
+  }
+
+  /// Downloads, verifies and installs `release` over `executableURL`, along with the resource
+  /// bundles (PhoneNumberKit's metadata) and `imsg-send-helper` that ship in the zip.
+  /// Everything is copied next to the old files before any is replaced, and the old companions
+  /// are put back if the binary can't be.
+  func install(_ release: GitHubRelease) async throws {
+    guard let archive = release.asset(named: SelfUpdater.assetName) else {
+      throw SelfUpdateError.missingAsset(tag: release.tagName, name: SelfUpdater.assetName)
+    }
+    guard let checksum = release.asset(named: SelfUpdater.checksumName) else {
+      throw SelfUpdateError.missingAsset(tag: release.tagName, name: SelfUpdater.checksumName)
+    }
+    let directory = executableURL.deletingLastPathComponent()
+    guard FileManager.default.isWritableFile(atPath: directory.path) else {
+      throw SelfUpdateError.notWritable(path: directory.path)
+    }
+
+    let checksumText = String(decoding: try await fetch(checksum.downloadURL), as: UTF8.self)
+    let expected =
+      checksumText.split(whereSeparator: \.isWhitespace).first.map { $0.lowercased() } ?? ""
+    let data = try await fetch(archive.downloadURL)
+    let actual = SHA256.hash(data: data).map { String(format: "%02x", $0) }.joined()
+    guard expected == actual else {
+      throw SelfUpdateError.checksumMismatch(expected: expected, actual: actual)
+    }
+
+    let work = FileManager.default.temporaryDirectory
+      .appendingPathComponent("imsg-update-\(UUID().uuidString)", isDirectory: true)
+    try FileManager.default.createDirectory(at: work, withIntermediateDirectories: true)
+    defer { try? FileManager.default.removeItem(at: work) }
+    let zipURL = work.appendingPathComponent(SelfUpdater.assetName)
+    let unpacked = work.appendingPathComponent("unpacked", isDirectory: true)
+    try data.write(to: zipURL)
+    let unzip = try tool("/usr/bin/ditto", ["-x", "-k", zipURL.path, unpacked.path])
+    let binary = unpacked.appendingPathComponent("imsg")
+    guard unzip.status == 0, FileManager.default.fileExists(atPath: binary.path) else {
+      throw SelfUpdateError.unpackFailed(output: unzip.output)
+    }
+    let helper = unpacked.appendingPathComponent(NativeSendHelper.executableName)
+    let executables =
+      [binary] + (FileManager.default.fileExists(atPath: helper.path) ? [helper] : [])
+    for executable in executables {
+      let verify = try tool(
+        "/usr/bin/codesign",
+        [
+          "--verify", "--strict", "--test-requirement", SelfUpdater.signingRequirement,
+          executable.path,
+        ])
+      guard verify.status == 0 else {
+        throw SelfUpdateError.signatureInvalid(output: verify.output)
+      }
+    }
+
+    try swapIn(binary: binary, from: unpacked, into: directory)
+  }
+
+  /// Stages the binary, bundles and send helper beside the installed ones (same volume, so the
+  /// swaps are renames), replaces the bundles and helper keeping the old ones, then renames the
+  /// binary over the old one. If that fails the old ones go back, so they always match it.
+  private func swapIn(binary: URL, from unpacked: URL, into directory: URL) throws {
+    let fileManager = FileManager.default
+    let stamp = UUID().uuidString
+    var staged: [URL] = []
+    defer {
+      for url in staged { try? fileManager.removeItem(at: url) }
+    }
+    let stagedBinary = directory.appendingPathComponent(".imsg-update-\(stamp)")
+    staged.append(stagedBinary)
+    try fileManager.copyItem(at: binary, to: stagedBinary)
+    try fileManager.setAttributes([.posixPermissions: 0o755], ofItemAtPath: stagedBinary.path)
+    var companions: [(staged: URL, target: URL)] = []
+    for item in try fileManager.contentsOfDirectory(
+      at: unpacked, includingPropertiesForKeys: nil
+    )
+    where item.pathExtension == "bundle"
+      || item.lastPathComponent == NativeSendHelper.executableName
+    {
+      let stagedItem = directory.appendingPathComponent(
+        ".imsg-update-\(stamp)-\(item.lastPathComponent)")
+      staged.append(stagedItem)
+      try fileManager.copyItem(at: item, to: stagedItem)
+      companions.append((stagedItem, directory.appendingPathComponent(item.lastPathComponent)))
+    }
+
+    // Old companions are moved aside rather than deleted until the binary is in place.
+    var replaced: [(backup: URL?, target: URL)] = []
+    func rollBack() {
+      for (backup, target) in replaced.reversed() {
+        try? fileManager.removeItem(at: target)
+        if let backup { try? fileManager.moveItem(at: backup, to: target) }
+      }
+    }
+    do {
+      for companion in companions {
+        var backup: URL?
+        if fileManager.fileExists(atPath: companion.target.path) {
+          let aside = directory.appendingPathComponent(
+            ".imsg-update-\(stamp)-old-\(companion.target.lastPathComponent)")
+          try fileManager.moveItem(at: companion.target, to: aside)
+          backup = aside
+        }
+        replaced.append((backup, companion.target))
+        try fileManager.moveItem(at: companion.staged, to: companion.target)
+      }
+      guard rename(stagedBinary.path, executableURL.path) == 0 else {
+        throw POSIXError(POSIXErrorCode(rawValue: errno) ?? .EIO)
+      }
+    } catch {
+      rollBack()
+      throw error
+    }
+    staged += replaced.compactMap(\.backup)
+  }
+
+  private func fetch(_ url: URL, accept: String? = nil) async throws -> Data {
+    var request = URLRequest(url: url)
+    request.setValue("imsg/\(IMsgVersion.current)", forHTTPHeaderField: "User-Agent")
+    if let accept {
+      request.setValue(accept, forHTTPHeaderField: "Accept")
+    }
+    let (data, response) = try await transport(request)
+    if let status = (response as? HTTPURLResponse)?.statusCode, !(200..<300).contains(status) {
+      throw SelfUpdateError.requestFailed(url: url, status: status)
+    }
+    return data
+  }
+
+  static func runTool(_ path: String, _ arguments: [String]) throws -> (
+    status: Int32, output: String
+  ) {
+    let process = Process()
+    process.executableURL = URL(fileURLWithPath: path)
+    process.arguments = arguments
+    let pipe = Pipe()
+    process.standardOutput = pipe
+    process.standardError = pipe
+    try process.run()
+    let data = pipe.fileHandleForReading.readDataToEndOfFile()
+    process.waitUntilExit()
+    return (process.terminationStatus, String(data: data, encoding: .utf8) ?? "")
+  }
+}
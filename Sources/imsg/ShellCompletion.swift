@@ -0,0 +1,279 @@
+import Commander
+import Foundation
+import IMsgCore
+
+/// Generates bash/zsh/fish completion scripts from the command specs. Options that take chat
+/// ids, chat identifiers, or handles complete from the live chat.db through the hidden
+/// `imsg __complete <kind>` command.
+enum ShellCompletion {
+  enum Shell: String, CaseIterable {
+    case bash
+    case zsh
+    case fish
+  }
+
+  /// Values `__complete` can list; raw values double as its argument.
+  enum Source: String, CaseIterable {
+    case chatID = "chat-id"
+    case chatIdentifier = "chat-identifier"
+    case chatGUID = "chat-guid"
+    case handle
+  }
+
+  static let dynamicOptions: [String: Source] = [
+    "chat-id": .chatID,
+    "chat-identifier": .chatIdentifier,
+    "chat-guid": .chatGUID,
+    "participants": .handle,
+    "with": .handle,
+    "to": .handle,
+  ]
+
+  static let fileOptions: Set<String> = [
+    "db", "db-backup", "file", "out", "attachments-dir",
+  ]
+
+  /// `value<TAB>description` lines for `source`, most recent first.
+  static func candidates(_ source: Source, store: MessageStore, limit: Int = 200) throws
+    -> [String]
+  {
+    switch source {
+    case .chatID:
+      return try store.listChats(limit: limit).map { chat in
+        "\(chat.id)\t\(chatLabel(name: chat.name, identifier: chat.identifier))"
+      }
+    case .chatIdentifier:
+      return try store.listChats(limit: limit).map { chat in
+        "\(chat.identifier)\t\(chat.name)"
+      }
+    case .chatGUID:
+      return try store.listChats(limit: limit).compactMap { chat in
+        guard let info = try store.chatInfo(chatID: chat.id), !info.guid.isEmpty else {
+          return nil
+        }
+        return "\(info.guid)\t\(chat.name)"
+      }
+    case .handle:
+      return try store.recentHandles(limit: limit)
+    }
+  }
+
+  static func script(for shell: Shell, rootName: String, specs: [CommandSpec]) -> String {
+    let visible = specs.filter { !$0.isHidden }
+    switch shell {
+    case .bash: return bash(rootName: rootName, specs: visible)
+    case .zsh: return zsh(rootName: rootName, specs: visible)
+    case .fish: return fish(rootName: rootName, specs: visible)
+    }
+  }
+
+  private static func chatLabel(name: String, identifier: String) -> String {
+    name.isEmpty || name == identifier ? identifier : "\(name) (\(identifier))"
+  }
+
+  private struct Switch {
+    let names: [String]
+    let longName: String?
+    let help: String
+    let takesValue: Bool
+
+    var source: Source? { longName.flatMap { ShellCompletion.dynamicOptions[$0] } }
+    var isFile: Bool { longName.map { ShellCompletion.fileOptions.contains($0) } ?? false }
+  }
+
+  private static func switches(for spec: CommandSpec) -> [Switch] {
+    func make(_ names: [CommanderName], help: String?, takesValue: Bool) -> Switch {
+      var rendered: [String] = []
+      var longName: String?
+      for name in names {
+        switch name {
+        case .long(let value), .aliasLong(let value):
+          rendered.append("--\(value)")
+          if longName == nil { longName = value }
+        case .short(let char), .aliasShort(let char):
+          rendered.append("-\(char)")
+        }
+      }
+      return Switch(names: rendered, longName: longName, help: help ?? "", takesValue: takesValue)
+    }
+    return spec.signature.options.map { make($0.names, help: $0.help, takesValue: true) }
+      + spec.signature.flags.map { make($0.names, help: $0.help, takesValue: false) }
+  }
+
+  private static func quoted(_ value: String) -> String {
+    "'" + value.replacingOccurrences(of: "'", with: "'\\''") + "'"
+  }
+
+  private static func bash(rootName: String, specs: [CommandSpec]) -> String {
+    let function = "_\(rootName)"
+    var lines = [
+      "# bash completion for \(rootName)",
+      "\(function)_values() {",
+      "  local i db=()",
+      "  for ((i = 1; i < COMP_CWORD - 1; i++)); do",
+      "    [[ ${COMP_WORDS[i]} == --db ]] && db=(--db \"${COMP_WORDS[i + 1]}\")",
+      "  done",
+      "  \(rootName) __complete \"$1\" \"${db[@]}\" 2>/dev/null | cut -f1",
+      "}",
+      "",
+      "\(function)() {",
+      "  local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD - 1]}\"",
+      "  if ((COMP_CWORD == 1)); then",
+      "    COMPREPLY=($(compgen -W \"\(specs.map(\.name).joined(separator: " "))\" -- \"$cur\"))",
+      "    return",
+      "  fi",
+      "  case \"$prev\" in",
+    ]
+    var dynamic: [Source: Set<String>] = [:]
+    var files = Set<String>()
+    for spec in specs {
+      for item in switches(for: spec) where item.takesValue {
+        if let source = item.source {
+          dynamic[source, default: []].formUnion(item.names)
+        } else if item.isFile {
+          files.formUnion(item.names)
+        }
+      }
+    }
+    for source in Source.allCases {
+      guard let names = dynamic[source], !names.isEmpty else { continue }
+      lines.append("    \(names.sorted().joined(separator: "|")))")
+      lines.append(
+        "      COMPREPLY=($(compgen -W \"$(\(function)_values \(source.rawValue))\" -- \"$cur\"))")
+      lines.append("      return ;;")
+    }
+    if !files.isEmpty {
+      lines.append("    \(files.sorted().joined(separator: "|")))")
+      lines.append("      COMPREPLY=($(compgen -f -- \"$cur\"))")
+      lines.append("      return ;;")
+    }
+    lines.append("  esac")
+    lines.append("  local opts")
+    lines.append("  case \"${COMP_WORDS[1]}\" in")
+    for spec in specs {
+      let names = switches(for: spec).flatMap(\.names)
+      lines.append("    \(spec.name)) opts=\"\(names.joined(separator: " "))\" ;;")
+    }
+    lines.append("  esac")
+    lines.append("  COMPREPLY=($(compgen -W \"$opts\" -- \"$cur\"))")
+    lines.append("}")
+    lines.append("")
+    lines.append("complete -o default -F \(function) \(rootName)")
+    return lines.joined(separator: "\n") + "\n"
+  }
+
+  private static func zsh(rootName: String, specs: [CommandSpec]) -> String {
+    func escaped(_ text: String) -> String {
+      var result = ""
+      for char in text {
+        if "[]:\\".contains(char) { result.append("\\") }
+        result.append(char)
+      }
+      return result
+    }
+    let function = "_\(rootName)"
+    var lines = [
+      "#compdef \(rootName)",
+      "",
+      "\(function)_values() {",
+      "  local -a db items",
+      "  local i=${words[(I)--db]}",
+      "  (( i )) && db=(--db \"${words[i + 1]}\")",
+      "  items=(\"${(@f)$(\(rootName) __complete \"$1\" \"${db[@]}\" 2>/dev/null)}\")",
+      "  items=(\"${(@)items//:/\\\\:}\")",
+      "  items=(\"${(@)items//$'\\t'/:}\")",
+      "  _describe -t \"$1\" \"$1\" items",
+      "}",
+      "",
+      "\(function)() {",
+      "  local -a commands",
+      "  commands=(",
+    ]
+    for spec in specs {
+      lines.append("    \(quoted("\(escaped(spec.name)):\(spec.abstract)"))")
+    }
+    lines.append("  )")
+    lines.append("  if (( CURRENT == 2 )); then")
+    lines.append("    _describe -t commands command commands")
+    lines.append("    return")
+    lines.append("  fi")
+    lines.append("  local cmd=$words[2]")
+    lines.append("  shift words")
+    lines.append("  (( CURRENT-- ))")
+    lines.append("  case $cmd in")
+    for spec in specs {
+      lines.append("    \(spec.name))")
+      lines.append("      _arguments \\")
+      for item in switches(for: spec) {
+        var action = ""
+        if item.takesValue {
+          if let source = item.source {
+            action = ":\(source.rawValue):{\(function)_values \(source.rawValue)}"
+          } else if item.isFile {
+            action = ":file:_files"
+          } else {
+            action = ":value: "
+          }
+        }
+        for name in item.names {
+          lines.append("        \(quoted("\(name)[\(escaped(item.help))]\(action)")) \\")
+        }
+      }
+      lines.append("        && return ;;")
+    }
+    lines.append("  esac")
+    lines.append("}")
+    lines.append("")
+    lines.append("if [[ $funcstack[1] == \(function) ]]; then")
+    lines.append("  \(function) \"$@\"")
+    lines.append("else")
+    lines.append("  compdef \(function) \(rootName)")
+    lines.append("fi")
+    return lines.joined(separator: "\n") + "\n"
+  }
+
+  private static func fish(rootName: String, specs: [CommandSpec]) -> String {
+    let function = "__\(rootName)_values"
+    var lines = [
+      "# fish completion for \(rootName)",
+      "function \(function)",
+      "    set -l args (commandline -opc)",
+      "    set -l db",
+      "    if set -l i (contains -i -- --db $args)",
+      "        set db --db $args[(math $i + 1)]",
+      "    end",
+      "    \(rootName) __complete $argv $db 2>/dev/null",
+      "end",
+      "",
+      "complete -c \(rootName) -f",
+    ]
+    for spec in specs {
+      lines.append(
+        "complete -c \(rootName) -n __fish_use_subcommand -a \(spec.name) "
+          + "-d \(quoted(spec.abstract))")
+    }
+    for spec in specs {
+      let condition = quoted("__fish_seen_subcommand_from \(spec.name)")
+      for item in switches(for: spec) {
+        var parts = ["complete -c \(rootName) -n \(condition)"]
+        for name in item.names {
+          parts.append(name.hasPrefix("--") ? "-l \(name.dropFirst(2))" : "-s \(name.dropFirst())")
+        }
+        if item.takesValue {
+          if let source = item.source {
+            parts.append("-x -a \(quoted("(\(function) \(source.rawValue))"))")
+          } else if item.isFile {
+            parts.append("-r -F")
+          } else {
+            parts.append("-x")
+          }
+        }
+        if !item.help.isEmpty {
+          parts.append("-d \(quoted(item.help))")
+        }
+        lines.append(parts.joined(separator: " "))
+      }
+    }
+    return lines.joined(separator: "\n") + "\n"
+  }
+}
@@ -0,0 +1,135 @@
+import Commander
+import Foundation
+import IMsgCore
+
+/// `--format csv|tsv` for read commands: a header row, then one row per record, ready for
+/// spreadsheets and pandas. CSV quotes per RFC 4180; TSV escapes tabs, newlines and
+/// backslashes as `\t`, `\n`, `\r` and `\\` so every record stays on one line.
+enum TabularFormat: String, CaseIterable {
+  case csv
+  case tsv
+
+  static func option() -> OptionDefinition {
+    .make(
+      label: "format", names: [.long("format")],
+      help: "table output instead of text: csv|tsv (header row first)")
+  }
+
+  /// nil when `--format` wasn't given. Conflicts with `--json` and `--template`.
+  static func from(values: ParsedValues, runtime: RuntimeOptions) throws -> TabularFormat? {
+    guard let raw = values.option("format") else { return nil }
+    guard let format = TabularFormat(rawValue: raw.lowercased()),
+      !runtime.jsonOutput, values.option("template") == nil
+    else {
+      throw ParsedValuesError.invalidOption("format")
+    }
+    return format
+  }
+
+  func line(_ fields: [String]) -> String {
+    switch self {
+    case .csv:
+      return fields.map(Self.csvField).joined(separator: ",")
+    case .tsv:
+      return fields.map(Self.tsvField).joined(separator: "\t")
+    }
+  }
+
+  func print(header: [String], rows: [[String]]) {
+    Swift.print(line(header))
+    for row in rows {
+      Swift.print(line(row))
+    }
+  }
+
+  /// The records of CSV `text` as `line(_:)` writes them: quoted fields may hold commas,
+  /// doubled quotes and line breaks.
+  static func parseCSV(_ text: String) -> [[String]] {
+    var records: [[String]] = []
+    var record: [String] = []
+    var field = ""
+    var quoted = false
+    var iterator = text.makeIterator()
+    var pending = iterator.next()
+    while let char = pending {
+      pending = iterator.next()
+      if quoted {
+        if char == "\"" {
+          if pending == "\"" {
+            field.append("\"")
+            pending = iterator.next()
+          } else {
+            quoted = false
+          }
+        } else {
+          field.append(char)
+        }
+        continue
+      }
+      switch char {
+      case "\"" where field.isEmpty:
+        quoted = true
+      case ",":
+        record.append(field)
+        field = ""
+      case "\n", "\r\n", "\r":
+        record.append(field)
+        records.append(record)
+        record = []
+        field = ""
+      default:
+        field.append(char)
+      }
+    }
+    if !field.isEmpty || !record.isEmpty {
+      record.append(field)
+      records.append(record)
+    }
+    return records
+  }
+
+  private static func csvField(_ field: String) -> String {
+    guard field.contains(where: { ",\"\r\n".contains($0) }) else { return field }
+    return "\"" + field.replacingOccurrences(of: "\"", with: "\"\"") + "\""
+  }
+
+  private static func tsvField(_ field: String) -> String {
+    var escaped = ""
+    for scalar in field.unicodeScalars {
+      switch scalar {
+      case "\\": escaped += "\\\\"
+      case "\t": escaped += "\\t"
+      case "\n": escaped += "\\n"
+      case "\r": escaped += "\\r"
+      default: escaped.unicodeScalars.append(scalar)
+      }
+    }
+    return escaped
+  }
+}
+
+enum TabularRows {
+  static let chatHeader = [
+    "id", "name", "identifier", "service", "last_message_at", "message_count",
+  ]
+
+  static func chat(_ chat: Chat) -> [String] {
+    [
+      String(chat.id), chat.name, chat.identifier, chat.service,
+      CLIISO8601.format(chat.lastMessageAt), String(chat.messageCount),
+    ]
+  }
+
+  static let messageHeader = [
+    "id", "chat_id", "guid", "reply_to_guid", "created_at", "sender", "is_from_me", "service",
+    "text", "attachment_count",
+  ]
+
+  static func message(_ message: Message) -> [String] {
+    [
+      String(message.rowID), String(message.chatID), message.guid, message.replyToGUID ?? "",
+      CLIISO8601.format(message.date), message.sender, message.isFromMe ? "true" : "false",
+      message.service, message.text, String(message.attachmentsCount),
+    ]
+  }
+}
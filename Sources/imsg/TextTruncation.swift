@@ -0,0 +1,42 @@
+import Commander
+
+/// `--truncate N` for one-line views (history, watch, unread, tagged): message bodies are cut
+/// to N characters. Characters are grapheme clusters, so an emoji with a skin tone, a flag or
+/// a ZWJ sequence like 👨‍👩‍👧 is kept or dropped whole, never split into stray code points.
+enum TextTruncation {
+  static let ellipsis: Character = "…"
+
+  static func option() -> OptionDefinition {
+    .make(
+      label: "truncate", names: [.long("truncate")],
+      help: "cut message text to N characters on one line")
+  }
+
+  /// nil without `--truncate`.
+  static func limit(from values: ParsedValues) throws -> Int? {
+    guard let raw = values.option("truncate") else { return nil }
+    guard let limit = Int(raw), limit > 0 else {
+      throw ParsedValuesError.invalidOption("truncate")
+    }
+    return limit
+  }
+
+  /// Line breaks become spaces; longer text keeps its first `limit - 1` characters and ends
+  /// with `…`, so the result is never longer than `limit`.
+  static func truncate(_ text: String, to limit: Int) -> String {
+    let line = text.split(whereSeparator: \.isNewline).joined(separator: " ")
+    guard line.count > limit else { return line }
+    let kept = line.prefix(limit - 1).trimmingTrailingWhitespace()
+    return kept + String(ellipsis)
+  }
+}
+
+extension Substring {
+  fileprivate func trimmingTrailingWhitespace() -> String {
+    var end = endIndex
+    while end > startIndex, self[index(before: end)].isWhitespace {
+      end = index(before: end)
+    }
+    return String(self[startIndex..<end])
+  }
+}
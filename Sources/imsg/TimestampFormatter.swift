@@ -0,0 +1,123 @@
+import Commander
+import Foundation
+
+/// Text-output timestamps for `--tz` / `--time-format`. JSON output always stays RFC3339 UTC.
+struct TimestampFormatter {
+  enum Style: Equatable {
+    case rfc3339
+    case unix
+    case relative
+    case custom(String)
+  }
+
+  let style: Style
+  let timeZone: TimeZone
+  let locale: Locale
+  let now: () -> Date
+
+  init(
+    style: Style = .rfc3339,
+    timeZone: TimeZone = TimeZone(identifier: "UTC")!,
+    locale: Locale = .current,
+    now: @escaping () -> Date = Date.init
+  ) {
+    self.style = style
+    self.timeZone = timeZone
+    self.locale = locale
+    self.now = now
+  }
+
+  static func options() -> [OptionDefinition] {
+    [
+      .make(
+        label: "tz", names: [.long("tz")],
+        help: "time zone for text output: IANA name (Europe/Vienna) or local (default UTC)"),
+      .make(
+        label: "timeFormat", names: [.long("time-format")],
+        help: "rfc3339|unix|relative or a strftime pattern like '%Y-%m-%d %H:%M'"),
+    ]
+  }
+
+  static func from(values: ParsedValues) throws -> TimestampFormatter {
+    var timeZone = TimeZone(identifier: "UTC")!
+    if let tz = values.option("tz") {
+      if tz.lowercased() == "local" {
+        timeZone = .current
+      } else if let named = TimeZone(identifier: tz) {
+        timeZone = named
+      } else {
+        throw ParsedValuesError.invalidOption("tz")
+      }
+    }
+    guard let style = style(named: values.option("timeFormat") ?? "rfc3339") else {
+      throw ParsedValuesError.invalidOption("time-format")
+    }
+    // --lang also names the units of relative times, on commands that take it.
+    let locale = values.option("lang").map { Locale(identifier: $0) } ?? .current
+    return TimestampFormatter(style: style, timeZone: timeZone, locale: locale)
+  }
+
+  static func style(named value: String) -> Style? {
+    switch value.lowercased() {
+    case "rfc3339", "iso8601": return .rfc3339
+    case "unix": return .unix
+    case "relative": return .relative
+    default: return value.contains("%") ? .custom(value) : nil
+    }
+  }
+
+  func format(_ date: Date) -> String {
+    switch style {
+    case .rfc3339:
+      let formatter = ISO8601DateFormatter()
+      formatter.formatOptions = [.withInternetDateTime, .withFractionalSeconds]
+      formatter.timeZone = timeZone
+      return formatter.string(from: date)
+    case .unix:
+      return String(Int64(date.timeIntervalSince1970.rounded(.down)))
+    case .relative:
+      let formatter = RelativeDateTimeFormatter()
+      formatter.locale = locale
+      formatter.unitsStyle = .full
+      return formatter.localizedString(for: date, relativeTo: now())
+    case .custom(let pattern):
+      let formatter = DateFormatter()
+      formatter.locale = locale
+      formatter.timeZone = timeZone
+      formatter.dateFormat = TimestampFormatter.dateFormat(fromStrftime: pattern)
+      return formatter.string(from: date)
+    }
+  }
+
+  private static let strftimeTokens: [Character: String] = [
+    "Y": "yyyy", "y": "yy", "m": "MM", "d": "dd", "e": "d", "H": "HH", "I": "hh", "M": "mm",
+    "S": "ss", "p": "a", "b": "MMM", "B": "MMMM", "a": "EEE", "A": "EEEE", "j": "DDD",
+    "Z": "zzz", "z": "xx", "F": "yyyy-MM-dd", "T": "HH:mm:ss", "R": "HH:mm",
+  ]
+
+  /// Converts strftime conversions to a DateFormatter pattern, quoting literal text.
+  static func dateFormat(fromStrftime pattern: String) -> String {
+    var output = ""
+    var literal = ""
+    func flushLiteral() {
+      guard !literal.isEmpty else { return }
+      output += "'\(literal.replacingOccurrences(of: "'", with: "''"))'"
+      literal = ""
+    }
+    var iterator = pattern.makeIterator()
+    while let character = iterator.next() {
+      guard character == "%", let token = iterator.next() else {
+        literal.append(character)
+        continue
+      }
+      if let mapped = strftimeTokens[token] {
+        flushLiteral()
+        output += mapped
+      } else {
+        literal.append(token == "%" ? "%" : "%\(token)")
+      }
+    }
+    flushLiteral()
+    return output
+  }
+}
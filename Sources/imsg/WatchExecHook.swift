@@ -0,0 +1,197 @@
+import Commander
+import Foundation
+import IMsgCore
+
+enum WatchExecError: Error, CustomStringConvertible {
+  case exited(Int32)
+  case timedOut(TimeInterval)
+
+  var description: String {
+    switch self {
+    case .exited(let status):
+      return "exited with status \(status)"
+    case .timedOut(let timeout):
+      return "still running after \(String(format: "%g", timeout))s, terminated"
+    }
+  }
+}
+
+/// `watch --exec`: runs a shell command for each message watch prints, with the message in
+/// IMSG_* environment variables and its JSON (the `--json` line) on stdin. At most
+/// `concurrency` commands run at once; when all are busy watch waits for one to finish rather
+/// than queueing without bound. Failures are logged as errors and never stop the watch.
+/// `otp-forward --exec` runs through the same hook with its own payload.
+final class WatchExecHook {
+  let command: String
+  let timeout: TimeInterval
+  /// The imsg command the hook belongs to, for the failure log.
+  let owner: String
+  private let slots: ExecSlots
+  private let logger: AutomationLogger
+
+  init(
+    command: String, concurrency: Int = 4, timeout: TimeInterval = 30,
+    owner: String = "watch", logger: AutomationLogger = .disabled
+  ) {
+    self.command = command
+    self.timeout = timeout
+    self.owner = owner
+    self.slots = ExecSlots(limit: max(1, concurrency))
+    self.logger = logger
+  }
+
+  /// `--exec` with its concurrency and timeout, or nil without it.
+  static func from(
+    values: ParsedValues, owner: String = "watch", logger: AutomationLogger = .disabled
+  ) throws -> WatchExecHook? {
+    guard let command = values.option("exec") else {
+      if values.option("execConcurrency") != nil {
+        throw ParsedValuesError.invalidOption("execConcurrency")
+      }
+      if values.option("execTimeout") != nil {
+        throw ParsedValuesError.invalidOption("execTimeout")
+      }
+      return nil
+    }
+    guard !command.trimmingCharacters(in: .whitespaces).isEmpty else {
+      throw ParsedValuesError.invalidOption("exec")
+    }
+    var concurrency = 4
+    if values.option("execConcurrency") != nil {
+      guard let parsed = values.optionInt("execConcurrency"), parsed > 0 else {
+        throw ParsedValuesError.invalidOption("execConcurrency")
+      }
+      concurrency = parsed
+    }
+    var timeout: TimeInterval = 30
+    if let raw = values.option("execTimeout") {
+      guard let parsed = DurationParser.parse(raw), parsed > 0 else {
+        throw ParsedValuesError.invalidOption("execTimeout")
+      }
+      timeout = parsed
+    }
+    return WatchExecHook(
+      command: command, concurrency: concurrency, timeout: timeout, owner: owner, logger: logger)
+  }
+
+  /// IMSG_* variables describing `message`; the rules `exec` action sets the same ones.
+  static func environment(for message: Message) -> [String: String] {
+    [
+      "IMSG_MESSAGE_ID": String(message.rowID),
+      "IMSG_GUID": message.guid,
+      "IMSG_CHAT_ID": String(message.chatID),
+      "IMSG_SENDER": message.sender,
+      "IMSG_TEXT": displayText(for: message),
+      "IMSG_IS_FROM_ME": message.isFromMe ? "1" : "0",
+      "IMSG_SERVICE": message.service,
+      "IMSG_DATE": CLIISO8601.format(message.date),
+    ]
+  }
+
+  /// Starts the command for `message` once a slot is free and returns without waiting for it.
+  /// `environment` adds variables on top of the message's.
+  func submit<Payload: Encodable>(
+    _ message: Message, payload: Payload, environment: [String: String] = [:]
+  ) async {
+    await slots.acquire()
+    Task {
+      do {
+        try await run(message, payload: payload, environment: environment)
+      } catch {
+        logger.log(
+          error, "--exec for message \(message.rowID) failed",
+          fields: ["command": owner, "exec": command])
+      }
+      await slots.release()
+    }
+  }
+
+  /// Waits for the commands still running, so watch doesn't exit underneath them.
+  func finish() async {
+    await slots.waitUntilIdle()
+  }
+
+  /// Runs the command for one message and waits for it; throws when it fails or times out.
+  func run<Payload: Encodable>(
+    _ message: Message, payload: Payload, environment: [String: String] = [:]
+  ) async throws {
+    // stdin comes from a file rather than a pipe, so a command that never reads it can't
+    // leave watch blocked on (or killed by) a write to a closed pipe.
+    let input = FileManager.default.temporaryDirectory
+      .appendingPathComponent("imsg-exec-\(UUID().uuidString).json")
+    try Data((try JSONLines.encode(payload) + "\n").utf8).write(to: input)
+    defer { try? FileManager.default.removeItem(at: input) }
+    let stdin = try FileHandle(forReadingFrom: input)
+    defer { try? stdin.close() }
+
+    let process = Process()
+    process.executableURL = URL(fileURLWithPath: "/bin/sh")
+    process.arguments = ["-c", command]
+    process.environment = ProcessInfo.processInfo.environment.merging(
+      WatchExecHook.environment(for: message).merging(environment) { _, new in new }
+    ) { _, new in new }
+    process.standardInput = stdin
+    let timeout = self.timeout
+    let watchdog = Task { () -> Bool in
+      try await Task.sleep(nanoseconds: UInt64(timeout * 1_000_000_000))
+      guard process.isRunning else { return false }
+      process.terminate()
+      return true
+    }
+    defer { watchdog.cancel() }
+    let status: Int32 = try await withCheckedThrowingContinuation { continuation in
+      process.terminationHandler = { continuation.resume(returning: $0.terminationStatus) }
+      do {
+        try process.run()
+      } catch {
+        continuation.resume(throwing: error)
+      }
+    }
+    watchdog.cancel()
+    // True only when the watchdog got to terminate the command before it exited.
+    if (try? await watchdog.value) == true {
+      throw WatchExecError.timedOut(timeout)
+    }
+    if status != 0 {
+      throw WatchExecError.exited(status)
+    }
+  }
+}
+
+/// Counts running commands for `WatchExecHook`; `acquire` waits while all slots are taken.
+private actor ExecSlots {
+  private let limit: Int
+  private var running = 0
+  private var waiting: [CheckedContinuation<Void, Never>] = []
+  private var idle: [CheckedContinuation<Void, Never>] = []
+
+  init(limit: Int) {
+    self.limit = limit
+  }
+
+  func acquire() async {
+    if running < limit {
+      running += 1
+      return
+    }
+    // release() hands its slot straight to the first waiter, so `running` stays the same.
+    await withCheckedContinuation { waiting.append($0) }
+  }
+
+  func release() {
+    if !waiting.isEmpty {
+      waiting.removeFirst().resume()
+      return
+    }
+    running -= 1
+    if running == 0 {
+      idle.forEach { $0.resume() }
+      idle = []
+    }
+  }
+
+  func waitUntilIdle() async {
+    guard running > 0 else { return }
+    await withCheckedContinuation { idle.append($0) }
+  }
+}
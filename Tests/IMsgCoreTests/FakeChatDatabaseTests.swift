@@ -0,0 +1,103 @@
+import Foundation
+import IMsgTesting
+import Testing
+
+@testable import IMsgCore
+
+@Test
+func fakeChatDatabaseServesStoreQueriesWithoutBeingWritten() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let start = Date(timeIntervalSince1970: 1_700_000_000)
+  let ann = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let group = try fake.addChat(
+    identifier: "chat42", name: "Trip", participants: ["+15551234567", "bob@example.com"])
+  let hello = try fake.addMessage(
+    chatID: ann, text: "hello", sender: "+15551234567", date: start)
+  try fake.addMessage(
+    chatID: ann, text: "hi!", date: start.addingTimeInterval(60), account: "p:+15550000000",
+    attachments: [FakeAttachment(path: "/tmp/missing/photo.jpg", mimeType: "image/jpeg")])
+  try fake.addMessage(
+    chatID: group, text: "who's driving?", sender: "bob@example.com",
+    date: start.addingTimeInterval(120))
+  try fake.addReaction(to: hello, type: .love, date: start.addingTimeInterval(90))
+  let before = try fake.fingerprint()
+
+  let store = try fake.makeStore()
+  #expect(try store.listChats(limit: 10).map(\.id) == [group, ann])
+  #expect(try store.chatInfo(chatID: group)?.name == "Trip")
+  let history = try store.messages(chatID: ann, limit: 10)
+  #expect(history.map(\.text) == ["hi!", "hello"])
+  #expect(history.first?.attachmentsCount == 1)
+  #expect(try store.attachments(for: history[0].rowID).first?.transferName == "photo.jpg")
+  #expect(try store.reactions(for: hello).map(\.reactionType) == [.love])
+  #expect(try store.messagesAfter(afterRowID: hello, chatID: nil, limit: 10).count == 2)
+  #expect(try store.senderAliases().map(\.handle) == ["+15550000000"])
+  #expect(try store.searchMessages(query: "DRIVING", limit: 5).map(\.chatID) == [group])
+
+  #expect(try fake.fingerprint() == before)
+}
+
+@Test
+func fakeMessageSenderRecordsSendsAndDeliversThemToTheDatabase() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let group = try fake.addChat(
+    identifier: "chat42", guid: "iMessage;+;chat42",
+    participants: ["+15551234567", "+15557654321"])
+  let sender = FakeMessageSender(database: fake)
+
+  try sender.send(MessageSendOptions(recipient: "+15559876543", text: "new thread"))
+  try sender.send(
+    MessageSendOptions(recipient: "", text: "to the group", chatGUID: "iMessage;+;chat42"))
+  #expect(sender.sent.map(\.text) == ["new thread", "to the group"])
+
+  let store = try fake.makeStore()
+  let direct = try #require(try fake.chatID(matching: "+15559876543"))
+  #expect(try store.messages(chatID: direct, limit: 5).map(\.isFromMe) == [true])
+  #expect(try store.messages(chatID: group, limit: 5).map(\.text) == ["to the group"])
+
+  sender.failure = IMsgError.appleScriptFailure("Messages is not signed in")
+  #expect(throws: IMsgError.self) {
+    try sender.send(MessageSendOptions(recipient: "+15559876543", text: "lost"))
+  }
+  #expect(sender.sent.count == 2)
+  #expect(throws: IMsgError.self) {
+    try FakeMessageSender(database: fake).send(
+      MessageSendOptions(recipient: "", text: "x", chatIdentifier: "chat404"))
+  }
+}
+
+@Test
+func receiptsArePerRecipientInDirectChatsAndSharedInGroups() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let start = Date(timeIntervalSince1970: 1_700_000_000)
+  let ann = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let group = try fake.addChat(
+    identifier: "chat42", participants: ["+15551234567", "bob@example.com"])
+  let direct = try fake.addMessage(chatID: ann, text: "on my way", date: start)
+  try fake.setReceipt(
+    messageID: direct, delivered: start.addingTimeInterval(2), read: start.addingTimeInterval(60))
+  let toGroup = try fake.addMessage(chatID: group, text: "dinner?", date: start)
+  try fake.setReceipt(messageID: toGroup, delivered: start.addingTimeInterval(3))
+  let received = try fake.addMessage(
+    chatID: ann, text: "see you", sender: "+15551234567", date: start.addingTimeInterval(90))
+  try fake.setReceipt(messageID: received, delivered: nil, read: start.addingTimeInterval(120))
+  let store = try fake.makeStore()
+
+  let directReceipts = try store.receipts(for: try #require(try store.message(rowID: direct)))
+  #expect(
+    directReceipts == [
+      MessageReceipt(
+        handle: "+15551234567", deliveredAt: start.addingTimeInterval(2),
+        readAt: start.addingTimeInterval(60), perParticipant: true)
+    ])
+  let groupReceipts = try store.receipts(for: try #require(try store.message(rowID: toGroup)))
+  #expect(groupReceipts.map(\.handle) == ["+15551234567", "bob@example.com"])
+  #expect(groupReceipts.allSatisfy { !$0.perParticipant && $0.readAt == nil })
+  #expect(groupReceipts.first?.deliveredAt == start.addingTimeInterval(3))
+  let mine = try store.receipts(for: try #require(try store.message(rowID: received)))
+  #expect(mine.map(\.handle) == ["me"])
+  #expect(mine.first?.readAt == start.addingTimeInterval(120))
+}
@@ -1,4 +1,5 @@
 import Foundation
+import IMsgTesting
 import SQLite
 import Testing
 
@@ -179,3 +180,131 @@ func messagesAfterUsesAttributedBodyFallback() throws {
   #expect(messages.count == 1)
   #expect(messages.first?.text == "new text")
 }
+
+/// Writes typedstream archives shaped like Messages' attributedBody, sharing strings, classes,
+/// and attribute dictionaries by reference the way NSArchiver does.
+private struct AttributedBodyFixture {
+  enum Attribute {
+    case number(UInt8)
+    case string(String)
+  }
+
+  private(set) var bytes: [UInt8] = [0x04, 0x0b] + Array("streamtyped".utf8) + [0x81, 0xe8, 0x03]
+  private var strings: [String] = []
+  private var shared: [String] = []
+
+  init(text: String, runs: [(index: UInt8, length: UInt8, attributes: [(String, Attribute)])]) {
+    sharedString("@")
+    beginObject(["NSMutableAttributedString", "NSAttributedString", "NSObject"])
+    string(text)
+    var written = 0
+    for run in runs {
+      sharedString("iI")
+      bytes += [run.index, run.length]
+      if Int(run.index) > written {
+        dictionary(run.attributes)
+        written += 1
+      }
+    }
+    bytes.append(0x86)
+  }
+
+  private mutating func sharedString(_ value: String) {
+    if let index = strings.firstIndex(of: value) {
+      bytes.append(UInt8(0x92 + index))
+    } else {
+      strings.append(value)
+      bytes += [0x84, UInt8(value.utf8.count)] + Array(value.utf8)
+    }
+  }
+
+  private mutating func classChain(_ names: ArraySlice<String>) {
+    guard let name = names.first else {
+      bytes.append(0x85)
+      return
+    }
+    if let index = shared.firstIndex(of: "class " + name) {
+      bytes.append(UInt8(0x92 + index))
+      return
+    }
+    bytes.append(0x84)
+    sharedString(name)
+    bytes.append(0x00)
+    shared.append("class " + name)
+    classChain(names.dropFirst())
+  }
+
+  private mutating func beginObject(_ classes: [String]) {
+    bytes.append(0x84)
+    shared.append("object")
+    classChain(classes[...])
+  }
+
+  private mutating func string(_ value: String) {
+    sharedString("@")
+    beginObject(["NSString", "NSObject"])
+    sharedString("+")
+    bytes += [UInt8(value.utf8.count)] + Array(value.utf8)
+    bytes.append(0x86)
+  }
+
+  private mutating func dictionary(_ attributes: [(String, Attribute)]) {
+    sharedString("@")
+    beginObject(["NSDictionary", "NSObject"])
+    sharedString("i")
+    bytes.append(UInt8(attributes.count))
+    for (key, value) in attributes {
+      string(key)
+      switch value {
+      case .string(let text):
+        string(text)
+      case .number(let number):
+        sharedString("@")
+        beginObject(["NSNumber", "NSValue", "NSObject"])
+        sharedString("*")
+        sharedString("q")
+        sharedString("q")
+        bytes.append(number)
+        bytes.append(0x86)
+      }
+    }
+    bytes.append(0x86)
+  }
+}
+
+@Test
+func messagesDecodeMentionsFromAttributedBody() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15550000000", participants: ["+15550000000"])
+
+  // "Lunch 🍜 with Ann?": the emoji is two UTF-16 units, so "Ann" starts at 14.
+  let part = ("__kIMMessagePartAttributeName", AttributedBodyFixture.Attribute.number(0))
+  let mention = (
+    "__kIMMentionConfirmedMention", AttributedBodyFixture.Attribute.string("+15551234567")
+  )
+  let fixture = AttributedBodyFixture(
+    text: "Lunch 🍜 with Ann?",
+    runs: [
+      (index: 1, length: 14, attributes: [part]),
+      (index: 2, length: 3, attributes: [part, mention]),
+      (index: 1, length: 1, attributes: []),
+    ])
+  try fake.addMessage(
+    chatID: chat, text: nil, sender: "+15550000000", attributedBody: Data(fixture.bytes))
+
+  let store = try fake.makeStore()
+  let message = try #require(try store.messages(chatID: chat, limit: 10).first)
+  #expect(message.text == "Lunch 🍜 with Ann?")
+  #expect(
+    message.mentions == [
+      MessageMention(handle: "+15551234567", location: 14, length: 3, text: "Ann")
+    ])
+  #expect(MentionMatcher(handles: ["(555) 123-4567"]).matches(message))
+  #expect(!MentionMatcher(handles: ["me@example.com"]).matches(message))
+
+  let plain = AttributedBodyFixture(
+    text: "no mentions", runs: [(index: 1, length: 11, attributes: [part])])
+  #expect(MentionParser.mentions(in: Data(plain.bytes)).isEmpty)
+  #expect(MentionParser.mentions(in: Data(fixture.bytes.dropLast(10))).isEmpty)
+}
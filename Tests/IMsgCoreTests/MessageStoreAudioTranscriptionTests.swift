@@ -1,9 +1,30 @@
 import Foundation
+import IMsgTesting
 import SQLite
 import Testing
 
 @testable import IMsgCore
 
+/// Adds a chat with one audio message as Messages stores it: placeholder text, and the
+/// transcription in the attachment's `user_info`. Returns the chat's rowid.
+private func addAudioMessageChat(to fake: FakeChatDatabase) throws -> Int64 {
+  let chat = try fake.addChat(identifier: "+123", participants: ["+123"])
+  let info = try PropertyListSerialization.data(
+    fromPropertyList: ["audio-transcription": "test transcript"],
+    format: .binary,
+    options: 0
+  )
+  try fake.addMessage(
+    chatID: chat, text: "placeholder", sender: "+123",
+    attachments: [
+      FakeAttachment(
+        path: "~/Library/Messages/Attachments/Audio Message.caf", mimeType: "audio/x-caf",
+        userInfo: info)
+    ],
+    columns: ["is_audio_message": 1])
+  return chat
+}
+
 @Test
 func audioMessagesUseTranscriptionText() throws {
   let db = try Connection(.inMemory)
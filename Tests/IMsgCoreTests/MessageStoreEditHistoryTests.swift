@@ -0,0 +1,53 @@
+import Foundation
+import IMsgTesting
+import SQLite
+import Testing
+
+@testable import IMsgCore
+
+private func typedStream(_ text: String) -> Data {
+  Data([0x01, 0x2b, UInt8(text.utf8.count)] + Array(text.utf8) + [0x86, 0x84])
+}
+
+private func summaryInfo(_ revisions: [(text: String, seconds: Double)]) throws -> Data {
+  let events: [[String: Any]] = revisions.map { ["t": typedStream($0.text), "d": $0.seconds] }
+  let plist: [String: Any] = ["ec": ["0": events]]
+  return try PropertyListSerialization.data(
+    fromPropertyList: plist,
+    format: .binary,
+    options: 0
+  )
+}
+
+@Test
+func parseEditHistoryReadsRevisionsInOrder() throws {
+  let data = try summaryInfo([("helo", 700_000_000), ("hello", 700_000_030)])
+  let revisions = MessageStore.parseEditHistory(data)
+  #expect(revisions.map(\.text) == ["helo", "hello"])
+  #expect(revisions.map(\.part) == [0, 0])
+  #expect(
+    revisions.first?.date
+      == Date(timeIntervalSince1970: 700_000_000 + MessageStore.appleEpochOffset))
+  #expect(MessageStore.parseEditHistory(Data("not a plist".utf8)).isEmpty)
+}
+
+@Test
+func editHistoryOnlyForEditedMessages() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+123", participants: ["+123"])
+  let info = Blob(
+    bytes: [UInt8](try summaryInfo([("see you at 6", 700_000_000), ("see you at 7", 700_000_060)])))
+  let edited = try fake.addMessage(
+    chatID: chat, text: "see you at 7",
+    columns: ["date_edited": Int64(700_000_060_000_000_000), "message_summary_info": info])
+  let plain = try fake.addMessage(
+    chatID: chat, text: "plain", columns: ["date_edited": Int64(0), "message_summary_info": info])
+  let store = try fake.makeStore()
+  #expect(try store.editHistory(rowID: edited).map(\.text) == ["see you at 6", "see you at 7"])
+  #expect(try store.editHistory(rowID: plain).isEmpty)
+
+  let legacy = try MessageStore(
+    connection: Connection(fake.path, readonly: true), path: fake.path, hasEditColumns: false)
+  #expect(try legacy.editHistory(rowID: edited).isEmpty)
+}
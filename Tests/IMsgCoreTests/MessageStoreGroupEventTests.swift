@@ -0,0 +1,44 @@
+import Foundation
+import IMsgTesting
+import SQLite
+import Testing
+
+@testable import IMsgCore
+
+@Test
+func messagesDecodeGroupEvents() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(
+    identifier: "chat123", name: "Trip", participants: ["+15551230001", "+15551230002"])
+  let added = try fake.handleID("+15551230002")
+  let now = Date()
+  // item_type 1 adds or removes `other_handle`, 2 renames to `group_title`, 3 is leaving.
+  let rows: [(sender: String, text: String?, columns: [String: Binding?])] = [
+    ("+15551230001", "hello", [:]),
+    ("+15551230001", nil, ["item_type": 1, "other_handle": added]),
+    ("+15551230001", nil, ["item_type": 2, "group_title": "Trip"]),
+    ("+15551230002", nil, ["item_type": 3]),
+  ]
+  var rowIDs: [Int64] = []
+  for (offset, row) in rows.enumerated() {
+    rowIDs.append(
+      try fake.addMessage(
+        chatID: chat, text: row.text, sender: row.sender,
+        date: now.addingTimeInterval(Double(offset)), columns: row.columns))
+  }
+
+  let store = try fake.makeStore()
+  let messages = Array(try store.messages(chatID: chat, limit: 10).reversed())
+  #expect(messages[0].groupEvent == nil)
+  #expect(messages[1].groupEvent == GroupEvent(action: .added, handle: "+15551230002"))
+  #expect(messages[2].groupEvent == GroupEvent(action: .renamed, title: "Trip"))
+  #expect(messages[3].groupEvent?.action == .left)
+  #expect(try store.message(rowID: rowIDs[2])?.groupEvent?.title == "Trip")
+
+  #expect(
+    messages[1].groupEvent?.summary(actor: "+15551230001")
+      == "+15551230001 added +15551230002 to the conversation")
+  #expect(
+    messages[2].groupEvent?.summary(actor: "You") == "You named the conversation \"Trip\"")
+}
@@ -1,4 +1,5 @@
 import Foundation
+import IMsgTesting
 import SQLite
 import Testing
 
@@ -76,6 +77,21 @@ private enum ReactionTestDatabase {
     )
     try db.run("INSERT INTO chat_message_join(chat_id, message_id) VALUES (1, ?)", messageID)
   }
+
+  /// Adds a chat with +123 and +456 holding one message from +123, ten minutes before `now`,
+  /// and returns the message's rowid.
+  @discardableResult
+  static func seedBaseMessage(
+    _ fake: FakeChatDatabase,
+    now: Date,
+    guid: String = "msg-guid-1",
+    text: String = "Hello world"
+  ) throws -> Int64 {
+    let chat = try fake.addChat(
+      identifier: "+123", name: "Test Chat", participants: ["+123", "+456"])
+    return try fake.addMessage(
+      chatID: chat, text: text, sender: "+123", date: now.addingTimeInterval(-600), guid: guid)
+  }
 }
 
 @Test
@@ -316,3 +332,41 @@ func reactionTypeHelpers() throws {
   #expect(ReactionType.fromRemoval(3005) == .question)
   #expect(ReactionType.fromRemoval(3006, customEmoji: "🎉") == .custom("🎉"))
 }
+
+@Test
+func messageLookupByGuidAndRowID() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let message = try ReactionTestDatabase.seedBaseMessage(fake, now: Date())
+
+  let store = try fake.makeStore()
+  let byGUID = try store.message(guid: "msg-guid-1")
+  #expect(byGUID?.rowID == message)
+  #expect(byGUID?.chatID == 1)
+  #expect(byGUID?.text == "Hello world")
+  #expect(try store.message(rowID: message)?.guid == "msg-guid-1")
+  #expect(try store.message(guid: "missing") == nil)
+  #expect(try store.message(rowID: 99) == nil)
+}
+
+@Test
+func reactionsForMessageIDsBatchesByMessage() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let now = Date()
+  let first = try ReactionTestDatabase.seedBaseMessage(fake, now: now)
+  let second = try fake.addMessage(
+    chatID: 1, text: "second", sender: "+123", date: now.addingTimeInterval(-550),
+    guid: "msg-guid-2")
+  try fake.addReaction(to: first, type: .love, sender: "+456", date: now.addingTimeInterval(-500))
+  try fake.addReaction(to: second, type: .like, sender: "+456", date: now.addingTimeInterval(-400))
+  try fake.addReaction(
+    to: second, type: .like, sender: "+456", removed: true, date: now.addingTimeInterval(-300))
+
+  let store = try fake.makeStore()
+  let batched = try store.reactions(forMessageIDs: [first, second])
+  #expect(batched[first]?.map(\.reactionType) == [.love])
+  #expect(batched[second] == nil || batched[second]?.isEmpty == true)
+  #expect(try store.reactions(for: first) == batched[first])
+  #expect(try store.reactions(forMessageIDs: []).isEmpty)
+}
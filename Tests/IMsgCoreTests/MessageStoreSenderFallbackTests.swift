@@ -1,4 +1,5 @@
 import Foundation
+import IMsgTesting
 import SQLite
 import Testing
 
@@ -1,4 +1,5 @@
 import Foundation
+import IMsgTesting
 import SQLite
 
 @testable import IMsgCore
@@ -129,4 +130,30 @@ enum TestDatabase {
 
     return try MessageStore(connection: db, path: ":memory:")
   }
+
+  /// Chat 1 (`+123`, "Test Chat") with three messages: 1 "hello" from +123, 2 "hi back" from
+  /// me with a missing `test.dat` attached, and 3 "photo" from +123.
+  static func make() throws -> FakeChatDatabase {
+    let fake = try FakeChatDatabase()
+    let now = Date()
+    let chat = try fake.addChat(
+      identifier: "+123", guid: "iMessage;+;chat123", name: "Test Chat",
+      participants: ["+123", "Me"])
+    try fake.addMessage(
+      chatID: chat, text: "hello", sender: "+123", date: now.addingTimeInterval(-600))
+    try fake.addMessage(
+      chatID: chat, text: "hi back", date: now.addingTimeInterval(-500),
+      attachments: [
+        FakeAttachment(path: "~/Library/Messages/Attachments/test.dat", totalBytes: 123)
+      ])
+    try fake.addMessage(
+      chatID: chat, text: "photo", sender: "+123", date: now.addingTimeInterval(-60))
+    return fake
+  }
+
+  /// A minimal attributedBody typedstream holding `text`, for messages whose `text` column is
+  /// NULL as newer macOS writes them.
+  static func attributedBody(_ text: String) -> Data {
+    Data([0x01, 0x2b] + Array(text.utf8) + [0x86, 0x84])
+  }
 }
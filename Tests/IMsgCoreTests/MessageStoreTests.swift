@@ -1,4 +1,5 @@
 import Foundation
+import IMsgTesting
 import SQLite
 import Testing
 
@@ -12,6 +13,17 @@ func listChatsReturnsChat() throws {
   #expect(chats.first?.identifier == "+123")
 }
 
+@Test
+func listChatsFiltersByParticipantAndService() throws {
+  let fake = try TestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  #expect(try store.listChats(limit: 5, participant: "+123").map(\.id) == [1])
+  #expect(try store.listChats(limit: 5, participant: "+1 555 000 0000").isEmpty)
+  #expect(try store.listChats(limit: 5, service: .imessage).map(\.id) == [1])
+  #expect(try store.listChats(limit: 5, service: .sms).isEmpty)
+}
+
 @Test
 func chatInfoReturnsMetadata() throws {
   let store = try TestDatabase.makeStore()
@@ -54,6 +66,29 @@ func participantsReturnsUniqueHandles() throws {
   #expect(participants.contains("me@icloud.com"))
 }
 
+@Test
+func chatLookupsAreCachedUntilRowidsChange() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(
+    identifier: "chat123", guid: "iMessage;+;chat123", name: "Group", participants: ["+123"])
+  let store = try fake.makeStore()
+  store.lookups.validationInterval = 0
+  #expect(try store.chatInfo(chatID: chat)?.name == "Group")
+  #expect(try store.participants(chatID: chat) == ["+123"])
+
+  // A rename changes no rowids, so it's served stale until invalidated.
+  try fake.run("UPDATE chat SET display_name = 'Renamed' WHERE ROWID = ?", chat)
+  #expect(try store.chatInfo(chatID: chat)?.name == "Group")
+  store.invalidateLookupCache()
+  #expect(try store.chatInfo(chatID: chat)?.name == "Renamed")
+
+  try fake.run(
+    "INSERT INTO chat_handle_join(chat_id, handle_id) VALUES (?, ?)", chat,
+    try fake.handleID("+456"))
+  #expect(try store.participants(chatID: chat) == ["+123", "+456"])
+}
+
 @Test
 func messagesByChatReturnsMessages() throws {
   let store = try TestDatabase.makeStore()
@@ -63,6 +98,73 @@ func messagesByChatReturnsMessages() throws {
   #expect(messages[0].attachmentsCount == 0)
 }
 
+@Test
+func scanMessagesStreamsBatchesInEitherOrder() throws {
+  let fake = try TestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  var batches: [[Int64]] = []
+  try store.scanMessages(chatID: 1, batchSize: 2) { batches.append($0.map(\.rowID)) }
+  #expect(batches == [[3, 2], [1]])
+
+  var oldest: [Int64] = []
+  try store.scanMessages(chatID: 1, limit: 2, order: .oldestFirst) {
+    oldest += $0.map(\.rowID)
+  }
+  #expect(oldest == [2, 3])
+
+  var all: [Int64] = []
+  try store.scanMessages(chatID: 1, order: .oldestFirst) { all += $0.map(\.rowID) }
+  #expect(all == [1, 2, 3])
+}
+
+@Test
+func scanMessagesCountsOnlyMatchingRowsTowardTheLimit() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let now = Date()
+  let older = try fake.addMessage(
+    chatID: chat, text: "code is 1234", date: now.addingTimeInterval(-300))
+  let old = try fake.addMessage(
+    chatID: chat, text: "code is 5678", date: now.addingTimeInterval(-200))
+  for offset in 1...3 {
+    try fake.addMessage(
+      chatID: chat, text: "chatter \(offset)", date: now.addingTimeInterval(Double(-offset)))
+  }
+  let store = try fake.makeStore()
+  let matcher = try MessageTextMatcher(pattern: "code is")
+  var newest: [Int64] = []
+  try store.scanMessages(chatID: chat, limit: 2, matching: { matcher.matches($0.text) }) {
+    newest += $0.map(\.rowID)
+  }
+  #expect(newest == [old, older])
+  var oldest: [[Int64]] = []
+  try store.scanMessages(
+    chatID: chat, limit: 2, order: .oldestFirst, batchSize: 1,
+    matching: { matcher.matches($0.text) }
+  ) { oldest.append($0.map(\.rowID)) }
+  #expect(oldest == [[older], [old]])
+}
+
+@Test
+func textPatternsAlsoMatchAttachmentNames() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let invoice = try fake.addMessage(
+    chatID: chat, text: "", attachments: [FakeAttachment(path: "/tmp/invoice-0042.pdf")])
+  let photo = try fake.addMessage(
+    chatID: chat, text: "", attachments: [FakeAttachment(path: "/tmp/IMG_0001.heic")])
+  let store = try fake.makeStore()
+  let messages = try store.messages(chatID: chat, limit: 10)
+  let filter = MessageFilter(textMatcher: try MessageTextMatcher(pattern: "\\.pdf$"))
+  let kept = try messages.filter { try store.allows($0, by: filter) }
+  #expect(kept.map(\.rowID) == [invoice])
+  #expect(messages.contains { $0.rowID == photo })
+  #expect(try messages.allSatisfy { try store.allows($0, by: MessageFilter()) })
+}
+
 @Test
 func messagesAfterReturnsMessages() throws {
   let store = try TestDatabase.makeStore()
@@ -275,6 +377,78 @@ func messagesReplyToGuidHandlesNoPrefix() throws {
   #expect(reply?.replyToGUID == "msg-guid-1")
 }
 
+@Test
+func schemaVersionReadsClientVersion() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  #expect(try store.schemaVersion() == nil)
+
+  try fake.execute(
+    """
+    CREATE TABLE _SqliteDatabaseProperties (key TEXT, value TEXT);
+    INSERT INTO _SqliteDatabaseProperties(key, value) VALUES ('_ClientVersion', '18026');
+    """)
+  #expect(try store.schemaVersion() == "18026")
+}
+
+@Test
+func senderAliasesGroupOutgoingCallerIDs() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15550000000", participants: ["+15550000000"])
+  let now = Date()
+  let rows: [(sender: String?, service: String, account: String)] = [
+    (nil, "iMessage", "e:me@icloud.com"),
+    (nil, "iMessage", "e:me@icloud.com"),
+    (nil, "SMS", "p:+15551234567"),
+    ("+15550000000", "iMessage", "p:+15559999999"),
+  ]
+  for (offset, row) in rows.enumerated() {
+    try fake.addMessage(
+      chatID: chat, text: "hi", sender: row.sender,
+      date: now.addingTimeInterval(Double(offset)), service: row.service, account: row.account)
+  }
+  let store = try fake.makeStore()
+  let aliases = try store.senderAliases()
+  #expect(aliases.map(\.handle) == ["+15551234567", "me@icloud.com"])
+  #expect(aliases.first?.kind == "phone")
+  #expect(aliases.last?.kind == "email")
+  #expect(aliases.last?.messagesSent == 2)
+}
+
+@Test
+func groupChatLookupMatchesExactParticipants() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let pairID = try fake.addChat(
+    identifier: "chat100", name: "Pair", participants: ["+15551234567", "friend@example.com"])
+  let trioID = try fake.addChat(
+    identifier: "chat200", name: "Trio",
+    participants: ["+15551234567", "friend@example.com", "+15550000000"])
+  let store = try fake.makeStore()
+
+  let pair = try store.groupChat(participants: ["(555) 123-4567", "Friend@example.com"])
+  #expect(pair?.guid == "iMessage;+;chat100")
+  let trio = try store.groupChat(
+    participants: ["+15550000000", "+15551234567", "friend@example.com"])
+  #expect(trio?.id == trioID)
+  #expect(try store.groupChat(participants: ["+15551234567", "+15559999999"]) == nil)
+  #expect(try store.chatInfo(identifierOrGUID: "chat200")?.name == "Trio")
+  #expect(try store.chatInfo(identifierOrGUID: "iMessage;+;chat100")?.id == pairID)
+}
+
+@Test
+func attachmentsForMessageIDsBatchesLookups() throws {
+  let fake = try TestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  let batched = try store.attachments(forMessageIDs: [1, 2, 3])
+  #expect(batched.keys.sorted() == [2])
+  #expect(batched[2] == (try store.attachments(for: 2)))
+  #expect(MessageStore.chunked(Array(1...1_201)).map(\.count) == [500, 500, 201])
+}
+
 @Test
 func attachmentsByMessageReturnsMetadata() throws {
   let store = try TestDatabase.makeStore()
@@ -354,3 +528,486 @@ func longRepeatedPatternMessage() throws {
   #expect(messages.first?.text == longText)
   #expect(messages.first?.text.count == longText.count)
 }
+
+@Test
+func storageAuditCountsMissingAndOrphanedAttachments() throws {
+  let fake = try TestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  let root = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try FileManager.default.createDirectory(at: root, withIntermediateDirectories: true)
+  defer { try? FileManager.default.removeItem(at: root) }
+  try Data("stale".utf8).write(to: root.appendingPathComponent("orphan.jpg"))
+
+  let audit = try store.storageAudit(attachmentsRoot: root.path)
+  #expect(audit.totalMessages == 3)
+  #expect(audit.totalAttachments == 1)
+  #expect(audit.missing.count == 1)
+  #expect(audit.orphaned?.map { ($0 as NSString).lastPathComponent } == ["orphan.jpg"])
+  #expect(audit.orphanedBytes == 5)
+  #expect(audit.chats.first?.chatID == 1)
+  #expect(audit.chats.first?.messages == 3)
+  #expect(audit.chats.first?.missing == 1)
+}
+
+@Test
+func pooledConnectionsReuseStatementsAndSeeNewRows() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15550001", name: "Chat 1", participants: ["+15550001"])
+  for index in 1...3 {
+    try fake.addMessage(chatID: chat, text: "message \(index)", sender: "+15550001")
+  }
+  let store = try fake.makeStore()
+
+  #expect(try store.maxRowID() == 3)
+  #expect(try store.messagesAfter(afterRowID: 0, chatID: chat, limit: 10).count == 3)
+  #expect(try store.chatInfo(chatID: chat)?.name == "Chat 1")
+
+  try fake.addMessage(chatID: chat, text: "fresh", sender: "+15550001")
+
+  #expect(try store.maxRowID() == 4)
+  #expect(try store.messagesAfter(afterRowID: 3, chatID: chat, limit: 10).map(\.text) == ["fresh"])
+  #expect(try store.chatInfo(chatID: chat)?.name == "Chat 1")
+
+  // Concurrent readers each get a connection of their own and see the same rows.
+  let results = ConcurrentResults()
+  DispatchQueue.concurrentPerform(iterations: 8) { _ in
+    let count = (try? store.messagesAfter(afterRowID: 0, chatID: chat, limit: 10).count) ?? -1
+    results.append(count)
+  }
+  #expect(results.values == Array(repeating: 4, count: 8))
+}
+
+@Test
+func readOnlyStoreReadsRowsStillInTheWAL() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let path = fake.path
+  let chat = try fake.addChat(identifier: "+15550001", participants: ["+15550001"])
+  for index in 1...2 {
+    try fake.addMessage(chatID: chat, text: "message \(index)", sender: "+15550001")
+  }
+
+  // The fake keeps its writer open; with checkpoints off the new row only exists in chat.db-wal.
+  try fake.execute("PRAGMA journal_mode = WAL; PRAGMA wal_autocheckpoint = 0;")
+  try fake.addMessage(chatID: chat, text: "only in the wal", sender: "+15550001")
+
+  let store = try fake.makeStore()
+  #expect(try store.maxRowID() == 3)
+  let fresh = try store.messagesAfter(afterRowID: 2, chatID: chat, limit: 10)
+  #expect(fresh.map(\.text) == ["only in the wal"])
+
+  let status = DatabaseWAL.inspect(path: path)
+  #expect(status.isWAL == true)
+  #expect(status.walFrames > 0)
+  let pending = try #require(status.pendingFrames)
+  #expect(pending > 0 && pending <= status.walFrames)
+  #expect(status.issues.isEmpty)
+  let lagging = DatabaseWAL.inspect(path: path, lagFrameThreshold: 0)
+  #expect(lagging.issues == [.checkpointLag(frames: pending)])
+  // A checkpoint leaves the WAL file at its size, but nothing in it is pending any more.
+  try fake.execute("PRAGMA wal_checkpoint(PASSIVE);")
+  let checkpointed = DatabaseWAL.inspect(path: path, lagFrameThreshold: 0)
+  #expect(checkpointed.walFrames == status.walFrames)
+  #expect(checkpointed.pendingFrames == 0)
+  #expect(checkpointed.issues.isEmpty)
+  let none = URL(fileURLWithPath: path).deletingLastPathComponent()
+    .appendingPathComponent("none.db")
+  #expect(DatabaseWAL.inspect(path: none.path).issues == [])
+}
+
+@Test
+func serviceChangeTrackerReportsSwitchesWithAccount() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15557654321", participants: ["+15557654321"])
+  let now = Date()
+  let rows: [(service: String, account: String)] = [
+    ("iMessage", "e:me@icloud.com"),
+    ("iMessage", "e:me@icloud.com"),
+    ("SMS", "p:+15551234567"),
+    ("SMS", "p:+15551234567"),
+    ("iMessage", "e:me@icloud.com"),
+  ]
+  var rowIDs: [Int64] = []
+  for (offset, row) in rows.enumerated() {
+    rowIDs.append(
+      try fake.addMessage(
+        chatID: chat, text: "hi", sender: "+15557654321",
+        date: now.addingTimeInterval(Double(offset)), service: row.service,
+        account: row.account))
+  }
+  let store = try fake.makeStore()
+  // Start mid-thread: the first message seen is compared with the chat's earlier history.
+  let messages = try store.messagesAfter(afterRowID: rowIDs[1], chatID: nil, limit: 10)
+  #expect(messages.first?.account == "p:+15551234567")
+  var tracker = ServiceChangeTracker(store: store)
+  let changes = try messages.compactMap { try tracker.observe($0) }
+  #expect(changes.map(\.rowID) == [rowIDs[2], rowIDs[4]])
+  #expect(changes.first?.from == "iMessage")
+  #expect(changes.first?.to == "SMS")
+  #expect(changes.first?.account == "p:+15551234567")
+}
+
+@Test
+func searchMatchesChatsMessagesAndAttachmentNames() throws {
+  let fake = try TestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  #expect(try store.searchMessages(query: "HI B", limit: 10).map(\.rowID) == [2])
+  #expect(try store.searchMessages(query: "h", limit: 1).map(\.rowID) == [3])
+  #expect(try store.searchMessages(query: "100%", limit: 10).isEmpty)
+  #expect(try store.searchMessages(query: "h", limit: 0).isEmpty)
+  #expect(try store.searchMessages(query: "HI B", chatID: 1, limit: 10).map(\.chatID) == [1])
+  #expect(try store.listChats(limit: 10, matching: "test chat").map(\.id) == [1])
+  #expect(try store.listChats(limit: 10, matching: "Me").map(\.id) == [1])
+  #expect(try store.listChats(limit: 10, matching: "nobody").isEmpty)
+  let files = try store.searchAttachments(query: "TEST.d", limit: 10)
+  #expect(files.map(\.messageRowID) == [2])
+  #expect(files.first?.meta.transferName == "test.dat")
+  #expect(try store.searchAttachments(query: "test_dat", limit: 10).isEmpty)
+}
+
+@Test
+func messagesByRowIDsAndGuidsKeepTheRequestedOrder() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let first = try fake.addMessage(chatID: chat, text: "one", guid: "GUID-1")
+  let second = try fake.addMessage(
+    chatID: chat, text: "two", sender: "+15551234567", guid: "GUID-2")
+  let store = try fake.makeStore()
+  let byRowID = try store.messages(rowIDs: [second, 999, first, second])
+  #expect(byRowID.map(\.rowID) == [second, first])
+  #expect(byRowID.map(\.text) == ["two", "one"])
+  let byGUID = try store.messages(guids: ["GUID-2", "missing", "GUID-1"])
+  #expect(byGUID.map(\.rowID) == [second, first])
+  #expect(try store.messages(rowIDs: []).isEmpty)
+  let many = try store.messages(rowIDs: Array(1...1_200).map(Int64.init))
+  #expect(many.map(\.rowID) == [first, second])
+}
+
+@Test
+func dateRangesAreAppliedBeforeTheLimit() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let day: TimeInterval = 86_400
+  let now = Date()
+  let old = try fake.addMessage(
+    chatID: chat, text: "last year", date: now.addingTimeInterval(-365 * day))
+  for offset in 1...5 {
+    try fake.addMessage(
+      chatID: chat, text: "recent \(offset)", date: now.addingTimeInterval(-Double(offset) * day))
+  }
+  let store = try fake.makeStore()
+  let filter = MessageFilter(
+    startDate: now.addingTimeInterval(-400 * day), endDate: now.addingTimeInterval(-300 * day))
+  let inRange = try store.messages(chatID: chat, limit: 2, dateRange: filter.dateRange)
+  #expect(inRange.map(\.rowID) == [old])
+  var scanned: [Int64] = []
+  try store.scanMessages(chatID: chat, limit: 2, dateRange: filter.dateRange) {
+    scanned += $0.map(\.rowID)
+  }
+  #expect(scanned == [old])
+  let since = MessageFilter(startDate: now.addingTimeInterval(-2.5 * day)).dateRange
+  #expect(try store.messages(chatID: chat, limit: 10, dateRange: since).count == 2)
+  let until = MessageFilter(endDate: now.addingTimeInterval(-300 * day)).dateRange
+  #expect(try store.messages(chatID: chat, limit: 10, dateRange: until).map(\.rowID) == [old])
+  #expect(MessageFilter().dateRange == nil)
+  let backwards = MessageFilter(startDate: now, endDate: now.addingTimeInterval(-day))
+  #expect(backwards.dateRange?.isEmpty == true)
+}
+
+@Test
+func dateRangesMatchSecondsAndNanosecondsRowsThroughTheDateIndex() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let day: TimeInterval = 86_400
+  let now = Date()
+  let inSeconds = try fake.addMessage(
+    chatID: chat, text: "old format", date: now.addingTimeInterval(-2 * day))
+  let inNanoseconds = try fake.addMessage(
+    chatID: chat, text: "new format", date: now.addingTimeInterval(-day))
+  try fake.addMessage(chatID: chat, text: "too old", date: now.addingTimeInterval(-10 * day))
+  let seconds = AppleTime.raw(from: now.addingTimeInterval(-2 * day), unit: .seconds)
+  try fake.run("UPDATE message SET date = ? WHERE ROWID = ?", seconds, inSeconds)
+  let store = try fake.makeStore()
+  let range = MessageFilter(startDate: now.addingTimeInterval(-3 * day)).dateRange!
+  let found = try store.messages(chatID: chat, limit: 10, dateRange: range)
+  #expect(Set(found.map(\.rowID)) == [inSeconds, inNanoseconds])
+
+  var bindings: [Binding?] = []
+  let condition = MessageStore.dateCondition(range, bindings: &bindings)
+  let db = try Connection(fake.path, readonly: true)
+  let plan = try db.prepare(
+    "EXPLAIN QUERY PLAN SELECT m.ROWID FROM message m WHERE 1\(condition)", bindings
+  ).map { String(describing: $0[3] ?? "") }
+  #expect(plan.contains { $0.contains("message_idx_date") })
+  #expect(!plan.contains { $0.hasPrefix("SCAN") })
+}
+
+@Test
+func participantFiltersResolveHandlesInSQL() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(
+    identifier: "chat200", name: "Team", participants: ["+15551230001", "ana@example.com"])
+  let now = Date()
+  let fromBob = try fake.addMessage(
+    chatID: chat, text: "bob", sender: "+15551230001", date: now.addingTimeInterval(-60))
+  for offset in 1...3 {
+    try fake.addMessage(
+      chatID: chat, text: "ana \(offset)", sender: "ana@example.com",
+      date: now.addingTimeInterval(Double(offset)))
+  }
+  let store = try fake.makeStore()
+  let filter = MessageFilter(participants: ["(555) 123-0001"])
+  let handles = try store.senderHandleIDs(for: filter)
+  #expect(handles?.count == 1)
+  let newest = try store.messages(chatID: chat, limit: 1, handleIDs: handles)
+  #expect(newest.map(\.rowID) == [fromBob])
+  var scanned: [Int64] = []
+  try store.scanMessages(chatID: chat, limit: 1, handleIDs: handles) { scanned += $0.map(\.rowID) }
+  #expect(scanned == [fromBob])
+  let ana = try store.senderHandleIDs(for: MessageFilter(participants: ["ANA@example.com"]))
+  #expect(try store.messages(chatID: chat, limit: 10, handleIDs: ana).count == 3)
+  let nobody = try store.senderHandleIDs(for: MessageFilter(participants: ["+447700900123"]))
+  #expect(nobody == [])
+  #expect(try store.messages(chatID: chat, limit: 10, handleIDs: nobody).isEmpty)
+  #expect(try store.senderHandleIDs(for: MessageFilter()) == nil)
+}
+
+@Test
+func listChatsSortsAndCountsMessages() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let now = Date()
+  let mom = try fake.addChat(
+    identifier: "+15551230001", name: "Mom", participants: ["+15551230001"])
+  let team = try fake.addChat(
+    identifier: "chat300", name: "book club", participants: ["+15551230002", "+15551230003"])
+  let ana = try fake.addChat(identifier: "ana@example.com", participants: ["ana@example.com"])
+  try fake.addMessage(chatID: mom, text: "call me", sender: "+15551230001", date: now)
+  for offset in 1...3 {
+    let date = now.addingTimeInterval(-Double(offset) * 60)
+    let message = try fake.addMessage(
+      chatID: team, text: "chapter \(offset)", sender: "+15551230002", date: date)
+    try fake.addReaction(to: message, type: .like, date: date)
+  }
+  try fake.addMessage(chatID: ana, text: "hi", date: now.addingTimeInterval(-3_600))
+  let store = try fake.makeStore()
+  #expect(try store.listChats(limit: 10).map(\.id) == [mom, team, ana])
+  #expect(try store.listChats(limit: 10, sort: .name).map(\.id) == [ana, team, mom])
+  let busiest = try store.listChats(limit: 1, sort: .messageCount)
+  #expect(busiest.map(\.id) == [team])
+  #expect(busiest.first?.messageCount == 3)
+  #expect(try store.listChats(limit: 10, matching: "MOM").map(\.id) == [mom])
+  #expect(try store.listChats(limit: 10, matching: "chat3").map(\.id) == [team])
+}
+
+
+@Test
+func cloudSyncStatusCountsSyncStatesAndMarkers() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  // What a Mac syncing Messages in iCloud adds to chat.db.
+  try fake.execute(
+    """
+    ALTER TABLE message ADD COLUMN ck_sync_state INTEGER DEFAULT 0;
+    ALTER TABLE chat ADD COLUMN ck_sync_state INTEGER DEFAULT 0;
+    ALTER TABLE attachment ADD COLUMN ck_sync_state INTEGER DEFAULT 0;
+    ALTER TABLE attachment ADD COLUMN ck_record_id TEXT;
+    CREATE TABLE sync_deleted_messages (ROWID INTEGER PRIMARY KEY, guid TEXT, recordID TEXT);
+    CREATE TABLE kvtable (ROWID INTEGER PRIMARY KEY, key TEXT UNIQUE, value BLOB);
+    """)
+  let chat = try fake.addChat(identifier: "+123", participants: ["+123"])
+  try fake.run("UPDATE chat SET ck_sync_state = 1 WHERE ROWID = ?", chat)
+  let synced = Date(timeIntervalSince1970: 1_700_000_000)
+  let rows: [(text: String, sender: String?, offset: TimeInterval, state: Int64)] = [
+    ("old", "+123", -60, 1), ("newer", nil, 0, 1), ("fresh", nil, 60, 0), ("odd", "+123", 120, 4),
+  ]
+  let rowIDs = try rows.map { row in
+    try fake.addMessage(
+      chatID: chat, text: row.text, sender: row.sender,
+      date: synced.addingTimeInterval(row.offset), columns: ["ck_sync_state": row.state])
+  }
+  let inCloud = try fake.addAttachment(FakeAttachment(path: "/nonexistent/a.jpg"), to: rowIDs[0])
+  try fake.run(
+    "UPDATE attachment SET ck_sync_state = 1, ck_record_id = 'rec-1' WHERE ROWID = ?", inCloud)
+  try fake.addAttachment(FakeAttachment(path: "/nonexistent/b.jpg"), to: rowIDs[0])
+  try fake.run(
+    "INSERT INTO sync_deleted_messages(guid, recordID) VALUES ('G1', 'r1'), ('G2', 'r2')")
+  let stamp = try PropertyListSerialization.data(
+    fromPropertyList: synced, format: .binary, options: 0)
+  try fake.run(
+    "INSERT INTO kvtable(key, value) VALUES ('lastSyncDate', ?), ('unrelated', 'x')",
+    Blob(bytes: [UInt8](stamp)))
+  let store = try fake.makeStore()
+
+  let status = try store.cloudSyncStatus()
+  #expect(status.hasCloudKitColumns)
+  #expect(status.messages == CloudSyncCounts(total: 4, synced: 2, pendingUpload: 1))
+  #expect(status.messages?.other == 1)
+  #expect(status.chats == CloudSyncCounts(total: 1, synced: 1, pendingUpload: 0))
+  #expect(status.attachments == CloudSyncCounts(total: 2, synced: 1, pendingUpload: 1))
+  #expect(status.attachmentsInCloudOnly == 1)
+  #expect(abs((status.lastSyncedMessageAt?.timeIntervalSince(synced)) ?? 99) < 1)
+  #expect(status.pendingDeletions == 2)
+  #expect(status.markers.map(\.key) == ["lastSyncDate"])
+  #expect(status.markers.first?.value == "2023-11-14T22:13:20Z")
+
+  let legacy = try TestDatabase.makeStore().cloudSyncStatus()
+  #expect(!legacy.hasCloudKitColumns && legacy.messages == nil && legacy.markers.isEmpty)
+}
+
+@Test
+func integrityReportFindsBrokenJoinsAndRowIDGaps() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  try fake.execute("ALTER TABLE attachment ADD COLUMN ck_record_id TEXT")
+  let chat = try fake.addChat(identifier: "+123", participants: ["+123"])
+  try fake.addMessage(
+    chatID: chat, text: "x", sender: "+123",
+    attachments: [FakeAttachment(path: "/nonexistent/a.jpg")])
+  try fake.addMessage(chatID: chat, text: "x", sender: "+123")
+  try fake.run("UPDATE attachment SET ck_record_id = 'rec-1'")
+  try fake.run("INSERT INTO attachment(guid, filename) VALUES ('b', '/nonexistent/b.jpg')")
+  // The damage a bad restore or sync leaves: rowid gaps, a sender handle that is gone, a
+  // message in no chat, and joins pointing at rows that don't exist.
+  try fake.run(
+    """
+    INSERT INTO message(ROWID, guid, handle_id, text, date)
+    VALUES (6, 'gap-6', 9, 'x', 0), (7, 'gap-7', 0, 'x', 0), (10, 'gap-10', 1, 'x', 0)
+    """)
+  try fake.run("DELETE FROM message WHERE ROWID = 10")
+  try fake.run(
+    "INSERT INTO chat_message_join(chat_id, message_id) VALUES (?, 6), (?, 99)", chat, chat)
+  try fake.run("INSERT INTO message_attachment_join(message_id, attachment_id) VALUES (2, 3)")
+  let store = try fake.makeStore()
+
+  let report = try store.integrityReport()
+  #expect(report.integrityErrors.isEmpty)
+  #expect(report.messagesWithoutChat == 1)
+  #expect(report.danglingChatMessageJoins == 1)
+  #expect(report.danglingAttachmentJoins == 1)
+  #expect(report.messagesWithMissingHandle == 1)
+  #expect(report.attachmentsWithFile == 2)
+  #expect(report.attachmentsMissingFile == 2)
+  #expect(report.attachmentsMissingFileInCloud == 1)
+  #expect(report.messageCount == 4 && report.minRowID == 1 && report.maxRowID == 7)
+  #expect(report.missingRowIDs == 3)
+  #expect(report.largestGap == RowIDGap(after: 2, before: 6))
+  #expect(report.rowIDSequence == 10 && report.sequenceAhead)
+}
+
+@Test
+func personListsEveryChatWithTotals() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let direct = try fake.addChat(identifier: "+14155551212", participants: ["+14155551212"])
+  let trip = try fake.addChat(
+    identifier: "chat42", name: "Trip", participants: ["4155551212", "+16502530000"])
+  let other = try fake.addChat(identifier: "+16502530000", participants: ["+16502530000"])
+  let base = Date(timeIntervalSince1970: 1_700_000_000)
+  let image = FakeAttachment(path: "a.jpg", mimeType: "image/jpeg", totalBytes: 100)
+  let video = FakeAttachment(path: "b.mov", mimeType: "video/quicktime", totalBytes: 1000)
+  let rows: [(chat: Int64, sender: String?, offset: TimeInterval, files: [FakeAttachment])] = [
+    (direct, "+14155551212", 0, [image]), (direct, nil, 60, []), (trip, "4155551212", 120, []),
+    (trip, "+16502530000", 180, [video]), (other, "+16502530000", 240, []),
+  ]
+  for row in rows {
+    try fake.addMessage(
+      chatID: row.chat, text: "x", sender: row.sender, date: base.addingTimeInterval(row.offset),
+      attachments: row.files)
+  }
+  let store = try fake.makeStore()
+
+  let person = try #require(try store.person(handle: "(415) 555-1212"))
+  #expect(person.handle == "+14155551212")
+  #expect(person.handleIDs == ["+14155551212", "4155551212"])
+  #expect(person.chats.map(\.chat.id) == [trip, direct])
+  let group = person.chats[0]
+  #expect(group.isGroup && group.chat.name == "Trip")
+  // The video in the group came from +16502530000, so it isn't this person's.
+  #expect(group.messages == 2 && group.fromPerson == 1 && group.attachments == 0)
+  func seconds(_ date: Date?) -> Int? {
+    date.map { Int($0.timeIntervalSince(base).rounded()) }
+  }
+  #expect(seconds(group.firstDate) == 120 && seconds(group.lastDate) == 180)
+  let oneToOne = person.chats[1]
+  #expect(!oneToOne.isGroup && oneToOne.messages == 2 && oneToOne.fromPerson == 1)
+  #expect(seconds(oneToOne.firstDate) == 0 && seconds(oneToOne.lastDate) == 60)
+  #expect(person.messages == 4 && person.fromPerson == 2)
+  #expect(person.attachmentKinds == ["image": 1])
+  #expect(person.attachmentBytes == 100)
+  #expect(try store.person(handle: "+12025550100") == nil)
+}
+
+@Test
+func recoverableMessagesComeFromRecentlyDeleted() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  #expect(try store.recoverableMessages(limit: 10).isEmpty)
+
+  // macOS 13 moves a deleted message's chat join here for 30 days.
+  try fake.execute(
+    """
+    CREATE TABLE chat_recoverable_message_join (
+      chat_id INTEGER, message_id INTEGER, delete_date INTEGER, ck_sync_state INTEGER
+    );
+    """)
+  let first = try fake.addChat(identifier: "+14155551212", participants: ["+14155551212"])
+  let second = try fake.addChat(identifier: "+16502530000", participants: ["+16502530000"])
+  let base = Date(timeIntervalSince1970: 1_700_000_000)
+  try fake.addMessage(chatID: first, text: "kept", sender: "+14155551212", date: base)
+  let deletions: [(chat: Int64, text: String, after: TimeInterval)] = [
+    (second, "oops", 7_200), (first, "older mistake", 3_600),
+  ]
+  var deletedIDs: [Int64] = []
+  for deletion in deletions {
+    let rowID = try fake.addMessage(
+      chatID: deletion.chat, text: deletion.text, sender: "+14155551212", date: base)
+    try fake.run("DELETE FROM chat_message_join WHERE message_id = ?", rowID)
+    try fake.run(
+      """
+      INSERT INTO chat_recoverable_message_join(chat_id, message_id, delete_date)
+      VALUES (?, ?, ?)
+      """,
+      deletion.chat, rowID, AppleTime.raw(from: base.addingTimeInterval(deletion.after)))
+    deletedIDs.append(rowID)
+  }
+
+  let deleted = try store.recoverableMessages(limit: 10)
+  #expect(deleted.map(\.message.text) == ["oops", "older mistake"])
+  #expect(deleted.map(\.message.chatID) == [second, first])
+  #expect(deleted.first?.message.sender == "+14155551212")
+  let newest = try #require(deleted.first)
+  let expires = newest.deletedAt.addingTimeInterval(MessageStore.recoveryWindow)
+  #expect(newest.expiresAt == expires)
+  #expect(abs(newest.remaining(at: expires.addingTimeInterval(-86_400)) - 86_400) < 0.001)
+  #expect(newest.remaining(at: expires.addingTimeInterval(60)) == 0)
+  let inFirst = try store.recoverableMessages(chatID: first, limit: 10)
+  #expect(inFirst.map(\.message.rowID) == [deletedIDs[1]])
+  #expect(try store.recoverableMessages(limit: 1).count == 1)
+}
+
+private final class ConcurrentResults: @unchecked Sendable {
+  private let lock = NSLock()
+  private var stored: [Int] = []
+
+  var values: [Int] {
+    lock.lock()
+    defer { lock.unlock() }
+    return stored
+  }
+
+  func append(_ value: Int) {
+    lock.lock()
+    stored.append(value)
+    lock.unlock()
+  }
+}
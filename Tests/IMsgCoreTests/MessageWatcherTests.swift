@@ -1,4 +1,5 @@
 import Foundation
+import IMsgTesting
 import SQLite
 import Testing
 
@@ -43,6 +44,14 @@ private enum WatcherTestDatabase {
     return try MessageStore(
       connection: db, path: ":memory:", hasAttributedBody: false, hasReactionColumns: false)
   }
+
+  /// One chat holding a single "hello" from +123.
+  static func make() throws -> FakeChatDatabase {
+    let fake = try FakeChatDatabase()
+    let chat = try fake.addChat(identifier: "+123", participants: ["+123"])
+    try fake.addMessage(chatID: chat, text: "hello", sender: "+123")
+    return fake
+  }
 }
 
 @Test
@@ -63,3 +72,157 @@ func messageWatcherYieldsExistingMessages() async throws {
   let message = try await task.value
   #expect(message?.text == "hello")
 }
+
+@Test
+func messageWatchHubReplaysPerSubscriberAndStopsWithTheLast() async throws {
+  let fake = try WatcherTestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  let hub = MessageWatchHub(
+    store: store,
+    configuration: MessageWatcherConfiguration(debounceInterval: 0.01, batchLimit: 10))
+  let replaying = try hub.subscribe(sinceRowID: -1)
+  do {
+    let live = try hub.subscribe()
+    #expect(hub.subscriberCount == 2)
+    withExtendedLifetime(live) {}
+  }
+
+  let task = Task { () throws -> Message? in
+    for try await event in replaying {
+      if case .message(let message) = event { return message }
+    }
+    return nil
+  }
+  #expect(try await task.value?.text == "hello")
+
+  for _ in 0..<20 where hub.subscriberCount > 0 {
+    try await Task.sleep(nanoseconds: 10_000_000)
+  }
+  #expect(hub.subscriberCount == 0)
+}
+
+@Test
+func messageWatcherReopensReplacedDatabase() async throws {
+  func database(messages: Int) throws -> FakeChatDatabase {
+    let fake = try FakeChatDatabase()
+    let chat = try fake.addChat(identifier: "+15550001", participants: ["+15550001"])
+    for index in 1...messages {
+      try fake.addMessage(chatID: chat, text: "message \(index)", sender: "+15550001")
+    }
+    return fake
+  }
+  let fake = try database(messages: 3)
+  defer { fake.remove() }
+  let path = fake.path
+  let store = try fake.makeStore()
+  let watcher = MessageWatcher(store: store)
+  let stream = watcher.events(
+    chatID: nil,
+    sinceRowID: 3,
+    configuration: MessageWatcherConfiguration(debounceInterval: 0.01, healthCheckInterval: 0.05)
+  )
+
+  // Swap in a rebuilt database (new inode) with one more message.
+  let replacement = try database(messages: 4)
+  defer { replacement.remove() }
+  try FileManager.default.removeItem(atPath: path)
+  try FileManager.default.moveItem(atPath: replacement.path, toPath: path)
+
+  let task = Task { () throws -> [MessageWatchEvent] in
+    var events: [MessageWatchEvent] = []
+    for try await event in stream {
+      events.append(event)
+      if case .message = event { break }
+    }
+    return events
+  }
+  let events = try await task.value
+  guard case .reconnected(let reconnect) = events.first else {
+    Issue.record("expected reconnect event first")
+    return
+  }
+  #expect(reconnect.reason == .replaced)
+  #expect(reconnect.resumeRowID == 3)
+  guard case .message(let message) = events.last else {
+    Issue.record("expected a message after reconnect")
+    return
+  }
+  #expect(message.rowID == 4)
+}
+
+@Test
+func messageWatcherSendsHeartbeatsWithTheLastRowID() async throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let first = try fake.addMessage(chatID: chat, text: "before", sender: "+15551234567")
+  let watcher = MessageWatcher(store: try fake.makeStore())
+  let stream = watcher.events(
+    configuration: MessageWatcherConfiguration(debounceInterval: 0.01, heartbeatInterval: 0.05))
+  var iterator = stream.makeAsyncIterator()
+  guard case .heartbeat(let quiet) = try await iterator.next() else {
+    Issue.record("expected a heartbeat while nothing arrives")
+    return
+  }
+  #expect(quiet.lastRowID == first)
+
+  let next = try fake.addMessage(chatID: chat, text: "after", sender: "+15551234567")
+  var sawMessage = false
+  while let event = try await iterator.next() {
+    if case .message(let message) = event {
+      #expect(message.rowID == next)
+      sawMessage = true
+    }
+    if case .heartbeat(let heartbeat) = event, heartbeat.lastRowID == next { break }
+  }
+  #expect(sawMessage)
+}
+
+@Test
+func messageWatcherReportsReactionsEditsUnsendsAndReads() async throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let plan = try fake.addMessage(chatID: chat, text: "see you at 6", sender: "+15551234567")
+  let typo = try fake.addMessage(chatID: chat, text: "wrong chat", sender: "+15551234567")
+  let reply = try fake.addMessage(chatID: chat, text: "ok")
+  let watcher = MessageWatcher(store: try fake.makeStore(), reopen: nil)
+  let stream = watcher.events(
+    configuration: MessageWatcherConfiguration(debounceInterval: 0.01, events: .all))
+
+  let task = Task { () throws -> [MessageWatchEvent] in
+    var events: [MessageWatchEvent] = []
+    for try await event in stream {
+      events.append(event)
+      if events.count == 5 { break }
+    }
+    return events
+  }
+  // The first poll only records the existing messages' state.
+  try await Task.sleep(nanoseconds: 200_000_000)
+  try fake.addReaction(to: reply, type: .love, sender: "+15551234567")
+  try fake.editMessage(plan, text: "see you at 7")
+  try fake.unsendMessage(typo)
+  try fake.setReceipt(messageID: reply, delivered: Date(), read: Date())
+  try await Task.sleep(nanoseconds: 200_000_000)
+  let later = try fake.addMessage(chatID: chat, text: "on my way", sender: "+15551234567")
+
+  let events = try await task.value
+  guard events.count == 5, case .reaction(let reaction) = events[0],
+    case .edited(let edit) = events[1], case .deleted(let deletion) = events[2],
+    case .receipt(let receipt) = events[3], case .message(let message) = events[4]
+  else {
+    Issue.record("unexpected events: \(events)")
+    return
+  }
+  #expect(reaction.reaction.reactionType == .love)
+  #expect(reaction.reaction.associatedMessageID == reply)
+  #expect(!reaction.isRemoval)
+  #expect(edit.message.rowID == plan)
+  #expect(edit.message.text == "see you at 7")
+  #expect(edit.previousText == "see you at 6")
+  #expect(deletion.message.rowID == typo)
+  #expect(receipt.message.rowID == reply)
+  #expect(message.rowID == later)
+}
@@ -1,4 +1,8 @@
+import CoreGraphics
 import Foundation
+import IMsgTesting
+import ImageIO
+import SQLite
 import Testing
 
 @testable import IMsgCore
@@ -21,6 +25,32 @@ func attachmentResolverResolvesPaths() throws {
   #expect(directory.missing == true)
 }
 
+@Test
+func attachmentResolverLooksNextToAnotherUsersDatabase() throws {
+  let messages = FileManager.default.temporaryDirectory
+    .appendingPathComponent(UUID().uuidString)
+    .appendingPathComponent("Users/alex/Library/Messages")
+  defer { try? FileManager.default.removeItem(at: messages) }
+  let file = messages.appendingPathComponent("Attachments/ab/12/GUID/photo.jpg")
+  try FileManager.default.createDirectory(
+    at: file.deletingLastPathComponent(), withIntermediateDirectories: true)
+  try Data("jpg".utf8).write(to: file)
+
+  for recorded in [
+    "~/Library/Messages/Attachments/ab/12/GUID/photo.jpg",
+    "/Users/alex/Library/Messages/Attachments/ab/12/GUID/photo.jpg",
+  ] {
+    let found = AttachmentResolver.resolve(recorded, messagesDirectory: messages.path)
+    #expect(found.missing == false)
+    #expect(found.resolved == file.path)
+  }
+  let gone = AttachmentResolver.resolve(
+    "~/Library/Messages/Attachments/cd/34/GUID/gone.jpg", messagesDirectory: messages.path)
+  #expect(gone.missing)
+  #expect(gone.resolved.hasPrefix(NSHomeDirectory()))
+  #expect(AttachmentResolver.messagesRelativePath("/tmp/photo.jpg") == nil)
+}
+
 @Test
 func attachmentResolverDisplayNamePrefersTransfer() {
   #expect(
@@ -70,6 +100,87 @@ func messageFilterHonorsParticipantsAndDates() throws {
   #expect(pastFilter.allows(message) == false)
 }
 
+@Test
+func messageFilterMatchesTextPattern() throws {
+  let message = Message(
+    rowID: 1,
+    chatID: 1,
+    sender: "+123",
+    text: "Your code is 123456",
+    date: Date(),
+    isFromMe: false,
+    service: "SMS",
+    handleID: nil,
+    attachmentsCount: 0
+  )
+  let sensitive = try MessageFilter.fromISO(
+    participants: [], startISO: nil, endISO: nil, textPattern: "CODE IS")
+  #expect(sensitive.allows(message) == false)
+  let insensitive = try MessageFilter.fromISO(
+    participants: [], startISO: nil, endISO: nil, textPattern: "CODE IS [0-9]+",
+    caseInsensitive: true)
+  #expect(insensitive.allows(message) == true)
+
+  let attachmentOnly = Message(
+    rowID: 2,
+    chatID: 1,
+    sender: "+123",
+    text: "",
+    date: Date(),
+    isFromMe: false,
+    service: "SMS",
+    handleID: nil,
+    attachmentsCount: 1
+  )
+  let anything = try MessageFilter.fromISO(
+    participants: [], startISO: nil, endISO: nil, textPattern: ".*")
+  #expect(anything.allows(attachmentOnly) == false)
+}
+
+@Test
+func messageFilterKeepsDetectedLanguages() {
+  func message(_ text: String) -> Message {
+    Message(
+      rowID: 1,
+      chatID: 1,
+      sender: "+123",
+      text: text,
+      date: Date(),
+      isFromMe: false,
+      service: "iMessage",
+      handleID: nil,
+      attachmentsCount: 0
+    )
+  }
+  let english = message("Are you still coming over for dinner tonight? Let me know soon.")
+  let german = message("Kommst du heute Abend noch zum Essen vorbei? Sag mir bitte Bescheid.")
+  #expect(MessageLanguage.detect(english.text) == "en")
+  #expect(MessageLanguage.detect(german.text) == "de")
+  #expect(MessageLanguage.detect("ok") == nil)
+  #expect(MessageLanguage.detect("https://example.com/trip/photos @Alex") == nil)
+
+  let filter = MessageFilter(languages: ["DE"])
+  #expect(filter.allows(german) == true)
+  #expect(filter.allows(english) == false)
+  #expect(MessageFilter(languages: ["und"]).allows(message("👍")) == true)
+  #expect(MessageLanguage.matches("zh-Hans", codes: ["zh"]))
+  #expect(!MessageLanguage.matches("zh-Hans", codes: ["z"]))
+  #expect(MessageLanguage.normalizedCode(" pt-BR ") == "pt-br")
+  #expect(MessageLanguage.normalizedCode("english") == nil)
+}
+
+@Test
+func messageFilterRejectsInvalidPattern() {
+  do {
+    _ = try MessageFilter.fromISO(participants: [], startISO: nil, endISO: nil, textPattern: "(")
+    #expect(Bool(false))
+  } catch let error as IMsgError {
+    #expect(error.errorDescription?.contains("Invalid regular expression") == true)
+  } catch {
+    #expect(Bool(false))
+  }
+}
+
 @Test
 func messageFilterRejectsInvalidISO() {
   do {
@@ -116,6 +227,130 @@ func phoneNumberNormalizerReturnsInputOnFailure() {
   #expect(normalized == "not-a-number")
 }
 
+@Test
+func automationPermissionMapsStatusCodes() {
+  #expect(MessagesAutomation.permissionStatus(for: 0) == .granted)
+  #expect(MessagesAutomation.permissionStatus(for: -1743) == .denied)
+  #expect(MessagesAutomation.permissionStatus(for: -1744) == .notDetermined)
+  #expect(MessagesAutomation.permissionStatus(for: -600) == .appNotRunning)
+  #expect(MessagesAutomation.permissionStatus(for: -1) == .unknown)
+}
+
+private final class LogCapture: @unchecked Sendable {
+  private let lock = NSLock()
+  private var storage: [String] = []
+
+  var lines: [String] {
+    lock.lock()
+    defer { lock.unlock() }
+    return storage
+  }
+
+  func append(_ line: String) {
+    lock.lock()
+    storage.append(line)
+    lock.unlock()
+  }
+}
+
+@Test
+func automationLogLevelParsesNames() {
+  #expect(AutomationLogLevel(name: "TRACE") == .trace)
+  #expect(AutomationLogLevel(name: "debug") == .debug)
+  #expect(AutomationLogLevel(name: "warn") == .error)
+  #expect(AutomationLogLevel(name: "none") == .off)
+  #expect(AutomationLogLevel(name: "loud") == nil)
+  #expect(AutomationLogLevel.info < AutomationLogLevel.trace)
+}
+
+@Test
+func automationLoggerRedactsHandlesAndText() {
+  #expect(AutomationLogger.redactHandle("+16502530000") == "+1…00")
+  #expect(AutomationLogger.redactHandle("abc") == "***")
+  #expect(AutomationLogger.redactText("hello") == "<5 chars>")
+}
+
+@Test
+func automationLoggerNamesTheFailedQuery() throws {
+  let capture = LogCapture()
+  let logger = AutomationLogger(level: .error, sink: { capture.append($0) })
+  let db = try Connection(.inMemory)
+  try db.execute("CREATE TABLE t (x INTEGER UNIQUE); INSERT INTO t VALUES (1);")
+  do {
+    try db.run("INSERT INTO t VALUES (1)")
+    Issue.record("insert should have failed")
+  } catch {
+    logger.log(error, "poll failed", fields: ["command": "watch"])
+  }
+  let line = try #require(capture.lines.first)
+  #expect(line.hasPrefix("[imsg error] poll failed: "))
+  #expect(line.contains("sql=INSERT INTO t VALUES (1)"))
+  #expect(line.contains("command=watch"))
+  #expect(AutomationLogger.context(of: IMsgError.appleScriptFailure("x")).isEmpty)
+}
+
+@Test
+func messageSenderLogsRedactedInvocation() throws {
+  let capture = LogCapture()
+  let logger = AutomationLogger(level: .debug, sink: { capture.append($0) })
+  let sender = MessageSender(runner: { _, _ in }, logger: logger)
+  try sender.send(MessageSendOptions(recipient: "+16502530000", text: "secret plan"))
+  let output = capture.lines.joined(separator: "\n")
+  #expect(output.contains("<11 chars>"))
+  #expect(output.contains("secret plan") == false)
+  #expect(output.contains("send finished"))
+  #expect(output.contains("applescript source") == false)
+}
+
+@Test
+func messageSenderNativeBackendPassesRequestToHelper() throws {
+  let fileManager = FileManager.default
+  let tempDir = fileManager.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try fileManager.createDirectory(at: tempDir, withIntermediateDirectories: true)
+  defer { try? fileManager.removeItem(at: tempDir) }
+  let requestURL = tempDir.appendingPathComponent("request.json")
+  let helperURL = tempDir.appendingPathComponent(NativeSendHelper.executableName)
+  try "#!/bin/sh\ncat > '\(requestURL.path)'\n".write(
+    to: helperURL, atomically: true, encoding: .utf8)
+  try fileManager.setAttributes([.posixPermissions: 0o755], ofItemAtPath: helperURL.path)
+
+  #expect(
+    NativeSendHelper.locate(environment: [:], executableDirectory: tempDir)?.executableURL
+      == helperURL)
+  #expect(NativeSendHelper.locate(environment: [:], executableDirectory: nil) == nil)
+  let sender = MessageSender(
+    backend: .native, nativeHelper: NativeSendHelper(executableURL: helperURL))
+  try sender.send(MessageSendOptions(recipient: "(650) 253-0000", text: "hi"))
+  let request = try String(contentsOf: requestURL, encoding: .utf8)
+  #expect(
+    request == #"{"attachments":[],"recipient":"+16502530000","service":"imessage","text":"hi"}"#)
+
+  // Exits without reading its request, which must not take imsg down with SIGPIPE.
+  let failingURL = tempDir.appendingPathComponent("failing")
+  try "#!/bin/sh\necho 'not signed in' >&2\nexit 3\n".write(
+    to: failingURL, atomically: true, encoding: .utf8)
+  try fileManager.setAttributes([.posixPermissions: 0o755], ofItemAtPath: failingURL.path)
+  let failing = MessageSender(
+    backend: .native, nativeHelper: NativeSendHelper(executableURL: failingURL))
+  #expect(throws: IMsgError.self) {
+    try failing.send(MessageSendOptions(recipient: "", text: "x", chatGUID: "iMessage;+;chat1"))
+  }
+}
+
+@Test
+func messageSenderTraceLogsScriptSource() throws {
+  let capture = LogCapture()
+  let logger = AutomationLogger(level: .trace, sink: { capture.append($0) })
+  let sender = MessageSender(runner: { _, _ in }, logger: logger)
+  try sender.send(MessageSendOptions(recipient: "+16502530000", text: "secret plans"))
+  let output = capture.lines.joined(separator: "\n")
+  #expect(output.contains("applescript source"))
+  #expect(output.contains("tell application \"Messages\""))
+  #expect(output.contains("applescript arguments"))
+  #expect(!output.contains("secret plans"))
+  #expect(!output.contains("6502530000"))
+}
+
 @Test
 func messageSenderBuildsArguments() throws {
   var captured: [String] = []
@@ -131,11 +366,37 @@ func messageSenderBuildsArguments() throws {
       region: "US"
     )
   )
-  #expect(captured.count == 7)
+  #expect(captured.count == 8)
   #expect(captured[0] == "+16502530000")
   #expect(captured[2] == "imessage")
   #expect(captured[5].isEmpty)
   #expect(captured[6] == "0")
+  #expect(captured[7].isEmpty)
+}
+
+@Test
+func messageSenderStartsNewGroupWithRecipients() throws {
+  var captured: [String] = []
+  var capturedSource = ""
+  let sender = MessageSender(runner: { source, args in
+    capturedSource = source
+    captured = args
+  })
+  try sender.send(
+    MessageSendOptions(
+      recipient: "",
+      text: "hi all",
+      region: "US",
+      groupRecipients: ["(650) 253-0000", "friend@example.com"],
+      groupName: "Dinner"
+    )
+  )
+  #expect(capturedSource.contains("make new text chat"))
+  #expect(capturedSource.contains("set name of targetChat"))
+  #expect(
+    captured == [
+      "hi all", "imessage", "", "0", "Dinner", "", "+16502530000", "friend@example.com",
+    ])
 }
 
 @Test
@@ -209,6 +470,80 @@ func messageSenderStagesAttachmentsBeforeSend() throws {
   #expect(stagedData == payload)
 }
 
+@Test
+func messageSenderStagesEveryAttachmentInOrder() throws {
+  let fileManager = FileManager.default
+  let root = fileManager.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try fileManager.createDirectory(at: root, withIntermediateDirectories: true)
+  defer { try? fileManager.removeItem(at: root) }
+  let first = root.appendingPathComponent("a.jpg")
+  let second = root.appendingPathComponent("b.jpg")
+  try Data("a".utf8).write(to: first)
+  try Data("b".utf8).write(to: second)
+
+  var captured: [String] = []
+  var source = ""
+  let sender = MessageSender(
+    runner: { script, args in
+      source = script
+      captured = args
+    },
+    attachmentsSubdirectoryProvider: { root.appendingPathComponent("staged") }
+  )
+  try sender.send(
+    MessageSendOptions(
+      recipient: "+16502530000", attachmentPaths: [first.path, second.path], region: "US"))
+
+  let staged = captured[3].split(separator: "\n").map(String.init)
+  #expect(staged.map { URL(fileURLWithPath: $0).lastPathComponent } == ["a.jpg", "b.jpg"])
+  #expect(staged.allSatisfy { fileManager.fileExists(atPath: $0) })
+  #expect(captured[4] == "1")
+  #expect(source.contains("paragraphs of theFilePaths"))
+
+  // A missing file fails the whole send before anything is staged.
+  let missing = root.appendingPathComponent("missing.jpg").path
+  let emptyStage = root.appendingPathComponent("empty-stage")
+  let failing = MessageSender(runner: { _, _ in }, attachmentsSubdirectoryProvider: { emptyStage })
+  #expect(throws: IMsgError.self) {
+    try failing.send(
+      MessageSendOptions(
+        recipient: "+16502530000", attachmentPaths: [first.path, missing], region: "US"))
+  }
+  #expect(!fileManager.fileExists(atPath: emptyStage.path))
+}
+
+@Test
+func sendAttachmentsExpandGlobsAndValidateUpFront() throws {
+  let fileManager = FileManager.default
+  let root = fileManager.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try fileManager.createDirectory(at: root, withIntermediateDirectories: true)
+  defer { try? fileManager.removeItem(at: root) }
+  for name in ["b.heic", "a.heic", "notes.txt"] {
+    try Data(repeating: 1, count: 4).write(to: root.appendingPathComponent(name))
+  }
+  try Data().write(to: root.appendingPathComponent("empty.jpg"))
+
+  let accepted = try SendAttachments.resolve([
+    root.appendingPathComponent("*.heic").path,
+    root.appendingPathComponent("notes.txt").path,
+    root.appendingPathComponent("a.heic").path,
+  ])
+  #expect(
+    accepted.map { URL(fileURLWithPath: $0.path).lastPathComponent }
+      == ["a.heic", "b.heic", "notes.txt"])
+  #expect(accepted.allSatisfy { $0.bytes == 4 })
+
+  for bad in ["*.png", "empty.jpg", "missing.jpg", ""] {
+    let path = bad.isEmpty ? root.path : root.appendingPathComponent(bad).path
+    #expect(throws: IMsgError.self) {
+      try SendAttachments.resolve([path])
+    }
+  }
+  #expect(throws: IMsgError.self) {
+    try SendAttachments.resolve([root.appendingPathComponent("notes.txt").path], maxBytes: 2)
+  }
+}
+
 @Test
 func messageSenderThrowsWhenAttachmentsSubdirectoryIsReadOnly() throws {
   let fileManager = FileManager.default
@@ -318,3 +653,724 @@ func errorDescriptionsIncludeDetails() {
   #expect(permissionDescription.contains("Permission Error") == true)
   #expect(permissionDescription.contains("/tmp/chat.db") == true)
 }
+
+@Test
+func messagesAccountsParseTabSeparatedRows() {
+  let output = "E:me@icloud.com\tiMessage\tme@icloud.com\ttrue\tconnected\n"
+    + "SMS-1\tSMS\tSMS\tfalse\tdisconnected\nbroken row"
+  let accounts = MessagesAutomation.parseAccounts(output)
+  #expect(accounts.count == 2)
+  #expect(accounts[0].serviceType == "iMessage")
+  #expect(accounts[0].enabled == true)
+  #expect(accounts[1].isSMS)
+  #expect(accounts[1].enabled == false)
+}
+
+@Test
+func backupLocatorFindsIOSBackupDatabase() throws {
+  let root = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  let fileID = BackupLocator.iOSMessagesFileID
+  let shard = root.appendingPathComponent(String(fileID.prefix(2)))
+  try FileManager.default.createDirectory(at: shard, withIntermediateDirectories: true)
+  let manifest = try Connection(root.appendingPathComponent("Manifest.db").path)
+  try manifest.execute("CREATE TABLE Files (fileID TEXT, domain TEXT, relativePath TEXT);")
+  try manifest.run(
+    "INSERT INTO Files VALUES (?, 'HomeDomain', 'Library/SMS/sms.db')", fileID)
+  FileManager.default.createFile(atPath: shard.appendingPathComponent(fileID).path, contents: nil)
+
+  let path = try BackupLocator.chatDatabasePath(in: root.path)
+  #expect(path.hasSuffix("\(fileID.prefix(2))/\(fileID)"))
+}
+
+@Test
+func backupLocatorFindsTimeMachineDatabase() throws {
+  let root = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  let messages = root.appendingPathComponent("Macintosh HD - Data/Users/alex/Library/Messages")
+  try FileManager.default.createDirectory(at: messages, withIntermediateDirectories: true)
+  let dbPath = messages.appendingPathComponent("chat.db").path
+  FileManager.default.createFile(atPath: dbPath, contents: nil)
+
+  #expect(try BackupLocator.chatDatabasePath(in: root.path, userName: "alex") == dbPath)
+  #expect(throws: IMsgError.self) {
+    try BackupLocator.chatDatabasePath(in: root.path, userName: "sam")
+  }
+}
+
+@Test
+func unreadCursorStoreTracksChatsAndFloor() throws {
+  let file = FileManager.default.temporaryDirectory
+    .appendingPathComponent(UUID().uuidString)
+    .appendingPathComponent("unread.json")
+  let cursors = try UnreadCursorStore(databasePath: "/tmp/chat.db", fileURL: file)
+  #expect(cursors.cursor(chatID: 1) == 0)
+
+  cursors.acknowledge(through: 40, chatID: 1)
+  cursors.acknowledge(through: 10, chatID: 1)
+  cursors.acknowledge(through: 25, chatID: nil)
+  #expect(cursors.cursor(chatID: 1) == 40)
+  #expect(cursors.cursor(chatID: 2) == 25)
+  try cursors.save()
+
+  let reloaded = try UnreadCursorStore(databasePath: "/tmp/chat.db", fileURL: file)
+  #expect(reloaded.cursor(chatID: 1) == 40)
+  #expect(reloaded.floor == 25)
+  let otherDatabase = try UnreadCursorStore(databasePath: "/tmp/other.db", fileURL: file)
+  #expect(otherDatabase.floor == 0)
+}
+
+@Test
+func watchCursorStoreKeepsCursorPerDatabaseAndFilterSet() throws {
+  let file = FileManager.default.temporaryDirectory
+    .appendingPathComponent(UUID().uuidString)
+    .appendingPathComponent("watch.json")
+  let cursors = try WatchCursorStore(databasePath: "/tmp/chat.db", fileURL: file)
+  #expect(cursors.cursor(for: "chat=1") == nil)
+
+  cursors.record(40, for: "chat=1")
+  cursors.record(12, for: "chat=all")
+  try cursors.save()
+
+  let reloaded = try WatchCursorStore(databasePath: "/tmp/chat.db", fileURL: file)
+  #expect(reloaded.cursor(for: "chat=1") == 40)
+  #expect(reloaded.cursor(for: "chat=all") == 12)
+  reloaded.record(3, for: "chat=1")
+  #expect(reloaded.cursor(for: "chat=1") == 3)
+  let otherDatabase = try WatchCursorStore(databasePath: "/tmp/other.db", fileURL: file)
+  #expect(otherDatabase.cursor(for: "chat=1") == nil)
+
+  // Two watches with different filter sets, both loaded before either saves.
+  let first = try WatchCursorStore(databasePath: "/tmp/chat.db", fileURL: file)
+  let second = try WatchCursorStore(databasePath: "/tmp/chat.db", fileURL: file)
+  let now = Date()
+  first.record(50, for: "chat=1")
+  #expect(try first.saveIfDue(now: now))
+  first.record(51, for: "chat=1")
+  #expect(try first.saveIfDue(now: now.addingTimeInterval(0.5)) == false)
+  second.record(20, for: "chat=all")
+  try second.save()
+  try first.save()
+  let merged = try WatchCursorStore(databasePath: "/tmp/chat.db", fileURL: file)
+  #expect(merged.cursor(for: "chat=1") == 51)
+  #expect(merged.cursor(for: "chat=all") == 20)
+}
+
+@Test
+func appMessageNamesKnownAndExtensionBundles() {
+  let plugin = "com.apple.messages.MSMessageExtensionBalloonPlugin"
+  #expect(
+    AppMessage.appName(bundleID: "\(plugin):ABC123:com.gamerdelights.gamepigeon.ext")
+      == "GamePigeon")
+  #expect(
+    AppMessage.appName(bundleID: "com.apple.PassbookUIService.PeerPaymentMessagesExtension")
+      == "Apple Pay")
+  #expect(
+    AppMessage.appName(
+      bundleID: "com.apple.messages.MSMessageExtensionBalloonPlugin:XYZ:com.example.Polls.ext",
+      payloadName: "Polls for Messages"
+    ) == "Polls for Messages")
+  #expect(
+    AppMessage.appName(
+      bundleID: "com.apple.messages.MSMessageExtensionBalloonPlugin:XYZ:com.example.Trivia.ext"
+    ) == "Trivia")
+}
+
+@Test
+func appMessagePayloadSummaryReadsCaptions() throws {
+  let root: NSDictionary = [
+    "an": "GamePigeon",
+    "ldtext": "Let's play!",
+    "userInfo": ["caption": "8-Ball"] as NSDictionary,
+  ]
+  let data = try NSKeyedArchiver.archivedData(withRootObject: root, requiringSecureCoding: false)
+  let info = AppMessage.info(
+    bundleID: "com.apple.messages.MSMessageExtensionBalloonPlugin:T:com.gamerdelights.gamepigeon",
+    payload: data
+  )
+  #expect(info.displayText == "GamePigeon: 8-Ball")
+  #expect(AppMessage.parsePayload(Data([0x00, 0x01])).summary == nil)
+}
+
+@Test
+func messagesExposeBalloonBundleID() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+123", participants: ["+123"])
+  let sketch = try fake.addMessage(
+    chatID: chat, text: nil,
+    columns: ["balloon_bundle_id": "com.apple.DigitalTouchBalloonProvider"])
+  let plain = try fake.addMessage(chatID: chat, text: "plain")
+  let store = try fake.makeStore()
+  let messages = try store.messages(chatID: chat, limit: 10)
+  let app = messages.first { $0.rowID == sketch }?.app
+  #expect(app?.bundleID == "com.apple.DigitalTouchBalloonProvider")
+  #expect(app?.displayText == "Digital Touch")
+  #expect(messages.first { $0.rowID == plain }?.app == nil)
+  #expect(try store.message(rowID: sketch)?.app?.name == "Digital Touch")
+}
+
+@Test
+func phoneNumberNormalizerCanonicalizesHandles() {
+  let normalizer = PhoneNumberNormalizer()
+  #expect(normalizer.normalizeHandle("(650) 253-0000") == "+16502530000")
+  #expect(normalizer.normalizeHandle(" Friend@Example.com ") == "friend@example.com")
+  #expect(normalizer.normalizeHandle("020 7946 0018", region: "GB") == "+442079460018")
+  #expect(
+    normalizer.uniqueHandles(["+1 650 253 0000", "6502530000", "a@b.co"])
+      == ["+16502530000", "a@b.co"])
+  #expect(normalizer.isValidHandle("+16502530000"))
+  #expect(normalizer.isValidHandle("friend@example.com"))
+  #expect(normalizer.isValidHandle("72727"))
+  #expect(!normalizer.isValidHandle("bob"))
+}
+
+@Test
+func phoneNumberNormalizerInfersRegionFromCountryCode() {
+  let normalizer = PhoneNumberNormalizer()
+  #expect(normalizer.region(of: "+442079460018") == "GB")
+  #expect(normalizer.region(of: "+16502530000") == "US")
+  #expect(normalizer.region(of: "+4930123456") == "DE")
+  #expect(normalizer.region(of: "6502530000") == nil)
+  #expect(normalizer.region(of: "friend@example.com") == nil)
+  #expect(PhoneNumberNormalizer.flag(forRegion: "GB") == "🇬🇧")
+  #expect(PhoneNumberNormalizer.flag(forRegion: "001") == nil)
+}
+
+@Test
+func messageFilterMatchesParticipantsAcrossPhoneFormats() {
+  let message = Message(
+    rowID: 1,
+    chatID: 1,
+    sender: "+16502530000",
+    text: "hi",
+    date: Date(),
+    isFromMe: false,
+    service: "iMessage",
+    handleID: nil,
+    attachmentsCount: 0
+  )
+  #expect(MessageFilter(participants: ["(650) 253-0000"]).allows(message))
+  #expect(!MessageFilter(participants: ["(650) 253-0001"]).allows(message))
+}
+
+@Test
+func messageSenderRejectsInvalidHandles() {
+  let sender = MessageSender(runner: { _, _ in })
+  #expect(throws: IMsgError.self) {
+    try sender.send(MessageSendOptions(recipient: "bob", text: "hi"))
+  }
+}
+
+@Test
+func sendJournalSkipsRepeatedIdempotencyKeys() throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let journal = SendJournal(fileURL: dir.appendingPathComponent("sends.jsonl"))
+  var sends = 0
+  func attempt(fail: Bool = false) throws -> SendJournalEntry.Status {
+    try journal.record(
+      idempotencyKey: "daily-1", target: "+16502530000", service: "imessage", textLength: 2,
+      attachment: nil
+    ) {
+      if fail { throw IMsgError.appleScriptFailure("offline") }
+      sends += 1
+    }
+  }
+
+  #expect(throws: IMsgError.self) { try attempt(fail: true) }
+  #expect(try attempt() == .sent)
+  #expect(try attempt() == .duplicate)
+  #expect(sends == 1)
+  #expect(try journal.entries().map(\.status) == [.failed, .sent, .duplicate])
+  #expect(try journal.hasSent(idempotencyKey: "daily-2") == false)
+}
+
+@Test
+func sendJournalRotatesAndNeverFailsASentMessage() throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let journal = SendJournal(fileURL: dir.appendingPathComponent("sends.jsonl"), maxBytes: 400)
+  func send(_ key: String?, to journal: SendJournal) throws -> SendJournalEntry.Status {
+    try journal.record(
+      idempotencyKey: key, target: "+16502530000", service: "imessage", textLength: 2,
+      attachment: nil, send: {})
+  }
+  for index in 0..<6 {
+    _ = try send("key-\(index)", to: journal)
+  }
+  let current = try Data(contentsOf: journal.fileURL)
+  #expect(current.count <= 400)
+  #expect(FileManager.default.fileExists(atPath: journal.rotatedURL.path))
+  // The key from before the last rotation is still known.
+  #expect(try send("key-1", to: journal) == .duplicate)
+
+  // A journal that can't be written to still reports the send as done.
+  let blocked = dir.appendingPathComponent("blocked.jsonl")
+  try FileManager.default.createDirectory(at: blocked, withIntermediateDirectories: true)
+  #expect(try send(nil, to: SendJournal(fileURL: blocked)) == .sent)
+}
+
+@Test
+func tapbackSenderFindsBubbleByTextFromTheBottom() throws {
+  func message(_ rowID: Int64, _ text: String) -> Message {
+    Message(
+      rowID: rowID, chatID: 1, sender: "+16502530000", text: text,
+      date: Date(timeIntervalSince1970: Double(rowID)), isFromMe: false, service: "iMessage",
+      handleID: 1, attachmentsCount: 0)
+  }
+  let recent = [
+    message(5, "ok"), message(4, "ok!\nsee you"), message(3, "\u{FFFC}"), message(2, "ok"),
+  ]
+  let target = try #require(
+    TapbackTarget.locate(recent[3], recent: recent, participants: ["+16502530000", "a@b.c"]))
+  #expect(target.text == "ok")
+  #expect(target.occurrence == 3)
+  #expect(target.conversationURL == "imessage://open?addresses=+16502530000,a@b.c")
+  #expect(TapbackTarget.locate(recent[2], recent: recent, participants: ["+1"]) == nil)
+  #expect(TapbackTarget.locate(message(1, "old"), recent: recent, participants: ["+1"]) == nil)
+
+  var captured: [String] = []
+  var capturedSource = ""
+  let sender = TapbackSender(runner: { source, args in
+    capturedSource = source
+    captured = args
+  })
+  let single = try #require(
+    TapbackTarget.locate(recent[0], recent: recent, participants: ["+16502530000"]))
+  try sender.react(.laugh, to: single)
+  #expect(captured == ["imessage://+16502530000", "ok", "1", "4"])
+  #expect(capturedSource.contains("AXShowMenu"))
+  #expect(throws: IMsgError.self) {
+    try sender.react(.custom("🎉"), to: single)
+  }
+}
+
+@Test
+func adaptivePollBackoffDoublesWhileIdle() {
+  var backoff = AdaptivePollBackoff(min: 0.5, max: 5)
+  #expect(backoff.delay == 0.5)
+  #expect([false, false, false, false, false].map { backoff.record(activity: $0) } == [
+    1, 2, 4, 5, 5,
+  ])
+  #expect(backoff.record(activity: true) == 0.5)
+  #expect(AdaptivePollBackoff(min: 2, max: 1).max == 2)
+}
+
+@Test
+func quietHoursHandlesWindowsAcrossMidnight() throws {
+  var calendar = Calendar(identifier: .gregorian)
+  calendar.timeZone = try #require(TimeZone(identifier: "Europe/Vienna"))
+  func at(_ hour: Int, _ minute: Int) throws -> Date {
+    try #require(
+      calendar.date(
+        from: DateComponents(year: 2026, month: 5, day: 4, hour: hour, minute: minute)))
+  }
+  let night = try #require(QuietHours("22:00-08:00"))
+  #expect(night.end(containing: try at(12, 0), calendar: calendar) == nil)
+  #expect(
+    night.end(containing: try at(23, 15), calendar: calendar)
+      == (try at(8, 0)).addingTimeInterval(86_400))
+  #expect(night.end(containing: try at(3, 0), calendar: calendar) == (try at(8, 0)))
+  #expect(night.end(containing: try at(8, 0), calendar: calendar) == nil)
+
+  let lunch = try #require(QuietHours("12:00-13:30"))
+  #expect(lunch.end(containing: try at(12, 45), calendar: calendar) == (try at(13, 30)))
+  #expect(QuietHours("25:00-08:00") == nil)
+  #expect(QuietHours("08:00-08:00") == nil)
+  #expect(QuietHours("tonight") == nil)
+}
+
+@Test
+func sharedLocationDecodesAppleMapsVCard() throws {
+  let pin = """
+    BEGIN:VCARD\r
+    VERSION:3.0\r
+    N:;Ferry Building;;;\r
+    FN:Ferry Building\r
+    item1.URL;type=pref:https://maps.apple.com/?ll=37.795500\\,-122.393700&q=Ferry%20Buil\r
+     ding\r
+    item1.X-ABLabel:map url\r
+    END:VCARD\r
+    """
+  let location = try #require(SharedLocationDecoder.decode(vcard: pin))
+  #expect(location.latitude == 37.7955)
+  #expect(location.longitude == -122.3937)
+  #expect(location.name == "Ferry Building")
+  #expect(location.summary == "37.7955,-122.3937 Ferry Building")
+
+  let current = """
+    BEGIN:VCARD
+    FN:Current Location
+    item1.URL;type=pref:http://maps.apple.com/?ll=48.2082\\,16.3738&q=48.2082\\,16.3738
+    END:VCARD
+    """
+  let here = try #require(SharedLocationDecoder.decode(vcard: current, fileName: "CL.loc.vcf"))
+  #expect(here.summary == "48.2082,16.3738 Current Location")
+  #expect(SharedLocationDecoder.decode(vcard: "BEGIN:VCARD\nFN:Ann\nEND:VCARD") == nil)
+}
+
+@Test
+func messageExtractorFindsCodesAndLinks() throws {
+  func codes(_ text: String) -> [String] {
+    MessageExtractor.codes(in: text).map(\.1)
+  }
+  #expect(codes("Your verification code is 123-456") == ["123456"])
+  #expect(codes("G-482913 is your Google verification code.") == ["482913"])
+  #expect(codes("Your Acme login code: AB12CD") == ["AB12CD"])
+  #expect(codes("Use code HERE at checkout") == [])
+  #expect(codes("Order 123456 ships Friday, $1200 total") == [])
+
+  let message = Message(
+    rowID: 7,
+    chatID: 2,
+    sender: "+123",
+    text: "Track it at https://example.com/t/9Z and use PIN 4821 at pickup",
+    date: Date(),
+    isFromMe: false,
+    service: "SMS",
+    handleID: nil,
+    attachmentsCount: 0
+  )
+  let items = MessageExtractor.items(in: message, kinds: [.url, .code])
+  #expect(items.map(\.kind) == [.url, .code])
+  #expect(items.first?.value == "https://example.com/t/9Z")
+  #expect(items.last?.value == "4821")
+  #expect(items.allSatisfy { $0.messageRowID == 7 && $0.chatID == 2 })
+  #expect(MessageExtractor.items(in: message, kinds: [.address]).isEmpty)
+  #expect(ExtractedItem.Kind(option: "URLs") == .url)
+  #expect(ExtractedItem.Kind(option: "phone") == .phone)
+  #expect(ExtractedItem.Kind(option: "emails") == nil)
+}
+
+@Test
+func calendarEventsResolveAgainstTheSendDay() throws {
+  var calendar = Calendar(identifier: .gregorian)
+  calendar.timeZone = try #require(TimeZone(identifier: "UTC"))
+  // Wednesday, 2026-10-14 10:00 UTC.
+  let sentAt = try #require(ISO8601DateFormatter().date(from: "2026-10-14T10:00:00Z"))
+  func event(_ text: String) -> CalendarEvent? {
+    CalendarEventExtractor.event(in: text, sentAt: sentAt, calendar: calendar)
+  }
+  func iso(_ date: Date?) -> String? {
+    date.map { ISO8601DateFormatter().string(from: $0) }
+  }
+
+  let dinner = try #require(event("dinner Friday at 7"))
+  #expect(iso(dinner.start) == "2026-10-16T19:00:00Z")
+  #expect(iso(dinner.end) == "2026-10-16T20:00:00Z")
+  #expect(!dinner.allDay)
+  #expect(iso(event("coffee tomorrow at 8:30")?.start) == "2026-10-15T08:30:00Z")
+  #expect(iso(event("call me at 3pm")?.start) == "2026-10-14T15:00:00Z")
+  #expect(iso(event("next wed, noon?")?.start) == "2026-10-21T12:00:00Z")
+  let flight = try #require(event("Flight on Oct 24th, landing late"))
+  #expect(flight.allDay)
+  #expect(iso(flight.start) == "2026-10-24T00:00:00Z")
+  #expect(iso(flight.end) == "2026-10-25T00:00:00Z")
+  #expect(iso(event("party 3/2")?.start) == "2027-03-02T00:00:00Z")
+  #expect(event("so tired today") == nil)
+  #expect(event("see you tomorrow") == nil)
+  #expect(event("lol") == nil)
+}
+
+@Test
+func iCalendarRoundTripsEvents() throws {
+  var calendar = Calendar(identifier: .gregorian)
+  calendar.timeZone = try #require(TimeZone(identifier: "America/New_York"))
+  let attached = """
+    BEGIN:VCALENDAR\r
+    BEGIN:VEVENT\r
+    UID:abc-123\r
+    DTSTART;TZID=Europe/Vienna:20261024T190000\r
+    SUMMARY:Dinner\\, downtown\r
+    LOCATION:Figlmüller\r
+    END:VEVENT\r
+    BEGIN:VEVENT\r
+    DTSTART;VALUE=DATE:20261101\r
+    SUMMARY:Trip\r
+    END:VEVENT\r
+    END:VCALENDAR\r
+    """
+  let events = ICalendar.events(in: attached, calendar: calendar)
+  #expect(events.count == 2)
+  #expect(events[0].uid == "abc-123")
+  #expect(events[0].summary == "Dinner, downtown")
+  #expect(events[0].location == "Figlmüller")
+  #expect(ISO8601DateFormatter().string(from: events[0].start) == "2026-10-24T17:00:00Z")
+  #expect(events[0].end == events[0].start.addingTimeInterval(3600))
+  #expect(events[1].allDay)
+
+  let document = ICalendar.document(for: events, calendar: calendar)
+  #expect(document.contains("DTSTART:20261024T170000Z\r\n"))
+  #expect(document.contains("DTSTART;VALUE=DATE:20261101\r\nDTEND;VALUE=DATE:20261102\r\n"))
+  #expect(document.contains("SUMMARY:Dinner\\, downtown\r\n"))
+  let reparsed = ICalendar.events(in: document, calendar: calendar)
+  #expect(reparsed.map(\.start) == events.map(\.start))
+  #expect(reparsed.map(\.summary) == events.map(\.summary))
+}
+
+@Test
+func appleTimeDetectsSecondsAndNanosecondsPerValue() {
+  // 2024-01-01T00:00:00Z as stored by older (seconds) and newer (nanoseconds) databases.
+  let expected = Date(timeIntervalSince1970: 1_704_067_200)
+  #expect(AppleTime.date(fromRaw: Int64(725_846_400)) == expected)
+  #expect(AppleTime.date(fromRaw: Int64(725_846_400_000_000_000)) == expected)
+  #expect(AppleTime.unit(of: 725_846_400) == .seconds)
+  #expect(AppleTime.unit(of: 725_846_400_000_000_000) == .nanoseconds)
+  #expect(AppleTime.date(fromRaw: Int64(0)) == Date(timeIntervalSince1970: AppleTime.epochOffset))
+  #expect(AppleTime.raw(from: expected) == 725_846_400_000_000_000)
+  #expect(AppleTime.raw(from: expected, unit: .seconds) == 725_846_400)
+  #expect(AppleTime.raw(from: .distantFuture) == .max)
+  #expect(AppleTime.raw(from: .distantPast) == .min)
+}
+
+@Test
+func sendAttachmentsCheckTypesAndLeaveOversizedMediaForTranscoding() throws {
+  let root = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try FileManager.default.createDirectory(at: root, withIntermediateDirectories: true)
+  defer { try? FileManager.default.removeItem(at: root) }
+  let photo = root.appendingPathComponent("photo.jpg")
+  let archive = root.appendingPathComponent("notes.zip")
+  try Data(repeating: 7, count: 64).write(to: photo)
+  try Data(repeating: 7, count: 64).write(to: archive)
+
+  #expect(try SendAttachments.resolve([photo.path]).first?.kind == .image)
+  #expect(throws: IMsgError.self) {
+    try SendAttachments.resolve([archive.path], service: .sms)
+  }
+  #expect(try SendAttachments.resolve([archive.path], service: .imessage).first?.kind == .other)
+  #expect(throws: IMsgError.self) {
+    try SendAttachments.resolve([photo.path], maxBytes: 32)
+  }
+  let oversized = try SendAttachments.resolve([photo.path], maxBytes: 32, allowOversizedMedia: true)
+  #expect(oversized.count == 1)
+  #expect(throws: IMsgError.self) {
+    try SendAttachments.resolve([archive.path], maxBytes: 32, allowOversizedMedia: true)
+  }
+}
+
+@Test
+func attachmentTranscoderShrinksOversizedImages() async throws {
+  let root = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try FileManager.default.createDirectory(at: root, withIntermediateDirectories: true)
+  defer { try? FileManager.default.removeItem(at: root) }
+
+  // Noise compresses badly, so the PNG is large and only downscaling gets it under the limit.
+  let side = 1200
+  var pixels = [UInt8](repeating: 255, count: side * side * 4)
+  for index in pixels.indices where index % 4 != 3 {
+    pixels[index] = UInt8.random(in: 0...255)
+  }
+  let context = try #require(
+    CGContext(
+      data: &pixels, width: side, height: side, bitsPerComponent: 8, bytesPerRow: side * 4,
+      space: CGColorSpaceCreateDeviceRGB(),
+      bitmapInfo: CGImageAlphaInfo.premultipliedLast.rawValue))
+  let image = try #require(context.makeImage())
+  let source = root.appendingPathComponent("noise.png")
+  let destination = try #require(
+    CGImageDestinationCreateWithURL(source as CFURL, "public.png" as CFString, 1, nil))
+  CGImageDestinationAddImage(destination, image, nil)
+  #expect(CGImageDestinationFinalize(destination))
+
+  let original = try #require(try SendAttachments.resolve([source.path]).first)
+  let transcoder = AttachmentTranscoder(
+    maxBytes: 200_000, imageQuality: 0.8, outputDirectory: root.appendingPathComponent("out"))
+  let fitted = try await transcoder.fit(original)
+  #expect(fitted.originalPath == source.path)
+  #expect(fitted.path.hasSuffix("noise.jpg"))
+  #expect(fitted.bytes <= 200_000)
+  #expect(try await transcoder.fit(fitted) == fitted)
+
+  AttachmentTranscoder.removeOutput(original)
+  #expect(FileManager.default.fileExists(atPath: source.path))
+  AttachmentTranscoder.removeOutput(fitted)
+  #expect(!FileManager.default.fileExists(atPath: fitted.path))
+  #expect(
+    !FileManager.default.fileExists(
+      atPath: URL(fileURLWithPath: fitted.path).deletingLastPathComponent().path))
+}
+
+@Test
+func sendRetryPolicyBacksOffWithJitterAndClassifiesErrors() {
+  let policy = SendRetryPolicy(retries: 3, backoff: 2, jitter: 0.5, maxDelay: 5)
+  #expect(policy.delay(beforeRetry: 1, random: 0.5) == 2)
+  #expect(policy.delay(beforeRetry: 2, random: 0.5) == 4)
+  #expect(policy.delay(beforeRetry: 3, random: 0.5) == 5)
+  #expect(policy.delay(beforeRetry: 1, random: 0) == 1)
+  #expect(policy.delay(beforeRetry: 1, random: 1) == 3)
+
+  let timeout = IMsgError.appleScriptFailure("Messages got an error: AppleEvent timed out. (-1712)")
+  #expect(SendRetryPolicy.errorCode(of: timeout) == -1712)
+  #expect(SendRetryPolicy.isTransient(timeout))
+  #expect(SendRetryPolicy.isRetryable(timeout, idempotent: true))
+  #expect(!SendRetryPolicy.isRetryable(timeout, idempotent: false))
+  let notRunning = IMsgError.sendHelperFailure("sending: Application isn’t running. (-600)")
+  #expect(SendRetryPolicy.isRetryable(notRunning, idempotent: false))
+  // Only the number counts, not wording that happens to sound transient.
+  #expect(!SendRetryPolicy.isTransient(IMsgError.appleScriptFailure("Application isn’t running.")))
+  let badBuddy = IMsgError.appleScriptFailure("Can’t get buddy id \"x\". (-1728)")
+  #expect(!SendRetryPolicy.isRetryable(badBuddy, idempotent: true))
+  #expect(!SendRetryPolicy.isRetryable(IMsgError.invalidHandle("bob"), idempotent: true))
+}
+
+@Test
+func appleScriptGateSpacesRunsAndOpensAfterFailures() throws {
+  var clock = Date(timeIntervalSince1970: 0)
+  var slept: [TimeInterval] = []
+  let gate = AppleScriptGate(
+    minInterval: 1, failureThreshold: 2, cooldown: 30, now: { clock },
+    sleep: {
+      slept.append($0)
+      clock = clock.addingTimeInterval($0)
+    })
+  #expect(try gate.run { 1 } == 1)
+  clock = clock.addingTimeInterval(0.25)
+  #expect(try gate.run { 2 } == 2)
+  #expect(slept == [0.75])
+
+  func fail() throws {
+    throw IMsgError.appleScriptFailure("AppleEvent timed out. (-1712)")
+  }
+  for _ in 0..<2 {
+    clock = clock.addingTimeInterval(5)
+    #expect(throws: IMsgError.self) { try gate.run(fail) }
+  }
+  var ran = false
+  clock = clock.addingTimeInterval(10)
+  do {
+    try gate.run { ran = true }
+    Issue.record("expected the breaker to be open")
+  } catch IMsgError.sendBackoff(let failures, let retryAfter) {
+    #expect(failures == 2 && retryAfter == 20)
+  }
+  #expect(!ran)
+  #expect(!SendRetryPolicy.isTransient(IMsgError.sendBackoff(failures: 2, retryAfter: 20)))
+  #expect(
+    IMsgError.sendBackoff(failures: 2, retryAfter: 19.5).errorDescription?
+      .hasPrefix("E_SEND_BACKOFF:") == true)
+
+  // After the cooldown one probe goes through; a failure reopens the breaker at once.
+  clock = clock.addingTimeInterval(21)
+  #expect(throws: IMsgError.self) { try gate.run(fail) }
+  #expect(throws: IMsgError.self) { try gate.run { ran = true } }
+  #expect(!ran)
+  clock = clock.addingTimeInterval(31)
+  try gate.run { ran = true }
+  #expect(ran)
+  clock = clock.addingTimeInterval(5)
+  #expect(throws: IMsgError.self) { try gate.run(fail) }
+  #expect(try gate.run { 3 } == 3)
+
+  // A permanent error means Messages answered; it neither counts nor trips the breaker.
+  for _ in 0..<3 {
+    clock = clock.addingTimeInterval(5)
+    #expect(throws: IMsgError.self) {
+      try gate.run { throw IMsgError.appleScriptFailure("Can’t get buddy id \"x\".") }
+    }
+  }
+  #expect(try gate.run { 4 } == 4)
+}
+
+@Test
+func appleScriptGateSharesBreakerStateThroughItsLockFile() throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let lockURL = dir.appendingPathComponent("applescript.lock")
+  let clock = Date(timeIntervalSince1970: 0)
+  func gate() -> AppleScriptGate {
+    AppleScriptGate(
+      minInterval: 0, failureThreshold: 1, cooldown: 30, lockURL: lockURL, now: { clock },
+      sleep: { _ in })
+  }
+  #expect(throws: IMsgError.self) {
+    try gate().run { throw IMsgError.appleScriptFailure("AppleEvent timed out. (-1712)") }
+  }
+  do {
+    try gate().run {}
+    Issue.record("expected another gate on the same lock file to see the open breaker")
+  } catch IMsgError.sendBackoff(let failures, _) {
+    #expect(failures == 1)
+  }
+}
+
+@Test
+func callHistoryStoreListsNewestCallsAndFiltersByHandle() throws {
+  let db = try Connection(.inMemory)
+  try db.execute(
+    """
+    CREATE TABLE ZCALLRECORD (
+      Z_PK INTEGER PRIMARY KEY, ZADDRESS TEXT, ZNAME TEXT, ZCALLTYPE INTEGER,
+      ZSERVICE_PROVIDER TEXT, ZORIGINATED INTEGER, ZANSWERED INTEGER, ZDATE TIMESTAMP,
+      ZDURATION FLOAT
+    );
+    INSERT INTO ZCALLRECORD VALUES
+      (1, '+14155551212', 'Ann', 1, 'com.apple.Telephony', 1, 1, 700000000.5, 192.4),
+      (2, '(415) 555-1212', NULL, 8, 'com.apple.FaceTime', 0, 0, 700000100, 0),
+      (3, 'bob@example.com', NULL, 16, 'com.apple.FaceTime', 0, 1, 700000050, 30);
+    """)
+  let store = CallHistoryStore(connection: db, path: ":memory:")
+
+  let calls = try store.calls(limit: 10)
+  #expect(calls.map(\.id) == [2, 3, 1])
+  #expect(calls[0].kind == .faceTimeVideo)
+  #expect(calls[0].isOutgoing == false && calls[0].answered == false)
+  #expect(calls[1].kind == .faceTimeAudio)
+  #expect(calls[2].kind == .phone)
+  #expect(calls[2].duration == 192.4)
+  #expect(calls[2].date == Date(timeIntervalSince1970: 700000000.5 + AppleTime.epochOffset))
+
+  #expect(try store.calls(limit: 10, handle: "415-555-1212").map(\.id) == [2, 1])
+  #expect(try store.calls(limit: 1).count == 1)
+}
+
+@Test
+func messageRedactorMasksBuiltInRulesAndCustomPatterns() throws {
+  let redactor = try MessageRedactor(specs: ["phone,email", "ssn", "order #[0-9]+"])
+  let text =
+    "call +1 (415) 555-1212 or mail sam@example.com, ssn 123-45-6789, code 123456, order #991"
+  #expect(
+    redactor.redact(text)
+      == "call [phone] or mail [email], ssn [ssn], code 123456, [redacted]")
+  #expect(try MessageRedactor(specs: ["email"]).redact("4155551212") == "4155551212")
+
+  let message = Message(
+    rowID: 1, chatID: 1, sender: "+123", text: "text me at 415.555.1212", date: Date(),
+    isFromMe: false, service: "iMessage", handleID: nil, attachmentsCount: 0)
+  #expect(redactor.redact(message).text == "text me at [phone]")
+  #expect(throws: IMsgError.self) { try MessageRedactor(specs: ["("]) }
+}
+
+@Test
+func messageTextNormalizerStripsArtifactsAndComposes() throws {
+  let all = try MessageTextNormalizer(specs: ["all"])
+  #expect(all.normalize("\u{FFFC}code\u{200B} is 12\u{2060}34\u{FEFF}") == "code is 1234")
+  #expect(all.normalize("Cafe\u{0301}") == "Café")
+  #expect(all.normalize("Cafe\u{0301}").unicodeScalars.count == 4)
+  // Joiners inside emoji sequences stay; stray ones go.
+  let family = "👨\u{200D}👩\u{200D}👧"
+  #expect(all.normalize("\(family) a\u{200D}b") == "\(family) ab")
+  #expect(all.normalize("❤\u{FE0F}\u{200D}🔥") == "❤\u{FE0F}\u{200D}🔥")
+
+  let objects = try MessageTextNormalizer(specs: ["fffc"])
+  #expect(objects.normalize("\u{FFFC}a\u{200B}b") == "a\u{200B}b")
+  #expect(try MessageTextNormalizer(specs: ["zero-width, nfc"]).steps == [.zeroWidth, .nfc])
+  #expect(throws: IMsgError.self) { try MessageTextNormalizer(specs: ["nfd"]) }
+
+  let message = Message(
+    rowID: 1, chatID: 1, sender: "+123", text: "\u{FFFC}photo", date: Date(),
+    isFromMe: false, service: "iMessage", handleID: nil, attachmentsCount: 1)
+  #expect(all.normalize(message).text == "photo")
+  #expect(all.normalize(message).attachmentsCount == 1)
+
+  // "\u{FFFC}hi @Ann\u{200B} there" mentions "@Ann" at 4; after normalizing it sits at 3.
+  let mentioned = Message(
+    rowID: 2, chatID: 1, sender: "+123", text: "\u{FFFC}hi @Ann\u{200B} there", date: Date(),
+    isFromMe: false, service: "iMessage", handleID: nil, attachmentsCount: 1,
+    mentions: [
+      MessageMention(handle: "ann@example.com", location: 4, length: 5, text: "@Ann\u{200B}")
+    ])
+  let normalized = all.normalize(mentioned)
+  #expect(normalized.text == "hi @Ann there")
+  #expect(
+    normalized.mentions
+      == [MessageMention(handle: "ann@example.com", location: 3, length: 4, text: "@Ann")])
+}
@@ -0,0 +1,167 @@
+import Commander
+import Foundation
+import SQLite
+import Testing
+
+@testable import IMsgCore
+@testable import imsg
+
+private final class MatrixTransportStub {
+  var requests: [URLRequest] = []
+  var responses: [String: String] = [:]
+
+  func handle(_ request: URLRequest) throws -> (Data, URLResponse) {
+    requests.append(request)
+    let path = request.url?.path ?? ""
+    let body = responses.first { path.hasSuffix($0.key) }?.value ?? #"{"event_id":"$event"}"#
+    let response = HTTPURLResponse(
+      url: request.url!, statusCode: 200, httpVersion: nil, headerFields: nil)!
+    return (Data(body.utf8), response)
+  }
+
+  func client() -> MatrixClient {
+    MatrixClient(homeserver: URL(string: "https://matrix.example.org/")!, token: "secret") {
+      try self.handle($0)
+    }
+  }
+}
+
+private func makeBridgeJournal() -> SendJournal {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  return SendJournal(fileURL: dir.appendingPathComponent("sends.jsonl"))
+}
+
+private let bridgedChat = ChatInfo(
+  id: 3, identifier: "iMessage;+;chat42", guid: "iMessage;+;chat42", name: "Crew",
+  service: "iMessage")
+
+@Test
+func matrixClientSendsTextAndParsesSync() async throws {
+  let stub = MatrixTransportStub()
+  stub.responses = [
+    "/send/m.room.message/imsg-abc": #"{"event_id":"$sent"}"#,
+    "/sync": """
+      {"next_batch":"s2","rooms":{"join":{"!room:example.org":{"timeline":{"events":[
+        {"type":"m.room.message","event_id":"$1","sender":"@ann:example.org",
+         "content":{"msgtype":"m.text","body":"hi +1"}},
+        {"type":"m.room.member","event_id":"$2","sender":"@ann:example.org","content":{}}
+      ]}}}}}
+      """,
+  ]
+  let client = stub.client()
+
+  let eventID = try await client.sendText(
+    "hello", roomID: "!room:example.org", transactionID: "imsg-abc")
+  #expect(eventID == "$sent")
+  let send = try #require(stub.requests.first)
+  #expect(send.httpMethod == "PUT")
+  #expect(
+    send.url?.absoluteString
+      == "https://matrix.example.org/_matrix/client/v3/rooms/%21room%3Aexample.org"
+      + "/send/m.room.message/imsg-abc")
+  #expect(send.value(forHTTPHeaderField: "Authorization") == "Bearer secret")
+
+  let batch = try await client.sync(since: "s1", timeout: 0, roomIDs: ["!room:example.org"])
+  #expect(batch.nextBatch == "s2")
+  #expect(
+    batch.events == [
+      MatrixRoomEvent(
+        roomID: "!room:example.org", eventID: "$1", sender: "@ann:example.org",
+        msgtype: "m.text", body: "hi +1")
+    ])
+  let query = stub.requests.last?.url?.query ?? ""
+  #expect(query.contains("since=s1"))
+}
+
+@Test
+func matrixClientSurfacesErrors() async {
+  let client = MatrixClient(homeserver: URL(string: "https://matrix.example.org")!, token: "t") {
+    request in
+    let body = #"{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token"}"#
+    let response = HTTPURLResponse(
+      url: request.url!, statusCode: 401, httpVersion: nil, headerFields: nil)!
+    return (Data(body.utf8), response)
+  }
+  await #expect(throws: MatrixError.self) {
+    try await client.whoami()
+  }
+}
+
+@Test
+func matrixBridgeParsesRoomMappings() throws {
+  let mapping = try MatrixBridge.parseMapping("12=!abc:example.org")
+  #expect(mapping.chatID == 12)
+  #expect(mapping.roomID == "!abc:example.org")
+  #expect(throws: ParsedValuesError.self) {
+    try MatrixBridge.parseMapping("12")
+  }
+  #expect(throws: ParsedValuesError.self) {
+    try MatrixBridge.parseMapping("abc=!room:example.org")
+  }
+}
+
+@Test
+func matrixBridgeRelaysRepliesOnceAndSkipsEchoes() async throws {
+  let stub = MatrixTransportStub()
+  var sent: [MessageSendOptions] = []
+  let journal = makeBridgeJournal()
+  defer { try? FileManager.default.removeItem(at: journal.fileURL.deletingLastPathComponent()) }
+  let bridge = MatrixBridge(
+    client: stub.client(),
+    rooms: [MatrixBridge.Room(chat: bridgedChat, roomID: "!room:example.org")],
+    journal: journal,
+    sendMessage: { sent.append($0) }
+  )
+  let reply = MatrixRoomEvent(
+    roomID: "!room:example.org", eventID: "$1", sender: "@ann:example.org", msgtype: "m.text",
+    body: "on my way")
+
+  #expect(try await bridge.relay(reply, ownUserID: "@bot:example.org") == .sent)
+  #expect(try await bridge.relay(reply, ownUserID: "@bot:example.org") == .duplicate)
+  let own = MatrixRoomEvent(
+    roomID: "!room:example.org", eventID: "$2", sender: "@bot:example.org", msgtype: "m.text",
+    body: "ignored")
+  #expect(try await bridge.relay(own, ownUserID: "@bot:example.org") == nil)
+  #expect(sent.count == 1)
+  #expect(sent.first?.chatGUID == "iMessage;+;chat42")
+  #expect(sent.first?.text == "on my way")
+
+  let store = try MessageStore(
+    connection: Connection(.inMemory), path: ":memory:", hasAttributedBody: false,
+    hasReactionColumns: false)
+  func message(_ rowID: Int64, _ text: String, fromMe: Bool) -> Message {
+    Message(
+      rowID: rowID, chatID: 3, sender: fromMe ? "" : "+15551234567", text: text, date: Date(),
+      isFromMe: fromMe, service: "iMessage", handleID: nil, attachmentsCount: 0,
+      guid: "guid-\(rowID)")
+  }
+  // The relayed text comes back from chat.db as our own message and is not mirrored again.
+  try await bridge.mirror(message(10, "on my way", fromMe: true), store: store)
+  try await bridge.mirror(message(11, "see you", fromMe: false), store: store)
+  try await bridge.mirror(message(12, "sent from phone", fromMe: true), store: store)
+  let bodies = try stub.requests.map {
+    try JSONSerialization.jsonObject(with: $0.httpBody ?? Data()) as? [String: String]
+  }
+  #expect(bodies.map { $0?["body"] } == ["+15551234567: see you", "me: sent from phone"])
+  #expect(stub.requests.first?.url?.path.hasSuffix("/imsg-guid-11") == true)
+}
+
+@Test
+func matrixSyncPositionIsKeptPerAccount() throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fileURL = dir.appendingPathComponent("matrix-sync.json")
+  let homeserver = try #require(URL(string: "https://matrix.example.org"))
+  let bot = try MatrixSyncPosition(
+    homeserver: homeserver, userID: "@bot:example.org", fileURL: fileURL)
+  #expect(bot.since == nil)
+  try bot.save("s42")
+
+  let other = try MatrixSyncPosition(
+    homeserver: homeserver, userID: "@other:example.org", fileURL: fileURL)
+  #expect(other.since == nil)
+  try other.save("s7")
+  let reopened = try MatrixSyncPosition(
+    homeserver: homeserver, userID: "@bot:example.org", fileURL: fileURL)
+  #expect(reopened.since == "s42")
+}
@@ -26,3 +26,22 @@ func commandRouterUnknownCommand() async {
   let status = await router.run(argv: ["imsg", "nope"])
   #expect(status == 1)
 }
+
+@Test
+func shellCompletionScriptsCoverCommandsAndDynamicOptions() {
+  let router = CommandRouter()
+  let bash = ShellCompletion.script(for: .bash, rootName: "imsg", specs: router.specs)
+  #expect(bash.contains("complete -o default -F _imsg imsg"))
+  #expect(bash.contains("--chat-id)"))
+  #expect(bash.contains("_imsg_values chat-id"))
+  #expect(!bash.contains("__complete)"))
+
+  let zsh = ShellCompletion.script(for: .zsh, rootName: "imsg", specs: router.specs)
+  #expect(zsh.hasPrefix("#compdef imsg"))
+  #expect(zsh.contains("'--participants[") && zsh.contains(":handle:{_imsg_values handle}'"))
+  #expect(zsh.contains("'--db[") && zsh.contains(":file:_files'"))
+
+  let fish = ShellCompletion.script(for: .fish, rootName: "imsg", specs: router.specs)
+  #expect(fish.contains("-n __fish_use_subcommand -a history"))
+  #expect(fish.contains("-l chat-id -x -a '(__imsg_values chat-id)'"))
+}
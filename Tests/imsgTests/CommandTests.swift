@@ -1,5 +1,7 @@
 import Commander
+import CryptoKit
 import Foundation
+import IMsgTesting
 import SQLite
 import Testing
 
@@ -77,6 +79,16 @@ private enum CommandTestDatabase {
     return path
   }
 
+  static func makeJournal() -> SendJournal {
+    let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+    return SendJournal(fileURL: dir.appendingPathComponent("sends.jsonl"))
+  }
+
+  /// Deletes the directory `makeJournal()` created, with the journal, its lock and rotations.
+  static func removeJournal(_ journal: SendJournal) {
+    try? FileManager.default.removeItem(at: journal.fileURL.deletingLastPathComponent())
+  }
+
   static func makePathWithAttachment() throws -> String {
     let path = try makePath()
     let db = try Connection(path)
@@ -89,6 +101,17 @@ private enum CommandTestDatabase {
     try db.run("INSERT INTO message_attachment_join(message_id, attachment_id) VALUES (1, 1)")
     return path
   }
+
+  /// Chat 1 (`+123`, "Test Chat") holding message 1, "hello" from +123, with
+  /// `/tmp/file.dat` attached when `withAttachment` is set.
+  static func make(withAttachment: Bool = false) throws -> FakeChatDatabase {
+    let fake = try FakeChatDatabase()
+    let chat = try fake.addChat(
+      identifier: "+123", guid: "iMessage;+;chat123", name: "Test Chat", participants: ["+123"])
+    let attachments = withAttachment ? [FakeAttachment(path: "/tmp/file.dat", totalBytes: 10)] : []
+    try fake.addMessage(chatID: chat, text: "hello", sender: "+123", attachments: attachments)
+    return fake
+  }
 }
 
 @Test
@@ -115,6 +138,54 @@ func historyCommandRunsWithChatID() async throws {
   try await HistoryCommand.spec.run(values, runtime)
 }
 
+@Test
+func messageTemplateRendererIncludesChatMetadata() throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let store = try MessageStore(path: path)
+  let message = try #require(try store.messages(chatID: 1, limit: 1).first)
+  let renderer = try #require(
+    try MessageTemplateRenderer.from(
+      values: ParsedValues(
+        positional: [],
+        options: ["template": ["{{.Chat.Name}} [{{.Direction}}] {{.Sender}}: {{.Text}}"]],
+        flags: []),
+      timestamps: TimestampFormatter(style: .unix)))
+  #expect(try renderer.render(message, store: store) == "Test Chat [recv] +123: hello")
+}
+
+@Test
+func chatsCommandRunsWithTemplate() async throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "template": ["{{.ID}} {{.Name}} {{.MessageCount}}"]],
+    flags: []
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  let mutes = URL(fileURLWithPath: path).deletingLastPathComponent()
+    .appendingPathComponent("muted.json")
+  var lines: [String] = []
+  try ChatsCommand.run(
+    values: values, runtime: runtime, muteListFactory: { try ChatMuteList(fileURL: mutes) },
+    output: { lines.append($0) })
+  #expect(lines == ["1 Test Chat 1"])
+}
+
+@Test
+func completionCandidatesComeFromChatDatabase() throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  #expect(try ShellCompletion.candidates(.chatID, store: store) == ["1\tTest Chat (+123)"])
+  #expect(
+    try ShellCompletion.candidates(.chatGUID, store: store) == ["iMessage;+;chat123\tTest Chat"])
+  #expect(try ShellCompletion.candidates(.handle, store: store) == ["+123"])
+}
+
 @Test
 func historyCommandRunsWithAttachmentsNonJson() async throws {
   let path = try CommandTestDatabase.makePathWithAttachment()
@@ -159,6 +230,8 @@ func sendCommandRejectsMissingRecipient() async {
 
 @Test
 func sendCommandRunsWithStubSender() async throws {
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
   let values = ParsedValues(
     positional: [],
     options: ["to": ["+15551234567"], "text": ["hi"]],
@@ -170,13 +243,289 @@ func sendCommandRunsWithStubSender() async throws {
     values: values, runtime: runtime,
     sendMessage: { options in
       captured = options
-    })
+    },
+    journal: journal)
   #expect(captured?.recipient == "+15551234567")
   #expect(captured?.text == "hi")
 }
 
+@Test
+func sendCommandConfirmsBeforeSending() async throws {
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  func send(flags: Set<String> = [], answer: Bool) async throws -> (String?, Bool) {
+    let values = ParsedValues(
+      positional: [], options: ["to": ["(650) 253-0000"], "text": ["see you at 7"]],
+      flags: flags)
+    var prompt: String?
+    var sent = false
+    try await SendCommand.run(
+      values: values, runtime: RuntimeOptions(parsedValues: values),
+      sendMessage: { _ in sent = true }, journal: journal,
+      confirm: {
+        prompt = $0
+        return answer
+      })
+    return (prompt, sent)
+  }
+
+  let (prompt, sent) = try await send(answer: true)
+  #expect(sent)
+  #expect(prompt?.contains("To:      +16502530000") == true)
+  #expect(prompt?.contains("see you at 7") == true)
+  await #expect(throws: IMsgError.self) { _ = try await send(answer: false) }
+  let skipped = try await send(flags: ["yes"], answer: false)
+  #expect(skipped.0 == nil)
+  #expect(skipped.1)
+
+  // Quiet hours and an already-used idempotency key stop the send before anyone is asked.
+  let lateNight = try #require(
+    Calendar.current.date(from: DateComponents(year: 2026, month: 3, day: 2, hour: 23)))
+  func refused(_ options: [String: [String]]) async throws {
+    let values = ParsedValues(positional: [], options: options, flags: [])
+    try await SendCommand.run(
+      values: values, runtime: RuntimeOptions(parsedValues: values), sendMessage: { _ in },
+      journal: journal,
+      confirm: { _ in
+        Issue.record("a send that won't go out must not prompt")
+        return true
+      },
+      now: { lateNight })
+  }
+  await #expect(throws: QuietHoursError.self) {
+    try await refused(["to": ["+15551234567"], "text": ["hi"], "quietHours": ["22:00-08:00"]])
+  }
+  let keyed = ParsedValues(
+    positional: [], options: ["to": ["+15551234567"], "text": ["hi"], "idempotencyKey": ["c1"]],
+    flags: ["yes"])
+  try await SendCommand.run(
+    values: keyed, runtime: RuntimeOptions(parsedValues: keyed), sendMessage: { _ in },
+    journal: journal)
+  try await refused(["to": ["+15551234567"], "text": ["hi"], "idempotencyKey": ["c1"]])
+
+  let options = MessageSendOptions(
+    recipient: "", text: String(repeating: "a", count: 200), service: .imessage,
+    chatIdentifier: "chat42")
+  let chatPrompt = SendCommand.confirmationPrompt(
+    for: options, account: nil, chatName: "Family", nameLookup: { _ in "Mom" })
+  #expect(chatPrompt.contains("To:      Family (chat42)"))
+  #expect(chatPrompt.contains("Service: imessage"))
+  #expect(!chatPrompt.contains(String(repeating: "a", count: 81)))
+  #expect(
+    SendCommand.confirmationPrompt(
+      for: MessageSendOptions(recipient: "+15551234567", text: "hi"), account: nil,
+      chatName: "", nameLookup: { _ in "Mom" }
+    ).hasPrefix("To:      Mom (+15551234567)"))
+}
+
+@Test
+func sendCommandPicksAccountWithFrom() async throws {
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  let accounts = [
+    MessagesAccount(
+      id: "A1", serviceType: "iMessage", name: "E:me@icloud.com", enabled: true,
+      connectionStatus: "connected"),
+    MessagesAccount(
+      id: "A2", serviceType: "iMessage", name: "E:work@example.com", enabled: true,
+      connectionStatus: "connected"),
+    MessagesAccount(
+      id: "S1", serviceType: "SMS", name: "SMS", enabled: false, connectionStatus: "disconnected"),
+  ]
+  func send(_ options: [String: [String]]) async throws -> MessageSendOptions? {
+    let values = ParsedValues(
+      positional: [], options: ["to": ["+15551234567"], "text": ["hi"]].merging(options) { $1 },
+      flags: [])
+    var captured: MessageSendOptions?
+    try await SendCommand.run(
+      values: values, runtime: RuntimeOptions(parsedValues: values),
+      sendMessage: { captured = $0 }, accountsProvider: { accounts },
+      journal: journal)
+    return captured
+  }
+
+  let work = try await send(["from": ["Work@Example.com"]])
+  #expect(work?.accountID == "A2")
+  #expect(work?.service == .imessage)
+  #expect(try await send([:])?.accountID == "")
+  let rejected: [[String: [String]]] = [
+    ["from": ["other@example.com"]], ["from": ["SMS"]], ["from": ["A1"], "service": ["sms"]],
+  ]
+  for bad in rejected {
+    await #expect(throws: IMsgError.self) { _ = try await send(bad) }
+  }
+  await #expect(throws: ParsedValuesError.self) {
+    _ = try await send(["to": ["chat123"], "from": ["A1"]])
+  }
+}
+
+@Test
+func sendCommandSendsRepeatedAndGlobbedFiles() async throws {
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try FileManager.default.createDirectory(at: dir, withIntermediateDirectories: true)
+  for name in ["cover.jpg", "p1.heic", "p2.heic"] {
+    try Data("x".utf8).write(to: dir.appendingPathComponent(name))
+  }
+  let values = ParsedValues(
+    positional: [],
+    options: [
+      "db": [dir.appendingPathComponent("missing.db").path],
+      "to": ["+15551234567"],
+      "file": [
+        dir.appendingPathComponent("cover.jpg").path, dir.appendingPathComponent("*.heic").path,
+      ],
+    ],
+    flags: []
+  )
+  var captured: MessageSendOptions?
+  try await SendCommand.run(
+    values: values, runtime: RuntimeOptions(parsedValues: values),
+    sendMessage: { captured = $0 }, journal: journal)
+  #expect(
+    captured?.attachmentPaths.map { URL(fileURLWithPath: $0).lastPathComponent }
+      == ["cover.jpg", "p1.heic", "p2.heic"])
+
+  let missing = ParsedValues(
+    positional: [],
+    options: ["to": ["+15551234567"], "file": [dir.appendingPathComponent("gone.jpg").path]],
+    flags: []
+  )
+  var sent = false
+  await #expect(throws: IMsgError.self) {
+    try await SendCommand.run(
+      values: missing, runtime: RuntimeOptions(parsedValues: missing),
+      sendMessage: { _ in sent = true }, journal: journal)
+  }
+  #expect(!sent)
+}
+
+@Test
+func sendCommandReportsGuidsOfSentAttachments() async throws {
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let file = URL(fileURLWithPath: path).deletingLastPathComponent()
+    .appendingPathComponent("pic.jpg")
+  try Data("x".utf8).write(to: file)
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "chatID": ["1"], "file": [file.path]],
+    flags: []
+  )
+  var polls = 0
+  let found = try await SendCommand.locateSent(
+    [SendAttachment(path: file.path, bytes: 1)], store: try MessageStore(path: path),
+    afterRowID: 1, sleep: { _ in polls += 1 })
+  #expect(found == [nil])
+  #expect(polls == Int(SendCommand.sentLookupTimeout / SendCommand.sentLookupInterval))
+
+  try await SendCommand.run(
+    values: values, runtime: RuntimeOptions(parsedValues: values),
+    sendMessage: { _ in
+      // What Messages writes for the send: the file on its own outgoing message.
+      try fake.addMessage(
+        chatID: 1, text: "\u{FFFC}", guid: "sent-guid",
+        attachments: [
+          FakeAttachment(
+            guid: "att-guid", path: "~/Library/Messages/Attachments/ab/pic.jpg", totalBytes: 1)
+        ])
+    },
+    journal: journal, environment: [:], sleep: { _ in })
+  let records = try MessageStore(path: path).sentAttachments(afterRowID: 1)
+  #expect(records.map(\.messageGUID) == ["sent-guid"])
+  #expect(records.map(\.attachmentGUID) == ["att-guid"])
+  let located = try await SendCommand.locateSent(
+    [SendAttachment(path: file.path, bytes: 1)], store: try MessageStore(path: path),
+    afterRowID: 1, sleep: { _ in })
+  #expect(located.compactMap { $0 } == records)
+}
+
+@Test
+func searchCommandReturnsTypedHits() throws {
+  let fake = try CommandTestDatabase.make(withAttachment: true)
+  defer { fake.remove() }
+  let path = fake.path
+  let store = try fake.makeStore()
+  let hits = try SearchCommand.search(
+    "file", types: SearchType.allCases, chatID: nil, limit: 5, store: store)
+  #expect(hits.map(\.payload.type) == ["attachment"])
+  #expect(hits.first?.payload.attachment?.file.transferName == "file.dat")
+  let both = try SearchCommand.search(
+    "hel", types: [.chats, .messages], chatID: 1, limit: 5, store: store)
+  #expect(both.map(\.payload.type) == ["message"])
+  let chats = try SearchCommand.search(
+    "Test", types: [.chats], chatID: nil, limit: 5, store: store)
+  #expect(chats.map(\.payload.chat?.id) == [1])
+
+  // Chats also match through the names of their participants in Contacts.
+  let contacts = try FakeChatDatabase()
+  defer { contacts.remove() }
+  let alice = try contacts.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  try contacts.addMessage(chatID: alice, text: "hi", sender: "+15551234567")
+  try contacts.addChat(identifier: "+15557654321", participants: ["+15557654321"])
+  let named = try SearchCommand.search(
+    "Alice", types: [.chats], chatID: nil, limit: 5, store: try contacts.makeStore(),
+    contactHandles: { $0 == "Alice" ? ["(555) 123-4567", "alice@example.com"] : [] })
+  #expect(named.map(\.payload.chat?.id) == [alice])
+
+  let values = ParsedValues(
+    positional: ["hello"], options: ["db": [path], "type": ["messages,chats"]], flags: [])
+  try SearchCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+  let invalid = ParsedValues(
+    positional: ["hello"], options: ["db": [path], "type": ["people"]], flags: [])
+  #expect(throws: ParsedValuesError.self) {
+    try SearchCommand.run(values: invalid, runtime: RuntimeOptions(parsedValues: invalid))
+  }
+}
+
+@Test
+func forwardCommandResendsTextAndAttachments() async throws {
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let file = URL(fileURLWithPath: path).deletingLastPathComponent()
+    .appendingPathComponent("photo [1].jpg")
+  try Data("x".utf8).write(to: file)
+  try fake.addAttachment(
+    FakeAttachment(path: file.path, mimeType: "image/jpeg", uti: "public.jpeg", totalBytes: 1),
+    to: 1)
+
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "rowid": ["1"], "to": ["+15550001111"]],
+    flags: []
+  )
+  var captured: MessageSendOptions?
+  try await ForwardCommand.run(
+    values: values, runtime: RuntimeOptions(parsedValues: values),
+    sendMessage: { captured = $0 }, journal: journal)
+  #expect(captured?.recipient == "+15550001111")
+  #expect(captured?.text == "hello")
+  #expect(captured?.attachmentPaths == [file.path])
+
+  #expect(ForwardCommand.forwardedText("\u{FFFC}\u{FFFC} look") == "look")
+  let unknown = ParsedValues(
+    positional: [],
+    options: ["db": [path], "rowid": ["99"], "to": ["+15550001111"]],
+    flags: []
+  )
+  await #expect(throws: IMsgError.self) {
+    try await ForwardCommand.run(
+      values: unknown, runtime: RuntimeOptions(parsedValues: unknown),
+      sendMessage: { _ in }, journal: journal)
+  }
+}
+
 @Test
 func sendCommandResolvesChatID() async throws {
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
   let path = try CommandTestDatabase.makePath()
   let values = ParsedValues(
     positional: [],
@@ -189,12 +538,330 @@ func sendCommandResolvesChatID() async throws {
     values: values, runtime: runtime,
     sendMessage: { options in
       captured = options
-    })
+    },
+    journal: journal)
   #expect(captured?.chatIdentifier == "+123")
   #expect(captured?.chatGUID == "iMessage;+;chat123")
   #expect(captured?.recipient.isEmpty == true)
 }
 
+@Test
+func sendCommandStartsNewGroupWithForceNew() async throws {
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  let values = ParsedValues(
+    positional: [],
+    options: ["to": ["+15551234567, friend@example.com"], "text": ["hi"]],
+    flags: ["forceNew"]
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  var captured: MessageSendOptions?
+  try await SendCommand.run(
+    values: values, runtime: runtime,
+    sendMessage: { options in
+      captured = options
+    },
+    storeFactory: { _ in
+      throw IMsgError.invalidChatTarget("store should not be opened")
+    },
+    journal: journal)
+  #expect(captured?.recipient == "")
+  #expect(captured?.groupRecipients == ["+15551234567", "friend@example.com"])
+}
+
+@Test
+func sendCommandCreatesNamedGroupFromRepeatedTo() async throws {
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let values = ParsedValues(
+    positional: [],
+    options: [
+      "db": [path], "to": ["+15551234567", "friend@example.com"], "groupName": ["Dinner"],
+      "text": ["hi"],
+    ],
+    flags: ["group"]
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  var captured: MessageSendOptions?
+  try await SendCommand.run(
+    values: values, runtime: runtime,
+    sendMessage: { options in
+      captured = options
+    },
+    journal: journal)
+  #expect(captured?.groupRecipients == ["+15551234567", "friend@example.com"])
+  #expect(captured?.groupName == "Dinner")
+}
+
+@Test
+func sendCommandRejectsGroupWithSingleRecipient() async {
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  let values = ParsedValues(
+    positional: [],
+    options: ["to": ["+15551234567"], "text": ["hi"]],
+    flags: ["group"]
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  await #expect(throws: ParsedValuesError.self) {
+    try await SendCommand.run(
+      values: values, runtime: runtime, sendMessage: { _ in },
+      journal: journal)
+  }
+}
+
+@Test
+func sendCommandRefusesToSendInQuietHours() async throws {
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  var calendar = Calendar.current
+  calendar.timeZone = .current
+  let lateNight = try #require(
+    calendar.date(from: DateComponents(year: 2026, month: 3, day: 2, hour: 23, minute: 30)))
+  var sent = 0
+  func send(_ values: ParsedValues, config: IMsgConfig = IMsgConfig()) async throws {
+    try await SendCommand.run(
+      values: values, runtime: RuntimeOptions(parsedValues: values),
+      sendMessage: { _ in sent += 1 }, journal: journal, config: { config },
+      now: { lateNight }, sleep: { _ in Issue.record("quiet hours must not wait") })
+  }
+  let options = ["to": ["+15551234567"], "text": ["hi"], "quietHours": ["22:00-08:00"]]
+  await #expect {
+    try await send(ParsedValues(positional: [], options: options, flags: []))
+  } throws: { error in
+    guard case QuietHoursError.active(let until) = error else { return false }
+    return until.timeIntervalSince(lateNight) == 8.5 * 3600
+      && "\(error)".contains("--ignore-quiet-hours")
+  }
+  #expect(sent == 0)
+  try await send(ParsedValues(positional: [], options: options, flags: ["ignoreQuietHours"]))
+  #expect(sent == 1)
+
+  // Without --quiet-hours the window comes from config.yaml.
+  let plain = ParsedValues(
+    positional: [], options: ["to": ["+15551234567"], "text": ["hi"]], flags: [])
+  await #expect(throws: QuietHoursError.self) {
+    try await send(plain, config: IMsgConfig(quietHours: "22:00-08:00"))
+  }
+  try await send(plain, config: IMsgConfig(quietHours: "09:00-17:00"))
+  #expect(sent == 2)
+  await #expect(throws: IMsgConfigError.self) {
+    try await SendCommand.run(
+      values: plain, runtime: RuntimeOptions(parsedValues: plain), sendMessage: { _ in },
+      journal: journal, config: { IMsgConfig(quietHours: "late") })
+  }
+
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try FileManager.default.createDirectory(at: dir, withIntermediateDirectories: true)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let file = dir.appendingPathComponent("config.yaml")
+  #expect(try IMsgConfig.load(from: file) == IMsgConfig())
+  try "quiet_hours: \"22:00-08:00\"\n".write(to: file, atomically: true, encoding: .utf8)
+  #expect(try IMsgConfig.load(from: file).quietHours == "22:00-08:00")
+  try "quiet_hours: [".write(to: file, atomically: true, encoding: .utf8)
+  #expect(throws: IMsgConfigError.self) { try IMsgConfig.load(from: file) }
+}
+
+@Test
+func sendCommandHonorsIdempotencyKey() async throws {
+  let values = ParsedValues(
+    positional: [],
+    options: ["to": ["+15551234567"], "text": ["hi"], "idempotencyKey": ["standup-1"]],
+    flags: []
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  var sends = 0
+  for _ in 0..<2 {
+    try await SendCommand.run(
+      values: values, runtime: runtime, sendMessage: { _ in sends += 1 }, journal: journal)
+  }
+  #expect(sends == 1)
+  #expect(try journal.entries().map(\.status) == [.sent, .duplicate])
+}
+
+@Test
+func sendCommandRetriesTransientFailures() async throws {
+  let values = ParsedValues(
+    positional: [],
+    options: [
+      "to": ["+15551234567"], "text": ["hi"], "retries": ["2"], "retryBackoff": ["1s"],
+    ],
+    flags: []
+  )
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  var attempts = 0
+  var slept: [TimeInterval] = []
+  try await SendCommand.run(
+    values: values, runtime: RuntimeOptions(parsedValues: values),
+    sendMessage: { _ in
+      attempts += 1
+      if attempts < 3 { throw IMsgError.appleScriptFailure("Application isn’t running. (-600)") }
+    },
+    journal: journal, environment: [:], sleep: { slept.append($0) })
+  #expect(attempts == 3)
+  #expect(slept.count == 2)
+  #expect((0.75...1.25).contains(slept[0]))
+  #expect((1.5...2.5).contains(slept[1]))
+  #expect(try journal.entries().map(\.status) == [.failed, .failed, .sent])
+
+  // A timeout may have been delivered, so it's only retried with an idempotency key.
+  var timeouts = 0
+  let timingOut: (MessageSendOptions) throws -> Void = { _ in
+    timeouts += 1
+    if timeouts < 2 { throw IMsgError.appleScriptFailure("AppleEvent timed out. (-1712)") }
+  }
+  await #expect(throws: IMsgError.self) {
+    try await SendCommand.run(
+      values: values, runtime: RuntimeOptions(parsedValues: values), sendMessage: timingOut,
+      journal: CommandTestDatabase.makeJournal(), environment: [:], sleep: { _ in })
+  }
+  #expect(timeouts == 1)
+  let keyed = ParsedValues(
+    positional: [],
+    options: [
+      "to": ["+15551234567"], "text": ["hi"], "retries": ["2"], "idempotencyKey": ["retry-test"],
+    ],
+    flags: []
+  )
+  timeouts = 0
+  try await SendCommand.run(
+    values: keyed, runtime: RuntimeOptions(parsedValues: keyed), sendMessage: timingOut,
+    journal: CommandTestDatabase.makeJournal(), environment: [:], sleep: { _ in })
+  #expect(timeouts == 2)
+
+  var permanent = 0
+  await #expect(throws: IMsgError.self) {
+    try await SendCommand.run(
+      values: values, runtime: RuntimeOptions(parsedValues: values),
+      sendMessage: { _ in
+        permanent += 1
+        throw IMsgError.invalidHandle("+15551234567")
+      },
+      journal: CommandTestDatabase.makeJournal(), environment: [:], sleep: { _ in })
+  }
+  #expect(permanent == 1)
+}
+
+@Test
+func reactCommandRejectsCustomEmojiType() async {
+  let values = ParsedValues(
+    positional: [],
+    options: ["messageGUID": ["guid-1"], "type": ["🎉"]],
+    flags: []
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  await #expect(throws: ParsedValuesError.self) {
+    try await ReactCommand.run(
+      values: values, runtime: runtime,
+      storeFactory: { _ in throw IMsgError.invalidChatTarget("store should not be opened") },
+      sendTapback: { _, _ in })
+  }
+}
+
+@Test
+func sendCommandDetectsGroupChatIdentifiers() {
+  #expect(SendCommand.looksLikeChatIdentifier("chat123456"))
+  #expect(SendCommand.looksLikeChatIdentifier("iMessage;+;chat123456"))
+  #expect(!SendCommand.looksLikeChatIdentifier("chatty@example.com"))
+  #expect(!SendCommand.looksLikeChatIdentifier("+15551234567"))
+}
+
+@Test
+func messageCommandRequiresGuidOrRowID() async {
+  let values = ParsedValues(positional: [], options: [:], flags: [])
+  let runtime = RuntimeOptions(parsedValues: values)
+  do {
+    try await MessageCommand.run(values: values, runtime: runtime)
+    #expect(Bool(false))
+  } catch let error as ParsedValuesError {
+    #expect(error.description.contains("guid or rowid"))
+  } catch {
+    #expect(Bool(false))
+  }
+}
+
+@Test
+func messageCommandPrintsByRowID() async throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "rowid": ["1"]],
+    flags: ["jsonOutput"]
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  var lines: [String] = []
+  try await MessageCommand.run(values: values, runtime: runtime, output: { lines.append($0) })
+  #expect(lines.count == 1)
+  let payload = try JSONDecoder().decode(MessagePayload.self, from: Data(lines[0].utf8))
+  #expect(payload.id == 1)
+  #expect(payload.chatID == 1)
+  #expect(payload.sender == "+123")
+  #expect(payload.text == "hello")
+  #expect(!payload.isFromMe)
+
+  let plain = ParsedValues(positional: [], options: ["db": [path], "rowid": ["1"]], flags: [])
+  lines = []
+  try await MessageCommand.run(
+    values: plain, runtime: RuntimeOptions(parsedValues: plain), output: { lines.append($0) })
+  #expect(lines.count == 2)
+  #expect(lines.first?.hasSuffix("+123: hello") == true)
+  #expect(lines.last?.hasPrefix("  id=1 chat=1 guid=") == true)
+}
+
+@Test
+func messagesCommandFetchesIdsOrGuids() throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  for options: [String: [String]] in [["ids": ["1,2"]], ["ids": ["2", "1,999"]]] {
+    var all = options
+    all["db"] = [path]
+    let values = ParsedValues(positional: [], options: all, flags: ["jsonOutput"])
+    try MessagesCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+  }
+  for options: [String: [String]] in [[:], ["ids": ["1"], "guids": ["x"]], ["ids": ["one"]]] {
+    var all = options
+    all["db"] = [path]
+    let values = ParsedValues(positional: [], options: all, flags: [])
+    #expect(throws: ParsedValuesError.self) {
+      try MessagesCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+    }
+  }
+}
+
+@Test
+func unreadCommandListsThenAcks() async throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let stateFile = FileManager.default.temporaryDirectory
+    .appendingPathComponent(UUID().uuidString)
+    .appendingPathComponent("unread.json")
+  let cursorFactory: (String) throws -> UnreadCursorStore = {
+    try UnreadCursorStore(databasePath: $0, fileURL: stateFile)
+  }
+  let store = try MessageStore(path: path)
+  let before = try UnreadCommand.unreadMessages(
+    store: store, cursors: try cursorFactory(path), chatID: nil, limit: 10)
+  #expect(before.map(\.rowID) == [1])
+
+  let values = ParsedValues(positional: [], options: ["db": [path]], flags: ["ack"])
+  try await UnreadCommand.run(
+    values: values, runtime: RuntimeOptions(parsedValues: values), cursorFactory: cursorFactory)
+
+  let after = try UnreadCommand.unreadMessages(
+    store: store, cursors: try cursorFactory(path), chatID: 1, limit: 10)
+  #expect(after.isEmpty)
+}
+
 @Test
 func watchCommandRejectsInvalidDebounce() async {
   let values = ParsedValues(
@@ -213,6 +880,20 @@ func watchCommandRejectsInvalidDebounce() async {
   }
 }
 
+@Test
+func watchPollIntervalsDefaultAndValidate() throws {
+  func intervals(_ options: [String: [String]]) throws -> (min: TimeInterval, max: TimeInterval) {
+    try WatchCommand.pollIntervals(
+      from: ParsedValues(positional: [], options: options, flags: []))
+  }
+  #expect(try intervals([:]).max == 0)
+  let fallback = try intervals(["pollMax": ["1m"]])
+  #expect(fallback.min == 0.5 && fallback.max == 60)
+  #expect(try intervals(["pollMin": ["2s"]]).max == 30)
+  #expect(throws: ParsedValuesError.self) { try intervals(["pollMin": ["1m"], "pollMax": ["5s"]]) }
+  #expect(throws: ParsedValuesError.self) { try intervals(["pollMin": ["soon"]]) }
+}
+
 @Test
 func watchCommandRunsWithStubStream() async throws {
   let values = ParsedValues(
@@ -245,9 +926,9 @@ func watchCommandRunsWithStubStream() async throws {
       Int64?,
       Int64?,
       MessageWatcherConfiguration
-    ) -> AsyncThrowingStream<Message, Error> = { _, _, _, _ in
+    ) -> AsyncThrowingStream<MessageWatchEvent, Error> = { _, _, _, _ in
       AsyncThrowingStream { continuation in
-        continuation.yield(message)
+        continuation.yield(.message(message))
         continuation.finish()
       }
     }
@@ -259,6 +940,56 @@ func watchCommandRunsWithStubStream() async throws {
   )
 }
 
+@Test
+func watchCommandResumesAfterLastProcessedRowID() async throws {
+  let stateFile = FileManager.default.temporaryDirectory
+    .appendingPathComponent(UUID().uuidString)
+    .appendingPathComponent("watch.json")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": ["/tmp/unused"], "chatID": ["1"], "debounce": ["1ms"]],
+    flags: ["resume"]
+  )
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  let message = Message(
+    rowID: 7,
+    chatID: 1,
+    sender: "+123",
+    text: "hello",
+    date: Date(),
+    isFromMe: false,
+    service: "iMessage",
+    handleID: nil,
+    attachmentsCount: 0
+  )
+  var requested: [Int64?] = []
+  let streamProvider:
+    (
+      MessageWatcher,
+      Int64?,
+      Int64?,
+      MessageWatcherConfiguration
+    ) -> AsyncThrowingStream<MessageWatchEvent, Error> = { _, _, sinceRowID, _ in
+      requested.append(sinceRowID)
+      return AsyncThrowingStream { continuation in
+        continuation.yield(.message(message))
+        continuation.finish()
+      }
+    }
+  for _ in 0..<2 {
+    try await WatchCommand.run(
+      values: values,
+      runtime: RuntimeOptions(parsedValues: values),
+      storeFactory: { _ in store },
+      cursorFactory: { try WatchCursorStore(databasePath: $0, fileURL: stateFile) },
+      streamProvider: streamProvider
+    )
+  }
+  #expect(requested == [nil, 7])
+}
+
 @Test
 func watchCommandRunsWithJsonOutput() async throws {
   let values = ParsedValues(
@@ -314,9 +1045,9 @@ func watchCommandRunsWithJsonOutput() async throws {
       Int64?,
       Int64?,
       MessageWatcherConfiguration
-    ) -> AsyncThrowingStream<Message, Error> = { _, _, _, _ in
+    ) -> AsyncThrowingStream<MessageWatchEvent, Error> = { _, _, _, _ in
       AsyncThrowingStream { continuation in
-        continuation.yield(message)
+        continuation.yield(.message(message))
         continuation.finish()
       }
     }
@@ -327,3 +1058,937 @@ func watchCommandRunsWithJsonOutput() async throws {
     streamProvider: streamProvider
   )
 }
+
+@Test
+func auditCommandRunsWithJsonOutput() async throws {
+  let fake = try CommandTestDatabase.make(withAttachment: true)
+  defer { fake.remove() }
+  let path = fake.path
+  let attachmentsDir = URL(fileURLWithPath: path).deletingLastPathComponent()
+    .appendingPathComponent("Attachments")
+  try FileManager.default.createDirectory(at: attachmentsDir, withIntermediateDirectories: true)
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "attachmentsDir": [attachmentsDir.path]],
+    flags: ["jsonOutput"]
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  try await AuditCommand.run(values: values, runtime: runtime)
+  for limit in ["0", "-3", "many"] {
+    let bad = ParsedValues(positional: [], options: ["db": [path], "limit": [limit]], flags: [])
+    await #expect(throws: ParsedValuesError.self) {
+      try await AuditCommand.run(values: bad, runtime: RuntimeOptions(parsedValues: bad))
+    }
+  }
+}
+
+@Test
+func doctorDatabaseChecksReportReadableDatabase() throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let checks = DoctorCommand.databaseChecks(path: path)
+  #expect(checks.first?.name == "database")
+  #expect(checks.first?.status == .ok)
+}
+
+@Test
+func doctorDatabaseChecksFailWhenMissing() {
+  let path = FileManager.default.temporaryDirectory
+    .appendingPathComponent(UUID().uuidString)
+    .appendingPathComponent("chat.db").path
+  let checks = DoctorCommand.databaseChecks(path: path)
+  #expect(checks.count == 1)
+  #expect(checks.first?.status == .fail)
+  #expect(checks.first?.remediation.isEmpty == false)
+}
+
+@Test
+func doctorWALChecksMapIssuesToRemediation() {
+  func status(_ issues: [WALStatus.Issue], isWAL: Bool? = true) -> WALStatus {
+    WALStatus(
+      isWAL: isWAL, walBytes: 4_096_032, walFrames: 992, pendingFrames: 12, walModified: nil,
+      databaseModified: nil, issues: issues)
+  }
+  #expect(DoctorCommand.walChecks(status: status([])).map(\.status) == [.ok])
+  #expect(DoctorCommand.walChecks(status: status([])).first?.detail.contains("12 frames") == true)
+  let rollback = DoctorCommand.walChecks(status: status([], isWAL: false))
+  #expect(rollback.first?.detail.contains("no WAL") == true)
+  let checks = DoctorCommand.walChecks(
+    status: status([.walUnreadable, .checkpointLag(frames: 20_000)]))
+  #expect(checks.map(\.status) == [.fail, .warn])
+  #expect(checks.allSatisfy { !$0.remediation.isEmpty })
+  #expect(DoctorCommand.walChecks(status: status([.shmMissing])).first?.status == .fail)
+}
+
+@Test
+func doctorIntegrityChecksFlagDamage() throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  let healthy = DoctorCommand.integrityChecks(report: try store.integrityReport())
+  #expect(healthy.map(\.name) == ["integrity", "joins", "attachment files", "rowids"])
+  #expect(healthy.first?.status == .ok)
+
+  let damaged = DatabaseIntegrity(
+    integrityErrors: ["row 12 missing from index message_idx_date"],
+    messagesWithoutChat: 3, danglingChatMessageJoins: 0, danglingAttachmentJoins: 0,
+    messagesWithMissingHandle: 0, attachmentsWithFile: 10, attachmentsMissingFile: 2,
+    attachmentsMissingFileInCloud: 1, messageCount: 90, minRowID: 1, maxRowID: 100,
+    missingRowIDs: 10, largestGap: RowIDGap(after: 40, before: 48), rowIDSequence: 120)
+  let checks = DoctorCommand.integrityChecks(report: damaged)
+  #expect(checks.map(\.status) == [.fail, .warn, .warn, .warn])
+  #expect(checks[1].detail == "3 messages without a chat")
+  #expect(checks[3].detail.contains("largest gap 7 after 40"))
+  #expect(checks[3].detail.contains("the newest 20 are gone"))
+}
+
+@Test
+func doctorSkipsAccountCheckWithoutAutomation() {
+  var probed = false
+  let check = DoctorCommand.signedInCheck(
+    automation: .denied,
+    enabledServiceCount: {
+      probed = true
+      return 1
+    }
+  )
+  #expect(check.status == .warn)
+  #expect(probed == false)
+  #expect(DoctorCommand.automationCheck(status: .denied).status == .fail)
+}
+
+@Test
+func doctorCommandRunsWithStubProbes() async throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path]],
+    flags: ["jsonOutput"]
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  var lines: [String] = []
+  try await DoctorCommand.run(
+    values: values,
+    runtime: runtime,
+    automationStatus: { .granted },
+    enabledServiceCount: { 2 },
+    output: { lines.append($0) }
+  )
+  #expect(lines.count == 1)
+  let report = try JSONDecoder().decode(DoctorReport.self, from: Data(lines[0].utf8))
+  #expect(report.ok)
+  let checks = Dictionary(uniqueKeysWithValues: report.checks.map { ($0.name, $0) })
+  #expect(checks["database"]?.detail == "readable (max rowid 1)")
+  #expect(checks["automation"]?.detail == "Messages automation allowed")
+  #expect(checks["account"]?.detail == "2 enabled services")
+}
+
+@Test
+func doctorCommandThrowsWhenAccountSignedOut() async throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let values = ParsedValues(positional: [], options: ["db": [path]], flags: [])
+  let runtime = RuntimeOptions(parsedValues: values)
+  do {
+    try await DoctorCommand.run(
+      values: values,
+      runtime: runtime,
+      automationStatus: { .granted },
+      enabledServiceCount: { 0 }
+    )
+    #expect(Bool(false))
+  } catch let error as DoctorError {
+    #expect(error.description.contains("1 check failed"))
+  }
+}
+
+@Test
+func accountsCommandRunsWithStubProvider() async throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path]],
+    flags: ["jsonOutput"]
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  var called = false
+  try await AccountsCommand.run(
+    values: values,
+    runtime: runtime,
+    accountsProvider: {
+      called = true
+      return [
+        MessagesAccount(
+          id: "SMS-1", serviceType: "SMS", name: "SMS", enabled: true,
+          connectionStatus: "connected")
+      ]
+    }
+  )
+  #expect(called)
+}
+
+@Test
+func accountsCommandToleratesAutomationFailure() async throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let values = ParsedValues(positional: [], options: ["db": [path]], flags: [])
+  let runtime = RuntimeOptions(parsedValues: values)
+  var lines: [String] = []
+  try await AccountsCommand.run(
+    values: values,
+    runtime: runtime,
+    accountsProvider: { throw IMsgError.appleScriptFailure("not authorized") },
+    output: { lines.append($0) }
+  )
+  // No account rows and no SMS relay verdict, just the reason they're missing.
+  #expect(lines.count == 1)
+  #expect(lines.first?.hasPrefix("accounts: unavailable (") == true)
+  #expect(lines.first?.contains("not authorized") == true)
+}
+
+@Test
+func historyCommandRejectsBothMatchOptions() async throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "chatID": ["1"], "match": ["a"], "matchIcase": ["b"]],
+    flags: []
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  do {
+    try await HistoryCommand.spec.run(values, runtime)
+    #expect(Bool(false))
+  } catch let error as ParsedValuesError {
+    #expect(error.description.contains("match-icase"))
+  }
+}
+
+@Test
+func historyCommandRunsWithMatchFilter() async throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "chatID": ["1"], "matchIcase": ["HELLO"]],
+    flags: ["jsonOutput"]
+  )
+  let runtime = RuntimeOptions(parsedValues: values)
+  try await HistoryCommand.spec.run(values, runtime)
+}
+
+@Test
+func serviceCommandInstallsLaunchAgentAndReportsStatus() throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let agents = dir.appendingPathComponent("LaunchAgents")
+  var calls: [[String]] = []
+  let launchctl: ServiceCommand.Launchctl = { arguments in
+    calls.append(arguments)
+    if arguments.first == "print" {
+      return (0, "com.imsg.test = {\n\tstate = running\n\tpid = 4242\n\tlast exit code = 0\n}")
+    }
+    return (0, "")
+  }
+  let install = ParsedValues(
+    positional: ["install"],
+    options: [
+      "label": ["com.imsg.test"], "run": ["bridge matrix --room 1='!a:example.org'"],
+      "logDir": [dir.appendingPathComponent("Logs").path],
+    ],
+    flags: [])
+  try ServiceCommand.run(
+    values: install, runtime: RuntimeOptions(parsedValues: install), agentsDirectory: agents,
+    executablePath: "/usr/local/bin/imsg", environment: ["IMSG_STATE_DIR": "/tmp/s", "HOME": "/h"],
+    launchctl: launchctl)
+
+  let plistURL = agents.appendingPathComponent("com.imsg.test.plist")
+  let plist = try #require(
+    PropertyListSerialization.propertyList(from: Data(contentsOf: plistURL), format: nil)
+      as? [String: Any])
+  #expect(
+    plist["ProgramArguments"] as? [String]
+      == [
+        "/usr/local/bin/imsg", "bridge", "matrix", "--room", "1=!a:example.org", "--log-file",
+        dir.appendingPathComponent("Logs/com.imsg.test.log").path,
+      ])
+  #expect(plist["KeepAlive"] as? Bool == true)
+  #expect(plist["EnvironmentVariables"] as? [String: String] == ["IMSG_STATE_DIR": "/tmp/s"])
+  #expect(calls.map(\.first) == ["bootout", "bootstrap"])
+  #expect(calls[1].last == plistURL.path)
+
+  let payload = try ServiceCommand.status(
+    label: "com.imsg.test", plistURL: plistURL, launchctl: launchctl)
+  #expect(payload.installed && payload.loaded)
+  #expect(payload.state == "running")
+  #expect(payload.pid == 4242)
+  #expect(payload.lastExitCode == 0)
+
+  #expect(
+    LaunchAgent.splitArguments("watch --template \"{{.Sender}}: {{.Text}}\"")
+      == ["watch", "--template", "{{.Sender}}: {{.Text}}"])
+  #expect(LaunchAgent.splitArguments("watch 'unclosed") == nil)
+  let bad = ParsedValues(positional: ["install"], options: ["run": ["service status"]], flags: [])
+  #expect(throws: ParsedValuesError.self) {
+    try ServiceCommand.run(
+      values: bad, runtime: RuntimeOptions(parsedValues: bad), agentsDirectory: agents,
+      launchctl: launchctl)
+  }
+}
+
+@Test
+func messageRulesRunActionsOfMatchingRules() async throws {
+  let ruleSet = try MessageRuleSet.parse(
+    """
+    rules:
+      - name: greet
+        match: {sender: "+123", text: "^hel+o$", from_me: false}
+        actions:
+          - exec: "echo \\"$IMSG_TEXT\\""
+          - reply: "Auto: got {{.Text}}"
+        stop: true
+      - name: after-stop
+        actions:
+          - notify: "{{.Text}}"
+      - name: photos
+        match: {attachment: image}
+        actions:
+          - notify: "photo"
+    """)
+  var commands: [[String]] = []
+  var sent: [MessageSendOptions] = []
+  let journal = CommandTestDatabase.makeJournal()
+  defer { CommandTestDatabase.removeJournal(journal) }
+  let engine = MessageRuleEngine(
+    ruleSet: ruleSet,
+    timestamps: TimestampFormatter(style: .unix),
+    journal: journal,
+    sendMessage: { sent.append($0) },
+    runProcess: { _, arguments, environment in
+      commands.append(arguments + [environment["IMSG_TEXT"] ?? ""])
+    }
+  )
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  let message = try #require(try store.message(rowID: 1))
+
+  #expect(await engine.handle(message, store: store) == ["greet"])
+  #expect(await engine.handle(message, store: store) == ["greet"])
+  #expect(commands.first == ["-c", "echo \"$IMSG_TEXT\"", "hello"])
+  #expect(sent.map(\.text) == ["Auto: got hello"])
+
+  #expect(throws: MessageRuleError.self) {
+    try MessageRuleSet.parse("rules:\n  - actions: [{reply: \"{{.Nope}}\"}]")
+  }
+  #expect(throws: MessageRuleError.self) {
+    try MessageRuleSet.parse("rules:\n  - match: {between: noon}\n    actions: [{exec: ls}]")
+  }
+}
+
+@Test
+func messageRulesMatchBetweenOnTheMessageDate() throws {
+  let rule = try #require(
+    try MessageRuleSet.parse(
+      "rules:\n  - match: {between: \"22:00-07:00\"}\n    actions: [{exec: ls}]"
+    ).rules.first)
+  var calendar = Calendar(identifier: .gregorian)
+  calendar.timeZone = TimeZone(identifier: "UTC")!
+  func message(hour: Int) throws -> Message {
+    let date = try #require(
+      calendar.date(from: DateComponents(year: 2024, month: 5, day: 1, hour: hour)))
+    return Message(
+      rowID: 1, chatID: 1, sender: "+123", text: "hi", date: date, isFromMe: false,
+      service: "iMessage", handleID: nil, attachmentsCount: 0)
+  }
+  // Whenever it is read (a --resume replay the next morning, say), a message sent at 23:00
+  // is in the window and one sent at noon is not.
+  #expect(rule.matches(try message(hour: 23), attachments: { [] }, calendar: calendar))
+  #expect(!rule.matches(try message(hour: 12), attachments: { [] }, calendar: calendar))
+}
+
+@Test
+func webhookQueueReplaysInOrderOnceEndpointRecovers() async throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  var now = Date(timeIntervalSince1970: 1_700_000_000)
+  var status = 503
+  var posted: [(id: String, body: String)] = []
+  let queue = WebhookQueue(
+    directoryURL: dir.appendingPathComponent("webhook-queue"),
+    receiptsURL: dir.appendingPathComponent("webhook-receipts.jsonl"),
+    capacity: 3,
+    transport: { request in
+      posted.append(
+        (
+          request.value(forHTTPHeaderField: "X-Imsg-Event-Id") ?? "",
+          String(decoding: request.httpBody ?? Data(), as: UTF8.self)
+        ))
+      let response = HTTPURLResponse(
+        url: try #require(request.url), statusCode: status, httpVersion: nil, headerFields: nil)
+      return (Data(), try #require(response))
+    },
+    now: { now }
+  )
+  let url = try #require(URL(string: "https://example.com/hook"))
+  func deliver(_ body: String) async throws -> WebhookQueue.Outcome {
+    try await queue.deliver(url: url, body: Data(body.utf8), rule: "codes", messageID: 7)
+  }
+
+  #expect(try await deliver("1") == .queued(pending: 1, error: "returned 503"))
+  // Queued behind the first, which is still backing off.
+  #expect(try await deliver("2") == .queued(pending: 2, error: "returned 503"))
+  #expect(posted.count == 1)
+  status = 200
+  #expect(try await queue.flush() == 0)
+  now += WebhookQueue.retryDelay(afterAttempts: 1) + 1
+  #expect(try await queue.flush() == 2)
+  #expect(posted.map(\.body) == ["1", "1", "2"])
+  #expect(posted[0].id == posted[1].id && posted[1].id != posted[2].id)
+  #expect(try queue.pending().isEmpty)
+
+  status = 400
+  #expect(try await deliver("3") == .rejected(statusCode: 400))
+  status = 500
+  for body in ["a", "b", "c", "d"] {
+    _ = try await deliver(body)
+  }
+  #expect(try queue.pending().map(\.body) == ["b", "c", "d"])
+  #expect(
+    try queue.receipts().map(\.status) == [.delivered, .delivered, .rejected, .dropped])
+  #expect(try queue.receipts().first?.attempts == 2)
+
+  status = 200
+  let values = ParsedValues(positional: [], options: [:], flags: ["drain"])
+  try await WebhookQueueCommand.run(
+    values: values, runtime: RuntimeOptions(parsedValues: values), queue: queue)
+  #expect(try queue.pending().isEmpty)
+  #expect(posted.suffix(3).map(\.body) == ["b", "c", "d"])
+}
+
+@Test
+func webhookQueueLeavesClaimedURLsAndRotatesReceipts() async throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  var posted = 0
+  let queue = WebhookQueue(
+    directoryURL: dir.appendingPathComponent("webhook-queue"),
+    receiptsURL: dir.appendingPathComponent("webhook-receipts.jsonl"),
+    receiptsMaxBytes: 600,
+    transport: { request in
+      posted += 1
+      let response = HTTPURLResponse(
+        url: try #require(request.url), statusCode: 200, httpVersion: nil, headerFields: nil)
+      return (Data(), try #require(response))
+    }
+  )
+  let url = try #require(URL(string: "https://example.com/hook"))
+
+  // Another live process (launchd's pid stands in) is flushing this URL.
+  _ = try queue.pending()
+  try "1".write(to: queue.claimURL(for: url), atomically: true, encoding: .utf8)
+  #expect(
+    try await queue.deliver(url: url, body: Data("1".utf8), rule: nil, messageID: 1)
+      == .queued(pending: 1, error: nil))
+  #expect(posted == 0)
+  try FileManager.default.removeItem(at: queue.claimURL(for: url))
+
+  for body in ["2", "3", "4"] {
+    #expect(
+      try await queue.deliver(url: url, body: Data(body.utf8), rule: nil, messageID: 2)
+        == .delivered)
+  }
+  #expect(posted == 4)
+  #expect(try queue.pending().isEmpty)
+  #expect(FileManager.default.fileExists(atPath: queue.rotatedReceiptsURL.path))
+  #expect(try queue.receipts().map(\.status) == Array(repeating: .delivered, count: 4))
+}
+
+@Test
+func selfUpdateVerifiesChecksumBeforeReplacingBinary() async throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try FileManager.default.createDirectory(at: dir, withIntermediateDirectories: true)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let executable = dir.appendingPathComponent("imsg")
+  try Data("old".utf8).write(to: executable)
+  let zip = Data("zip".utf8)
+  let digest = SHA256.hash(data: zip).map { String(format: "%02x", $0) }.joined()
+  var checksum = "\(digest)  imsg-macos.zip\n"
+  func release(
+    _ tag: String, prerelease: Bool = false, draft: Bool = false, signed: Bool = true
+  ) -> String {
+    let sum =
+      signed
+      ? ",{\"name\":\"imsg-macos.zip.sha256\","
+        + "\"browser_download_url\":\"https://example.com/\(tag).sha256\"}" : ""
+    return """
+      {"tag_name":"\(tag)","html_url":"https://github.com/steipete/imsg/releases/tag/\(tag)",
+      "draft":\(draft),"prerelease":\(prerelease),"assets":[
+      {"name":"imsg-macos.zip","browser_download_url":"https://example.com/\(tag).zip"}\(sum)]}
+      """
+  }
+  // v0.7.0 was rebuilt by CI without a checksum, so it is skipped.
+  let releases =
+    "[\(release("v0.6.0-beta.1", prerelease: true)),\(release("v0.5.0")),"
+    + "\(release("v0.4.1")),\(release("v0.9.0", draft: true)),\(release("v0.7.0", signed: false))]"
+  var tools: [[String]] = []
+  let transport: SelfUpdater.Transport = { request in
+    let url = try #require(request.url)
+    let body: Data
+    switch url.pathExtension {
+    case "sha256": body = Data(checksum.utf8)
+    case "zip": body = zip
+    default: body = Data(releases.utf8)
+    }
+    let response = HTTPURLResponse(url: url, statusCode: 200, httpVersion: nil, headerFields: nil)
+    return (body, try #require(response))
+  }
+  let tool: SelfUpdater.Tool = { path, arguments in
+    tools.append([path] + arguments)
+    if path == "/usr/bin/ditto", let out = arguments.last {
+      let bundle = URL(fileURLWithPath: out)
+        .appendingPathComponent("PhoneNumberKit_PhoneNumberKit.bundle")
+      try FileManager.default.createDirectory(at: bundle, withIntermediateDirectories: true)
+      try Data("new".utf8).write(to: bundle.appendingPathComponent("new.txt"))
+      try Data("new".utf8).write(to: URL(fileURLWithPath: out).appendingPathComponent("imsg"))
+    }
+    return (0, "")
+  }
+  let updater = SelfUpdater(executableURL: executable, transport: transport, tool: tool)
+
+  #expect(try #require(ReleaseVersion("v0.5.0-beta.2")) < #require(ReleaseVersion("0.5.0")))
+  #expect(try #require(ReleaseVersion("v0.5.0-beta.2")) < #require(ReleaseVersion("0.5.0-rc.1")))
+  #expect(try await updater.latestRelease(channel: .stable)?.tagName == "v0.5.0")
+  #expect(try await updater.latestRelease(channel: .edge)?.tagName == "v0.6.0-beta.1")
+
+  let check = ParsedValues(positional: [], options: [:], flags: ["check"])
+  try await SelfUpdateCommand.run(
+    values: check, runtime: RuntimeOptions(parsedValues: check), currentVersion: "0.4.0",
+    updater: updater)
+  #expect(try String(contentsOf: executable, encoding: .utf8) == "old")
+
+  let values = ParsedValues(positional: [], options: ["channel": ["edge"]], flags: [])
+  func update() async throws {
+    try await SelfUpdateCommand.run(
+      values: values, runtime: RuntimeOptions(parsedValues: values), currentVersion: "0.4.0",
+      updater: updater)
+  }
+  checksum = String(repeating: "0", count: 64)
+  await #expect(throws: SelfUpdateError.self) { try await update() }
+  #expect(try String(contentsOf: executable, encoding: .utf8) == "old")
+  #expect(tools.isEmpty)
+
+  checksum = "\(digest)  imsg-macos.zip\n"
+  // A binary that can't be replaced (here a directory is in the way) puts the old bundle back.
+  let bundle = dir.appendingPathComponent("PhoneNumberKit_PhoneNumberKit.bundle")
+  try FileManager.default.createDirectory(at: bundle, withIntermediateDirectories: true)
+  try Data("old".utf8).write(to: bundle.appendingPathComponent("old.txt"))
+  let blocked = dir.appendingPathComponent("blocked")
+  try FileManager.default.createDirectory(
+    at: blocked.appendingPathComponent("inside"), withIntermediateDirectories: true)
+  let stuck = SelfUpdater(executableURL: blocked, transport: transport, tool: tool)
+  let edge = try #require(try await stuck.latestRelease(channel: .edge))
+  await #expect(throws: (any Error).self) { try await stuck.install(edge) }
+  #expect(FileManager.default.fileExists(atPath: bundle.appendingPathComponent("old.txt").path))
+  try FileManager.default.removeItem(at: blocked)
+
+  try await update()
+  #expect(FileManager.default.fileExists(atPath: bundle.appendingPathComponent("new.txt").path))
+  #expect(try String(contentsOf: executable, encoding: .utf8) == "new")
+  #expect(
+    FileManager.default.fileExists(
+      atPath: dir.appendingPathComponent("PhoneNumberKit_PhoneNumberKit.bundle").path))
+  #expect(tools.last?.contains(SelfUpdater.signingRequirement) == true)
+  let leftovers = try FileManager.default.contentsOfDirectory(atPath: dir.path)
+  #expect(leftovers.sorted() == ["PhoneNumberKit_PhoneNumberKit.bundle", "imsg"])
+  #expect(
+    SelfUpdater.isHomebrewManaged(
+      URL(fileURLWithPath: "/opt/homebrew/Cellar/imsg/0.4.0/bin/imsg")))
+}
+
+@Test
+func watchExecHookPassesMessageInEnvironmentAndStdin() async throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try FileManager.default.createDirectory(at: dir, withIntermediateDirectories: true)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  let message = try #require(try store.message(rowID: 1))
+  let payload = MessagePayload(message: message, attachments: [])
+  let out = dir.appendingPathComponent("out").path
+
+  let hook = WatchExecHook(
+    command: "printf '%s|%s|' \"$IMSG_CHAT_ID\" \"$IMSG_TEXT\" > '\(out)'; cat >> '\(out)'",
+    concurrency: 2)
+  await hook.submit(message, payload: payload)
+  await hook.finish()
+  let written = try String(contentsOfFile: out, encoding: .utf8)
+  #expect(written == "1|hello|" + (try JSONLines.encode(payload)) + "\n")
+
+  await #expect(throws: WatchExecError.self) {
+    try await WatchExecHook(command: "exit 3").run(message, payload: payload)
+  }
+  let started = Date()
+  await #expect(throws: WatchExecError.self) {
+    try await WatchExecHook(command: "sleep 5", timeout: 0.2).run(message, payload: payload)
+  }
+  #expect(Date().timeIntervalSince(started) < 4)
+
+  let values = ParsedValues(positional: [], options: ["execTimeout": ["5s"]], flags: [])
+  #expect(throws: ParsedValuesError.self) { try WatchExecHook.from(values: values) }
+}
+
+@Test
+func autoreplyCommandAnswersEachSenderOncePerInterval() async throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let stateDirectory = FileManager.default.temporaryDirectory
+    .appendingPathComponent(UUID().uuidString)
+  defer { try? FileManager.default.removeItem(at: stateDirectory) }
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "text": ["Away until Monday"], "oncePer": ["1h"]],
+    flags: []
+  )
+  func incoming(_ rowID: Int64, from sender: String, isFromMe: Bool = false) -> Message {
+    Message(
+      rowID: rowID, chatID: 1, sender: sender, text: "hi", date: Date(), isFromMe: isFromMe,
+      service: "iMessage", handleID: nil, attachmentsCount: 0)
+  }
+  let streamProvider:
+    (
+      MessageWatcher,
+      Int64?,
+      Int64?,
+      MessageWatcherConfiguration
+    ) -> AsyncThrowingStream<MessageWatchEvent, Error> = { _, _, _, _ in
+      AsyncThrowingStream { continuation in
+        continuation.yield(.message(incoming(10, from: "+123")))
+        continuation.yield(.message(incoming(11, from: "", isFromMe: true)))
+        continuation.yield(.message(incoming(12, from: "+123")))
+        continuation.finish()
+      }
+    }
+  var sent: [MessageSendOptions] = []
+  try await AutoreplyCommand.run(
+    values: values,
+    runtime: RuntimeOptions(parsedValues: values),
+    sendMessage: { sent.append($0) },
+    journal: SendJournal(fileURL: stateDirectory.appendingPathComponent("sends.jsonl")),
+    limiterFactory: {
+      try AutoReplyLimiter(fileURL: stateDirectory.appendingPathComponent("autoreply.json"))
+    },
+    streamProvider: streamProvider
+  )
+  #expect(sent.map(\.text) == ["Away until Monday"])
+  #expect(sent.first?.chatIdentifier == "+123")
+
+  let limiter = try AutoReplyLimiter(
+    fileURL: stateDirectory.appendingPathComponent("autoreply.json"))
+  #expect(!limiter.allows(chatID: 1, sender: "+123", interval: 3600, now: Date()))
+  #expect(limiter.allows(chatID: 1, sender: "+123", interval: 3600, now: Date() + 7200))
+}
+
+@Test
+func otpForwardDeliversFreshCodesOnce() async throws {
+  let fake = try CommandTestDatabase.make()
+  defer { fake.remove() }
+  let path = fake.path
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try FileManager.default.createDirectory(at: dir, withIntermediateDirectories: true)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let execOutput = dir.appendingPathComponent("exec.txt")
+  let out = execOutput.path
+  let values = ParsedValues(
+    positional: [],
+    options: [
+      "db": [path],
+      "exec": ["printf '%s ' \"$IMSG_OTP_CODE\" > '\(out)'; cat >> '\(out)'"],
+      "webhook": ["https://example.com/otp"],
+    ],
+    flags: ["copy"]
+  )
+  let now = Date()
+  func incoming(
+    _ rowID: Int64, _ text: String, service: String = "SMS", age: TimeInterval = 0
+  ) -> Message {
+    Message(
+      rowID: rowID, chatID: 1, sender: "+123", text: text, date: now - age, isFromMe: false,
+      service: service, handleID: nil, attachmentsCount: 0)
+  }
+  let streamProvider:
+    (
+      MessageWatcher,
+      Int64?,
+      Int64?,
+      MessageWatcherConfiguration
+    ) -> AsyncThrowingStream<MessageWatchEvent, Error> = { _, _, _, _ in
+      AsyncThrowingStream { continuation in
+        continuation.yield(.message(incoming(10, "Your verification code is 123-456")))
+        continuation.yield(.message(incoming(11, "Your verification code is 123-456")))
+        continuation.yield(.message(incoming(12, "Your login code: 998877", age: 600)))
+        continuation.yield(.message(incoming(13, "Code 4455 for sign in", service: "iMessage")))
+        continuation.yield(.message(incoming(14, "see you at 7")))
+        continuation.finish()
+      }
+    }
+  var runs: [(String, String?)] = []
+  var posted: [OTPPayload] = []
+  let webhooks = WebhookQueue(
+    directoryURL: dir.appendingPathComponent("webhook-queue"),
+    receiptsURL: dir.appendingPathComponent("webhook-receipts.jsonl"),
+    transport: { request in
+      posted.append(try JSONDecoder().decode(OTPPayload.self, from: request.httpBody ?? Data()))
+      let response = HTTPURLResponse(
+        url: try #require(request.url), statusCode: 200, httpVersion: nil, headerFields: nil)
+      return (Data(), try #require(response))
+    })
+  try await OTPForwardCommand.run(
+    values: values,
+    runtime: RuntimeOptions(parsedValues: values),
+    now: { now },
+    runProcess: { executable, _, _, input in
+      runs.append((executable, input))
+    },
+    webhooks: webhooks,
+    streamProvider: streamProvider
+  )
+  #expect(runs.map(\.0) == ["/usr/bin/pbcopy"])
+  #expect(runs.first?.1 == "123456")
+  let exec = try String(contentsOf: execOutput, encoding: .utf8)
+  #expect(exec.hasPrefix("123456 {"))
+  #expect(exec.contains(#""expires_at""#))
+  #expect(posted.map(\.code) == ["123456"])
+  #expect(posted.first?.messageID == 10)
+  #expect(try webhooks.receipts().map(\.status) == [.delivered])
+}
+
+@Test
+func readCommandsLeaveChatDatabaseUntouched() async throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let hello = try fake.addMessage(chatID: chat, text: "hello", sender: "+15551234567")
+  try fake.addMessage(
+    chatID: chat, text: "see attached",
+    attachments: [FakeAttachment(path: "/tmp/missing/notes.txt", mimeType: "text/plain")])
+  try fake.addReaction(to: hello, type: .like)
+  let before = try fake.fingerprint()
+
+  let out = URL(fileURLWithPath: fake.path).deletingLastPathComponent()
+    .appendingPathComponent("export.html")
+  let runs: [(CommandSpec, [String], [String: [String]], Set<String>)] = [
+    (ChatsCommand.spec, [], [:], ["jsonOutput"]),
+    (HistoryCommand.spec, [], ["chatID": ["\(chat)"]], ["jsonOutput", "attachments"]),
+    (MessageCommand.spec, [], ["rowid": ["\(hello)"]], ["jsonOutput"]),
+    (SearchCommand.spec, ["attached"], [:], ["jsonOutput"]),
+    (ContextCommand.spec, [], ["chatID": ["\(chat)"]], []),
+    (ExportCommand.spec, [], ["chatID": ["\(chat)"], "out": [out.path]], []),
+  ]
+  for (spec, positional, options, flags) in runs {
+    var all = options
+    all["db"] = [fake.path]
+    let values = ParsedValues(positional: positional, options: all, flags: flags)
+    try await spec.run(values, RuntimeOptions(parsedValues: values))
+  }
+  #expect(try fake.fingerprint() == before)
+}
+
+@Test
+func tagCommandAnnotatesMessagesInASidecarStore() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let chat = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let first = try fake.addMessage(
+    chatID: chat, text: "call the plumber", sender: "+15551234567", guid: "GUID-1")
+  try fake.addMessage(chatID: chat, text: "ok", guid: "GUID-2")
+  let tagsURL = URL(fileURLWithPath: fake.path).deletingLastPathComponent()
+    .appendingPathComponent("state/tags.db")
+  let tagStore = { try MessageTagStore(fileURL: tagsURL) }
+  let before = try fake.fingerprint()
+  func tag(_ options: [String: [String]]) throws {
+    var all = options
+    all["db"] = [fake.path]
+    let values = ParsedValues(positional: [], options: all, flags: [])
+    try TagCommand.run(
+      values: values, runtime: RuntimeOptions(parsedValues: values), tagStoreFactory: tagStore)
+  }
+
+  try tag(["rowid": ["\(first)"], "add": ["FollowUp,pinned"], "note": ["before friday"]])
+  try tag(["messageGUID": ["GUID-2"], "add": ["followup"]])
+  try tag(["messageGUID": ["GUID-2"], "remove": ["followup"]])
+  #expect(throws: ParsedValuesError.self) { try tag(["rowid": ["\(first)"], "add": ["two words"]]) }
+  #expect(throws: IMsgError.self) { try tag(["messageGUID": ["nope"], "add": ["x"]]) }
+
+  let store = try tagStore()
+  #expect(try store.tags(for: "GUID-1").map(\.tag) == ["followup", "pinned"])
+  #expect(try store.tags(for: "GUID-1").first?.note == "before friday")
+  #expect(try store.taggedMessages("followup") == ["GUID-1"])
+  #expect(try store.tags(for: "GUID-2").isEmpty)
+  #expect(try fake.fingerprint() == before)
+
+  let values = ParsedValues(
+    positional: [], options: ["db": [fake.path], "tag": ["followup"]], flags: ["jsonOutput"])
+  try TaggedCommand.run(
+    values: values, runtime: RuntimeOptions(parsedValues: values), tagStoreFactory: tagStore)
+}
+
+@Test
+func muteCommandHidesChatsUntilUnmuted() throws {
+  let fake = try FakeChatDatabase()
+  defer { fake.remove() }
+  let quiet = try fake.addChat(identifier: "+15551234567", participants: ["+15551234567"])
+  let noisy = try fake.addChat(
+    identifier: "chat100", guid: "iMessage;+;chat100", name: "Neighbours",
+    participants: ["+15551230001", "+15551230002"])
+  try fake.addMessage(chatID: quiet, text: "hi", sender: "+15551234567")
+  try fake.addMessage(chatID: noisy, text: "bins tonight", sender: "+15551230001")
+  let mutedURL = URL(fileURLWithPath: fake.path).deletingLastPathComponent()
+    .appendingPathComponent("state/muted.json")
+  let muteList = { try ChatMuteList(fileURL: mutedURL) }
+  let before = try fake.fingerprint()
+  func values(_ options: [String: [String]], flags: Set<String> = []) -> ParsedValues {
+    var all = options
+    all["db"] = [fake.path]
+    return ParsedValues(positional: [], options: all, flags: flags)
+  }
+
+  let mute = values(["chatID": ["\(noisy)"]])
+  for _ in 0..<2 {
+    try MuteCommand.run(
+      values: mute, runtime: RuntimeOptions(parsedValues: mute), muteListFactory: muteList)
+  }
+  let unknown = values(["chatID": ["999"]])
+  #expect(throws: IMsgError.self) {
+    try MuteCommand.run(
+      values: unknown, runtime: RuntimeOptions(parsedValues: unknown), muteListFactory: muteList)
+  }
+  let store = try fake.makeStore()
+  #expect(try muteList().entries.map(\.guid) == ["iMessage;+;chat100"])
+  #expect(try muteList().entries.first?.name == "Neighbours")
+  #expect(try muteList().isMuted(chatID: noisy, in: store))
+  #expect(try !muteList().isMuted(chatID: quiet, in: store))
+  for flags: Set<String> in [["jsonOutput"], ["jsonOutput", "all"]] {
+    let list = values([:], flags: flags)
+    try ChatsCommand.run(
+      values: list, runtime: RuntimeOptions(parsedValues: list), muteListFactory: muteList)
+  }
+
+  let both = values(["chatID": ["\(noisy)"], "chatGUID": ["iMessage;+;chat100"]])
+  #expect(throws: ParsedValuesError.self) {
+    try UnmuteCommand.run(
+      values: both, runtime: RuntimeOptions(parsedValues: both), muteListFactory: muteList)
+  }
+  let unmute = values(["chatGUID": ["iMessage;+;chat100"]])
+  try UnmuteCommand.run(
+    values: unmute, runtime: RuntimeOptions(parsedValues: unmute), muteListFactory: muteList)
+  #expect(try muteList().isEmpty)
+  #expect(try fake.fingerprint() == before)
+}
+
+@Test
+func diffCommandReportsMessagesMissingFromEitherDatabase() throws {
+  let laptop = try FakeChatDatabase()
+  defer { laptop.remove() }
+  let desktop = try FakeChatDatabase()
+  defer { desktop.remove() }
+  let start = Date(timeIntervalSince1970: 1_700_000_000)
+  for fake in [laptop, desktop] {
+    let chat = try fake.addChat(
+      identifier: "+15551234567", guid: "iMessage;-;+15551234567", participants: ["+15551234567"])
+    try fake.addMessage(
+      chatID: chat, text: "synced", sender: "+15551234567", date: start, guid: "SHARED")
+  }
+  let laptopChat = try #require(try laptop.chatID(matching: "iMessage;-;+15551234567"))
+  try laptop.addMessage(
+    chatID: laptopChat, text: "lost in sync", date: start.addingTimeInterval(60), guid: "LOST")
+  let desktopChat = try desktop.addChat(identifier: "chat9", guid: "iMessage;+;chat9")
+  try desktop.addMessage(
+    chatID: desktopChat, text: "desktop only", date: start.addingTimeInterval(120), guid: "NEW")
+
+  let diff = try MessageStore.diff(try laptop.makeStore(), try desktop.makeStore())
+  #expect(diff.common == 1)
+  #expect(diff.onlyInFirst.map(\.guid) == ["LOST"])
+  #expect(diff.onlyInSecond.map(\.chatGUID) == ["iMessage;+;chat9"])
+  let scoped = try MessageStore.diff(
+    try laptop.makeStore(), try desktop.makeStore(), chatGUID: "iMessage;-;+15551234567")
+  #expect(scoped.onlyInSecond.isEmpty)
+
+  let out = FileManager.default.temporaryDirectory.appendingPathComponent(
+    "\(UUID().uuidString).db")
+  defer { try? FileManager.default.removeItem(at: out) }
+  let values = ParsedValues(
+    positional: [], options: ["db": [laptop.path], "db2": [desktop.path], "out": [out.path]],
+    flags: ["jsonOutput"])
+  try DiffCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+  let archive = try Connection(out.path, readonly: true)
+  #expect(try archive.scalar("SELECT text FROM messages") as? String == "lost in sync")
+  #expect(try archive.scalar("SELECT guid FROM chats") as? String == "iMessage;-;+15551234567")
+  // A second run replaces the archive only once the new one is complete.
+  try DiffCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+  let replaced = try Connection(out.path, readonly: true)
+  #expect(try replaced.scalar("SELECT COUNT(*) FROM messages") as? Int64 == 1)
+  let partial = out.deletingLastPathComponent().appendingPathComponent(
+    ".\(out.lastPathComponent).partial")
+  #expect(!FileManager.default.fileExists(atPath: partial.path))
+  #expect(throws: CocoaError.self) {
+    _ = try PortableArchive(path: out.path, includeBlobs: false, generator: "test")
+  }
+  #expect(throws: ParsedValuesError.self) {
+    let missing = ParsedValues(positional: [], options: ["db": [laptop.path]], flags: [])
+    try DiffCommand.run(values: missing, runtime: RuntimeOptions(parsedValues: missing))
+  }
+}
+
+@Test
+func benchmarkRunsAgainstGeneratedFixture() throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try FileManager.default.createDirectory(at: dir, withIntermediateDirectories: true)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let path = dir.appendingPathComponent("chat.db").path
+  try BenchmarkFixture.generate(at: path, messages: 300, chats: 5)
+
+  let store = try MessageStore(path: path)
+  #expect(try store.maxRowID() == 300)
+  let results = try MessageStoreBenchmark(store: store, iterations: 2).run()
+  #expect(
+    results.map(\.name) == [
+      "list_chats", "messages_by_chat", "messages_after", "text_match", "search",
+    ])
+  #expect(results.allSatisfy { $0.iterations == 2 && $0.minMilliseconds <= $0.p95Milliseconds })
+  #expect(results[0].rows == 5)
+  #expect(results[4].rows == 20)
+}
+
+@Test
+func benchCommandDeletesItsGeneratedFixture() async throws {
+  func leftovers() throws -> [String] {
+    try FileManager.default.contentsOfDirectory(atPath: NSTemporaryDirectory())
+      .filter { $0.hasPrefix("imsg-bench-") }
+  }
+  let before = try leftovers()
+  let values = ParsedValues(
+    positional: [], options: ["fixture": ["50"], "iterations": ["1"]], flags: ["jsonOutput"])
+  try await BenchCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+  #expect(try leftovers() == before)
+}
+
+@Test
+func deletedCommandDescribesRecoveryWindow() {
+  #expect(DeletedCommand.remainingText(12.5 * 86_400) == "12 days left")
+  #expect(DeletedCommand.remainingText(86_400) == "1 day left")
+  #expect(DeletedCommand.remainingText(5 * 3_600 + 60) == "5 hours left")
+  #expect(DeletedCommand.remainingText(30) == "1 hour left")
+  #expect(DeletedCommand.remainingText(0) == "expired")
+}
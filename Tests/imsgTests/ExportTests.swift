@@ -0,0 +1,620 @@
+import Commander
+import Foundation
+import IMsgTesting
+import PDFKit
+import SQLite
+import Testing
+
+@testable import IMsgCore
+@testable import imsg
+
+private enum ExportTestDatabase {
+  static func makeDirectory() throws -> URL {
+    let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+    try FileManager.default.createDirectory(at: dir, withIntermediateDirectories: true)
+    return dir
+  }
+
+  /// Group chat 1 ("Family <3", +123 and +456) with message 1, "look at this" from +123
+  /// carrying `photo.png`, and message 2, "nice & sunny", sent a minute later.
+  static func make(in dir: URL) throws -> FakeChatDatabase {
+    let fake = try FakeChatDatabase(directory: dir)
+    let image = dir.appendingPathComponent("photo.png")
+    try Data([0x89, 0x50, 0x4E, 0x47]).write(to: image)
+    let now = Date()
+    let chat = try fake.addChat(
+      identifier: "chat123", guid: "iMessage;+;chat123", name: "Family <3",
+      participants: ["+123", "+456"])
+    try fake.addMessage(
+      chatID: chat, text: "look at this", sender: "+123", date: now.addingTimeInterval(-60),
+      attachments: [
+        FakeAttachment(path: image.path, mimeType: "image/png", uti: "public.png", totalBytes: 4)
+      ])
+    try fake.addMessage(chatID: chat, text: "nice & sunny", date: now)
+    return fake
+  }
+}
+
+@Test
+func exportHTMLBubblesEmbedsMedia() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  let out = dir.appendingPathComponent("out.html")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "chatID": ["1"], "format": ["html-bubbles"], "out": [out.path]],
+    flags: []
+  )
+  try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+
+  let html = try String(contentsOf: out, encoding: .utf8)
+  #expect(html.contains("<title>Family &lt;3</title>"))
+  #expect(html.contains("class=\"row them\""))
+  #expect(html.contains("class=\"row me\""))
+  #expect(html.contains("nice &amp; sunny"))
+  #expect(html.contains("src=\"data:image/png;base64,"))
+  #expect(html.contains("class=\"day\""))
+  let first = html.range(of: "look at this")?.lowerBound
+  let second = html.range(of: "nice &amp; sunny")?.lowerBound
+  #expect(first != nil && second != nil && first! < second!)
+}
+
+@Test
+func exportHTMLBubblesCopiesAssetsToSiblingDirectory() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  let out = dir.appendingPathComponent("chat.html")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "chatID": ["1"], "assets": ["dir"], "out": [out.path]],
+    flags: ["jsonOutput"]
+  )
+  try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+
+  let html = try String(contentsOf: out, encoding: .utf8)
+  #expect(html.contains("src=\"chat_files/1-0-photo.png\""))
+  let copied = dir.appendingPathComponent("chat_files/1-0-photo.png").path
+  #expect(FileManager.default.fileExists(atPath: copied))
+}
+
+@Test
+func exportHTMLBubblesReplacesUnreadableAttachmentsWithAPlaceholder() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  // Still there, so not "missing", but a directory can't be read as the image.
+  let image = dir.appendingPathComponent("photo.png")
+  try FileManager.default.removeItem(at: image)
+  try FileManager.default.createDirectory(at: image, withIntermediateDirectories: false)
+  let out = dir.appendingPathComponent("out.html")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "chatID": ["1"], "format": ["html-bubbles"], "out": [out.path]],
+    flags: []
+  )
+  try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+
+  let html = try String(contentsOf: out, encoding: .utf8)
+  #expect(html.contains("[unreadable attachment: photo.png]"))
+  #expect(html.contains("look at this"))
+  #expect(html.contains("nice &amp; sunny"))
+}
+
+@Test
+func exportEMLWritesOneMIMEMessagePerMessage() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  let out = dir.appendingPathComponent("family-eml")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "chatID": ["1"], "format": ["eml"], "out": [out.path]],
+    flags: []
+  )
+  try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+
+  let files = try FileManager.default.contentsOfDirectory(atPath: out.path).sorted()
+  #expect(files.count == 2)
+  #expect(files.allSatisfy { $0.hasSuffix(".eml") })
+  let received = try String(contentsOf: out.appendingPathComponent(files[0]), encoding: .utf8)
+  #expect(received.contains("From: <+123@imessage.invalid>\r\n"))
+  #expect(received.contains("Subject: Family <3\r\n"))
+  #expect(received.contains("Content-Type: multipart/mixed; boundary=\"=_imsg_1\""))
+  #expect(received.contains("Content-Disposition: attachment; filename=\"photo.png\""))
+  #expect(received.contains("iVBORw==\r\n--=_imsg_1--\r\n"))
+  let sent = try String(contentsOf: out.appendingPathComponent(files[1]), encoding: .utf8)
+  #expect(sent.contains("From: Me <me@imessage.invalid>\r\n"))
+  #expect(sent.contains("\r\n\r\nnice & sunny\r\n"))
+  #expect(!sent.contains("multipart"))
+}
+
+@Test
+func exportTXTCompatMatchesImessageExporterLayout() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  let out = dir.appendingPathComponent("family.txt")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "chatID": ["1"], "format": ["txt-compat"], "out": [out.path]],
+    flags: []
+  )
+  try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+
+  let blocks = try String(contentsOf: out, encoding: .utf8).components(separatedBy: "\n\n")
+  #expect(blocks.count == 3 && blocks[2].isEmpty)
+  let received = blocks[0].split(separator: "\n").map(String.init)
+  #expect(received.count == 4)
+  #expect(received[1...] == ["+123", "look at this", dir.appendingPathComponent("photo.png").path])
+  #expect(blocks[1].hasSuffix("\nMe\nnice & sunny"))
+
+  var renderer = TXTCompatRenderer(outputURL: out)
+  renderer.timeZone = try #require(TimeZone(identifier: "UTC"))
+  let date = try #require(ISO8601DateFormatter().date(from: "2022-05-17T17:29:42Z"))
+  #expect(renderer.timestamp(date) == "May 17, 2022  5:29:42 PM")
+  #expect(renderer.timestamp(date.addingTimeInterval(-17 * 3600)) == "May 17, 2022 12:29:42 AM")
+  #expect(TXTCompatRenderer.verb(for: .laugh) == "Laughed at")
+}
+
+@Test
+func exportLimitCountsOnlyMatchingMessages() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  let out = dir.appendingPathComponent("family.jsonl")
+  func export(match: String) async throws -> [String] {
+    let values = ParsedValues(
+      positional: [],
+      options: [
+        "db": [path], "chatID": ["1"], "format": ["jsonl"], "out": [out.path],
+        "limit": ["1"], "match": [match],
+      ],
+      flags: []
+    )
+    try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+    return try String(contentsOf: out, encoding: .utf8).split(separator: "\n").map {
+      try JSONDecoder().decode(MessagePayload.self, from: Data($0.utf8)).text
+    }
+  }
+
+  // The newest message, "nice & sunny", doesn't match; the limit still finds the older one.
+  #expect(try await export(match: "look") == ["look at this"])
+  // Matched by its attachment's name rather than its text.
+  #expect(try await export(match: "photo\\.png$") == ["look at this"])
+}
+
+@Test
+func exportJSONLEmbedsSmallAttachments() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  let out = dir.appendingPathComponent("family.jsonl")
+  func export(maxSize: String) async throws -> [MessagePayload] {
+    let values = ParsedValues(
+      positional: [],
+      options: [
+        "db": [path], "chatID": ["1"], "format": ["jsonl"], "out": [out.path],
+        "embedMaxSize": [maxSize],
+      ],
+      flags: ["embedAttachments"]
+    )
+    try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+    return try String(contentsOf: out, encoding: .utf8).split(separator: "\n").map {
+      try JSONDecoder().decode(MessagePayload.self, from: Data($0.utf8))
+    }
+  }
+
+  let embedded = try await export(maxSize: "1KB")
+  #expect(embedded.map(\.text) == ["look at this", "nice & sunny"])
+  let photo = try #require(embedded.first?.attachments.first)
+  #expect(photo.mimeType == "image/png")
+  #expect(photo.data == Data([0x89, 0x50, 0x4E, 0x47]).base64EncodedString())
+  #expect(try await export(maxSize: "2").first?.attachments.first?.data == nil)
+
+  let values = ParsedValues(
+    positional: [], options: ["db": [path], "chatID": ["1"], "format": ["txt-compat"]],
+    flags: ["embedAttachments"])
+  await #expect(throws: ParsedValuesError.self) {
+    try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+  }
+}
+
+@Test
+func exportPDFPaginatesBubblesAndNamesAttachments() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  // Long enough to run over several pages.
+  let long = Array(repeating: "The quick brown fox jumps over the lazy dog.", count: 400)
+    .joined(separator: " ")
+  try fake.addMessage(chatID: 1, text: long, sender: "+456", date: Date().addingTimeInterval(1))
+  let out = dir.appendingPathComponent("family.pdf")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "chatID": ["1"], "format": ["pdf"], "out": [out.path]],
+    flags: []
+  )
+  try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+
+  let document = try #require(PDFDocument(url: out))
+  #expect(document.pageCount >= 3)
+  let text = document.string ?? ""
+  #expect(text.contains("Family <3"))
+  #expect(text.contains("look at this"))
+  #expect(text.contains("nice & sunny"))
+  // The fixture's photo.png is four bytes ImageIO can't decode, so it is named instead.
+  #expect(text.contains("[image: photo.png]"))
+  #expect(text.contains("Page 3"))
+  let partial = dir.appendingPathComponent(".family.pdf.partial")
+  #expect(!FileManager.default.fileExists(atPath: partial.path))
+}
+
+@Test
+func exportWritesManifestAndReportsDrift() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  let out = dir.appendingPathComponent("family.jsonl")
+  let manifestURL = dir.appendingPathComponent("family.jsonl.manifest.json")
+  // Keeps a write in chat.db-wal, as Messages does between checkpoints.
+  try fake.execute("PRAGMA journal_mode=WAL; CREATE TABLE wal_probe (x INTEGER);")
+  defer { withExtendedLifetime(fake) {} }
+  func export(manifest: Bool = true, redact: Bool = false) async throws -> ExportManifest? {
+    var options = ["db": [path], "chatID": ["1"], "format": ["jsonl"], "out": [out.path]]
+    if redact {
+      options["redact"] = ["phone"]
+    }
+    let values = ParsedValues(
+      positional: [], options: options,
+      flags: manifest ? ["jsonOutput", "manifest"] : ["jsonOutput"]
+    )
+    try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+    return ExportManifest.load(from: manifestURL)
+  }
+
+  #expect(try await export(manifest: false) == nil)
+  let first = try #require(try await export())
+  #expect(first.format == "jsonl")
+  #expect(first.generator == "imsg \(IMsgVersion.current)")
+  let source = try ExportManifest.checksum(of: URL(fileURLWithPath: path))
+  #expect(first.source.sha256 == source.sha256)
+  let wal = try ExportManifest.checksum(of: URL(fileURLWithPath: path + "-wal"))
+  #expect(first.source.walSHA256 == wal.sha256 && first.source.walBytes == wal.bytes)
+  #expect(first.chats == 1 && first.messages == 2 && first.attachments == 1)
+  let file = try #require(first.files.first)
+  #expect(first.files.count == 1 && file.path == "family.jsonl" && file.chatIDs == [1])
+  #expect(file.sha256 == (try ExportManifest.checksum(of: out)).sha256)
+  #expect(
+    file.attachments.first?.sha256
+      == "0f4636c78f65d3639ece5a064b5ae753e3408614a14fb18ab4d7540d2c248543")
+  #expect(file.attachments.first?.path?.hasSuffix("photo.png") == true)
+  #expect(first.drift.isEmpty)
+
+  try Data("tampered\n".utf8).write(to: out)
+  let second = try #require(try await export())
+  #expect(second.drift.map(\.path) == ["family.jsonl"])
+  #expect(second.drift.first?.expected == file.sha256)
+  #expect(second.files.first?.sha256 == file.sha256)
+
+  let redacted = try #require(try await export(redact: true))
+  let attachment = try #require(redacted.files.first?.attachments.first)
+  #expect(attachment.path == nil && attachment.sha256 == file.attachments.first?.sha256)
+}
+
+@Test
+func attachmentsCommandCopiesIntoLayoutWithIndex() throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  let out = dir.appendingPathComponent("files")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "out": [out.path], "layout": ["chat"]],
+    flags: []
+  )
+  try AttachmentsCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+  let copied = out.appendingPathComponent("1 Family <3/photo.png")
+  #expect(FileManager.default.contents(atPath: copied.path) == Data([0x89, 0x50, 0x4E, 0x47]))
+  let index = try String(contentsOf: out.appendingPathComponent("index.csv"), encoding: .utf8)
+    .split(separator: "\n").map(String.init)
+  #expect(index.count == 2)
+  #expect(index[0] == AttachmentsCommand.indexHeader.joined(separator: ","))
+  #expect(index[1].hasPrefix("1 Family <3/photo.png,1,"))
+  #expect(index[1].contains(",+123,0,"))
+
+  // A second run finds the file in place instead of copying it again.
+  try AttachmentsCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+  let folder = out.appendingPathComponent("1 Family <3")
+  #expect(try FileManager.default.contentsOfDirectory(atPath: folder.path) == ["photo.png"])
+  #expect(
+    try String(contentsOf: out.appendingPathComponent("index.csv"), encoding: .utf8)
+      .split(separator: "\n").count == 2)
+
+  // Rows from earlier runs survive; rows for the same path are replaced in place.
+  let indexURL = out.appendingPathComponent("index.csv")
+  let merged = try AttachmentsCommand.mergedIndex(
+    at: indexURL,
+    with: [("1 Family <3/photo.png", "1 Family <3/photo.png,9"), ("2 x/a.png", "2 x/a.png,2")])
+  #expect(merged == ["1 Family <3/photo.png,9", "2 x/a.png,2"])
+  try Data("path\n\"old, \"\"quoted\"\".png\",5\n".utf8).write(to: indexURL)
+  try AttachmentsCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+  let rows = try String(contentsOf: indexURL, encoding: .utf8).split(separator: "\n")
+  #expect(rows.count == 3)
+  #expect(rows[1] == "\"old, \"\"quoted\"\".png\",5")
+  #expect(rows[2].hasPrefix("1 Family <3/photo.png,1,"))
+
+  let other = dir.appendingPathComponent("other.png")
+  try Data([1, 2, 3]).write(to: other)
+  let (renamed, isNew) = try AttachmentsCommand.copy(other, into: folder, name: "photo.png")
+  #expect(isNew && renamed.lastPathComponent == "photo (2).png")
+
+  var calendar = Calendar(identifier: .gregorian)
+  calendar.timeZone = try #require(TimeZone(identifier: "UTC"))
+  let message = Message(
+    rowID: 1, chatID: 1, sender: "+123", text: "", date: Date(timeIntervalSince1970: 1_740_000_000),
+    isFromMe: false, service: "iMessage", handleID: nil, attachmentsCount: 1)
+  let chat = ChatInfo(id: 1, identifier: "a/b", guid: "", name: "", service: "iMessage")
+  #expect(AttachmentLayout.date.folder(for: message, chat: chat, calendar: calendar) == "2025/02")
+  #expect(AttachmentLayout.chat.folder(for: message, chat: chat, calendar: calendar) == "1 a-b")
+}
+
+@Test
+func exportWithoutChatIDWritesEveryChatConcurrently() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  let oneToOne = try fake.addChat(identifier: "+456", participants: ["+456"])
+  try fake.addMessage(chatID: oneToOne, text: "just us", sender: "+456")
+  let out = dir.appendingPathComponent("all")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "format": ["txt-compat"], "out": [out.path], "jobs": ["2"]],
+    flags: ["quiet"]
+  )
+  try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+
+  let family = try String(contentsOf: out.appendingPathComponent("chat-1.txt"), encoding: .utf8)
+  let direct = try String(contentsOf: out.appendingPathComponent("chat-2.txt"), encoding: .utf8)
+  #expect(family.contains("look at this") && !family.contains("just us"))
+  #expect(direct.contains("just us") && !direct.contains("look at this"))
+
+  let bad = ParsedValues(
+    positional: [], options: ["db": [path], "out": [out.path], "jobs": ["0"]], flags: [])
+  await #expect(throws: ParsedValuesError.self) {
+    try await ExportCommand.run(values: bad, runtime: RuntimeOptions(parsedValues: bad))
+  }
+}
+
+@Test
+func exportProgressJSONReportsEachChatAndTotals() throws {
+  var lines: [String] = []
+  let progress = ExportProgress(mode: .json, chats: 1) { lines.append($0) }
+  progress.start(chatID: 7, title: "Family", total: 3)
+  progress.advance(chatID: 7, by: 2)
+  progress.finish(chatID: 7)
+  progress.summary(chats: 1, messages: 2, failed: 0, seconds: 1.23)
+
+  let decoder = JSONDecoder()
+  let events = try lines.dropLast().map {
+    try decoder.decode(ExportProgress.Event.self, from: Data($0.utf8))
+  }
+  #expect(events.map(\.event) == ["start", "progress", "done"])
+  #expect(events.map(\.messages) == [0, 2, 2])
+  #expect(events.allSatisfy { $0.chatID == 7 && $0.total == 3 })
+  let summary = try decoder.decode(
+    ExportProgress.Summary.self, from: Data(try #require(lines.last).utf8))
+  #expect(summary.event == "summary" && summary.messages == 2 && summary.seconds == 1.2)
+
+  var quiet: [String] = []
+  let silent = ExportProgress(mode: .none, chats: 1) { quiet.append($0) }
+  silent.start(chatID: 7, title: "Family", total: nil)
+  silent.finish(chatID: 7)
+  #expect(quiet.isEmpty)
+}
+
+@Test
+func emlQuotedPrintableEncodesUTF8AndWrapsLongLines() {
+  #expect(EMLRenderer.quotedPrintable("café = ok ") == "caf=C3=A9 =3D ok=20")
+  let wrapped = EMLRenderer.quotedPrintable(String(repeating: "a", count: 100))
+  #expect(wrapped.components(separatedBy: "=\r\n").map(\.count) == [75, 25])
+  #expect(EMLRenderer.encodedWord("Trip ✈️").hasPrefix("=?UTF-8?B?"))
+  #expect(EMLRenderer.address(for: "bob@example.com") == "<bob@example.com>")
+  #expect(EMLRenderer.me(account: "p:+15550000000") == "Me <+15550000000@imessage.invalid>")
+}
+
+@Test
+func exportRejectsUnknownFormat() async throws {
+  let values = ParsedValues(
+    positional: [],
+    options: ["chatID": ["1"], "format": ["docx"]],
+    flags: []
+  )
+  do {
+    try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+    #expect(Bool(false))
+  } catch let error as ParsedValuesError {
+    #expect(error.description.contains("--format"))
+  }
+}
+
+@Test
+func htmlEscapeEscapesMarkup() {
+  #expect(
+    htmlEscape("<a href=\"x\">'&'</a>")
+      == "&lt;a href=&quot;x&quot;&gt;&#39;&amp;&#39;&lt;/a&gt;")
+}
+
+@Test
+func exportSQLiteWritesDocumentedPortableArchive() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  // The reply resends the same photo, which the archive should store once.
+  try fake.addAttachment(
+    FakeAttachment(
+      path: dir.appendingPathComponent("photo.png").path, transferName: "again.png",
+      mimeType: "image/png", uti: "public.png", totalBytes: 4),
+    to: 2)
+  let out = dir.appendingPathComponent("archive.db")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "format": ["sqlite"], "out": [out.path]],
+    flags: ["blobs"]
+  )
+  try await ExportCommand.run(values: values, runtime: RuntimeOptions(parsedValues: values))
+
+  let archive = try Connection(out.path, readonly: true)
+  let version = try archive.scalar("SELECT value FROM meta WHERE key = 'format_version'")
+  #expect(version as? String == "2")
+  #expect(try archive.scalar("SELECT name FROM chats WHERE id = 1") as? String == "Family <3")
+  #expect(try archive.scalar("SELECT COUNT(*) FROM chat_participants") as? Int64 == 2)
+  let rows = try archive.prepare(
+    """
+    SELECT m.text, m.is_from_me, h.address FROM messages m
+    LEFT JOIN handles h ON h.id = m.sender_handle_id ORDER BY m.sent_at_unix
+    """
+  ).map { [$0[0] as? String, ($0[1] as? Int64).map(String.init), $0[2] as? String] }
+  #expect(rows == [["look at this", "0", "+123"], ["nice & sunny", "1", nil]])
+  let blob = try archive.scalar(
+    """
+    SELECT b.data FROM attachments a JOIN blobs b ON b.sha256 = a.blob_sha256
+    WHERE a.message_id = 1
+    """) as? Blob
+  #expect(blob?.bytes == [0x89, 0x50, 0x4E, 0x47])
+  #expect(try archive.scalar("SELECT COUNT(*) FROM blobs") as? Int64 == 1)
+  #expect(try archive.scalar("SELECT ref_count FROM blobs") as? Int64 == 2)
+  #expect(
+    try archive.scalar("SELECT COUNT(DISTINCT blob_sha256) FROM attachments") as? Int64 == 1)
+  let documented = try archive.scalar(
+    "SELECT COUNT(*) FROM schema_doc WHERE table_name = 'messages' AND column_name IS NOT NULL")
+  #expect(documented as? Int64 == 10)
+}
+
+@Test
+func exportSplitSinceLastOnlyRewritesPeriodsWithNewMessages() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  let march = try #require(
+    Calendar.current.date(from: DateComponents(year: 2020, month: 3, day: 15, hour: 12)))
+  try fake.addMessage(chatID: 1, text: "long ago", sender: "+123", date: march)
+  let stateFile = dir.appendingPathComponent("state/export.json")
+  let out = dir.appendingPathComponent("chat.html")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "chatID": ["1"], "split": ["monthly"], "out": [out.path]],
+    flags: ["sinceLast"]
+  )
+  func export() async throws {
+    try await ExportCommand.run(
+      values: values, runtime: RuntimeOptions(parsedValues: values),
+      cursorFactory: { try RowCursorStore(databasePath: $0, fileURL: stateFile) })
+  }
+
+  try await export()
+  let marchURL = dir.appendingPathComponent("chat-2020-03.html")
+  let currentURL = ExportSplit.monthly.url(
+    for: ExportSplit.monthly.period(containing: Date()), base: out)
+  #expect(try String(contentsOf: marchURL, encoding: .utf8).contains("long ago"))
+  #expect(try String(contentsOf: currentURL, encoding: .utf8).contains("nice &amp; sunny"))
+
+  // Nothing new: existing files are left alone.
+  try FileManager.default.removeItem(at: currentURL)
+  try await export()
+  #expect(!FileManager.default.fileExists(atPath: currentURL.path))
+
+  // A late March message rewrites March in full and nothing else.
+  try fake.addMessage(chatID: 1, text: "replying late", date: march.addingTimeInterval(60))
+  try await export()
+  let html = try String(contentsOf: marchURL, encoding: .utf8)
+  #expect(html.contains("long ago") && html.contains("replying late"))
+  #expect(!FileManager.default.fileExists(atPath: currentURL.path))
+}
+
+@Test
+func exportSinceLastWithoutSplitKeepsTheArchiveComplete() async throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let path = fake.path
+  let stateFile = dir.appendingPathComponent("state/export.json")
+  let out = dir.appendingPathComponent("archive.db")
+  let values = ParsedValues(
+    positional: [],
+    options: ["db": [path], "chatID": ["1"], "format": ["sqlite"], "out": [out.path]],
+    flags: ["sinceLast"]
+  )
+  func export() async throws -> Int64? {
+    try await ExportCommand.run(
+      values: values, runtime: RuntimeOptions(parsedValues: values),
+      cursorFactory: { try RowCursorStore(databasePath: $0, fileURL: stateFile) })
+    return try Connection(out.path, readonly: true).scalar("SELECT COUNT(*) FROM messages")
+      as? Int64
+  }
+
+  let first = try #require(try await export())
+  #expect(first > 0)
+  #expect(try await export() == first)
+  try fake.addMessage(chatID: 1, text: "one more", sender: "+123")
+  #expect(try await export() == first + 1)
+}
+
+@Test
+func partialFileSwapsInOnlyFinishedWrites() throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let out = dir.appendingPathComponent("chat.txt")
+  let partial = PartialFile.url(for: out)
+  #expect(partial.lastPathComponent == ".chat.txt.partial")
+  try "old".write(to: out, atomically: true, encoding: .utf8)
+
+  #expect(throws: CocoaError.self) {
+    try PartialFile.stream(to: out) { handle -> Int in
+      handle.write(Data("half".utf8))
+      throw CocoaError(.fileWriteUnknown)
+    }
+  }
+  #expect(try String(contentsOf: out, encoding: .utf8) == "old")
+  #expect(!FileManager.default.fileExists(atPath: partial.path))
+
+  let skipped = try PartialFile.stream(to: out, keep: { $0 > 0 }) { _ in 0 }
+  #expect(skipped == 0)
+  #expect(try String(contentsOf: out, encoding: .utf8) == "old")
+
+  try PartialFile.stream(to: out) { handle in handle.write(Data("new".utf8)) }
+  #expect(try String(contentsOf: out, encoding: .utf8) == "new")
+  #expect(!FileManager.default.fileExists(atPath: partial.path))
+}
+
+@Test
+func exportPDFKeepsBubblesThatDoNotFitAPage() throws {
+  let dir = try ExportTestDatabase.makeDirectory()
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let fake = try ExportTestDatabase.make(in: dir)
+  let store = try fake.makeStore()
+  let chat = try #require(try store.chatInfo(chatID: 1))
+  let export = try ChatExport.load(store: store, chat: chat, limit: nil, filter: MessageFilter())
+  let out = dir.appendingPathComponent("tiny.pdf")
+  // Too short for a single line of text between the margins.
+  let renderer = PDFRenderer(outputURL: out, pageSize: CGSize(width: 320, height: 110))
+  #expect(try renderer.write(export) == 2)
+
+  let text = try #require(PDFDocument(url: out)).string ?? ""
+  #expect(text.contains("look at this"))
+  #expect(text.contains("nice & sunny"))
+}
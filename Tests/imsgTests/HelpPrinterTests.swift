@@ -33,3 +33,20 @@ func helpPrinterPrintsCommandDetails() throws {
   #expect(output.contains("-o, --opt <value>"))
   #expect(output.contains("-f, --flag"))
 }
+
+@Test
+func helpPrinterSkipsHiddenCommands() {
+  let visible = CommandSpec(
+    name: "chats", abstract: "List chats", discussion: nil,
+    signature: CommandSignature(), usageExamples: []
+  ) { _, _ in }
+  let hidden = CommandSpec(
+    name: "bench", abstract: "Benchmark", discussion: nil,
+    signature: CommandSignature(), usageExamples: [], isHidden: true
+  ) { _, _ in }
+
+  let output = HelpPrinter.renderRoot(version: "1.0", rootName: "imsg", commands: [visible, hidden])
+    .joined(separator: "\n")
+  #expect(output.contains("chats"))
+  #expect(!output.contains("bench"))
+}
@@ -112,6 +112,7 @@ func messagePayloadOmitsEmptyReplyToGuid() {
   )
   #expect(payload["reply_to_guid"] == nil)
   #expect(payload["guid"] as? String == "msg-guid-6")
+  #expect(payload["language"] == nil)
 }
 
 @Test
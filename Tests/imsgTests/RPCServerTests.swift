@@ -1,4 +1,5 @@
 import Foundation
+import IMsgTesting
 import SQLite
 import Testing
 
@@ -76,6 +77,16 @@ private enum RPCTestDatabase {
     return try MessageStore(
       connection: db, path: ":memory:", hasAttributedBody: false, hasReactionColumns: false)
   }
+
+  /// Group chat 1 ("Group Chat", +123 and me@icloud.com) holding one "hello" from +123.
+  static func make() throws -> FakeChatDatabase {
+    let fake = try FakeChatDatabase()
+    let chat = try fake.addChat(
+      identifier: "iMessage;+;chat123", guid: "iMessage;+;chat123", name: "Group Chat",
+      participants: ["+123", "me@icloud.com"])
+    try fake.addMessage(chatID: chat, text: "hello", sender: "+123")
+    return fake
+  }
 }
 
 final class TestRPCOutput: RPCOutput, @unchecked Sendable {
@@ -119,7 +130,7 @@ private func int64Value(_ value: Any?) -> Int64? {
 func rpcChatsListReturnsChatPayload() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line = #"{"jsonrpc":"2.0","id":"1","method":"chats.list","params":{"limit":10}}"#
   await server.handleLineForTesting(line)
@@ -139,7 +150,7 @@ func rpcChatsListReturnsChatPayload() async throws {
 func rpcMessagesHistoryIncludesChatFields() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line =
     #"{"jsonrpc":"2.0","id":2,"method":"messages.history","params":{"chat_id":1,"limit":5}}"#
@@ -161,7 +172,6 @@ func rpcSendResolvesChatID() async throws {
   var captured: MessageSendOptions?
   let server = RPCServer(
     store: store,
-    verbose: false,
     output: output,
     sendMessage: { options in captured = options }
   )
@@ -179,7 +189,7 @@ func rpcSendResolvesChatID() async throws {
 func rpcSendRejectsMissingTextAndFile() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line = #"{"jsonrpc":"2.0","id":"4","method":"send","params":{"to":"+15551234567"}}"#
   await server.handleLineForTesting(line)
@@ -193,7 +203,7 @@ func rpcSendRejectsMissingTextAndFile() async throws {
 func rpcRejectsInvalidJSON() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   await server.handleLineForTesting("not-json")
 
@@ -205,7 +215,7 @@ func rpcRejectsInvalidJSON() async throws {
 func rpcRejectsNonObjectRequest() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   await server.handleLineForTesting("[]")
 
@@ -217,7 +227,7 @@ func rpcRejectsNonObjectRequest() async throws {
 func rpcRejectsInvalidJSONRPCVersion() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line = #"{"jsonrpc":"1.0","id":1,"method":"chats.list"}"#
   await server.handleLineForTesting(line)
@@ -230,7 +240,7 @@ func rpcRejectsInvalidJSONRPCVersion() async throws {
 func rpcRejectsMissingMethod() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line = #"{"jsonrpc":"2.0","id":1}"#
   await server.handleLineForTesting(line)
@@ -243,7 +253,7 @@ func rpcRejectsMissingMethod() async throws {
 func rpcReportsMethodNotFound() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line = #"{"jsonrpc":"2.0","id":1,"method":"nope"}"#
   await server.handleLineForTesting(line)
@@ -256,7 +266,7 @@ func rpcReportsMethodNotFound() async throws {
 func rpcHistoryRequiresChatID() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line = #"{"jsonrpc":"2.0","id":5,"method":"messages.history","params":{"limit":5}}"#
   await server.handleLineForTesting(line)
@@ -269,7 +279,7 @@ func rpcHistoryRequiresChatID() async throws {
 func rpcSendRejectsInvalidService() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line =
     #"{"jsonrpc":"2.0","id":6,"method":"send","params":{"to":"+15551234567","text":"hi","service":"fax"}}"#
@@ -283,7 +293,7 @@ func rpcSendRejectsInvalidService() async throws {
 func rpcSendRejectsMissingRecipientForDirectSend() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line = #"{"jsonrpc":"2.0","id":7,"method":"send","params":{"text":"hi"}}"#
   await server.handleLineForTesting(line)
@@ -296,7 +306,7 @@ func rpcSendRejectsMissingRecipientForDirectSend() async throws {
 func rpcSendRejectsChatAndRecipient() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line =
     #"{"jsonrpc":"2.0","id":8,"method":"send","params":{"chat_id":1,"to":"+15551234567","text":"hi"}}"#
@@ -310,7 +320,7 @@ func rpcSendRejectsChatAndRecipient() async throws {
 func rpcSendRejectsUnknownChatID() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line = #"{"jsonrpc":"2.0","id":9,"method":"send","params":{"chat_id":999,"text":"hi"}}"#
   await server.handleLineForTesting(line)
@@ -323,7 +333,7 @@ func rpcSendRejectsUnknownChatID() async throws {
 func rpcWatchSubscribeEmitsNotificationAndUnsubscribe() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let subscribe =
     #"{"jsonrpc":"2.0","id":10,"method":"watch.subscribe","params":{"chat_id":1,"since_rowid":-1}}"#
@@ -349,11 +359,41 @@ func rpcWatchSubscribeEmitsNotificationAndUnsubscribe() async throws {
   #expect(output.responses.count >= 2)
 }
 
+@Test
+func rpcWatchSubscriptionsShareOneWatchWithTheirOwnFilters() async throws {
+  let fake = try RPCTestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  let output = TestRPCOutput()
+  let server = RPCServer(store: store, output: output)
+
+  await server.handleLineForTesting(
+    #"{"jsonrpc":"2.0","id":20,"method":"watch.subscribe","params":{"chat_ids":[1],"since_rowid":-1}}"#
+  )
+  await server.handleLineForTesting(
+    #"{"jsonrpc":"2.0","id":21,"method":"watch.subscribe","params":{"chat_id":2,"since_rowid":-1}}"#
+  )
+  let subscriptions = output.responses.compactMap {
+    int64Value(($0["result"] as? [String: Any])?["subscription"])
+  }
+  #expect(subscriptions.count == 2)
+
+  for _ in 0..<20 {
+    if output.notifications.count >= 1 { break }
+    try await Task.sleep(nanoseconds: 50_000_000)
+  }
+  try await Task.sleep(nanoseconds: 100_000_000)
+  let notified = output.notifications.compactMap {
+    int64Value(($0["params"] as? [String: Any])?["subscription"])
+  }
+  #expect(notified == [subscriptions[0]])
+}
+
 @Test
 func rpcWatchUnsubscribeRequiresSubscription() async throws {
   let store = try RPCTestDatabase.makeStore()
   let output = TestRPCOutput()
-  let server = RPCServer(store: store, verbose: false, output: output)
+  let server = RPCServer(store: store, output: output)
 
   let line = #"{"jsonrpc":"2.0","id":12,"method":"watch.unsubscribe","params":{}}"#
   await server.handleLineForTesting(line)
@@ -361,3 +401,69 @@ func rpcWatchUnsubscribeRequiresSubscription() async throws {
   let error = output.errors.first?["error"] as? [String: Any]
   #expect(int64Value(error?["code"]) == -32602)
 }
+
+@Test
+func rpcWarmUpPreloadsRecentChatsAndMessages() async throws {
+  let fake = try RPCTestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  let warmUp = RPCWarmUp(
+    store: store, cache: ChatCache(store: store), chatLimit: 10, messageLimit: 5)
+  let (chats, messages) = try warmUp.run()
+  #expect(chats == 1)
+  #expect(messages == min(5, try store.messages(chatID: 1, limit: 100).count))
+  #expect(messages > 0)
+
+  let chatsOnly = RPCWarmUp(
+    store: store, cache: ChatCache(store: store), chatLimit: 10, messageLimit: 0)
+  #expect(try chatsOnly.run().messages == 0)
+  let disabled = RPCWarmUp(
+    store: store, cache: ChatCache(store: store), chatLimit: 0, messageLimit: 5)
+  #expect(try disabled.run().chats == 0)
+}
+
+@Test
+func mcpServerListsToolsAndForwardsCallsToRPCMethods() async throws {
+  let fake = try RPCTestDatabase.make()
+  defer { fake.remove() }
+  let store = try fake.makeStore()
+  let output = TestRPCOutput()
+  var captured: MessageSendOptions?
+  let server = MCPServer(
+    store: store, output: output, sendMessage: { captured = $0 })
+
+  await server.handleLineForTesting(
+    #"{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2024-11-05"}}"#)
+  await server.handleLineForTesting(#"{"jsonrpc":"2.0","method":"notifications/initialized"}"#)
+  await server.handleLineForTesting(#"{"jsonrpc":"2.0","id":2,"method":"tools/list"}"#)
+  let initialize = output.responses[0]["result"] as? [String: Any]
+  #expect(initialize?["protocolVersion"] as? String == "2024-11-05")
+  let tools = (output.responses[1]["result"] as? [String: Any])?["tools"] as? [[String: Any]]
+  #expect(tools?.compactMap { $0["name"] as? String }.contains("get_history") == true)
+
+  await server.handleLineForTesting(
+    #"{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"get_history","arguments":{"chat_id":1}}}"#
+  )
+  let history = output.responses[2]["result"] as? [String: Any]
+  #expect(history?["isError"] as? Bool == false)
+  let structured = history?["structuredContent"] as? [String: Any]
+  #expect((structured?["messages"] as? [[String: Any]])?.count == 1)
+  let content = (history?["content"] as? [[String: Any]])?.first?["text"] as? String
+  #expect(content?.contains("\"hello\"") == true)
+
+  await server.handleLineForTesting(
+    #"{"jsonrpc":"2.0","id":4,"method":"tools/call","params":{"name":"send_message","arguments":{"chat_id":1,"text":"yo"}}}"#
+  )
+  #expect(captured?.chatGUID == "iMessage;+;chat123")
+
+  await server.handleLineForTesting(
+    #"{"jsonrpc":"2.0","id":5,"method":"tools/call","params":{"name":"send_message","arguments":{}}}"#
+  )
+  let failed = output.responses[4]["result"] as? [String: Any]
+  #expect(failed?["isError"] as? Bool == true)
+
+  await server.handleLineForTesting(
+    #"{"jsonrpc":"2.0","id":6,"method":"tools/call","params":{"name":"nope"}}"#)
+  #expect(output.errors.count == 1)
+  #expect(output.notifications.isEmpty)
+}
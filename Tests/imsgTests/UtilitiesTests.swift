@@ -15,6 +15,16 @@ func durationParserHandlesUnits() {
   #expect(DurationParser.parse("bad") == nil)
 }
 
+@Test
+func byteSizeParserHandlesUnits() {
+  #expect(ByteSizeParser.parse("100MB") == 100 * 1024 * 1024)
+  #expect(ByteSizeParser.parse("512kb") == 512 * 1024)
+  #expect(ByteSizeParser.parse("1.5G") == 1_610_612_736)
+  #expect(ByteSizeParser.parse("2048") == 2048)
+  #expect(ByteSizeParser.parse("0MB") == nil)
+  #expect(ByteSizeParser.parse("big") == nil)
+}
+
 @Test
 func attachmentDisplayPrefersTransferName() {
   let meta = AttachmentMeta(
@@ -111,6 +121,9 @@ func outputModelsEncodeExpectedKeys() throws {
   #expect(messageObject?["guid"] as? String == "msg-guid-7")
   #expect(messageObject?["reply_to_guid"] as? String == "msg-guid-1")
   #expect(messageObject?["created_at"] != nil)
+  #expect(messageObject?["sender_region"] == nil)
+  #expect(displayHandle("+442079460018") == "🇬🇧 +442079460018")
+  #expect(displayHandle("+123") == "+123")
 
   let attachmentPayload = AttachmentPayload(meta: attachment)
   let attachmentData = try JSONEncoder().encode(attachmentPayload)
@@ -144,3 +157,376 @@ func parsedValuesHelpers() throws {
   #expect(runtime.verbose == true)
   #expect(runtime.logLevel == "debug")
 }
+
+@Test
+func runtimeOptionsMapAutomationLogLevel() {
+  let verboseOnly = RuntimeOptions(
+    parsedValues: ParsedValues(positional: [], options: [:], flags: ["verbose"]))
+  #expect(verboseOnly.automationLogLevel == .debug)
+  let trace = RuntimeOptions(
+    parsedValues: ParsedValues(positional: [], options: ["logLevel": ["trace"]], flags: []))
+  #expect(trace.automationLogLevel == .trace)
+  let quiet = RuntimeOptions(parsedValues: ParsedValues(positional: [], options: [:], flags: []))
+  #expect(quiet.automationLogLevel == .error)
+}
+
+@Test
+func runtimeOptionsLogJSONToRotatingFile() throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  defer { try? FileManager.default.removeItem(at: dir) }
+  let path = dir.appendingPathComponent("imsg.log").path
+  let runtime = RuntimeOptions(
+    parsedValues: ParsedValues(
+      positional: [], options: ["logFile": [path]], flags: ["logJSON", "verbose"]))
+  runtime.automationLogger.log(.debug, "query failed", fields: ["chat_id": "7"])
+  let line = try String(contentsOfFile: path, encoding: .utf8)
+  let object = try JSONSerialization.jsonObject(with: Data(line.utf8)) as? [String: String]
+  #expect(object?["level"] == "debug")
+  #expect(object?["msg"] == "query failed")
+  #expect(object?["chat_id"] == "7")
+  #expect(object?["time"] != nil)
+
+  let file = LogFile(path: path, maxBytes: 64, keep: 2)
+  for index in 0..<6 {
+    file.write(String(repeating: "\(index)", count: 40))
+  }
+  let rotated = try FileManager.default.contentsOfDirectory(atPath: dir.path).sorted()
+  #expect(rotated == ["imsg.log", "imsg.log.1", "imsg.log.2"])
+  #expect(try String(contentsOfFile: path, encoding: .utf8).hasPrefix("5555"))
+}
+
+@Test
+func databasePathRejectsDbWithBackup() {
+  let plain = ParsedValues(positional: [], options: ["db": ["/tmp/chat.db"]], flags: [])
+  #expect(try CommandSignatures.databasePath(from: plain) == "/tmp/chat.db")
+  let both = ParsedValues(
+    positional: [],
+    options: ["db": ["/tmp/chat.db"], "dbBackup": ["/tmp/backup"]],
+    flags: []
+  )
+  #expect(throws: ParsedValuesError.self) {
+    try CommandSignatures.databasePath(from: both)
+  }
+  let user = ParsedValues(positional: [], options: ["user": ["imsg-nobody"]], flags: [])
+  #expect(
+    try CommandSignatures.databasePath(from: user).hasSuffix("/Library/Messages/chat.db"))
+  let userAndDB = ParsedValues(
+    positional: [], options: ["user": ["imsg-nobody"], "db": ["/tmp/chat.db"]], flags: [])
+  #expect(throws: ParsedValuesError.self) {
+    try CommandSignatures.databasePath(from: userAndDB)
+  }
+}
+
+@Test
+func timestampFormatterAppliesZoneAndStyles() throws {
+  let date = Date(timeIntervalSince1970: 1_735_700_400)  // 2025-01-01T03:00:00Z
+  let vienna = try TimestampFormatter.from(
+    values: ParsedValues(
+      positional: [], options: ["tz": ["Europe/Vienna"], "timeFormat": ["%Y-%m-%d %H:%M h"]],
+      flags: []))
+  #expect(vienna.format(date) == "2025-01-01 04:00 h")
+
+  let utc = try TimestampFormatter.from(
+    values: ParsedValues(positional: [], options: [:], flags: []))
+  #expect(utc.format(date) == "2025-01-01T03:00:00.000Z")
+
+  let unix = TimestampFormatter(style: .unix)
+  #expect(unix.format(date) == "1735700400")
+
+  let relative = TimestampFormatter(
+    style: .relative, locale: Locale(identifier: "en_US"), now: { date.addingTimeInterval(120) })
+  #expect(relative.format(date) == "2 minutes ago")
+
+  #expect(throws: ParsedValuesError.self) {
+    try TimestampFormatter.from(
+      values: ParsedValues(positional: [], options: ["tz": ["Mars/Olympus"]], flags: []))
+  }
+  #expect(TimestampFormatter.style(named: "fancy") == nil)
+  #expect(TimestampFormatter.dateFormat(fromStrftime: "%H:%M o'clock") == "HH:mm' o''clock'")
+}
+
+@Test
+func outputTemplateParsesFieldsAndRejectsUnknown() throws {
+  let template = try OutputTemplate(
+    "{{.Date}} {{ .Sender }}: {{.Text}}!", fields: OutputTemplate.messageFields)
+  #expect(template.fields == ["Date", "Sender", "Text"])
+  let rendered = template.render { "<\($0)>" }
+  #expect(rendered == "<Date> <Sender>: <Text>!")
+
+  #expect(throws: ParsedValuesError.self) {
+    try OutputTemplate("{{.Nope}}", fields: OutputTemplate.messageFields)
+  }
+  #expect(throws: ParsedValuesError.self) {
+    try OutputTemplate("{{.Text", fields: OutputTemplate.messageFields)
+  }
+  #expect(throws: ParsedValuesError.self) {
+    try OutputTemplate("{{.Chat.Name}}", fields: OutputTemplate.chatFields)
+  }
+}
+
+@Test
+func sharedLocationAttachmentRendersInTextAndJSON() throws {
+  let dir = FileManager.default.temporaryDirectory.appendingPathComponent(UUID().uuidString)
+  try FileManager.default.createDirectory(at: dir, withIntermediateDirectories: true)
+  let file = dir.appendingPathComponent("Ferry Building.loc.vcf")
+  try """
+  BEGIN:VCARD
+  FN:Ferry Building
+  item1.URL:https://maps.apple.com/?ll=37.7955\\,-122.3937&q=Ferry%20Building
+  END:VCARD
+  """.write(to: file, atomically: true, encoding: .utf8)
+  let attachment = AttachmentMeta(
+    filename: file.path,
+    transferName: "Ferry Building.loc.vcf",
+    uti: "public.vcard",
+    mimeType: "text/vcard",
+    totalBytes: 120,
+    isSticker: false,
+    originalPath: file.path,
+    missing: false
+  )
+  let message = Message(
+    rowID: 8, chatID: 1, sender: "+123", text: "\u{FFFC}", date: Date(timeIntervalSince1970: 1),
+    isFromMe: false, service: "iMessage", handleID: nil, attachmentsCount: 1)
+
+  #expect(
+    displayText(for: message, attachments: [attachment])
+      == "[location: 37.7955,-122.3937 Ferry Building]")
+  let data = try JSONEncoder().encode(MessagePayload(message: message, attachments: [attachment]))
+  let object = try JSONSerialization.jsonObject(with: data) as? [String: Any]
+  let location = object?["location"] as? [String: Any]
+  #expect(location?["latitude"] as? Double == 37.7955)
+  #expect(location?["name"] as? String == "Ferry Building")
+
+  let plain = AttachmentMeta(
+    filename: "photo.jpg", transferName: "photo.jpg", uti: "public.jpeg", mimeType: "image/jpeg",
+    totalBytes: 1, isSticker: false, originalPath: "/tmp/photo.jpg", missing: false)
+  #expect(displayText(for: message, attachments: [plain]) == "\u{FFFC}")
+  let plainData = try JSONEncoder().encode(MessagePayload(message: message, attachments: [plain]))
+  let plainObject = try JSONSerialization.jsonObject(with: plainData) as? [String: Any]
+  #expect(plainObject?["location"] == nil)
+}
+
+@Test
+func drawnMessagesRenderPlaceholderAndKind() throws {
+  let asset = AttachmentMeta(
+    filename: "~/Library/Messages/Attachments/ab/HandwrittenNote.png", transferName: "",
+    uti: "public.png", mimeType: "image/png", totalBytes: 10, isSticker: false,
+    originalPath: "/Users/me/Library/Messages/Attachments/ab/HandwrittenNote.png", missing: false)
+  let handwriting = Message(
+    rowID: 9, chatID: 1, sender: "+123", text: "\u{FFFC}", date: Date(timeIntervalSince1970: 1),
+    isFromMe: false, service: "iMessage", handleID: nil, attachmentsCount: 1,
+    app: AppMessageInfo(
+      bundleID: "com.apple.Handwriting.HandwritingProvider", name: "Handwriting"))
+
+  #expect(
+    displayText(for: handwriting, attachments: [asset]) == "[Handwriting: \(asset.originalPath)]")
+  let data = try JSONEncoder().encode(MessagePayload(message: handwriting, attachments: [asset]))
+  let object = try JSONSerialization.jsonObject(with: data) as? [String: Any]
+  #expect(object?["kind"] as? String == "handwriting")
+  #expect(object?["asset_path"] as? String == asset.originalPath)
+
+  let touch = AttachmentMeta(
+    filename: "DigitalTouch-1.mov", transferName: "DigitalTouch-1.mov",
+    uti: "com.apple.quicktime-movie", mimeType: "video/quicktime", totalBytes: 10,
+    isSticker: false, originalPath: "/tmp/dt.mov", missing: true)
+  #expect(DrawnMessageKind.detect(bundleID: nil, attachments: [touch]) == .digitalTouch)
+  #expect(DrawnMessageKind.detect(bundleID: "com.apple.messages.URLBalloonProvider") == nil)
+  let plain = Message(
+    rowID: 10, chatID: 1, sender: "+123", text: "hi", date: Date(timeIntervalSince1970: 1),
+    isFromMe: false, service: "iMessage", handleID: nil, attachmentsCount: 0)
+  let plainData = try JSONEncoder().encode(MessagePayload(message: plain, attachments: []))
+  #expect(String(decoding: plainData, as: UTF8.self).contains("\"kind\"") == false)
+}
+
+@Test
+func chatPickerFiltersFuzzilyAndHandlesKeys() {
+  let date = Date(timeIntervalSince1970: 0)
+  let chats = [
+    Chat(id: 1, identifier: "+15551234567", name: "Mom", service: "iMessage", lastMessageAt: date),
+    Chat(
+      id: 2, identifier: "chat42", name: "Climbing Crew", service: "iMessage", lastMessageAt: date),
+    Chat(
+      id: 3, identifier: "ann@example.com", name: "Ann", service: "iMessage", lastMessageAt: date),
+  ]
+  #expect(ChatPicker.filter(chats, query: "").map(\.id) == [1, 2, 3])
+  #expect(ChatPicker.filter(chats, query: "ccw").map(\.id) == [2])
+  #expect(ChatPicker.filter(chats, query: "n").map(\.id) == [3, 2])
+  #expect(ChatPicker.filter(chats, query: "5551").map(\.id) == [1])
+  #expect(ChatPicker.filter(chats, query: "zzz").isEmpty)
+
+  var state = ChatPicker.State(chats: chats)
+  #expect(state.handle(.down) == nil)
+  #expect(state.handle(.down) == nil)
+  #expect(state.handle(.down) == nil)
+  #expect(state.selection == 2)
+  #expect(state.handle(.character("c")) == nil)
+  #expect(state.selection == 0)
+  #expect(state.handle(.enter) == .some(chats[1]))
+  #expect(state.handle(.cancel) == .some(nil))
+
+  #expect(
+    ChatPicker.decodeKeys(Array("a\u{1b}[B\u{7f}é\r".utf8))
+      == [.character("a"), .down, .backspace, .character("é"), .enter])
+  #expect(ChatPicker.decodeKeys([0x1b]) == [.cancel])
+}
+
+@Test
+func tabularFormatQuotesCSVAndEscapesTSV() throws {
+  let fields = ["7", "Ann, Bo", "say \"hi\"", "two\nlines", "a\tb\\c"]
+  #expect(
+    TabularFormat.csv.line(fields)
+      == "7,\"Ann, Bo\",\"say \"\"hi\"\"\",\"two\nlines\",a\tb\\c")
+  #expect(TabularFormat.tsv.line(fields) == "7\tAnn, Bo\tsay \"hi\"\ttwo\\nlines\ta\\tb\\\\c")
+
+  let runtime = RuntimeOptions(parsedValues: ParsedValues(positional: [], options: [:], flags: []))
+  let values = ParsedValues(positional: [], options: ["format": ["TSV"]], flags: [])
+  #expect(try TabularFormat.from(values: values, runtime: runtime) == .tsv)
+  #expect(
+    try TabularFormat.from(
+      values: ParsedValues(positional: [], options: [:], flags: []), runtime: runtime) == nil)
+  #expect(throws: ParsedValuesError.self) {
+    try TabularFormat.from(
+      values: ParsedValues(positional: [], options: ["format": ["xlsx"]], flags: []),
+      runtime: runtime)
+  }
+  let json = RuntimeOptions(
+    parsedValues: ParsedValues(positional: [], options: [:], flags: ["jsonOutput"]))
+  #expect(throws: ParsedValuesError.self) {
+    try TabularFormat.from(values: values, runtime: json)
+  }
+}
+
+@Test
+func conversationContextKeepsNewestTurnsWithinBudget() {
+  func message(_ rowID: Int64, _ text: String, fromMe: Bool, attachments: Int = 0) -> Message {
+    Message(
+      rowID: rowID, chatID: 1, sender: fromMe ? "" : "+15551234567", text: text,
+      date: Date(timeIntervalSince1970: Double(rowID)), isFromMe: fromMe, service: "iMessage",
+      handleID: nil, attachmentsCount: attachments)
+  }
+  // Newest first, as MessageStore returns them.
+  let messages = [
+    message(4, "see you at 7", fromMe: true),
+    message(3, "\u{FFFC}", fromMe: false, attachments: 1),
+    message(2, "dinner tonight?", fromMe: false),
+    message(1, String(repeating: "old news ", count: 40), fromMe: true),
+  ]
+  let context = ConversationContext(messages: messages, isGroup: false, tokens: 22)
+  #expect(context.turns.map(\.content) == ["dinner tonight?", "[attachment]", "see you at 7"])
+  #expect(context.estimatedTokens == 22)
+  #expect(context.render(.plain) == "them: dinner tonight?\nthem: [attachment]\nme: see you at 7")
+  #expect(context.render(.chatml).hasPrefix("<|im_start|>user\ndinner tonight?<|im_end|>\n"))
+  #expect(context.render(.chatml).hasSuffix("<|im_start|>assistant\nsee you at 7<|im_end|>"))
+
+  let group = ConversationContext(messages: Array(messages.prefix(3)), isGroup: true, tokens: 100)
+  #expect(group.render(.plain).hasPrefix("them (+15551234567): dinner tonight?"))
+
+  let tight = ConversationContext(messages: Array(messages.suffix(1)), isGroup: false, tokens: 8)
+  #expect(tight.turns.count == 1)
+  #expect(tight.turns[0].content.hasPrefix("…"))
+  #expect(tight.turns[0].content.count == 17)
+}
+
+@Test
+func watchStatsCountMessagesPerChatAndSender() throws {
+  let start = Date(timeIntervalSince1970: 1_700_000_000)
+  let tracker = ActivityTracker(start: start, topSenderLimit: 2)
+  for (chatID, sender, isFromMe) in [
+    (Int64(2), "+123", false), (2, "+123", false), (1, "", true), (2, "+456", false),
+    (1, "+789", false),
+  ] {
+    tracker.record(
+      Message(
+        rowID: 1, chatID: chatID, sender: sender, text: "hi", date: start, isFromMe: isFromMe,
+        service: "iMessage", handleID: nil, attachmentsCount: 0))
+  }
+  let snapshot = tracker.snapshot(at: start.addingTimeInterval(120))
+  #expect(snapshot.messages == 5)
+  #expect(snapshot.chats.map(\.chatID) == [2, 1])
+  #expect(snapshot.chats.map(\.perMinute) == [1.5, 1])
+  #expect(snapshot.topSenders.map(\.sender) == ["+123", "+456"])
+  #expect(
+    WatchCommand.statsLine(for: snapshot, timestamps: TimestampFormatter(style: .unix))
+      == "-- stats 1700000000 to 1700000120: 5 messages; chat 2 1.50/min, chat 1 1.00/min; "
+      + "top senders +123 (2), +456 (1) --")
+  let payload = try JSONLines.encode(WatchStatsPayload(snapshot: snapshot))
+  #expect(payload.contains(#""top_senders":[{"sender":"+123","messages":2}"#))
+
+  let quiet = tracker.snapshot(at: start.addingTimeInterval(180))
+  #expect(quiet.start == snapshot.end)
+  #expect(quiet.messages == 0 && quiet.chats.isEmpty)
+}
+
+@Test
+func outputLabelsTranslateAndRightToLeftTextIsIsolated() throws {
+  let hebrew = ParsedValues(positional: [], options: ["lang": ["he_IL"]], flags: [])
+  let labels = try OutputLabels.from(values: hebrew)
+  #expect(labels.direction(isFromMe: true) == "נשלחה")
+  let none = ParsedValues(positional: [], options: [:], flags: [])
+  #expect(try OutputLabels.from(values: none) == .english)
+  let unknown = ParsedValues(positional: [], options: ["lang": ["xx"]], flags: [])
+  #expect(throws: ParsedValuesError.self) { try OutputLabels.from(values: unknown) }
+  #expect(try TimestampFormatter.from(values: hebrew).locale.identifier == "he_IL")
+
+  #expect(bidiIsolated("hello") == "hello")
+  #expect(bidiIsolated("שלום, 3 cats") == "\u{2068}שלום, 3 cats\u{2069}")
+  #expect(bidiIsolated("مرحبا") == "\u{2068}مرحبا\u{2069}")
+  #expect(OutputLabels.english.attachmentCount(1) == "  (1 attachment)")
+
+  let meta = AttachmentMeta(
+    filename: "/tmp/x", transferName: "תמונה.jpg", uti: "public.jpeg", mimeType: "image/jpeg",
+    totalBytes: 1, isSticker: false, originalPath: "/tmp/x", missing: true)
+  #expect(
+    attachmentLine(for: meta, labels: try OutputLabels.from(values: hebrew)).hasPrefix(
+      "  קובץ מצורף: name=\u{2068}תמונה.jpg\u{2069} "))
+}
+
+@Test
+func compactTranscriptGroupsRunsAndInlinesTapbacks() {
+  let start = Date(timeIntervalSince1970: 1_735_700_400)  // 2025-01-01T03:00:00Z
+  func message(_ rowID: Int64, _ text: String, from sender: String?, minutes: Double) -> Message {
+    Message(
+      rowID: rowID, chatID: 1, sender: sender ?? "", text: text,
+      date: start.addingTimeInterval(minutes * 60), isFromMe: sender == nil,
+      service: "iMessage", handleID: nil, attachmentsCount: 0)
+  }
+  let heart = Reaction(
+    rowID: 90, reactionType: .love, sender: "", isFromMe: true, date: start, associatedMessageID: 2)
+  let like = Reaction(
+    rowID: 91, reactionType: .like, sender: "ana@example.com", isFromMe: false, date: start,
+    associatedMessageID: 2)
+  var transcript = CompactTranscript(timestamps: TimestampFormatter(style: .custom("%H:%M")))
+  var lines: [String] = []
+  for (next, reactions) in [
+    (message(1, "hey", from: "ana@example.com", minutes: 0), []),
+    (message(2, "are you around?", from: "ana@example.com", minutes: 1), [heart, like]),
+    (message(3, "yes", from: nil, minutes: 2), []),
+    (message(4, "back now", from: nil, minutes: 120), []),
+  ] as [(Message, [Reaction])] {
+    lines += transcript.lines(for: next, attachments: [], reactions: reactions)
+  }
+  #expect(
+    lines == [
+      "ana@example.com · 03:00", "  hey", "  are you around?  ❤️ me, 👍 ana@example.com",
+      "me · 03:02", "  yes", "me · 05:00", "  back now",
+    ])
+}
+
+
+@Test
+func textTruncationKeepsGraphemeClustersWhole() throws {
+  let family = "👨\u{200D}👩\u{200D}👧"
+  #expect(TextTruncation.truncate("hi \(family) there", to: 5) == "hi \(family)…")
+  #expect(TextTruncation.truncate("🇯🇵🇺🇸🇫🇷", to: 2) == "🇯🇵…")
+  #expect(TextTruncation.truncate("大大大大", to: 3) == "大大…")
+  #expect(TextTruncation.truncate("👍🏽👍🏽", to: 2) == "👍🏽👍🏽")
+  #expect(TextTruncation.truncate("line one\r\nline two", to: 40) == "line one line two")
+  #expect(TextTruncation.truncate("trailing space here", to: 10) == "trailing…")
+  #expect(TextTruncation.truncate("abc", to: 1) == "…")
+
+  let values = ParsedValues(positional: [], options: ["truncate": ["0"]], flags: [])
+  #expect(throws: ParsedValuesError.self) { try TextTruncation.limit(from: values) }
+  let unset = ParsedValues(positional: [], options: [:], flags: [])
+  #expect(try TextTruncation.limit(from: unset) == nil)
+}
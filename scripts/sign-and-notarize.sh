@@ -9,6 +9,7 @@ CODESIGN_IDENTITY=${CODESIGN_IDENTITY:-"Developer ID Application: Peter Steinber
 ENTITLEMENTS="${ROOT}/Resources/imsg.entitlements"
 OUTPUT_DIR="${OUTPUT_DIR:-/tmp}"
 ZIP_PATH="${OUTPUT_DIR}/imsg-macos.zip"
+CHECKSUM_PATH="${ZIP_PATH}.sha256"
 ARCHES_VALUE=${ARCHES:-"arm64 x86_64"}
 ARCH_LIST=( ${ARCHES_VALUE} )
 DIST_DIR="$(mktemp -d "/tmp/${APP_NAME}-dist.XXXXXX")"
@@ -27,21 +28,25 @@ fi
 
 echo "$APP_STORE_CONNECT_API_KEY_P8" | sed 's/\\n/\n/g' > "$API_KEY_FILE"
 
+# The send helper ships next to imsg for `send --backend native`.
+PRODUCTS=(imsg imsg-send-helper)
 for ARCH in "${ARCH_LIST[@]}"; do
-  swift build -c release --product imsg --arch "$ARCH"
+  for PRODUCT in "${PRODUCTS[@]}"; do
+    swift build -c release --product "$PRODUCT" --arch "$ARCH"
+  done
 done
 
-BINARIES=()
-for ARCH in "${ARCH_LIST[@]}"; do
-  BINARIES+=("$ROOT/.build/${ARCH}-apple-macosx/release/imsg")
+for PRODUCT in "${PRODUCTS[@]}"; do
+  BINARIES=()
+  for ARCH in "${ARCH_LIST[@]}"; do
+    BINARIES+=("$ROOT/.build/${ARCH}-apple-macosx/release/${PRODUCT}")
+  done
+  lipo -create "${BINARIES[@]}" -output "$DIST_DIR/${PRODUCT}"
+  codesign --force --timestamp --options runtime --sign "$CODESIGN_IDENTITY" \
+    --entitlements "$ENTITLEMENTS" \
+    "$DIST_DIR/${PRODUCT}"
 done
 
-lipo -create "${BINARIES[@]}" -output "$DIST_DIR/imsg"
-
-codesign --force --timestamp --options runtime --sign "$CODESIGN_IDENTITY" \
-  --entitlements "$ENTITLEMENTS" \
-  "$DIST_DIR/imsg"
-
 FIRST_ARCH="${ARCH_LIST[0]}"
 for bundle in "$ROOT/.build/${FIRST_ARCH}-apple-macosx/release"/*.bundle; do
   if [[ -e "$bundle" ]]; then
@@ -65,9 +70,17 @@ xcrun notarytool submit "$ZIP_PATH" \
   --issuer "$APP_STORE_CONNECT_ISSUER_ID" \
   --wait
 
-codesign --verify --strict --verbose=4 "$DIST_DIR/imsg"
+for PRODUCT in "${PRODUCTS[@]}"; do
+  codesign --verify --strict --verbose=4 "$DIST_DIR/${PRODUCT}"
+done
 if ! spctl -a -t exec -vv "$DIST_DIR/imsg"; then
   echo "spctl check failed (CLI binaries often report 'not an app')." >&2
 fi
 
-echo "Done: $ZIP_PATH"
+# `imsg selfupdate` refuses a release without this file.
+(
+  cd "$(dirname "$ZIP_PATH")"
+  shasum -a 256 "$(basename "$ZIP_PATH")" > "$CHECKSUM_PATH"
+)
+
+echo "Done: $ZIP_PATH ($CHECKSUM_PATH)"